@@ -1,4 +1,9 @@
-if [ $# -ne 1 ]; then
+if [ "$1" = "--debug" ]; then
+    mv "$2" code.cpp
+    clang++ -g -O0 code.cpp
+    chmod 700 a.out
+    gdb -q ./a.out
+elif [ $# -ne 1 ]; then
     cling
 else
     mv "$1" code.cpp
@@ -0,0 +1,6 @@
+if ($args.Count -ne 1) {
+    powershell -NoLogo
+} else {
+    Copy-Item $args[0] C:\code.ps1
+    & C:\code.ps1
+}
@@ -0,0 +1,11 @@
+# start a throwaway server with its data dir on the tmpfs
+export PGDATA=/data/pg
+initdb -A trust > /dev/null
+pg_ctl -w -s -o "-c listen_addresses=''" start > /dev/null
+
+if [ $# -ne 1 ]; then
+    psql -q
+else
+    sh /seed.sh
+    psql -q -f "$1"
+fi
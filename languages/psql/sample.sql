@@ -0,0 +1,23 @@
+CREATE TABLE departments (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL
+);
+
+CREATE TABLE employees (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    department_id INTEGER REFERENCES departments(id),
+    salary INTEGER NOT NULL
+);
+
+INSERT INTO departments (id, name) VALUES
+    (1, 'Engineering'),
+    (2, 'Sales'),
+    (3, 'Support');
+
+INSERT INTO employees (id, name, department_id, salary) VALUES
+    (1, 'Alice', 1, 120000),
+    (2, 'Bob', 1, 95000),
+    (3, 'Carol', 2, 70000),
+    (4, 'Dave', 2, 65000),
+    (5, 'Eve', 3, 55000);
@@ -0,0 +1,5 @@
+# wait for the server to accept connections, then load the sample schema
+until pg_isready -q; do
+    sleep 0.1
+done
+psql -q -v ON_ERROR_STOP=1 -f /sample.sql > /dev/null
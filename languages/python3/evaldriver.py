@@ -0,0 +1,32 @@
+# openrepl eval driver: reads one JSON request per line on stdin and writes one JSON result per line on stdout
+import ast
+import contextlib
+import io
+import json
+import sys
+import traceback
+
+namespace = {"__name__": "__main__"}
+
+for line in sys.stdin:
+    req = json.loads(line)
+    res = {}
+    out, err = io.StringIO(), io.StringIO()
+    with contextlib.redirect_stdout(out), contextlib.redirect_stderr(err):
+        try:
+            # evaluate the final expression separately to report its value
+            tree = ast.parse(req["code"], "<cell>", "exec")
+            last = None
+            if tree.body and isinstance(tree.body[-1], ast.Expr):
+                last = ast.Expression(tree.body.pop().value)
+            exec(compile(tree, "<cell>", "exec"), namespace)
+            if last is not None:
+                value = eval(compile(last, "<cell>", "eval"), namespace)
+                if value is not None:
+                    res["value"] = repr(value)
+        except BaseException:
+            res["error"] = traceback.format_exc()
+    res["stdout"] = out.getvalue()
+    res["stderr"] = err.getvalue()
+    sys.__stdout__.write(json.dumps(res) + "\n")
+    sys.__stdout__.flush()
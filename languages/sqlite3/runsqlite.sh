@@ -0,0 +1,6 @@
+if [ $# -ne 1 ]; then
+    sqlite3 /data/sample.db
+else
+    sqlite3 /data/sample.db < /sample.sql
+    sqlite3 /data/sample.db < "$1"
+fi
@@ -0,0 +1,233 @@
+// Package client is a client of the openrepl server.
+// Sessions speak the openrepl.v3 websocket protocol, in which every message is a JSON envelope.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol is the websocket subprotocol spoken by the client.
+const Protocol = "openrepl.v3"
+
+// Mode is the kind of a session.
+type Mode string
+
+const (
+	// ModeRun runs a program to completion.
+	ModeRun Mode = "run"
+
+	// ModeTerm starts an interactive terminal.
+	ModeTerm Mode = "term"
+)
+
+// Client is a client of an openrepl server.
+type Client struct {
+	// URL is the base URL of the server (e.g. "https://repl.example.com").
+	URL string
+
+	// Token is the bearer token sent to servers which require authentication.
+	// If empty, no credentials are sent.
+	Token string
+
+	// Dialer is the dialer of websocket connections.
+	// If nil, websocket.DefaultDialer is used.
+	Dialer *websocket.Dialer
+
+	// HTTPClient is the client of plain HTTP requests.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// Options are the options of a session.
+type Options struct {
+	// Lang is the name of the language.
+	Lang string
+
+	// Version is the version of the language (e.g. "3.12").
+	// If empty, the default version is used.
+	Version string
+
+	// Args are the command line arguments of a run.
+	Args []string
+
+	// Env is a set of environment variables of the program, which must be allowed by the server.
+	Env map[string]string
+
+	// Streams is whether a run is executed without a terminal, so that stdout and stderr are kept apart.
+	// The exit status of a run is only reported in this mode.
+	Streams bool
+
+	// Query is a set of extra query parameters selecting session options (e.g. "deterministic").
+	Query url.Values
+}
+
+// query generates the query parameters of the session.
+func (o Options) query() url.Values {
+	q := url.Values{}
+	for k, v := range o.Query {
+		q[k] = append([]string(nil), v...)
+	}
+	q.Set("lang", o.Lang)
+	if o.Version != "" {
+		q.Set("version", o.Version)
+	}
+	if len(o.Args) > 0 {
+		q["arg"] = o.Args
+	}
+	env := make([]string, 0, len(o.Env))
+	for k, v := range o.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	if len(env) > 0 {
+		q["env"] = env
+	}
+	if o.Streams {
+		q.Set("streams", "true")
+	}
+	return q
+}
+
+// HTTPError is an error response of the server to a request.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (he *HTTPError) Error() string {
+	if he.Message == "" {
+		return fmt.Sprintf("openrepl: server returned %d %s", he.StatusCode, http.StatusText(he.StatusCode))
+	}
+	return fmt.Sprintf("openrepl: server returned %d: %s", he.StatusCode, he.Message)
+}
+
+// httpError converts an error response to an *HTTPError.
+func httpError(resp *http.Response) error {
+	dat, _ := ioutil.ReadAll(resp.Body)
+	return &HTTPError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(dat))}
+}
+
+// endpoint returns the URL of a path on the server, with the scheme switched to ws or wss for websocket connections.
+func (c *Client) endpoint(path string, q url.Values, ws bool) (string, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "", err
+	}
+	if ws {
+		switch u.Scheme {
+		case "http":
+			u.Scheme = "ws"
+		case "https":
+			u.Scheme = "wss"
+		}
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// header returns the headers sent with every request.
+func (c *Client) header() http.Header {
+	hdr := http.Header{}
+	if c.Token != "" {
+		hdr.Set("Authorization", "Bearer "+c.Token)
+	}
+	return hdr
+}
+
+// Connect starts a session, which ends when the context is cancelled.
+func (c *Client) Connect(ctx context.Context, mode Mode, opts Options) (*Session, error) {
+	u, err := c.endpoint("/"+string(mode), opts.query(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	// dial through the context
+	d := websocket.DefaultDialer
+	if c.Dialer != nil {
+		d = c.Dialer
+	}
+	dialer := *d
+	dialer.Subprotocols = []string{Protocol}
+	netDial := d.NetDial
+	dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		if netDial != nil {
+			return netDial(network, addr)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	conn, resp, err := dialer.Dial(u, c.header())
+	if err == websocket.ErrBadHandshake && resp != nil {
+		return nil, httpError(resp)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if conn.Subprotocol() != Protocol {
+		conn.Close()
+		return nil, errors.New("openrepl: server does not support protocol " + Protocol)
+	}
+	return newSession(ctx, conn), nil
+}
+
+// Terminal starts an interactive terminal session.
+func (c *Client) Terminal(ctx context.Context, opts Options) (*Session, error) {
+	return c.Connect(ctx, ModeTerm, opts)
+}
+
+// Language is the description of a language available on the server.
+type Language struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name"`
+	Extension   string   `json:"extension,omitempty"`
+	Version     string   `json:"version,omitempty"`
+	Example     string   `json:"example,omitempty"`
+	Deprecated  bool     `json:"deprecated,omitempty"`
+	Message     string   `json:"message,omitempty"`
+	Versions    []string `json:"versions,omitempty"`
+}
+
+// Languages lists the languages available on the server.
+func (c *Client) Languages(ctx context.Context) ([]Language, error) {
+	u, err := c.endpoint("/languages", nil, false)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.header()
+	cli := c.HTTPClient
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	resp, err := cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpError(resp)
+	}
+	var langs []Language
+	err = json.NewDecoder(resp.Body).Decode(&langs)
+	if err != nil {
+		return nil, err
+	}
+	return langs, nil
+}
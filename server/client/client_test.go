@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeServer is a server speaking the openrepl.v3 protocol, which runs a session handler for each connection.
+type fakeServer struct {
+	t       *testing.T
+	handler func(*fakeConn)
+
+	// query and header are those of the last connection.
+	query  url.Values
+	header http.Header
+}
+
+func (fs *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/languages" {
+		json.NewEncoder(w).Encode([]Language{{Name: "python3", DisplayName: "Python 3", Versions: []string{"3.11", "3.12"}}})
+		return
+	}
+	if r.URL.Query().Get("lang") == "missing" {
+		http.Error(w, "language not found", http.StatusNotFound)
+		return
+	}
+	fs.query, fs.header = r.URL.Query(), r.Header
+	u := websocket.Upgrader{Subprotocols: []string{Protocol}}
+	conn, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		fs.t.Errorf("failed to upgrade: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	fs.handler(&fakeConn{t: fs.t, conn: conn})
+}
+
+// fakeConn is the server side of a connection.
+type fakeConn struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func (fc *fakeConn) send(typ string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		fc.t.Fatal(err)
+	}
+	err = fc.conn.WriteJSON(envelope{Type: typ, Payload: payload})
+	if err != nil {
+		fc.t.Errorf("failed to send %s: %s", typ, err.Error())
+	}
+}
+
+func (fc *fakeConn) status(st Status) {
+	fc.send("status", st)
+}
+
+// recv receives the next envelope of the client.
+func (fc *fakeConn) recv() envelope {
+	var env envelope
+	err := fc.conn.ReadJSON(&env)
+	if err != nil {
+		fc.t.Errorf("failed to receive: %s", err.Error())
+	}
+	return env
+}
+
+// data decodes the data of a payload.
+func (fc *fakeConn) data(env envelope) string {
+	var dp dataPayload
+	err := json.Unmarshal(env.Payload, &dp)
+	if err != nil {
+		fc.t.Errorf("invalid %s payload: %s", env.Type, err.Error())
+	}
+	return string(dp.Data)
+}
+
+func (fc *fakeConn) close() {
+	fc.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+func newFakeServer(t *testing.T, handler func(*fakeConn)) (*fakeServer, *httptest.Server) {
+	fs := &fakeServer{t: t, handler: handler}
+	return fs, httptest.NewServer(fs)
+}
+
+func TestRunCode(t *testing.T) {
+	code := int64(3)
+	fs, hs := newFakeServer(t, func(fc *fakeConn) {
+		fc.status(Status{Status: "starting", Session: "abc"})
+		fc.status(Status{Status: "ready"})
+		env := fc.recv()
+		if env.Type != "code" || fc.data(env) != "print(input())" {
+			t.Errorf("expected code message, got %s %q", env.Type, env.Payload)
+		}
+		fc.status(Status{Status: "running"})
+		env = fc.recv()
+		if env.Type != "stdin" || fc.data(env) != "hello\n" {
+			t.Errorf("expected stdin message, got %s %q", env.Type, env.Payload)
+		}
+		if env = fc.recv(); env.Type != "eof" {
+			t.Errorf("expected eof message, got %s", env.Type)
+		}
+		fc.send("stdout", dataPayload{Data: []byte("hello\n")})
+		fc.send("stderr", dataPayload{Data: []byte("warning\n")})
+		fc.status(Status{Status: "exit", ExitCode: &code, Duration: 0.5})
+		fc.close()
+	})
+	defer hs.Close()
+
+	c := &Client{URL: hs.URL, Token: "secret"}
+	var stdout, stderr bytes.Buffer
+	res, err := c.RunCode(context.Background(), Options{
+		Lang:    "python3",
+		Version: "3.12",
+		Args:    []string{"-v"},
+		Env:     map[string]string{"B": "2", "A": "1"},
+		Streams: true,
+	}, []byte("print(input())"), strings.NewReader("hello\n"), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("run failed: %s", err.Error())
+	}
+	if stdout.String() != "hello\n" || stderr.String() != "warning\n" {
+		t.Errorf("unexpected output %q and %q", stdout.String(), stderr.String())
+	}
+	if res.Session != "abc" || res.ExitCode == nil || *res.ExitCode != 3 || res.Duration != 0.5 || len(res.Statuses) != 4 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	expect := url.Values{
+		"lang":    {"python3"},
+		"version": {"3.12"},
+		"arg":     {"-v"},
+		"env":     {"A=1", "B=2"},
+		"streams": {"true"},
+	}
+	if !reflect.DeepEqual(fs.query, expect) {
+		t.Errorf("expected query %v, got %v", expect, fs.query)
+	}
+	if auth := fs.header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("expected bearer token, got %q", auth)
+	}
+}
+
+func TestRunCodeFailure(t *testing.T) {
+	_, hs := newFakeServer(t, func(fc *fakeConn) {
+		fc.status(Status{Status: "starting", Session: "abc"})
+		fc.status(Status{Status: "capacity", Error: "timed out waiting for capacity", Code: "capacity"})
+		fc.close()
+	})
+	defer hs.Close()
+
+	c := &Client{URL: hs.URL}
+	_, err := c.RunCode(context.Background(), Options{Lang: "python3"}, []byte("print(1)"), nil, nil, nil)
+	se, ok := err.(*StatusError)
+	if !ok {
+		t.Fatalf("expected status error, got %v", err)
+	}
+	if se.Status.Code != "capacity" || se.Error() != "openrepl: timed out waiting for capacity (capacity)" {
+		t.Errorf("unexpected error %+v", se.Status)
+	}
+}
+
+func TestConnectHTTPError(t *testing.T) {
+	_, hs := newFakeServer(t, nil)
+	defer hs.Close()
+
+	c := &Client{URL: hs.URL}
+	_, err := c.Connect(context.Background(), ModeRun, Options{Lang: "missing"})
+	he, ok := err.(*HTTPError)
+	if !ok {
+		t.Fatalf("expected HTTP error, got %v", err)
+	}
+	if he.StatusCode != http.StatusNotFound || he.Message != "language not found" {
+		t.Errorf("unexpected error %+v", he)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	_, hs := newFakeServer(t, func(fc *fakeConn) {
+		fc.status(Status{Status: "starting", Session: "abc"})
+		env := fc.recv()
+		var rp resizePayload
+		if env.Type != "resize" || json.Unmarshal(env.Payload, &rp) != nil || rp != (resizePayload{Cols: 80, Rows: 24}) {
+			t.Errorf("expected resize message, got %s %q", env.Type, env.Payload)
+		}
+		env = fc.recv()
+		var sp signalPayload
+		if env.Type != "signal" || json.Unmarshal(env.Payload, &sp) != nil || sp.Signal != "SIGINT" {
+			t.Errorf("expected signal message, got %s %q", env.Type, env.Payload)
+		}
+		fc.send("stdout", dataPayload{Data: []byte("$ ")})
+		fc.send("notebook", map[string]string{"op": "restart"})
+		fc.close()
+	})
+	defer hs.Close()
+
+	c := &Client{URL: hs.URL}
+	s, err := c.Terminal(context.Background(), Options{Lang: "bash"})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer s.Close()
+	msg, err := s.Recv()
+	if err != nil || msg.Status == nil || msg.Status.Status != "starting" || s.ID() != "abc" {
+		t.Fatalf("expected starting status, got %+v (%v)", msg, err)
+	}
+	if err = s.Resize(80, 24); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Signal("SIGINT"); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = s.Recv()
+	if err != nil || msg.Type != "stdout" || string(msg.Data) != "$ " {
+		t.Fatalf("expected output, got %+v (%v)", msg, err)
+	}
+	msg, err = s.Recv()
+	if err != nil || msg.Type != "notebook" || string(msg.Data) != `{"op":"restart"}` {
+		t.Fatalf("expected raw message, got %+v (%v)", msg, err)
+	}
+	if _, err = s.Recv(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	_, hs := newFakeServer(t, func(fc *fakeConn) {
+		fc.status(Status{Status: "starting", Session: "abc"})
+		fc.conn.ReadMessage()
+	})
+	defer hs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{URL: hs.URL}
+	s, err := c.Terminal(ctx, Options{Lang: "bash"})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer s.Close()
+	if _, err = s.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err = s.Recv(); err != context.Canceled {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	_, hs := newFakeServer(t, nil)
+	defer hs.Close()
+
+	c := &Client{URL: hs.URL + "/"}
+	langs, err := c.Languages(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Language{{Name: "python3", DisplayName: "Python 3", Versions: []string{"3.11", "3.12"}}}
+	if !reflect.DeepEqual(langs, expect) {
+		t.Errorf("expected %+v, got %+v", expect, langs)
+	}
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"io"
+)
+
+// Result is the result of a run.
+type Result struct {
+	// Session is the ID of the session of the run.
+	Session string
+
+	// ExitCode is the exit status of the program, which is only reported for runs with separate streams.
+	ExitCode *int64
+
+	// Duration is the run time of the program in seconds, which is only reported for runs with separate streams.
+	Duration float64
+
+	// Statuses are the status updates of the run, in order.
+	Statuses []Status
+}
+
+// RunCode runs code to completion, copying stdin to the program and its output to stdout and stderr.
+// If the session fails before the program runs, the failure is returned as a *StatusError.
+// Without separate streams, all output is written to stdout.
+func (c *Client) RunCode(ctx context.Context, opts Options, code []byte, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*Result, error) {
+	s, err := c.Connect(ctx, ModeRun, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	res := &Result{}
+	var failure *Status
+	running := false
+	err = s.Stream(stdout, stderr, func(st Status) error {
+		res.Statuses = append(res.Statuses, st)
+		switch {
+		case st.Status == "ready":
+			return s.SendCode(code)
+		case st.Status == "running" && !running:
+			running = true
+			if opts.Streams {
+				go copyInput(s, stdin)
+			} else if stdin != nil {
+				go io.Copy(s, stdin)
+			}
+		case st.Status == "exit":
+			res.ExitCode, res.Duration = st.ExitCode, st.Duration
+		case st.Error != "" && failure == nil:
+			failure = &st
+		}
+		return nil
+	})
+	res.Session = s.ID()
+	if err != nil {
+		return res, err
+	}
+	if !running {
+		if failure == nil {
+			failure = &Status{Status: "error", Error: "session ended before running", Session: res.Session}
+		}
+		return res, &StatusError{Status: *failure}
+	}
+	return res, nil
+}
+
+// copyInput copies the input of a program without a terminal, and then closes it.
+func copyInput(s *Session, stdin io.Reader) {
+	if stdin != nil {
+		_, err := io.Copy(s, stdin)
+		if err != nil {
+			return
+		}
+	}
+	s.CloseInput()
+}
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeTimeout is the time allowed for sending the close message when a session is closed.
+const closeTimeout = time.Second
+
+// Status is a status update sent by the server.
+type Status struct {
+	Status  string `json:"status"`
+	Error   string `json:"err,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Code identifies the kind of error, and DocsURL links to its documentation.
+	Code    string `json:"code,omitempty"`
+	DocsURL string `json:"docs_url,omitempty"`
+
+	// Session is the ID of the session, which is sent with the first status update.
+	Session string `json:"session,omitempty"`
+
+	// ResumeToken is the token with which a terminal may be reattached after losing its connection.
+	ResumeToken string `json:"resume_token,omitempty"`
+
+	// Position is the position of a queued session in the capacity queue.
+	Position int `json:"position,omitempty"`
+
+	// RetryAfter is the number of seconds after which a client over quota may start sessions again.
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// ExitCode and Duration are the exit status and the run time in seconds of a run with separate streams.
+	ExitCode *int64  `json:"exit_code,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+
+	// Raw is the complete status update, including the fields of specific session modes.
+	Raw json.RawMessage `json:"-"`
+}
+
+// StatusError is an error reported by the server in a status update.
+type StatusError struct {
+	Status Status
+}
+
+func (se *StatusError) Error() string {
+	if se.Status.Code != "" {
+		return fmt.Sprintf("openrepl: %s (%s)", se.Status.Error, se.Status.Code)
+	}
+	return "openrepl: " + se.Status.Error
+}
+
+// Message is a message received from the server.
+type Message struct {
+	// Type is the kind of message, which is "status", "stdout", "stderr", or a type specific to a session mode.
+	Type string
+
+	// Status is the update of a status message.
+	Status *Status
+
+	// Data is the output of stdout and stderr messages, or the raw payload of other messages.
+	Data []byte
+}
+
+// envelope is a message of the openrepl.v3 protocol.
+type envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// dataPayload is the payload of code, input and output messages.
+type dataPayload struct {
+	Data []byte `json:"data"`
+}
+
+// resizePayload is the payload of resize messages.
+type resizePayload struct {
+	Cols uint `json:"cols"`
+	Rows uint `json:"rows"`
+}
+
+// signalPayload is the payload of signal messages.
+type signalPayload struct {
+	Signal string `json:"signal"`
+}
+
+// Session is a session on the server.
+// Messages may be sent concurrently with Recv, which must only be called from one goroutine.
+type Session struct {
+	conn *websocket.Conn
+	ctx  context.Context
+
+	wlck sync.Mutex
+
+	lck sync.Mutex
+	id  string
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newSession starts a session over a connection, closing it when the context is cancelled.
+func newSession(ctx context.Context, conn *websocket.Conn) *Session {
+	s := &Session{conn: conn, ctx: ctx, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+// ID returns the ID of the session, once the server has sent it.
+func (s *Session) ID() string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.id
+}
+
+// send sends an envelope with a JSON-encoded payload.
+func (s *Session) send(typ string, v interface{}) error {
+	env := envelope{Type: typ}
+	if v != nil {
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		env.Payload = payload
+	}
+	dat, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	s.wlck.Lock()
+	defer s.wlck.Unlock()
+	return s.conn.WriteMessage(websocket.TextMessage, dat)
+}
+
+// SendCode sends the code of a run, once the server reports the "ready" status.
+func (s *Session) SendCode(code []byte) error {
+	return s.send("code", dataPayload{Data: code})
+}
+
+// Write sends input to the program.
+func (s *Session) Write(p []byte) (int, error) {
+	err := s.send("stdin", dataPayload{Data: p})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseInput ends the input of a program without a terminal.
+func (s *Session) CloseInput() error {
+	return s.send("eof", nil)
+}
+
+// Resize changes the size of the terminal.
+func (s *Session) Resize(cols uint, rows uint) error {
+	return s.send("resize", resizePayload{Cols: cols, Rows: rows})
+}
+
+// Signal sends a signal (e.g. "SIGINT") to the program.
+func (s *Session) Signal(sig string) error {
+	return s.send("signal", signalPayload{Signal: sig})
+}
+
+// Recv receives the next message from the server.
+// Returns io.EOF once the server has ended the session.
+func (s *Session) Recv() (Message, error) {
+	for {
+		t, dat, err := s.conn.ReadMessage()
+		switch {
+		case s.ctx.Err() != nil:
+			return Message{}, s.ctx.Err()
+		case websocket.IsCloseError(err, websocket.CloseNormalClosure):
+			return Message{}, io.EOF
+		case err != nil:
+			return Message{}, err
+		case t != websocket.TextMessage:
+			continue
+		}
+
+		var env envelope
+		err = json.Unmarshal(dat, &env)
+		if err != nil {
+			return Message{}, fmt.Errorf("openrepl: invalid message: %s", err.Error())
+		}
+		msg := Message{Type: env.Type}
+		switch env.Type {
+		case "status":
+			var st Status
+			err = json.Unmarshal(env.Payload, &st)
+			if err != nil {
+				return Message{}, fmt.Errorf("openrepl: invalid status: %s", err.Error())
+			}
+			st.Raw = env.Payload
+			if st.Session != "" {
+				s.lck.Lock()
+				s.id = st.Session
+				s.lck.Unlock()
+			}
+			msg.Status = &st
+		case "stdout", "stderr":
+			var dp dataPayload
+			err = json.Unmarshal(env.Payload, &dp)
+			if err != nil {
+				return Message{}, fmt.Errorf("openrepl: invalid %s payload: %s", env.Type, err.Error())
+			}
+			msg.Data = dp.Data
+		default:
+			msg.Data = env.Payload
+		}
+		return msg, nil
+	}
+}
+
+// Stream copies the output of the session to stdout and stderr until the session ends, passing status updates to the status callback.
+// Output without separate streams is sent to stdout, and a nil callback ignores status updates.
+// Stream stops with the error of the callback, if any.
+func (s *Session) Stream(stdout io.Writer, stderr io.Writer, status func(Status) error) error {
+	for {
+		msg, err := s.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case msg.Status != nil && status != nil:
+			err = status(*msg.Status)
+		case msg.Type == "stdout" && stdout != nil:
+			_, err = stdout.Write(msg.Data)
+		case msg.Type == "stderr" && stderr != nil:
+			_, err = stderr.Write(msg.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the session.
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wlck.Lock()
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeTimeout))
+		s.wlck.Unlock()
+		err = s.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,172 @@
+// Command openrepl runs code on an openrepl server from the command line.
+//
+// Usage:
+//
+//	openrepl run [flags] FILE [ARGS...]
+//	openrepl term [flags]
+//	openrepl languages [flags]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/openrepl/server/client"
+)
+
+// command is a subcommand of the CLI.
+type command struct {
+	Name    string
+	Usage   string
+	Summary string
+
+	// Flags registers the flags of the command, and returns the function running it with the remaining arguments.
+	Flags func(fs *flag.FlagSet, c *client.Client) func(ctx context.Context, args []string) error
+}
+
+// commands are the subcommands of the CLI, by name.
+var commands = map[string]command{
+	"run": {
+		Name:    "run",
+		Usage:   "run [flags] FILE [ARGS...]",
+		Summary: "run a file to completion, streaming its output (FILE may be - to read the code from stdin)",
+		Flags:   runFlags,
+	},
+	"term": {
+		Name:    "term",
+		Usage:   "term [flags]",
+		Summary: "open an interactive terminal",
+		Flags:   termFlags,
+	},
+	"languages": {
+		Name:    "languages",
+		Usage:   "languages [flags]",
+		Summary: "list the languages available on the server",
+		Flags:   languagesFlags,
+	},
+}
+
+// exitError is an error which ends the CLI with an exit status, without a message.
+type exitError struct {
+	Code int
+}
+
+func (ee exitError) Error() string {
+	return fmt.Sprintf("exit status %d", ee.Code)
+}
+
+// envFlag is a repeated flag of environment variables in KEY=VALUE form.
+type envFlag map[string]string
+
+func (ef envFlag) String() string {
+	vars := make([]string, 0, len(ef))
+	for k, v := range ef {
+		vars = append(vars, k+"="+v)
+	}
+	sort.Strings(vars)
+	return strings.Join(vars, ",")
+}
+
+func (ef envFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 1 {
+		return fmt.Errorf("environment variable %q is not in KEY=VALUE form", s)
+	}
+	ef[s[:i]] = s[i+1:]
+	return nil
+}
+
+// clientFlags registers the flags selecting the server, which default to the OPENREPL_URL and OPENREPL_TOKEN environment variables.
+func clientFlags(fs *flag.FlagSet, c *client.Client) {
+	server := os.Getenv("OPENREPL_URL")
+	if server == "" {
+		server = "http://localhost"
+	}
+	fs.StringVar(&c.URL, "server", server, "URL of the openrepl server")
+	fs.StringVar(&c.Token, "token", os.Getenv("OPENREPL_TOKEN"), "access token of the server")
+}
+
+// sessionFlags registers the flags shared by the options of sessions.
+func sessionFlags(fs *flag.FlagSet, opts *client.Options) {
+	fs.StringVar(&opts.Lang, "lang", "", "language of the session")
+	fs.StringVar(&opts.Version, "version", "", "version of the language (default version if empty)")
+	opts.Env = envFlag{}
+	fs.Var(envFlag(opts.Env), "env", "environment variable of the program in KEY=VALUE form (may be repeated)")
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: openrepl COMMAND [flags] [ARGS...]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].Summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `run "openrepl COMMAND -h" for the flags of a command`)
+}
+
+// execute runs the CLI with the given arguments.
+func execute(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		usage()
+		return exitError{2}
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage()
+		return nil
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "openrepl: unknown command %q\n", args[0])
+		usage()
+		return exitError{2}
+	}
+
+	fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: openrepl "+cmd.Usage)
+		fs.PrintDefaults()
+	}
+	c := &client.Client{}
+	clientFlags(fs, c)
+	run := cmd.Flags(fs, c)
+	err := fs.Parse(args[1:])
+	switch {
+	case err == flag.ErrHelp:
+		return nil
+	case err != nil:
+		return exitError{2}
+	}
+	return run(ctx, fs.Args())
+}
+
+func main() {
+	// cancel the session on interrupt, which only arrives here when the terminal is not in raw mode
+	ctx, cancel := context.WithCancel(context.Background())
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt)
+	go func() {
+		<-sigch
+		cancel()
+	}()
+
+	err := execute(ctx, os.Args[1:])
+	cancel()
+	if ee, ok := err.(exitError); ok {
+		os.Exit(ee.Code)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "openrepl: "+strings.TrimPrefix(err.Error(), "openrepl: "))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/openrepl/server/client"
+)
+
+// envelope is a message of the openrepl.v3 protocol.
+type envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// newRunServer starts a server which runs code by echoing it with the language, and then exits with status 4.
+func newRunServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/languages" {
+			json.NewEncoder(w).Encode([]client.Language{
+				{Name: "python2", Extension: ".py", Deprecated: true},
+				{Name: "python3", Extension: ".py"},
+			})
+			return
+		}
+		u := websocket.Upgrader{Subprotocols: []string{client.Protocol}}
+		conn, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %s", err.Error())
+			return
+		}
+		defer conn.Close()
+		send := func(typ string, v interface{}) {
+			payload, _ := json.Marshal(v)
+			conn.WriteJSON(envelope{Type: typ, Payload: payload})
+		}
+
+		send("status", client.Status{Status: "ready"})
+		var env envelope
+		err = conn.ReadJSON(&env)
+		if err != nil || env.Type != "code" {
+			t.Errorf("expected code, got %s (%v)", env.Type, err)
+			return
+		}
+		var code struct{ Data []byte }
+		json.Unmarshal(env.Payload, &code)
+		send("status", client.Status{Status: "running"})
+		send("stdout", map[string][]byte{"data": []byte(r.URL.Query().Get("lang") + ": " + string(code.Data))})
+		send("stderr", map[string][]byte{"data": []byte(strings.Join(r.URL.Query()["arg"], " "))})
+		status := int64(4)
+		send("status", client.Status{Status: "exit", ExitCode: &status})
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}))
+}
+
+func TestRunFile(t *testing.T) {
+	hs := newRunServer(t)
+	defer hs.Close()
+
+	dir, err := ioutil.TempDir("", "openrepl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "main.py")
+	err = ioutil.WriteFile(file, []byte("print(1)"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &client.Client{URL: hs.URL}
+	var stdout, stderr bytes.Buffer
+	opts := client.Options{Args: []string{"-x", "y"}, Streams: true}
+	err = runFile(context.Background(), c, opts, file, nil, &stdout, &stderr)
+	if err != (exitError{4}) {
+		t.Errorf("expected exit status 4, got %v", err)
+	}
+	if stdout.String() != "python3: print(1)" || stderr.String() != "-x y" {
+		t.Errorf("unexpected output %q and %q", stdout.String(), stderr.String())
+	}
+
+	// read the code from stdin
+	stdout.Reset()
+	opts = client.Options{Lang: "lua", Streams: true}
+	err = runFile(context.Background(), c, opts, "-", strings.NewReader("print(2)"), &stdout, &stderr)
+	if err != (exitError{4}) {
+		t.Errorf("expected exit status 4, got %v", err)
+	}
+	if stdout.String() != "lua: print(2)" {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	hs := newRunServer(t)
+	defer hs.Close()
+
+	c := &client.Client{URL: hs.URL}
+	tbl := []struct {
+		file string
+		lang string
+		err  bool
+	}{
+		{"main.py", "python3", false},
+		{"main.rs", "", true},
+		{"Makefile", "", true},
+	}
+	for _, v := range tbl {
+		lang, err := detectLanguage(context.Background(), c, v.file)
+		if lang != v.lang || (err != nil) != v.err {
+			t.Errorf("expected %q (error %v) for %s, got %q (%v)", v.lang, v.err, v.file, lang, err)
+		}
+	}
+}
+
+func TestEnvFlag(t *testing.T) {
+	ef := envFlag{}
+	for _, s := range []string{"A=1", "B=x=y", "C="} {
+		if err := ef.Set(s); err != nil {
+			t.Errorf("failed to set %q: %s", s, err.Error())
+		}
+	}
+	expect := envFlag{"A": "1", "B": "x=y", "C": ""}
+	if !reflect.DeepEqual(ef, expect) {
+		t.Errorf("expected %v, got %v", expect, ef)
+	}
+	if ef.String() != "A=1,B=x=y,C=" {
+		t.Errorf("unexpected string %q", ef.String())
+	}
+	for _, s := range []string{"A", "=1"} {
+		if err := ef.Set(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/openrepl/server/client"
+)
+
+// exitInterrupted is the exit status of the CLI when a session is interrupted, as for a shell.
+const exitInterrupted = 130
+
+// runFlags registers the flags of the run command.
+func runFlags(fs *flag.FlagSet, c *client.Client) func(ctx context.Context, args []string) error {
+	var opts client.Options
+	sessionFlags(fs, &opts)
+	tty := fs.Bool("tty", false, "run in a terminal, merging stdout and stderr (the exit status is not reported)")
+	return func(ctx context.Context, args []string) error {
+		if len(args) == 0 {
+			fs.Usage()
+			return exitError{2}
+		}
+		opts.Args, opts.Streams = args[1:], !*tty
+		return runFile(ctx, c, opts, args[0], os.Stdin, os.Stdout, os.Stderr)
+	}
+}
+
+// runFile runs a file, exiting with the status of the program.
+// The code is read from stdin if the file is "-", in which case the program has no input.
+func runFile(ctx context.Context, c *client.Client, opts client.Options, file string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	var code []byte
+	var err error
+	if file == "-" {
+		code, err = ioutil.ReadAll(stdin)
+		stdin = nil
+	} else {
+		code, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Lang == "" {
+		opts.Lang, err = detectLanguage(ctx, c, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := c.RunCode(ctx, opts, code, stdin, stdout, stderr)
+	switch {
+	case ctx.Err() != nil:
+		return exitError{exitInterrupted}
+	case err != nil:
+		return err
+	case res.ExitCode != nil && *res.ExitCode != 0:
+		return exitError{int(*res.ExitCode)}
+	}
+	return nil
+}
+
+// detectLanguage selects the language of a file by its extension among the languages of the server.
+func detectLanguage(ctx context.Context, c *client.Client, file string) (string, error) {
+	ext := filepath.Ext(file)
+	if ext == "" {
+		return "", errors.New("cannot detect the language of " + file + ", use -lang")
+	}
+	langs, err := c.Languages(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range langs {
+		if l.Extension == ext && !l.Deprecated {
+			return l.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no language for %s files, use -lang", ext)
+}
+
+// languagesFlags registers the flags of the languages command.
+func languagesFlags(fs *flag.FlagSet, c *client.Client) func(ctx context.Context, args []string) error {
+	return func(ctx context.Context, args []string) error {
+		langs, err := c.Languages(ctx)
+		if err != nil {
+			return err
+		}
+		for _, l := range langs {
+			fmt.Printf("%-12s %s", l.Name, l.DisplayName)
+			if l.Version != "" {
+				fmt.Printf(" %s", l.Version)
+			}
+			for _, v := range l.Versions {
+				if v != l.Version {
+					fmt.Printf(", %s", v)
+				}
+			}
+			if l.Deprecated {
+				fmt.Print(" (deprecated)")
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/openrepl/server/client"
+)
+
+// termFlags registers the flags of the term command.
+func termFlags(fs *flag.FlagSet, c *client.Client) func(ctx context.Context, args []string) error {
+	var opts client.Options
+	sessionFlags(fs, &opts)
+	return func(ctx context.Context, args []string) error {
+		if opts.Lang == "" {
+			return errors.New("-lang is required")
+		}
+		s, err := c.Terminal(ctx, opts)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		return terminal(ctx, s, os.Stdin, os.Stdout)
+	}
+}
+
+// terminal attaches the local terminal to a terminal session until the session ends.
+// The local terminal is switched to raw mode, so that control keys are handled by the remote terminal, and its size is kept in sync.
+func terminal(ctx context.Context, s *client.Session, stdin *os.File, stdout *os.File) error {
+	fd := int(stdin.Fd())
+	nl := "\n"
+	if isTerminal(fd) {
+		restore, err := makeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer restore()
+		nl = "\r\n"
+
+		stop := watchSize(fd, func(cols uint, rows uint) {
+			s.Resize(cols, rows)
+		})
+		defer stop()
+	}
+
+	// errors are printed as they arrive, and the last one is the result once the server ends the session
+	var failure error
+	go io.Copy(s, stdin)
+	err := s.Stream(stdout, stdout, func(st client.Status) error {
+		switch {
+		case st.Error != "":
+			failure = &client.StatusError{Status: st}
+			fmt.Fprint(os.Stderr, failure.Error()+nl)
+		case st.Status == "warning":
+			fmt.Fprint(os.Stderr, "openrepl: warning: "+st.Message+nl)
+		}
+		return nil
+	})
+	switch {
+	case ctx.Err() != nil:
+		return exitError{exitInterrupted}
+	case err != nil:
+		return err
+	case failure != nil:
+		return exitError{1}
+	}
+	return nil
+}
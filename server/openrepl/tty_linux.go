@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// ioctls getting and setting the attributes of a terminal
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
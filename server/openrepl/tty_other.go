@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "errors"
+
+// isTerminal returns whether a file descriptor is a terminal, which is never detected on this platform.
+// Terminal sessions still work, but without raw mode or resizing.
+func isTerminal(fd int) bool {
+	return false
+}
+
+// makeRaw switches a terminal to raw mode, which is not supported on this platform.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
+
+// watchSize watches the size of a terminal, which is not supported on this platform.
+func watchSize(fd int, fn func(cols uint, rows uint)) func() {
+	return func() {}
+}
@@ -0,0 +1,67 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// isTerminal returns whether a file descriptor is a terminal.
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	return err == nil
+}
+
+// makeRaw switches a terminal to raw mode, returning a function restoring the previous mode.
+func makeRaw(fd int) (func(), error) {
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+
+	// same as cfmakeraw(3)
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	err = unix.IoctlSetTermios(fd, ioctlSetTermios, &raw)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		unix.IoctlSetTermios(fd, ioctlSetTermios, old)
+	}, nil
+}
+
+// watchSize calls fn with the size of a terminal, and again whenever it is resized, until the returned function is called.
+func watchSize(fd int, fn func(cols uint, rows uint)) func() {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+			if err == nil {
+				fn(uint(ws.Col), uint(ws.Row))
+			}
+			select {
+			case <-sigch:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigch)
+		close(done)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// requireAdmin wraps a handler so that it requires the admin token as a bearer token.
+// If no admin token is configured, admin endpoints are disabled.
+func (cs *ContainerServer) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cs.AdminToken == "" {
+			http.Error(w, "admin API disabled", http.StatusForbidden)
+			return
+		}
+		tok := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(tok), []byte("Bearer "+cs.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// HandleAdminSessions lists active sessions (GET /admin/sessions), or forcibly terminates one (DELETE /admin/sessions/{id}).
+func (cs *ContainerServer) HandleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/sessions"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		cs.adminGet(cs.adminSessions)(w, r)
+	case id != "" && r.Method == http.MethodDelete:
+		sess := cs.SessionConfig.Sessions.Get(id)
+		if sess == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		sess.logger().Printf("terminated by admin")
+		sess.Terminate("session terminated by an administrator")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Terminate forcibly ends the session, notifying the client of the reason.
+func (cs *ContainerSession) Terminate(reason string) {
+	cs.Events.Record("terminated", reason)
+	cs.UpdateStatus(StatusUpdate{Status: "terminated", Error: reason, Code: codeTerminated})
+	cs.Close()
+}
+
+// flushWriter is an io.Writer which flushes the HTTP response after every write.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(dat []byte) (int, error) {
+	n, err := fw.w.Write(dat)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// HandleAdminLogs streams the container logs of an active session.
+// The log driver of the container must support reading logs.
+func (cs *ContainerServer) HandleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// look up session
+	sess := cs.SessionConfig.Sessions.Get(r.URL.Query().Get("session"))
+	if sess == nil || sess.Container == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	if cs.SessionConfig.DockerClient == nil {
+		http.Error(w, "container logs "+errRequiresDocker.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	// parse options
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+
+	// open log stream
+	rc, err := cs.SessionConfig.DockerClient.ContainerLogs(r.Context(), sess.Container.ID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     follow,
+		Tail:       r.URL.Query().Get("tail"),
+	})
+	if err != nil {
+		http.Error(w, "failed to read logs: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer rc.Close()
+
+	// copy logs to client
+	// containers run with a TTY, so the stream is not multiplexed
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(flushWriter{w}, rc)
+}
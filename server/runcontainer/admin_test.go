@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// recordConn is a ClientConn which records the status updates sent to it.
+type recordConn struct {
+	updates []StatusUpdate
+	closed  bool
+}
+
+func (rc *recordConn) WriteJSON(v interface{}) error {
+	if st, ok := v.(StatusUpdate); ok {
+		rc.updates = append(rc.updates, st)
+	}
+	return nil
+}
+
+func (rc *recordConn) WriteMessage(int, []byte) error            { return nil }
+func (rc *recordConn) WriteControl(int, []byte, time.Time) error { return nil }
+func (rc *recordConn) ReadMessage() (int, []byte, error)         { return 0, nil, errors.New("closed") }
+func (rc *recordConn) NextReader() (int, io.Reader, error)       { return 0, nil, errors.New("closed") }
+func (rc *recordConn) SetPongHandler(func(string) error)         {}
+func (rc *recordConn) Close() error                              { rc.closed = true; return nil }
+
+func TestHandleAdminSessions(t *testing.T) {
+	cs := &ContainerServer{SessionConfig: ContainerSessionConfig{Sessions: &SessionRegistry{}}}
+	conn := &recordConn{}
+	sess := &ContainerSession{
+		ID:              "abc",
+		Client:          conn,
+		Config:          &cs.SessionConfig,
+		ContainerConfig: ContainerConfig{Language: "python3"},
+		Remote:          "203.0.113.5:4321",
+		started:         time.Now(),
+	}
+	cs.SessionConfig.Sessions.Add(sess)
+
+	// list sessions
+	rec := httptest.NewRecorder()
+	cs.HandleAdminSessions(rec, httptest.NewRequest(http.MethodGet, "/admin/sessions", nil))
+	var list []SessionInfo
+	err := json.NewDecoder(rec.Body).Decode(&list)
+	if err != nil {
+		t.Fatalf("failed to decode sessions: %s", err.Error())
+	}
+	if len(list) != 1 || list[0].ID != "abc" || list[0].Language != "python3" || list[0].ClientIP != "203.0.113.5" {
+		t.Errorf("unexpected sessions %+v", list)
+	}
+
+	// kill the session
+	rec = httptest.NewRecorder()
+	cs.HandleAdminSessions(rec, httptest.NewRequest(http.MethodDelete, "/admin/sessions/abc", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 but got %d", rec.Code)
+	}
+	if len(conn.updates) != 1 || conn.updates[0].Status != "terminated" || conn.updates[0].Code != codeTerminated || !conn.closed {
+		t.Errorf("client not notified: %+v", conn.updates)
+	}
+	if cs.SessionConfig.Sessions.Get("abc") != nil {
+		t.Error("terminated session still registered")
+	}
+
+	for _, v := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodDelete, "/admin/sessions/abc", http.StatusNotFound},
+		{http.MethodDelete, "/admin/sessions", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/sessions/abc", http.StatusMethodNotAllowed},
+	} {
+		rec = httptest.NewRecorder()
+		cs.HandleAdminSessions(rec, httptest.NewRequest(v.method, v.path, nil))
+		if rec.Code != v.code {
+			t.Errorf("%s %s: expected status %d but got %d", v.method, v.path, v.code, rec.Code)
+		}
+	}
+}
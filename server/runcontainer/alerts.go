@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Alerter posts alerts to a Slack-compatible webhook when errors exceed thresholds.
+// The most recent errors are also kept for the admin API.
+// A nil Alerter discards all errors.
+type Alerter struct {
+	// URL is the URL of the webhook.
+	// If empty, errors are kept but no alerts are posted.
+	URL string
+
+	// Window is the period over which errors are counted.
+	Window time.Duration
+
+	// Cooldown is the minimum time between alerts of the same kind.
+	Cooldown time.Duration
+
+	// Thresholds is the number of errors of each kind within the window which triggers an alert.
+	// Kinds without a threshold alert on every error.
+	Thresholds map[string]int
+
+	// Client is the HTTP client used to post alerts.
+	Client *http.Client
+
+	lck    sync.Mutex
+	events map[string][]time.Time
+	last   map[string]time.Time
+	recent []RecordedError
+}
+
+// RecordedError is an error recorded by the Alerter.
+type RecordedError struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// maxRecentErrors is the number of recent errors kept by the Alerter.
+const maxRecentErrors = 100
+
+// Alert is the payload posted to the webhook.
+// The "text" field is displayed by Slack, and the remaining fields are for generic consumers.
+type Alert struct {
+	Text   string `json:"text"`
+	Kind   string `json:"kind"`
+	Count  int    `json:"count"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Record records an error of the given kind, posting an alert if the threshold is exceeded.
+func (a *Alerter) Record(kind string, detail string) {
+	if a == nil {
+		return
+	}
+
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	if a.events == nil {
+		a.events = make(map[string][]time.Time)
+		a.last = make(map[string]time.Time)
+	}
+
+	// keep recent errors
+	now := time.Now()
+	if len(a.recent) >= maxRecentErrors {
+		a.recent = a.recent[1:]
+	}
+	a.recent = append(a.recent, RecordedError{Time: now, Kind: kind, Detail: detail})
+	if a.URL == "" {
+		return
+	}
+
+	// drop events outside of the window
+	evs := a.events[kind]
+	for len(evs) > 0 && now.Sub(evs[0]) > a.Window {
+		evs = evs[1:]
+	}
+	evs = append(evs, now)
+	a.events[kind] = evs
+
+	// check threshold and cooldown
+	threshold := a.Thresholds[kind]
+	if len(evs) < threshold {
+		return
+	}
+	if last, ok := a.last[kind]; ok && now.Sub(last) < a.Cooldown {
+		return
+	}
+	a.last[kind] = now
+
+	// post alert in the background
+	go a.post(Alert{
+		Text:   fmt.Sprintf("openrepl: %d %s errors in the last %s (latest: %s)", len(evs), kind, a.Window, detail),
+		Kind:   kind,
+		Count:  len(evs),
+		Detail: detail,
+	})
+}
+
+// Recent returns the most recent errors, oldest first.
+func (a *Alerter) Recent() []RecordedError {
+	if a == nil {
+		return nil
+	}
+	a.lck.Lock()
+	defer a.lck.Unlock()
+	return append([]RecordedError(nil), a.recent...)
+}
+
+// post sends an alert to the webhook.
+func (a *Alerter) post(alert Alert) {
+	dat, err := json.Marshal(alert)
+	if err != nil {
+		serverLog.Errorf("failed to encode alert: %s", err.Error())
+		return
+	}
+	resp, err := a.Client.Post(a.URL, "application/json", bytes.NewReader(dat))
+	if err != nil {
+		serverLog.Errorf("failed to post alert: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		serverLog.Errorf("failed to post alert: webhook returned %s", resp.Status)
+	}
+}
+
+// monitorDaemon periodically checks the health of the Docker daemon, recording an error whenever it is unreachable.
+func monitorDaemon(dh *DockerHost, rate time.Duration, alerts *Alerter) {
+	tick := time.NewTicker(rate)
+	defer tick.Stop()
+	for range tick.C {
+		ctx, cancel := context.WithTimeout(context.Background(), rate)
+		err := dh.check(ctx)
+		cancel()
+		if err != nil {
+			serverLog.Errorf("docker daemon %s unreachable: %s", dh.Name, err.Error())
+			alerts.Record("daemon_unreachable", err.Error())
+		}
+	}
+}
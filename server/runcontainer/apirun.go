@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxRunRequest is the maximum size of the body of an HTTP run request.
+const maxRunRequest = 4 << 20
+
+// maxRunOutput is the maximum amount of output collected from each stream of a REST run.
+const maxRunOutput = 1 << 20
+
+// RunRequest is a request to run a program to completion over HTTP.
+type RunRequest struct {
+	// Lang is the name of the language of the program.
+	Lang string `json:"lang"`
+
+	// Code is the code of the program.
+	Code string `json:"code"`
+
+	// Stdin is the input of the program, after which it reads the end of its input.
+	Stdin string `json:"stdin"`
+
+	// Args are the command line arguments of the program.
+	Args []string `json:"args"`
+
+	// Env are the environment variables of the program, which are restricted by the EnvPolicy of the server.
+	Env map[string]string `json:"env"`
+
+	// Version is the version of the language (e.g. "3.12").
+	// If empty, the default version is used.
+	Version string `json:"version"`
+
+	// Packages is the dependency manifest of the program (e.g. a requirements.txt or package.json), in the format of its language.
+	Packages string `json:"packages"`
+}
+
+// RunResponse is the result of a program run over HTTP.
+type RunResponse struct {
+	// Session is the ID of the session, which can be matched to the server logs.
+	Session string `json:"session"`
+
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+
+	// ExitCode is the exit status of the program, which is null if it did not exit by itself (e.g. when it was killed after the time limit).
+	ExitCode *int64 `json:"exit_code"`
+
+	// Duration is the run time of the program in seconds.
+	Duration float64 `json:"duration"`
+
+	// Truncated is set if output was dropped because it exceeded the output limits.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Usage is the resource usage of the program, if requested with the usage query parameter.
+	Usage *RunUsage `json:"usage,omitempty"`
+
+	// Tests is the parsed result of the test suite of a grade request, which is returned instead of the output.
+	Tests *TestReport `json:"tests,omitempty"`
+
+	// Warnings are the warnings sent during the session (e.g. for deprecated languages).
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Error and Code describe why the run ended abnormally, if it did.
+	Error string `json:"err,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// runConn is a ClientConn which runs a session to completion on behalf of an HTTP request, collecting its output.
+// The code is sent once the session is ready, after which no further messages are sent.
+type runConn struct {
+	hangup chan struct{}
+	once   sync.Once
+
+	lck       sync.Mutex
+	code      []byte
+	pong      func(string) error
+	res       RunResponse
+	running   bool
+	exited    bool
+	failure   *StatusUpdate
+	truncated [2]bool
+}
+
+func newRunConn(code []byte) *runConn {
+	return &runConn{
+		hangup: make(chan struct{}),
+		code:   code,
+	}
+}
+
+// collect appends output to the buffer of a stream, dropping output beyond maxRunOutput.
+// The lock must be held.
+func (rc *runConn) collect(stream string, dat []byte) {
+	buf, i := &rc.res.Stdout, 0
+	if stream == "stderr" {
+		buf, i = &rc.res.Stderr, 1
+	}
+	if n := maxRunOutput - len(*buf); len(dat) > n {
+		dat = dat[:n]
+		rc.truncated[i] = true
+	}
+	*buf += string(dat)
+}
+
+func (rc *runConn) WriteJSON(v interface{}) error {
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	switch v := v.(type) {
+	case OutputEvent:
+		rc.collect(v.Stream, v.Data)
+	case StatusUpdate:
+		switch {
+		case v.Status == "starting" && v.Session != "":
+			rc.res.Session = v.Session
+		case v.Status == "running":
+			rc.running = true
+		case v.Status == "exit":
+			rc.exited = true
+			rc.res.ExitCode, rc.res.Duration, rc.res.Usage = v.ExitCode, v.Duration, v.Usage
+		case v.Status == "tested":
+			rc.running, rc.exited = true, true
+			rc.res.Tests = v.Tests
+			rc.res.ExitCode, rc.res.Duration = &v.Tests.ExitCode, v.Tests.Duration
+		case v.Status == "warning":
+			rc.res.Warnings = append(rc.res.Warnings, v.Message)
+		case v.Status == "output_truncated":
+			rc.res.Truncated = true
+		case v.Error != "" && rc.failure == nil:
+			rc.failure = &v
+		}
+	}
+	return nil
+}
+
+// WriteMessage collects raw output and handles the close message.
+func (rc *runConn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case websocket.TextMessage, websocket.BinaryMessage:
+		rc.lck.Lock()
+		rc.collect("stdout", data)
+		rc.lck.Unlock()
+	case websocket.CloseMessage:
+		rc.Close()
+	}
+	return nil
+}
+
+// WriteControl answers pings immediately, as the client is disconnected with the HTTP request instead.
+func (rc *runConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	select {
+	case <-rc.hangup:
+		return errors.New("run connection closed")
+	default:
+	}
+	rc.lck.Lock()
+	pong := rc.pong
+	rc.lck.Unlock()
+	if pong != nil && messageType == websocket.PingMessage {
+		pong(string(data))
+	}
+	return nil
+}
+
+// ReadMessage returns the code, and then blocks until the connection is closed.
+func (rc *runConn) ReadMessage() (int, []byte, error) {
+	rc.lck.Lock()
+	code := rc.code
+	rc.code = nil
+	rc.lck.Unlock()
+	if code != nil {
+		return websocket.BinaryMessage, code, nil
+	}
+	<-rc.hangup
+	return 0, nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}
+}
+
+func (rc *runConn) NextReader() (int, io.Reader, error) {
+	t, dat, err := rc.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return t, bytes.NewReader(dat), nil
+}
+
+func (rc *runConn) SetPongHandler(h func(appData string) error) {
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	rc.pong = h
+}
+
+func (rc *runConn) Close() error {
+	rc.once.Do(func() { close(rc.hangup) })
+	return nil
+}
+
+// result returns the response to the run.
+// If the session ended before the program ran, the status explaining why is returned instead.
+func (rc *runConn) result() (RunResponse, *StatusUpdate) {
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	if !rc.running {
+		if rc.failure == nil {
+			return RunResponse{}, &StatusUpdate{Status: "error", Error: "session ended before running", Session: rc.res.Session}
+		}
+		return RunResponse{}, rc.failure
+	}
+	res := rc.res
+	res.Truncated = res.Truncated || rc.truncated[0] || rc.truncated[1]
+	if rc.failure != nil {
+		res.Error, res.Code = rc.failure.Error, rc.failure.Code
+	}
+	if !rc.exited {
+		res.ExitCode = nil
+	}
+	return res, nil
+}
+
+// runRequestKey is the context key of the RunRequest of an HTTP run.
+type runRequestKey struct{}
+
+// HandleAPIRun runs the program in the RunRequest in the body of a POST request, responding with a RunResponse once it has finished.
+// The session options of websocket runs may be selected with query parameters.
+func (cs *ContainerServer) HandleAPIRun(w http.ResponseWriter, r *http.Request) {
+	cs.serveAPIRun(w, r, "rest")
+}
+
+// HandleAPIRunStream runs the program in the RunRequest in the body of a POST request, streaming status updates and output as server-sent events.
+func (cs *ContainerServer) HandleAPIRunStream(w http.ResponseWriter, r *http.Request) {
+	cs.serveAPIRun(w, r, "sse")
+}
+
+// serveAPIRun starts a run for the RunRequest in the body of a POST request over the given transport.
+func (cs *ContainerServer) serveAPIRun(w http.ResponseWriter, r *http.Request, transport string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req RunRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRunRequest)).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid run request", http.StatusBadRequest)
+		return
+	}
+
+	// select the language and arguments, running without a terminal
+	q := r.URL.Query()
+	q.Set("lang", req.Lang)
+	if req.Version != "" {
+		q.Set("version", req.Version)
+	}
+	q["arg"] = req.Args
+	for name, v := range req.Env {
+		q.Add("env", name+"="+v)
+	}
+	sort.Strings(q["env"])
+	q.Set("streams", "true")
+	q.Set("transport", transport)
+	r.URL.RawQuery = q.Encode()
+	r = r.WithContext(context.WithValue(r.Context(), runRequestKey{}, &req))
+	cs.serveSession(w, r, true)
+}
+
+// serveHTTPRun runs a session to completion for an HTTP run request, responding with its output.
+func serveHTTPRun(w http.ResponseWriter, r *http.Request, cc ContainerConfig, opts SessionOptions, sc *ContainerSessionConfig) {
+	req, ok := r.Context().Value(runRequestKey{}).(*RunRequest)
+	if !ok || r.Method != http.MethodPost {
+		http.Error(w, "HTTP runs are only available at /api/run", http.StatusBadRequest)
+		return
+	}
+	if opts.Grade {
+		greq, ok := r.Context().Value(gradeRequestKey{}).(*GradeRequest)
+		if !ok {
+			http.Error(w, "test runs are only available at /api/grade", http.StatusBadRequest)
+			return
+		}
+		opts.TestBundle = greq.Tests
+	}
+	opts.Input = []byte(req.Stdin)
+	opts.Packages = []byte(req.Packages)
+	cc.stdinOnce = true
+	if opts.RunTransport == "sse" {
+		serveSSERun(w, r, req, cc, opts, sc)
+		return
+	}
+
+	// stop the session if the client goes away
+	rc := newRunConn([]byte(req.Code))
+	ctx := r.Context()
+	stopch := make(chan struct{})
+	defer close(stopch)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rc.Close()
+		case <-stopch:
+		}
+	}()
+	serveContainerSession(rc, r.RemoteAddr, r.Header.Get(tenantHeader), defaultSubprotocol, true, cc, opts, sc)
+	if ctx.Err() != nil {
+		return
+	}
+
+	res, su := rc.result()
+	w.Header().Set("Content-Type", "application/json")
+	if su != nil {
+		status := http.StatusBadGateway
+		if su.Status == "rejected" {
+			status = http.StatusForbidden
+		}
+		if su.Code == codePayloadTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		if su.Code == codeInstallFailed {
+			status = http.StatusUnprocessableEntity
+		}
+		if su.Code == codeQuotaExceeded {
+			status = http.StatusTooManyRequests
+			w.Header().Set("Retry-After", strconv.Itoa(su.RetryAfter))
+		}
+		if su.Status == "capacity" || su.Code == codeDaemonUnavailable || su.Code == codeTooManySessions {
+			status = http.StatusServiceUnavailable
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(su)
+		return
+	}
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		Logger{Session: res.Session}.Errorf("failed to send run result: %s", err.Error())
+	}
+}
+
+// sendInput writes the fixed input of the session to the program, then closes its input.
+func (cs *ContainerSession) sendInput() {
+	cs.recording.input(cs.Options.Input)
+	_, err := cs.Container.Write(cs.Options.Input)
+	if err == nil {
+		err = cs.Container.closeInput()
+	}
+	if err != nil {
+		cs.logger().Errorf("failed to send input: %s", err.Error())
+	}
+}
+
+// closeInput closes the input stream of the program, so that it reads the end of its input.
+func (c *Container) closeInput() error {
+	cw, ok := c.IO.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return errors.New("closing the input of the container is not supported")
+	}
+	return cw.CloseWrite()
+}
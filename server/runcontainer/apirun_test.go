@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRunConn(t *testing.T) {
+	rc := newRunConn([]byte("print(1)"))
+
+	// the code is sent once, after which reads block until the connection is closed
+	typ, dat, err := rc.ReadMessage()
+	if err != nil || typ != websocket.BinaryMessage || string(dat) != "print(1)" {
+		t.Fatalf("expected code but got %d %q %v", typ, dat, err)
+	}
+
+	// simulate a session running a program
+	code := int64(3)
+	rc.WriteJSON(StatusUpdate{Status: "starting", Session: "s1"})
+	rc.WriteJSON(StatusUpdate{Status: "warning", Message: "deprecated"})
+	rc.WriteJSON(StatusUpdate{Status: "running"})
+	rc.WriteJSON(OutputEvent{Stream: "stdout", Data: []byte("out")})
+	rc.WriteJSON(OutputEvent{Stream: "stderr", Data: []byte("err")})
+	rc.WriteJSON(OutputEvent{Stream: "stdout", Data: make([]byte, maxRunOutput)})
+	rc.WriteJSON(StatusUpdate{Status: "exit", ExitCode: &code, Duration: 1.5, Usage: &RunUsage{PeakMemory: 1 << 20}})
+	rc.WriteMessage(websocket.CloseMessage, nil)
+	if _, _, err := rc.ReadMessage(); err == nil {
+		t.Error("expected read to fail after close")
+	}
+
+	res, su := rc.result()
+	if su != nil {
+		t.Fatalf("unexpected status %+v", su)
+	}
+	if res.Session != "s1" || res.Stderr != "err" || len(res.Stdout) != maxRunOutput || !strings.HasPrefix(res.Stdout, "out") {
+		t.Errorf("unexpected output %q %q of session %q", res.Stdout[:3], res.Stderr, res.Session)
+	}
+	if res.ExitCode == nil || *res.ExitCode != 3 || res.Duration != 1.5 || res.Usage == nil || res.Usage.PeakMemory != 1<<20 || !res.Truncated || len(res.Warnings) != 1 {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+func TestRunConnFailure(t *testing.T) {
+	tbl := []struct {
+		name    string
+		updates []StatusUpdate
+		status  string
+		err     string
+	}{
+		{"start", []StatusUpdate{{Status: "capacity", Error: "insufficient memory"}}, "capacity", ""},
+		{"ended", nil, "error", ""},
+		{"timeout", []StatusUpdate{{Status: "running"}, {Status: "timeout", Error: "too slow", Code: codeRunTimeout}}, "", "too slow"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newRunConn(nil)
+			for _, su := range tt.updates {
+				rc.WriteJSON(su)
+			}
+			res, su := rc.result()
+			if tt.status != "" {
+				if su == nil || su.Status != tt.status {
+					t.Errorf("expected status %q but got %+v", tt.status, su)
+				}
+				return
+			}
+			if su != nil || res.Error != tt.err || res.Code != codeRunTimeout || res.ExitCode != nil {
+				t.Errorf("unexpected result %+v %+v", res, su)
+			}
+		})
+	}
+}
+
+func TestHandleAPIRunInvalid(t *testing.T) {
+	srv := &ContainerServer{Containers: map[string]Language{}}
+	tbl := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "{", http.StatusBadRequest},
+		{http.MethodPost, `{"lang":"cobol","code":"x"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tbl {
+		w := httptest.NewRecorder()
+		srv.HandleAPIRun(w, httptest.NewRequest(tt.method, "/api/run", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s %q: expected status %d but got %d", tt.method, tt.body, tt.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Artifact is a file collected from a container after a run.
+type Artifact struct {
+	// Name is the path of the file relative to the artifact directory.
+	Name string
+
+	// Data is the content of the file.
+	Data []byte
+
+	// Expires is the time after which the artifact is no longer available.
+	Expires time.Time
+}
+
+// ArtifactInfo is a description of an Artifact which is sent to the client.
+type ArtifactInfo struct {
+	// ID is the ID used to download the artifact.
+	ID string `json:"id"`
+
+	// Name is the path of the file relative to the artifact directory.
+	Name string `json:"name"`
+
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+}
+
+// ArtifactError describes an artifact which was not collected.
+type ArtifactError struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Error string `json:"err"`
+}
+
+// errArtifactTooLarge is the error of artifacts exceeding a size limit.
+const errArtifactTooLarge = "artifact too large"
+
+// ArtifactStore is an in-memory store of collected artifacts.
+type ArtifactStore struct {
+	lck       sync.Mutex
+	artifacts map[string]*Artifact
+
+	// TTL is the amount of time for which artifacts are available for download.
+	TTL time.Duration
+}
+
+// Add adds a file to the store and returns the ID of the new Artifact.
+func (as *ArtifactStore) Add(name string, dat []byte) (string, error) {
+	// generate random ID
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	as.lck.Lock()
+	defer as.lck.Unlock()
+
+	// store artifact
+	now := time.Now()
+	if as.artifacts == nil {
+		as.artifacts = make(map[string]*Artifact)
+	}
+	as.artifacts[id] = &Artifact{
+		Name:    name,
+		Data:    dat,
+		Expires: now.Add(as.TTL),
+	}
+
+	return id, nil
+}
+
+// Clean drops the artifacts which have expired.
+func (as *ArtifactStore) Clean(now time.Time) {
+	as.lck.Lock()
+	defer as.lck.Unlock()
+	for k, v := range as.artifacts {
+		if now.After(v.Expires) {
+			delete(as.artifacts, k)
+		}
+	}
+}
+
+// RunCleaner periodically drops expired artifacts, so that their data is freed even if no further artifacts are added.
+func (as *ArtifactStore) RunCleaner(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for now := range tick.C {
+		as.Clean(now)
+	}
+}
+
+// Get looks up an Artifact by ID.
+// Returns nil if the artifact does not exist or has expired.
+func (as *ArtifactStore) Get(id string) *Artifact {
+	as.lck.Lock()
+	defer as.lck.Unlock()
+
+	a := as.artifacts[id]
+	if a == nil || time.Now().After(a.Expires) {
+		return nil
+	}
+	return a
+}
+
+// ServeHTTP serves an artifact download.
+func (as *ArtifactStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	a := as.Get(r.URL.Query().Get("id"))
+	if a == nil {
+		http.Error(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+path.Base(a.Name)+"\"")
+	w.Write(a.Data)
+}
+
+// matchGlob checks whether a slash-separated name matches a glob pattern.
+// In addition to the syntax of path.Match, a "**" element matches any number of path elements.
+func matchGlob(pattern, name string) bool {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(pat, parts []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchGlobParts(pat[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		ok, err := path.Match(pat[0], parts[0])
+		if err != nil || !ok {
+			return false
+		}
+		pat, parts = pat[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// artifactDir returns the directory in which artifacts are collected.
+// Configurations collecting artifacts are rejected at load if it is empty or the root directory.
+func (cc ContainerConfig) artifactDir() string {
+	if cc.ArtifactDir != "" {
+		return cc.ArtifactDir
+	}
+	return cc.WorkDir
+}
+
+// checkArtifactSize checks an artifact against the per-file limit and the remaining part of the total limit.
+// Returns the reason the artifact is rejected, or an empty string if it fits.
+func checkArtifactSize(size, maxFile, remaining, total int64) string {
+	switch {
+	case maxFile > 0 && size > maxFile:
+		return fmt.Sprintf("%s (limit %d bytes per file)", errArtifactTooLarge, maxFile)
+	case size > remaining:
+		return fmt.Sprintf("%s (limit %d bytes per run)", errArtifactTooLarge, total)
+	default:
+		return ""
+	}
+}
+
+// scanArtifacts copies dir out of the container, and calls fn with each regular file matching any of the globs.
+// Names are relative to dir.
+func (cs *ContainerSession) scanArtifacts(ctx context.Context, dir string, globs []string, fn func(name string, hdr *tar.Header, r io.Reader) error) error {
+	c := cs.Container
+	if c.cli == nil {
+		return errRequiresDocker
+	}
+
+	// copy artifact directory out of the container
+	rc, _, err := c.cli.CopyFromContainer(ctx, c.ID, dir)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// scan tarball for matching files
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// strip the name of the artifact directory
+		spl := strings.SplitN(hdr.Name, "/", 2)
+		if len(spl) != 2 {
+			continue
+		}
+		name := spl[1]
+
+		// check globs
+		matched := false
+		for _, g := range globs {
+			if matchGlob(g, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		err = fn(name, hdr, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// collectArtifacts copies files in dir matching any of the globs out of the container.
+// Files larger than maxFile, or which would exceed the remaining size limit of the session, are rejected.
+func (cs *ContainerSession) collectArtifacts(ctx context.Context, dir string, globs []string, maxFile int64, remaining *int64) (infos []ArtifactInfo, rejected []ArtifactError, err error) {
+	err = cs.scanArtifacts(ctx, dir, globs, func(name string, hdr *tar.Header, r io.Reader) error {
+		// enforce size limits
+		if msg := checkArtifactSize(hdr.Size, maxFile, *remaining, cs.Config.MaxArtifactBytes); msg != "" {
+			rejected = append(rejected, ArtifactError{Name: name, Size: hdr.Size, Error: msg})
+			return nil
+		}
+		*remaining -= hdr.Size
+
+		// store artifact
+		dat, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		id, err := cs.Config.Artifacts.Add(name, dat)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, ArtifactInfo{
+			ID:   id,
+			Name: name,
+			Size: hdr.Size,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return infos, rejected, nil
+}
+
+// archiveName is the name of the archive of the artifacts of a run.
+const archiveName = "artifacts.tar"
+
+// collectArchive copies files in dir matching any of the globs out of the container into a single tar archive.
+// The size limits apply to the files in the archive, and no archive is stored if no file matches.
+func (cs *ContainerSession) collectArchive(ctx context.Context, dir string, globs []string, maxFile int64, remaining *int64) (info *ArtifactInfo, rejected []ArtifactError, err error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	n := 0
+	err = cs.scanArtifacts(ctx, dir, globs, func(name string, hdr *tar.Header, r io.Reader) error {
+		// enforce size limits
+		if msg := checkArtifactSize(hdr.Size, maxFile, *remaining, cs.Config.MaxArtifactBytes); msg != "" {
+			rejected = append(rejected, ArtifactError{Name: name, Size: hdr.Size, Error: msg})
+			return nil
+		}
+		*remaining -= hdr.Size
+
+		// add file to archive
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     hdr.Mode,
+			Size:     hdr.Size,
+			ModTime:  hdr.ModTime,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, r)
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == 0 {
+		return nil, rejected, nil
+	}
+
+	// store archive
+	id, err := cs.Config.Artifacts.Add(archiveName, buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ArtifactInfo{ID: id, Name: archiveName, Size: int64(buf.Len())}, rejected, nil
+}
+
+// collectsArtifacts checks whether any files are collected after the program exits.
+func (cs *ContainerSession) collectsArtifacts() bool {
+	return len(cs.ContainerConfig.Artifacts) > 0 || cs.ContainerConfig.ArtifactArchive || cs.Options.Profile || cs.Options.CoreDump
+}
+
+// waitExit waits for the container to exit and returns its exit status.
+func (c *Container) waitExit(ctx context.Context) (int64, error) {
+	return c.backend.Wait(ctx, c)
+}
+
+// sendArtifacts collects artifacts after the program exited with the given status and reports them to the client.
+func (cs *ContainerSession) sendArtifacts(ctx context.Context, code int64) error {
+	cc := cs.ContainerConfig
+	status := StatusUpdate{Status: "artifacts", ExitCode: &code}
+	remaining := cs.Config.MaxArtifactBytes
+	maxFile := cs.Config.MaxArtifactFileBytes
+
+	// collect core dump if the program was killed by a signal
+	if cs.Options.CoreDump && code > 128 {
+		coreRemaining := cc.coreLimit
+		infos, _, err := cs.collectArtifacts(ctx, cc.CoreDump.Dir, []string{"core", "core.*"}, 0, &coreRemaining)
+		if err != nil {
+			return err
+		}
+		if len(infos) > 0 {
+			status.Core = &infos[0]
+		}
+	}
+
+	// collect profiling report
+	if cs.Options.Profile {
+		infos, rejected, err := cs.collectArtifacts(ctx, path.Dir(cc.Profile.Report), []string{path.Base(cc.Profile.Report)}, maxFile, &remaining)
+		if err != nil {
+			return err
+		}
+		if len(infos) > 0 {
+			status.Profile = &infos[0]
+		}
+		status.ArtifactErrors = append(status.ArtifactErrors, rejected...)
+	}
+
+	// collect artifacts
+	switch {
+	case cc.ArtifactArchive:
+		globs := cc.Artifacts
+		if len(globs) == 0 {
+			globs = []string{"**"}
+		}
+		info, rejected, err := cs.collectArchive(ctx, cc.artifactDir(), globs, maxFile, &remaining)
+		if err != nil {
+			return err
+		}
+		status.Archive = info
+		status.ArtifactErrors = append(status.ArtifactErrors, rejected...)
+	case len(cc.Artifacts) > 0:
+		infos, rejected, err := cs.collectArtifacts(ctx, cc.artifactDir(), cc.Artifacts, maxFile, &remaining)
+		if err != nil {
+			return err
+		}
+		status.Artifacts = infos
+		status.ArtifactErrors = append(status.ArtifactErrors, rejected...)
+	}
+	status.ArtifactsSkipped = len(status.ArtifactErrors)
+	if status.ArtifactsSkipped > 0 {
+		cs.Events.Record("artifacts_rejected", fmt.Sprintf("%d artifacts too large", status.ArtifactsSkipped))
+	}
+
+	return cs.UpdateStatus(status)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tbl := []struct {
+		pattern string
+		name    string
+		expect  bool
+	}{
+		{"*.png", "plot.png", true},
+		{"*.png", "out/plot.png", false},
+		{"out/**", "out/plot.png", true},
+		{"out/**", "out/a/b/c.txt", true},
+		{"out/**", "output.txt", false},
+		{"**/*.csv", "data.csv", true},
+		{"**/*.csv", "a/b/data.csv", true},
+		{"**/*.csv", "a/b/data.json", false},
+		{"a/*/c", "a/b/c", true},
+		{"a/*/c", "a/b/b/c", false},
+	}
+	for _, v := range tbl {
+		got := matchGlob(v.pattern, v.name)
+		if got != v.expect {
+			t.Errorf("matchGlob(%q, %q): expected %v but got %v", v.pattern, v.name, v.expect, got)
+		}
+	}
+}
+
+func TestCheckArtifactSize(t *testing.T) {
+	tbl := []struct {
+		size, maxFile, remaining int64
+		expect                   string
+	}{
+		{10, 100, 1000, ""},
+		{100, 100, 1000, ""},
+		{101, 100, 1000, "artifact too large (limit 100 bytes per file)"},
+		{500, 0, 1000, ""},
+		{50, 100, 40, "artifact too large (limit 1000 bytes per run)"},
+	}
+	for _, v := range tbl {
+		got := checkArtifactSize(v.size, v.maxFile, v.remaining, 1000)
+		if got != v.expect {
+			t.Errorf("checkArtifactSize(%d, %d, %d): expected %q but got %q", v.size, v.maxFile, v.remaining, v.expect, got)
+		}
+	}
+}
+
+func TestArtifactStoreClean(t *testing.T) {
+	as := &ArtifactStore{TTL: time.Minute}
+	id, err := as.Add("out.png", []byte("png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	as.Clean(time.Now())
+	if as.Get(id) == nil {
+		t.Fatal("artifact dropped before expiring")
+	}
+
+	// expired artifacts are dropped without waiting for another artifact to be added
+	as.Clean(time.Now().Add(2 * time.Minute))
+	as.lck.Lock()
+	n := len(as.artifacts)
+	as.lck.Unlock()
+	if n != 0 {
+		t.Errorf("expected expired artifact to be dropped, %d left", n)
+	}
+}
+
+// artifactSession returns a session whose container is served by a fake Docker daemon, which returns entries for the archive of /out.
+func artifactSession(t *testing.T, entries []tarEntry) (*ContainerSession, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/c1/archive") || r.URL.Query().Get("path") != "/out" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString([]byte(`{"name":"out"}`)))
+		tr := packTarball(entries)
+		defer tr.Close()
+		io.Copy(w, tr)
+	}))
+	cli, err := client.NewClient("tcp://"+strings.TrimPrefix(srv.URL, "http://"), "1.29", nil, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	cs := &ContainerSession{
+		Container: &Container{ID: "c1", cli: cli},
+		Config:    &ContainerSessionConfig{Artifacts: &ArtifactStore{TTL: time.Minute}, MaxArtifactBytes: 6},
+	}
+	return cs, srv.Close
+}
+
+// artifactEntries is the archive of an artifact directory with nested, oversized, unmatched and symlinked files.
+var artifactEntries = []tarEntry{
+	{&tar.Header{Name: "out/", Typeflag: tar.TypeDir, Mode: 0755}, nil},
+	{&tar.Header{Name: "out/a.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, []byte("aaa")},
+	{&tar.Header{Name: "out/sub/b.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}, []byte("bb")},
+	{&tar.Header{Name: "out/big.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 30}, []byte(strings.Repeat("x", 30))},
+	{&tar.Header{Name: "out/notes.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, []byte("txt")},
+	{&tar.Header{Name: "out/link.png", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, nil},
+	{&tar.Header{Name: "out/hard.png", Typeflag: tar.TypeLink, Linkname: "out/a.png"}, nil},
+}
+
+func TestCollectArtifacts(t *testing.T) {
+	cs, done := artifactSession(t, artifactEntries)
+	defer done()
+
+	// globs match within a directory, oversized files are rejected, and links are never followed
+	remaining := int64(100)
+	infos, rejected, err := cs.collectArtifacts(context.Background(), "/out", []string{"*.png"}, 20, &remaining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "a.png" || infos[0].Size != 3 {
+		t.Errorf("unexpected artifacts %+v", infos)
+	}
+	if a := cs.Config.Artifacts.Get(infos[0].ID); a == nil || string(a.Data) != "aaa" {
+		t.Errorf("unexpected stored artifact %+v", a)
+	}
+	if len(rejected) != 1 || rejected[0].Name != "big.png" || !strings.Contains(rejected[0].Error, "per file") {
+		t.Errorf("unexpected rejected artifacts %+v", rejected)
+	}
+	if remaining != 97 {
+		t.Errorf("expected 97 bytes remaining, got %d", remaining)
+	}
+}
+
+func TestCollectArchive(t *testing.T) {
+	cs, done := artifactSession(t, artifactEntries)
+	defer done()
+
+	// files are archived until the total limit is reached, and links are left out
+	remaining := cs.Config.MaxArtifactBytes
+	info, rejected, err := cs.collectArchive(context.Background(), "/out", []string{"**"}, 20, &remaining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Name != archiveName {
+		t.Fatalf("unexpected archive %+v", info)
+	}
+	var errs []string
+	for _, r := range rejected {
+		errs = append(errs, r.Name+": "+r.Error)
+	}
+	expect := []string{"big.png: artifact too large (limit 20 bytes per file)", "notes.txt: artifact too large (limit 6 bytes per run)"}
+	if !reflect.DeepEqual(errs, expect) {
+		t.Errorf("expected rejected artifacts %q, got %q", expect, errs)
+	}
+
+	// the archive contains the accepted regular files
+	a := cs.Config.Artifacts.Get(info.ID)
+	if a == nil {
+		t.Fatal("archive not stored")
+	}
+	tr := tar.NewReader(strings.NewReader(string(a.Data)))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		dat, _ := ioutil.ReadAll(tr)
+		names = append(names, hdr.Name+"="+string(dat))
+	}
+	if expect := []string{"a.png=aaa", "sub/b.png=bb"}; !reflect.DeepEqual(names, expect) {
+		t.Errorf("expected archive %q, got %q", expect, names)
+	}
+
+	// no archive is stored if no file matches
+	remaining = cs.Config.MaxArtifactBytes
+	info, _, err = cs.collectArchive(context.Background(), "/out", []string{"*.gif"}, 0, &remaining)
+	if info != nil || err != nil {
+		t.Errorf("expected no archive, got %+v (%v)", info, err)
+	}
+}
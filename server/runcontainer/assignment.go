@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AssignmentTest is a test case of an assignment.
+// The program is run with the input on stdin, and passes if its output matches the expected output.
+type AssignmentTest struct {
+	Name     string `json:"name"`
+	Input    string `json:"input,omitempty"`
+	Expected string `json:"expected"`
+
+	// Timeout is the maximum run time of the test in seconds.
+	// If zero, defaultTestTimeout is used.
+	Timeout float64 `json:"timeout,omitempty"`
+}
+
+// defaultTestTimeout is the run time limit of tests without a timeout.
+const defaultTestTimeout = 10 * time.Second
+
+// maxTestOutput is the maximum number of output bytes of a test which are compared and reported.
+const maxTestOutput = 64 << 10
+
+// Assignment is a programming exercise, which student submissions are graded against.
+type Assignment struct {
+	ID       string `json:"id"`
+	Language string `json:"language"`
+	Title    string `json:"title,omitempty"`
+
+	// Statement is the description of the exercise shown to students.
+	Statement string `json:"statement"`
+
+	// Starter is the code initially given to students.
+	Starter string `json:"starter,omitempty"`
+
+	// Tests are the test cases shown to students.
+	Tests []AssignmentTest `json:"tests,omitempty"`
+
+	// HiddenTests are test cases which are never revealed to students, and of which only verdicts are returned.
+	HiddenTests []AssignmentTest `json:"hidden_tests,omitempty"`
+}
+
+// public returns the copy of the assignment shown to students, without the hidden tests.
+func (a Assignment) public() Assignment {
+	a.HiddenTests = nil
+	return a
+}
+
+// assignmentIDPattern matches valid assignment IDs.
+var assignmentIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// validate checks that the assignment is well-formed.
+func (a Assignment) validate(langs map[string]Language) error {
+	if !assignmentIDPattern.MatchString(a.ID) {
+		return fmt.Errorf("invalid assignment ID %q", a.ID)
+	}
+	if _, ok := langs[a.Language]; !ok {
+		return fmt.Errorf("language %q not supported", a.Language)
+	}
+	if len(a.Tests)+len(a.HiddenTests) == 0 {
+		return errors.New("assignment has no tests")
+	}
+	return nil
+}
+
+// AssignmentStore is a set of assignments, optionally persisted to a JSON file.
+// A nil AssignmentStore has no assignments.
+type AssignmentStore struct {
+	// Path is the path of the file in which the assignments are saved.
+	// If empty, assignments are only kept in memory.
+	Path string
+
+	lck         sync.Mutex
+	assignments map[string]Assignment
+}
+
+// OpenAssignmentStore opens an assignment store, loading the saved assignments if the file exists.
+func OpenAssignmentStore(path string) (*AssignmentStore, error) {
+	as := &AssignmentStore{Path: path, assignments: make(map[string]Assignment)}
+	if path == "" {
+		return as, nil
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return as, nil
+		}
+		return nil, err
+	}
+	var list []Assignment
+	err = json.Unmarshal(dat, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range list {
+		as.assignments[a.ID] = a
+	}
+	return as, nil
+}
+
+// Get looks up an assignment by ID.
+func (as *AssignmentStore) Get(id string) (Assignment, bool) {
+	if as == nil {
+		return Assignment{}, false
+	}
+	as.lck.Lock()
+	defer as.lck.Unlock()
+	a, ok := as.assignments[id]
+	return a, ok
+}
+
+// List returns all assignments, ordered by ID.
+func (as *AssignmentStore) List() []Assignment {
+	if as == nil {
+		return []Assignment{}
+	}
+	as.lck.Lock()
+	defer as.lck.Unlock()
+	return as.list()
+}
+
+func (as *AssignmentStore) list() []Assignment {
+	list := make([]Assignment, 0, len(as.assignments))
+	for _, a := range as.assignments {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Put creates or replaces an assignment.
+func (as *AssignmentStore) Put(a Assignment) error {
+	as.lck.Lock()
+	defer as.lck.Unlock()
+	prev, existed := as.assignments[a.ID]
+	as.assignments[a.ID] = a
+	err := as.save()
+	if err != nil {
+		// keep memory consistent with the file
+		if existed {
+			as.assignments[a.ID] = prev
+		} else {
+			delete(as.assignments, a.ID)
+		}
+	}
+	return err
+}
+
+// Delete removes an assignment, returning false if it did not exist.
+func (as *AssignmentStore) Delete(id string) (bool, error) {
+	as.lck.Lock()
+	defer as.lck.Unlock()
+	prev, ok := as.assignments[id]
+	if !ok {
+		return false, nil
+	}
+	delete(as.assignments, id)
+	err := as.save()
+	if err != nil {
+		as.assignments[id] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+// save writes the assignments to the file, replacing it atomically.
+func (as *AssignmentStore) save() error {
+	if as.Path == "" {
+		return nil
+	}
+	dat, err := json.MarshalIndent(as.list(), "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := as.Path + ".tmp"
+	err = ioutil.WriteFile(tmp, dat, 0600)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, as.Path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// HandleAssignment serves the public view of the assignment selected by the id query parameter.
+func (cs *ContainerServer) HandleAssignment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	a, ok := cs.Assignments.Get(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "assignment not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.public())
+}
+
+// HandleAdminAssignments manages assignments.
+// GET lists all assignments (or the one selected by the id query parameter), PUT creates or replaces the assignment in the body, and DELETE removes the assignment selected by the id query parameter.
+func (cs *ContainerServer) HandleAdminAssignments(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	switch r.Method {
+	case http.MethodGet:
+		var v interface{} = cs.Assignments.List()
+		if id != "" {
+			a, ok := cs.Assignments.Get(id)
+			if !ok {
+				http.Error(w, "assignment not found", http.StatusNotFound)
+				return
+			}
+			v = a
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	case http.MethodPut:
+		var a Assignment
+		err := json.NewDecoder(r.Body).Decode(&a)
+		if err != nil {
+			http.Error(w, "failed to decode assignment: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = a.validate(cs.languages())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = cs.Assignments.Put(a)
+		if err != nil {
+			http.Error(w, "failed to save assignment: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		ok, err := cs.Assignments.Delete(id)
+		if err != nil {
+			http.Error(w, "failed to save assignments: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "assignment not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// TestVerdict is the result of running a submission against a single test.
+type TestVerdict struct {
+	// Name is the name of the test, which is not revealed for hidden tests.
+	Name   string `json:"name,omitempty"`
+	Hidden bool   `json:"hidden,omitempty"`
+
+	// Verdict is "passed", "failed" (wrong output), "error" (non-zero exit status) or "timeout".
+	Verdict string `json:"verdict"`
+
+	// Output is the output of the program, which is only returned for visible tests.
+	Output string `json:"output,omitempty"`
+}
+
+// GradeResult is the result of grading a submission.
+type GradeResult struct {
+	Assignment string        `json:"assignment"`
+	Passed     int           `json:"passed"`
+	Total      int           `json:"total"`
+	Tests      []TestVerdict `json:"tests"`
+}
+
+// normalizeOutput removes trailing whitespace from every line and trailing blank lines, so that these do not affect verdicts.
+func normalizeOutput(out string) string {
+	lines := strings.Split(strings.Replace(out, "\r\n", "\n", -1), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// limitedBuffer is a buffer which discards data beyond its limit.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (lb *limitedBuffer) Write(dat []byte) (int, error) {
+	n := len(dat)
+	if rem := lb.limit - lb.Len(); rem < len(dat) {
+		if rem < 0 {
+			rem = 0
+		}
+		dat = dat[:rem]
+	}
+	lb.Buffer.Write(dat)
+	return n, nil
+}
+
+// runTest runs the program against a single test.
+func (cs *ContainerSession) runTest(ctx context.Context, test AssignmentTest) (verdict string, output string, err error) {
+	timeout := defaultTestTimeout
+	if test.Timeout > 0 {
+		timeout = time.Duration(test.Timeout * float64(time.Second))
+	}
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// kill the program when it exceeds the timeout
+	donech := make(chan struct{})
+	defer close(donech)
+	go func() {
+		select {
+		case <-tctx.Done():
+			cs.Container.Exec(context.Background(), []string{"sh", "-c", "kill -KILL $(cat " + execPidFile + ") 2>/dev/null"})
+		case <-donech:
+		}
+	}()
+
+	// run the program, recording its PID so that it can be killed
+	cmd := append([]string{"sh", "-c", "echo $$ > " + execPidFile + "; exec \"$@\"", "sh"}, cs.progArgv...)
+	out := &limitedBuffer{limit: maxTestOutput}
+	code, err := cs.Container.ExecInput(ctx, cmd, strings.NewReader(test.Input), out, ioutil.Discard)
+	if err != nil {
+		return "", "", err
+	}
+	output = out.String()
+	switch {
+	case tctx.Err() == context.DeadlineExceeded && ctx.Err() == nil:
+		return "timeout", output, nil
+	case code != 0:
+		return "error", output, nil
+	case normalizeOutput(output) != normalizeOutput(test.Expected):
+		return "failed", output, nil
+	default:
+		return "passed", output, nil
+	}
+}
+
+// runGrading runs the submission against the visible and hidden tests of the assignment.
+func (cs *ContainerSession) runGrading(ctx context.Context) (*GradeResult, error) {
+	a := cs.Options.Assignment
+	res := &GradeResult{
+		Assignment: a.ID,
+		Total:      len(a.Tests) + len(a.HiddenTests),
+		Tests:      []TestVerdict{},
+	}
+	run := func(test AssignmentTest, hidden bool) error {
+		verdict, output, err := cs.runTest(ctx, test)
+		if err != nil {
+			return err
+		}
+		cs.Events.Record("test", verdict)
+		v := TestVerdict{Verdict: verdict, Hidden: hidden}
+		if !hidden {
+			v.Name = test.Name
+			v.Output = output
+		}
+		if verdict == "passed" {
+			res.Passed++
+		}
+		res.Tests = append(res.Tests, v)
+		return nil
+	}
+	for _, test := range a.Tests {
+		err := run(test, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, test := range a.HiddenTests {
+		err := run(test, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeOutput(t *testing.T) {
+	tbl := []struct {
+		a, b  string
+		equal bool
+	}{
+		{a: "hello\n", b: "hello", equal: true},
+		{a: "a  \r\nb\t\n\n", b: "a\nb", equal: true},
+		{a: "a\n\nb", b: "a\nb", equal: false},
+		{a: " a", b: "a", equal: false},
+	}
+	for _, v := range tbl {
+		if eq := normalizeOutput(v.a) == normalizeOutput(v.b); eq != v.equal {
+			t.Errorf("comparing %q and %q: expected equal=%v", v.a, v.b, v.equal)
+		}
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	lb := &limitedBuffer{limit: 4}
+	for _, s := range []string{"ab", "cde", "f"} {
+		n, err := lb.Write([]byte(s))
+		if err != nil || n != len(s) {
+			t.Fatalf("write %q returned %d, %v", s, n, err)
+		}
+	}
+	if lb.String() != "abcd" {
+		t.Errorf("expected %q but got %q", "abcd", lb.String())
+	}
+}
+
+func TestAssignmentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "assignments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "assignments.json")
+
+	as, err := OpenAssignmentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := Assignment{
+		ID:          "sum",
+		Language:    "python3",
+		Statement:   "Print the sum of two numbers.",
+		Tests:       []AssignmentTest{{Name: "small", Input: "1 2", Expected: "3"}},
+		HiddenTests: []AssignmentTest{{Name: "large", Input: "1000000 2000000", Expected: "3000000"}},
+	}
+	err = as.Put(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = as.Put(Assignment{ID: "other", Language: "python3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := as.Delete("other")
+	if err != nil || !ok {
+		t.Fatalf("failed to delete assignment: %v", err)
+	}
+
+	// assignments persist across reopening
+	as, err = OpenAssignmentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := as.List(); len(l) != 1 || l[0].ID != "sum" {
+		t.Fatalf("unexpected assignments %v", l)
+	}
+	got, ok := as.Get("sum")
+	if !ok || len(got.HiddenTests) != 1 {
+		t.Fatalf("hidden tests not persisted: %v", got)
+	}
+	if pub := got.public(); len(pub.HiddenTests) != 0 || len(pub.Tests) != 1 {
+		t.Errorf("public view exposes hidden tests: %v", pub)
+	}
+}
+
+func TestAssignmentValidate(t *testing.T) {
+	langs := map[string]Language{"python3": {}}
+	tests := []AssignmentTest{{Expected: "3"}}
+	tbl := []struct {
+		a     Assignment
+		valid bool
+	}{
+		{a: Assignment{ID: "sum-1", Language: "python3", Tests: tests}, valid: true},
+		{a: Assignment{ID: "sum", Language: "python3", HiddenTests: tests}, valid: true},
+		{a: Assignment{ID: "Sum/1", Language: "python3", Tests: tests}, valid: false},
+		{a: Assignment{ID: "sum", Language: "cobol", Tests: tests}, valid: false},
+		{a: Assignment{ID: "sum", Language: "python3"}, valid: false},
+	}
+	for _, v := range tbl {
+		if err := v.a.validate(langs); (err == nil) != v.valid {
+			t.Errorf("validating %+v: expected valid=%v but got %v", v.a, v.valid, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditQueueSize is the number of audit records which may wait to be written, beyond which records are dropped.
+const auditQueueSize = 1024
+
+// maxAuditCode is the maximum amount of code included in an audit record.
+const maxAuditCode = 64 << 10
+
+// auditDropped counts the audit records which were dropped because the sink could not keep up.
+var auditDropped = &Counter{
+	Name: "openrepl_audit_dropped_total",
+	Help: "Number of audit records dropped because the audit sink was too slow.",
+}
+
+func init() {
+	metrics.Register(auditDropped)
+}
+
+// AuditRecord is the record of code executed in a session, kept for abuse investigations.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session"`
+	Remote    string    `json:"remote"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	Language  string    `json:"language"`
+
+	// Kind is the kind of session ("run" or "term").
+	Kind string `json:"kind"`
+
+	// CodeHash is the hex SHA-256 hash of the code of a run, and CodeSize is its size in bytes.
+	CodeHash string `json:"code_sha256,omitempty"`
+	CodeSize int    `json:"code_size,omitempty"`
+
+	// Code is the redacted code of the run, if code is included in the audit log.
+	Code string `json:"code,omitempty"`
+
+	// CodeTruncated is set if the redacted code was cut to maxAuditCode bytes.
+	CodeTruncated bool `json:"code_truncated,omitempty"`
+}
+
+// AuditSink writes audit records.
+type AuditSink interface {
+	WriteAudit(rec AuditRecord) error
+}
+
+// Auditor writes the records of executed code to an AuditSink in the background.
+// A nil Auditor records nothing.
+type Auditor struct {
+	Sink AuditSink
+
+	// IncludeCode is whether the code itself is recorded, rather than only its hash.
+	IncludeCode bool
+
+	// Redact matches the parts of the code which are replaced with "[REDACTED]" (e.g. credentials).
+	// If nil, code is recorded as is.
+	Redact *regexp.Regexp
+
+	// SampleRate is the fraction of sessions which are recorded.
+	SampleRate float64
+
+	once  sync.Once
+	queue chan AuditRecord
+}
+
+// Record queues the record of a session for writing, adding the code of a run.
+func (a *Auditor) Record(rec AuditRecord, code []byte) {
+	if a == nil || (a.SampleRate < 1 && rand.Float64() >= a.SampleRate) {
+		return
+	}
+	if code != nil {
+		sum := sha256.Sum256(code)
+		rec.CodeHash, rec.CodeSize = hex.EncodeToString(sum[:]), len(code)
+		if a.IncludeCode {
+			if a.Redact != nil {
+				code = a.Redact.ReplaceAll(code, []byte("[REDACTED]"))
+			}
+			if len(code) > maxAuditCode {
+				code, rec.CodeTruncated = code[:maxAuditCode], true
+			}
+			rec.Code = string(code)
+		}
+	}
+
+	a.once.Do(func() {
+		a.queue = make(chan AuditRecord, auditQueueSize)
+		go a.run()
+	})
+	select {
+	case a.queue <- rec:
+	default:
+		auditDropped.Add(1)
+	}
+}
+
+// run writes queued records to the sink.
+func (a *Auditor) run() {
+	for rec := range a.queue {
+		err := a.Sink.WriteAudit(rec)
+		if err != nil {
+			Logger{Session: rec.Session}.Errorf("failed to write audit record: %s", err.Error())
+		}
+	}
+}
+
+// audit records the session in the audit log, with the code of a run.
+func (cs *ContainerSession) audit(code []byte) {
+	cs.Config.Audit.Record(AuditRecord{
+		Time:      time.Now(),
+		Session:   cs.ID,
+		Remote:    remoteIP(cs.Remote),
+		Tenant:    cs.Tenant,
+		Principal: cs.Options.Principal,
+		Language:  cs.ContainerConfig.Language,
+		Kind:      cs.kind(),
+	}, code)
+}
+
+// FileAuditSink appends audit records to a file as JSON lines.
+type FileAuditSink struct {
+	lck sync.Mutex
+	f   *os.File
+}
+
+// OpenFileAuditSink opens a file for appending audit records, creating it if it does not exist.
+func OpenFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{f: f}, nil
+}
+
+func (fs *FileAuditSink) WriteAudit(rec AuditRecord) error {
+	dat, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	fs.lck.Lock()
+	defer fs.lck.Unlock()
+	_, err = fs.f.Write(append(dat, '\n'))
+	return err
+}
+
+// SyslogAuditSink sends audit records to syslog as JSON messages.
+type SyslogAuditSink struct {
+	w *syslog.Writer
+}
+
+// OpenSyslogAuditSink connects to the local syslog daemon.
+func OpenSyslogAuditSink() (*SyslogAuditSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "openrepl-audit")
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogAuditSink{w: w}, nil
+}
+
+func (ss *SyslogAuditSink) WriteAudit(rec AuditRecord) error {
+	dat, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return ss.w.Info(string(dat))
+}
+
+// WebhookAuditSink posts audit records to a webhook as JSON.
+type WebhookAuditSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (ws *WebhookAuditSink) WriteAudit(rec AuditRecord) error {
+	dat, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	resp, err := ws.Client.Post(ws.URL, "application/json", bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// openAuditSink opens the sink selected by a flag, which is "syslog", a webhook URL or a file path.
+func openAuditSink(dst string) (AuditSink, error) {
+	switch {
+	case dst == "syslog":
+		return OpenSyslogAuditSink()
+	case strings.HasPrefix(dst, "http://") || strings.HasPrefix(dst, "https://"):
+		return &WebhookAuditSink{URL: dst, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+	default:
+		return OpenFileAuditSink(dst)
+	}
+}
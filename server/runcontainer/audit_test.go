@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chanAuditSink is an AuditSink which sends records to a channel.
+type chanAuditSink chan AuditRecord
+
+func (cs chanAuditSink) WriteAudit(rec AuditRecord) error {
+	cs <- rec
+	return nil
+}
+
+func TestAuditor(t *testing.T) {
+	sink := make(chanAuditSink, 1)
+	a := &Auditor{
+		Sink:        sink,
+		IncludeCode: true,
+		Redact:      regexp.MustCompile(`sk_[0-9a-z]+`),
+		SampleRate:  1,
+	}
+	a.Record(AuditRecord{Session: "abc", Kind: "run"}, []byte(`key = "sk_live123"`))
+
+	select {
+	case rec := <-sink:
+		if rec.Code != `key = "[REDACTED]"` {
+			t.Errorf("expected redacted code, got %q", rec.Code)
+		}
+		if len(rec.CodeHash) != 64 || rec.CodeSize != 18 {
+			t.Errorf("unexpected code hash %q and size %d", rec.CodeHash, rec.CodeSize)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("audit record not written")
+	}
+
+	// sessions outside of the sample are not recorded
+	a.SampleRate = 0
+	a.Record(AuditRecord{Session: "def", Kind: "term"}, nil)
+	select {
+	case rec := <-sink:
+		t.Fatalf("unexpected record %+v", rec)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	sink, err := OpenFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"abc", "def"} {
+		if err := sink.WriteAudit(AuditRecord{Session: id, Language: "python3", Kind: "run"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(dat)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", dat)
+	}
+	var rec AuditRecord
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil || rec.Session != "def" {
+		t.Errorf("unexpected record %s", lines[1])
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Principal is an authenticated client, with which sessions are associated for quotas and auditing.
+type Principal struct {
+	// ID identifies the client, such as the name of an API key or the subject of a token.
+	ID string `json:"id"`
+
+	// Tenant is the tenant which the client belongs to, if any.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Authenticator authenticates the clients of session requests.
+type Authenticator interface {
+	// Authenticate returns the principal which sent the request.
+	// If the request carries no credentials handled by the Authenticator, errNoCredentials is returned.
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+var (
+	errNoCredentials      = errors.New("no credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// requestToken returns the bearer token of a request.
+// Browsers cannot set headers on websocket connections, so it may also be passed as the access_token query parameter.
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// APIKey is a static API key, stored as the hex-encoded SHA-256 hash of the key.
+type APIKey struct {
+	Principal
+	Hash string `json:"key_sha256"`
+}
+
+// APIKeys authenticates clients with static API keys, sent as a bearer token or in the X-Api-Key header.
+type APIKeys []APIKey
+
+// LoadAPIKeys loads a JSON list of API keys.
+func LoadAPIKeys(path string) (APIKeys, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys APIKeys
+	err = json.Unmarshal(dat, &keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.ID == "" || len(k.Hash) != 2*sha256.Size {
+			return nil, errors.New("API keys need an id and a SHA-256 hash")
+		}
+	}
+	return keys, nil
+}
+
+// Authenticate looks up the API key of the request.
+func (keys APIKeys) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		key = requestToken(r)
+	}
+	if key == "" || strings.Count(key, ".") == 2 {
+		// JWTs are left to other authenticators
+		return Principal{}, errNoCredentials
+	}
+	h := sha256.Sum256([]byte(key))
+	hash := []byte(hex.EncodeToString(h[:]))
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(hash, []byte(strings.ToLower(k.Hash))) == 1 {
+			return k.Principal, nil
+		}
+	}
+	return Principal{}, errInvalidCredentials
+}
+
+// JWTAuthenticator authenticates clients with signed JSON web tokens.
+type JWTAuthenticator struct {
+	// HMACKey is the key of tokens signed with HS256.
+	HMACKey []byte
+
+	// RSAKey is the public key of tokens signed with RS256.
+	RSAKey *rsa.PublicKey
+
+	// Issuer and Audience are the required issuer and audience of tokens.
+	// If empty, they are not checked.
+	Issuer   string
+	Audience string
+
+	// TenantClaim is the name of the claim containing the tenant of the principal.
+	// If empty, principals have no tenant.
+	TenantClaim string
+
+	// Leeway is the clock skew tolerated when checking expiry.
+	Leeway time.Duration
+}
+
+// LoadRSAPublicKey loads a PEM-encoded RSA public key.
+func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rkey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key: " + path)
+	}
+	return rkey, nil
+}
+
+// audience is the aud claim, which may be a string or a list of strings.
+type audience []string
+
+func (aud *audience) UnmarshalJSON(dat []byte) error {
+	var s string
+	if json.Unmarshal(dat, &s) == nil {
+		*aud = audience{s}
+		return nil
+	}
+	return json.Unmarshal(dat, (*[]string)(aud))
+}
+
+// Authenticate validates the bearer token of the request.
+func (ja *JWTAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	tok := requestToken(r)
+	if strings.Count(tok, ".") != 2 {
+		return Principal{}, errNoCredentials
+	}
+	claims, err := ja.verify(tok, time.Now())
+	if err != nil {
+		return Principal{}, err
+	}
+	var p Principal
+	json.Unmarshal(claims["sub"], &p.ID)
+	if p.ID == "" {
+		return Principal{}, errors.New("token has no subject")
+	}
+	if ja.TenantClaim != "" {
+		json.Unmarshal(claims[ja.TenantClaim], &p.Tenant)
+	}
+	return p, nil
+}
+
+// verify checks the signature and registered claims of a token, returning its claims.
+func (ja *JWTAuthenticator) verify(tok string, now time.Time) (map[string]json.RawMessage, error) {
+	parts := strings.Split(tok, ".")
+	var hdr struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &hdr); err != nil {
+		return nil, errInvalidCredentials
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	// check signature with the key of the algorithm
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+	switch {
+	case hdr.Alg == "HS256" && ja.HMACKey != nil:
+		mac := hmac.New(sha256.New, ja.HMACKey)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errInvalidCredentials
+		}
+	case hdr.Alg == "RS256" && ja.RSAKey != nil:
+		if rsa.VerifyPKCS1v15(ja.RSAKey, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errInvalidCredentials
+		}
+	default:
+		return nil, errors.New("unsupported token algorithm " + hdr.Alg)
+	}
+
+	// check registered claims
+	var claims map[string]json.RawMessage
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errInvalidCredentials
+	}
+	var reg struct {
+		Issuer    string   `json:"iss"`
+		Audience  audience `json:"aud"`
+		Expires   *int64   `json:"exp"`
+		NotBefore *int64   `json:"nbf"`
+	}
+	if err := decodeJWTPart(parts[1], &reg); err != nil {
+		return nil, errInvalidCredentials
+	}
+	switch {
+	case reg.Expires == nil || now.After(time.Unix(*reg.Expires, 0).Add(ja.Leeway)):
+		return nil, errors.New("token expired")
+	case reg.NotBefore != nil && now.Before(time.Unix(*reg.NotBefore, 0).Add(-ja.Leeway)):
+		return nil, errors.New("token not yet valid")
+	case ja.Issuer != "" && reg.Issuer != ja.Issuer:
+		return nil, errors.New("token has the wrong issuer")
+	case ja.Audience != "" && !inList(ja.Audience, reg.Audience):
+		return nil, errors.New("token has the wrong audience")
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes a base64url-encoded JSON part of a token.
+func decodeJWTPart(part string, v interface{}) error {
+	dat, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(dat, v)
+}
+
+// Authenticators tries each Authenticator in turn, using the first which handles the credentials of a request.
+type Authenticators []Authenticator
+
+// Authenticate authenticates the request with the first Authenticator which recognizes its credentials.
+func (as Authenticators) Authenticate(r *http.Request) (Principal, error) {
+	for _, a := range as {
+		p, err := a.Authenticate(r)
+		if err != errNoCredentials {
+			return p, err
+		}
+	}
+	return Principal{}, errNoCredentials
+}
+
+// principalKey is the context key of the authenticated principal of a request.
+type principalKey struct{}
+
+// requestPrincipal returns the authenticated principal of a request, if any.
+func requestPrincipal(r *http.Request) (Principal, bool) {
+	p, ok := r.Context().Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// requireAuth wraps a session handler so that it requires an authenticated client.
+// The tenant of the request is replaced by the tenant of the principal, so that clients cannot choose it.
+// If no Authenticator is configured, all requests are accepted.
+func (cs *ContainerServer) requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cs.Auth == nil {
+			h(w, r)
+			return
+		}
+		p, err := cs.Auth.Authenticate(r)
+		if err != nil {
+			authFailures.Add(1)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			msg := http.StatusText(http.StatusUnauthorized)
+			if err != errNoCredentials {
+				msg += ": " + err.Error()
+			}
+			http.Error(w, msg, http.StatusUnauthorized)
+			return
+		}
+		r.Header.Del(tenantHeader)
+		if p.Tenant != "" {
+			r.Header.Set(tenantHeader, p.Tenant)
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// authFailures counts rejected session requests.
+var authFailures = &Counter{
+	Name: "openrepl_auth_failures_total",
+	Help: "Number of session requests rejected for missing or invalid credentials.",
+}
+
+func init() {
+	metrics.Register(authFailures)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signJWT generates a token with the claims, signed with HS256 if key is a byte slice or RS256 if it is an RSA key.
+func signJWT(t *testing.T, key interface{}, claims map[string]interface{}) string {
+	alg := "HS256"
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		alg = "RS256"
+	}
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign token: %s", err.Error())
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rkey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err.Error())
+	}
+	hkey := []byte("secret")
+	ja := &JWTAuthenticator{
+		HMACKey:     hkey,
+		RSAKey:      &rkey.PublicKey,
+		Issuer:      "https://auth.example.com",
+		Audience:    "openrepl",
+		TenantClaim: "org",
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "iss": ja.Issuer, "aud": []string{"other", "openrepl"}, "exp": exp, "org": "acme"}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	tbl := []struct {
+		tok string
+		ok  bool
+	}{
+		{signJWT(t, hkey, claims(nil)), true},
+		{signJWT(t, rkey, claims(map[string]interface{}{"aud": "openrepl"})), true},
+		{signJWT(t, []byte("wrong"), claims(nil)), false},
+		{signJWT(t, hkey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), false},
+		{signJWT(t, hkey, claims(map[string]interface{}{"exp": nil})), false},
+		{signJWT(t, hkey, claims(map[string]interface{}{"nbf": exp})), false},
+		{signJWT(t, hkey, claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{signJWT(t, hkey, claims(map[string]interface{}{"aud": "other"})), false},
+		{signJWT(t, hkey, claims(map[string]interface{}{"sub": nil})), false},
+		{"eyJhbGciOiJub25lIn0.eyJzdWIiOiJhbGljZSJ9.", false},
+	}
+	for i, v := range tbl {
+		r := httptest.NewRequest(http.MethodGet, "/run", nil)
+		r.Header.Set("Authorization", "Bearer "+v.tok)
+		p, err := ja.Authenticate(r)
+		if (err == nil) != v.ok {
+			t.Errorf("token %d: expected ok %v but got %v", i, v.ok, err)
+		}
+		if err == nil && p != (Principal{ID: "alice", Tenant: "acme"}) {
+			t.Errorf("token %d: unexpected principal %+v", i, p)
+		}
+	}
+
+	// tokens may be sent as a query parameter by browsers
+	r := httptest.NewRequest(http.MethodGet, "/run?access_token="+signJWT(t, hkey, claims(nil)), nil)
+	if _, err := ja.Authenticate(r); err != nil {
+		t.Errorf("query token rejected: %s", err.Error())
+	}
+	if _, err := ja.Authenticate(httptest.NewRequest(http.MethodGet, "/run", nil)); err != errNoCredentials {
+		t.Errorf("expected errNoCredentials but got %v", err)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	h := sha256.Sum256([]byte("key1"))
+	keys := APIKeys{{Principal: Principal{ID: "ci", Tenant: "builds"}, Hash: hex.EncodeToString(h[:])}}
+	cs := &ContainerServer{Auth: Authenticators{keys, &JWTAuthenticator{HMACKey: []byte("secret")}}}
+	var got Principal
+	var tenant string
+	handler := cs.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = requestPrincipal(r)
+		tenant = r.Header.Get(tenantHeader)
+	})
+
+	tbl := []struct {
+		hdr    string
+		value  string
+		code   int
+		id     string
+		tenant string
+	}{
+		{"X-Api-Key", "key1", http.StatusOK, "ci", "builds"},
+		{"Authorization", "Bearer key1", http.StatusOK, "ci", "builds"},
+		{"Authorization", "Bearer " + signJWT(t, []byte("secret"), map[string]interface{}{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}), http.StatusOK, "bob", ""},
+		{"X-Api-Key", "key2", http.StatusUnauthorized, "", ""},
+		{"", "", http.StatusUnauthorized, "", ""},
+	}
+	for _, v := range tbl {
+		got, tenant = Principal{}, ""
+		r := httptest.NewRequest(http.MethodGet, "/run", nil)
+		r.Header.Set(tenantHeader, "spoofed")
+		if v.hdr != "" {
+			r.Header.Set(v.hdr, v.value)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		if rec.Code != v.code || got.ID != v.id || tenant != v.tenant {
+			t.Errorf("%s %q: expected %d as %q in %q but got %d as %q in %q", v.hdr, v.value, v.code, v.id, v.tenant, rec.Code, got.ID, tenant)
+		}
+	}
+}
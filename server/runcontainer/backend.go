@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ContainerBackend is a container runtime on which session containers are deployed.
+type ContainerBackend interface {
+	// Deploy creates a container for a session and starts its program.
+	// If prestart is not nil, it is called before the program starts.
+	Deploy(ctx context.Context, cc ContainerConfig, session string, prestart func(context.Context, *Container) error) (*Container, error)
+
+	// Remove removes a container along with the resources created for it.
+	Remove(ctx context.Context, c *Container) error
+
+	// CopyTo extracts a tarball into a directory of a container.
+	CopyTo(ctx context.Context, c *Container, dir string, tr io.Reader) error
+
+	// ExecInput runs a command inside a container with the given standard input, copying output to the given writers, and returns the exit code.
+	// If stdin is nil, the command has no input.
+	ExecInput(ctx context.Context, c *Container, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+
+	// Wait waits for the program of a container to exit and returns its exit status.
+	Wait(ctx context.Context, c *Container) (int64, error)
+
+	// Resize changes the terminal size of the program of a container.
+	Resize(ctx context.Context, c *Container, cols uint, rows uint) error
+}
+
+// errRequiresDocker is returned for features which are only available on the Docker backend.
+var errRequiresDocker = errors.New("not supported by this container backend")
+
+// requiresDocker checks whether the session uses features which are implemented with the Docker API, and are unavailable on other backends.
+func (opts SessionOptions) requiresDocker(isrun bool, cc ContainerConfig) bool {
+	return opts.Benchmark > 0 || opts.Watch || opts.Assignment != nil || opts.Grade || opts.Eval || opts.Notebook ||
+		opts.Profile || opts.CoreDump || opts.Diff || opts.Streams || opts.Usage || opts.Workspace != "" || len(opts.Packages) > 0 || cc.NetworkLimits != nil ||
+		(isrun && (cc.usesPipeline() || len(cc.Artifacts) > 0 || cc.ArtifactArchive))
+}
+
+// backend returns the backend on which the containers of a language are deployed.
+// If no backend is configured, containers are deployed with the Docker client.
+func (sc *ContainerSessionConfig) backend(cc ContainerConfig) (ContainerBackend, error) {
+	if cc.Backend != "" {
+		b := sc.Backends[cc.Backend]
+		if b == nil {
+			return nil, errors.New("container backend " + cc.Backend + " is not configured")
+		}
+		return b, nil
+	}
+	if sc.Backend != nil {
+		return sc.Backend, nil
+	}
+	return DockerBackend{Client: sc.DockerClient, StopTimeout: sc.ContainerStopTimeout}, nil
+}
+
+// DockerBackend deploys session containers on a Docker daemon.
+type DockerBackend struct {
+	Client *client.Client
+
+	// StopTimeout is the timeout for removing containers after a failed deployment.
+	StopTimeout time.Duration
+}
+
+// Deploy creates and starts a container with the ContainerConfig.
+func (b DockerBackend) Deploy(ctx context.Context, cc ContainerConfig, session string, prestart func(context.Context, *Container) error) (*Container, error) {
+	return cc.Deploy(ctx, b.Client, session, b.StopTimeout, prestart)
+}
+
+// Remove force-removes the container and its session network.
+func (b DockerBackend) Remove(ctx context.Context, c *Container) error {
+	err := b.Client.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{
+		Force: true,
+	})
+	if c.network != "" {
+		nerr := b.Client.NetworkRemove(ctx, c.network)
+		if nerr != nil {
+			Logger{Session: c.session}.Errorf("failed to remove network: %s", nerr.Error())
+		}
+	}
+	return err
+}
+
+// CopyTo copies the tarball into the container.
+func (b DockerBackend) CopyTo(ctx context.Context, c *Container, dir string, tr io.Reader) error {
+	return b.Client.CopyToContainer(ctx, c.ID, dir, tr, types.CopyToContainerOptions{})
+}
+
+// ExecInput runs the command through a Docker exec instance.
+func (b DockerBackend) ExecInput(ctx context.Context, c *Container, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	// create exec instance
+	ex, err := b.Client.ContainerExecCreate(ctx, c.ID, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// start command
+	resp, err := b.Client.ContainerExecAttach(ctx, ex.ID, types.ExecStartCheck{})
+	if err != nil {
+		return 0, err
+	}
+
+	// send input, closing the input stream once it has been written
+	if stdin != nil {
+		go func() {
+			io.Copy(resp.Conn, stdin)
+			resp.CloseWrite()
+		}()
+	}
+
+	// wait for output to end
+	_, err = stdcopy.StdCopy(stdout, stderr, resp.Reader)
+	resp.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// get exit status
+	insp, err := b.Client.ContainerExecInspect(ctx, ex.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	return insp.ExitCode, nil
+}
+
+// Wait waits for the container to stop.
+func (b DockerBackend) Wait(ctx context.Context, c *Container) (int64, error) {
+	waitch, errch := b.Client.ContainerWait(ctx, c.ID, container.WaitConditionNotRunning)
+	select {
+	case exit := <-waitch:
+		return exit.StatusCode, nil
+	case err := <-errch:
+		return 0, err
+	}
+}
+
+// Resize resizes the container TTY.
+func (b DockerBackend) Resize(ctx context.Context, c *Container, cols uint, rows uint) error {
+	return b.Client.ContainerResize(ctx, c.ID, types.ResizeOptions{Height: rows, Width: cols})
+}
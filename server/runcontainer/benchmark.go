@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// idleEntrypoint is the entrypoint used to keep a container idle while the program is run through exec.
+var idleEntrypoint = []string{"sh", "-c", "while :; do sleep 3600; done"}
+
+// cpuUsageCommand prints the CPU usage of the container cgroup.
+// On cgroup v1 this is in nanoseconds, and on cgroup v2 it is a "usage_usec" line.
+var cpuUsageCommand = []string{"sh", "-c", "cat /sys/fs/cgroup/cpuacct/cpuacct.usage 2>/dev/null || grep usage_usec /sys/fs/cgroup/cpu.stat"}
+
+// BenchmarkStats is a summary of a set of measurements, in seconds.
+type BenchmarkStats struct {
+	Min    float64 `json:"min"`
+	Median float64 `json:"median"`
+	Max    float64 `json:"max"`
+}
+
+// BenchmarkResult is the result of a benchmark.
+type BenchmarkResult struct {
+	// Runs is the number of measured runs.
+	Runs int `json:"runs"`
+
+	// Wall is the wall-clock time of the runs.
+	Wall BenchmarkStats `json:"wall"`
+
+	// CPU is the CPU time used by the runs.
+	CPU BenchmarkStats `json:"cpu"`
+}
+
+// summarize computes BenchmarkStats from a set of durations.
+func summarize(durs []time.Duration) BenchmarkStats {
+	if len(durs) == 0 {
+		return BenchmarkStats{}
+	}
+	sorted := make([]time.Duration, len(durs))
+	copy(sorted, durs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+	return BenchmarkStats{
+		Min:    sorted[0].Seconds(),
+		Median: median.Seconds(),
+		Max:    sorted[len(sorted)-1].Seconds(),
+	}
+}
+
+// programCommand determines the full command line run by the container configuration.
+func (cc ContainerConfig) programCommand(ctx context.Context, cli *client.Client) ([]string, error) {
+	entry := cc.Entrypoint
+	if entry == nil {
+		if cli == nil {
+			return nil, errors.New("the entrypoint must be configured when images cannot be inspected")
+		}
+		img, _, err := cli.ImageInspectWithRaw(ctx, cc.Image)
+		if err != nil {
+			return nil, err
+		}
+		if img.Config != nil {
+			entry = img.Config.Entrypoint
+		}
+	}
+	argv := append(append([]string{}, entry...), cc.Command...)
+	if len(argv) == 0 {
+		return nil, errors.New("no command to run")
+	}
+	return argv, nil
+}
+
+// cpuUsage reads the total CPU time used by the container.
+func (c *Container) cpuUsage(ctx context.Context) (time.Duration, error) {
+	out, code, err := c.ExecOutput(ctx, cpuUsageCommand)
+	if err != nil {
+		return 0, err
+	}
+	if code != 0 {
+		return 0, errors.New("failed to read cgroup cpu usage")
+	}
+	str := strings.TrimSpace(string(out))
+	unit := time.Nanosecond
+	if strings.HasPrefix(str, "usage_usec") {
+		str = strings.TrimSpace(strings.TrimPrefix(str, "usage_usec"))
+		unit = time.Microsecond
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// runBenchmark runs the program once to warm up, and then Options.Benchmark more times while measuring it.
+func (cs *ContainerSession) runBenchmark(ctx context.Context) (*BenchmarkResult, error) {
+	c := cs.Container
+	walls := make([]time.Duration, 0, cs.Options.Benchmark)
+	cpus := make([]time.Duration, 0, cs.Options.Benchmark)
+	for i := 0; i <= cs.Options.Benchmark; i++ {
+		// measure run
+		cpu0, err := c.cpuUsage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		code, err := c.ExecTo(ctx, cs.progArgv, ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			return nil, err
+		}
+		wall := time.Since(start)
+		cpu1, err := c.cpuUsage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if code != 0 {
+			return nil, fmt.Errorf("program exited with status %d", code)
+		}
+
+		// skip warm-up run
+		if i == 0 {
+			continue
+		}
+		walls = append(walls, wall)
+		cpus = append(cpus, cpu1-cpu0)
+	}
+
+	return &BenchmarkResult{
+		Runs: cs.Options.Benchmark,
+		Wall: summarize(walls),
+		CPU:  summarize(cpus),
+	}, nil
+}
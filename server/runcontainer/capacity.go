@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// CapacityQueue limits the number of containers held by sessions across the server.
+// Sessions beyond the limit wait in a queue, ordered by priority and then by arrival.
+// A nil CapacityQueue does not limit sessions.
+type CapacityQueue struct {
+	// Max is the maximum number of containers.
+	Max int
+
+	lck     sync.Mutex
+	used    int
+	seq     uint64
+	waiting []*queueTicket
+}
+
+// queueTicket is the place of a session in the queue.
+type queueTicket struct {
+	priority int
+	seq      uint64
+
+	// pos is the 1-based position in the queue, which is zero once a slot has been granted.
+	pos int
+
+	// ready is closed once a slot has been granted.
+	ready chan struct{}
+
+	// moved is signaled when pos changes.
+	moved chan struct{}
+}
+
+// queueLength is the number of sessions waiting for capacity.
+var queueLength = &Gauge{
+	Name: "openrepl_capacity_queue_length",
+	Help: "Number of sessions waiting for container capacity.",
+}
+
+func init() {
+	metrics.Register(queueLength)
+}
+
+// reposition updates the positions of the waiting tickets.
+// The lock must be held.
+func (q *CapacityQueue) reposition() {
+	for i, t := range q.waiting {
+		if t.pos != i+1 {
+			t.pos = i + 1
+			select {
+			case t.moved <- struct{}{}:
+			default:
+			}
+		}
+	}
+	queueLength.Set(float64(len(q.waiting)))
+}
+
+// remove removes a ticket from the queue, returning false if it was not waiting.
+// The lock must be held.
+func (q *CapacityQueue) remove(t *queueTicket) bool {
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.reposition()
+			return true
+		}
+	}
+	return false
+}
+
+// release frees a slot, handing it to the first waiting session.
+func (q *CapacityQueue) release() {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	if len(q.waiting) == 0 {
+		q.used--
+		return
+	}
+	t := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	t.pos = 0
+	close(t.ready)
+	q.reposition()
+}
+
+// Acquire waits for a slot, calling notify with the position of the session whenever it changes while queued.
+// Sessions with a higher priority are served first.
+// The returned function releases the slot.
+func (q *CapacityQueue) Acquire(ctx context.Context, priority int, notify func(pos int) error) (func(), error) {
+	if q == nil || q.Max <= 0 {
+		return func() {}, nil
+	}
+	var once sync.Once
+	release := func() { once.Do(q.release) }
+
+	// take a free slot if nobody is waiting
+	q.lck.Lock()
+	if q.used < q.Max && len(q.waiting) == 0 {
+		q.used++
+		q.lck.Unlock()
+		return release, nil
+	}
+
+	// join the queue behind sessions of the same or higher priority
+	q.seq++
+	t := &queueTicket{priority: priority, seq: q.seq, ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	i := sort.Search(len(q.waiting), func(i int) bool {
+		return q.waiting[i].priority < priority
+	})
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = t
+	q.reposition()
+	q.lck.Unlock()
+
+	// wait for a slot, leaving the queue on failure
+	leave := func(err error) (func(), error) {
+		q.lck.Lock()
+		waiting := q.remove(t)
+		q.lck.Unlock()
+		if !waiting {
+			// a slot was granted concurrently
+			release()
+		}
+		return nil, err
+	}
+	for {
+		select {
+		case <-t.ready:
+			return release, nil
+		case <-t.moved:
+			q.lck.Lock()
+			pos := t.pos
+			q.lck.Unlock()
+			if pos == 0 {
+				continue
+			}
+			if err := notify(pos); err != nil {
+				return leave(err)
+			}
+		case <-ctx.Done():
+			return leave(ctx.Err())
+		}
+	}
+}
+
+// Status returns the number of slots in use and the number of waiting sessions.
+func (q *CapacityQueue) Status() (used int, waiting int) {
+	if q == nil {
+		return 0, 0
+	}
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	return q.used, len(q.waiting)
+}
+
+// parseTenantPriorities parses comma-separated tenant=priority pairs.
+func parseTenantPriorities(str string) (map[string]int, error) {
+	m := make(map[string]int)
+	for tenant, p := range parseKeyValues(str) {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, errors.New("invalid priority for tenant " + tenant + ": " + p)
+		}
+		m[tenant] = v
+	}
+	return m, nil
+}
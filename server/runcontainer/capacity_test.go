@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCapacityQueue(t *testing.T) {
+	q := &CapacityQueue{Max: 1}
+	nop := func(int) error { return nil }
+	release, err := q.Acquire(context.Background(), 0, nop)
+	if err != nil {
+		t.Fatalf("failed to acquire: %s", err.Error())
+	}
+
+	// queue sessions, with a high-priority session arriving last
+	var lck sync.Mutex
+	var order []string
+	var positions = make(map[string][]int)
+	var wg sync.WaitGroup
+	start := func(name string, priority int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rel, err := q.Acquire(context.Background(), priority, func(pos int) error {
+				lck.Lock()
+				defer lck.Unlock()
+				positions[name] = append(positions[name], pos)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("%s: failed to acquire: %s", name, err.Error())
+				return
+			}
+			lck.Lock()
+			order = append(order, name)
+			lck.Unlock()
+			rel()
+		}()
+	}
+	waitQueued := func(n int) {
+		for i := 0; i < 100; i++ {
+			if _, waiting := q.Status(); waiting == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("expected %d waiting sessions", n)
+	}
+	start("a", 0)
+	waitQueued(1)
+	start("b", 0)
+	waitQueued(2)
+	start("c", 1)
+	waitQueued(3)
+
+	// the high-priority session moves ahead of the others
+	expect := map[string]int{"c": 1, "a": 2, "b": 3}
+	for i := 0; ; i++ {
+		lck.Lock()
+		done := true
+		for name, pos := range expect {
+			p := positions[name]
+			done = done && len(p) > 0 && p[len(p)-1] == pos
+		}
+		lck.Unlock()
+		if done {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("unexpected positions %v", positions)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	wg.Wait()
+
+	if len(order) != 3 || order[0] != "c" || order[1] != "a" || order[2] != "b" {
+		t.Errorf("unexpected order %v", order)
+	}
+	if used, waiting := q.Status(); used != 0 || waiting != 0 {
+		t.Errorf("expected empty queue but got %d used and %d waiting", used, waiting)
+	}
+}
+
+func TestCapacityQueueTimeout(t *testing.T) {
+	q := &CapacityQueue{Max: 1}
+	nop := func(int) error { return nil }
+	release, err := q.Acquire(context.Background(), 0, nop)
+	if err != nil {
+		t.Fatalf("failed to acquire: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Acquire(ctx, 0, nop); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded but got %v", err)
+	}
+	release()
+	if used, waiting := q.Status(); used != 0 || waiting != 0 {
+		t.Errorf("expected empty queue but got %d used and %d waiting", used, waiting)
+	}
+
+	var nilq *CapacityQueue
+	if _, err := nilq.Acquire(context.Background(), 0, nop); err != nil {
+		t.Errorf("nil queue rejected session: %s", err.Error())
+	}
+}
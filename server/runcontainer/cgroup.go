@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cgroup2Config is a set of resource controls which are only available with cgroup v2.
+// These allow gentler throttling than the hard limits enforced by Docker.
+type Cgroup2Config struct {
+	// MemoryHigh is the memory.high soft limit in bytes, above which the container is throttled and reclaimed.
+	MemoryHigh int64 `json:"memory_high,omitempty"`
+
+	// CPUBurst is the cpu.max.burst allowance in microseconds, which lets the container exceed its CPU quota briefly.
+	CPUBurst int64 `json:"cpu_burst,omitempty"`
+
+	// IOWeight is the io.weight (1-10000) of the container relative to other containers.
+	IOWeight int `json:"io_weight,omitempty"`
+}
+
+// CgroupFS is a cgroup v2 hierarchy of the Docker host, used to apply Cgroup2Config controls.
+// The controls are applied to a parent cgroup created for each session, so that they are in place before the program starts.
+// A nil CgroupFS does not apply any controls.
+type CgroupFS struct {
+	// Root is the path at which the host cgroup hierarchy is mounted (e.g. "/sys/fs/cgroup").
+	Root string
+}
+
+// cgroupSessions is the cgroup below Root containing the parent cgroups of sessions.
+const cgroupSessions = "openrepl"
+
+// cgroupControllers are the controllers enabled for the cgroups of sessions.
+const cgroupControllers = "+cpu +io +memory +pids"
+
+// cpuPeriod is the cpu.max period in microseconds.
+const cpuPeriod = 100000
+
+var (
+	// errNoCgroup2 is returned when the host does not use a unified cgroup hierarchy.
+	errNoCgroup2 = errors.New("host is not using cgroup v2")
+
+	// errCgroupSystemd is returned when the Docker daemon uses the systemd cgroup driver, with which parent cgroups must be systemd slices.
+	errCgroupSystemd = errors.New("cgroup v2 controls require the cgroupfs driver of the Docker daemon")
+)
+
+// openCgroupFS checks for a cgroup v2 hierarchy at root, in which the Docker daemon creates cgroups with driver.
+func openCgroupFS(root string, driver string) (*CgroupFS, error) {
+	if driver == "systemd" {
+		return nil, errCgroupSystemd
+	}
+	_, err := os.Stat(filepath.Join(root, "cgroup.controllers"))
+	if os.IsNotExist(err) {
+		return nil, errNoCgroup2
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CgroupFS{Root: root}, nil
+}
+
+// sessionPath returns the path of the parent cgroup of the container of a session.
+func (fs *CgroupFS) sessionPath(session string) string {
+	return filepath.Join(fs.Root, cgroupSessions, session)
+}
+
+// create creates the parent cgroup of the container of a session with the controls, returning its path relative to Root.
+// Returns an empty path if there are no controls to apply.
+// If the controls include a CPU burst, the CPU limit of the container is enforced by the parent cgroup instead, as the burst only applies along with its quota.
+func (fs *CgroupFS) create(session string, cfg *Cgroup2Config) (string, error) {
+	if fs == nil || cfg == nil {
+		return "", nil
+	}
+
+	// enable the controllers down to the cgroup of the session
+	sessions := filepath.Join(fs.Root, cgroupSessions)
+	err := os.MkdirAll(sessions, 0755)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range []string{fs.Root, sessions} {
+		err = ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(cgroupControllers), 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+	dir := fs.sessionPath(session)
+	err = os.Mkdir(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	// generate control file values
+	var files [][2]string
+	if cfg.MemoryHigh > 0 {
+		files = append(files, [2]string{"memory.high", strconv.FormatInt(cfg.MemoryHigh, 10)})
+	}
+	if cfg.CPUBurst > 0 {
+		quota := sessionNanoCPUs * cpuPeriod / int64(time.Second/time.Nanosecond)
+		files = append(files, [2]string{"cpu.max", strconv.FormatInt(quota, 10) + " " + strconv.Itoa(cpuPeriod)})
+		files = append(files, [2]string{"cpu.max.burst", strconv.FormatInt(cfg.CPUBurst, 10)})
+	}
+	if cfg.IOWeight > 0 {
+		files = append(files, [2]string{"io.weight", "default " + strconv.Itoa(cfg.IOWeight)})
+	}
+
+	// write control files
+	for _, f := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, f[0]), []byte(f[1]), 0644)
+		if err != nil {
+			fs.remove(session)
+			return "", err
+		}
+	}
+	return "/" + cgroupSessions + "/" + session, nil
+}
+
+// usage reads the CPU time and peak memory usage of the parent cgroup of a session, which includes its container even once it has stopped.
+// The peak memory usage is zero on kernels without memory.peak (before 5.19).
+func (fs *CgroupFS) usage(session string) (time.Duration, uint64, error) {
+	if fs == nil {
+		return 0, 0, errResourceUnsupported
+	}
+	dir := fs.sessionPath(session)
+	dat, err := ioutil.ReadFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	var cpu time.Duration
+	s := bufio.NewScanner(bytes.NewReader(dat))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usec, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, 0, err
+			}
+			cpu = time.Duration(usec) * time.Microsecond
+		}
+	}
+	var peak uint64
+	dat, err = ioutil.ReadFile(filepath.Join(dir, "memory.peak"))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return 0, 0, err
+	default:
+		peak, err = strconv.ParseUint(strings.TrimSpace(string(dat)), 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return cpu, peak, nil
+}
+
+// remove removes the parent cgroup of a session once its container has been removed.
+func (fs *CgroupFS) remove(session string) error {
+	if fs == nil {
+		return nil
+	}
+	err := os.Remove(fs.sessionPath(session))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
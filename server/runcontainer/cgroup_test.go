@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCgroupFS(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgrouptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if _, err := openCgroupFS(root, "cgroupfs"); err != errNoCgroup2 {
+		t.Errorf("expected errNoCgroup2, got %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu io memory pids"), 0644)
+	if _, err := openCgroupFS(root, "systemd"); err != errCgroupSystemd {
+		t.Errorf("expected errCgroupSystemd, got %v", err)
+	}
+	fs, err := openCgroupFS(root, "cgroupfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sessions without controls have no parent cgroup
+	if parent, err := fs.create("s1", nil); parent != "" || err != nil {
+		t.Errorf("unexpected parent %q (%v)", parent, err)
+	}
+
+	// the controls are written to the parent cgroup, which also enforces the CPU limit along with the burst
+	parent, err := fs.create("s1", &Cgroup2Config{MemoryHigh: 1 << 20, CPUBurst: 20000, IOWeight: 50})
+	if parent != "/openrepl/s1" || err != nil {
+		t.Fatalf("unexpected parent %q (%v)", parent, err)
+	}
+	for file, expect := range map[string]string{
+		"cgroup.subtree_control":          cgroupControllers,
+		"openrepl/cgroup.subtree_control": cgroupControllers,
+		"openrepl/s1/memory.high":         "1048576",
+		"openrepl/s1/cpu.max":             "50000 100000",
+		"openrepl/s1/cpu.max.burst":       "20000",
+		"openrepl/s1/io.weight":           "default 50",
+	} {
+		dat, err := ioutil.ReadFile(filepath.Join(root, file))
+		if err != nil || string(dat) != expect {
+			t.Errorf("expected %s to be %q, got %q (%v)", file, expect, dat, err)
+		}
+	}
+	cc := ContainerConfig{Cgroup2: &Cgroup2Config{CPUBurst: 20000}, cgroupParent: parent}
+	if n := cc.nanoCPUs(); n != 0 {
+		t.Errorf("expected the container to have no CPU limit of its own, got %d", n)
+	}
+
+	// the parent cgroup is removed with the session
+	for _, f := range []string{"memory.high", "cpu.max", "cpu.max.burst", "io.weight"} {
+		os.Remove(filepath.Join(fs.sessionPath("s1"), f))
+	}
+	if err := fs.remove("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fs.sessionPath("s1")); !os.IsNotExist(err) {
+		t.Errorf("expected parent cgroup to be removed, got %v", err)
+	}
+	if err := fs.remove("s1"); err != nil {
+		t.Errorf("expected removing a missing cgroup to succeed, got %v", err)
+	}
+}
+
+func TestCgroupUsage(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgrouptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &CgroupFS{Root: root}
+	if _, _, err := fs.usage("s1"); !os.IsNotExist(err) {
+		t.Errorf("expected missing cgroup, got %v", err)
+	}
+	dir := fs.sessionPath("s1")
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "cpu.stat"), []byte("usage_usec 1500000\nuser_usec 1000000\nsystem_usec 500000\n"), 0644)
+	if cpu, peak, err := fs.usage("s1"); cpu != 1500*time.Millisecond || peak != 0 || err != nil {
+		t.Errorf("unexpected usage %v, %d (%v)", cpu, peak, err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "memory.peak"), []byte("4194304\n"), 0644)
+	if cpu, peak, err := fs.usage("s1"); cpu != 1500*time.Millisecond || peak != 4<<20 || err != nil {
+		t.Errorf("unexpected usage %v, %d (%v)", cpu, peak, err)
+	}
+	if _, _, err := (*CgroupFS)(nil).usage("s1"); err != errResourceUnsupported {
+		t.Errorf("expected errResourceUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Chaos injects failures into sessions, so that the retry and error paths can be exercised during development.
+// A nil Chaos injects no failures.
+type Chaos struct {
+	// DeployDelay is the delay added before every deployment, simulating a slow image pull.
+	DeployDelay time.Duration
+
+	// AttachFailRate is the probability that attaching to a container fails.
+	AttachFailRate float64
+
+	// KillRate is the probability that the container of a session is killed.
+	KillRate float64
+
+	// KillWindow is the period after startup within which containers are killed.
+	KillWindow time.Duration
+
+	// DropRate is the probability that an output frame is dropped instead of being sent to the client.
+	DropRate float64
+}
+
+// errChaosAttach is the error injected in place of an attach failure.
+var errChaosAttach = errors.New("chaos: injected attach failure")
+
+// parseChaos parses a chaos configuration in key=value form (e.g. "deploy_delay=2s,attach_fail=0.2").
+// Returns nil if the configuration is empty.
+func parseChaos(str string) (*Chaos, error) {
+	kv := parseKeyValues(str)
+	if len(kv) == 0 {
+		return nil, nil
+	}
+	ch := &Chaos{KillWindow: time.Minute}
+	for k, v := range kv {
+		var err error
+		switch k {
+		case "deploy_delay":
+			ch.DeployDelay, err = time.ParseDuration(v)
+		case "attach_fail":
+			ch.AttachFailRate, err = strconv.ParseFloat(v, 64)
+		case "kill":
+			ch.KillRate, err = strconv.ParseFloat(v, 64)
+		case "kill_window":
+			ch.KillWindow, err = time.ParseDuration(v)
+		case "drop":
+			ch.DropRate, err = strconv.ParseFloat(v, 64)
+		default:
+			return nil, fmt.Errorf("unknown chaos option %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid chaos option %q: %s", k, err.Error())
+		}
+	}
+	return ch, nil
+}
+
+// roll returns true with the given probability.
+func (ch *Chaos) roll(p float64) bool {
+	return ch != nil && p > 0 && rand.Float64() < p
+}
+
+// delayDeploy waits for the deploy delay, returning early if the context expires.
+func (ch *Chaos) delayDeploy(ctx context.Context) {
+	if ch == nil || ch.DeployDelay <= 0 {
+		return
+	}
+	timer := time.NewTimer(ch.DeployDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// wrapPrestart wraps a prestart hook so that it may fail before the container is attached.
+func (ch *Chaos) wrapPrestart(prestart func(context.Context, *Container) error) func(context.Context, *Container) error {
+	if ch == nil || ch.AttachFailRate <= 0 {
+		return prestart
+	}
+	return func(ctx context.Context, c *Container) error {
+		if prestart != nil {
+			err := prestart(ctx, c)
+			if err != nil {
+				return err
+			}
+		}
+		if ch.roll(ch.AttachFailRate) {
+			return errChaosAttach
+		}
+		return nil
+	}
+}
+
+// dropFrame checks whether an output frame should be dropped.
+func (ch *Chaos) dropFrame() bool {
+	return ch != nil && ch.roll(ch.DropRate)
+}
+
+// killContainer may kill the container at a random time within the kill window.
+// Returns when the container is killed or the context expires.
+func (ch *Chaos) killContainer(ctx context.Context, c *Container) {
+	if !ch.roll(ch.KillRate) || ch.KillWindow <= 0 {
+		return
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(ch.KillWindow))))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return
+	}
+	if c.cli == nil {
+		return
+	}
+	serverLog.Printf("chaos: killing container %s", c.ID)
+	err := c.cli.ContainerKill(ctx, c.ID, "KILL")
+	if err != nil {
+		serverLog.Errorf("failed to kill container: %s", err.Error())
+	}
+}
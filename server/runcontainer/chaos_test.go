@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseChaos(t *testing.T) {
+	tbl := []struct {
+		str    string
+		expect *Chaos
+		err    bool
+	}{
+		{
+			str:    "",
+			expect: nil,
+		},
+		{
+			str:    "deploy_delay=2s,attach_fail=0.5",
+			expect: &Chaos{DeployDelay: 2 * time.Second, AttachFailRate: 0.5, KillWindow: time.Minute},
+		},
+		{
+			str:    "kill=0.1,kill_window=10s,drop=0.01",
+			expect: &Chaos{KillRate: 0.1, KillWindow: 10 * time.Second, DropRate: 0.01},
+		},
+		{
+			str: "kill=often",
+			err: true,
+		},
+		{
+			str: "explode=1",
+			err: true,
+		},
+	}
+	for _, v := range tbl {
+		got, err := parseChaos(v.str)
+		if v.err {
+			if err == nil {
+				t.Errorf("expected error parsing %q", v.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", v.str, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(v.expect, got) {
+			t.Errorf("expected %+v but got %+v", v.expect, got)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// checkConfig implements the check-config subcommand, which validates the language configuration and exits.
+// With -images, it also checks that every image used by the languages is present on the Docker daemon.
+// It returns the exit status of the command.
+func checkConfig(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	fs.SetOutput(out)
+	var dockerConfig DockerConfig
+	path := fs.String("langs", "langs.json", "path of the language configuration file")
+	osType := fs.String("os", "linux", "operating system of the containers (linux or windows) whose languages are checked")
+	images := fs.Bool("images", false, "check that the images of the languages are present on the Docker daemon")
+	fs.StringVar(&dockerConfig.Host, "docker-host", "", "address of the Docker daemon (DOCKER_HOST if empty)")
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	langs, err := loadLanguages(*path, *osType, ContainerDefaults{})
+	if err != nil {
+		fmt.Fprintln(out, err.Error())
+		return 1
+	}
+	fmt.Fprintf(out, "%s: %d languages valid\n", *path, len(langs))
+	if !*images {
+		return 0
+	}
+
+	cli, err := dockerConfig.NewClient()
+	if err != nil {
+		fmt.Fprintf(out, "failed to connect to Docker: %s\n", err.Error())
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	users := languageImages(langs)
+	imgs := make([]string, 0, len(users))
+	for img := range users {
+		imgs = append(imgs, img)
+	}
+	sort.Strings(imgs)
+	status := 0
+	for _, img := range imgs {
+		_, _, err := cli.ImageInspectWithRaw(ctx, img)
+		switch {
+		case client.IsErrNotFound(err):
+			fmt.Fprintf(out, "image %s (used by %v) is missing\n", img, users[img])
+			status = 1
+		case err != nil:
+			fmt.Fprintf(out, "failed to inspect image %s: %s\n", img, err.Error())
+			return 1
+		}
+	}
+	if status == 0 {
+		fmt.Fprintf(out, "all %d images present\n", len(imgs))
+	}
+	return status
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// containersCreated counts the containers created for each language.
+var containersCreated = &Counter{
+	Name:   "openrepl_containers_created_total",
+	Help:   "Number of session containers created.",
+	Labels: []string{"language"},
+}
+
+// containersRemoved counts the containers removed for each language.
+var containersRemoved = &Counter{
+	Name:   "openrepl_containers_removed_total",
+	Help:   "Number of session containers removed.",
+	Labels: []string{"language"},
+}
+
+// deployFailures counts the failed container deployments for each language.
+var deployFailures = &Counter{
+	Name:   "openrepl_deploy_failures_total",
+	Help:   "Number of failed container deployments.",
+	Labels: []string{"language"},
+}
+
+// containerLifetime records the time between the creation and removal of each container.
+var containerLifetime = &Histogram{
+	Name:    "openrepl_container_lifetime_seconds",
+	Help:    "Lifetime of session containers.",
+	Labels:  []string{"language"},
+	Buckets: []float64{1, 5, 15, 60, 300, 900, 1800, 3600},
+}
+
+func init() {
+	metrics.Register(containersCreated)
+	metrics.Register(containersRemoved)
+	metrics.Register(deployFailures)
+	metrics.Register(containerLifetime)
+}
+
+// ChurnMonitor alerts when containers are created abnormally fast, or when a large fraction of deployments fail.
+// Container creations are counted over consecutive windows, and compared to a moving average of previous windows.
+type ChurnMonitor struct {
+	// Window is the period over which creations and failures are counted.
+	Window time.Duration
+
+	// SpikeFactor is the ratio to the moving average above which creations in a window are considered a spike.
+	// If zero, spikes are not detected.
+	SpikeFactor float64
+
+	// MaxFailureRatio is the ratio of failed deployments to created containers in a window above which an alert is raised.
+	// If zero, failure ratios are not checked.
+	MaxFailureRatio float64
+
+	// MinCreates is the number of creations in a window below which no alerts are raised.
+	MinCreates int
+
+	// Alerts is the Alerter notified of churn spikes and high failure ratios.
+	Alerts *Alerter
+
+	lck      sync.Mutex
+	created  map[string]float64
+	failed   map[string]float64
+	baseline map[string]float64
+}
+
+// churnSmoothing is the weight of the latest window in the moving average of creations.
+const churnSmoothing = 0.2
+
+// check counts the creations and failures since the last check, raising alerts for abnormal languages.
+func (m *ChurnMonitor) check(created, failed map[string]float64) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	if m.baseline == nil {
+		m.baseline = make(map[string]float64)
+	}
+
+	// the first check only records the totals
+	first := m.created == nil
+	prevCreated, prevFailed := m.created, m.failed
+	m.created, m.failed = created, failed
+	if first {
+		return
+	}
+
+	langs := make([]string, 0, len(created))
+	for lang := range created {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		n := created[lang] - prevCreated[lang]
+		f := failed[lang] - prevFailed[lang]
+
+		// compare with the moving average, which only includes windows with activity
+		base, seen := m.baseline[lang]
+		if n >= float64(m.MinCreates) {
+			if m.SpikeFactor > 0 && seen && n > m.SpikeFactor*base {
+				m.Alerts.Record("container_churn", fmt.Sprintf("%s: %.0f containers created in %s (average %.1f)", lang, n, m.Window, base))
+			}
+			if m.MaxFailureRatio > 0 && f/n > m.MaxFailureRatio {
+				m.Alerts.Record("deploy_failure_ratio", fmt.Sprintf("%s: %.0f of %.0f deployments failed in %s", lang, f, n, m.Window))
+			}
+		}
+		if seen {
+			m.baseline[lang] = (1-churnSmoothing)*base + churnSmoothing*n
+		} else {
+			m.baseline[lang] = n
+		}
+	}
+}
+
+// Run checks container churn after every window.
+func (m *ChurnMonitor) Run() {
+	if m == nil {
+		return
+	}
+	tick := time.NewTicker(m.Window)
+	defer tick.Stop()
+	for ; ; <-tick.C {
+		m.check(containersCreated.Totals(), deployFailures.Totals())
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestChurnMonitor(t *testing.T) {
+	alerts := &Alerter{}
+	m := &ChurnMonitor{SpikeFactor: 3, MaxFailureRatio: 0.5, MinCreates: 10, Alerts: alerts}
+
+	// steady windows establish the baseline
+	created := map[string]float64{"go": 0}
+	failed := map[string]float64{}
+	m.check(created, failed)
+	for i := 1; i <= 3; i++ {
+		created = map[string]float64{"go": float64(20 * i)}
+		m.check(created, failed)
+	}
+	if n := len(alerts.Recent()); n != 0 {
+		t.Fatalf("expected no alerts for steady churn but got %d", n)
+	}
+
+	// a spike with many failures raises both alerts
+	m.check(map[string]float64{"go": 160}, map[string]float64{"go": 80})
+	recent := alerts.Recent()
+	if len(recent) != 2 || recent[0].Kind != "container_churn" || recent[1].Kind != "deploy_failure_ratio" {
+		t.Fatalf("expected churn and failure ratio alerts but got %v", recent)
+	}
+}
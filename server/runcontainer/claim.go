@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Claim is a terminal container deployed in advance for a client which has not connected yet.
+type Claim struct {
+	token string
+
+	// id is the ID of the session which the container is deployed for.
+	id string
+
+	// lang is the name of the language of the container.
+	lang string
+
+	done chan struct{}
+	c    *Container
+	err  error
+
+	expiry *time.Timer
+	once   sync.Once
+}
+
+// wait waits for the deployment of the container to complete.
+func (cl *Claim) wait(ctx context.Context) (*Container, error) {
+	select {
+	case <-cl.done:
+		return cl.c, cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release shuts down the container of a claim which is not used by a session.
+func (cl *Claim) release() {
+	go cl.close()
+}
+
+// close waits for the deployment of a claim to complete, then shuts down its container.
+func (cl *Claim) close() {
+	cl.once.Do(func() {
+		<-cl.done
+		if cl.c != nil {
+			cl.c.Close()
+		}
+	})
+}
+
+// ClaimStore keeps claimed containers until their clients connect.
+// A nil ClaimStore has no claims.
+type ClaimStore struct {
+	// TTL is the amount of time for which a claimed container is kept before it is shut down.
+	TTL time.Duration
+
+	// Max is the maximum number of outstanding claims.
+	Max int
+
+	lck    sync.Mutex
+	claims map[string]*Claim
+}
+
+// errTooManyClaims is returned when the maximum number of outstanding claims is reached.
+var errTooManyClaims = errors.New("too many outstanding claims")
+
+// New starts deploying a container for a claim.
+func (st *ClaimStore) New(lang string, cc ContainerConfig, sc *ContainerSessionConfig) (*Claim, error) {
+	token, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	cl := &Claim{
+		token: token,
+		id:    id,
+		lang:  lang,
+		done:  make(chan struct{}),
+	}
+
+	// shut down the container if the client does not connect in time
+	cl.expiry = time.AfterFunc(st.TTL, func() {
+		if st.Take(token) != nil {
+			cl.release()
+		}
+	})
+
+	st.lck.Lock()
+	if st.claims == nil {
+		st.claims = make(map[string]*Claim)
+	}
+	if len(st.claims) >= st.Max {
+		st.lck.Unlock()
+		cl.expiry.Stop()
+		return nil, errTooManyClaims
+	}
+	st.claims[token] = cl
+	st.lck.Unlock()
+
+	// deploy container
+	go func() {
+		defer close(cl.done)
+		ctx, cancel := context.WithTimeout(context.Background(), sc.StartTimeout)
+		defer cancel()
+		if sc.DeploySlots != nil {
+			cl.err = sc.DeploySlots.acquire(ctx)
+			if cl.err != nil {
+				return
+			}
+			defer sc.DeploySlots.release()
+		}
+		sess := &ContainerSession{ID: id, Config: sc}
+		cl.c, cl.err = sess.deploy(ctx, cc, nil)
+		if cl.err != nil {
+			Logger{Session: id}.Errorf("failed to deploy claimed container: %s", cl.err.Error())
+			sc.Alerts.Record("deploy_failure", cl.err.Error())
+		}
+	}()
+
+	return cl, nil
+}
+
+// Take removes a claim from the store so that it can be bound to a session.
+// Returns nil if there is no such claim, or if it has expired.
+func (st *ClaimStore) Take(token string) *Claim {
+	if st == nil {
+		return nil
+	}
+	st.lck.Lock()
+	defer st.lck.Unlock()
+	cl := st.claims[token]
+	if cl != nil {
+		delete(st.claims, token)
+		cl.expiry.Stop()
+	}
+	return cl
+}
+
+// Clear shuts down the containers of all outstanding claims, waiting for them to be removed.
+func (st *ClaimStore) Clear() {
+	if st == nil {
+		return
+	}
+	st.lck.Lock()
+	claims := st.claims
+	st.claims = nil
+	st.lck.Unlock()
+	var wg sync.WaitGroup
+	for _, cl := range claims {
+		cl.expiry.Stop()
+		wg.Add(1)
+		go func(cl *Claim) {
+			defer wg.Done()
+			cl.close()
+		}(cl)
+	}
+	wg.Wait()
+}
+
+// Len returns the number of outstanding claims.
+func (st *ClaimStore) Len() int {
+	st.lck.Lock()
+	defer st.lck.Unlock()
+	return len(st.claims)
+}
+
+// ClaimInfo is the response to claiming a container.
+type ClaimInfo struct {
+	// Claim is the token passed in the claim query parameter of the terminal websocket.
+	Claim string `json:"claim"`
+
+	// Expires is the number of seconds after which the claim expires.
+	Expires float64 `json:"expires"`
+}
+
+// HandleClaim deploys a terminal container for the language in the lang query parameter, which a client can later bind to with the returned claim token.
+// The locale and timezone are selected when claiming, as the container is already running when the client connects.
+// Claims require the claim token as a bearer token.
+func (cs *ContainerServer) HandleClaim(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if cs.ClaimToken == "" || cs.Claims == nil {
+		http.Error(w, "claims disabled", http.StatusForbidden)
+		return
+	}
+	tok := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(tok), []byte("Bearer "+cs.ClaimToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	// get language
+	sc := &cs.SessionConfig
+	langname := r.URL.Query().Get("lang")
+	lang, ok := cs.languages()[langname]
+	if !ok {
+		http.Error(w, "language not supported", http.StatusBadRequest)
+		return
+	}
+	if platform := sc.Platform(); !lang.SupportsPlatform(platform) {
+		http.Error(w, "language not available on this host", http.StatusBadRequest)
+		return
+	}
+	cc := lang.TermContainer
+	if cc.GPU != nil {
+		http.Error(w, "GPU languages cannot be claimed", http.StatusBadRequest)
+		return
+	}
+
+	// check that a session could be started now
+	if cs.Draining() || !sc.Daemon.Healthy() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "server unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	err := sc.Resources.Check()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// configure the container as the terminal handler would
+	env, err := cs.localeEnv(r.URL.Query(), lang)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cc = cc.withEnv(env...)
+	cc = cc.withCommandVars(CommandVars{
+		EntryFile: cc.entryFile(sc.DaemonOS),
+		WorkDir:   cc.WorkDir,
+	})
+
+	// start deploying
+	cl, err := cs.Claims.New(langname, cc, sc)
+	switch {
+	case err == errTooManyClaims:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		serverLog.Errorf("failed to create claim: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ClaimInfo{Claim: cl.token, Expires: cs.Claims.TTL.Seconds()})
+}
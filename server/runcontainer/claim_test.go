@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClaimStoreTake(t *testing.T) {
+	st := &ClaimStore{TTL: time.Minute, Max: 1}
+	cl := &Claim{token: "a", done: make(chan struct{}), expiry: time.NewTimer(time.Minute)}
+	st.claims = map[string]*Claim{"a": cl}
+
+	// claims can only be taken once
+	if st.Take("a") != cl {
+		t.Fatal("failed to take claim")
+	}
+	if st.Take("a") != nil {
+		t.Error("claim taken twice")
+	}
+	if st.Len() != 0 {
+		t.Errorf("expected no claims but got %d", st.Len())
+	}
+	var nilStore *ClaimStore
+	if nilStore.Take("a") != nil {
+		t.Error("nil store returned a claim")
+	}
+}
+
+func TestClaimWait(t *testing.T) {
+	cl := &Claim{done: make(chan struct{})}
+
+	// waiting is bounded by the context while the container is deploying
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := cl.wait(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded but got %v", err)
+	}
+
+	c := &Container{ID: "test"}
+	cl.c = c
+	close(cl.done)
+	got, err := cl.wait(context.Background())
+	if err != nil || got != c {
+		t.Fatalf("expected deployed container but got %v %v", got, err)
+	}
+}
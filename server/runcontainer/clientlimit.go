@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientLimiter limits the sessions started by each client IP address.
+// A nil ClientLimiter does not limit clients.
+type ClientLimiter struct {
+	// MaxSessions is the maximum number of concurrent sessions of a client.
+	// If zero, the number of sessions is not limited.
+	MaxSessions int
+
+	// Rate is the number of sessions per second which a client may start, with bursts of up to Burst sessions.
+	// If zero, the session rate is not limited.
+	Rate  float64
+	Burst int
+
+	// TrustedProxies are the networks of reverse proxies whose X-Forwarded-For headers are trusted.
+	TrustedProxies []*net.IPNet
+
+	lck       sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+// clientState is the state of the limits of a client.
+type clientState struct {
+	sessions int
+	tokens   float64
+	updated  time.Time
+}
+
+// clientSweepRate is the rate at which the state of idle clients is dropped.
+const clientSweepRate = time.Minute
+
+var (
+	errTooManySessions = errors.New("too many concurrent sessions from this address")
+	errRateLimited     = errors.New("sessions are being started too quickly from this address")
+)
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or IP addresses.
+func parseTrustedProxies(str string) ([]*net.IPNet, error) {
+	if str == "" {
+		return nil, nil
+	}
+	var nets []*net.IPNet
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid trusted proxy " + strconv.Quote(s))
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trusted checks whether an address belongs to a trusted proxy.
+func (cl *ClientLimiter) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range cl.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP strips the port from a remote address.
+func remoteIP(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
+
+// clientKey returns the key by which the sessions of a client are limited.
+// Authenticated clients are limited by principal, and others by IP address.
+func clientKey(remote string, principal string) string {
+	if principal != "" {
+		return "principal:" + principal
+	}
+	return remoteIP(remote)
+}
+
+// ClientIP returns the IP address of the client which sent a request.
+// Requests from trusted proxies are attributed to the last untrusted address in X-Forwarded-For.
+func (cl *ClientLimiter) ClientIP(r *http.Request) string {
+	ip := remoteIP(r.RemoteAddr)
+	if cl == nil || !cl.trusted(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !cl.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// state returns the state of a client, refilling its rate limit tokens.
+// The lock must be held.
+func (cl *ClientLimiter) state(ip string, now time.Time) *clientState {
+	if cl.clients == nil {
+		cl.clients = make(map[string]*clientState)
+	}
+	st, ok := cl.clients[ip]
+	if !ok {
+		st = &clientState{tokens: float64(cl.Burst), updated: now}
+		cl.clients[ip] = st
+	}
+	st.tokens += now.Sub(st.updated).Seconds() * cl.Rate
+	if st.tokens > float64(cl.Burst) {
+		st.tokens = float64(cl.Burst)
+	}
+	st.updated = now
+	return st
+}
+
+// sweep drops the state of clients which have no sessions and a full rate limit.
+// The lock must be held.
+func (cl *ClientLimiter) sweep(now time.Time) {
+	if now.Sub(cl.lastSweep) < clientSweepRate {
+		return
+	}
+	cl.lastSweep = now
+	for ip, st := range cl.clients {
+		if st.sessions == 0 && st.tokens+now.Sub(st.updated).Seconds()*cl.Rate >= float64(cl.Burst) {
+			delete(cl.clients, ip)
+		}
+	}
+}
+
+// Allow consumes a session from the rate limit of a client, returning errRateLimited if it is exhausted.
+func (cl *ClientLimiter) Allow(ip string, now time.Time) error {
+	if cl == nil || cl.Rate <= 0 {
+		return nil
+	}
+	cl.lck.Lock()
+	defer cl.lck.Unlock()
+	cl.sweep(now)
+	st := cl.state(ip, now)
+	if st.tokens < 1 {
+		return errRateLimited
+	}
+	st.tokens--
+	return nil
+}
+
+// Acquire reserves one of the concurrent sessions of a client, returning errTooManySessions if none are left.
+// The returned function releases the session.
+func (cl *ClientLimiter) Acquire(ip string) (func(), error) {
+	if cl == nil || cl.MaxSessions <= 0 {
+		return func() {}, nil
+	}
+	cl.lck.Lock()
+	defer cl.lck.Unlock()
+	now := time.Now()
+	cl.sweep(now)
+	st := cl.state(ip, now)
+	if st.sessions >= cl.MaxSessions {
+		return nil, errTooManySessions
+	}
+	st.sessions++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cl.lck.Lock()
+			defer cl.lck.Unlock()
+			st.sessions--
+		})
+	}, nil
+}
+
+// limitClients wraps a session handler so that clients are identified by their IP address or principal, and rejected when starting sessions too quickly.
+// Rejections are sent as a StatusUpdate, like errors of the sessions themselves.
+func (cs *ContainerServer) limitClients(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cl := cs.SessionConfig.Clients
+		ip := cl.ClientIP(r)
+		r.RemoteAddr = ip
+		p, _ := requestPrincipal(r)
+		if err := cl.Allow(clientKey(ip, p.ID), time.Now()); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(int(1/cl.Rate)+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(StatusUpdate{
+				Status:  "error",
+				Error:   err.Error(),
+				Code:    codeRateLimited,
+				DocsURL: cs.SessionConfig.docsURL(codeRateLimited),
+			})
+			return
+		}
+		h(w, r)
+	}
+}
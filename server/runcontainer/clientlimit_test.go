@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("failed to parse proxies: %s", err.Error())
+	}
+	cl := &ClientLimiter{TrustedProxies: proxies}
+	tbl := []struct {
+		remote string
+		xff    []string
+		ip     string
+	}{
+		{"203.0.113.5:1234", nil, "203.0.113.5"},
+		{"203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"10.1.2.3:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.1.2.3:80", []string{"1.1.1.1, 198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"192.168.1.1:80", []string{"1.1.1.1", "198.51.100.1"}, "198.51.100.1"},
+		{"10.1.2.3:80", []string{"10.4.4.4"}, "10.4.4.4"},
+		{"10.1.2.3:80", []string{"garbage"}, "10.1.2.3"},
+		{"10.1.2.3:80", nil, "10.1.2.3"},
+	}
+	for _, v := range tbl {
+		r := httptest.NewRequest(http.MethodGet, "/run", nil)
+		r.RemoteAddr = v.remote
+		r.Header["X-Forwarded-For"] = v.xff
+		if ip := cl.ClientIP(r); ip != v.ip {
+			t.Errorf("%s via %v: expected %s but got %s", v.remote, v.xff, v.ip, ip)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
+
+func TestClientLimiterSessions(t *testing.T) {
+	cl := &ClientLimiter{MaxSessions: 2}
+	r1, err := cl.Acquire("1.1.1.1")
+	if err != nil {
+		t.Fatalf("failed to acquire session: %s", err.Error())
+	}
+	if _, err := cl.Acquire("1.1.1.1"); err != nil {
+		t.Fatalf("failed to acquire session: %s", err.Error())
+	}
+	if _, err := cl.Acquire("1.1.1.1"); err != errTooManySessions {
+		t.Errorf("expected errTooManySessions but got %v", err)
+	}
+	if _, err := cl.Acquire("2.2.2.2"); err != nil {
+		t.Errorf("other client rejected: %s", err.Error())
+	}
+	r1()
+	r1()
+	if _, err := cl.Acquire("1.1.1.1"); err != nil {
+		t.Errorf("released session not reusable: %s", err.Error())
+	}
+	if _, err := cl.Acquire("1.1.1.1"); err != errTooManySessions {
+		t.Errorf("double release freed a second session")
+	}
+}
+
+func TestClientLimiterRate(t *testing.T) {
+	cl := &ClientLimiter{Rate: 1, Burst: 2}
+	now := time.Now()
+	for i, ok := range []bool{true, true, false} {
+		if err := cl.Allow("1.1.1.1", now); (err == nil) != ok {
+			t.Errorf("request %d: expected ok %v but got %v", i, ok, err)
+		}
+	}
+	if err := cl.Allow("1.1.1.1", now.Add(time.Second)); err != nil {
+		t.Errorf("rate limit not refilled: %s", err.Error())
+	}
+
+	// idle clients are dropped
+	cl.Allow("2.2.2.2", now.Add(time.Second))
+	cl.Allow("3.3.3.3", now.Add(2*clientSweepRate))
+	if len(cl.clients) != 1 {
+		t.Errorf("expected 1 client but got %d", len(cl.clients))
+	}
+}
+
+func TestLimitClients(t *testing.T) {
+	cs := &ContainerServer{SessionConfig: ContainerSessionConfig{
+		DocsBaseURL: "https://docs.example.com/errors/",
+		Clients:     &ClientLimiter{Rate: 0.5, Burst: 1},
+	}}
+	var remote string
+	h := cs.limitClients(func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+	})
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/run", nil))
+	if rec.Code != http.StatusOK || remote != "192.0.2.1" {
+		t.Errorf("unexpected response %d from %s", rec.Code, remote)
+	}
+
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/run", nil))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "3" {
+		t.Fatalf("unexpected response %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	var status StatusUpdate
+	err := json.NewDecoder(rec.Body).Decode(&status)
+	if err != nil {
+		t.Fatalf("failed to decode status: %s", err.Error())
+	}
+	if status.Status != "error" || status.Code != codeRateLimited || status.DocsURL != "https://docs.example.com/errors/rate_limited" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clusterForwardedHeader is set on requests proxied to another node, which must not be proxied again.
+const clusterForwardedHeader = "X-Openrepl-Forwarded-By"
+
+// errClusterCapacity is returned when the sessions across the cluster have reached the limit.
+var errClusterCapacity = errors.New("cluster at capacity")
+
+// ClusterNode is the record of a server instance in the cluster.
+type ClusterNode struct {
+	Node     string    `json:"node"`
+	URL      string    `json:"url"`
+	Sessions int       `json:"sessions"`
+	Updated  time.Time `json:"updated"`
+
+	// Platform is the platform of the containers of the node in os/arch form (e.g. "linux/arm64").
+	Platform string `json:"platform,omitempty"`
+}
+
+// ClusterSession is the record of a session in the cluster, with the node running it.
+type ClusterSession struct {
+	SessionInfo
+	Node string `json:"node"`
+	URL  string `json:"url"`
+}
+
+// Cluster coordinates server instances running behind a load balancer through Redis.
+// Nodes register their sessions cluster-wide, route clients reattaching to a terminal to the node running it, and share a limit on the number of sessions.
+// Sessions of languages unavailable on the platform of a node are routed to the least loaded node of a supported platform.
+// Records expire unless refreshed by Run, so that the sessions of nodes which went away are forgotten.
+// A nil Cluster leaves nodes independent.
+type Cluster struct {
+	// Redis is the client of the Redis server shared by the nodes.
+	Redis *RedisClient
+
+	// Prefix is the prefix of the keys of the cluster (e.g. "openrepl:").
+	Prefix string
+
+	// Node is the instance ID of this node, and URL is the base URL (e.g. "http://10.0.0.5:8080") at which other nodes reach it.
+	Node string
+	URL  string
+
+	// Platform is the platform of the containers of this node in os/arch form, which is advertised to the other nodes.
+	Platform string
+
+	// TTL is the time after which the records of a node expire unless refreshed.
+	TTL time.Duration
+
+	// MaxSessions is the maximum number of sessions across the cluster.
+	// If zero, the number of sessions is only limited per node.
+	MaxSessions int
+
+	// Sessions is the registry of the sessions of this node, which must not be nil.
+	Sessions *SessionRegistry
+
+	// lck guards the cached number of sessions on other nodes, which is updated by Run.
+	lck    sync.Mutex
+	remote int
+}
+
+func (c *Cluster) key(kind string, id string) string {
+	return c.Prefix + kind + ":" + id
+}
+
+// sessionRecord generates the record of a session of this node.
+func (c *Cluster) sessionRecord(cs *ContainerSession) ClusterSession {
+	return ClusterSession{SessionInfo: sessionInfo(cs), Node: c.Node, URL: c.URL}
+}
+
+// register writes the records of a session, under its ID and its resume token.
+func (c *Cluster) register(ctx context.Context, cs *ContainerSession) error {
+	dat, err := json.Marshal(c.sessionRecord(cs))
+	if err != nil {
+		return err
+	}
+	err = c.Redis.Set(ctx, c.key("session", cs.ID), string(dat), c.TTL)
+	if err != nil {
+		return err
+	}
+	if tok := cs.Options.ResumeToken; tok != "" {
+		err = c.Redis.Set(ctx, c.key("resume", tok), string(dat), c.TTL)
+	}
+	return err
+}
+
+// Register registers a session which started on this node.
+func (c *Cluster) Register(cs *ContainerSession) {
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Redis.Timeout)
+	defer cancel()
+	err := c.register(ctx, cs)
+	if err != nil {
+		cs.logger().Errorf("failed to register session in cluster: %s", err.Error())
+	}
+}
+
+// Unregister removes the records of a session which ended.
+func (c *Cluster) Unregister(cs *ContainerSession) {
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Redis.Timeout)
+	defer cancel()
+	keys := []string{c.key("session", cs.ID)}
+	if tok := cs.Options.ResumeToken; tok != "" {
+		keys = append(keys, c.key("resume", tok))
+	}
+	err := c.Redis.Del(ctx, keys...)
+	if err != nil {
+		cs.logger().Errorf("failed to unregister session from cluster: %s", err.Error())
+	}
+}
+
+// Check checks whether another session may start without exceeding the limit of the cluster.
+// The limit is approximate, as the sessions of other nodes are counted at the last refresh.
+func (c *Cluster) Check() error {
+	if c == nil || c.MaxSessions <= 0 {
+		return nil
+	}
+	c.lck.Lock()
+	remote := c.remote
+	c.lck.Unlock()
+	if remote+len(c.Sessions.List()) >= c.MaxSessions {
+		return errClusterCapacity
+	}
+	return nil
+}
+
+// Nodes returns the records of the nodes in the cluster.
+func (c *Cluster) Nodes(ctx context.Context) ([]ClusterNode, error) {
+	vals, err := c.Redis.Scan(ctx, c.key("node", "*"))
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]ClusterNode, 0, len(vals))
+	for _, v := range vals {
+		var n ClusterNode
+		if json.Unmarshal([]byte(v), &n) == nil {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	return nodes, nil
+}
+
+// List returns the records of the sessions across the cluster.
+func (c *Cluster) List(ctx context.Context) ([]ClusterSession, error) {
+	vals, err := c.Redis.Scan(ctx, c.key("session", "*"))
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]ClusterSession, 0, len(vals))
+	for _, v := range vals {
+		var s ClusterSession
+		if json.Unmarshal([]byte(v), &s) == nil {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions, nil
+}
+
+// lookupResume looks up the record of the session with a resume token.
+// Returns nil if no node has such a session.
+func (c *Cluster) lookupResume(ctx context.Context, token string) (*ClusterSession, error) {
+	v, err := c.Redis.Get(ctx, c.key("resume", token))
+	if err == errRedisNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s ClusterSession
+	err = json.Unmarshal([]byte(v), &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// refresh refreshes the records of this node and its sessions, and counts the sessions on other nodes.
+func (c *Cluster) refresh(ctx context.Context) error {
+	sessions := c.Sessions.List()
+	dat, err := json.Marshal(ClusterNode{Node: c.Node, URL: c.URL, Sessions: len(sessions), Updated: time.Now(), Platform: c.Platform})
+	if err != nil {
+		return err
+	}
+	err = c.Redis.Set(ctx, c.key("node", c.Node), string(dat), c.TTL)
+	if err != nil {
+		return err
+	}
+	for _, cs := range sessions {
+		err = c.register(ctx, cs)
+		if err != nil {
+			return err
+		}
+	}
+
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	remote := 0
+	for _, n := range nodes {
+		if n.Node != c.Node {
+			remote += n.Sessions
+		}
+	}
+	c.lck.Lock()
+	c.remote = remote
+	c.lck.Unlock()
+	return nil
+}
+
+// Run periodically refreshes the records of this node, at a third of their TTL.
+func (c *Cluster) Run() {
+	tick := time.NewTicker(c.TTL / 3)
+	defer tick.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), c.TTL/3)
+		err := c.refresh(ctx)
+		cancel()
+		if err != nil {
+			serverLog.Errorf("failed to refresh cluster records: %s", err.Error())
+		}
+		<-tick.C
+	}
+}
+
+// Leave removes the record of this node when it shuts down.
+func (c *Cluster) Leave(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	return c.Redis.Del(ctx, c.key("node", c.Node))
+}
+
+// proxy forwards a websocket request to the node running its session, and then relays the connection.
+func (c *Cluster) proxy(w http.ResponseWriter, r *http.Request, target string) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		http.Error(w, "invalid node URL", http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be proxied", http.StatusInternalServerError)
+		return
+	}
+
+	// connect to the node
+	d := net.Dialer{Timeout: c.Redis.Timeout}
+	var backend net.Conn
+	switch u.Scheme {
+	case "https":
+		backend, err = tls.DialWithDialer(&d, "tcp", hostPort(u, "443"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		backend, err = d.Dial("tcp", hostPort(u, "80"))
+	}
+	if err != nil {
+		http.Error(w, "node unreachable", http.StatusBadGateway)
+		return
+	}
+	defer backend.Close()
+
+	// forward the request, keeping the client address
+	out := r.WithContext(context.Background())
+	out.URL = &url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	out.Host = u.Host
+	out.Header = cloneHeader(r.Header)
+	out.Header.Set(clusterForwardedHeader, c.Node)
+	if ip := remoteIP(r.RemoteAddr); ip != "" {
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+	err = out.Write(backend)
+	if err != nil {
+		http.Error(w, "node unreachable", http.StatusBadGateway)
+		return
+	}
+
+	// relay the connection, including the response to the upgrade
+	client, buf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// hostPort returns the host and port of a URL, with the default port of its scheme if it has none.
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// cloneHeader copies a header, so that a forwarded request can be changed.
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// selectNode selects the other node with the fewest sessions among those whose platform supports a language.
+// Returns nil if no other node supports the language.
+func (c *Cluster) selectNode(ctx context.Context, lang Language) (*ClusterNode, error) {
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var sel *ClusterNode
+	for i, n := range nodes {
+		if n.Node == c.Node || n.URL == "" || n.Platform == "" || !lang.SupportsPlatform(n.Platform) {
+			continue
+		}
+		if sel == nil || n.Sessions < sel.Sessions {
+			sel = &nodes[i]
+		}
+	}
+	return sel, nil
+}
+
+// serveOnSupportedNode routes a session of a language which is unavailable on the platform of this node to another node supporting it.
+// Returns false if no other node supports the language.
+func (c *Cluster) serveOnSupportedNode(w http.ResponseWriter, r *http.Request, lang Language) bool {
+	if c == nil || r.Header.Get(clusterForwardedHeader) != "" {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), c.Redis.Timeout)
+	n, err := c.selectNode(ctx, lang)
+	cancel()
+	if err != nil {
+		serverLog.Errorf("failed to select cluster node: %s", err.Error())
+		return false
+	}
+	if n == nil {
+		return false
+	}
+	c.proxy(w, r, n.URL)
+	return true
+}
+
+// serveRemoteResume routes a client reattaching to a session of another node to that node.
+// Returns false if no other node has the session.
+func (c *Cluster) serveRemoteResume(w http.ResponseWriter, r *http.Request, token string) bool {
+	if c == nil || r.Header.Get(clusterForwardedHeader) != "" {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), c.Redis.Timeout)
+	s, err := c.lookupResume(ctx, token)
+	cancel()
+	if err != nil {
+		serverLog.Errorf("failed to look up resume token in cluster: %s", err.Error())
+		return false
+	}
+	if s == nil || s.Node == c.Node || s.URL == "" {
+		return false
+	}
+	c.proxy(w, r, s.URL)
+	return true
+}
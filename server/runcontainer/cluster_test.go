@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestCluster creates a node of a cluster coordinated through a fake Redis server.
+func newTestCluster(fr *fakeRedis, node string, url string) *Cluster {
+	return &Cluster{
+		Redis:    &RedisClient{Addr: fr.Addr(), Timeout: time.Second},
+		Prefix:   "openrepl:",
+		Node:     node,
+		URL:      url,
+		TTL:      30 * time.Second,
+		Sessions: &SessionRegistry{},
+	}
+}
+
+func TestCluster(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.Close()
+	a := newTestCluster(fr, "a", "http://a:8080")
+	b := newTestCluster(fr, "b", "http://b:8080")
+	b.MaxSessions = 2
+	ctx := context.Background()
+
+	// sessions are listed across the cluster
+	sess := &ContainerSession{
+		ID:              "s1",
+		ContainerConfig: ContainerConfig{Language: "python3"},
+		Options:         SessionOptions{ResumeToken: "tok"},
+		started:         time.Now(),
+	}
+	a.Sessions.Add(sess)
+	a.Register(sess)
+	b.Sessions.Add(&ContainerSession{ID: "s2"})
+	sessions, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "s1" || sessions[0].Node != "a" || sessions[0].Language != "python3" {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+	s, err := b.lookupResume(ctx, "tok")
+	if err != nil || s == nil || s.URL != "http://a:8080" {
+		t.Errorf("unexpected resume record %+v (%v)", s, err)
+	}
+
+	// the limit counts the sessions of other nodes once they are refreshed
+	if err := b.Check(); err != nil {
+		t.Errorf("expected capacity before refresh, got %v", err)
+	}
+	if err := a.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Check(); err != errClusterCapacity {
+		t.Errorf("expected errClusterCapacity, got %v", err)
+	}
+	nodes, err := a.Nodes(ctx)
+	if err != nil || len(nodes) != 2 || nodes[0].Node != "a" || nodes[1].Sessions != 1 {
+		t.Errorf("unexpected nodes %+v (%v)", nodes, err)
+	}
+
+	// ended sessions are forgotten
+	a.Unregister(sess)
+	if s, err := b.lookupResume(ctx, "tok"); s != nil || err != nil {
+		t.Errorf("expected no resume record, got %+v (%v)", s, err)
+	}
+	if err := a.Leave(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, _ := b.Nodes(ctx); len(nodes) != 1 {
+		t.Errorf("expected one node after leaving, got %+v", nodes)
+	}
+}
+
+func TestClusterResumeProxy(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.Close()
+
+	// the owning node echoes messages of the reattached client
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(clusterForwardedHeader) != "b" || r.URL.Query().Get("session") != "tok" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		typ, dat, err := conn.ReadMessage()
+		if err == nil {
+			conn.WriteMessage(typ, append([]byte("echo: "), dat...))
+		}
+	}))
+	defer owner.Close()
+	a := newTestCluster(fr, "a", owner.URL)
+	a.Register(&ContainerSession{ID: "s1", Options: SessionOptions{ResumeToken: "tok"}})
+
+	b := newTestCluster(fr, "b", "http://b:8080")
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.serveRemoteResume(w, r, r.URL.Query().Get("session")) {
+			http.Error(w, "session not found or expired", http.StatusNotFound)
+		}
+	}))
+	defer front.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(front.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/term?session=tok", nil)
+	if err != nil {
+		t.Fatalf("failed to reattach through the proxy: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("hi"))
+	_, dat, err := conn.ReadMessage()
+	if err != nil || string(dat) != "echo: hi" {
+		t.Errorf("unexpected message %q (%v)", dat, err)
+	}
+
+	// unknown tokens are not routed
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"/term?session=other", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestClusterSelectNode(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.Close()
+	ctx := context.Background()
+	nodes := map[string]string{"a": "linux/arm64", "b": "linux/amd64", "c": "linux/amd64", "d": "linux/arm64"}
+	clusters := make(map[string]*Cluster)
+	for node, platform := range nodes {
+		c := newTestCluster(fr, node, "http://"+node+":8080")
+		c.Platform = platform
+		clusters[node] = c
+	}
+
+	// the least loaded node of the platform is selected, even if a node of another platform has fewer sessions
+	clusters["b"].Sessions.Add(&ContainerSession{ID: "s1"})
+	clusters["b"].Sessions.Add(&ContainerSession{ID: "s2"})
+	clusters["c"].Sessions.Add(&ContainerSession{ID: "s3"})
+	clusters["d"].Sessions.Add(&ContainerSession{ID: "s4"})
+	clusters["d"].Sessions.Add(&ContainerSession{ID: "s5"})
+	clusters["d"].Sessions.Add(&ContainerSession{ID: "s6"})
+	for _, c := range clusters {
+		if err := c.refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := clusters["a"].selectNode(ctx, Language{Platforms: []string{"linux/amd64"}})
+	if err != nil || n == nil || n.Node != "c" {
+		t.Errorf("expected node c, got %+v (%v)", n, err)
+	}
+
+	// this node is not selected, even if it supports the language
+	n, err = clusters["a"].selectNode(ctx, Language{Platforms: []string{"linux/arm64"}})
+	if err != nil || n == nil || n.Node != "d" {
+		t.Errorf("expected node d, got %+v (%v)", n, err)
+	}
+
+	// no node supports the platform
+	n, err = clusters["a"].selectNode(ctx, Language{Platforms: []string{"windows/amd64"}})
+	if err != nil || n != nil {
+		t.Errorf("expected no node, got %+v (%v)", n, err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// FileMode is a set of file permission bits, written in JSON as an octal string (e.g. "0644").
+type FileMode int64
+
+// UnmarshalJSON parses an octal permission string.
+func (m *FileMode) UnmarshalJSON(dat []byte) error {
+	var str string
+	err := json.Unmarshal(dat, &str)
+	if err != nil {
+		return err
+	}
+	v, err := strconv.ParseInt(str, 8, 64)
+	if err != nil || v < 0 || v > 07777 {
+		return fmt.Errorf("invalid file mode %q", str)
+	}
+	*m = FileMode(v)
+	return nil
+}
+
+// MarshalJSON formats the mode as an octal string.
+func (m FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%04o", int64(m)))
+}
+
+// CodeFileConfig is a configuration of the file into which user code is copied.
+type CodeFileConfig struct {
+	// Dir is the directory in which the file is created, which must exist in the image.
+	// If empty, the root directory of the container operating system is used.
+	Dir string `json:"dir,omitempty"`
+
+	// Name is the name of the file.
+	// If empty, "code" is used.
+	Name string `json:"name,omitempty"`
+
+	// Mode is the permission bits of the file.
+	// If zero, the file is read-only (0444).
+	Mode FileMode `json:"mode,omitempty"`
+
+	// UID and GID are the owner of the file, which is owned by root by default.
+	UID int `json:"uid,omitempty"`
+	GID int `json:"gid,omitempty"`
+}
+
+// validate checks that the code file is a plain file name in an absolute directory, on the given container operating system.
+func (f *CodeFileConfig) validate(os string) error {
+	if f.Name != "" && (strings.ContainsAny(f.Name, `/\`) || f.Name == "." || f.Name == "..") {
+		return fmt.Errorf("code file name %q must not be a path", f.Name)
+	}
+	if f.Dir != "" && os != "windows" && !path.IsAbs(f.Dir) {
+		return fmt.Errorf("code file directory %q must be absolute", f.Dir)
+	}
+	if f.UID < 0 || f.GID < 0 {
+		return errors.New("code file owner must not be negative")
+	}
+	return nil
+}
+
+// defaultCodeMode is the mode of the code file when none is configured.
+const defaultCodeMode = 0444
+
+// codeFile returns the directory and name of the code file on the given container operating system.
+func (cc ContainerConfig) codeFile(os string) (dir string, name string) {
+	dir, name = codeDir(os), "code"
+	if cc.CodeFile != nil {
+		if cc.CodeFile.Dir != "" {
+			dir = cc.CodeFile.Dir
+		}
+		if cc.CodeFile.Name != "" {
+			name = cc.CodeFile.Name
+		}
+	}
+	return dir, name
+}
+
+// entryFile returns the path of the code file on the given container operating system.
+func (cc ContainerConfig) entryFile(os string) string {
+	dir, name := cc.codeFile(os)
+	if os == "windows" {
+		return strings.TrimSuffix(dir, `\`) + `\` + name
+	}
+	return path.Join(dir, name)
+}
+
+// codeHeader generates the tar header of a code file of the given size.
+func (cc ContainerConfig) codeHeader(os string, size int64) *tar.Header {
+	_, name := cc.codeFile(os)
+	hdr := &tar.Header{
+		Name: name,
+		Mode: defaultCodeMode,
+		Size: size,
+	}
+	if f := cc.CodeFile; f != nil {
+		if f.Mode != 0 {
+			hdr.Mode = int64(f.Mode)
+		}
+		hdr.Uid, hdr.Gid = f.UID, f.GID
+	}
+	return hdr
+}
+
+// copyCode copies user code into the container, replacing any previous code file.
+// In project mode, dat contains the project files instead.
+func (cs *ContainerSession) copyCode(ctx context.Context, c *Container, dat []byte) error {
+	if max := cs.Config.MaxMessageSize; max > 0 && int64(len(dat)) > max {
+		return errPayloadTooLarge
+	}
+	if cs.Options.Project != "" {
+		return cs.copyProject(ctx, c, dat)
+	}
+	os := cs.Config.DaemonOS
+	dir, _ := cs.ContainerConfig.codeFile(os)
+	tr := packTarball([]tarEntry{{cs.ContainerConfig.codeHeader(os, int64(len(dat))), dat}})
+	defer tr.Close()
+	return c.backend.CopyTo(ctx, c, dir, tr)
+}
+
+// tarEntry is a tar header and the contents of the file.
+type tarEntry struct {
+	hdr *tar.Header
+	dat []byte
+}
+
+// packTarball generates a tarball containing the given entries.
+func packTarball(entries []tarEntry) io.ReadCloser {
+	// create pipe
+	r, w := io.Pipe()
+	go func() {
+		// handle closing, passing any error to the reader
+		var err error
+		defer func() {
+			if err == nil {
+				w.Close()
+			} else {
+				w.CloseWithError(err)
+			}
+		}()
+
+		// prepare tar for writing
+		tw := tar.NewWriter(w)
+		defer func() {
+			cerr := tw.Close()
+			if cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+
+		for _, e := range entries {
+			// write tar header
+			err = tw.WriteHeader(e.hdr)
+			if err != nil {
+				return
+			}
+
+			// add file to tarball
+			_, err = tw.Write(e.dat)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return r
+}
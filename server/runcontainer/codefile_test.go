@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCodeFile(t *testing.T) {
+	tbl := []struct {
+		json  string
+		os    string
+		path  string
+		mode  int64
+		owner [2]int
+	}{
+		{`{}`, "linux", "/code", 0444, [2]int{0, 0}},
+		{`{}`, "windows", `C:\code`, 0444, [2]int{0, 0}},
+		{`{"code_file": {"dir": "/home/runner/src", "name": "main.py", "mode": "0644", "uid": 1000, "gid": 1000}}`, "linux", "/home/runner/src/main.py", 0644, [2]int{1000, 1000}},
+		{`{"code_file": {"name": "Main.java"}}`, "linux", "/Main.java", 0444, [2]int{0, 0}},
+		{`{"code_file": {"dir": "C:\\src\\", "name": "main.ps1"}}`, "windows", `C:\src\main.ps1`, 0444, [2]int{0, 0}},
+	}
+	for _, v := range tbl {
+		var cc ContainerConfig
+		err := json.Unmarshal([]byte(v.json), &cc)
+		if err != nil {
+			t.Fatalf("failed to decode %s: %s", v.json, err.Error())
+		}
+		if p := cc.entryFile(v.os); p != v.path {
+			t.Errorf("%s: expected path %q but got %q", v.json, v.path, p)
+		}
+		hdr := cc.codeHeader(v.os, 5)
+		if hdr.Mode != v.mode || hdr.Uid != v.owner[0] || hdr.Gid != v.owner[1] || hdr.Size != 5 {
+			t.Errorf("%s: unexpected header %+v", v.json, hdr)
+		}
+	}
+
+	// modes must be octal permission strings
+	for _, bad := range []string{`"0999"`, `"rw-r--r--"`, `"77777"`, `420`} {
+		var m FileMode
+		if json.Unmarshal([]byte(bad), &m) == nil {
+			t.Errorf("invalid mode %s accepted", bad)
+		}
+	}
+}
+
+func TestCodeFileValidate(t *testing.T) {
+	valid := []CodeFileConfig{{}, {Dir: "/src", Name: "Main.java", Mode: 0644, UID: 1000}}
+	for _, f := range valid {
+		if err := f.validate("linux"); err != nil {
+			t.Errorf("%+v: %v", f, err)
+		}
+	}
+	if err := (&CodeFileConfig{Dir: `C:\src`}).validate("windows"); err != nil {
+		t.Error(err)
+	}
+	invalid := []CodeFileConfig{{Name: "src/main.go"}, {Name: ".."}, {Dir: "src"}, {UID: -1}}
+	for _, f := range invalid {
+		if err := f.validate("linux"); err == nil {
+			t.Errorf("%+v: expected error", f)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// compile runs the compile command of the language, sending the "running" status once it succeeds.
+// Compiler output is forwarded to the client, and a failure is reported with the exit status of the compiler.
+func (cs *ContainerSession) compile(ctx context.Context, in *execInput) (int64, error) {
+	err := cs.UpdateStatus(StatusUpdate{Status: "compiling"})
+	if err != nil {
+		return 0, err
+	}
+	cs.Events.Record("compile_start", "")
+	start := time.Now()
+	code, err := cs.runStep(ctx, in, Step{
+		Name:    "compile",
+		Command: cs.ContainerConfig.Compile,
+		Timeout: cs.ContainerConfig.CompileTimeout,
+	})
+	if err != nil && ctx.Err() == nil {
+		if code != 0 {
+			err = fmt.Errorf("compilation failed with status %d", code)
+		}
+		cs.Events.Record("compile_failed", err.Error())
+		su := StatusUpdate{
+			Status:   "compile_failed",
+			Error:    err.Error(),
+			Code:     codeCompileFailed,
+			Duration: time.Since(start).Seconds(),
+		}
+		if code != 0 {
+			su.ExitCode = &code
+		}
+		cs.UpdateStatus(su)
+		return code, err
+	}
+	if err != nil {
+		return code, err
+	}
+	cs.Events.Record("compile_end", "")
+	return 0, cs.UpdateStatus(StatusUpdate{Status: "running", LSPToken: cs.lspToken, RealClock: cs.realClock()})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the general configuration of the server, which was previously hard-coded.
+type Config struct {
+	// ListenAddr is the address on which the server listens.
+	ListenAddr string
+
+	// GRPCListenAddr is the address on which the gRPC execution API is served, with the TLS settings of the server.
+	// If empty, the API is disabled.
+	GRPCListenAddr string
+
+	// TLSCert and TLSKey are the paths of the certificate and key with which TLS is served.
+	// If empty, the server listens for plain HTTP.
+	TLSCert string
+	TLSKey  string
+
+	// TLSRedirectAddr is the address of a plain HTTP listener redirecting to HTTPS, which also serves the ACME challenges in ACMEWebroot.
+	// If empty, there is no plain HTTP listener.
+	TLSRedirectAddr string
+	ACMEWebroot     string
+
+	// LanguagesPath is the path of the language configuration file.
+	LanguagesPath string
+
+	// OutputBufferSize is the size of the buffer into which container output is read.
+	OutputBufferSize int
+
+	// Timeouts of session lifecycle stages.
+	StartTimeout         time.Duration
+	SessionTimeout       time.Duration
+	ShutdownTimeout      time.Duration
+	ContainerStopTimeout time.Duration
+	PingRate             time.Duration
+	PongTimeout          time.Duration
+	WriteTimeout         time.Duration
+
+	// MaxMessageSize is the maximum size in bytes of a message from a client, including the code of a run.
+	MaxMessageSize int64
+
+	// ResumeGrace is the time for which a terminal is kept after its client loses the connection, so that the client can reattach.
+	ResumeGrace time.Duration
+
+	// DrainTimeout is the time for which the server waits for sessions to end when shutting down.
+	DrainTimeout time.Duration
+
+	// PollTimeout is the timeout of long-polling requests.
+	PollTimeout time.Duration
+
+	// EvalIdleTimeout is the time after which idle HTTP eval sessions are closed.
+	EvalIdleTimeout time.Duration
+
+	// ArtifactTTL is the time for which collected artifacts are kept.
+	ArtifactTTL time.Duration
+
+	// MaxEventLogs is the maximum number of session event logs kept.
+	MaxEventLogs int
+
+	// ClaimTTL is the time for which a claimed container waits for its session, and MaxClaims is the maximum number of pending claims.
+	ClaimTTL  time.Duration
+	MaxClaims int
+
+	// MaxBenchmarkRuns is the maximum number of measured runs in benchmark mode.
+	MaxBenchmarkRuns int
+
+	// DeterministicTime is the time at which the clock starts in deterministic mode.
+	DeterministicTime string
+}
+
+// RegisterFlags defines the flags of the configuration, with the defaults of the server.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", ":80", "address on which the server listens")
+	fs.StringVar(&c.GRPCListenAddr, "grpc-listen", "", "address on which the gRPC execution API is served (e.g. :9090; disabled if empty, requires the grpc build tag)")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "PEM file of the TLS certificate chain, which is reloaded when it changes (plain HTTP if empty)")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "PEM file of the TLS private key")
+	fs.StringVar(&c.TLSRedirectAddr, "tls-redirect", "", "address of a plain HTTP listener redirecting to HTTPS (e.g. :80; disabled if empty)")
+	fs.StringVar(&c.ACMEWebroot, "acme-webroot", "", "webroot directory of an external ACME client (e.g. certbot --webroot), whose HTTP-01 challenges are served by the redirect listener")
+	fs.StringVar(&c.LanguagesPath, "langs", "langs.json", "path of the language configuration file")
+	fs.IntVar(&c.OutputBufferSize, "output-buffer", 1024, "size in bytes of the buffer into which container output is read")
+	fs.DurationVar(&c.StartTimeout, "start-timeout", time.Minute, "maximum time for starting a session")
+	fs.DurationVar(&c.SessionTimeout, "session-timeout", time.Hour, "maximum duration of a session")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "time to wait for the client to close the connection at the end of a session")
+	fs.DurationVar(&c.ContainerStopTimeout, "container-stop-timeout", time.Minute, "timeout for stopping and removing a session container")
+	fs.DurationVar(&c.PingRate, "ping-rate", 30*time.Second, "interval at which clients are pinged, after which unresponsive clients are disconnected")
+	fs.DurationVar(&c.PongTimeout, "pong-timeout", 10*time.Second, "time within which clients must answer pings before their connection is considered dead (until the next ping if zero)")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 30*time.Second, "time after which writes to unresponsive clients fail (disabled if zero)")
+	fs.Int64Var(&c.MaxMessageSize, "max-message-size", 16<<20, "maximum size in bytes of a websocket message or code payload from a client (unlimited if zero)")
+	fs.DurationVar(&c.ResumeGrace, "resume-grace", 30*time.Second, "time for which a terminal is kept after its client disconnects, within which the client can reattach (disabled if zero)")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", time.Minute, "time for which sessions may continue after SIGTERM or SIGINT, before they are terminated and the server exits")
+	fs.DurationVar(&c.PollTimeout, "poll-timeout", 20*time.Second, "timeout of long-polling requests")
+	fs.DurationVar(&c.EvalIdleTimeout, "eval-idle-timeout", 10*time.Minute, "time after which idle HTTP eval sessions are closed")
+	fs.DurationVar(&c.ArtifactTTL, "artifact-ttl", 10*time.Minute, "time for which artifacts collected from runs are kept")
+	fs.IntVar(&c.MaxEventLogs, "max-event-logs", 1000, "maximum number of session event logs kept")
+	fs.DurationVar(&c.ClaimTTL, "claim-ttl", time.Minute, "time for which a claimed container waits for its session")
+	fs.IntVar(&c.MaxClaims, "max-claims", 50, "maximum number of pending container claims")
+	fs.IntVar(&c.MaxBenchmarkRuns, "max-benchmark-runs", 20, "maximum number of measured runs in benchmark mode")
+	fs.StringVar(&c.DeterministicTime, "deterministic-time", "2000-01-01 00:00:00", "time at which the clock starts in deterministic mode")
+}
+
+// envPrefix is the prefix of the environment variables setting flags.
+const envPrefix = "OPENREPL_"
+
+// flagEnv returns the environment variable setting a flag (e.g. OPENREPL_MAX_RUN_TIME for -max-run-time).
+func flagEnv(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// parseFlags parses the command line, then sets flags which were not given on the command line from the environment and the config file.
+// Settings on the command line take precedence over the environment, which takes precedence over the config file.
+// The config file is a flat YAML mapping of flag names to values, and is selected by the -config flag.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	path := fs.String("config", os.Getenv(flagEnv("config")), "YAML file setting flags by name")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// read config file
+	var file map[string]string
+	if *path != "" {
+		file, err = readConfigFile(*path)
+		if err != nil {
+			return err
+		}
+		for name := range file {
+			if fs.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown setting %q", *path, name)
+			}
+		}
+	}
+
+	// apply environment and config file
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || f.Name == "config" {
+			return
+		}
+		v, ok := os.LookupEnv(flagEnv(f.Name))
+		src := flagEnv(f.Name)
+		if !ok {
+			v, ok = file[f.Name]
+			src = *path
+		}
+		if ok {
+			if serr := f.Value.Set(v); serr != nil {
+				err = fmt.Errorf("%s: invalid value %q for %s: %s", src, v, f.Name, serr.Error())
+			}
+		}
+	})
+	return err
+}
+
+// readConfigFile reads a flat YAML mapping of names to scalar values.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	settings := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		spl := strings.SplitN(line, ":", 2)
+		if len(spl) != 2 || strings.TrimSpace(spl[0]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected name: value", path, n)
+		}
+		name, v := strings.TrimSpace(spl[0]), strings.TrimSpace(spl[1])
+
+		// remove quotes or trailing comment
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') {
+			if v[len(v)-1] != v[0] {
+				return nil, fmt.Errorf("%s:%d: unterminated string", path, n)
+			}
+			v = v[1 : len(v)-1]
+		} else if i := strings.Index(v, " #"); i >= 0 {
+			v = strings.TrimSpace(v[:i])
+		}
+		if _, dup := settings[name]; dup {
+			return nil, errors.New(path + ": duplicate setting " + name)
+		}
+		settings[name] = v
+	}
+	return settings, sc.Err()
+}
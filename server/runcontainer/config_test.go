@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "openrepl.yaml")
+	err = ioutil.WriteFile(path, []byte(`# server settings
+---
+listen: ":8080"
+langs: /etc/openrepl/langs.json # installed by the package
+session-timeout: 2h
+start-timeout: 30s
+deterministic-time: '2001-01-01 00:00:00'
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("OPENREPL_SESSION_TIMEOUT")
+	os.Setenv("OPENREPL_SESSION_TIMEOUT", "3h")
+
+	var conf Config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	conf.RegisterFlags(fs)
+	err = parseFlags(fs, []string{"-config", path, "-start-timeout", "10s"})
+	if err != nil {
+		t.Fatalf("failed to parse flags: %s", err.Error())
+	}
+	switch {
+	case conf.ListenAddr != ":8080" || conf.LanguagesPath != "/etc/openrepl/langs.json" || conf.DeterministicTime != "2001-01-01 00:00:00":
+		t.Errorf("config file not applied: %+v", conf)
+	case conf.SessionTimeout != 3*time.Hour:
+		t.Errorf("environment did not override config file: %v", conf.SessionTimeout)
+	case conf.StartTimeout != 10*time.Second:
+		t.Errorf("command line did not override config file: %v", conf.StartTimeout)
+	case conf.PingRate != 30*time.Second:
+		t.Errorf("default not kept: %v", conf.PingRate)
+	}
+
+	// unknown settings and invalid values are rejected
+	os.Unsetenv("OPENREPL_SESSION_TIMEOUT")
+	for _, dat := range []string{"listen-addr: :80\n", "session-timeout: forever\n", "listen\n"} {
+		ioutil.WriteFile(path, []byte(dat), 0644)
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		new(Config).RegisterFlags(fs)
+		if err := parseFlags(fs, []string{"-config", path}); err == nil {
+			t.Errorf("%q accepted", dat)
+		}
+	}
+}
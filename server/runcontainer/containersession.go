@@ -1,16 +1,24 @@
 package main
 
 import (
-	"archive/tar"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/gorilla/websocket"
 )
@@ -24,11 +32,31 @@ type ContainerSessionConfig struct {
 	ShutdownTimeout time.Duration
 
 	// DockerClient is the docker client to use to create containers.
+	// It is nil when containers are deployed on another backend, which disables features requiring Docker.
 	DockerClient *client.Client
 
+	// Backend is the backend on which session containers are deployed.
+	// If nil, containers are deployed with DockerClient.
+	Backend ContainerBackend
+
+	// Backends are further backends, which languages select by name with the backend option of their containers.
+	Backends map[string]ContainerBackend
+
 	// PingRate is the amount of time to wait between sending pings.
 	PingRate time.Duration
 
+	// PongTimeout is the time within which clients must answer pings, after which their connection is considered dead.
+	// If zero, clients have until the next ping to answer.
+	PongTimeout time.Duration
+
+	// WriteTimeout is the time after which a write blocked on an unresponsive client fails.
+	// If zero, writes may block until the connection closes.
+	WriteTimeout time.Duration
+
+	// MaxMessageSize is the maximum size in bytes of a message from a client, including the code of a run.
+	// If zero, messages are unlimited.
+	MaxMessageSize int64
+
 	// ContainerStopTimeout is the timeout for stopping a container.
 	ContainerStopTimeout time.Duration
 
@@ -38,17 +66,239 @@ type ContainerSessionConfig struct {
 	// SessionTimeout is the timeout for the session if using HandleContainerSession.
 	SessionTimeout time.Duration
 
+	// IdleTimeout is the time without input or output after which terminal sessions are closed.
+	// Clients are warned IdleWarning before the session is closed.
+	// If zero, idle sessions are kept open until the session timeout.
+	IdleTimeout time.Duration
+	IdleWarning time.Duration
+
+	// MaxRunTime is the maximum time for which a run may execute once it is running, after which its container is killed.
+	// If zero, runs are only limited by SessionTimeout.
+	MaxRunTime time.Duration
+
 	// Upgrader is the websocket upgrader to use if using HandleContainerSession.
 	Upgrader websocket.Upgrader
+
+	// DaemonOS is the operating system of containers run by the Docker daemon ("linux" or "windows").
+	DaemonOS string
+
+	// DaemonArch is the normalized CPU architecture of the Docker daemon (e.g. "amd64", "arm64").
+	DaemonArch string
+
+	// Artifacts is the store in which collected run artifacts are kept.
+	Artifacts *ArtifactStore
+
+	// MaxArtifactBytes is the maximum total size of the artifacts collected from a run.
+	MaxArtifactBytes int64
+
+	// MaxArtifactFileBytes is the maximum size of a single artifact.
+	// If zero, only the total size is limited.
+	MaxArtifactFileBytes int64
+
+	// EventLogs is the store in which session event logs are kept.
+	// If nil, events are not recorded.
+	EventLogs *EventLogStore
+
+	// Sessions is the registry of active sessions.
+	Sessions *SessionRegistry
+
+	// Cluster registers sessions with the other server instances, and limits the sessions across them.
+	// If nil, the server runs on its own.
+	Cluster *Cluster
+
+	// Alerts is the Alerter notified of server errors.
+	Alerts *Alerter
+
+	// Resources is the guard which rejects sessions when the host is low on resources.
+	Resources *ResourceGuard
+
+	// Clients limits the sessions of each client address.
+	Clients *ClientLimiter
+
+	// Capacity limits the number of containers across the server, queueing sessions when it is full.
+	Capacity *CapacityQueue
+
+	// QueueTimeout is the maximum time a session waits in the capacity queue.
+	QueueTimeout time.Duration
+
+	// TenantPriorities are the queue priorities of tenants, which are 0 by default.
+	TenantPriorities map[string]int
+
+	// Registries provides the credentials used to pull images from private registries.
+	// If nil, images are pulled anonymously.
+	Registries *RegistryAuth
+
+	// Orphans removes the containers left behind without a live session, and tracks the containers of live sessions.
+	// If nil, containers are not tracked.
+	Orphans *OrphanCollector
+
+	// Pulls pulls missing images when a session first uses them.
+	// If nil, deployments with missing images fail.
+	Pulls *ImagePuller
+
+	// DeployRetries is the number of times a deployment is retried after a transient daemon error.
+	DeployRetries int
+
+	// DeploySlots limits the number of concurrent container deployments, which are queued when it is full.
+	// If nil, deployments are not limited.
+	DeploySlots semaphore
+
+	// Daemon is the health-checked Docker daemon, through which new sessions are rejected while it is unhealthy.
+	// If nil, the daemon is assumed to be healthy.
+	Daemon *DockerHost
+
+	// Cgroups is the cgroup v2 hierarchy used to apply cgroup v2 controls.
+	// If nil, cgroup v2 controls are ignored.
+	Cgroups *CgroupFS
+
+	// Traffic is used to limit the rate of networked sessions.
+	// If nil, network rate limits are ignored.
+	Traffic *TrafficShaper
+
+	// Egress restricts the destinations reachable from networked sessions.
+	// If nil, languages with egress allow-lists cannot be used.
+	Egress *EgressFirewall
+
+	// Packages installs the dependencies of runs into cached images.
+	// If nil, runs may not have dependencies.
+	Packages *PackageCache
+
+	// Tracer records trace spans of the session lifecycle.
+	// If nil, sessions are not traced.
+	Tracer *Tracer
+
+	// Results caches the results of graded submissions.
+	// If nil, every submission is graded.
+	Results *ResultCache
+
+	// DocsBaseURL is the base URL of the error code documentation.
+	// If empty, errors are sent without documentation links.
+	DocsBaseURL string
+
+	// History is the persistent history of completed run sessions.
+	// If nil, runs are not recorded.
+	History *JobHistory
+
+	// EvalSessions is the store of stateful eval sessions used by HTTP clients.
+	// If nil, HTTP eval sessions are disabled.
+	EvalSessions *EvalSessionStore
+
+	// PairParticipants is the maximum number of clients attached to a pair-programming session, including the host.
+	// If zero, the number of participants is unlimited.
+	PairParticipants int
+
+	// Quotas limits the sessions and execution time of each principal.
+	// If nil, principals are not limited.
+	Quotas *Quotas
+
+	// GPUQuotas are the stricter quotas of sessions using GPUs, which also count against Quotas.
+	// If nil, GPU sessions are only limited by Quotas.
+	GPUQuotas *Quotas
+
+	// GPUs limits the sessions using GPUs, and allocates devices to them.
+	// If nil, GPU sessions are rejected.
+	GPUs *GPUPool
+
+	// Policy checks the code of runs before their containers are created.
+	// If nil, all code is run.
+	Policy Policy
+
+	// Audit records the code executed in sessions.
+	// If nil, sessions are not audited.
+	Audit *Auditor
+
+	// Workspaces is the store of workspaces shared between the terminals and runs of a client.
+	// If nil, shared workspaces are disabled.
+	Workspaces *WorkspaceStore
+
+	// Webhooks is notified of the start, completion, timeout and failure of sessions.
+	// If nil, no notifications are sent.
+	Webhooks *Webhooks
+
+	// Recordings is the store of session recordings.
+	// If nil, sessions are not recorded.
+	Recordings RecordingStore
+
+	// Resumes is the store of terminal sessions which survive the loss of the client connection.
+	// If nil, sessions end when the client disconnects.
+	Resumes *ResumeStore
+
+	// Polls is the store of long-polling connections.
+	// If nil, the long-polling fallback is disabled.
+	Polls *PollStore
+
+	// RecordDiffs is whether the filesystem changes of every run are recorded in the event log and metrics for abuse analysis.
+	RecordDiffs bool
+
+	// Receipts signs the execution receipts requested by run clients.
+	// If nil, receipts are not available.
+	Receipts *ReceiptSigner
+
+	// Output limits the output sent to the client in each session.
+	// If nil, output is not limited.
+	Output *OutputLimit
+
+	// Costs accounts for the cost of sessions.
+	// If nil, resource usage is not tracked.
+	Costs *CostLedger
+
+	// Chaos injects failures into sessions for testing.
+	// If nil, no failures are injected.
+	Chaos *Chaos
+}
+
+// Platform returns the platform of the Docker daemon in os/arch form.
+func (sc *ContainerSessionConfig) Platform() string {
+	return sc.DaemonOS + "/" + sc.DaemonArch
+}
+
+// normalizeArch converts a kernel architecture name into the form used in image platforms.
+func normalizeArch(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "armv7l":
+		return "arm"
+	case "i386", "i686":
+		return "386"
+	default:
+		return arch
+	}
+}
+
+// codeDir returns the directory into which code is copied on the given container operating system.
+func codeDir(os string) string {
+	if os == "windows" {
+		return `C:\`
+	}
+	return "/"
+}
+
+// randomID generates a random hex ID.
+func randomID() (string, error) {
+	var idbuf [16]byte
+	_, err := rand.Read(idbuf[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idbuf[:]), nil
 }
 
 // ContainerSession is a terminal session with a container over a websocket.
 type ContainerSession struct {
+	// ID is the unique ID of the session.
+	ID string
+
+	// Events is the event log of the session.
+	Events *EventLog
+
 	// Container is the container being controlled.
-	Container io.ReadWriteCloser
+	Container *Container
 
-	// Client is the client websocket connection.
-	Client *websocket.Conn
+	// Client is the client connection, which is a websocket unless the client uses the long-polling fallback.
+	Client ClientConn
 
 	// Config is the configuration of the ContainerSession.
 	Config *ContainerSessionConfig
@@ -59,17 +309,238 @@ type ContainerSession struct {
 	// ContainerConfig is the ContainerConfig to be used to create the container.
 	// Only necessary when using CreateContainer.
 	ContainerConfig ContainerConfig
+
+	// Options is the set of options selected by the client.
+	Options SessionOptions
+
+	// Protocol is the websocket subprotocol negotiated with the client.
+	Protocol string
+
+	// Tenant is the tenant which the session belongs to.
+	Tenant string
+
+	// Remote is the address of the client.
+	Remote string
+
+	// progArgv is the command line of the program when it is run through exec (in benchmark and watch mode).
+	progArgv []string
+
+	// code is the user code received from the client.
+	code []byte
+
+	// projectPaths are the paths of the project files and directories copied into the container, in project mode.
+	projectPaths []string
+
+	// started is the time at which the session started, and runStarted is the time at which it started running.
+	started    time.Time
+	runStarted time.Time
+
+	// pending is output read from the container before the session started running, which is sent first.
+	pending []byte
+
+	// wlck serializes writes to the client websocket.
+	wlck sync.Mutex
+
+	// output is the beginning of the program output, which is kept for the job history.
+	output []byte
+
+	// outMeter tracks the output sent to the client against the output limits.
+	outMeter outputMeter
+
+	// outputHash is the hash of the complete program output, which is computed when a receipt is requested.
+	outputHash hash.Hash
+
+	// exitCode is the exit status of the program, once it has exited.
+	exitCode *int64
+
+	// timedOut is set (atomically) once the run is killed for exceeding its time limit.
+	timedOut int32
+
+	// pairing is the set of pair-programming participants, in pair-programming sessions.
+	pairing *Pairing
+
+	// lspToken authorizes connections to the language server of the session, if the language has one.
+	lspToken string
+
+	// lspActive is set (atomically) while a client is connected to the language server.
+	lspActive int32
+
+	// recording is the recording of the terminal I/O, if the session is recorded.
+	recording *Recording
+
+	// trace is the span of the session request, if the session is traced.
+	trace *Span
+
+	// tracker accumulates the resource usage of the container.
+	tracker usageTracker
+
+	// releaseGPUs returns the GPU slot and devices of the session to the pool, if it holds them.
+	releaseGPUs func()
+
+	// usage and cost are the resource usage and cost of the session, once it has completed.
+	usage *SessionUsage
+	cost  float64
+
+	// state is the lifecycle state of the session, which is accessed atomically.
+	state int32
+
+	closeOnce sync.Once
+}
+
+// SessionOptions is a set of options for a ContainerSession selected by the client.
+type SessionOptions struct {
+	// Benchmark is the number of measured runs in benchmark mode.
+	// If zero, the program is run normally.
+	Benchmark int
+
+	// Deterministic is whether the program is run with a fixed clock, locale, and seed.
+	Deterministic bool
+
+	// Seed is the random seed passed to the program in deterministic mode.
+	Seed uint64
+
+	// Timestamps is whether output is sent as timestamped OutputEvents instead of raw messages.
+	Timestamps bool
+
+	// Debug is whether the program is run under a debugger.
+	Debug bool
+
+	// Profile is whether the program is run under a profiler.
+	Profile bool
+
+	// CoreDump is whether a core dump is captured if the program crashes.
+	CoreDump bool
+
+	// Watch is whether the program is re-run whenever the client sends new code.
+	Watch bool
+
+	// Eval is whether the session uses the structured eval protocol instead of a raw terminal.
+	Eval bool
+
+	// HTTPEval is whether the eval session is driven by individual HTTP requests instead of a connection.
+	HTTPEval bool
+
+	// Notebook is whether the session executes notebook cells through the eval driver instead of a raw terminal.
+	Notebook bool
+
+	// Claim is the claim of the container deployed in advance for the session.
+	// If nil, a container is deployed when the session starts.
+	Claim *Claim
+
+	// Principal is the ID of the authenticated client, if authentication is enabled.
+	Principal string
+
+	// Assignment is the assignment which the submitted code is graded against.
+	// If nil, the program is run normally.
+	Assignment *Assignment
+
+	// Grade is whether the test bundle is run instead of the program.
+	Grade bool
+
+	// TestBundle is the files of the instructor test suite in grade mode.
+	TestBundle []ProjectFile
+
+	// Pair is whether other clients may join the terminal as pair-programming participants.
+	Pair bool
+
+	// Receipt is whether a signed receipt is sent after the program exits.
+	Receipt bool
+
+	// Diff is whether the filesystem changes made by the program are sent after it exits.
+	Diff bool
+
+	// Streams is whether the program runs without a terminal, so that stdout and stderr are sent separately.
+	// The exit status and duration of the program are sent once it exits.
+	Streams bool
+
+	// Usage is whether the resource usage of the program (peak memory, CPU time and wall time) is sent with its exit status.
+	Usage bool
+
+	// RunTransport is the transport of a run driven by a single HTTP request.
+	// With "rest", the response carries the collected output, and with "sse", status updates and output are streamed as server-sent events.
+	// If empty, the session is driven by a client connection.
+	RunTransport string
+
+	// Input is sent to the program once it starts running, after which its input is closed.
+	// If nil, input is read from the client.
+	Input []byte
+
+	// Packages is the dependency manifest of a run, whose dependencies are installed before the program runs.
+	// If empty, the run has no dependencies.
+	Packages []byte
+
+	// ResumeToken is the token with which the client may reattach to the session after losing its connection.
+	// If empty, the session is not resumable.
+	ResumeToken string
+
+	// Project is the format ("tar" or "json") in which the files of a multi-file project are uploaded.
+	// If empty, a single code file is uploaded.
+	Project string
+
+	// Entry is the path of the entry file of a project, relative to the project directory.
+	Entry string
+
+	// Workspace is the token of the shared workspace mounted as the working directory.
+	// If empty, the working directory belongs to the session alone.
+	Workspace string
+
+	// ID is the session ID, which is generated when the client connects so that failures before the session starts can be correlated.
+	// If empty, an ID is generated when the session starts.
+	ID string
+
+	// Trace is the span of the request which started the session, under which the session lifecycle is traced.
+	// If nil, the session is not traced.
+	Trace *Span
 }
 
 // Close closes the ContainerSession.
+// Calls after the first have no effect.
 func (cs *ContainerSession) Close() {
-	// shut down container
+	cs.closeOnce.Do(cs.close)
+}
+
+func (cs *ContainerSession) close() {
+	cs.setState(stateClosed)
+	cs.Events.Record("close", "")
+
+	// unregister session
+	if cs.Config.Sessions != nil {
+		cs.Config.Sessions.Remove(cs.ID)
+	}
+	cs.Config.Cluster.Unregister(cs)
+
+	// disconnect pair-programming participants
+	cs.pairing.close()
+
+	// shut down container, reading its final usage from the parent cgroup before it is removed
 	if cs.Container != nil {
 		cs.Container.Close()
 	}
+	if cpu, peak, err := cs.Config.Cgroups.usage(cs.ID); err == nil {
+		cs.tracker.observeTotals(cpu, peak)
+	}
+	err := cs.Config.Cgroups.remove(cs.ID)
+	if err != nil {
+		cs.logger().Errorf("failed to remove cgroup: %s", err.Error())
+	}
+
+	// return the GPUs once the container no longer uses them
+	if cs.releaseGPUs != nil {
+		cs.releaseGPUs()
+	}
+
+	// remove egress restrictions
+	if cs.ContainerConfig.Network && len(cs.Config.Egress.allowList(cs.ContainerConfig)) > 0 {
+		cs.Config.Egress.remove(cs.ID)
+	}
+
+	// store the recording
+	cs.saveRecording()
 
 	// attempt to gracefully shutdown websocket
+	cs.wlck.Lock()
 	cerr := cs.Client.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	cs.wlck.Unlock()
 	if cerr == nil {
 		donech := make(chan struct{})
 		go func() {
@@ -96,6 +567,21 @@ func (cs *ContainerSession) Close() {
 func (cs *ContainerSession) runOutput(errch chan<- error) {
 	var err error
 	defer func() { errch <- err }()
+	// send output received before the session started running
+	if len(cs.pending) > 0 {
+		err = cs.writeOutput(cs.pending)
+		cs.pending = nil
+		if err != nil {
+			return
+		}
+	}
+
+	// demultiplex output streams
+	if cs.ContainerConfig.noTTY {
+		err = cs.runStreams()
+		return
+	}
+
 	buf := make([]byte, cs.Config.OutputBufferSize)
 	for err == nil {
 		var n int
@@ -107,13 +593,73 @@ func (cs *ContainerSession) runOutput(errch chan<- error) {
 		}
 
 		// send data to client
-		err = cs.Client.WriteMessage(websocket.TextMessage, buf[:n])
+		err = cs.writeOutput(buf[:n])
 		if err != nil {
 			return
 		}
 	}
 }
 
+// writeOutput sends a chunk of program output to the client.
+func (cs *ContainerSession) writeOutput(dat []byte) error {
+	return cs.writeStream("", dat)
+}
+
+// writeStream sends a chunk of output from a stream ("stdout" or "stderr") of the program to the client.
+// Output of a terminal has no stream.
+func (cs *ContainerSession) writeStream(stream string, dat []byte) error {
+	cs.wlck.Lock()
+	if cs.outputHash != nil {
+		cs.outputHash.Write(dat)
+	}
+
+	// apply output limits
+	n, notice := cs.outMeter.limit(cs.Config.Output, len(dat), time.Now())
+	err := cs.sendOutput(stream, dat[:n])
+	cs.wlck.Unlock()
+	if err == nil && notice != "" {
+		err = cs.limitOutput(notice)
+	}
+	return err
+}
+
+// sendOutput sends output to the client and pair-programming participants.
+// The caller must hold wlck.
+func (cs *ContainerSession) sendOutput(stream string, dat []byte) error {
+	if len(dat) == 0 || cs.Config.Chaos.dropFrame() {
+		return nil
+	}
+	if h := cs.Config.History; h != nil && cs.IsRun && len(cs.output) <= h.MaxOutput {
+		cs.output = append(cs.output, dat...)
+	}
+	cs.pairing.broadcastOutput(dat)
+	cs.recording.output(dat)
+	var err error
+	if cs.Options.Timestamps || stream != "" {
+		err = cs.Client.WriteJSON(OutputEvent{
+			Time:   time.Since(cs.started).Seconds(),
+			Stream: stream,
+			Data:   dat,
+		})
+	} else {
+		err = cs.Client.WriteMessage(websocket.TextMessage, dat)
+	}
+	cs.countClientError("write", err)
+	return err
+}
+
+// OutputEvent is a chunk of output sent to the client in timestamped output mode.
+type OutputEvent struct {
+	// Time is the number of seconds since the start of the session at which the output was received.
+	Time float64 `json:"t"`
+
+	// Stream is the output stream ("stdout" or "stderr") of a program run without a terminal.
+	Stream string `json:"stream,omitempty"`
+
+	// Data is the output data.
+	Data []byte `json:"data"`
+}
+
 // runInput copies input from the client to the container.
 func (cs *ContainerSession) runInput(errch chan<- error) {
 	var err error
@@ -125,6 +671,7 @@ func (cs *ContainerSession) runInput(errch chan<- error) {
 		// get next websocket message reader
 		t, r, err = cs.Client.NextReader()
 		if err != nil {
+			cs.countClientError("read", err)
 			return
 		}
 
@@ -134,8 +681,20 @@ func (cs *ContainerSession) runInput(errch chan<- error) {
 			return
 		}
 
+		// only forward the input of the driver in pair-programming sessions
+		if cs.pairing != nil {
+			err = cs.pairInput(cs.pairing.host, t, r)
+			continue
+		}
+
+		// apply control messages
+		if t == websocket.TextMessage && cs.controlMessages() {
+			err = cs.handleControl(r)
+			continue
+		}
+
 		// copy to container
-		_, err = io.Copy(cs.Container, r)
+		err = cs.writeInput(r)
 		if err != nil {
 			return
 		}
@@ -148,6 +707,7 @@ func (cs *ContainerSession) runPing(errch chan<- error) {
 	cs.Client.SetPongHandler(func(appData string) error {
 		select {
 		case pongch <- struct{}{}:
+		default:
 		}
 		return nil
 	})
@@ -165,11 +725,20 @@ func (cs *ContainerSession) runPing(errch chan<- error) {
 				return
 			}
 
-			// wait for pong
+			// wait for pong, until the next ping if there is no pong timeout
+			timeout := tick.C
+			var timer *time.Timer
+			if cs.Config.PongTimeout > 0 {
+				timer = time.NewTimer(cs.Config.PongTimeout)
+				timeout = timer.C
+			}
 			select {
 			case <-pongch:
 				// we are good - client sent pong on time
-			case <-tick.C:
+				if timer != nil {
+					timer.Stop()
+				}
+			case <-timeout:
 				// timeout while waiting for pong - stalled client
 				err = errors.New("stalled client")
 				return
@@ -187,6 +756,9 @@ func (cs *ContainerSession) RunIO(ctx context.Context) error {
 
 	// start input
 	go cs.runInput(errch)
+	if cs.Options.Input != nil {
+		go cs.sendInput()
+	}
 
 	// start ping-pong
 	cs.runPing(errch)
@@ -194,6 +766,48 @@ func (cs *ContainerSession) RunIO(ctx context.Context) error {
 	// wait for error
 	err := <-errch
 
+	_, closed := err.(*websocket.CloseError)
+	switch {
+	case err == io.EOF:
+		cs.Events.Record("exit", "")
+	case closed:
+		// the client left, so there is no one to report the error to
+		cs.Events.Record("error", err.Error())
+	case err != nil:
+		cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error()}, "")
+	}
+
+	// collect artifacts once the program has exited
+	if err == io.EOF && cs.IsRun && (cs.collectsArtifacts() || cs.Config.History != nil || cs.Options.Receipt || cs.reportsDiff() || cs.Options.Streams || cs.Options.Usage || cs.Config.Webhooks != nil) {
+		code, aerr := cs.Container.waitExit(ctx)
+		if aerr == nil {
+			cs.exitCode = &code
+			if cs.Options.Streams || cs.Options.Usage {
+				su := StatusUpdate{Status: "exit", ExitCode: &code, Duration: time.Since(cs.runStarted).Seconds()}
+				if cs.Options.Usage {
+					if cpu, peak, uerr := cs.Config.Cgroups.usage(cs.ID); uerr == nil {
+						cs.tracker.observeTotals(cpu, peak)
+					}
+					u := cs.tracker.runUsage(time.Since(cs.runStarted))
+					su.Usage = &u
+				}
+				aerr = cs.UpdateStatus(su)
+			}
+		}
+		if aerr == nil && cs.collectsArtifacts() {
+			aerr = cs.sendArtifacts(ctx, code)
+		}
+		if aerr == nil && cs.reportsDiff() {
+			aerr = cs.reportDiff(ctx)
+		}
+		if aerr == nil && cs.Options.Receipt {
+			aerr = cs.sendReceipt(code)
+		}
+		if aerr != nil {
+			cs.logger().Errorf("failed to collect artifacts: %s", aerr.Error())
+		}
+	}
+
 	// close session
 	cs.Close()
 
@@ -208,87 +822,187 @@ func (cs *ContainerSession) RunIO(ctx context.Context) error {
 type StatusUpdate struct {
 	Status string `json:"status"`
 	Error  string `json:"err,omitempty"`
-}
 
-// UpdateStatus sends a StatusUpdate to the client.
-func (cs *ContainerSession) UpdateStatus(status StatusUpdate) error {
-	return cs.Client.WriteJSON(status)
-}
+	// Message is a human-readable explanation sent with warnings.
+	Message string `json:"message,omitempty"`
 
-// packCodeTarball generates a tarball containing dat as a file called "code".
-func packCodeTarball(dat []byte) io.ReadCloser {
-	// create pipe
-	r, w := io.Pipe()
-	go func() {
-		// handle closing, passing any error to the reader
-		var err error
-		defer func() {
-			if err == nil {
-				w.Close()
-			} else {
-				w.CloseWithError(err)
-			}
-		}()
+	// Code identifies the kind of error, for common failures.
+	Code string `json:"code,omitempty"`
 
-		// prepare tar for writing
-		tw := tar.NewWriter(w)
-		defer func() {
-			cerr := tw.Close()
-			if cerr != nil && err == nil {
-				err = cerr
-			}
-		}()
+	// DocsURL is a link to the documentation of the error code.
+	DocsURL string `json:"docs_url,omitempty"`
 
-		// write tar header
-		err = tw.WriteHeader(&tar.Header{
-			Name: "code",
-			Mode: 0444,
-			Size: int64(len(dat)),
-		})
-		if err != nil {
-			return
-		}
+	// ResumeToken is the token with which the client may reattach to the session after losing its connection.
+	ResumeToken string `json:"resume_token,omitempty"`
 
-		// add file to tarball
-		_, err = tw.Write(dat)
-		if err != nil {
-			return
-		}
-	}()
-	return r
+	// Session is the ID of the session, which is sent with the first status update.
+	Session string `json:"session,omitempty"`
+
+	// Pull is the progress of the pull of a missing image.
+	Pull *PullProgress `json:"pull,omitempty"`
+
+	// Position is the 1-based position of a queued session in the capacity queue.
+	Position int `json:"position,omitempty"`
+
+	// RetryAfter is the number of seconds after which a client over quota may start sessions again.
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// Artifacts is the list of files collected after a run.
+	Artifacts []ArtifactInfo `json:"artifacts,omitempty"`
+
+	// ArtifactsSkipped is the number of artifacts skipped due to the size limits.
+	ArtifactsSkipped int `json:"artifacts_skipped,omitempty"`
+
+	// ArtifactErrors explains why each skipped artifact was not collected.
+	ArtifactErrors []ArtifactError `json:"artifact_errors,omitempty"`
+
+	// Archive is the tar archive of the artifacts of a run, if the language collects artifacts into an archive.
+	Archive *ArtifactInfo `json:"archive,omitempty"`
+
+	// Benchmark is the result of a benchmark run.
+	Benchmark *BenchmarkResult `json:"benchmark,omitempty"`
+
+	// Profile is the profiling report collected after a run in profiling mode.
+	Profile *ArtifactInfo `json:"profile,omitempty"`
+
+	// ExitCode is the exit status of the program, which is sent along with collected files.
+	ExitCode *int64 `json:"exit_code,omitempty"`
+
+	// Duration is the number of seconds for which the program ran, which is sent along with the exit status.
+	Duration float64 `json:"duration,omitempty"`
+
+	// Usage is the resource usage of the program, which is sent along with the exit status if requested.
+	Usage *RunUsage `json:"usage,omitempty"`
+
+	// Core is the core dump captured after a crash.
+	Core *ArtifactInfo `json:"core,omitempty"`
+
+	// Step is the name of the pipeline step which the status refers to.
+	Step string `json:"step,omitempty"`
+
+	// Grade is the result of grading a submission against an assignment.
+	Grade *GradeResult `json:"grade,omitempty"`
+
+	// Tests is the parsed result of the test suite run in grade mode.
+	Tests *TestReport `json:"tests,omitempty"`
+
+	// Cached is set if the grade is the cached result of an identical submission.
+	Cached bool `json:"cached,omitempty"`
+
+	// Receipt is the signed receipt of a completed run.
+	Receipt *Receipt `json:"receipt,omitempty"`
+
+	// Diff is the report of the filesystem changes made by a run.
+	Diff *FileDiff `json:"diff,omitempty"`
+
+	// Pair is the state of a pair-programming session.
+	Pair *PairState `json:"pair,omitempty"`
+
+	// RealClock is set when a deterministic session runs with the real clock, so that only its locale and seed are fixed.
+	RealClock bool `json:"real_clock,omitempty"`
+
+	// LSPToken is the token with which the client may connect to the language server of the session at /lsp.
+	LSPToken string `json:"lsp_token,omitempty"`
 }
 
-// sendCode sends client code to the container.
-func (cs *ContainerSession) sendCode(ctx context.Context, c *Container) error {
+// Error codes of common failures, each of which has a page under the documentation base URL.
+const (
+	codeDaemonUnavailable = "daemon_unavailable"
+	codeCapacity          = "capacity"
+	codeStartFailed       = "start_failed"
+	codeStartTimeout      = "start_timeout"
+	codeDiskQuota         = "disk_quota_exceeded"
+	codeRunTimeout        = "run_timeout"
+	codeNetworkBudget     = "network_budget_exceeded"
+	codeStepFailed        = "step_failed"
+	codeCompileFailed     = "compile_failed"
+	codeInstallFailed     = "install_failed"
+	codePolicyRejected    = "policy_rejected"
+	codeQuotaExceeded     = "quota_exceeded"
+	codePayloadTooLarge   = "payload_too_large"
+	codeRateLimited       = "rate_limited"
+	codeTooManySessions   = "too_many_sessions"
+	codeIdleTimeout       = "idle_timeout"
+	codeTerminated        = "terminated"
+	codeOutputLimit       = "output_limit_exceeded"
+	codeShutdown          = "server_shutdown"
+	codeInternal          = "internal_error"
+)
+
+// docsURL returns the link to the documentation of an error code, or an empty string if there is none.
+func (sc *ContainerSessionConfig) docsURL(code string) string {
+	if code == "" || sc.DocsBaseURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(sc.DocsBaseURL, "/") + "/" + code
+}
+
+// UpdateStatus sends a StatusUpdate to the client.
+// Errors are tagged with the session ID, so that they can be matched to the server logs.
+func (cs *ContainerSession) UpdateStatus(status StatusUpdate) error {
+	if status.Error != "" {
+		status.Session = cs.ID
+		cs.trace.SetError(errors.New(status.Error))
+		cs.trace.SetAttribute("openrepl.error.code", status.Code)
+	}
+	status.DocsURL = cs.Config.docsURL(status.Code)
+	cs.wlck.Lock()
+	defer cs.wlck.Unlock()
+	err := cs.Client.WriteJSON(status)
+	cs.countClientError("write", err)
+	return err
+}
+
+// receiveCode accepts user code from the client.
+func (cs *ContainerSession) receiveCode() error {
 	// update status to ready
 	err := cs.UpdateStatus(StatusUpdate{Status: "ready"})
 	if err != nil {
 		return err
 	}
 
-	// accept user code
 	t, dat, err := cs.Client.ReadMessage()
+	if max := cs.Config.MaxMessageSize; err == errPayloadTooLarge || err == nil && max > 0 && int64(len(dat)) > max {
+		msg := fmt.Sprintf("code exceeds the size limit of %d bytes", max)
+		cs.abort("payload_too_large", msg, StatusUpdate{Status: "error", Error: msg, Code: codePayloadTooLarge}, "")
+		return errPayloadTooLarge
+	}
 	if err != nil {
 		return err
 	}
 	if t != websocket.BinaryMessage && t != websocket.TextMessage {
 		return err
 	}
+	cs.Events.Record("code_received", strconv.Itoa(len(dat))+" bytes")
+	cs.code = dat
+	cs.audit(dat)
+	return nil
+}
+
+// sendCode sends client code to the container.
+func (cs *ContainerSession) sendCode(ctx context.Context, c *Container) error {
+	// accept user code, which is kept in case the deployment is retried
+	if cs.code == nil {
+		err := cs.receiveCode()
+		if err != nil {
+			return err
+		}
+	}
+	dat := cs.code
 
 	// update status to uploading
-	err = cs.UpdateStatus(StatusUpdate{Status: "uploading"})
+	err := cs.UpdateStatus(StatusUpdate{Status: "uploading"})
 	if err != nil {
 		return err
 	}
 
 	// send code to Docker
-	tr := packCodeTarball(dat)
-	err = c.cli.CopyToContainer(ctx, c.ID, "/", tr, types.CopyToContainerOptions{})
-	tr.Close()
+	cs.Events.Record("copy_start", "")
+	err = cs.copyCode(ctx, c, dat)
 	if err != nil {
-		cs.UpdateStatus(StatusUpdate{Status: "error", Error: err.Error()})
 		return err
 	}
+	cs.Events.Record("copy_end", "")
 
 	// update status to starting
 	err = cs.UpdateStatus(StatusUpdate{Status: "starting"})
@@ -301,17 +1015,115 @@ func (cs *ContainerSession) sendCode(ctx context.Context, c *Container) error {
 
 // CreateContainer creates and starts a container.
 func (cs *ContainerSession) CreateContainer(ctx context.Context) error {
+	// use the container deployed in advance
+	if cs.Options.Claim != nil {
+		cs.Events.Record("claimed", "")
+		c, err := cs.Options.Claim.wait(ctx)
+		if err != nil {
+			return err
+		}
+		cs.Container = c
+		return nil
+	}
+
+	// pull the image if it is missing, leaving failures to the fallback image
+	cc := cs.ContainerConfig
+	var err error
+	if cc.Backend == "" {
+		err = cs.pullImage(ctx, cc.Image)
+	}
+	if err != nil && (cc.FallbackImage == "" || ctx.Err() != nil) {
+		return err
+	}
+
 	// select prestart hook
 	var prestart func(context.Context, *Container) error
 	if cs.IsRun {
 		prestart = cs.sendCode
 	}
 
-	// deploy container
-	c, err := cs.ContainerConfig.Deploy(ctx, cs.Config.DockerClient, cs.Config.ContainerStopTimeout, prestart)
-	if err != nil {
+	// replace the program with an idle process when it is run through exec
+	if cs.Options.Benchmark > 0 || cs.Options.Watch || cs.Options.Assignment != nil {
+		argv, err := cc.programCommand(ctx, cs.Config.DockerClient)
+		if err != nil {
+			return err
+		}
+		cs.progArgv = argv
+		cc.Entrypoint = idleEntrypoint
+		cc.Command = nil
+	}
+	if cs.Options.Eval || cs.Options.Notebook || cs.Options.Grade {
+		cc.Entrypoint = idleEntrypoint
+		cc.Command = nil
+	}
+	if cs.IsRun && cc.usesPipeline() {
+		if len(cc.Steps) == 0 {
+			argv, err := cc.programCommand(ctx, cs.Config.DockerClient)
+			if err != nil {
+				return err
+			}
+			cs.progArgv = argv
+		}
+		cc.Entrypoint = idleEntrypoint
+		cc.Command = nil
+	}
+
+	// wait for a deployment slot
+	if cs.Config.DeploySlots != nil {
+		if !cs.Config.DeploySlots.tryAcquire() {
+			cs.Events.Record("queued", "")
+			err := cs.UpdateStatus(StatusUpdate{Status: "queued"})
+			if err != nil {
+				return err
+			}
+			err = cs.Config.DeploySlots.acquire(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		defer cs.Config.DeploySlots.release()
+	}
+
+	// apply cgroup v2 controls to a parent cgroup of the container, before the program starts
+	// the parent cgroup is also created without controls to measure usage, as it outlives the container
+	cgcfg := cc.Cgroup2
+	if cgcfg == nil && (cs.Options.Usage || cs.Config.Costs != nil) {
+		cgcfg = &Cgroup2Config{}
+	}
+	cc.cgroupParent, err = cs.Config.Cgroups.create(cs.ID, cgcfg)
+	if err != nil {
+		cs.logger().Errorf("failed to apply cgroup v2 controls: %s", err.Error())
+	}
+
+	// deploy container, falling back to the known-good image on failure
+	c, err := cs.deploy(ctx, cc, prestart)
+	if err != nil && cc.FallbackImage != "" && ctx.Err() == nil {
+		cs.logger().Errorf("failed to deploy %s, falling back to %s: %s", cc.Image, cc.FallbackImage, err.Error())
+		cs.Events.Record("fallback_image", err.Error())
+		cs.Config.Alerts.Record("fallback_image", fmt.Sprintf("%s: %s", cc.Image, err.Error()))
+		uerr := cs.UpdateStatus(StatusUpdate{
+			Status:  "warning",
+			Message: fmt.Sprintf("image %s is unavailable, using fallback image %s", cc.Image, cc.FallbackImage),
+		})
+		if uerr != nil {
+			return uerr
+		}
+		cc.Image = cc.FallbackImage
+		c, err = cs.deploy(ctx, cc, prestart)
+	}
+	if err != nil {
 		return err
 	}
+	cs.Events.Record("deploy_end", c.ID)
+
+	// limit the network rate
+	if cc.Network && cc.NetworkLimits != nil {
+		err = cs.Config.Traffic.apply(sessionBridge(cs.ID), cc.NetworkLimits.Rate)
+		if err != nil {
+			c.Close()
+			return fmt.Errorf("failed to limit network rate: %s", err.Error())
+		}
+	}
 
 	// save container for I/O
 	cs.Container = c
@@ -319,51 +1131,672 @@ func (cs *ContainerSession) CreateContainer(ctx context.Context) error {
 	return nil
 }
 
+// pullImage pulls an image which is not present on the host, sending the progress to the client.
+func (cs *ContainerSession) pullImage(ctx context.Context, img string) error {
+	pulled := false
+	err := cs.Config.Pulls.Ensure(ctx, img, func(p PullProgress) error {
+		if !pulled {
+			pulled = true
+			cs.Events.Record("pull_start", img)
+		}
+		return cs.UpdateStatus(StatusUpdate{Status: "pulling", Pull: &p})
+	})
+	if pulled && err == nil {
+		cs.Events.Record("pull_end", img)
+	}
+	return err
+}
+
+// deploy deploys a container for the session, retrying transient failures.
+func (cs *ContainerSession) deploy(ctx context.Context, cc ContainerConfig, prestart func(context.Context, *Container) error) (*Container, error) {
+	prestart, err := cs.restrictEgress(cc, prestart)
+	if err != nil {
+		return nil, err
+	}
+	prestart = cs.Config.Chaos.wrapPrestart(prestart)
+	var c *Container
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			cs.Events.Record("deploy_retry", err.Error())
+			if !waitRetry(ctx, attempt) {
+				return nil, err
+			}
+		}
+		cs.Events.Record("deploy_start", cc.Image)
+		span := cs.trace.Child("deploy")
+		span.SetAttribute("container.image.name", cc.Image)
+		span.SetAttribute("openrepl.deploy.attempt", attempt)
+		cs.Config.Chaos.delayDeploy(ctx)
+		cc.attempt = attempt
+		var b ContainerBackend
+		b, err = cs.Config.backend(cc)
+		if err == nil {
+			c, err = b.Deploy(withSpan(ctx, span), cc, cs.ID, prestart)
+		}
+		if err == nil {
+			cs.Config.Orphans.track(c)
+			span.SetAttribute("container.id", c.ID)
+		}
+		span.SetError(err)
+		span.End()
+		if err == nil || attempt >= cs.Config.DeployRetries || !isTransient(err) || ctx.Err() != nil {
+			return c, err
+		}
+	}
+}
+
+// waitPrompt reads output from the container until it matches the prompt pattern.
+// The output is kept so that it is sent to the client once the session is running.
+func (cs *ContainerSession) waitPrompt(ctx context.Context) error {
+	re, err := regexp.Compile(cs.ContainerConfig.Prompt)
+	if err != nil {
+		return err
+	}
+
+	// interrupt reads when the context expires
+	conn, ok := cs.Container.IO.(interface {
+		SetReadDeadline(time.Time) error
+	})
+	if !ok {
+		return errors.New("container connection does not support deadlines")
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(dl)
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	buf := make([]byte, cs.Config.OutputBufferSize)
+	for !re.Match(cs.pending) {
+		n, err := cs.Container.Read(buf)
+		cs.pending = append(cs.pending, buf[:n]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordJob adds the completed session to the job history.
+func (cs *ContainerSession) recordJob(ctx context.Context, err error) {
+	rec := JobRecord{
+		ID:        cs.ID,
+		Tenant:    cs.Tenant,
+		Principal: cs.Options.Principal,
+		Language:  cs.ContainerConfig.Language,
+		Started:   cs.started,
+		Finished:  time.Now(),
+		ExitCode:  cs.exitCode,
+		Output:    cs.output,
+		Usage:     cs.usage,
+		Cost:      cs.cost,
+	}
+	switch {
+	case atomic.LoadInt32(&cs.timedOut) != 0:
+		rec.Status = "timeout"
+	case cs.exitCode != nil:
+		rec.Status = "exited"
+	case ctx.Err() == context.DeadlineExceeded:
+		rec.Status = "timeout"
+	case err != nil:
+		rec.Status = "error"
+	default:
+		rec.Status = "exited"
+	}
+	herr := cs.Config.History.Add(rec)
+	if herr != nil {
+		cs.logger().Errorf("failed to record job: %s", herr.Error())
+	}
+}
+
+// tenantHeader is the request header in which the proxy passes the tenant of a session.
+const tenantHeader = "X-Openrepl-Tenant"
+
 // HandleContainerSession processes a container session.
-func HandleContainerSession(w http.ResponseWriter, r *http.Request, isrun bool, cc ContainerConfig, sc *ContainerSessionConfig) {
+// Clients which cannot use websockets may start the session with a POST request, and then use the long-polling transport.
+func HandleContainerSession(w http.ResponseWriter, r *http.Request, isrun bool, cc ContainerConfig, opts SessionOptions, sc *ContainerSessionConfig) {
+	// serve stateful eval sessions over individual HTTP requests
+	if opts.HTTPEval {
+		if r.Method != http.MethodPost || sc.EvalSessions == nil {
+			http.Error(w, "HTTP eval sessions not available", http.StatusBadRequest)
+			return
+		}
+		serveEvalSession(w, r, cc, opts, sc)
+		return
+	}
+
+	// serve RPC clients over the stream they attach
+	if pe, ok := r.Context().Value(pendingExecKey{}).(*pendingExec); ok {
+		pe.serve(r, isrun, cc, opts, sc)
+		return
+	}
+
+	// run to completion, responding with the output
+	if opts.RunTransport != "" {
+		serveHTTPRun(w, r, cc, opts, sc)
+		return
+	}
+
+	// fall back to long polling
+	if r.Method == http.MethodPost && sc.Polls != nil {
+		pc, err := sc.Polls.New()
+		if err != nil {
+			serverLog.Errorf("failed to create poll connection: %s", err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		remote, tenant := r.RemoteAddr, r.Header.Get(tenantHeader)
+		go func() {
+			defer sc.Polls.release(pc)
+			serveContainerSession(pc, remote, tenant, defaultSubprotocol, isrun, cc, opts, sc)
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PollSession{Token: pc.token})
+		return
+	}
+
+	// negotiate protocol version
+	offered := websocket.Subprotocols(r)
+	proto, ok := negotiateSubprotocol(offered)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported protocol (supported: %s)", strings.Join(subprotocols, ", ")), http.StatusBadRequest)
+		return
+	}
+	var hdr http.Header
+	if len(offered) > 0 {
+		hdr = http.Header{"Sec-Websocket-Protocol": {proto}}
+	}
+
+	// generate session ID, reusing the ID of a claimed container
+	if opts.Claim != nil {
+		opts.ID = opts.Claim.id
+	} else {
+		id, err := randomID()
+		if err != nil {
+			serverLog.Errorf("failed to generate session ID: %s", err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		opts.ID = id
+	}
+
 	// upgrade websocket connection
-	ws, err := sc.Upgrader.Upgrade(w, r, nil)
+	upgraded := time.Now()
+	ws, err := sc.Upgrader.Upgrade(w, r, hdr)
+	opts.Trace.Record("upgrade", upgraded, err)
 	if err != nil {
-		log.Printf("failed to upgrade: %s", err.Error())
+		Logger{Session: opts.ID}.Errorf("failed to upgrade: %s", err.Error())
+		websocketErrors.Add(1, "upgrade")
+		if opts.Claim != nil {
+			opts.Claim.release()
+		}
 		return
 	}
 
+	// let clients sending control messages end the input of programs without a terminal
+	if proto != defaultSubprotocol {
+		cc.stdinOnce = cc.noTTY
+	}
+
+	// keep terminals alive for clients which lose their connection
+	var conn ClientConn = sc.clientConn(ws)
+	if sc.Resumes != nil && !isrun && !opts.Pair {
+		rc, err := sc.Resumes.New(conn, proto, opts.Principal)
+		if err != nil {
+			Logger{Session: opts.ID}.Errorf("failed to make session resumable: %s", err.Error())
+		} else {
+			defer sc.Resumes.remove(rc)
+			conn = rc
+			opts.ResumeToken = rc.token
+		}
+	}
+
+	// wrap messages in envelopes
+	if proto == protocolV3 {
+		conn = newEnvelopeConn(conn, opts.Eval || opts.Notebook)
+	}
+
+	serveContainerSession(conn, r.RemoteAddr, r.Header.Get(tenantHeader), proto, isrun, cc, opts, sc)
+}
+
+// serveContainerSession runs a container session over a client connection.
+func serveContainerSession(conn ClientConn, remote string, tenant string, proto string, isrun bool, cc ContainerConfig, opts SessionOptions, sc *ContainerSessionConfig) {
+	// generate session ID, reusing the ID of a claimed container
+	id := opts.ID
+	var err error
+	if opts.Claim != nil {
+		id = opts.Claim.id
+	} else if id == "" {
+		id, err = randomID()
+		if err != nil {
+			serverLog.Errorf("failed to generate session ID: %s", err.Error())
+			conn.Close()
+			return
+		}
+	}
+
 	// create ContainerSession
 	cs := &ContainerSession{
-		Client:          ws,
+		ID:              id,
+		Client:          conn,
 		Config:          sc,
 		IsRun:           isrun,
 		ContainerConfig: cc,
+		Options:         opts,
+		Protocol:        proto,
+		Tenant:          tenant,
+		Remote:          remote,
+		started:         time.Now(),
+		trace:           opts.Trace,
+	}
+	cs.trace.SetAttribute("openrepl.session.id", id)
+	if sc.EventLogs != nil {
+		cs.Events = sc.EventLogs.New(id, tenant)
+	}
+	if opts.Receipt {
+		cs.outputHash = sha256.New()
+	}
+	if sc.Recordings != nil {
+		cs.recording = newRecording(cc.Language, defaultTermCols, defaultTermRows, time.Now())
+	}
+	if opts.Pair {
+		cs.pairing, err = newPairing(cs, sc.PairParticipants)
+		if err != nil {
+			Logger{Session: id}.Errorf("failed to set up pairing: %s", err.Error())
+			conn.Close()
+			return
+		}
+	}
+	if cc.LSP != nil && sc.Sessions != nil {
+		cs.lspToken, err = randomID()
+		if err != nil {
+			Logger{Session: id}.Errorf("failed to generate LSP token: %s", err.Error())
+			conn.Close()
+			return
+		}
+	}
+	cs.Events.Record("upgrade", remote+" "+proto)
+	if opts.Principal != "" {
+		cs.Events.Record("principal", opts.Principal)
+	}
+	sessionsStarted.Add(1, cc.Language, cs.kind())
+	if !isrun {
+		// runs are audited with their code
+		cs.audit(nil)
 	}
+	defer sessionsEnded.Add(1, cc.Language, cs.kind())
+	defer sc.Workspaces.Acquire(opts.Workspace)()
 	defer cs.Close()
 
+	// release a claimed container if the session ends before using it
+	if opts.Claim != nil {
+		defer func() {
+			if cs.Container == nil {
+				opts.Claim.release()
+			}
+		}()
+	}
+
 	// set status to "starting"
-	err = cs.UpdateStatus(StatusUpdate{Status: "starting"})
+	err = cs.UpdateStatus(StatusUpdate{Status: "starting", Session: cs.ID, ResumeToken: opts.ResumeToken})
 	if err != nil {
 		return
 	}
 
+	// warn clients of deprecated languages
+	if cc.Deprecation != "" {
+		cs.Events.Record("deprecated", cc.Language)
+		err = cs.UpdateStatus(StatusUpdate{Status: "warning", Message: cc.Deprecation})
+		if err != nil {
+			return
+		}
+	}
+
+	// reuse the result of an identical graded submission
+	var resKey *ResultKey
+	if opts.Assignment != nil && sc.Results != nil {
+		err = cs.receiveCode()
+		if err != nil {
+			return
+		}
+		keyctx, kcancel := context.WithTimeout(context.Background(), sc.StartTimeout)
+		key, kerr := cs.resultKey(keyctx)
+		kcancel()
+		if kerr != nil {
+			cs.logger().Errorf("failed to compute result cache key: %s", kerr.Error())
+		} else {
+			resKey = &key
+			if res := sc.Results.Get(key, time.Now()); res != nil {
+				resultCacheLookups.Add(1, cc.Language, "hit")
+				cs.Events.Record("result_cached", opts.Assignment.ID)
+				cs.UpdateStatus(StatusUpdate{Status: "graded", Grade: res, Cached: true})
+				return
+			}
+			resultCacheLookups.Add(1, cc.Language, "miss")
+		}
+	}
+
+	// reject abusive submissions before creating a container
+	if isrun && sc.Policy != nil {
+		if cs.code == nil {
+			err = cs.receiveCode()
+			if err != nil {
+				return
+			}
+		}
+		err = cs.checkPolicy()
+		if pr, ok := err.(*PolicyRejection); ok {
+			cs.reject("policy_rejected", pr.Hook, StatusUpdate{Status: "rejected", Error: pr.Reason, Code: codePolicyRejected}, "rejected by policy "+pr.Hook)
+			return
+		}
+		if err != nil {
+			cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: "failed to check submission"}, err.Error())
+			return
+		}
+	}
+
+	// check daemon health
+	if !sc.Daemon.Healthy() {
+		cs.abort("error", "docker daemon unavailable", StatusUpdate{Status: "error", Error: "docker daemon unavailable", Code: codeDaemonUnavailable}, "")
+		return
+	}
+
+	// limit the concurrent sessions of the client
+	release, err := sc.Clients.Acquire(clientKey(remote, opts.Principal))
+	if err != nil {
+		cs.reject("capacity", err.Error(), StatusUpdate{Status: "error", Error: err.Error(), Code: codeTooManySessions}, "rejected "+remote+": "+err.Error())
+		return
+	}
+	defer release()
+
+	// enforce the quotas of the principal
+	if cc.GPU != nil {
+		err = sc.GPUQuotas.AcquireGPU(opts.Principal, sc.Quotas, time.Now())
+	} else {
+		err = sc.Quotas.Acquire(opts.Principal, time.Now())
+	}
+	if qe, ok := err.(*QuotaError); ok {
+		cs.reject("quota", qe.Msg, StatusUpdate{Status: "error", Error: qe.Msg, Code: codeQuotaExceeded, RetryAfter: int(qe.RetryAfter.Seconds()) + 1}, "rejected "+opts.Principal+": "+qe.Msg)
+		return
+	}
+	if err != nil {
+		cs.reject("quota", err.Error(), StatusUpdate{Status: "error", Error: "failed to check quota", Code: codeInternal}, "failed to check quota: "+err.Error())
+		return
+	}
+
+	// wait for server capacity
+	qctx, qcancel := context.WithTimeout(context.Background(), sc.QueueTimeout)
+	queued := false
+	releaseCapacity, err := sc.Capacity.Acquire(qctx, sc.TenantPriorities[tenant], func(pos int) error {
+		if !queued {
+			cs.Events.Record("queued", "capacity")
+			queued = true
+		}
+		return cs.UpdateStatus(StatusUpdate{Status: "queued", Position: pos})
+	})
+	qcancel()
+	if err != nil {
+		if qctx.Err() == context.DeadlineExceeded {
+			cs.reject("capacity", "queue timeout", StatusUpdate{Status: "capacity", Error: "timed out waiting for capacity", Code: codeCapacity}, "rejected: timed out waiting for capacity")
+		} else {
+			cs.fail("capacity", err.Error(), StatusUpdate{Status: "error", Error: "failed to wait for capacity", Code: codeCapacity})
+		}
+		return
+	}
+	defer releaseCapacity()
+
+	// reserve GPUs, which are held until the session is closed
+	if cc.GPU != nil {
+		cs.ContainerConfig.gpuDevices, cs.releaseGPUs, err = sc.GPUs.Acquire(cc.GPU.Count)
+		if err != nil {
+			cs.reject("capacity", err.Error(), StatusUpdate{Status: "capacity", Error: err.Error(), Code: codeCapacity}, "rejected: "+err.Error())
+			return
+		}
+	}
+
+	// check host capacity
+	err = sc.Resources.Check()
+	if err != nil {
+		cs.reject("capacity", err.Error(), StatusUpdate{Status: "capacity", Error: err.Error(), Code: codeCapacity}, "rejected: "+err.Error())
+		return
+	}
+
+	// check cluster capacity
+	err = sc.Cluster.Check()
+	if err != nil {
+		cs.reject("capacity", err.Error(), StatusUpdate{Status: "capacity", Error: err.Error(), Code: codeCapacity}, "rejected: "+err.Error())
+		return
+	}
+
+	// install dependencies into a cached image
+	if len(opts.Packages) > 0 {
+		err = cs.installPackages()
+		if err != nil {
+			cs.abort("error", err.Error(), StatusUpdate{Status: "install_failed", Error: err.Error(), Code: codeInstallFailed}, "failed to install dependencies: "+err.Error())
+			return
+		}
+	}
+
 	// start container
 	startctx, scancel := context.WithTimeout(context.Background(), sc.StartTimeout)
 	defer scancel()
 	err = cs.CreateContainer(startctx)
 	if err != nil {
-		cs.UpdateStatus(StatusUpdate{Status: "error", Error: err.Error()})
-		log.Printf("failed to start: %s", err.Error())
+		sc.Alerts.Record("deploy_failure", err.Error())
+		code := codeStartFailed
+		if startctx.Err() == context.DeadlineExceeded {
+			code = codeStartTimeout
+		}
+		cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error(), Code: code}, "failed to start: "+err.Error())
 		return
 	}
+	cs.setState(stateReady)
 
-	// set status to "running"
-	err = cs.UpdateStatus(StatusUpdate{Status: "running"})
-	if err != nil {
-		return
+	// register session now that the container exists
+	if sc.Sessions != nil {
+		sc.Sessions.Add(cs)
+	}
+	sc.Cluster.Register(cs)
+
+	// account for the execution time of the principal
+	if sc.Quotas != nil && opts.Principal != "" {
+		begin := time.Now()
+		defer func() {
+			qerr := sc.Quotas.AddTime(opts.Principal, time.Since(begin), time.Now())
+			if qerr != nil {
+				cs.logger().Errorf("failed to record quota usage: %s", qerr.Error())
+			}
+		}()
+	}
+	if sc.GPUQuotas != nil && cc.GPU != nil && opts.Principal != "" {
+		begin := time.Now()
+		defer func() {
+			qerr := sc.GPUQuotas.AddTime(opts.Principal, time.Since(begin), time.Now())
+			if qerr != nil {
+				cs.logger().Errorf("failed to record GPU quota usage: %s", qerr.Error())
+			}
+		}()
 	}
 
-	// run session IO
 	sessctx, cancel := context.WithTimeout(context.Background(), sc.SessionTimeout)
 	defer cancel()
+
+	// randomly kill the container in chaos mode
+	go sc.Chaos.killContainer(sessctx, cs.Container)
+
+	// record the run in the job history
+	if isrun && sc.History != nil {
+		defer func() { cs.recordJob(sessctx, err) }()
+	}
+
+	// track resource usage, accounting for the cost before the job is recorded
+	if sc.Costs != nil || opts.Usage {
+		go func() {
+			terr := cs.Container.trackUsage(sessctx, &cs.tracker)
+			if terr != nil {
+				cs.logger().Errorf("failed to track usage: %s", terr.Error())
+			}
+		}()
+	}
+	if sc.Costs != nil {
+		defer cs.recordCost()
+	}
+
+	// run benchmark instead of session IO
+	if cs.Options.Benchmark > 0 {
+		err = cs.UpdateStatus(StatusUpdate{Status: "benchmarking"})
+		if err != nil {
+			return
+		}
+		res, err := cs.runBenchmark(sessctx)
+		if err != nil {
+			cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error()}, "benchmark failed: "+err.Error())
+			return
+		}
+		cs.UpdateStatus(StatusUpdate{Status: "benchmark", Benchmark: res})
+		return
+	}
+
+	// grade the submission instead of running session IO
+	if cs.Options.Assignment != nil {
+		err = cs.UpdateStatus(StatusUpdate{Status: "grading"})
+		if err != nil {
+			return
+		}
+		res, err := cs.runGrading(sessctx)
+		if err != nil {
+			cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error()}, "grading failed: "+err.Error())
+			return
+		}
+		if resKey != nil {
+			sc.Results.Put(*resKey, res, time.Now())
+		}
+		cs.UpdateStatus(StatusUpdate{Status: "graded", Grade: res})
+		return
+	}
+
+	// run the instructor test suite instead of the program
+	if cs.Options.Grade {
+		err = cs.UpdateStatus(StatusUpdate{Status: "testing"})
+		if err != nil {
+			return
+		}
+		report, err := cs.runTestSuite(sessctx)
+		if err != nil {
+			cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error()}, "test run failed: "+err.Error())
+			return
+		}
+		cs.Events.Record("tested", fmt.Sprintf("%d passed, %d failed", report.Passed, report.Failed))
+		cs.UpdateStatus(StatusUpdate{Status: "tested", Tests: report})
+		return
+	}
+
+	// wait for the REPL to initialize
+	if !isrun && !opts.Eval && !opts.Notebook && cc.Prompt != "" {
+		err = cs.waitPrompt(startctx)
+		if err != nil && cc.RequirePrompt {
+			msg := "language did not become ready: " + err.Error()
+			cs.abort("prompt_timeout", err.Error(), StatusUpdate{Status: "error", Error: msg, Code: codeStartTimeout}, msg)
+			return
+		}
+		if err != nil {
+			cs.Events.Record("prompt_timeout", err.Error())
+			cs.logger().Errorf("failed to detect prompt: %s", err.Error())
+		}
+	}
+
+	// set status to "running", which is deferred until the code has been compiled
+	if !isrun || len(cc.Compile) == 0 {
+		err = cs.UpdateStatus(StatusUpdate{Status: "running", LSPToken: cs.lspToken, RealClock: cs.realClock()})
+		if err != nil {
+			return
+		}
+	}
+	cs.setState(stateRunning)
+	cs.Events.Record("run_start", "")
+	cs.runStarted = time.Now()
+	runSpan := cs.trace.Child("run")
+	runSpan.SetAttribute("container.id", cs.Container.ID)
+	defer func() {
+		if cs.exitCode != nil {
+			runSpan.SetAttribute("process.exit.code", *cs.exitCode)
+		}
+		runSpan.End()
+	}()
+	sessionStartLatency.Observe(cs.runStarted.Sub(cs.started).Seconds(), cc.Language, cs.kind())
+	cs.notifyStart()
+	defer cs.notifyEnd()
+
+	// send the join token to the host
+	if cs.pairing != nil {
+		cs.pairing.broadcastState()
+	}
+
+	// watch for the workspace or the writable layer filling up
+	switch {
+	case cc.workspaceVolume != "":
+		go cs.watchUsage(sessctx, cc.WorkDir, sc.Workspaces.Size, fmt.Sprintf("shared workspace size limit of %d bytes exceeded", sc.Workspaces.Size))
+	case cc.hasWorkspace():
+		go cs.watchDisk(sessctx, cc.WorkDir, "workspace size limit of "+cc.WorkspaceSize+" exceeded")
+	}
+	if cc.StorageSize != "" {
+		go cs.watchDisk(sessctx, "/", "storage size limit of "+cc.StorageSize+" exceeded")
+	}
+
+	// watch for the network traffic budget running out
+	if cc.Network && cc.NetworkLimits != nil && cc.NetworkLimits.MaxBytes > 0 {
+		go cs.watchNetwork(sessctx)
+	}
+
+	// close terminal sessions which the user has left
+	if !isrun && sc.IdleTimeout > 0 {
+		go cs.watchIdle(sessctx, sc.IdleTimeout, sc.IdleWarning)
+	}
+
+	// kill runs which exceed the time limit, except in watch mode which re-runs the program indefinitely
+	if limit := cs.runTimeLimit(); isrun && !opts.Watch && limit > 0 {
+		timer := time.AfterFunc(limit, func() { cs.timeoutRun(limit) })
+		defer timer.Stop()
+	}
+
+	// evaluate code sent by the client
+	if cs.Options.Eval {
+		err = cs.runEval(sessctx)
+		if err != nil {
+			cs.logger().Errorf("eval session stopped with error: %s", err.Error())
+		}
+		return
+	}
+
+	// execute notebook cells sent by the client
+	if cs.Options.Notebook {
+		err = cs.runNotebook(sessctx)
+		if err != nil {
+			cs.logger().Errorf("notebook session stopped with error: %s", err.Error())
+		}
+		return
+	}
+
+	// run pipeline steps and hooks
+	if isrun && cc.usesPipeline() {
+		err = cs.runPipeline(sessctx)
+		if err != nil {
+			cs.logger().Errorf("pipeline stopped with error: %s", err.Error())
+		}
+		return
+	}
+
+	// re-run the program whenever new code arrives
+	if cs.Options.Watch {
+		err = cs.runWatch(sessctx)
+		if err != nil {
+			cs.logger().Errorf("watch session stopped with error: %s", err.Error())
+		}
+		return
+	}
+
+	// run session IO
 	err = cs.RunIO(sessctx)
 	if err != nil {
-		log.Printf("I/O stopped with error: %s", err.Error())
+		cs.logger().Errorf("I/O stopped with error: %s", err.Error())
 	}
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// sessionCost counts the cost of completed sessions for each tenant.
+var sessionCost = &Counter{
+	Name:   "openrepl_session_cost_total",
+	Help:   "Cost of completed sessions.",
+	Labels: []string{"tenant"},
+}
+
+// sessionCPU counts the CPU time used by completed sessions for each tenant.
+var sessionCPU = &Counter{
+	Name:   "openrepl_session_cpu_seconds_total",
+	Help:   "CPU time used by completed sessions.",
+	Labels: []string{"tenant"},
+}
+
+// sessionMemory counts the memory used over time by completed sessions for each tenant.
+var sessionMemory = &Counter{
+	Name:   "openrepl_session_memory_gb_seconds_total",
+	Help:   "Memory used over time by completed sessions, in GB-seconds.",
+	Labels: []string{"tenant"},
+}
+
+func init() {
+	metrics.Register(sessionCost)
+	metrics.Register(sessionCPU)
+	metrics.Register(sessionMemory)
+}
+
+// SessionUsage is the resource usage of a session.
+type SessionUsage struct {
+	// CPUSeconds is the CPU time used by the container.
+	CPUSeconds float64 `json:"cpu_seconds"`
+
+	// MemorySeconds is the memory usage of the container integrated over time, in GB-seconds.
+	MemorySeconds float64 `json:"memory_gb_seconds"`
+
+	// Duration is the wall-clock duration of the session in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// CostRates are the prices of the resources used by sessions.
+type CostRates struct {
+	// CPU is the price of a CPU-second.
+	CPU float64
+
+	// Memory is the price of a GB-second of memory.
+	Memory float64
+
+	// Duration is the price of a second of session time.
+	Duration float64
+}
+
+// Cost computes the cost of a session from its resource usage.
+func (r CostRates) Cost(u SessionUsage) float64 {
+	return r.CPU*u.CPUSeconds + r.Memory*u.MemorySeconds + r.Duration*u.Duration
+}
+
+// TenantCost is the total usage and cost of the sessions of a tenant.
+type TenantCost struct {
+	Tenant   string       `json:"tenant"`
+	Sessions int          `json:"sessions"`
+	Usage    SessionUsage `json:"usage"`
+	Cost     float64      `json:"cost"`
+}
+
+// CostLedger computes the cost of sessions, and aggregates usage and costs per tenant.
+// A nil CostLedger does not account for costs.
+type CostLedger struct {
+	// Rates are the prices used to compute costs.
+	Rates CostRates
+
+	lck     sync.Mutex
+	tenants map[string]*TenantCost
+}
+
+// Add adds the usage of a completed session to the ledger, returning its cost.
+func (cl *CostLedger) Add(tenant string, u SessionUsage) float64 {
+	cost := cl.Rates.Cost(u)
+	sessionCost.Add(cost, tenant)
+	sessionCPU.Add(u.CPUSeconds, tenant)
+	sessionMemory.Add(u.MemorySeconds, tenant)
+
+	cl.lck.Lock()
+	defer cl.lck.Unlock()
+	if cl.tenants == nil {
+		cl.tenants = make(map[string]*TenantCost)
+	}
+	tc := cl.tenants[tenant]
+	if tc == nil {
+		tc = &TenantCost{Tenant: tenant}
+		cl.tenants[tenant] = tc
+	}
+	tc.Sessions++
+	tc.Usage.CPUSeconds += u.CPUSeconds
+	tc.Usage.MemorySeconds += u.MemorySeconds
+	tc.Usage.Duration += u.Duration
+	tc.Cost += cost
+	return cost
+}
+
+// Tenants returns the totals of every tenant, ordered by tenant.
+func (cl *CostLedger) Tenants() []TenantCost {
+	cl.lck.Lock()
+	defer cl.lck.Unlock()
+	list := make([]TenantCost, 0, len(cl.tenants))
+	for _, tc := range cl.tenants {
+		list = append(list, *tc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	return list
+}
+
+// ServeHTTP serves the totals of every tenant as JSON.
+// If the tenant query parameter is set, only the totals of that tenant are served.
+func (cl *CostLedger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	list := cl.Tenants()
+	if tenant, ok := r.URL.Query()["tenant"]; ok {
+		sel := []TenantCost{}
+		for _, tc := range list {
+			if tc.Tenant == tenant[0] {
+				sel = append(sel, tc)
+			}
+		}
+		list = sel
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// usageTracker accumulates the resource usage of a container from its stats.
+type usageTracker struct {
+	lck sync.Mutex
+
+	// cpu is the CPU time used so far.
+	cpu time.Duration
+
+	// memSeconds is the memory usage integrated over time, in byte-seconds.
+	memSeconds float64
+
+	// lastRead and lastMem are the time and memory usage of the previous sample.
+	lastRead time.Time
+	lastMem  float64
+
+	// peakMem is the highest memory usage seen, in bytes.
+	peakMem uint64
+}
+
+// observe adds a stats sample.
+// Samples of stopped containers, which have no usage, are ignored.
+func (ut *usageTracker) observe(st *types.StatsJSON) {
+	if st.Read.IsZero() || st.CPUStats.CPUUsage.TotalUsage == 0 {
+		return
+	}
+	ut.lck.Lock()
+	defer ut.lck.Unlock()
+	if cpu := time.Duration(st.CPUStats.CPUUsage.TotalUsage); cpu > ut.cpu {
+		ut.cpu = cpu
+	}
+	if !ut.lastRead.IsZero() && st.Read.After(ut.lastRead) {
+		ut.memSeconds += ut.lastMem * st.Read.Sub(ut.lastRead).Seconds()
+	}
+	ut.lastRead, ut.lastMem = st.Read, float64(st.MemoryStats.Usage)
+	for _, mem := range []uint64{st.MemoryStats.Usage, st.MemoryStats.MaxUsage} {
+		if mem > ut.peakMem {
+			ut.peakMem = mem
+		}
+	}
+}
+
+// observeTotals adds the CPU time and peak memory usage of the container over its whole run.
+func (ut *usageTracker) observeTotals(cpu time.Duration, peakMem uint64) {
+	ut.lck.Lock()
+	defer ut.lck.Unlock()
+	if cpu > ut.cpu {
+		ut.cpu = cpu
+	}
+	if peakMem > ut.peakMem {
+		ut.peakMem = peakMem
+	}
+}
+
+// usage returns the usage of the container so far, given the duration of the session.
+func (ut *usageTracker) usage(d time.Duration) SessionUsage {
+	ut.lck.Lock()
+	defer ut.lck.Unlock()
+	return SessionUsage{
+		CPUSeconds:    ut.cpu.Seconds(),
+		MemorySeconds: ut.memSeconds / 1e9,
+		Duration:      d.Seconds(),
+	}
+}
+
+// RunUsage is the resource usage of a program, as sampled from the stats of its container.
+// Usage is sampled about once a second, so the figures of short runs are approximate unless cgroup v2 is available.
+// With cgroup v2, the totals are read from the parent cgroup of the session once the program exits.
+type RunUsage struct {
+	// PeakMemory is the highest memory usage of the container in bytes.
+	PeakMemory uint64 `json:"peak_memory_bytes"`
+
+	// CPUSeconds is the CPU time used by the container.
+	CPUSeconds float64 `json:"cpu_seconds"`
+
+	// WallSeconds is the wall-clock run time of the program in seconds.
+	WallSeconds float64 `json:"wall_seconds"`
+}
+
+// runUsage returns the usage of the container so far, given the run time of the program.
+func (ut *usageTracker) runUsage(wall time.Duration) RunUsage {
+	ut.lck.Lock()
+	defer ut.lck.Unlock()
+	return RunUsage{
+		PeakMemory:  ut.peakMem,
+		CPUSeconds:  ut.cpu.Seconds(),
+		WallSeconds: wall.Seconds(),
+	}
+}
+
+// trackUsage streams the stats of the container into the tracker until the container stops or the context is canceled.
+func (c *Container) trackUsage(ctx context.Context, ut *usageTracker) error {
+	return c.streamStats(ctx, func(st *types.StatsJSON) bool {
+		ut.observe(st)
+		return true
+	})
+}
+
+// streamStats passes each stats sample of the container to fn, until fn returns false, the container stops, or the context is canceled.
+func (c *Container) streamStats(ctx context.Context, fn func(*types.StatsJSON) bool) error {
+	if c.cli == nil {
+		return errRequiresDocker
+	}
+	resp, err := c.cli.ContainerStats(ctx, c.ID, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var st types.StatsJSON
+		err = dec.Decode(&st)
+		if err != nil {
+			// the stream ends when the container is removed
+			if err == io.EOF || err == io.ErrUnexpectedEOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !fn(&st) {
+			return nil
+		}
+	}
+}
+
+// recordCost computes the usage and cost of the completed session, adding them to the ledger.
+func (cs *ContainerSession) recordCost() {
+	u := cs.tracker.usage(time.Since(cs.started))
+	cs.usage = &u
+	cs.cost = cs.Config.Costs.Add(cs.Tenant, u)
+	cs.Events.Record("cost", formatFloat(cs.cost))
+}
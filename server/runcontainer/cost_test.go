@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestUsageTracker(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	sample := func(offset time.Duration, cpu time.Duration, mem uint64) *types.StatsJSON {
+		st := &types.StatsJSON{}
+		st.Read = start.Add(offset)
+		st.CPUStats.CPUUsage.TotalUsage = uint64(cpu)
+		st.MemoryStats.Usage = mem
+		return st
+	}
+
+	var ut usageTracker
+	ut.observe(sample(0, time.Second, 1e9))
+	ut.observe(sample(2*time.Second, 2*time.Second, 5e8))
+	ut.observe(sample(4*time.Second, 3*time.Second, 5e8))
+
+	// samples of the stopped container are ignored
+	ut.observe(sample(5*time.Second, 0, 0))
+
+	u := ut.usage(10 * time.Second)
+	if u.CPUSeconds != 3 || u.MemorySeconds != 3 || u.Duration != 10 {
+		t.Fatalf("expected 3 CPU-seconds, 3 GB-seconds and 10 seconds but got %+v", u)
+	}
+
+	// the peak includes the maximum usage reported by the daemon
+	st := sample(6*time.Second, 4*time.Second, 2e8)
+	st.MemoryStats.MaxUsage = 1.5e9
+	ut.observe(st)
+	ru := ut.runUsage(8 * time.Second)
+	if ru.PeakMemory != 1.5e9 || ru.CPUSeconds != 4 || ru.WallSeconds != 8 {
+		t.Fatalf("expected peak of 1.5 GB, 4 CPU-seconds and 8 seconds but got %+v", ru)
+	}
+}
+
+func TestCostLedger(t *testing.T) {
+	cl := &CostLedger{Rates: CostRates{CPU: 0.01, Memory: 0.001, Duration: 0.0001}}
+	u := SessionUsage{CPUSeconds: 2, MemorySeconds: 10, Duration: 100}
+	cost := cl.Add("acme", u)
+	if math.Abs(cost-0.04) > 1e-9 {
+		t.Fatalf("expected cost 0.04 but got %v", cost)
+	}
+	cl.Add("acme", u)
+	cl.Add("", u)
+
+	tenants := cl.Tenants()
+	if len(tenants) != 2 || tenants[0].Tenant != "" || tenants[1].Tenant != "acme" {
+		t.Fatalf("unexpected tenants %+v", tenants)
+	}
+	acme := tenants[1]
+	if acme.Sessions != 2 || acme.Usage.CPUSeconds != 4 || math.Abs(acme.Cost-0.08) > 1e-9 {
+		t.Fatalf("unexpected totals %+v", acme)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of values matched by a field of a cron expression, as a bitset.
+type cronField uint64
+
+// cronBounds are the minimum and maximum values of each field: minute, hour, day of month, month and day of week.
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// CronSpec is a parsed five-field cron expression (minute, hour, day of month, month, day of week), evaluated in UTC.
+type CronSpec struct {
+	fields [5]cronField
+
+	// anyDay is set if the day of month or the day of week is "*".
+	// Otherwise, cron matches days which match either of the two fields.
+	anyDay bool
+}
+
+// parseCronField parses a comma-separated list of values, ranges ("1-5") and steps ("*/15" or "0-30/10").
+func parseCronField(str string, min, max int) (cronField, error) {
+	var f cronField
+	for _, part := range strings.Split(str, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				// "5/15" is equivalent to "5-max/15"
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("value %q out of range %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+// ParseCron parses a five-field cron expression (e.g. "*/15 8-18 * * 1-5").
+// Sunday is day 0 of the week, and 7 is not accepted.
+func ParseCron(expr string) (CronSpec, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return CronSpec{}, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	var spec CronSpec
+	for i, p := range parts {
+		f, err := parseCronField(p, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return CronSpec{}, fmt.Errorf("invalid cron expression %q: %s", expr, err.Error())
+		}
+		spec.fields[i] = f
+	}
+	spec.anyDay = strings.HasPrefix(parts[2], "*") || strings.HasPrefix(parts[4], "*")
+	return spec, nil
+}
+
+// has checks whether a field matches a value.
+func (f cronField) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+// matchesDay checks whether the day containing t matches the day of month and day of week fields.
+func (spec CronSpec) matchesDay(t time.Time) bool {
+	dom, dow := spec.fields[2].has(t.Day()), spec.fields[4].has(int(t.Weekday()))
+	if spec.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Matches checks whether the minute containing t matches the expression.
+func (spec CronSpec) Matches(t time.Time) bool {
+	t = t.UTC()
+	return spec.fields[0].has(t.Minute()) && spec.fields[1].has(t.Hour()) && spec.fields[3].has(int(t.Month())) && spec.matchesDay(t)
+}
+
+// maxCronSearch bounds the search for the next match, as some expressions (e.g. "0 0 31 2 *") never match.
+const maxCronSearch = 4 * 366 * 24 * time.Hour
+
+// Next returns the start of the first matching minute after t, or the zero time if there is none within four years.
+func (spec CronSpec) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	for end := t.Add(maxCronSearch); t.Before(end); {
+		switch {
+		case !spec.fields[3].has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !spec.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !spec.fields[1].has(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+		case !spec.fields[0].has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
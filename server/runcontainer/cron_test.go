@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"*/15 8-18 * * 1-5", true},
+		{"0,30 0 1 1,6 *", true},
+		{"5/20 * * * *", true},
+		{"* * * *", false},
+		{"60 * * * *", false},
+		{"* * 0 * *", false},
+		{"* * * * 7", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+	}
+	for _, test := range tests {
+		_, err := ParseCron(test.expr)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: expected ok=%v, got %v", test.expr, test.ok, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2018-01-01 is a Monday
+	start := time.Date(2018, 1, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr   string
+		expect time.Time
+	}{
+		{"* * * * *", time.Date(2018, 1, 1, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2018, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2018, 1, 2, 9, 0, 0, 0, time.UTC)},
+		{"30 8 * * 6", time.Date(2018, 1, 6, 8, 30, 0, 0, time.UTC)},
+		{"0 0 1 3 *", time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)},
+		// either the day of month or the day of week matches when both are restricted
+		{"0 0 15 * 3", time.Date(2018, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		spec, err := ParseCron(test.expr)
+		if err != nil {
+			t.Fatalf("%q: %s", test.expr, err.Error())
+		}
+		next := spec.Next(start)
+		if !next.Equal(test.expect) {
+			t.Errorf("%q: expected %v, got %v", test.expr, test.expect, next)
+		}
+		if !next.IsZero() && !spec.Matches(next) {
+			t.Errorf("%q: next run %v does not match", test.expr, next)
+		}
+	}
+}
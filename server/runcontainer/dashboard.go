@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// adminAPI returns the handler of the JSON endpoints backing the ops dashboard.
+// All endpoints are served under /admin/api/ and require the admin token.
+func (cs *ContainerServer) adminAPI() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/api/hosts", cs.adminGet(cs.adminHosts))
+	mux.HandleFunc("/admin/api/images", cs.adminGet(cs.adminImages))
+	mux.HandleFunc("/admin/api/images/gc", cs.adminGet(cs.adminImageGC))
+	mux.HandleFunc("/admin/api/images/pull", cs.HandleAdminPull)
+	mux.HandleFunc("/admin/api/pools", cs.adminGet(cs.adminPools))
+	mux.HandleFunc("/admin/api/sessions", cs.adminGet(cs.adminSessions))
+	mux.HandleFunc("/admin/api/errors", cs.adminGet(cs.adminErrors))
+	if cs.SessionConfig.History != nil {
+		mux.Handle("/admin/api/history", cs.SessionConfig.History)
+	}
+	if cs.SessionConfig.Costs != nil {
+		mux.Handle("/admin/api/costs", cs.SessionConfig.Costs)
+	}
+	if c := cs.SessionConfig.Cluster; c != nil {
+		mux.HandleFunc("/admin/api/cluster", cs.adminGet(func(r *http.Request) (interface{}, error) {
+			return c.Nodes(r.Context())
+		}))
+	}
+	return mux
+}
+
+// adminGet wraps a function generating a JSON response into a GET handler.
+func (cs *ContainerServer) adminGet(f func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := f(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// HostInfo is the status of a Docker host.
+type HostInfo struct {
+	Name     string `json:"name"`
+	Healthy  bool   `json:"healthy"`
+	Platform string `json:"platform"`
+}
+
+func (cs *ContainerServer) adminHosts(r *http.Request) (interface{}, error) {
+	sc := &cs.SessionConfig
+	name := "default"
+	if sc.Daemon != nil {
+		name = sc.Daemon.Name
+	}
+	return []HostInfo{{
+		Name:     name,
+		Healthy:  sc.Daemon.Healthy(),
+		Platform: sc.Platform(),
+	}}, nil
+}
+
+// ImageInfo is the status of a language image on the Docker host.
+type ImageInfo struct {
+	Image     string   `json:"image"`
+	Languages []string `json:"languages"`
+
+	// Status is "present" if the image is available on the host, or "missing" if it must be pulled.
+	Status  string `json:"status"`
+	ID      string `json:"id,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Created string `json:"created,omitempty"`
+
+	// LastPull is the result of the last pull of the image by the server, if any.
+	LastPull *PullResult `json:"last_pull,omitempty"`
+}
+
+func (cs *ContainerServer) adminImages(r *http.Request) (interface{}, error) {
+	if cs.SessionConfig.DockerClient == nil {
+		return nil, errRequiresDocker
+	}
+
+	// inspect the images used by each language
+	users := languageImages(cs.languages())
+	images := make([]ImageInfo, 0, len(users))
+	for img, langs := range users {
+		info := ImageInfo{Image: img, Languages: langs, LastPull: cs.lastPull(img)}
+		inspect, _, err := cs.SessionConfig.DockerClient.ImageInspectWithRaw(r.Context(), img)
+		switch {
+		case err == nil:
+			info.Status = "present"
+			info.ID = inspect.ID
+			info.Size = inspect.Size
+			info.Created = inspect.Created
+		case client.IsErrNotFound(err):
+			info.Status = "missing"
+		default:
+			return nil, err
+		}
+		images = append(images, info)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Image < images[j].Image })
+	return images, nil
+}
+
+// adminImageGC lists the images which the next garbage collection would remove, without removing them.
+func (cs *ContainerServer) adminImageGC(r *http.Request) (interface{}, error) {
+	if cs.ImageGC == nil {
+		return []ImageGCCandidate{}, nil
+	}
+	plan, err := cs.ImageGC.Plan(r.Context(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if plan == nil {
+		plan = []ImageGCCandidate{}
+	}
+	return plan, nil
+}
+
+// PoolInfo is the usage of a limited pool of resources.
+type PoolInfo struct {
+	Used int `json:"used"`
+
+	// Size is the capacity of the pool, or 0 if unlimited.
+	Size int `json:"size"`
+}
+
+// semaphorePool returns the usage of a semaphore.
+func semaphorePool(s semaphore) PoolInfo {
+	return PoolInfo{Used: len(s), Size: cap(s)}
+}
+
+func (cs *ContainerServer) adminPools(r *http.Request) (interface{}, error) {
+	sc := &cs.SessionConfig
+	pools := map[string]PoolInfo{
+		"deploy": semaphorePool(sc.DeploySlots),
+	}
+	if sc.GPUs != nil {
+		sessions, devices := sc.GPUs.Status()
+		pools["gpu"] = PoolInfo{Used: sessions, Size: sc.GPUs.Sessions}
+		pools["gpu_devices"] = PoolInfo{Used: devices, Size: sc.GPUs.Devices}
+	}
+	if sc.Capacity != nil {
+		used, waiting := sc.Capacity.Status()
+		pools["containers"] = PoolInfo{Used: used, Size: sc.Capacity.Max}
+		pools["queue"] = PoolInfo{Used: waiting}
+	}
+	if sc.Sessions != nil {
+		pools["sessions"] = PoolInfo{Used: len(sc.Sessions.List())}
+	}
+	if c := sc.Cluster; c != nil {
+		c.lck.Lock()
+		remote := c.remote
+		c.lck.Unlock()
+		pools["cluster_sessions"] = PoolInfo{Used: remote + len(sc.Sessions.List()), Size: c.MaxSessions}
+	}
+	if sc.Polls != nil {
+		pools["polls"] = PoolInfo{Used: sc.Polls.Len()}
+	}
+	if cs.Claims != nil {
+		pools["claims"] = PoolInfo{Used: cs.Claims.Len(), Size: cs.Claims.Max}
+	}
+	if sc.Workspaces != nil {
+		pools["workspaces"] = PoolInfo{Used: sc.Workspaces.Len(), Size: sc.Workspaces.Max}
+	}
+	if sc.EvalSessions != nil {
+		pools["eval_sessions"] = PoolInfo{Used: sc.EvalSessions.Len()}
+	}
+	return pools, nil
+}
+
+// SessionInfo is the description of an active session.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Language  string    `json:"language"`
+	Run       bool      `json:"run"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Protocol  string    `json:"protocol"`
+	Container string    `json:"container,omitempty"`
+	State     string    `json:"state"`
+	Started   time.Time `json:"started"`
+}
+
+// sessionInfo describes an active session.
+func sessionInfo(sess *ContainerSession) SessionInfo {
+	info := SessionInfo{
+		ID:        sess.ID,
+		Language:  sess.ContainerConfig.Language,
+		Run:       sess.IsRun,
+		Tenant:    sess.Tenant,
+		Principal: sess.Options.Principal,
+		ClientIP:  remoteIP(sess.Remote),
+		Protocol:  sess.Protocol,
+		State:     sess.State().String(),
+		Started:   sess.started,
+	}
+	if sess.Container != nil {
+		info.Container = sess.Container.ID
+	}
+	return info
+}
+
+// adminSessions lists the active sessions of this server, or of every server in the cluster with ?scope=cluster.
+func (cs *ContainerServer) adminSessions(r *http.Request) (interface{}, error) {
+	if c := cs.SessionConfig.Cluster; c != nil && r.URL.Query().Get("scope") == "cluster" {
+		return c.List(r.Context())
+	}
+	var active []*ContainerSession
+	if cs.SessionConfig.Sessions != nil {
+		active = cs.SessionConfig.Sessions.List()
+	}
+	sessions := make([]SessionInfo, 0, len(active))
+	for _, sess := range active {
+		sessions = append(sessions, sessionInfo(sess))
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions, nil
+}
+
+func (cs *ContainerServer) adminErrors(r *http.Request) (interface{}, error) {
+	errs := cs.SessionConfig.Alerts.Recent()
+	if errs == nil {
+		errs = []RecordedError{}
+	}
+	return errs, nil
+}
@@ -1,39 +1,773 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
 )
 
 // ContainerConfig is a container configuration.
 type ContainerConfig struct {
+	// Language is the name of the language which the container belongs to.
+	// This is set when the configuration is loaded.
+	Language string `json:"-"`
+
+	// Deprecation is the warning sent to clients if the language is deprecated.
+	// This is set when the configuration is loaded.
+	Deprecation string `json:"-"`
+
 	Image   string   `json:"image"`
 	Command []string `json:"cmd"`
+
+	// FallbackImage is an image (e.g. a previous known-good tag) used when the primary image fails to deploy.
+	FallbackImage string `json:"fallback_image,omitempty"`
+
+	// Entrypoint overrides the entrypoint of the image.
+	Entrypoint []string `json:"entrypoint,omitempty"`
+
+	// Env is a list of environment variables (in KEY=value form) to set in the container.
+	Env []string `json:"env,omitempty"`
+
+	// GPU is the GPU configuration of the container.
+	// If nil, the container does not have GPU access.
+	GPU *GPUConfig `json:"gpu,omitempty"`
+
+	// Backend selects a backend of the server for the containers of the language (e.g. "wasm").
+	// If empty, containers are deployed on the default backend.
+	Backend string `json:"backend,omitempty"`
+
+	// WasmModule is the WASI module run by the wasm backend, relative to its module directory (e.g. "python3.wasm").
+	// The module is the interpreter or compiled program of the language, and Entrypoint and Command are its arguments.
+	WasmModule string `json:"wasm_module,omitempty"`
+
+	// Rootfs is the root filesystem image booted by the firecracker backend, relative to its image directory (e.g. "python3.ext4").
+	// The image must contain the init process of the microVM protocol, which runs the Entrypoint and Command of the language.
+	Rootfs string `json:"rootfs,omitempty"`
+
+	// Runtime is the OCI runtime used to run the container (e.g. "runc", "runsc", "kata-runtime").
+	// If empty, the default runtime of the daemon is used.
+	Runtime string `json:"runtime,omitempty"`
+
+	// SecurityOpt is a list of security options (e.g. "seccomp=...", "apparmor=...") applied to the container.
+	SecurityOpt []string `json:"security_opt,omitempty"`
+
+	// SeccompProfile is the path of a seccomp profile applied to the container, relative to the language configuration file.
+	// If empty, the default profile of the daemon is used.
+	SeccompProfile string `json:"seccomp_profile,omitempty"`
+
+	// ReadonlyRootfs is whether the root filesystem of the container is read-only.
+	// A tmpfs is mounted at /tmp unless Tmpfs already mounts one, and code must be copied into a writable mount.
+	ReadonlyRootfs bool `json:"readonly_rootfs,omitempty"`
+
+	// NoNewPrivileges is whether processes in the container are prevented from gaining privileges (e.g. through setuid binaries).
+	NoNewPrivileges bool `json:"no_new_privileges,omitempty"`
+
+	// CapDrop is a list of Linux capabilities (or "ALL") dropped from the container.
+	// Capabilities in CapAdd are added back.
+	CapDrop []string `json:"cap_drop,omitempty"`
+
+	// User is the user (e.g. "1000:1000" or "runner") the program runs as.
+	// If empty, the user of the image is used.
+	User string `json:"user,omitempty"`
+
+	// Tmpfs is a map of paths to tmpfs mount options for tmpfs mounts in the container.
+	Tmpfs map[string]string `json:"tmpfs,omitempty"`
+
+	// TmpfsSize is the size limit (e.g. "64m") of tmpfs mounts whose options do not include a size.
+	// If empty, the server default is used.
+	TmpfsSize string `json:"tmpfs_size,omitempty"`
+
+	// Readiness is a command executed repeatedly after the container starts until it succeeds (e.g. "pg_isready").
+	// The container is not considered running until then.
+	Readiness []string `json:"readiness,omitempty"`
+
+	// WaitHealthy is whether to wait for the image healthcheck to report the container as healthy after it starts.
+	WaitHealthy bool `json:"wait_healthy,omitempty"`
+
+	// Prompt is a regular expression matching the end of the REPL prompt (e.g. ">>> $").
+	// If set, interactive sessions are not considered running until the prompt is printed.
+	Prompt string `json:"prompt,omitempty"`
+
+	// RequirePrompt is whether interactive sessions fail to start if the prompt is not printed before the start timeout.
+	// If false, the session is reported as running anyway once the timeout passes.
+	RequirePrompt bool `json:"require_prompt,omitempty"`
+
+	// Init is a command executed inside the container after it starts (e.g. to load a database seed).
+	// The container is not considered running until the command exits successfully.
+	Init []string `json:"init,omitempty"`
+
+	// WorkDir is the working directory of the container.
+	// If empty, the working directory of the image is used.
+	WorkDir string `json:"workdir,omitempty"`
+
+	// WorkspaceSize is the size limit (e.g. "32m") of the working directory, which is mounted as a tmpfs.
+	// If empty, the working directory is part of the container filesystem.
+	WorkspaceSize string `json:"workspace_size,omitempty"`
+
+	// StorageSize is the size limit (e.g. "1g") of the writable layer of the container.
+	// This requires a storage driver supporting quotas (e.g. overlay2 on xfs with pquota), and if empty, the server default is used.
+	StorageSize string `json:"storage_size,omitempty"`
+
+	// Files is a list of host files or directories mounted read-only into the container.
+	Files []FileMount `json:"files,omitempty"`
+
+	// FakeTimeLib is the path of libfaketime inside the image, used to fix the clock in deterministic mode.
+	// If empty, deterministic runs use the real clock, and only their locale and seed are fixed.
+	FakeTimeLib string `json:"faketime_lib,omitempty"`
+
+	// Network is whether the container has network access.
+	// Each networked session is attached to its own bridge network, isolated from other sessions.
+	Network bool `json:"network,omitempty"`
+
+	// NetworkLimits limits the traffic of networked containers.
+	// If nil, traffic is not limited.
+	NetworkLimits *NetworkLimits `json:"network_limits,omitempty"`
+
+	// Egress is the allow-list of domains, IP addresses and CIDRs which networked containers may connect to.
+	// If empty, the default allow-list of the server applies.
+	Egress []string `json:"egress,omitempty"`
+
+	// Labels is a set of extra labels attached to the container.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// LogDriver is the Docker log driver used by the container (e.g. "none", "local").
+	// Output is already streamed to the client, so this is usually "none" or a size-capped driver.
+	LogDriver string `json:"log_driver,omitempty"`
+
+	// LogOpts is the set of options passed to the log driver.
+	LogOpts map[string]string `json:"log_opts,omitempty"`
+
+	// Artifacts is a list of glob patterns for files collected after a run exits.
+	// Patterns are relative to ArtifactDir, and "**" matches any number of directories.
+	Artifacts []string `json:"artifacts,omitempty"`
+
+	// ArtifactDir is the directory in which artifacts are collected.
+	// If empty, WorkDir is used; languages collecting artifacts must set either, which may not be the root directory.
+	ArtifactDir string `json:"artifact_dir,omitempty"`
+
+	// ArtifactArchive is whether artifacts are collected into a single tar archive rather than as separate files.
+	// If Artifacts is empty, the archive contains the whole ArtifactDir.
+	ArtifactArchive bool `json:"artifact_archive,omitempty"`
+
+	// MaxRunTime is the maximum time in seconds for which a run may execute, after which its container is killed.
+	// The server limit applies if it is stricter or if this is zero.
+	MaxRunTime float64 `json:"max_run_time,omitempty"`
+
+	// MemoryMB is the memory limit of the container in megabytes.
+	// If zero, defaultMemoryLimit is used.
+	MemoryMB int64 `json:"memory_mb,omitempty"`
+
+	// CPUShares is the relative CPU weight of the container under contention.
+	// If zero, the Docker default (1024) is used.
+	CPUShares int64 `json:"cpu_shares,omitempty"`
+
+	// PidsLimit is the maximum number of processes in the container.
+	// If zero, defaultPidsLimit is used, and if negative, the number of processes is unlimited.
+	PidsLimit int64 `json:"pids_limit,omitempty"`
+
+	// Ulimits is a set of resource limits (e.g. "nofile") applied to the processes of the container.
+	// The core limit is managed by the server, and is only raised when core dumps are requested.
+	Ulimits map[string]Ulimit `json:"ulimits,omitempty"`
+
+	// Cpuset is the set of CPUs (e.g. "2-7") on which the container may run.
+	// If empty, the server default is used.
+	Cpuset string `json:"cpuset,omitempty"`
+
+	// Swap is the amount of swap in bytes the container may use in addition to its memory limit.
+	// If zero, the container may not swap, and if negative, swap is unlimited.
+	Swap int64 `json:"swap,omitempty"`
+
+	// Swappiness is the swappiness (0-100) of the container memory.
+	// If nil, the host swappiness is used.
+	Swappiness *int64 `json:"swappiness,omitempty"`
+
+	// OOMScoreAdj is the OOM score adjustment (-1000 to 1000) of the container.
+	// If nil, defaultOOMScoreAdj is used so that session containers are killed first under memory pressure.
+	OOMScoreAdj *int `json:"oom_score_adj,omitempty"`
+
+	// Cgroup2 is a set of cgroup v2 controls applied to a parent cgroup of the container where the host supports them.
+	Cgroup2 *Cgroup2Config `json:"cgroup2,omitempty"`
+
+	// Steps is an ordered list of steps run instead of Command.
+	// The container is kept idle and each step is executed in turn.
+	Steps []Step `json:"steps,omitempty"`
+
+	// Compile is the command line compiling the code before the program runs, with command placeholders expanded.
+	// Compiler output is sent under the "compiling" status, and the program only runs if compilation succeeds.
+	Compile []string `json:"compile,omitempty"`
+
+	// CompileTimeout is the maximum duration of compilation in seconds.
+	// If zero, compilation is only limited by the session timeout.
+	CompileTimeout float64 `json:"compile_timeout,omitempty"`
+
+	// Setup is a hook executed before the user run.
+	Setup *Hook `json:"setup,omitempty"`
+
+	// Teardown is a hook executed after the user run, even if it failed.
+	Teardown *Hook `json:"teardown,omitempty"`
+
+	// CapAdd is a list of Linux capabilities added to the container.
+	CapAdd []string `json:"cap_add,omitempty"`
+
+	// Eval is the configuration of the structured eval protocol.
+	// If nil, eval mode is not supported.
+	Eval *EvalConfig `json:"eval,omitempty"`
+
+	// LSP is the configuration of the language server run alongside sessions.
+	// If nil, sessions of the language have no language server.
+	LSP *LSPConfig `json:"lsp,omitempty"`
+
+	// Debug is the configuration used in debug mode.
+	// If nil, debug mode is not supported.
+	Debug *DebugConfig `json:"debug,omitempty"`
+
+	// Profile is the configuration used in profiling mode.
+	// If nil, profiling mode is not supported.
+	Profile *ProfileConfig `json:"profile,omitempty"`
+
+	// CoreDump is the configuration used to capture core dumps of crashed runs.
+	// If nil, core dumps are not supported.
+	CoreDump *CoreDumpConfig `json:"core_dump,omitempty"`
+
+	// CodeFile is the configuration of the file into which user code is copied.
+	// If nil, the code is copied to a read-only, root-owned file named "code" in the root directory.
+	CodeFile *CodeFileConfig `json:"code_file,omitempty"`
+
+	// Project is the configuration used to run multi-file projects.
+	// If nil, projects are not supported.
+	Project *ProjectConfig `json:"project,omitempty"`
+
+	// Test is the test runner of /api/grade.
+	// If nil, test runs are not supported.
+	Test *TestConfig `json:"test,omitempty"`
+
+	// Packages is the configuration used to install the dependencies of runs.
+	// If nil, runs may not have dependencies.
+	Packages *PackageConfig `json:"packages,omitempty"`
+
+	// seccomp is the contents of the seccomp profile, which is loaded along with the configuration.
+	seccomp string
+
+	// coreLimit is the size limit of core dumps in bytes, which is set when the client requests core dumps.
+	coreLimit int64
+
+	// noTTY is set when the program runs without a terminal, so that its output streams are multiplexed.
+	noTTY bool
+
+	// stdinOnce is set when the program reads the end of its input once the session closes the input stream.
+	stdinOnce bool
+
+	// workspaceVolume is the volume of the shared workspace of the session, which is mounted as the working directory instead of a tmpfs.
+	workspaceVolume string
+
+	// cgroupParent is the parent cgroup of the container, to which the cgroup v2 controls of the session are applied.
+	cgroupParent string
+
+	// gpuDevices are the indices of the GPUs allocated to the session.
+	gpuDevices []int
+
+	// attempt is the number of previous attempts to deploy the container of the session.
+	attempt int
+}
+
+// CoreDumpConfig is a configuration for capturing core dumps.
+// This requires the host core_pattern to write core files relative to the working directory of the crashed process (e.g. "core").
+type CoreDumpConfig struct {
+	// Dir is the directory in which core files are written.
+	Dir string `json:"dir"`
+
+	// MaxSize is the size limit of a core dump in bytes.
+	// If zero, defaultCoreLimit is used.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// defaultCoreLimit is the size limit of core dumps used when a CoreDumpConfig does not specify one.
+const defaultCoreLimit = 32 << 20
+
+// withCoreDump returns a copy of the ContainerConfig which allows core dumps.
+func (cc ContainerConfig) withCoreDump() ContainerConfig {
+	cc.coreLimit = cc.CoreDump.MaxSize
+	if cc.coreLimit == 0 {
+		cc.coreLimit = defaultCoreLimit
+	}
+	return cc
+}
+
+// Ulimit is a soft and hard resource limit.
+type Ulimit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+// ulimits generates the resource limits of the container, ordered by name.
+// Core dumps are disabled unless requested.
+func (cc ContainerConfig) ulimits() []*units.Ulimit {
+	names := make([]string, 0, len(cc.Ulimits))
+	for name := range cc.Ulimits {
+		if name != "core" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	limits := []*units.Ulimit{
+		{Name: "core", Soft: cc.coreLimit, Hard: cc.coreLimit},
+	}
+	for _, name := range names {
+		l := cc.Ulimits[name]
+		limits = append(limits, &units.Ulimit{Name: name, Soft: l.Soft, Hard: l.Hard})
+	}
+	return limits
+}
+
+// DebugConfig is a configuration for running code under a debugger (e.g. gdb, dlv, pdb).
+type DebugConfig struct {
+	// Command replaces the run command in debug mode.
+	Command []string `json:"cmd"`
+
+	// CapAdd is a list of extra capabilities (e.g. "SYS_PTRACE") added only in debug mode.
+	CapAdd []string `json:"cap_add,omitempty"`
+}
+
+// ProfileConfig is a configuration for running code under a profiler (e.g. perf, py-spy, pprof).
+type ProfileConfig struct {
+	// Command replaces the run command in profiling mode.
+	Command []string `json:"cmd"`
+
+	// Report is the absolute path of the report written by the profiler, which is returned to the client after exit.
+	Report string `json:"report"`
+
+	// CapAdd is a list of extra capabilities (e.g. "SYS_ADMIN" for perf) added only in profiling mode.
+	CapAdd []string `json:"cap_add,omitempty"`
+}
+
+// withProfile returns a copy of the ContainerConfig which runs the profiling configuration.
+func (cc ContainerConfig) withProfile() ContainerConfig {
+	cc.Command = cc.Profile.Command
+	caps := make([]string, 0, len(cc.CapAdd)+len(cc.Profile.CapAdd))
+	caps = append(caps, cc.CapAdd...)
+	cc.CapAdd = append(caps, cc.Profile.CapAdd...)
+	return cc
+}
+
+// withDebug returns a copy of the ContainerConfig which runs the debug configuration.
+func (cc ContainerConfig) withDebug() ContainerConfig {
+	cc.Command = cc.Debug.Command
+	caps := make([]string, 0, len(cc.CapAdd)+len(cc.Debug.CapAdd))
+	caps = append(caps, cc.CapAdd...)
+	cc.CapAdd = append(caps, cc.Debug.CapAdd...)
+	return cc
+}
+
+// defaultMemoryLimit is the memory limit in bytes of containers which do not specify one.
+const defaultMemoryLimit = 1 << 27 // 128MB
+
+// defaultPidsLimit is the process limit of containers which do not specify one, which stops fork bombs.
+const defaultPidsLimit = 256
+
+// memoryLimit returns the memory limit of the container in bytes.
+func (cc ContainerConfig) memoryLimit() int64 {
+	if cc.MemoryMB > 0 {
+		return cc.MemoryMB << 20
+	}
+	return defaultMemoryLimit
+}
+
+// pidsLimit returns the process limit of the container, or -1 if unlimited.
+func (cc ContainerConfig) pidsLimit() int64 {
+	switch {
+	case cc.PidsLimit < 0:
+		return -1
+	case cc.PidsLimit == 0:
+		return defaultPidsLimit
+	default:
+		return cc.PidsLimit
+	}
+}
+
+// defaultOOMScoreAdj is the OOM score adjustment used when a ContainerConfig does not specify one.
+const defaultOOMScoreAdj = 1000
+
+// memorySwap computes the Docker memory+swap limit of the container.
+func (cc ContainerConfig) memorySwap() int64 {
+	if cc.Swap < 0 {
+		return -1
+	}
+	return cc.memoryLimit() + cc.Swap
+}
+
+// oomScoreAdj returns the OOM score adjustment of the container.
+func (cc ContainerConfig) oomScoreAdj() int {
+	if cc.OOMScoreAdj == nil {
+		return defaultOOMScoreAdj
+	}
+	return *cc.OOMScoreAdj
+}
+
+// FileMount is a host file or directory mounted read-only into a container.
+type FileMount struct {
+	// Source is the path of the file or directory on the Docker host.
+	// Relative paths are resolved against the asset directory.
+	Source string `json:"src"`
+
+	// Target is the path at which the file or directory is mounted in the container.
+	Target string `json:"dst"`
+}
+
+// CommandVars is the set of values substituted into command placeholders.
+type CommandVars struct {
+	// EntryFile is the path of the user code file, substituted for {{entryfile}}.
+	EntryFile string
+
+	// Args is the list of program arguments, substituted for {{args}}.
+	Args []string
+
+	// WorkDir is the working directory, substituted for {{workdir}}.
+	WorkDir string
+}
+
+// expandCommand expands the placeholders in the command.
+// An element consisting only of {{args}} is replaced by all of the arguments.
+func (cc ContainerConfig) expandCommand(vars CommandVars) []string {
+	return expandArgs(cc.Command, vars)
+}
+
+// expandArgs expands the placeholders in a command line.
+func expandArgs(args []string, vars CommandVars) []string {
+	if args == nil {
+		return nil
+	}
+	cmd := make([]string, 0, len(args)+len(vars.Args))
+	repl := strings.NewReplacer(
+		"{{entryfile}}", vars.EntryFile,
+		"{{args}}", strings.Join(vars.Args, " "),
+		"{{workdir}}", vars.WorkDir,
+	)
+	for _, v := range args {
+		if v == "{{args}}" {
+			cmd = append(cmd, vars.Args...)
+			continue
+		}
+		cmd = append(cmd, repl.Replace(v))
+	}
+	return cmd
+}
+
+// withCommandVars returns a copy of the ContainerConfig with the command placeholders expanded.
+func (cc ContainerConfig) withCommandVars(vars CommandVars) ContainerConfig {
+	cc.Command = cc.expandCommand(vars)
+	cc.Compile = expandArgs(cc.Compile, vars)
+	cc.Setup = cc.Setup.withCommandVars(vars)
+	cc.Teardown = cc.Teardown.withCommandVars(vars)
+	if cc.Steps != nil {
+		steps := make([]Step, len(cc.Steps))
+		for i, st := range cc.Steps {
+			st.Command = expandArgs(st.Command, vars)
+			steps[i] = st
+		}
+		cc.Steps = steps
+	}
+	return cc
+}
+
+// Labels attached to every session container.
+const (
+	labelLanguage = "openrepl.language"
+	labelSession  = "openrepl.session"
+)
+
+// containerName generates the name of a session container.
+// Retried deployments are suffixed with their attempt, so that they do not conflict with a container left behind by a failed attempt.
+func containerName(lang string, session string, attempt int) string {
+	name := "openrepl-" + lang + "-" + session
+	if attempt > 0 {
+		name += "-" + strconv.Itoa(attempt)
+	}
+	return name
+}
+
+// createSessionNetwork creates a bridge network used only by a single session.
+// Inter-container communication is disabled on the bridge, and IPv6 is disabled as the egress firewall only covers IPv4.
+func createSessionNetwork(ctx context.Context, cli *client.Client, session string, labels map[string]string) (string, error) {
+	resp, err := cli.NetworkCreate(ctx, "openrepl-"+session, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+		EnableIPv6:     false,
+		Options: map[string]string{
+			"com.docker.network.bridge.enable_icc": "false",
+			"com.docker.network.bridge.name":       sessionBridge(session),
+		},
+		Labels: labels,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// ContainerDefaults is a set of server-wide defaults applied to every ContainerConfig.
+type ContainerDefaults struct {
+	// AssetDir is the directory on the Docker host against which relative file mounts are resolved.
+	AssetDir string
+
+	// LogDriver is the Docker log driver used when a ContainerConfig does not specify one.
+	LogDriver string
+
+	// LogOpts is the set of log driver options used along with LogDriver.
+	LogOpts map[string]string
+
+	// Labels is a set of labels attached to every container (e.g. environment, tenant).
+	// Labels set by a ContainerConfig take precedence.
+	Labels map[string]string
+
+	// Cpuset is the set of CPUs reserved for session containers.
+	// CPUs outside of the set are left for the server and the Docker daemon.
+	Cpuset string
+
+	// TmpfsSize is the default size limit of tmpfs mounts.
+	TmpfsSize string
+
+	// StorageSize is the default size limit of the writable layer of containers.
+	// If empty, the writable layer is only limited by the host disk.
+	StorageSize string
+
+	// Runtime is the OCI runtime (e.g. "runsc") used when a ContainerConfig does not specify one.
+	// GPU containers keep using the NVIDIA runtime.
+	Runtime string
+}
+
+// applyDefaults fills in unset fields of the ContainerConfig from the server defaults.
+func (cc *ContainerConfig) applyDefaults(d ContainerDefaults) {
+	// resolve relative file mount sources against the asset directory
+	for i, f := range cc.Files {
+		if !filepath.IsAbs(f.Source) {
+			cc.Files[i].Source = filepath.Join(d.AssetDir, f.Source)
+		}
+	}
+
+	// merge default labels
+	if len(d.Labels) > 0 {
+		labels := make(map[string]string, len(d.Labels)+len(cc.Labels))
+		for k, v := range d.Labels {
+			labels[k] = v
+		}
+		for k, v := range cc.Labels {
+			labels[k] = v
+		}
+		cc.Labels = labels
+	}
+
+	// use default logging configuration
+	if cc.LogDriver == "" {
+		cc.LogDriver = d.LogDriver
+		cc.LogOpts = d.LogOpts
+	}
+
+	// use default CPU set
+	if cc.Cpuset == "" {
+		cc.Cpuset = d.Cpuset
+	}
+
+	// use default tmpfs size
+	if cc.TmpfsSize == "" {
+		cc.TmpfsSize = d.TmpfsSize
+	}
+
+	// use default writable layer size
+	if cc.StorageSize == "" {
+		cc.StorageSize = d.StorageSize
+	}
+
+	// use default runtime
+	if cc.Runtime == "" && cc.GPU == nil {
+		cc.Runtime = d.Runtime
+	}
+}
+
+// tmpfs generates the tmpfs mounts for the container.
+// Mounts without an explicit size are limited to TmpfsSize, so that writes cannot consume unbounded host memory.
+func (cc ContainerConfig) tmpfs() map[string]string {
+	if len(cc.Tmpfs) == 0 && !cc.hasWorkspace() && !cc.ReadonlyRootfs {
+		return nil
+	}
+
+	// keep /tmp writable on a read-only root filesystem
+	tmpfs := cc.Tmpfs
+	if _, ok := tmpfs["/tmp"]; cc.ReadonlyRootfs && !ok {
+		tmpfs = make(map[string]string, len(cc.Tmpfs)+1)
+		for path, opts := range cc.Tmpfs {
+			tmpfs[path] = opts
+		}
+		tmpfs["/tmp"] = "mode=1777"
+	}
+
+	mnts := make(map[string]string, len(tmpfs)+1)
+	for path, opts := range tmpfs {
+		if cc.TmpfsSize != "" && !hasMountOption(opts, "size") {
+			if opts != "" {
+				opts += ","
+			}
+			opts += "size=" + cc.TmpfsSize
+		}
+		mnts[path] = opts
+	}
+	if cc.hasWorkspace() && cc.workspaceVolume == "" {
+		mnts[cc.WorkDir] = "rw,exec,mode=1777,size=" + cc.WorkspaceSize
+	}
+	return mnts
+}
+
+// sessionNanoCPUs is the CPU limit of session containers in billionths of a CPU.
+const sessionNanoCPUs = int64(time.Second/time.Nanosecond) / 2 // 1/2 CPU cap
+
+// nanoCPUs returns the CPU limit of the container, which is left to the parent cgroup if it allows bursts.
+func (cc ContainerConfig) nanoCPUs() int64 {
+	if cc.cgroupParent != "" && cc.Cgroup2 != nil && cc.Cgroup2.CPUBurst > 0 {
+		return 0
+	}
+	return sessionNanoCPUs
+}
+
+// hasWorkspace checks whether the working directory is mounted as a size-limited workspace.
+func (cc ContainerConfig) hasWorkspace() bool {
+	return cc.WorkspaceSize != "" && cc.WorkDir != ""
+}
+
+// storageOpt generates the storage driver options of the container, which limit the size of its writable layer.
+func (cc ContainerConfig) storageOpt() map[string]string {
+	if cc.StorageSize == "" {
+		return nil
+	}
+	return map[string]string{"size": cc.StorageSize}
+}
+
+// hasMountOption checks whether a comma-separated list of mount options sets the named option.
+func hasMountOption(opts string, name string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == name || strings.HasPrefix(o, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// mounts generates the mount specifications for the container.
+func (cc ContainerConfig) mounts() []mount.Mount {
+	if len(cc.Files) == 0 && cc.workspaceVolume == "" {
+		return nil
+	}
+	mnts := make([]mount.Mount, len(cc.Files), len(cc.Files)+1)
+	for i, f := range cc.Files {
+		mnts[i] = mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   f.Source,
+			Target:   f.Target,
+			ReadOnly: true,
+		}
+	}
+	if cc.workspaceVolume != "" {
+		mnts = append(mnts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: cc.workspaceVolume,
+			Target: cc.WorkDir,
+		})
+	}
+	return mnts
+}
+
+// GPUConfig is a configuration for exposing NVIDIA GPUs to a container.
+type GPUConfig struct {
+	// Count is the number of GPUs to expose, which are allocated to the session.
+	// If zero, all GPUs are exposed, and shared with other sessions.
+	Count int `json:"count,omitempty"`
+
+	// Capabilities is the list of driver capabilities to expose (e.g. "compute", "utility").
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// env generates the environment variables used by the NVIDIA runtime, exposing the devices allocated to the session.
+// If no devices are allocated, all devices are exposed.
+func (gc *GPUConfig) env(devices []int) []string {
+	visible := "all"
+	if len(devices) > 0 {
+		ids := make([]string, len(devices))
+		for i, d := range devices {
+			ids[i] = strconv.Itoa(d)
+		}
+		visible = strings.Join(ids, ",")
+	}
+	env := []string{"NVIDIA_VISIBLE_DEVICES=" + visible}
+	if len(gc.Capabilities) > 0 {
+		env = append(env, "NVIDIA_DRIVER_CAPABILITIES="+strings.Join(gc.Capabilities, ","))
+	}
+	return env
+}
+
+// withEnv returns a copy of the ContainerConfig with additional environment variables.
+func (cc ContainerConfig) withEnv(env ...string) ContainerConfig {
+	if len(env) == 0 {
+		return cc
+	}
+	nenv := make([]string, 0, len(cc.Env)+len(env))
+	nenv = append(nenv, cc.Env...)
+	cc.Env = append(nenv, env...)
+	return cc
 }
 
 // Container is a running container.
 type Container struct {
 	clck         sync.Mutex
 	closed       bool
-	cli          *client.Client
+	backend      ContainerBackend
 	ID           string
 	IO           io.ReadWriteCloser
 	closetimeout time.Duration
+
+	// cli is the Docker client of containers deployed on the Docker backend, and nil on other backends.
+	cli *client.Client
+
+	// network is the ID of the session network, which is removed along with the container.
+	network string
+
+	// lang is the language of the container, and created is the time at which it was created.
+	lang    string
+	created time.Time
+
+	// session is the ID of the session for which the container was deployed.
+	session string
+
+	// activity is the time of the last input or output of the program in Unix nanoseconds, accessed atomically.
+	activity int64
 }
 
 func (c *Container) Write(dat []byte) (int, error) {
-	return c.IO.Write(dat)
+	n, err := c.IO.Write(dat)
+	if n > 0 {
+		c.touch(time.Now())
+	}
+	return n, err
 }
 
 func (c *Container) Read(dat []byte) (int, error) {
-	return c.IO.Read(dat)
+	n, err := c.IO.Read(dat)
+	if n > 0 {
+		c.touch(time.Now())
+	}
+	return n, err
 }
 
 // Close closes and removes the container.
@@ -50,18 +784,21 @@ func (c *Container) Close() error {
 
 	// close websocket
 	cerr := c.IO.Close()
+	containersRunning.Add(-1, c.lang)
 
 	// remove container
 	ctx, cancel := context.WithTimeout(context.Background(), c.closetimeout)
 	defer cancel()
-	rerr := c.cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{
-		Force: true,
-	})
+	rerr := c.backend.Remove(ctx, c)
 
 	// handle errors
 	if rerr != nil {
-		log.Printf("failed to remove container: %s", rerr.Error())
+		Logger{Session: c.session}.Errorf("failed to remove container: %s", rerr.Error())
+	} else {
+		containersRemoved.Add(1, c.lang)
+		containerLifetime.Observe(time.Since(c.created).Seconds(), c.lang)
 	}
+
 	err := cerr
 	if err != nil {
 		err = rerr
@@ -70,23 +807,104 @@ func (c *Container) Close() error {
 }
 
 // Deploy deploys a container with this configuration.
-func (cc ContainerConfig) Deploy(ctx context.Context, cli *client.Client, stoptimeout time.Duration, prestart func(context.Context, *Container) error) (cont *Container, err error) {
-	// create container
-	c, err := cli.ContainerCreate(ctx, &container.Config{
+// The container is labeled with the session ID and named after the language and session.
+func (cc ContainerConfig) Deploy(ctx context.Context, cli *client.Client, session string, stoptimeout time.Duration, prestart func(context.Context, *Container) error) (cont *Container, err error) {
+	// count failures which were not caused by the client going away
+	defer func() {
+		if err != nil && ctx.Err() != context.Canceled {
+			deployFailures.Add(1, cc.Language)
+		}
+	}()
+
+	// generate labels
+	labels := make(map[string]string, len(cc.Labels)+2)
+	for k, v := range cc.Labels {
+		labels[k] = v
+	}
+	labels[labelLanguage] = cc.Language
+	labels[labelSession] = session
+
+	// prepare container configuration
+	cfg := &container.Config{
 		Image:           cc.Image,
 		Cmd:             cc.Command,
-		Tty:             true,
+		Entrypoint:      cc.Entrypoint,
+		Env:             cc.Env,
+		WorkingDir:      cc.WorkDir,
+		User:            cc.User,
+		Labels:          labels,
+		Tty:             !cc.noTTY,
 		OpenStdin:       true,
-		NetworkDisabled: true,
-	}, &container.HostConfig{
+		StdinOnce:       cc.stdinOnce,
+		NetworkDisabled: !cc.Network,
+	}
+	hcfg := &container.HostConfig{
+		Runtime:        cc.Runtime,
+		SecurityOpt:    cc.securityOpts(),
+		CapAdd:         cc.CapAdd,
+		CapDrop:        cc.CapDrop,
+		ReadonlyRootfs: cc.ReadonlyRootfs,
+		Tmpfs:          cc.tmpfs(),
+		Mounts:         cc.mounts(),
+		StorageOpt:     cc.storageOpt(),
+		LogConfig: container.LogConfig{
+			Type:   cc.LogDriver,
+			Config: cc.LogOpts,
+		},
+		OomScoreAdj: cc.oomScoreAdj(),
 		Resources: container.Resources{
-			NanoCPUs: int64(time.Second/time.Nanosecond) / 2, // 1/2 CPU cap
-			Memory:   1 << 27,                                // cap at 128MB
+			CgroupParent:     cc.cgroupParent,
+			NanoCPUs:         cc.nanoCPUs(),
+			Memory:           cc.memoryLimit(),
+			MemorySwap:       cc.memorySwap(),
+			MemorySwappiness: cc.Swappiness,
+			CPUShares:        cc.CPUShares,
+			CpusetCpus:       cc.Cpuset,
+			PidsLimit:        cc.pidsLimit(),
+			Ulimits:          cc.ulimits(),
 		},
-	}, nil, "")
+	}
+
+	// expose GPUs through the NVIDIA runtime
+	if cc.GPU != nil {
+		if hcfg.Runtime == "" {
+			hcfg.Runtime = "nvidia"
+		}
+		cfg.Env = cc.withEnv(cc.GPU.env(cc.gpuDevices)...).Env
+	}
+
+	// create an isolated network for the session
+	var netid string
+	if cc.Network {
+		netid, err = createSessionNetwork(ctx, cli, session, labels)
+		if err != nil {
+			return nil, err
+		}
+		hcfg.NetworkMode = container.NetworkMode(netid)
+		defer func() {
+			if err != nil {
+				delctx, cancel := context.WithTimeout(context.Background(), stoptimeout)
+				defer cancel()
+				nerr := cli.NetworkRemove(delctx, netid)
+				if nerr != nil {
+					Logger{Session: session}.Errorf("failed to remove network: %s", nerr.Error())
+				}
+			}
+		}()
+	}
+
+	// create container
+	t := time.Now()
+	c, err := cli.ContainerCreate(ctx, cfg, hcfg, nil, containerName(cc.Language, session, cc.attempt))
+	spanFromContext(ctx).Record("create", t, err)
 	if err != nil {
+		if cc.StorageSize != "" && strings.Contains(err.Error(), "storage-opt") {
+			err = fmt.Errorf("storage size limit not supported by the storage driver: %s", err.Error())
+		}
 		return nil, err
 	}
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "create")
+	containersCreated.Add(1, cc.Language)
 
 	// cleanup container on failed startup
 	defer func() {
@@ -97,15 +915,22 @@ func (cc ContainerConfig) Deploy(ctx context.Context, cli *client.Client, stopti
 				Force: true,
 			})
 			if rerr != nil {
-				log.Printf("failed to remove container: %s", rerr.Error())
+				Logger{Session: session}.Errorf("failed to remove container: %s", rerr.Error())
+			} else {
+				containersRemoved.Add(1, cc.Language)
 			}
 		}
 	}()
 
 	cont = &Container{
+		backend:      DockerBackend{Client: cli, StopTimeout: stoptimeout},
 		cli:          cli,
 		ID:           c.ID,
 		closetimeout: stoptimeout,
+		network:      netid,
+		lang:         cc.Language,
+		created:      t,
+		session:      session,
 	}
 
 	// run prestart hook
@@ -117,24 +942,141 @@ func (cc ContainerConfig) Deploy(ctx context.Context, cli *client.Client, stopti
 	}
 
 	// attach to container
+	t = time.Now()
 	resp, err := cli.ContainerAttach(ctx, c.ID, types.ContainerAttachOptions{
 		Stream: true,
 		Stdin:  true,
 		Stdout: true,
 		Stderr: true,
 	})
+	spanFromContext(ctx).Record("attach", t, err)
 	if err != nil {
 		return nil, err
 	}
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "attach")
 
 	// start container
+	t = time.Now()
 	err = cli.ContainerStart(ctx, c.ID, types.ContainerStartOptions{})
+	spanFromContext(ctx).Record("start", t, err)
 	if err != nil {
 		return nil, err
 	}
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "start")
 
 	// convert to websocket
 	cont.IO = resp.Conn
 
+	// wait for services inside the container
+	err = cont.waitReady(ctx, cc)
+	if err != nil {
+		resp.Close()
+		return nil, err
+	}
+
+	// run init command
+	if len(cc.Init) > 0 {
+		err = cont.Exec(ctx, cc.Init)
+		if err != nil {
+			resp.Close()
+			return nil, err
+		}
+	}
+
+	containersRunning.Add(1, cc.Language)
 	return cont, nil
 }
+
+// readinessPollRate is the interval at which container readiness is checked.
+const readinessPollRate = 250 * time.Millisecond
+
+// waitReady waits until the readiness command succeeds and the healthcheck reports healthy, as configured.
+func (c *Container) waitReady(ctx context.Context, cc ContainerConfig) error {
+	if len(cc.Readiness) == 0 && !cc.WaitHealthy {
+		return nil
+	}
+	tick := time.NewTicker(readinessPollRate)
+	defer tick.Stop()
+	for {
+		ready, err := c.checkReady(ctx, cc)
+		if err != nil {
+			return err
+		}
+		if ready {
+			return nil
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return errors.New("container did not become ready in time")
+		}
+	}
+}
+
+// checkReady checks the readiness of the container once.
+func (c *Container) checkReady(ctx context.Context, cc ContainerConfig) (bool, error) {
+	// check healthcheck status
+	if cc.WaitHealthy {
+		insp, err := c.cli.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return false, err
+		}
+		if insp.State == nil || insp.State.Health == nil {
+			return false, errors.New("image does not define a healthcheck")
+		}
+		switch insp.State.Health.Status {
+		case types.Healthy:
+		case types.Unhealthy:
+			return false, errors.New("container is unhealthy")
+		default:
+			return false, nil
+		}
+	}
+
+	// run readiness command
+	if len(cc.Readiness) > 0 {
+		_, code, err := c.ExecOutput(ctx, cc.Readiness)
+		if err != nil {
+			return false, err
+		}
+		if code != 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Exec runs a command inside the container and waits for it to complete.
+// The output of the command is discarded.
+func (c *Container) Exec(ctx context.Context, cmd []string) error {
+	_, code, err := c.ExecOutput(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("command %q exited with status %d", strings.Join(cmd, " "), code)
+	}
+	return nil
+}
+
+// ExecOutput runs a command inside the container and returns the standard output and exit code.
+func (c *Container) ExecOutput(ctx context.Context, cmd []string) ([]byte, int, error) {
+	buf := bytes.NewBuffer(nil)
+	code, err := c.ExecTo(ctx, cmd, buf, ioutil.Discard)
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), code, nil
+}
+
+// ExecTo runs a command inside the container, copying output to the given writers, and returns the exit code.
+func (c *Container) ExecTo(ctx context.Context, cmd []string, stdout, stderr io.Writer) (int, error) {
+	return c.ExecInput(ctx, cmd, nil, stdout, stderr)
+}
+
+// ExecInput runs a command inside the container with the given standard input, copying output to the given writers, and returns the exit code.
+// If stdin is nil, the command has no input.
+func (c *Container) ExecInput(ctx context.Context, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return c.backend.ExecInput(ctx, c, cmd, stdin, stdout, stderr)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandCommand(t *testing.T) {
+	vars := CommandVars{
+		EntryFile: "/code",
+		Args:      []string{"a", "b c"},
+		WorkDir:   "/work",
+	}
+	tbl := []struct {
+		cmd    []string
+		expect []string
+	}{
+		{
+			cmd:    nil,
+			expect: nil,
+		},
+		{
+			cmd:    []string{},
+			expect: []string{},
+		},
+		{
+			cmd:    []string{"{{entryfile}}"},
+			expect: []string{"/code"},
+		},
+		{
+			cmd:    []string{"{{entryfile}}", "{{args}}"},
+			expect: []string{"/code", "a", "b c"},
+		},
+		{
+			cmd:    []string{"sh", "-c", "cd {{workdir}} && ./run {{args}}"},
+			expect: []string{"sh", "-c", "cd /work && ./run a b c"},
+		},
+		{
+			cmd:    []string{"--file={{entryfile}}"},
+			expect: []string{"--file=/code"},
+		},
+	}
+	for _, v := range tbl {
+		got := ContainerConfig{Command: v.cmd}.expandCommand(vars)
+		if !reflect.DeepEqual(v.expect, got) {
+			t.Errorf("expected %q but got %q", v.expect, got)
+		}
+	}
+}
+
+func TestTmpfs(t *testing.T) {
+	tbl := []struct {
+		opts   string
+		size   string
+		expect string
+	}{
+		{
+			opts:   "",
+			size:   "64m",
+			expect: "size=64m",
+		},
+		{
+			opts:   "rw,mode=1777",
+			size:   "64m",
+			expect: "rw,mode=1777,size=64m",
+		},
+		{
+			opts:   "rw,size=16m",
+			size:   "64m",
+			expect: "rw,size=16m",
+		},
+		{
+			opts:   "rw",
+			size:   "",
+			expect: "rw",
+		},
+	}
+	for _, v := range tbl {
+		got := ContainerConfig{
+			Tmpfs:     map[string]string{"/tmp": v.opts},
+			TmpfsSize: v.size,
+		}.tmpfs()["/tmp"]
+		if got != v.expect {
+			t.Errorf("expected %q but got %q", v.expect, got)
+		}
+	}
+
+	// a read-only root filesystem keeps /tmp writable
+	mnts := ContainerConfig{ReadonlyRootfs: true, TmpfsSize: "64m"}.tmpfs()
+	if len(mnts) != 1 || mnts["/tmp"] != "mode=1777,size=64m" {
+		t.Errorf("unexpected mounts %v", mnts)
+	}
+	mnts = ContainerConfig{ReadonlyRootfs: true, Tmpfs: map[string]string{"/tmp": "rw"}}.tmpfs()
+	if len(mnts) != 1 || mnts["/tmp"] != "rw" {
+		t.Errorf("unexpected mounts %v", mnts)
+	}
+}
+
+func TestWorkspaceVolumeMount(t *testing.T) {
+	cc := ContainerConfig{WorkDir: "/work", WorkspaceSize: "32m", workspaceVolume: "openrepl-workspace-abc"}
+	if _, ok := cc.tmpfs()["/work"]; ok {
+		t.Error("expected shared workspace to replace the tmpfs workspace")
+	}
+	mnts := cc.mounts()
+	if len(mnts) != 1 || mnts[0].Source != "openrepl-workspace-abc" || mnts[0].Target != "/work" || mnts[0].ReadOnly {
+		t.Errorf("unexpected mounts %+v", mnts)
+	}
+}
+
+func TestStorageOpt(t *testing.T) {
+	if opt := (ContainerConfig{}).storageOpt(); opt != nil {
+		t.Errorf("expected no storage options, got %v", opt)
+	}
+	cc := ContainerConfig{}
+	cc.applyDefaults(ContainerDefaults{StorageSize: "1g"})
+	if opt := cc.storageOpt(); len(opt) != 1 || opt["size"] != "1g" {
+		t.Errorf("unexpected storage options %v", opt)
+	}
+	cc = ContainerConfig{StorageSize: "256m"}
+	cc.applyDefaults(ContainerDefaults{StorageSize: "1g"})
+	if cc.StorageSize != "256m" {
+		t.Errorf("default overrode storage size %q", cc.StorageSize)
+	}
+}
+
+func TestContainerName(t *testing.T) {
+	if name := containerName("python3", "abc", 0); name != "openrepl-python3-abc" {
+		t.Errorf("unexpected name %s", name)
+	}
+	if name := containerName("python3", "abc", 2); name != "openrepl-python3-abc-2" {
+		t.Errorf("unexpected name %s of a retried deployment", name)
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	tbl := []struct {
+		cc     ContainerConfig
+		memory int64
+		pids   int64
+	}{
+		{
+			cc:     ContainerConfig{},
+			memory: defaultMemoryLimit,
+			pids:   defaultPidsLimit,
+		},
+		{
+			cc:     ContainerConfig{MemoryMB: 512, PidsLimit: 64},
+			memory: 512 << 20,
+			pids:   64,
+		},
+		{
+			cc:     ContainerConfig{PidsLimit: -1},
+			memory: defaultMemoryLimit,
+			pids:   -1,
+		},
+	}
+	for _, v := range tbl {
+		if got := v.cc.memoryLimit(); got != v.memory {
+			t.Errorf("expected memory limit %d but got %d", v.memory, got)
+		}
+		if got := v.cc.pidsLimit(); got != v.pids {
+			t.Errorf("expected pids limit %d but got %d", v.pids, got)
+		}
+	}
+}
+
+func TestUlimits(t *testing.T) {
+	cc := ContainerConfig{
+		Ulimits: map[string]Ulimit{
+			"nproc":  {Soft: 64, Hard: 128},
+			"core":   {Soft: 1 << 30, Hard: 1 << 30},
+			"nofile": {Soft: 256, Hard: 512},
+		},
+	}
+	var got []string
+	for _, l := range cc.ulimits() {
+		got = append(got, l.String())
+	}
+	expect := []string{"core=0:0", "nofile=256:512", "nproc=64:128"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %v but got %v", expect, got)
+	}
+}
+
+func TestDefaultRuntime(t *testing.T) {
+	d := ContainerDefaults{Runtime: "runsc"}
+	tbl := []struct {
+		cc      ContainerConfig
+		runtime string
+	}{
+		{ContainerConfig{}, "runsc"},
+		{ContainerConfig{Runtime: "kata-runtime"}, "kata-runtime"},
+		{ContainerConfig{GPU: &GPUConfig{}}, ""},
+	}
+	for _, v := range tbl {
+		cc := v.cc
+		cc.applyDefaults(d)
+		if cc.Runtime != v.runtime {
+			t.Errorf("expected runtime %q but got %q", v.runtime, cc.Runtime)
+		}
+	}
+}
+
+func TestCompileCommandVars(t *testing.T) {
+	cc := ContainerConfig{Compile: []string{"cc", "-o", "{{workdir}}/a.out", "{{entryfile}}"}}
+	if !cc.usesPipeline() {
+		t.Error("languages with a compile command must run as a pipeline")
+	}
+	cc = cc.withCommandVars(CommandVars{EntryFile: "/tmp/code.c", WorkDir: "/tmp"})
+	if expect := []string{"cc", "-o", "/tmp/a.out", "/tmp/code.c"}; !reflect.DeepEqual(cc.Compile, expect) {
+		t.Errorf("expected compile command %q but got %q", expect, cc.Compile)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// DockerDiskUsage is the disk space in bytes used by the Docker daemon.
+type DockerDiskUsage struct {
+	Images     int64 `json:"images"`
+	Containers int64 `json:"containers"`
+	Volumes    int64 `json:"volumes"`
+	BuildCache int64 `json:"build_cache"`
+}
+
+// Total returns the total disk space used.
+func (u DockerDiskUsage) Total() int64 {
+	return u.Images + u.Containers + u.Volumes + u.BuildCache
+}
+
+// dockerDiskUsage records the disk space used by the Docker daemon.
+var dockerDiskUsage = &Gauge{
+	Name:   "openrepl_docker_disk_bytes",
+	Help:   "Disk space used by the Docker daemon.",
+	Labels: []string{"type"},
+}
+
+func init() {
+	metrics.Register(dockerDiskUsage)
+}
+
+// DiskMonitor monitors the disk usage of the Docker daemon, pruning unused data and rejecting sessions when it grows too large.
+// A nil DiskMonitor accepts all sessions.
+type DiskMonitor struct {
+	// Client is the client of the monitored daemon.
+	Client *client.Client
+
+	// PruneAbove is the disk usage in bytes above which stopped session containers, dangling images and the build cache are pruned.
+	// If zero, nothing is pruned.
+	PruneAbove int64
+
+	// RejectAbove is the disk usage in bytes above which new sessions are rejected.
+	// If zero, sessions are never rejected.
+	RejectAbove int64
+
+	lck   sync.Mutex
+	usage DockerDiskUsage
+}
+
+// measure queries the disk usage of the daemon.
+func (dm *DiskMonitor) measure(ctx context.Context) (DockerDiskUsage, error) {
+	du, err := dm.Client.DiskUsage(ctx)
+	if err != nil {
+		return DockerDiskUsage{}, err
+	}
+	usage := DockerDiskUsage{
+		Images:     du.LayersSize,
+		BuildCache: du.BuilderSize,
+	}
+	for _, c := range du.Containers {
+		usage.Containers += c.SizeRw
+	}
+	for _, v := range du.Volumes {
+		if v.UsageData != nil && v.UsageData.Size > 0 {
+			usage.Volumes += v.UsageData.Size
+		}
+	}
+	return usage, nil
+}
+
+// prune removes stopped session containers, dangling images and the build cache, returning the amount of space reclaimed.
+// Only containers labeled by a server are removed, so that the stopped containers of other users of the daemon are kept.
+func (dm *DiskMonitor) prune(ctx context.Context) (uint64, error) {
+	var reclaimed uint64
+	cargs := filters.NewArgs()
+	cargs.Add("label", labelServer)
+	crep, err := dm.Client.ContainersPrune(ctx, cargs)
+	if err != nil {
+		return reclaimed, err
+	}
+	reclaimed += crep.SpaceReclaimed
+	irep, err := dm.Client.ImagesPrune(ctx, filters.NewArgs())
+	if err != nil {
+		return reclaimed, err
+	}
+	reclaimed += irep.SpaceReclaimed
+	brep, err := dm.Client.BuildCachePrune(ctx)
+	if err != nil {
+		return reclaimed, err
+	}
+	reclaimed += brep.SpaceReclaimed
+	return reclaimed, nil
+}
+
+// update measures the disk usage, pruning if it is above the threshold.
+func (dm *DiskMonitor) update(ctx context.Context) error {
+	usage, err := dm.measure(ctx)
+	if err != nil {
+		return err
+	}
+
+	// prune unused data
+	if dm.PruneAbove > 0 && usage.Total() > dm.PruneAbove {
+		reclaimed, err := dm.prune(ctx)
+		serverLog.Printf("pruned docker data: %d MB reclaimed", reclaimed>>20)
+		if err != nil {
+			return err
+		}
+		usage, err = dm.measure(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// export usage
+	dockerDiskUsage.Set(float64(usage.Images), "images")
+	dockerDiskUsage.Set(float64(usage.Containers), "containers")
+	dockerDiskUsage.Set(float64(usage.Volumes), "volumes")
+	dockerDiskUsage.Set(float64(usage.BuildCache), "build_cache")
+
+	dm.lck.Lock()
+	defer dm.lck.Unlock()
+	dm.usage = usage
+	return nil
+}
+
+// Usage returns the most recently measured disk usage.
+func (dm *DiskMonitor) Usage() DockerDiskUsage {
+	dm.lck.Lock()
+	defer dm.lck.Unlock()
+	return dm.usage
+}
+
+// Check checks whether the disk usage is low enough to start a new session.
+func (dm *DiskMonitor) Check() error {
+	if dm == nil || dm.RejectAbove <= 0 {
+		return nil
+	}
+	if total := dm.Usage().Total(); total > dm.RejectAbove {
+		return fmt.Errorf("insufficient docker disk space: %d MB used", total>>20)
+	}
+	return nil
+}
+
+// Run periodically measures the disk usage.
+func (dm *DiskMonitor) Run(interval time.Duration) {
+	if dm == nil {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for ; ; <-tick.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := dm.update(ctx)
+		cancel()
+		if err != nil {
+			serverLog.Errorf("failed to check docker disk usage: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/client"
+)
+
+// DockerConfig is a configuration for connecting to a Docker daemon.
+// Unset connection fields are taken from the standard DOCKER_* environment variables.
+type DockerConfig struct {
+	// Host is the address of the daemon (e.g. "unix:///var/run/docker.sock", "tcp://10.0.0.2:2376").
+	Host string
+
+	// Podman selects the Docker-compatible API service of Podman as the default daemon, in place of Docker.
+	// Its address is taken from CONTAINER_HOST, or the socket of the current user if unset.
+	Podman bool
+
+	// APIVersion is the API version used to talk to the daemon.
+	// If empty, the default version of the client is used.
+	APIVersion string
+
+	// TLSCA is the path of the CA certificate used to verify the daemon.
+	TLSCA string
+
+	// TLSCert and TLSKey are the paths of the client certificate and key used to authenticate to the daemon.
+	TLSCert string
+	TLSKey  string
+
+	// DialTimeout is the timeout for establishing a connection to the daemon.
+	// If zero, there is no timeout.
+	DialTimeout time.Duration
+
+	// MaxIdleConns is the maximum number of idle connections kept open to the daemon.
+	// If zero, the default of net/http is used.
+	MaxIdleConns int
+
+	// IdleConnTimeout is the time after which idle connections are closed.
+	// If zero, idle connections are kept open.
+	IdleConnTimeout time.Duration
+}
+
+// tlsConfig loads the TLS configuration, returning nil if TLS is not configured.
+func (dc DockerConfig) tlsConfig() (*tls.Config, error) {
+	if dc.TLSCA == "" && dc.TLSCert == "" && dc.TLSKey == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	// load CA certificate
+	if dc.TLSCA != "" {
+		pem, err := ioutil.ReadFile(dc.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + dc.TLSCA)
+		}
+		tc.RootCAs = pool
+	}
+
+	// load client certificate
+	if dc.TLSCert != "" || dc.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(dc.TLSCert, dc.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// fromEnv fills in unset connection fields from the standard DOCKER_* environment variables.
+func (dc DockerConfig) fromEnv() DockerConfig {
+	if dc.Host == "" && dc.Podman {
+		dc.Host = os.Getenv("CONTAINER_HOST")
+		if dc.Host == "" {
+			dc.Host = podmanHost(os.Geteuid(), os.Getenv("XDG_RUNTIME_DIR"))
+		}
+	}
+	if dc.Host == "" {
+		dc.Host = os.Getenv("DOCKER_HOST")
+	}
+	if dc.Host == "" {
+		dc.Host = client.DefaultDockerHost
+	}
+	if dc.APIVersion == "" {
+		dc.APIVersion = os.Getenv("DOCKER_API_VERSION")
+	}
+	if dc.APIVersion == "" {
+		dc.APIVersion = api.DefaultVersion
+	}
+	if certs := os.Getenv("DOCKER_CERT_PATH"); certs != "" && dc.TLSCA == "" && dc.TLSCert == "" && dc.TLSKey == "" {
+		dc.TLSCA = filepath.Join(certs, "ca.pem")
+		dc.TLSCert = filepath.Join(certs, "cert.pem")
+		dc.TLSKey = filepath.Join(certs, "key.pem")
+	}
+	return dc
+}
+
+// podmanHost returns the address of the Podman API socket for a user.
+// Rootless Podman serves the API from the runtime directory of the user.
+func podmanHost(uid int, runtimeDir string) string {
+	if uid == 0 {
+		return "unix:///run/podman/podman.sock"
+	}
+	if runtimeDir == "" {
+		runtimeDir = "/run/user/" + strconv.Itoa(uid)
+	}
+	return "unix://" + path.Join(runtimeDir, "podman", "podman.sock")
+}
+
+// Local returns whether the daemon runs on this host, being reached over a socket or the loopback interface.
+func (dc DockerConfig) Local() bool {
+	hostURL, err := client.ParseHostURL(dc.fromEnv().Host)
+	if err != nil {
+		return false
+	}
+	switch hostURL.Scheme {
+	case "unix", "npipe":
+		return true
+	}
+	host, _, err := net.SplitHostPort(hostURL.Host)
+	if err != nil {
+		host = hostURL.Host
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// NewClient creates a Docker client using the configuration.
+func (dc DockerConfig) NewClient() (*client.Client, error) {
+	dc = dc.fromEnv()
+	host, version := dc.Host, dc.APIVersion
+	hostURL, err := client.ParseHostURL(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare transport
+	tc, err := dc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: dc.DialTimeout}
+	tr := &http.Transport{
+		TLSClientConfig:     tc,
+		TLSHandshakeTimeout: dc.DialTimeout,
+		MaxIdleConns:        dc.MaxIdleConns,
+		MaxIdleConnsPerHost: dc.MaxIdleConns,
+		IdleConnTimeout:     dc.IdleConnTimeout,
+	}
+	switch hostURL.Scheme {
+	case "unix":
+		tr.DisableCompression = true
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", hostURL.Host)
+		}
+	case "tcp":
+		tr.Proxy = http.ProxyFromEnvironment
+		tr.DialContext = dialer.DialContext
+	default:
+		return nil, errors.New("unsupported docker host protocol " + hostURL.Scheme)
+	}
+
+	return client.NewClient(host, version, &http.Client{
+		Transport:     tr,
+		CheckRedirect: client.CheckRedirect,
+	}, nil)
+}
+
+// DockerHost is a Docker daemon with a health-checked client.
+type DockerHost struct {
+	// Name is the name of the daemon used in logs.
+	Name string
+
+	// Client is the client connected to the daemon.
+	Client *client.Client
+
+	// unhealthy is set while the daemon fails health checks.
+	unhealthy int32
+}
+
+// Healthy checks whether the daemon passed its most recent health check.
+// A nil DockerHost is always healthy.
+func (dh *DockerHost) Healthy() bool {
+	return dh == nil || atomic.LoadInt32(&dh.unhealthy) == 0
+}
+
+// check pings the daemon and updates its health.
+func (dh *DockerHost) check(ctx context.Context) error {
+	_, err := dh.Client.Ping(ctx)
+	if err != nil {
+		atomic.StoreInt32(&dh.unhealthy, 1)
+		return err
+	}
+	if atomic.SwapInt32(&dh.unhealthy, 0) != 0 {
+		serverLog.Printf("docker daemon %s recovered", dh.Name)
+	}
+	return nil
+}
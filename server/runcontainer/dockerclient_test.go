@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPodmanHost(t *testing.T) {
+	tbl := []struct {
+		uid        int
+		runtimeDir string
+		host       string
+	}{
+		{0, "/run/user/0", "unix:///run/podman/podman.sock"},
+		{1000, "/run/user/1000", "unix:///run/user/1000/podman/podman.sock"},
+		{1000, "", "unix:///run/user/1000/podman/podman.sock"},
+		{1001, "/tmp/xdg/", "unix:///tmp/xdg/podman/podman.sock"},
+	}
+	for _, v := range tbl {
+		if host := podmanHost(v.uid, v.runtimeDir); host != v.host {
+			t.Errorf("uid %d in %q: expected %s but got %s", v.uid, v.runtimeDir, v.host, host)
+		}
+	}
+}
+
+func TestDockerConfigLocal(t *testing.T) {
+	os.Unsetenv("DOCKER_HOST")
+	tbl := []struct {
+		host  string
+		local bool
+	}{
+		{"", true},
+		{"unix:///var/run/docker.sock", true},
+		{"npipe:////./pipe/docker_engine", true},
+		{"tcp://127.0.0.1:2375", true},
+		{"tcp://localhost:2375", true},
+		{"tcp://[::1]:2376", true},
+		{"tcp://10.0.0.2:2376", false},
+		{"tcp://docker.example.com:2376", false},
+	}
+	for _, v := range tbl {
+		if local := (DockerConfig{Host: v.host}).Local(); local != v.local {
+			t.Errorf("%q: expected local %t but got %t", v.host, v.local, local)
+		}
+	}
+}
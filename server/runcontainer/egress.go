@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// errEgressUnsupported is returned when a language restricts egress but the server has no egress firewall.
+var errEgressUnsupported = errors.New("egress restrictions require the egress firewall to be enabled")
+
+// EgressFirewall restricts the destinations reachable from session networks with iptables rules.
+// Each restricted session gets its own chain, to which the DOCKER-USER chain sends traffic entering from the session bridge.
+// This requires the server to run on the Docker host with CAP_NET_ADMIN.
+// The rules only cover IPv4, so session networks are created without IPv6.
+// A nil EgressFirewall does not restrict egress.
+type EgressFirewall struct {
+	// Command is the path of the iptables binary.
+	Command string
+
+	// Default is the allow-list of networked languages which do not have their own.
+	// If empty, the egress of such languages is unrestricted.
+	Default []string
+
+	// Resolvers are the IPv4 addresses of the DNS servers which restricted sessions may query.
+	// Queries to other servers are dropped, so that they cannot carry data to arbitrary hosts.
+	Resolvers []string
+}
+
+// readResolvers reads the IPv4 nameservers of a resolv.conf file.
+// Loopback nameservers are skipped, as they are not reachable from session networks.
+func readResolvers(path string) ([]string, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var resolvers []string
+	for _, line := range strings.Split(string(dat), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(fields[1])
+		if ip != nil && ip.To4() != nil && !ip.IsLoopback() {
+			resolvers = append(resolvers, ip.String())
+		}
+	}
+	return resolvers, nil
+}
+
+// egressChain returns the name of the iptables chain of a session.
+// Chain names are limited to 28 characters.
+func egressChain(session string) string {
+	name := "openrepl-" + session
+	if len(name) > 28 {
+		name = name[:28]
+	}
+	return name
+}
+
+// allowList returns the allow-list of a language, or nil if its egress is unrestricted.
+func (ef *EgressFirewall) allowList(cc ContainerConfig) []string {
+	if len(cc.Egress) > 0 {
+		return cc.Egress
+	}
+	if ef == nil {
+		return nil
+	}
+	return ef.Default
+}
+
+// resolveEgress converts an allow-list of domains, IP addresses and CIDRs into IPv4 networks.
+// Domains are resolved when the session starts.
+func resolveEgress(ctx context.Context, allow []string) ([]string, error) {
+	var nets []string
+	for _, a := range allow {
+		a = strings.TrimSpace(a)
+		if _, ipnet, err := net.ParseCIDR(a); err == nil {
+			nets = append(nets, ipnet.String())
+			continue
+		}
+		if net.ParseIP(a) != nil {
+			nets = append(nets, a)
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, a)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve allowed host %s: %s", a, err.Error())
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				nets = append(nets, addr.IP.String())
+			}
+		}
+	}
+	return nets, nil
+}
+
+// iptables runs an iptables command.
+func (ef *EgressFirewall) iptables(args ...string) error {
+	out, err := exec.Command(ef.Command, append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %s: %s", strings.Join(args, " "), err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// apply restricts the traffic from the bridge of a session to the allowed destinations.
+// Replies, and DNS queries to the resolvers of the firewall, are always allowed.
+func (ef *EgressFirewall) apply(ctx context.Context, session string, allow []string) error {
+	nets, err := resolveEgress(ctx, allow)
+	if err != nil {
+		return err
+	}
+
+	// replace any rules left by a previous deployment attempt
+	ef.remove(session)
+	chain := egressChain(session)
+	rules := [][]string{
+		{"-N", chain},
+		{"-A", chain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"},
+	}
+	for _, r := range ef.Resolvers {
+		rules = append(rules,
+			[]string{"-A", chain, "-d", r, "-p", "udp", "--dport", "53", "-j", "RETURN"},
+			[]string{"-A", chain, "-d", r, "-p", "tcp", "--dport", "53", "-j", "RETURN"},
+		)
+	}
+	for _, n := range nets {
+		rules = append(rules, []string{"-A", chain, "-d", n, "-j", "RETURN"})
+	}
+	rules = append(rules,
+		[]string{"-A", chain, "-j", "DROP"},
+		[]string{"-I", "DOCKER-USER", "-i", sessionBridge(session), "-j", chain},
+	)
+	for _, args := range rules {
+		err = ef.iptables(args...)
+		if err != nil {
+			ef.remove(session)
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes the rules of a session, ignoring rules which do not exist.
+func (ef *EgressFirewall) remove(session string) {
+	if ef == nil {
+		return
+	}
+	chain := egressChain(session)
+	ef.iptables("-D", "DOCKER-USER", "-i", sessionBridge(session), "-j", chain)
+	ef.iptables("-F", chain)
+	ef.iptables("-X", chain)
+}
+
+// restrictEgress wraps a prestart hook so that the egress of a networked session is restricted before its container starts.
+func (cs *ContainerSession) restrictEgress(cc ContainerConfig, prestart func(context.Context, *Container) error) (func(context.Context, *Container) error, error) {
+	ef := cs.Config.Egress
+	allow := ef.allowList(cc)
+	if !cc.Network || len(allow) == 0 {
+		return prestart, nil
+	}
+	if ef == nil {
+		return nil, errEgressUnsupported
+	}
+	return func(ctx context.Context, c *Container) error {
+		err := ef.apply(ctx, cs.ID, allow)
+		if err != nil {
+			return err
+		}
+		cs.Events.Record("egress_restricted", strings.Join(allow, ","))
+		if prestart == nil {
+			return nil
+		}
+		return prestart(ctx, c)
+	}, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveEgress(t *testing.T) {
+	nets, err := resolveEgress(context.Background(), []string{"10.1.2.3/8", " 192.0.2.1 "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"10.0.0.0/8", "192.0.2.1"}; !reflect.DeepEqual(nets, expect) {
+		t.Errorf("expected %v, got %v", expect, nets)
+	}
+	if _, err := resolveEgress(context.Background(), []string{"host.invalid"}); err == nil {
+		t.Error("expected unresolvable host to fail")
+	}
+}
+
+func TestEgressFirewall(t *testing.T) {
+	// record the iptables commands
+	dir, err := ioutil.TempDir("", "egress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cmd := filepath.Join(dir, "iptables")
+	log := filepath.Join(dir, "log")
+	err = ioutil.WriteFile(cmd, []byte("#!/bin/sh\necho \"$@\" >> "+log+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef := &EgressFirewall{Command: cmd, Default: []string{"198.51.100.0/24"}, Resolvers: []string{"192.0.2.53"}}
+
+	if allow := ef.allowList(ContainerConfig{}); !reflect.DeepEqual(allow, ef.Default) {
+		t.Errorf("expected default allow-list, got %v", allow)
+	}
+	if allow := ef.allowList(ContainerConfig{Egress: []string{"192.0.2.1"}}); !reflect.DeepEqual(allow, []string{"192.0.2.1"}) {
+		t.Errorf("expected language allow-list, got %v", allow)
+	}
+
+	err = ef.apply(context.Background(), "abc", []string{"192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(dat)), "\n")
+	expect := []string{
+		"-w -N openrepl-abc",
+		"-w -A openrepl-abc -d 192.0.2.53 -p udp --dport 53 -j RETURN",
+		"-w -A openrepl-abc -d 192.0.2.53 -p tcp --dport 53 -j RETURN",
+		"-w -A openrepl-abc -d 192.0.2.1 -j RETURN",
+		"-w -A openrepl-abc -j DROP",
+		"-w -I DOCKER-USER -i or-abc -j openrepl-abc",
+	}
+	for _, e := range expect {
+		found := false
+		for _, l := range lines {
+			found = found || l == e
+		}
+		if !found {
+			t.Errorf("missing iptables command %q in %q", e, lines)
+		}
+	}
+	if last := lines[len(lines)-1]; last != expect[len(expect)-1] {
+		t.Errorf("expected the session to be attached last, got %q", last)
+	}
+}
+
+func TestReadResolvers(t *testing.T) {
+	f, err := ioutil.TempFile("", "resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# generated\nnameserver 127.0.0.53\nnameserver 192.0.2.53\nnameserver 2001:db8::53\nsearch example.com\n")
+	f.Close()
+
+	resolvers, err := readResolvers(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"192.0.2.53"}; !reflect.DeepEqual(resolvers, expect) {
+		t.Errorf("expected %v, got %v", expect, resolvers)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxClientEnv is the maximum number of environment variables a client may set.
+const maxClientEnv = 64
+
+// maxClientEnvSize is the maximum total size in bytes of the environment variables set by a client.
+const maxClientEnvSize = 32 << 10
+
+// envNamePattern matches valid environment variable names.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// deniedEnv are the environment variables which clients may never set, as they control the sandbox, the locale or deterministic mode.
+var deniedEnv = []string{
+	"PATH", "HOME", "USER", "SHELL", "HOSTNAME",
+	"LD_*", "DYLD_*", "FAKETIME*", "NVIDIA_*", "OPENREPL_*",
+	"LANG", "LC_*", "TZ", "PYTHONHASHSEED",
+}
+
+// EnvPolicy restricts the environment variables which clients may set for their programs.
+type EnvPolicy struct {
+	// Allow is the list of names which clients may set, where a trailing "*" matches any suffix.
+	// If empty, clients may not set environment variables.
+	Allow []string
+
+	// Deny is the list of names which clients may not set in addition to deniedEnv, in the same format.
+	Deny []string
+}
+
+// parseEnvPolicy parses comma-separated allow and deny lists.
+func parseEnvPolicy(allow string, deny string) *EnvPolicy {
+	return &EnvPolicy{Allow: splitNames(allow), Deny: splitNames(deny)}
+}
+
+// splitNames splits a comma-separated list, dropping empty entries.
+func splitNames(str string) []string {
+	var names []string
+	for _, n := range strings.Split(str, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// matchName checks whether a name matches a pattern list.
+func matchName(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if p == name || (strings.HasSuffix(p, "*") && strings.HasPrefix(name, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed checks whether clients may set the variable named name.
+func (ep *EnvPolicy) Allowed(name string) bool {
+	if ep == nil || !matchName(name, ep.Allow) {
+		return false
+	}
+	return !matchName(strings.ToUpper(name), deniedEnv) && !matchName(name, ep.Deny)
+}
+
+// parse validates the "NAME=value" environment variables requested by a client.
+func (ep *EnvPolicy) parse(vars []string) ([]string, error) {
+	if len(vars) > maxClientEnv {
+		return nil, fmt.Errorf("at most %d environment variables may be set", maxClientEnv)
+	}
+	size := 0
+	seen := make(map[string]bool, len(vars))
+	for _, v := range vars {
+		size += len(v)
+		spl := strings.SplitN(v, "=", 2)
+		if len(spl) != 2 || !envNamePattern.MatchString(spl[0]) {
+			return nil, fmt.Errorf("invalid environment variable %q", v)
+		}
+		if !ep.Allowed(spl[0]) {
+			return nil, fmt.Errorf("environment variable %s may not be set", spl[0])
+		}
+		if seen[spl[0]] {
+			return nil, fmt.Errorf("environment variable %s is set twice", spl[0])
+		}
+		seen[spl[0]] = true
+	}
+	if size > maxClientEnvSize {
+		return nil, fmt.Errorf("environment variables may not exceed %d bytes", maxClientEnvSize)
+	}
+	return vars, nil
+}
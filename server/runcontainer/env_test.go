@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnvPolicy(t *testing.T) {
+	ep := parseEnvPolicy("*", "SECRET_*")
+	tbl := []struct {
+		vars []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{"DEBUG=1", "NAME=a=b"}, true},
+		{[]string{"EMPTY="}, true},
+		{[]string{"PATH=/evil"}, false},
+		{[]string{"LD_PRELOAD=/evil.so"}, false},
+		{[]string{"ld_preload=/evil.so"}, false},
+		{[]string{"OPENREPL_SEED=1"}, false},
+		{[]string{"SECRET_KEY=1"}, false},
+		{[]string{"1BAD=1"}, false},
+		{[]string{"NOVALUE"}, false},
+		{[]string{"A=1", "A=2"}, false},
+		{[]string{"BIG=" + strings.Repeat("x", maxClientEnvSize)}, false},
+	}
+	for _, tt := range tbl {
+		_, err := ep.parse(tt.vars)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: expected ok=%v but got %v", tt.vars, tt.ok, err)
+		}
+	}
+
+	// only allowed names may be set
+	ep = parseEnvPolicy("APP_*,DEBUG", "")
+	if !ep.Allowed("APP_MODE") || !ep.Allowed("DEBUG") || ep.Allowed("OTHER") {
+		t.Error("allow-list not applied")
+	}
+
+	// without a policy, no variables may be set
+	var nilp *EnvPolicy
+	if _, err := nilp.parse([]string{"DEBUG=1"}); err == nil {
+		t.Error("variable accepted without a policy")
+	}
+}
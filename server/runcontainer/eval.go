@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gorilla/websocket"
+)
+
+// maxEvalOutput is the maximum size in bytes of each output stream of an evaluation, and of a driver result.
+const maxEvalOutput = 1 << 20
+
+// errEvalOutputLimit is returned when an evaluation prints more than maxEvalOutput bytes.
+// The rest of the output is left unread, so the session cannot continue.
+var errEvalOutputLimit = fmt.Errorf("evaluation output truncated at %d bytes", maxEvalOutput)
+
+// EvalConfig is a configuration for the structured eval protocol.
+// The driver reads one JSON-encoded EvalRequest per line on stdin, and writes one JSON-encoded EvalResult per line on stdout.
+type EvalConfig struct {
+	// Command is the full command line of the in-container driver.
+	Command []string `json:"cmd"`
+
+	// Sentinel is a statement printing its {{marker}} placeholder on a line of its own to both stdout and stderr (e.g. `import sys; print("{{marker}}"); print("{{marker}}", file=sys.stderr)`).
+	// If set, Command is a plain REPL instead of a driver, and the end of each evaluation is detected by running the statement after the code.
+	// Such REPLs print values and errors as output, so their results only have Stdout and Stderr.
+	Sentinel string `json:"sentinel,omitempty"`
+
+	// Prompts is a regular expression matching the prompts of a sentinel REPL (e.g. "(>>>|\\.\\.\\.) "), which are removed from its output.
+	Prompts string `json:"prompts,omitempty"`
+}
+
+// validate checks that the eval configuration is complete.
+func (ec *EvalConfig) validate() error {
+	if len(ec.Command) == 0 {
+		return errors.New("eval driver has no command")
+	}
+	if ec.Sentinel != "" && !strings.Contains(ec.Sentinel, "{{marker}}") {
+		return errors.New("eval sentinel does not print {{marker}}")
+	}
+	if ec.Prompts != "" && ec.Sentinel == "" {
+		return errors.New("eval prompts are only used with a sentinel")
+	}
+	_, err := regexp.Compile(ec.Prompts)
+	if err != nil {
+		return fmt.Errorf("invalid eval prompts: %s", err.Error())
+	}
+	return nil
+}
+
+// EvalRequest is a request to evaluate a piece of code.
+type EvalRequest struct {
+	// ID is an identifier chosen by the client, which is copied into the result.
+	ID string `json:"id,omitempty"`
+
+	// Code is the code to evaluate.
+	Code string `json:"code"`
+}
+
+// EvalResult is the result of evaluating a piece of code.
+type EvalResult struct {
+	// ID is the ID of the corresponding EvalRequest.
+	ID string `json:"id,omitempty"`
+
+	// Value is the representation of the value of the final expression, if any.
+	Value string `json:"value,omitempty"`
+
+	// Stdout is the output printed during evaluation.
+	Stdout string `json:"stdout"`
+
+	// Stderr is the error output printed during evaluation.
+	Stderr string `json:"stderr"`
+
+	// Error is the error raised by the code, if any.
+	Error string `json:"error,omitempty"`
+
+	// Duration is the time taken to evaluate the code in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// evalDriver is a running eval driver.
+type evalDriver struct {
+	conn types.HijackedResponse
+	out  *bufio.Reader
+
+	// errout is the stderr of a sentinel REPL, which is discarded for drivers.
+	errout *bufio.Reader
+
+	// marker is printed by the sentinel statement, which is empty for drivers.
+	marker   string
+	sentinel string
+	prompts  *regexp.Regexp
+}
+
+// startEvalDriver starts the eval driver in the container.
+func (cs *ContainerSession) startEvalDriver(ctx context.Context) (*evalDriver, error) {
+	c := cs.Container
+	if c.cli == nil {
+		return nil, errRequiresDocker
+	}
+	cfg := cs.ContainerConfig.Eval
+	d := &evalDriver{}
+	if cfg.Sentinel != "" {
+		id, err := randomID()
+		if err != nil {
+			return nil, err
+		}
+		d.marker = "__openrepl_" + id
+		d.sentinel = strings.Replace(cfg.Sentinel, "{{marker}}", d.marker, -1)
+		if cfg.Prompts != "" {
+			d.prompts, err = regexp.Compile(cfg.Prompts)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// create exec instance
+	ex, err := c.cli.ContainerExecCreate(ctx, c.ID, types.ExecConfig{
+		Cmd:          cfg.Command,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// start driver
+	resp, err := c.cli.ContainerExecAttach(ctx, ex.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, err
+	}
+
+	// demultiplex stdout, discarding the stderr of the driver itself
+	pr, pw := io.Pipe()
+	var errw io.Writer = ioutil.Discard
+	var epw *io.PipeWriter
+	if d.marker != "" {
+		var epr *io.PipeReader
+		epr, epw = io.Pipe()
+		errw = epw
+		d.errout = bufio.NewReader(epr)
+	}
+	go func() {
+		_, err := stdcopy.StdCopy(pw, errw, resp.Reader)
+		if err == nil {
+			err = io.EOF
+		}
+		pw.CloseWithError(err)
+		if epw != nil {
+			epw.CloseWithError(err)
+		}
+	}()
+
+	d.conn = resp
+	d.out = bufio.NewReader(pr)
+	return d, nil
+}
+
+// eval sends a request to the driver and waits for the result.
+func (d *evalDriver) eval(req EvalRequest) (EvalResult, error) {
+	if d.marker != "" {
+		return d.evalSentinel(req)
+	}
+	var res EvalResult
+
+	// send request
+	dat, err := json.Marshal(req)
+	if err != nil {
+		return res, err
+	}
+	_, err = d.conn.Conn.Write(append(dat, '\n'))
+	if err != nil {
+		return res, err
+	}
+
+	// read result
+	start := time.Now()
+	line, err := readLineLimited(d.out, maxEvalOutput)
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(line, &res)
+	if err != nil {
+		return res, errors.New("invalid response from eval driver")
+	}
+	res.ID = req.ID
+	res.Duration = time.Since(start).Seconds()
+	return res, nil
+}
+
+// evalSentinel sends code to a sentinel REPL followed by the sentinel statement, collecting output until the marker is printed.
+func (d *evalDriver) evalSentinel(req EvalRequest) (EvalResult, error) {
+	res := EvalResult{ID: req.ID}
+
+	// send code, separated from the sentinel by an empty line which ends any open block
+	start := time.Now()
+	_, err := d.conn.Conn.Write([]byte(req.Code + "\n\n" + d.sentinel + "\n"))
+	if err != nil {
+		return res, err
+	}
+
+	// read both streams up to the marker, which the REPL prints once the code has run
+	errch := make(chan error, 1)
+	var stderr string
+	go func() {
+		var err error
+		stderr, err = d.readMarked(d.errout)
+		if err != nil {
+			// stop the REPL, as the other stream may never reach the marker
+			d.conn.Close()
+		}
+		errch <- err
+	}()
+	stdout, err := d.readMarked(d.out)
+	if err != nil {
+		d.conn.Close()
+	}
+	if eerr := <-errch; err == nil || eerr == errEvalOutputLimit {
+		err = eerr
+	}
+	if err != nil {
+		return res, err
+	}
+	res.Stdout, res.Stderr = stdout, stderr
+	res.Duration = time.Since(start).Seconds()
+	return res, nil
+}
+
+// readMarked reads a stream of a sentinel REPL up to the line ending with the marker, removing prompts.
+// It fails with errEvalOutputLimit if the stream exceeds maxEvalOutput bytes before the marker.
+func (d *evalDriver) readMarked(r *bufio.Reader) (string, error) {
+	var buf bytes.Buffer
+	for {
+		dat, err := readLineLimited(r, maxEvalOutput-buf.Len())
+		switch {
+		case err == errEvalOutputLimit:
+			return "", err
+		case err != nil:
+			return "", errors.New("REPL exited during evaluation")
+		}
+		line := string(dat)
+		if trimmed := strings.TrimRight(line, "\r\n"); strings.HasSuffix(trimmed, d.marker) {
+			buf.WriteString(strings.TrimSuffix(trimmed, d.marker))
+			break
+		}
+		buf.WriteString(line)
+	}
+	out := buf.String()
+	if d.prompts != nil {
+		out = d.prompts.ReplaceAllString(out, "")
+	}
+	return out, nil
+}
+
+// readLineLimited reads a line of at most limit bytes, failing with errEvalOutputLimit if it is longer.
+func readLineLimited(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > limit {
+			return nil, errEvalOutputLimit
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// runEval runs the session using the structured eval protocol until an error occurs, closing afterwards.
+// Each text message from the client is an EvalRequest, which is answered with an EvalResult.
+func (cs *ContainerSession) runEval(ctx context.Context) error {
+	errch := make(chan error, 1)
+
+	// start ping-pong
+	cs.runPing(errch)
+
+	// start driver
+	d, err := cs.startEvalDriver(ctx)
+	if err != nil {
+		cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error()}, "")
+		cs.Close()
+		return err
+	}
+	// stop evaluation when the session times out or the client stalls
+	stopch := make(chan struct{})
+	defer close(stopch)
+	go func() {
+		select {
+		case <-errch:
+			cs.Client.Close()
+		case <-ctx.Done():
+			cs.Client.Close()
+		case <-stopch:
+		}
+		d.conn.Close()
+	}()
+
+	for {
+		// read request
+		var t int
+		var dat []byte
+		t, dat, err = cs.Client.ReadMessage()
+		if err != nil {
+			break
+		}
+		if t != websocket.TextMessage {
+			continue
+		}
+		var req EvalRequest
+		err = json.Unmarshal(dat, &req)
+		if err != nil {
+			cs.UpdateStatus(StatusUpdate{Status: "error", Error: "invalid eval request"})
+			continue
+		}
+
+		// evaluate code
+		cs.Events.Record("eval", req.ID)
+		var res EvalResult
+		res, err = d.eval(req)
+		if err != nil {
+			cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error()}, "")
+			break
+		}
+
+		// send result
+		cs.wlck.Lock()
+		err = cs.Client.WriteJSON(res)
+		cs.wlck.Unlock()
+		if err != nil {
+			break
+		}
+	}
+
+	// close session
+	cs.Close()
+
+	if _, ok := err.(*websocket.CloseError); ok {
+		err = nil
+	}
+	return err
+}
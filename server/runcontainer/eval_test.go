@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+// fakeREPL answers sentinel evaluations on conn like a Python REPL printing its prompts to stderr.
+func fakeREPL(conn io.Reader, stdout io.Writer, stderr io.Writer) {
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		line := s.Text()
+		io.WriteString(stderr, ">>> ")
+		switch {
+		case strings.HasPrefix(line, "print "):
+			io.WriteString(stdout, strings.TrimPrefix(line, "print ")+"\n")
+		case strings.HasPrefix(line, "raise "):
+			io.WriteString(stderr, "Error: "+strings.TrimPrefix(line, "raise ")+"\n")
+		case strings.HasPrefix(line, "mark "):
+			marker := strings.TrimPrefix(line, "mark ")
+			io.WriteString(stdout, marker+"\n")
+			io.WriteString(stderr, marker+"\n")
+		}
+	}
+}
+
+func TestEvalSentinel(t *testing.T) {
+	client, repl := tcpPair(t)
+	defer client.Close()
+	defer repl.Close()
+	outr, outw := io.Pipe()
+	errr, errw := io.Pipe()
+	go func() {
+		fakeREPL(repl, outw, errw)
+		outw.Close()
+		errw.Close()
+	}()
+	d := &evalDriver{
+		conn:     types.HijackedResponse{Conn: client},
+		out:      bufio.NewReader(outr),
+		errout:   bufio.NewReader(errr),
+		marker:   "__openrepl_test",
+		sentinel: "mark __openrepl_test",
+		prompts:  regexp.MustCompile(">>> "),
+	}
+
+	res, err := d.eval(EvalRequest{ID: "1", Code: "print hello\nraise oops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "1" || res.Stdout != "hello\n" || res.Stderr != "Error: oops\n" {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// state is kept between evaluations, which are delimited separately
+	res, err = d.eval(EvalRequest{ID: "2", Code: "print again"})
+	if err != nil || res.Stdout != "again\n" || res.Stderr != "" {
+		t.Errorf("unexpected result %+v (%v)", res, err)
+	}
+
+	// evaluations fail once the REPL exits
+	repl.Close()
+	if _, err := d.eval(EvalRequest{Code: "print 1"}); err == nil {
+		t.Error("expected error after the REPL exited")
+	}
+}
+
+func TestEvalConfigValidate(t *testing.T) {
+	valid := []EvalConfig{
+		{Command: []string{"python", "/evaldriver.py"}},
+		{Command: []string{"python", "-i", "-q"}, Sentinel: `print("{{marker}}")`, Prompts: `(>>>|\.\.\.) `},
+	}
+	for _, ec := range valid {
+		if err := ec.validate(); err != nil {
+			t.Errorf("%+v: %v", ec, err)
+		}
+	}
+	invalid := []EvalConfig{
+		{},
+		{Command: []string{"python"}, Sentinel: `print("done")`},
+		{Command: []string{"python"}, Prompts: ">>> "},
+		{Command: []string{"python"}, Sentinel: "{{marker}}", Prompts: "("},
+	}
+	for _, ec := range invalid {
+		if err := ec.validate(); err == nil {
+			t.Errorf("%+v: expected error", ec)
+		}
+	}
+}
+
+func TestEvalOutputLimit(t *testing.T) {
+	d := &evalDriver{marker: "__openrepl_test"}
+
+	// output up to the limit is kept
+	out, err := d.readMarked(bufio.NewReader(strings.NewReader(strings.Repeat("x", 1000) + "\n__openrepl_test\n")))
+	if err != nil || len(out) != 1001 {
+		t.Errorf("unexpected output of %d bytes (%v)", len(out), err)
+	}
+
+	// longer output fails the evaluation, whether it is on a single line or not
+	for _, long := range []string{
+		strings.Repeat("x", maxEvalOutput+1) + "\n",
+		strings.Repeat(strings.Repeat("x", 1023)+"\n", maxEvalOutput/1024+1),
+	} {
+		_, err := d.readMarked(bufio.NewReader(strings.NewReader(long + "__openrepl_test\n")))
+		if err != errEvalOutputLimit {
+			t.Errorf("expected errEvalOutputLimit, got %v", err)
+		}
+	}
+	if _, err := readLineLimited(bufio.NewReader(strings.NewReader(strings.Repeat("x", maxEvalOutput+1))), maxEvalOutput); err != errEvalOutputLimit {
+		t.Errorf("expected errEvalOutputLimit for a long driver result, got %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errEvalSessionClosed is returned when using an HTTP eval session after it has been closed.
+var errEvalSessionClosed = errors.New("eval session closed")
+
+// maxEvalRequest is the maximum size of an eval request sent over HTTP.
+const maxEvalRequest = 1 << 20
+
+// evalConn is a ClientConn which bridges the structured eval protocol to individual HTTP requests.
+// Each request is passed to the session as a message, and the session's answer is returned in the response.
+type evalConn struct {
+	token string
+
+	// reqlck serializes eval requests, as the driver evaluates one request at a time.
+	reqlck sync.Mutex
+	seq    uint64
+
+	in     chan []byte
+	out    chan interface{}
+	hangup chan struct{}
+	once   sync.Once
+
+	lck  sync.Mutex
+	pong func(string) error
+	idle *time.Timer
+
+	// kernel is the state of the Jupyter kernel served by the session, which is nil for other eval sessions.
+	kernel *jupyterKernel
+
+	// principal is the ID of the authenticated client which created the session.
+	principal string
+}
+
+func newEvalConn(token string, kernel *jupyterKernel) *evalConn {
+	return &evalConn{
+		token:  token,
+		kernel: kernel,
+		in:     make(chan []byte),
+		out:    make(chan interface{}, 16),
+		hangup: make(chan struct{}),
+	}
+}
+
+func (ec *evalConn) WriteJSON(v interface{}) error {
+	select {
+	case ec.out <- v:
+		return nil
+	case <-ec.hangup:
+		return errEvalSessionClosed
+	}
+}
+
+// WriteMessage handles the close message, and discards raw output, which is not produced in eval mode.
+func (ec *evalConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.CloseMessage {
+		ec.Close()
+	}
+	return nil
+}
+
+// WriteControl answers pings immediately, as the client is instead disconnected after an idle timeout.
+func (ec *evalConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	select {
+	case <-ec.hangup:
+		return errEvalSessionClosed
+	default:
+	}
+	ec.lck.Lock()
+	pong := ec.pong
+	ec.lck.Unlock()
+	if pong != nil && messageType == websocket.PingMessage {
+		pong(string(data))
+	}
+	return nil
+}
+
+func (ec *evalConn) ReadMessage() (int, []byte, error) {
+	select {
+	case dat := <-ec.in:
+		return websocket.TextMessage, dat, nil
+	case <-ec.hangup:
+		return 0, nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}
+	}
+}
+
+func (ec *evalConn) NextReader() (int, io.Reader, error) {
+	t, dat, err := ec.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return t, bytes.NewReader(dat), nil
+}
+
+func (ec *evalConn) SetPongHandler(h func(appData string) error) {
+	ec.lck.Lock()
+	defer ec.lck.Unlock()
+	ec.pong = h
+}
+
+func (ec *evalConn) Close() error {
+	ec.once.Do(func() { close(ec.hangup) })
+	return nil
+}
+
+// closed checks whether the connection has been closed.
+func (ec *evalConn) closed() bool {
+	select {
+	case <-ec.hangup:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchIdle closes the connection if no request is received within the timeout.
+// It must be called again after every request.
+func (ec *evalConn) watchIdle(timeout time.Duration) {
+	ec.lck.Lock()
+	defer ec.lck.Unlock()
+	if ec.idle == nil {
+		ec.idle = time.AfterFunc(timeout, func() { ec.Close() })
+		return
+	}
+	ec.idle.Reset(timeout)
+}
+
+// stopIdle stops the idle timer while a request is being processed.
+func (ec *evalConn) stopIdle() {
+	ec.lck.Lock()
+	defer ec.lck.Unlock()
+	if ec.idle != nil {
+		ec.idle.Stop()
+	}
+}
+
+// next waits for the next message written by the session.
+// Messages written before the connection was closed are still delivered.
+func (ec *evalConn) next(ctx context.Context) (interface{}, error) {
+	select {
+	case v := <-ec.out:
+		return v, nil
+	default:
+	}
+	select {
+	case v := <-ec.out:
+		return v, nil
+	case <-ec.hangup:
+		select {
+		case v := <-ec.out:
+			return v, nil
+		default:
+			return nil, errEvalSessionClosed
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// waitStart waits for the session to start running.
+// Returns the ID of the session, or the status explaining why it failed to start.
+func (ec *evalConn) waitStart(ctx context.Context) (string, *StatusUpdate, error) {
+	var id string
+	for {
+		v, err := ec.next(ctx)
+		if err != nil {
+			return id, nil, err
+		}
+		su, ok := v.(StatusUpdate)
+		if !ok {
+			continue
+		}
+		switch {
+		case su.Status == "starting" && su.Session != "":
+			id = su.Session
+		case su.Status == "running":
+			return id, nil, nil
+		case su.Error != "":
+			return id, &su, nil
+		}
+	}
+}
+
+// eval sends a request to the session and waits for the result.
+// Results of earlier requests which were abandoned by their clients are skipped.
+func (ec *evalConn) eval(ctx context.Context, req EvalRequest) (EvalResult, error) {
+	ec.reqlck.Lock()
+	defer ec.reqlck.Unlock()
+
+	// tag the request so that its result can be identified
+	ec.seq++
+	id := req.ID
+	req.ID = strconv.FormatUint(ec.seq, 10)
+	dat, err := json.Marshal(req)
+	if err != nil {
+		return EvalResult{}, err
+	}
+
+	// send request
+	select {
+	case ec.in <- dat:
+	case <-ec.hangup:
+		return EvalResult{}, errEvalSessionClosed
+	case <-ctx.Done():
+		return EvalResult{}, ctx.Err()
+	}
+
+	// wait for result
+	for {
+		v, err := ec.next(ctx)
+		if err != nil {
+			return EvalResult{}, err
+		}
+		switch v := v.(type) {
+		case EvalResult:
+			if v.ID == req.ID {
+				v.ID = id
+				return v, nil
+			}
+		case StatusUpdate:
+			if v.Error != "" {
+				return EvalResult{}, errors.New(v.Error)
+			}
+		}
+	}
+}
+
+// EvalSessionStore keeps the stateful eval sessions of HTTP clients.
+type EvalSessionStore struct {
+	// IdleTimeout is the amount of time after which a session which has not received a request is closed.
+	IdleTimeout time.Duration
+
+	lck   sync.Mutex
+	conns map[string]*evalConn
+}
+
+// New creates an HTTP eval connection for a principal, serving a Jupyter kernel if kernel is not nil.
+func (es *EvalSessionStore) New(kernel *jupyterKernel, principal string) (*evalConn, error) {
+	token, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	ec := newEvalConn(token, kernel)
+	ec.principal = principal
+
+	es.lck.Lock()
+	defer es.lck.Unlock()
+	if es.conns == nil {
+		es.conns = make(map[string]*evalConn)
+	}
+	es.conns[token] = ec
+	return ec, nil
+}
+
+// remove removes a connection once its session has ended.
+func (es *EvalSessionStore) remove(ec *evalConn) {
+	ec.Close()
+	es.lck.Lock()
+	defer es.lck.Unlock()
+	delete(es.conns, ec.token)
+}
+
+// Len returns the number of HTTP eval sessions.
+func (es *EvalSessionStore) Len() int {
+	es.lck.Lock()
+	defer es.lck.Unlock()
+	return len(es.conns)
+}
+
+// Get looks up an HTTP eval connection by token.
+// Returns nil if the connection does not exist.
+func (es *EvalSessionStore) Get(token string) *evalConn {
+	es.lck.Lock()
+	defer es.lck.Unlock()
+	return es.conns[token]
+}
+
+// EvalSession is the response to creating an HTTP eval session.
+type EvalSession struct {
+	// Token identifies the session in eval and delete requests.
+	Token string `json:"token"`
+
+	// Session is the ID of the session, which can be matched to the server logs.
+	Session string `json:"session"`
+}
+
+// serveEvalSession creates an eval session for an HTTP client, responding once it is running.
+func serveEvalSession(w http.ResponseWriter, r *http.Request, cc ContainerConfig, opts SessionOptions, sc *ContainerSessionConfig) {
+	es := sc.EvalSessions
+	kernel, _ := r.Context().Value(jupyterKernelKey{}).(*jupyterKernel)
+	ec, err := es.New(kernel, opts.Principal)
+	if err != nil {
+		serverLog.Errorf("failed to create eval session: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// run the session in the background
+	remote, tenant := r.RemoteAddr, r.Header.Get(tenantHeader)
+	go func() {
+		defer es.remove(ec)
+		serveContainerSession(ec, remote, tenant, defaultSubprotocol, false, cc, opts, sc)
+	}()
+
+	// wait for the container to start
+	id, su, err := ec.waitStart(r.Context())
+	switch {
+	case err != nil:
+		ec.Close()
+		http.Error(w, "session ended before starting", http.StatusBadGateway)
+		return
+	case su != nil:
+		ec.Close()
+		status := http.StatusBadGateway
+		if su.Status == "capacity" || su.Code == codeDaemonUnavailable {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(su)
+		return
+	}
+	ec.watchIdle(es.IdleTimeout)
+
+	w.Header().Set("Content-Type", "application/json")
+	if kernel != nil {
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(kernel.model(ec.token))
+		return
+	}
+	json.NewEncoder(w).Encode(EvalSession{Token: ec.token, Session: id})
+}
+
+// ServeHTTP serves eval requests against an existing session.
+// POST evaluates the EvalRequest in the body, and DELETE closes the session.
+func (es *EvalSessionStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ec := es.Get(r.URL.Query().Get("token"))
+	if ec == nil || ec.closed() {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req EvalRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, maxEvalRequest)).Decode(&req)
+		if err != nil {
+			http.Error(w, "invalid eval request", http.StatusBadRequest)
+			return
+		}
+		ec.stopIdle()
+		res, err := ec.eval(r.Context(), req)
+		ec.watchIdle(es.IdleTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	case http.MethodDelete:
+		ec.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
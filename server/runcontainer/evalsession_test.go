@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestEvalConn(t *testing.T) {
+	ec := newEvalConn("test", nil)
+	ctx := context.Background()
+
+	// simulate a session answering eval requests, including a stale result
+	go func() {
+		ec.WriteJSON(StatusUpdate{Status: "starting", Session: "s1"})
+		ec.WriteJSON(StatusUpdate{Status: "running"})
+		for {
+			_, dat, err := ec.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req EvalRequest
+			json.Unmarshal(dat, &req)
+			ec.WriteJSON(EvalResult{ID: "stale"})
+			ec.WriteJSON(EvalResult{ID: req.ID, Value: req.Code})
+		}
+	}()
+
+	id, su, err := ec.waitStart(ctx)
+	if err != nil || su != nil || id != "s1" {
+		t.Fatalf("expected session s1 to start but got %q %v %v", id, su, err)
+	}
+	for _, code := range []string{"1+1", "2+2"} {
+		res, err := ec.eval(ctx, EvalRequest{ID: "client", Code: code})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ID != "client" || res.Value != code {
+			t.Errorf("expected result of %q but got %+v", code, res)
+		}
+	}
+
+	// requests fail once the session is closed
+	ec.Close()
+	_, err = ec.eval(ctx, EvalRequest{Code: "3"})
+	if err != errEvalSessionClosed {
+		t.Errorf("expected errEvalSessionClosed but got %v", err)
+	}
+}
+
+func TestEvalConnStartFailure(t *testing.T) {
+	ec := newEvalConn("test", nil)
+
+	// errors written just before closing are still delivered
+	ec.WriteJSON(StatusUpdate{Status: "starting", Session: "s1"})
+	ec.WriteJSON(StatusUpdate{Status: "capacity", Error: "insufficient memory"})
+	ec.Close()
+	_, su, err := ec.waitStart(context.Background())
+	if err != nil || su == nil || su.Status != "capacity" {
+		t.Fatalf("expected capacity status but got %v %v", su, err)
+	}
+}
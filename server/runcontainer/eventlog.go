@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SessionEvent is an event in the timeline of a session.
+type SessionEvent struct {
+	// Time is the time at which the event occurred.
+	Time time.Time `json:"time"`
+
+	// Event is the type of event (e.g. "deploy_start", "exit").
+	Event string `json:"event"`
+
+	// Detail is optional additional information about the event.
+	Detail string `json:"detail,omitempty"`
+}
+
+// EventLog is a timeline of events in a session.
+// A nil EventLog discards all events.
+type EventLog struct {
+	lck    sync.Mutex
+	events []SessionEvent
+	size   int64
+
+	// tenant is the tenant which the session belongs to.
+	tenant string
+
+	// created is the time at which the log was created.
+	created time.Time
+}
+
+// Record adds an event to the log.
+func (el *EventLog) Record(event string, detail string) {
+	if el == nil {
+		return
+	}
+	el.lck.Lock()
+	defer el.lck.Unlock()
+	el.events = append(el.events, SessionEvent{
+		Time:   time.Now(),
+		Event:  event,
+		Detail: detail,
+	})
+	el.size += int64(len(event) + len(detail) + eventOverhead)
+}
+
+// eventOverhead is the approximate size in bytes of a SessionEvent excluding its strings.
+const eventOverhead = 64
+
+// Events returns a copy of the events in the log.
+func (el *EventLog) Events() []SessionEvent {
+	el.lck.Lock()
+	defer el.lck.Unlock()
+	events := make([]SessionEvent, len(el.events))
+	copy(events, el.events)
+	return events
+}
+
+// EventLogStore keeps the event logs of the most recent sessions.
+type EventLogStore struct {
+	lck   sync.Mutex
+	logs  map[string]*EventLog
+	order []string
+
+	// Max is the maximum number of event logs kept.
+	Max int
+
+	// Retention is the retention policy applied by the cleaner.
+	// If nil, logs are only evicted when Max is exceeded.
+	Retention *Retention
+}
+
+// New creates an event log for a session of a tenant, evicting the oldest logs if necessary.
+func (es *EventLogStore) New(id string, tenant string) *EventLog {
+	es.lck.Lock()
+	defer es.lck.Unlock()
+
+	if es.logs == nil {
+		es.logs = make(map[string]*EventLog)
+	}
+	for len(es.order) >= es.Max && len(es.order) > 0 {
+		delete(es.logs, es.order[0])
+		es.order = es.order[1:]
+	}
+
+	el := &EventLog{tenant: tenant, created: time.Now()}
+	es.logs[id] = el
+	es.order = append(es.order, id)
+	return el
+}
+
+// Clean deletes the event logs which are expired under the retention policy.
+func (es *EventLogStore) Clean(now time.Time) {
+	if es.Retention == nil {
+		return
+	}
+	es.lck.Lock()
+	defer es.lck.Unlock()
+
+	// collect log sizes
+	items := make([]retainedItem, 0, len(es.logs))
+	for id, el := range es.logs {
+		el.lck.Lock()
+		items = append(items, retainedItem{
+			key:     id,
+			tenant:  el.tenant,
+			created: el.created,
+			size:    el.size,
+		})
+		el.lck.Unlock()
+	}
+
+	// delete expired logs
+	del := es.Retention.expired(items, now)
+	if len(del) == 0 {
+		return
+	}
+	for _, id := range del {
+		delete(es.logs, id)
+	}
+	order := es.order[:0]
+	for _, id := range es.order {
+		if _, ok := es.logs[id]; ok {
+			order = append(order, id)
+		}
+	}
+	es.order = order
+}
+
+// RunCleaner periodically applies the retention policy.
+func (es *EventLogStore) RunCleaner(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for now := range tick.C {
+		es.Clean(now)
+	}
+}
+
+// Get looks up the event log of a session.
+// Returns nil if no log is available.
+func (es *EventLogStore) Get(id string) *EventLog {
+	es.lck.Lock()
+	defer es.lck.Unlock()
+	return es.logs[id]
+}
+
+// ServeHTTP serves the event log of a session as JSON.
+func (es *EventLogStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	el := es.Get(r.URL.Query().Get("session"))
+	if el == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(el.Events())
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// execAttachTimeout is the time within which a session started with ExecServer.Start must be attached to a stream.
+const execAttachTimeout = 30 * time.Second
+
+// errExecNotFound is returned when attaching to a session which was not started, or whose attach timeout expired.
+var errExecNotFound = errors.New("session not found or expired")
+
+// ExecStart is a request of an RPC client to start a session.
+type ExecStart struct {
+	// Lang is the name of the language, and Version selects one of its versions (the default if empty).
+	Lang    string
+	Version string
+
+	// Terminal is set to start an interactive terminal instead of a run.
+	Terminal bool
+
+	// Args are the command line arguments of a run.
+	Args []string
+
+	// Env are the environment variables of the program, which are restricted by the EnvPolicy of the server.
+	Env map[string]string
+
+	// Streams is whether a run is executed without a terminal, so that stdout and stderr are kept apart.
+	Streams bool
+
+	// Packages is the dependency manifest of a run.
+	Packages []byte
+
+	// Options are further session options, named like the query parameters of websocket sessions (e.g. "deterministic").
+	Options map[string]string
+}
+
+// query generates the query parameters of the equivalent websocket session.
+func (es ExecStart) query() url.Values {
+	q := url.Values{}
+	for k, v := range es.Options {
+		q.Set(k, v)
+	}
+	q.Set("lang", es.Lang)
+	if es.Version != "" {
+		q.Set("version", es.Version)
+	}
+	q["arg"] = es.Args
+	for name, v := range es.Env {
+		q.Add("env", name+"="+v)
+	}
+	sort.Strings(q["env"])
+	if es.Streams {
+		q.Set("streams", "true")
+	}
+	return q
+}
+
+// ExecError is the rejection of a session before it started, with the HTTP status with which a websocket session would have been rejected.
+type ExecError struct {
+	Status  int
+	Message string
+}
+
+func (ee *ExecError) Error() string {
+	return ee.Message
+}
+
+// execStream is the transport of an RPC session, which carries the messages of the openrepl.v3 protocol.
+type execStream interface {
+	Send(Envelope) error
+	Recv() (Envelope, error)
+}
+
+// ExecServer serves sessions to RPC clients, which start a session and then attach a stream to it.
+// Sessions are validated, authenticated and rate limited like websocket sessions.
+type ExecServer struct {
+	Server *ContainerServer
+
+	lck     sync.Mutex
+	pending map[string]*pendingExec
+}
+
+// pendingExecKey is the context key of the pending session of a start request.
+type pendingExecKey struct{}
+
+// pendingExec is a session which has been started and is waiting for its stream.
+type pendingExec struct {
+	es       *ExecServer
+	token    string
+	packages []byte
+
+	// started is closed once the session is waiting, and gone once it has stopped waiting.
+	started chan struct{}
+	gone    chan struct{}
+	attach  chan *execConn
+}
+
+// handler returns the handler of start requests, wrapped like the session endpoints.
+func (es *ExecServer) handler(isrun bool) http.HandlerFunc {
+	cs := es.Server
+	return cs.rejectDraining(cs.requireAuth(cs.limitClients(func(w http.ResponseWriter, r *http.Request) {
+		cs.serveSession(w, r, isrun)
+	})))
+}
+
+// Start validates and starts a session, returning the token with which its stream attaches.
+// The header carries the credentials of the client.
+func (es *ExecServer) Start(ctx context.Context, req ExecStart, remote string, header http.Header) (string, error) {
+	token, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	r, err := http.NewRequest(http.MethodGet, "/", nil)
+	if err != nil {
+		return "", err
+	}
+	r.URL.RawQuery = req.query().Encode()
+	r.RemoteAddr = remote
+	if header != nil {
+		r.Header = header
+	}
+	pe := &pendingExec{
+		es:       es,
+		token:    token,
+		packages: req.Packages,
+		started:  make(chan struct{}),
+		gone:     make(chan struct{}),
+		attach:   make(chan *execConn),
+	}
+	r = r.WithContext(context.WithValue(context.Background(), pendingExecKey{}, pe))
+
+	// the handler keeps running for the duration of the session
+	rec := &execRecorder{header: http.Header{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		es.handler(!req.Terminal)(rec, r)
+	}()
+	select {
+	case <-pe.started:
+		return token, nil
+	case <-done:
+		return "", rec.err()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Attach runs the session of a token over a stream, returning once the session has ended.
+func (es *ExecServer) Attach(token string, stream execStream) error {
+	es.lck.Lock()
+	pe := es.pending[token]
+	delete(es.pending, token)
+	es.lck.Unlock()
+	if pe == nil {
+		return errExecNotFound
+	}
+
+	conn := newExecConn(stream)
+	select {
+	case pe.attach <- conn:
+	case <-pe.gone:
+		return errExecNotFound
+	}
+	<-conn.closed
+	return nil
+}
+
+// serve waits for the stream of a validated session, and then runs the session over it.
+func (pe *pendingExec) serve(r *http.Request, isrun bool, cc ContainerConfig, opts SessionOptions, sc *ContainerSessionConfig) {
+	es := pe.es
+	es.lck.Lock()
+	if es.pending == nil {
+		es.pending = make(map[string]*pendingExec)
+	}
+	es.pending[pe.token] = pe
+	es.lck.Unlock()
+	close(pe.started)
+	defer close(pe.gone)
+
+	timer := time.NewTimer(execAttachTimeout)
+	defer timer.Stop()
+	select {
+	case conn := <-pe.attach:
+		// streams end the input of programs without a terminal with an eof message, like websocket clients
+		cc.stdinOnce = cc.noTTY
+		opts.Packages = pe.packages
+		serveContainerSession(newEnvelopeConn(conn, opts.Eval || opts.Notebook), r.RemoteAddr, r.Header.Get(tenantHeader), protocolV3, isrun, cc, opts, sc)
+	case <-timer.C:
+		es.lck.Lock()
+		delete(es.pending, pe.token)
+		es.lck.Unlock()
+		if opts.Claim != nil {
+			opts.Claim.release()
+		}
+		serverLog.Printf("session for %s was not attached within %s", r.RemoteAddr, execAttachTimeout)
+	}
+}
+
+// execRecorder is the ResponseWriter of a start request, which records why the session was rejected.
+type execRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (er *execRecorder) Header() http.Header {
+	return er.header
+}
+
+func (er *execRecorder) WriteHeader(status int) {
+	if er.status == 0 {
+		er.status = status
+	}
+}
+
+func (er *execRecorder) Write(p []byte) (int, error) {
+	er.WriteHeader(http.StatusOK)
+	return er.body.Write(p)
+}
+
+// err returns the rejection of the session, which is a plain text message or a StatusUpdate.
+func (er *execRecorder) err() error {
+	msg := strings.TrimSpace(er.body.String())
+	var su StatusUpdate
+	if json.Unmarshal(er.body.Bytes(), &su) == nil && su.Error != "" {
+		msg = su.Error
+	}
+	if msg == "" {
+		msg = http.StatusText(er.status)
+	}
+	return &ExecError{Status: er.status, Message: msg}
+}
+
+// execConn is a ClientConn carrying the text messages of the openrepl.v3 protocol over an execStream.
+// The session is expected to ping, which is answered immediately as RPC connections are kept alive by the transport.
+type execConn struct {
+	stream execStream
+
+	closed chan struct{}
+	once   sync.Once
+
+	// wlck serializes sends, as streams may not be sent on concurrently.
+	wlck sync.Mutex
+
+	lck  sync.Mutex
+	pong func(string) error
+}
+
+func newExecConn(stream execStream) *execConn {
+	return &execConn{stream: stream, closed: make(chan struct{})}
+}
+
+func (ec *execConn) WriteJSON(v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ec.WriteMessage(websocket.TextMessage, dat)
+}
+
+// WriteMessage sends an envelope, and ends the stream on the close message.
+func (ec *execConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.CloseMessage {
+		return ec.Close()
+	}
+	select {
+	case <-ec.closed:
+		return errors.New("exec stream closed")
+	default:
+	}
+	var env Envelope
+	err := json.Unmarshal(data, &env)
+	if err != nil {
+		return fmt.Errorf("invalid envelope: %s", err.Error())
+	}
+	ec.wlck.Lock()
+	defer ec.wlck.Unlock()
+	return ec.stream.Send(env)
+}
+
+func (ec *execConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	select {
+	case <-ec.closed:
+		return errors.New("exec stream closed")
+	default:
+	}
+	ec.lck.Lock()
+	pong := ec.pong
+	ec.lck.Unlock()
+	if pong != nil && messageType == websocket.PingMessage {
+		pong(string(data))
+	}
+	return nil
+}
+
+// ReadMessage receives the next envelope.
+// Once the client has closed its side of the stream, it blocks until the session ends.
+func (ec *execConn) ReadMessage() (int, []byte, error) {
+	env, err := ec.stream.Recv()
+	if err == io.EOF {
+		<-ec.closed
+		return 0, nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	dat, err := json.Marshal(env)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, dat, nil
+}
+
+func (ec *execConn) NextReader() (int, io.Reader, error) {
+	t, dat, err := ec.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return t, bytes.NewReader(dat), nil
+}
+
+func (ec *execConn) SetPongHandler(h func(appData string) error) {
+	ec.lck.Lock()
+	defer ec.lck.Unlock()
+	ec.pong = h
+}
+
+func (ec *execConn) Close() error {
+	ec.once.Do(func() { close(ec.closed) })
+	return nil
+}
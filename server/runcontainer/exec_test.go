@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// chanStream is an execStream over channels.
+type chanStream struct {
+	in  chan Envelope
+	out chan Envelope
+}
+
+func newChanStream() *chanStream {
+	return &chanStream{in: make(chan Envelope, 10), out: make(chan Envelope, 100)}
+}
+
+func (cs *chanStream) Send(env Envelope) error {
+	cs.out <- env
+	return nil
+}
+
+func (cs *chanStream) Recv() (Envelope, error) {
+	env, ok := <-cs.in
+	if !ok {
+		return Envelope{}, io.EOF
+	}
+	return env, nil
+}
+
+func TestExecStartQuery(t *testing.T) {
+	es := ExecStart{
+		Lang:    "python3",
+		Version: "3.12",
+		Args:    []string{"a", "b"},
+		Env:     map[string]string{"B": "2", "A": "1"},
+		Streams: true,
+		Options: map[string]string{"deterministic": "true", "lang": "bash"},
+	}
+	expect := url.Values{
+		"lang":          {"python3"},
+		"version":       {"3.12"},
+		"arg":           {"a", "b"},
+		"env":           {"A=1", "B=2"},
+		"streams":       {"true"},
+		"deterministic": {"true"},
+	}
+	if q := es.query(); !reflect.DeepEqual(q, expect) {
+		t.Errorf("expected %v but got %v", expect, q)
+	}
+}
+
+func TestExecStartRejected(t *testing.T) {
+	es := &ExecServer{Server: &ContainerServer{
+		Containers: map[string]Language{},
+		SessionConfig: ContainerSessionConfig{
+			Clients: &ClientLimiter{Rate: 0.5, Burst: 1},
+		},
+	}}
+	_, err := es.Start(context.Background(), ExecStart{Lang: "cobol"}, "192.0.2.1:1234", nil)
+	ee, ok := err.(*ExecError)
+	if !ok || ee.Status != http.StatusBadRequest || ee.Message != "language not supported" {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	// rate limit rejections are sent as a StatusUpdate
+	_, err = es.Start(context.Background(), ExecStart{Lang: "cobol"}, "192.0.2.1:1234", nil)
+	ee, ok = err.(*ExecError)
+	if !ok || ee.Status != http.StatusTooManyRequests || ee.Message == "" {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestExecAttachNotFound(t *testing.T) {
+	es := &ExecServer{}
+	err := es.Attach("missing", newChanStream())
+	if err != errExecNotFound {
+		t.Errorf("expected errExecNotFound but got %v", err)
+	}
+}
+
+func TestExecConn(t *testing.T) {
+	stream := newChanStream()
+	ec := newExecConn(stream)
+
+	// envelopes are passed through as text messages
+	stream.in <- Envelope{Type: "code", Payload: json.RawMessage(`{"data":"cHJpbnQoMSk="}`)}
+	typ, dat, err := ec.ReadMessage()
+	if err != nil || typ != websocket.TextMessage || string(dat) != `{"type":"code","payload":{"data":"cHJpbnQoMSk="}}` {
+		t.Fatalf("unexpected message %d %q (%v)", typ, dat, err)
+	}
+	err = ec.WriteMessage(websocket.TextMessage, []byte(`{"type":"status","payload":{"status":"ready"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := <-stream.out
+	if env.Type != "status" || string(env.Payload) != `{"status":"ready"}` {
+		t.Errorf("unexpected envelope %+v", env)
+	}
+
+	// pings are answered immediately
+	var pong string
+	ec.SetPongHandler(func(data string) error {
+		pong = data
+		return nil
+	})
+	ec.WriteControl(websocket.PingMessage, []byte("x"), time.Now().Add(time.Second))
+	if pong != "x" {
+		t.Errorf("expected pong but got %q", pong)
+	}
+
+	// reads block after the client closes its side, until the session closes the stream
+	close(stream.in)
+	done := make(chan error)
+	go func() {
+		_, _, err := ec.ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("read returned early with %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	ec.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err := <-done; !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected normal closure but got %v", err)
+	}
+	if err := ec.WriteMessage(websocket.TextMessage, []byte(`{"type":"stdout"}`)); err == nil {
+		t.Error("expected error writing to a closed stream")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/gorilla/websocket"
+)
+
+// execPidFile is the file in which the PID of the current execution is stored.
+const execPidFile = "/tmp/.openrepl-exec.pid"
+
+// execRun is an interactive execution of a command in a container, with output copied to the client.
+type execRun struct {
+	conn types.HijackedResponse
+	done chan struct{}
+
+	// exited is whether the command exited, which is valid once done is closed.
+	exited bool
+
+	// code is the exit status of the command, which is valid if exited is set.
+	code int64
+}
+
+// startExec starts an execution of a command, copying its output to the client.
+func (cs *ContainerSession) startExec(ctx context.Context, argv []string) (*execRun, error) {
+	c := cs.Container
+	if c.cli == nil {
+		return nil, errRequiresDocker
+	}
+
+	// create exec instance which records its PID so that it can be killed
+	cmd := append([]string{"sh", "-c", "echo $$ > " + execPidFile + "; exec \"$@\"", "sh"}, argv...)
+	ex, err := c.cli.ContainerExecCreate(ctx, c.ID, types.ExecConfig{
+		Cmd:          cmd,
+		Tty:          true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// start command
+	resp, err := c.cli.ContainerExecAttach(ctx, ex.ID, types.ExecStartCheck{Tty: true})
+	if err != nil {
+		return nil, err
+	}
+	run := &execRun{
+		conn: resp,
+		done: make(chan struct{}),
+	}
+
+	// copy output to client
+	go func() {
+		defer close(run.done)
+		buf := make([]byte, cs.Config.OutputBufferSize)
+		for {
+			n, err := resp.Reader.Read(buf)
+			if n > 0 {
+				if cs.writeOutput(buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		// get exit status
+		insp, err := c.cli.ContainerExecInspect(ctx, ex.ID)
+		if err != nil || insp.Running {
+			return
+		}
+		run.exited = true
+		run.code = int64(insp.ExitCode)
+	}()
+
+	return run, nil
+}
+
+// stopExec kills an execution and waits for its output to end.
+func (cs *ContainerSession) stopExec(ctx context.Context, run *execRun) {
+	if run == nil {
+		return
+	}
+	select {
+	case <-run.done:
+	default:
+		cs.Container.Exec(ctx, []string{"sh", "-c", "kill -KILL -- -$(cat " + execPidFile + ") 2>/dev/null"})
+		run.conn.Close()
+		<-run.done
+	}
+}
+
+// execInput forwards client input to the current execution.
+type execInput struct {
+	lck sync.Mutex
+	cur *execRun
+}
+
+// set sets the execution receiving input, returning the previous one.
+func (ei *execInput) set(run *execRun) *execRun {
+	ei.lck.Lock()
+	defer ei.lck.Unlock()
+	prev := ei.cur
+	ei.cur = run
+	return prev
+}
+
+// runExecInput reads client messages until an error occurs.
+// Text messages are copied to the current execution, and binary messages are passed to codech if it is not nil.
+func (cs *ContainerSession) runExecInput(ctx context.Context, in *execInput, codech chan<- []byte, errch chan<- error) {
+	var err error
+	defer func() { errch <- err }()
+	for err == nil {
+		var t int
+		var r io.Reader
+
+		// get next websocket message reader
+		t, r, err = cs.Client.NextReader()
+		if err != nil {
+			return
+		}
+
+		switch {
+		case t == websocket.CloseMessage:
+			// handle close sent by client
+			io.Copy(ioutil.Discard, r)
+			return
+		case t == websocket.BinaryMessage && codech != nil:
+			// pass new code to the main loop
+			var dat []byte
+			dat, err = ioutil.ReadAll(r)
+			if err != nil {
+				return
+			}
+			select {
+			case codech <- dat:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		default:
+			// copy input to the current execution
+			in.lck.Lock()
+			run := in.cur
+			in.lck.Unlock()
+			if run == nil {
+				io.Copy(ioutil.Discard, r)
+				continue
+			}
+			io.Copy(run.conn.Conn, r)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errFirecrackerExec is returned when a command is run in a microVM, which only runs the program of its language.
+var errFirecrackerExec = errors.New("commands cannot be run in microVMs")
+
+// firecrackerDirPrefix is the prefix of the directories of microVMs, by which leftover directories are recognized.
+const firecrackerDirPrefix = "openrepl-fc-"
+
+// firecrackerStatusPort is the vsock port on which the guest reports the exit status of the program.
+const firecrackerStatusPort = 52
+
+// firecrackerGuestCID is the vsock context ID of the guest.
+const firecrackerGuestCID = 3
+
+// firecrackerCgroup is the parent cgroup, below which the jailer creates the cgroup of each microVM.
+const firecrackerCgroup = "openrepl-fc"
+
+// firecrackerMemoryOverhead is the memory allowed to the firecracker process beyond the memory of its guest.
+const firecrackerMemoryOverhead = 64 << 20
+
+// Files of the code drive describing the program to the guest.
+const (
+	firecrackerCommandFile = ".openrepl/command"
+	firecrackerEnvFile     = ".openrepl/env"
+)
+
+// FirecrackerBackend runs sessions in Firecracker microVMs booted from a prebuilt root filesystem image per language, for isolation at the VM level.
+//
+// The root filesystem is attached read-only, and the files copied into the session are attached as a second read-only drive containing a tarball.
+// The init process of the image must extract that drive into the root, run the program described by its .openrepl/command (NUL-separated arguments) and .openrepl/env files on the serial console,
+// write the exit status to the host on vsock port 52, and power off.
+// The serial console, which is the standard I/O of the firecracker process, carries the I/O of the program; it has no window size and combines the output streams.
+// MicroVMs have no network interface, and cannot run further commands; session modes requiring Docker are unavailable.
+//
+// Each microVM is started by the jailer in a chroot of its own, as a user ID of its own, in a cgroup (v2) limiting its memory and CPUs.
+// The kernel and root filesystem images are hard-linked into the chroot, so they must be world-readable and on the filesystem of WorkDir.
+type FirecrackerBackend struct {
+	// Command is the path of the firecracker binary.
+	Command string
+
+	// Jailer is the path of the jailer binary, which starts firecracker.
+	Jailer string
+
+	// UID is the first user (and group) ID of microVMs, each of which runs as a user ID in [UID, UID+UIDs).
+	// The number of microVMs is thereby limited to UIDs.
+	UID  int
+	UIDs int
+
+	// Kernel is the path of the uncompressed guest kernel.
+	Kernel string
+
+	// BootArgs are further kernel command line arguments (e.g. "init=/sbin/openrepl-init").
+	BootArgs string
+
+	// RootfsDir is the directory containing the root filesystem images of languages.
+	RootfsDir string
+
+	// WorkDir is the base directory of the chroots of microVMs, in which the jailer creates the session directories.
+	// If empty, the default temporary directory is used.
+	WorkDir string
+
+	// VCPUs is the number of virtual CPUs of each microVM.
+	VCPUs int
+
+	// StopTimeout is the timeout for killing microVMs and removing their session directories.
+	StopTimeout time.Duration
+
+	lck  sync.Mutex
+	vms  map[string]*firecrackerVM
+	uids map[int]bool
+}
+
+// firecrackerVM is the microVM of a session.
+type firecrackerVM struct {
+	// jail is the session directory created for the jailer, and dir is the chroot within it.
+	jail string
+	dir  string
+	uid  int
+
+	// code is the tarball of the code drive, which is written until the microVM starts.
+	code     *os.File
+	codetar  *tar.Writer
+	cmd      *exec.Cmd
+	statusln *net.UnixListener
+
+	// done is closed once the microVM has stopped, with the exit status reported by the guest if status is set.
+	// received is closed once the exit status has been received, or the guest can no longer report it.
+	done     chan struct{}
+	received chan struct{}
+	lck      sync.Mutex
+	status   *int64
+}
+
+// firecrackerConfig is the configuration file of a microVM.
+type firecrackerConfig struct {
+	BootSource struct {
+		KernelImagePath string `json:"kernel_image_path"`
+		BootArgs        string `json:"boot_args"`
+	} `json:"boot-source"`
+	Drives        []firecrackerDrive `json:"drives"`
+	MachineConfig struct {
+		VCPUCount  int   `json:"vcpu_count"`
+		MemSizeMib int64 `json:"mem_size_mib"`
+	} `json:"machine-config"`
+	Vsock struct {
+		GuestCID int    `json:"guest_cid"`
+		UDSPath  string `json:"uds_path"`
+	} `json:"vsock"`
+	Logger struct {
+		LogPath string `json:"log_path"`
+		Level   string `json:"level"`
+	} `json:"logger"`
+}
+
+type firecrackerDrive struct {
+	DriveID      string `json:"drive_id"`
+	PathOnHost   string `json:"path_on_host"`
+	IsRootDevice bool   `json:"is_root_device"`
+	IsReadOnly   bool   `json:"is_read_only"`
+}
+
+// vcpus returns the number of virtual CPUs of each microVM.
+func (b *FirecrackerBackend) vcpus() int {
+	if b.VCPUs <= 0 {
+		return 1
+	}
+	return b.VCPUs
+}
+
+// config generates the configuration of the microVM of a session.
+// Its paths are within the chroot of the microVM, into which the kernel and root filesystem are linked.
+func (b *FirecrackerBackend) config(cc ContainerConfig) firecrackerConfig {
+	var fc firecrackerConfig
+	fc.BootSource.KernelImagePath = "/vmlinux"
+	fc.BootSource.BootArgs = strings.TrimSpace("console=ttyS0 quiet loglevel=0 reboot=k panic=1 pci=off " + b.BootArgs)
+	fc.Drives = []firecrackerDrive{
+		{DriveID: "rootfs", PathOnHost: "/rootfs", IsRootDevice: true, IsReadOnly: true},
+		{DriveID: "code", PathOnHost: "/code.tar", IsReadOnly: true},
+	}
+	fc.MachineConfig.VCPUCount = b.vcpus()
+	fc.MachineConfig.MemSizeMib = cc.memoryLimit() >> 20
+	fc.Vsock.GuestCID = firecrackerGuestCID
+	fc.Vsock.UDSPath = "/vsock.sock"
+	fc.Logger.LogPath = "/firecracker.log"
+	fc.Logger.Level = "Warning"
+	return fc
+}
+
+// jailerArgs generates the jailer command line starting the microVM of a session as a user ID, in its cgroup.
+func (b *FirecrackerBackend) jailerArgs(cc ContainerConfig, id string, uid int) []string {
+	return []string{
+		"--id", id,
+		"--exec-file", b.Command,
+		"--uid", strconv.Itoa(uid),
+		"--gid", strconv.Itoa(uid),
+		"--chroot-base-dir", b.workDir(),
+		"--cgroup-version", "2",
+		"--parent-cgroup", firecrackerCgroup,
+		"--cgroup", "memory.max=" + strconv.FormatInt(cc.memoryLimit()+firecrackerMemoryOverhead, 10),
+		"--cgroup", "cpu.max=" + strconv.Itoa(b.vcpus()*100000) + " 100000",
+		"--",
+		"--no-api", "--config-file", "/vm.json",
+	}
+}
+
+// workDir returns the base directory of the chroots of microVMs.
+func (b *FirecrackerBackend) workDir() string {
+	if b.WorkDir == "" {
+		return os.TempDir()
+	}
+	return b.WorkDir
+}
+
+// jailDir returns the directory in which the jailer creates the session directories, named after the firecracker binary.
+func (b *FirecrackerBackend) jailDir() string {
+	return filepath.Join(b.workDir(), filepath.Base(b.Command))
+}
+
+// allocUID reserves a free user ID for a microVM.
+func (b *FirecrackerBackend) allocUID() (int, error) {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	if b.uids == nil {
+		b.uids = make(map[int]bool)
+	}
+	for uid := b.UID; uid < b.UID+b.UIDs; uid++ {
+		if !b.uids[uid] {
+			b.uids[uid] = true
+			return uid, nil
+		}
+	}
+	return 0, errors.New("no free microVM user IDs")
+}
+
+// releaseUID frees the user ID of a removed microVM.
+func (b *FirecrackerBackend) releaseUID(uid int) {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	delete(b.uids, uid)
+}
+
+// vm looks up the microVM of a container.
+func (b *FirecrackerBackend) vm(c *Container) (*firecrackerVM, error) {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	vm := b.vms[c.ID]
+	if vm == nil {
+		return nil, errors.New("microVM not found")
+	}
+	return vm, nil
+}
+
+// addFile adds a file to the code drive.
+func (vm *firecrackerVM) addFile(name string, dat []byte) error {
+	err := vm.codetar.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(dat))})
+	if err != nil {
+		return err
+	}
+	_, err = vm.codetar.Write(dat)
+	return err
+}
+
+// Deploy prepares the session directory and code drive, copies code in with prestart, and then boots the microVM.
+func (b *FirecrackerBackend) Deploy(ctx context.Context, cc ContainerConfig, session string, prestart func(context.Context, *Container) error) (cont *Container, err error) {
+	// count failures which were not caused by the client going away
+	defer func() {
+		if err != nil && ctx.Err() != context.Canceled {
+			deployFailures.Add(1, cc.Language)
+		}
+	}()
+
+	// the program is started by the guest, so its command line must be known
+	argv, err := cc.programCommand(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cc.Rootfs == "" {
+		return nil, errors.New("no root filesystem configured")
+	}
+	_, err = os.Stat(filepath.Join(b.RootfsDir, cc.Rootfs))
+	if err != nil {
+		return nil, err
+	}
+
+	// create session directory and code drive
+	t := time.Now()
+	uid, err := b.allocUID()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(b.jailDir(), 0755)
+	if err != nil {
+		b.releaseUID(uid)
+		return nil, err
+	}
+	jail, err := ioutil.TempDir(b.jailDir(), firecrackerDirPrefix+session+"-")
+	if err != nil {
+		b.releaseUID(uid)
+		return nil, err
+	}
+	dir := filepath.Join(jail, "root")
+	vm := &firecrackerVM{jail: jail, dir: dir, uid: uid, done: make(chan struct{}), received: make(chan struct{})}
+	cont = &Container{
+		backend:      b,
+		ID:           filepath.Base(jail),
+		closetimeout: b.StopTimeout,
+		lang:         cc.Language,
+		created:      t,
+		session:      session,
+	}
+	b.lck.Lock()
+	if b.vms == nil {
+		b.vms = make(map[string]*firecrackerVM)
+	}
+	b.vms[cont.ID] = vm
+	b.lck.Unlock()
+
+	// cleanup microVM on failed startup
+	defer func() {
+		if err != nil {
+			delctx, cancel := context.WithTimeout(context.Background(), b.StopTimeout)
+			defer cancel()
+			rerr := b.Remove(delctx, cont)
+			if rerr != nil {
+				Logger{Session: session}.Errorf("failed to remove microVM: %s", rerr.Error())
+			} else {
+				containersRemoved.Add(1, cc.Language)
+			}
+		}
+	}()
+
+	// the chroot is owned by the user of the microVM, so that firecracker can create its sockets and log
+	err = os.Mkdir(dir, 0700)
+	if err == nil {
+		err = os.Chown(dir, uid, uid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = os.Link(b.Kernel, filepath.Join(dir, "vmlinux"))
+	if err == nil {
+		err = os.Link(filepath.Join(b.RootfsDir, cc.Rootfs), filepath.Join(dir, "rootfs"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	vm.code, err = os.Create(filepath.Join(dir, "code.tar"))
+	if err != nil {
+		return nil, err
+	}
+	vm.codetar = tar.NewWriter(vm.code)
+	err = vm.addFile(firecrackerCommandFile, []byte(strings.Join(argv, "\x00")))
+	if err == nil {
+		err = vm.addFile(firecrackerEnvFile, []byte(strings.Join(cc.Env, "\x00")))
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := json.Marshal(b.config(cc))
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "vm.json"), cfg, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "create")
+	containersCreated.Add(1, cc.Language)
+
+	// run prestart hook
+	if prestart != nil {
+		err = prestart(ctx, cont)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// seal the code drive
+	err = vm.codetar.Close()
+	if err == nil {
+		err = vm.code.Close()
+	}
+	vm.codetar = nil
+	if err != nil {
+		return nil, err
+	}
+
+	// listen for the exit status from the guest
+	statuspath := filepath.Join(dir, "vsock.sock_"+strconv.Itoa(firecrackerStatusPort))
+	vm.statusln, err = net.ListenUnix("unix", &net.UnixAddr{Name: statuspath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	go vm.receiveStatus()
+	err = os.Chown(statuspath, uid, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// boot the microVM in its jail
+	t = time.Now()
+	cmd := exec.Command(b.Jailer, b.jailerArgs(cc, cont.ID, uid)...)
+	cmd.Dir = dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, w, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdin.Close()
+		out.Close()
+		return nil, err
+	}
+	vm.cmd = cmd
+	go func() {
+		cmd.Wait()
+		// the status may have been sent just before the microVM powered off
+		vm.statusln.SetDeadline(time.Now().Add(time.Second))
+		<-vm.received
+		close(vm.done)
+	}()
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "start")
+	cont.IO = &wasmIO{stdin: stdin, out: out}
+
+	containersRunning.Add(1, cc.Language)
+	return cont, nil
+}
+
+// receiveStatus accepts the connection of the guest reporting the exit status of the program.
+func (vm *firecrackerVM) receiveStatus() {
+	defer close(vm.received)
+	defer vm.statusln.Close()
+	conn, err := vm.statusln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(io.LimitReader(conn, 32)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+	code, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil {
+		return
+	}
+	vm.lck.Lock()
+	vm.status = &code
+	vm.lck.Unlock()
+}
+
+// Remove kills the microVM and removes its session directory and cgroup.
+func (b *FirecrackerBackend) Remove(ctx context.Context, c *Container) error {
+	b.lck.Lock()
+	vm := b.vms[c.ID]
+	delete(b.vms, c.ID)
+	b.lck.Unlock()
+	if vm == nil {
+		return nil
+	}
+	defer b.releaseUID(vm.uid)
+	if vm.code != nil {
+		vm.code.Close()
+	}
+	if vm.cmd != nil {
+		vm.cmd.Process.Kill()
+		select {
+		case <-vm.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	} else if vm.statusln != nil {
+		vm.statusln.Close()
+	}
+	err := os.Remove(filepath.Join("/sys/fs/cgroup", firecrackerCgroup, c.ID))
+	if err != nil && !os.IsNotExist(err) {
+		serverLog.Errorf("failed to remove cgroup of microVM %s: %s", c.ID, err.Error())
+	}
+	return os.RemoveAll(vm.jail)
+}
+
+// CopyTo adds the files of the tarball to the code drive, so that the guest extracts them into dir when it boots.
+// Files cannot be copied once the microVM is running.
+func (b *FirecrackerBackend) CopyTo(ctx context.Context, c *Container, dir string, tr io.Reader) error {
+	vm, err := b.vm(c)
+	if err != nil {
+		return err
+	}
+	if vm.codetar == nil {
+		return errors.New("files cannot be copied into a running microVM")
+	}
+	rd := tar.NewReader(tr)
+	for {
+		hdr, err := rd.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + path.Join(dir, hdr.Name))
+		if name == "/" {
+			continue
+		}
+		hdr.Name = strings.TrimPrefix(name, "/")
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		err = vm.codetar.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(vm.codetar, rd)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ExecInput is not supported, as microVMs only run their program.
+func (b *FirecrackerBackend) ExecInput(ctx context.Context, c *Container, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return 0, errFirecrackerExec
+}
+
+// Wait waits for the microVM to stop, and returns the exit status reported by the guest.
+func (b *FirecrackerBackend) Wait(ctx context.Context, c *Container) (int64, error) {
+	vm, err := b.vm(c)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-vm.done:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	vm.lck.Lock()
+	defer vm.lck.Unlock()
+	if vm.status == nil {
+		return 0, errors.New("microVM stopped without reporting an exit status")
+	}
+	return *vm.status, nil
+}
+
+// Resize has no effect, as the serial console has no window size.
+func (b *FirecrackerBackend) Resize(ctx context.Context, c *Container, cols uint, rows uint) error {
+	return nil
+}
+
+// Clean removes the session directories left behind by a previous run of the server.
+func (b *FirecrackerBackend) Clean() error {
+	matches, err := filepath.Glob(filepath.Join(b.jailDir(), firecrackerDirPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		err = os.RemoveAll(m)
+		if err != nil {
+			return err
+		}
+		os.Remove(filepath.Join("/sys/fs/cgroup", firecrackerCgroup, filepath.Base(m)))
+	}
+	return nil
+}
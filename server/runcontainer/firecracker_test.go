@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeJailer is a stand-in for the jailer, which prints the user ID and runs the fake firecracker binary in the chroot of the microVM.
+const fakeJailer = `#!/bin/sh
+while [ "$1" != "--" ]; do
+	case "$1" in
+	--id) id="$2" ;;
+	--exec-file) exe="$2" ;;
+	--uid) uid="$2" ;;
+	--chroot-base-dir) base="$2" ;;
+	esac
+	shift 2
+done
+shift
+echo "uid $uid"
+cd "$base/$(basename "$exe")/$id/root" || exit 1
+exec "$exe" "$@"
+`
+
+// TestFirecrackerGuest is run by the fake firecracker binary in place of a microVM, in the chroot of the microVM.
+// It prints the command and code file of the code drive, echoes a line of input, and reports exit status 3.
+func TestFirecrackerGuest(t *testing.T) {
+	if os.Getenv("OPENREPL_FAKE_FIRECRACKER") == "" {
+		t.Skip("only run as the fake firecracker binary")
+	}
+	dat, err := ioutil.ReadFile("vm.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg firecrackerConfig
+	if err := json.Unmarshal(dat, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("%s %dMiB %s\n", cfg.BootSource.BootArgs, cfg.MachineConfig.MemSizeMib, filepath.Base(cfg.Drives[0].PathOnHost))
+	f, err := os.Open("." + cfg.Drives[1].PathOnHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := tar.NewReader(f)
+	for {
+		hdr, err := rd.Next()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(rd)
+		fmt.Printf("%s: %s\n", hdr.Name, strings.Replace(string(body), "\x00", " ", -1))
+	}
+	var line string
+	fmt.Scanln(&line)
+	fmt.Printf("input: %s\n", line)
+	conn, err := net.Dial("unix", "."+cfg.Vsock.UDSPath+"_52")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "3\n")
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestFirecrackerBackend(t *testing.T) {
+	if os.Getuid() != os.Getgid() {
+		t.Skip("microVMs run with equal user and group IDs")
+	}
+	dir, err := ioutil.TempDir("", "fctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "firecracker")
+	script := "#!/bin/sh\nOPENREPL_FAKE_FIRECRACKER=1 exec " + os.Args[0] + " -test.run=^TestFirecrackerGuest$\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	jailer := filepath.Join(dir, "jailer")
+	if err := ioutil.WriteFile(jailer, []byte(fakeJailer), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"lua.ext4", "vmlinux"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the chroots are created in a directory of WorkDir named after the binary, which must not be the binary itself
+	work := filepath.Join(dir, "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	uid := os.Getuid()
+	b := &FirecrackerBackend{Command: bin, Jailer: jailer, UID: uid, UIDs: 1, Kernel: filepath.Join(dir, "vmlinux"), BootArgs: "init=/init", RootfsDir: dir, WorkDir: work, StopTimeout: time.Second}
+	cc := ContainerConfig{Language: "lua", Rootfs: "lua.ext4", Entrypoint: []string{"lua"}, Command: []string{"/code"}, Env: []string{"A=1", "B=2"}, MemoryMB: 64}
+	prestart := func(ctx context.Context, c *Container) error {
+		tr := packTarball([]tarEntry{{&tar.Header{Name: "code", Mode: 0644, Size: 8}, []byte("print(1)")}})
+		defer tr.Close()
+		return c.backend.CopyTo(ctx, c, "/home", tr)
+	}
+	c, err := b.Deploy(context.Background(), cc, "abc", prestart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(c.ID, firecrackerDirPrefix+"abc-") {
+		t.Errorf("unexpected container ID %q", c.ID)
+	}
+
+	c.IO.Write([]byte("hi\n"))
+	out, err := ioutil.ReadAll(c.IO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := fmt.Sprintf("uid %d\n", uid) +
+		"console=ttyS0 quiet loglevel=0 reboot=k panic=1 pci=off init=/init 64MiB rootfs\n" +
+		".openrepl/command: lua /code\n.openrepl/env: A=1 B=2\nhome/code: print(1)\ninput: hi\n"
+	if string(out) != expect {
+		t.Errorf("expected output %q but got %q", expect, out)
+	}
+	code, err := b.Wait(context.Background(), c)
+	if code != 3 || err != nil {
+		t.Errorf("expected exit status 3, got %d (%v)", code, err)
+	}
+
+	// files cannot be added once the microVM has booted
+	tr := packTarball([]tarEntry{{&tar.Header{Name: "late", Mode: 0644, Size: 1}, []byte("x")}})
+	if err := b.CopyTo(context.Background(), c, "/", tr); err == nil {
+		t.Error("expected error copying into a running microVM")
+	}
+	tr.Close()
+	if _, err := b.ExecInput(context.Background(), c, []string{"ls"}, nil, ioutil.Discard, ioutil.Discard); err != errFirecrackerExec {
+		t.Errorf("expected errFirecrackerExec, got %v", err)
+	}
+
+	// every user ID is in use until the microVM is removed
+	if _, err := b.Deploy(context.Background(), cc, "ghi", nil); err == nil {
+		t.Error("expected error without a free user ID")
+	}
+
+	// the session directory is removed with the container
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(work, "firecracker", c.ID)); !os.IsNotExist(err) {
+		t.Errorf("expected session directory to be removed, got %v", err)
+	}
+
+	// languages without an image are not deployed
+	if _, err := b.Deploy(context.Background(), ContainerConfig{Language: "lua", Rootfs: "missing.ext4", Entrypoint: []string{"lua"}}, "def", nil); err == nil {
+		t.Error("expected error for missing image")
+	}
+
+	// leftover session directories are cleaned up
+	os.Mkdir(filepath.Join(work, "firecracker", firecrackerDirPrefix+"old"), 0755)
+	if err := b.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(work, "firecracker", firecrackerDirPrefix+"*"))
+	if len(matches) != 0 {
+		t.Errorf("expected no session directories, got %v", matches)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// fileChanges counts the filesystem changes made by runs, as a signal for abuse analysis.
+var fileChanges = &Counter{
+	Name:   "openrepl_run_file_changes_total",
+	Help:   "Number of paths created, modified or deleted by runs.",
+	Labels: []string{"language", "kind"},
+}
+
+func init() {
+	metrics.Register(fileChanges)
+}
+
+// FileChange is a path which was changed by a run.
+type FileChange struct {
+	Path string `json:"path"`
+
+	// Kind is "created", "modified" or "deleted".
+	Kind string `json:"kind"`
+}
+
+// FileDiff is the report of the filesystem changes made by a run.
+// Changes in tmpfs mounts and volumes are not included.
+type FileDiff struct {
+	Changes []FileChange `json:"changes"`
+
+	// Omitted is the number of changes left out of the report due to the size limit.
+	Omitted int `json:"omitted,omitempty"`
+}
+
+// maxDiffChanges is the maximum number of changes included in a diff report.
+const maxDiffChanges = 500
+
+// changeKinds are the names of the kinds of changes reported by the Docker daemon.
+var changeKinds = []string{"modified", "created", "deleted"}
+
+// fileDiff converts the changes reported by the Docker daemon into a diff report.
+// Paths written by the server are ignored, as are modified directories which only contain other changes.
+func fileDiff(items []container.ContainerChangeResponseItem, ignore []string) FileDiff {
+	// index parent directories of other changes
+	parents := make(map[string]bool)
+	for _, it := range items {
+		for p := it.Path; strings.LastIndex(p, "/") > 0; {
+			p = p[:strings.LastIndex(p, "/")]
+			parents[p] = true
+		}
+	}
+
+	var changes []FileChange
+	for _, it := range items {
+		if inList(it.Path, ignore) || int(it.Kind) >= len(changeKinds) {
+			continue
+		}
+		kind := changeKinds[it.Kind]
+		if kind == "modified" && parents[it.Path] {
+			continue
+		}
+		changes = append(changes, FileChange{Path: it.Path, Kind: kind})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	d := FileDiff{Changes: changes}
+	if d.Changes == nil {
+		d.Changes = []FileChange{}
+	}
+	if len(d.Changes) > maxDiffChanges {
+		d.Omitted = len(d.Changes) - maxDiffChanges
+		d.Changes = d.Changes[:maxDiffChanges]
+	}
+	return d
+}
+
+// counts returns the number of changes of each kind, including omitted changes as "unknown".
+func (d FileDiff) counts() map[string]int {
+	counts := make(map[string]int)
+	for _, ch := range d.Changes {
+		counts[ch.Kind]++
+	}
+	if d.Omitted > 0 {
+		counts["unknown"] = d.Omitted
+	}
+	return counts
+}
+
+// reportsDiff checks whether the filesystem changes of the run are computed after the program exits.
+func (cs *ContainerSession) reportsDiff() bool {
+	return cs.Options.Diff || cs.Config.RecordDiffs
+}
+
+// reportDiff records the filesystem changes made by the run, and sends them to the client if requested.
+func (cs *ContainerSession) reportDiff(ctx context.Context) error {
+	c := cs.Container
+	if c.cli == nil {
+		return errRequiresDocker
+	}
+	items, err := c.cli.ContainerDiff(ctx, c.ID)
+	if err != nil {
+		return err
+	}
+	ignore := append([]string{cs.ContainerConfig.entryFile(cs.Config.DaemonOS), execPidFile}, cs.projectPaths...)
+	d := fileDiff(items, ignore)
+
+	// record summary for operators
+	counts := d.counts()
+	for kind, n := range counts {
+		fileChanges.Add(float64(n), cs.ContainerConfig.Language, kind)
+	}
+	cs.Events.Record("fs_diff", fmt.Sprintf("%d created, %d modified, %d deleted, %d omitted", counts["created"], counts["modified"], counts["deleted"], d.Omitted))
+
+	if !cs.Options.Diff {
+		return nil
+	}
+	return cs.UpdateStatus(StatusUpdate{Status: "diff", Diff: &d})
+}
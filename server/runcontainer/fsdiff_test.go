@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestFileDiff(t *testing.T) {
+	items := []container.ContainerChangeResponseItem{
+		{Kind: 0, Path: "/tmp"},
+		{Kind: 1, Path: "/tmp/out.txt"},
+		{Kind: 1, Path: "/tmp/.openrepl-exec.pid"},
+		{Kind: 1, Path: "/code"},
+		{Kind: 0, Path: "/etc"},
+		{Kind: 0, Path: "/etc/hosts"},
+		{Kind: 2, Path: "/etc/motd"},
+		{Kind: 0, Path: "/root/.bashrc"},
+	}
+	d := fileDiff(items, []string{"/code", "/tmp/.openrepl-exec.pid"})
+	expect := []FileChange{
+		{Path: "/etc/hosts", Kind: "modified"},
+		{Path: "/etc/motd", Kind: "deleted"},
+		{Path: "/root/.bashrc", Kind: "modified"},
+		{Path: "/tmp/out.txt", Kind: "created"},
+	}
+	if !reflect.DeepEqual(d.Changes, expect) || d.Omitted != 0 {
+		t.Fatalf("expected %v but got %v (%d omitted)", expect, d.Changes, d.Omitted)
+	}
+
+	// large diffs are truncated
+	items = make([]container.ContainerChangeResponseItem, maxDiffChanges+3)
+	for i := range items {
+		items[i] = container.ContainerChangeResponseItem{Kind: 1, Path: fmt.Sprintf("/f%d", i)}
+	}
+	d = fileDiff(items, nil)
+	if len(d.Changes) != maxDiffChanges || d.Omitted != 3 {
+		t.Fatalf("expected %d changes and 3 omitted but got %d and %d", maxDiffChanges, len(d.Changes), d.Omitted)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// GPUPool limits the number of concurrent sessions using GPUs, and allocates the GPUs of the host to them.
+// Sessions requesting a number of GPUs are given distinct devices, which they hold until they are closed.
+// Other GPU sessions share all devices, and only hold a session slot.
+// A nil GPUPool rejects GPU sessions.
+type GPUPool struct {
+	// Sessions is the maximum number of concurrent GPU sessions.
+	Sessions int
+
+	// Devices is the number of GPUs of the host, which are identified by their index.
+	Devices int
+
+	// Scheduled is set if devices are allocated by the backend rather than by the pool, as on Kubernetes,
+	// where the device plugin allocates GPUs to Pods. The pool then only limits sessions.
+	Scheduled bool
+
+	lck      sync.Mutex
+	sessions int
+	used     []bool
+}
+
+// errGPUCapacity is returned when the maximum number of GPU sessions is reached.
+var errGPUCapacity = errors.New("GPU capacity exceeded")
+
+// Acquire reserves a session slot, and count distinct devices if count is nonzero.
+// It returns the indices of the reserved devices (nil if they are not allocated by the pool),
+// and a function returning them to the pool.
+func (p *GPUPool) Acquire(count int) ([]int, func(), error) {
+	if p == nil {
+		return nil, nil, errors.New("GPU sessions are not supported")
+	}
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	if p.sessions >= p.Sessions {
+		return nil, nil, errGPUCapacity
+	}
+
+	var devices []int
+	if count > 0 && !p.Scheduled {
+		if count > p.Devices {
+			return nil, nil, fmt.Errorf("%d GPUs requested, but the host has %d", count, p.Devices)
+		}
+		if p.used == nil {
+			p.used = make([]bool, p.Devices)
+		}
+		for i, u := range p.used {
+			if !u && len(devices) < count {
+				devices = append(devices, i)
+			}
+		}
+		if len(devices) < count {
+			return nil, nil, errGPUCapacity
+		}
+		for _, i := range devices {
+			p.used[i] = true
+		}
+	}
+	p.sessions++
+
+	var once sync.Once
+	return devices, func() {
+		once.Do(func() {
+			p.lck.Lock()
+			defer p.lck.Unlock()
+			p.sessions--
+			for _, i := range devices {
+				p.used[i] = false
+			}
+		})
+	}, nil
+}
+
+// Status returns the number of GPU sessions and of allocated devices.
+func (p *GPUPool) Status() (sessions int, devices int) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	for _, u := range p.used {
+		if u {
+			devices++
+		}
+	}
+	return p.sessions, devices
+}
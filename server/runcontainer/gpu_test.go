@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGPUPool(t *testing.T) {
+	p := &GPUPool{Sessions: 3, Devices: 4}
+	a, releaseA, err := p.Acquire(2)
+	if err != nil {
+		t.Fatalf("failed to acquire: %s", err.Error())
+	}
+	b, releaseB, err := p.Acquire(2)
+	if err != nil {
+		t.Fatalf("failed to acquire: %s", err.Error())
+	}
+	if !reflect.DeepEqual(a, []int{0, 1}) || !reflect.DeepEqual(b, []int{2, 3}) {
+		t.Errorf("expected distinct devices but got %v and %v", a, b)
+	}
+
+	// all devices are allocated, but sessions sharing all devices only take a slot
+	if _, _, err := p.Acquire(1); err != errGPUCapacity {
+		t.Errorf("expected capacity error but got %v", err)
+	}
+	shared, releaseShared, err := p.Acquire(0)
+	if err != nil || shared != nil {
+		t.Fatalf("expected shared session but got %v, %v", shared, err)
+	}
+	if _, _, err := p.Acquire(0); err != errGPUCapacity {
+		t.Errorf("expected capacity error but got %v", err)
+	}
+	releaseShared()
+
+	// released devices are allocated again, once
+	releaseA()
+	releaseA()
+	if sessions, devices := p.Status(); sessions != 1 || devices != 2 {
+		t.Errorf("expected 1 session with 2 devices but got %d and %d", sessions, devices)
+	}
+	c, releaseC, err := p.Acquire(2)
+	if err != nil || !reflect.DeepEqual(c, []int{0, 1}) {
+		t.Errorf("expected released devices but got %v, %v", c, err)
+	}
+	releaseB()
+	releaseC()
+
+	if _, _, err := p.Acquire(5); err == nil {
+		t.Error("expected error for more GPUs than the host has")
+	}
+	if sessions, devices := p.Status(); sessions != 0 || devices != 0 {
+		t.Errorf("expected empty pool but got %d sessions and %d devices", sessions, devices)
+	}
+
+	// devices of Pods are allocated by Kubernetes
+	k := &GPUPool{Sessions: 1, Scheduled: true}
+	if d, _, err := k.Acquire(2); err != nil || d != nil {
+		t.Errorf("expected session without devices but got %v, %v", d, err)
+	}
+
+	var nilp *GPUPool
+	if _, _, err := nilp.Acquire(0); err == nil {
+		t.Error("expected nil pool to reject GPU sessions")
+	}
+}
+
+func TestGPUEnv(t *testing.T) {
+	gc := &GPUConfig{Count: 2, Capabilities: []string{"compute", "utility"}}
+	env := gc.env([]int{1, 3})
+	expect := []string{"NVIDIA_VISIBLE_DEVICES=1,3", "NVIDIA_DRIVER_CAPABILITIES=compute,utility"}
+	if !reflect.DeepEqual(env, expect) {
+		t.Errorf("expected %v but got %v", expect, env)
+	}
+	if env := (&GPUConfig{}).env(nil); !reflect.DeepEqual(env, []string{"NVIDIA_VISIBLE_DEVICES=all"}) {
+		t.Errorf("expected all devices but got %v", env)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TestConfig is the configuration of the test runner of a language, which runs instructor test suites against submissions.
+type TestConfig struct {
+	// Command is the command running the test suite, in the working directory of the container.
+	Command []string `json:"command"`
+
+	// Dir is the directory into which the test bundle is copied.
+	// If empty, the project directory of the language is used, so that tests sit next to the submission.
+	Dir string `json:"dir,omitempty"`
+
+	// Format is the format of the results, either "junit" (JUnit XML) or "tap" (Test Anything Protocol).
+	Format string `json:"format"`
+
+	// Report is the path of the file to which the test runner writes its results, which is removed before the suite runs.
+	// If empty, the results are read from the output of the command.
+	Report string `json:"report,omitempty"`
+
+	// Timeout is the maximum run time of the test suite in seconds.
+	// If zero, defaultTestSuiteTimeout is used.
+	Timeout float64 `json:"timeout,omitempty"`
+}
+
+// defaultTestSuiteTimeout is the run time limit of test suites without a timeout.
+const defaultTestSuiteTimeout = time.Minute
+
+// maxTestReport is the maximum size of the results of a test suite.
+const maxTestReport = 4 << 20
+
+// validate checks that the test runner is well-formed.
+func (tc *TestConfig) validate() error {
+	if len(tc.Command) == 0 {
+		return errors.New("test runner has no command")
+	}
+	switch tc.Format {
+	case "junit", "tap":
+	default:
+		return fmt.Errorf("unsupported test result format %q", tc.Format)
+	}
+	return nil
+}
+
+// TestCaseResult is the result of a single test case of a test suite.
+type TestCaseResult struct {
+	Name string `json:"name"`
+
+	// Suite is the test suite or class of the test case, if reported.
+	Suite string `json:"suite,omitempty"`
+
+	// Status is "passed", "failed" or "skipped".
+	Status string `json:"status"`
+
+	// Message explains why the test failed or was skipped.
+	Message string `json:"message,omitempty"`
+
+	// Duration is the run time of the test in seconds, if reported.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// TestReport is the parsed result of running a test suite against a submission.
+type TestReport struct {
+	Passed  int              `json:"passed"`
+	Failed  int              `json:"failed"`
+	Skipped int              `json:"skipped"`
+	Tests   []TestCaseResult `json:"tests"`
+
+	// ExitCode is the exit status of the test runner.
+	ExitCode int64 `json:"exit_code"`
+
+	// Duration is the run time of the test suite in seconds.
+	Duration float64 `json:"duration"`
+
+	// Output is the output of the test runner, which is only returned if no tests were reported (e.g. when the submission does not compile).
+	Output string `json:"output,omitempty"`
+}
+
+// add records the result of a test case.
+func (tr *TestReport) add(res TestCaseResult) {
+	switch res.Status {
+	case "passed":
+		tr.Passed++
+	case "failed":
+		tr.Failed++
+	case "skipped":
+		tr.Skipped++
+	}
+	tr.Tests = append(tr.Tests, res)
+}
+
+// junitSuite is a testsuite or testsuites element of a JUnit XML report.
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Error     *junitMessage `xml:"error"`
+	Skipped   *junitMessage `xml:"skipped"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// text returns the message of a failure, preferring its attribute over its body.
+func (m *junitMessage) text() string {
+	if m.Message != "" {
+		return m.Message
+	}
+	return strings.TrimSpace(m.Text)
+}
+
+// parseJUnit parses a JUnit XML report, whose root is either a testsuites or a testsuite element.
+func parseJUnit(dat []byte) (*TestReport, error) {
+	var root junitSuite
+	err := xml.Unmarshal(dat, &root)
+	if err != nil {
+		return nil, err
+	}
+	report := &TestReport{Tests: []TestCaseResult{}}
+	var walk func(s junitSuite)
+	walk = func(s junitSuite) {
+		for _, c := range s.Cases {
+			res := TestCaseResult{Name: c.Name, Suite: c.Classname, Status: "passed"}
+			if res.Suite == "" {
+				res.Suite = s.Name
+			}
+			res.Duration, _ = strconv.ParseFloat(c.Time, 64)
+			switch {
+			case c.Failure != nil:
+				res.Status, res.Message = "failed", c.Failure.text()
+			case c.Error != nil:
+				res.Status, res.Message = "failed", c.Error.text()
+			case c.Skipped != nil:
+				res.Status, res.Message = "skipped", c.Skipped.text()
+			}
+			report.add(res)
+		}
+		for _, sub := range s.Suites {
+			walk(sub)
+		}
+	}
+	walk(root)
+	return report, nil
+}
+
+// tapResultPattern matches the result lines of a TAP stream, capturing the status, description and directive.
+var tapResultPattern = regexp.MustCompile(`^(not ok|ok)\b\s*\d*\s*(?:-\s*)?([^#]*?)\s*(?:#\s*(.*))?$`)
+
+// tapPlanPattern matches the plan of a TAP stream.
+var tapPlanPattern = regexp.MustCompile(`^1\.\.(\d+)`)
+
+// parseTAP parses a TAP stream.
+// Diagnostics following a failed test (comments or a YAML block) become its message, and tests which were planned but not reported count as failed.
+func parseTAP(r io.Reader) (*TestReport, error) {
+	report := &TestReport{Tests: []TestCaseResult{}}
+	planned, bailed := -1, 0
+	var last *TestCaseResult
+	var diag []string
+	flush := func() {
+		if last != nil {
+			if last.Message == "" && len(diag) > 0 {
+				last.Message = strings.Join(diag, "\n")
+			}
+			report.add(*last)
+		}
+		last, diag = nil, nil
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxTestReport)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		trimmed := strings.TrimSpace(line)
+		if m := tapResultPattern.FindStringSubmatch(line); m != nil {
+			flush()
+			res := TestCaseResult{Name: m[2], Status: "passed"}
+			if m[1] == "not ok" {
+				res.Status = "failed"
+			}
+			directive := strings.ToUpper(m[3])
+			switch {
+			case strings.HasPrefix(directive, "SKIP"):
+				res.Status, res.Message = "skipped", strings.TrimSpace(m[3][4:])
+			case strings.HasPrefix(directive, "TODO"):
+				// failures of unfinished tests are expected
+				res.Status, res.Message = "skipped", strings.TrimSpace(m[3][4:])
+			}
+			if res.Name == "" {
+				res.Name = "test " + strconv.Itoa(len(report.Tests)+1)
+			}
+			last = &res
+			continue
+		}
+		if m := tapPlanPattern.FindStringSubmatch(trimmed); m != nil {
+			planned, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if strings.HasPrefix(trimmed, "Bail out!") {
+			flush()
+			report.add(TestCaseResult{Name: "bail out", Status: "failed", Message: strings.TrimSpace(strings.TrimPrefix(trimmed, "Bail out!"))})
+			bailed = 1
+			break
+		}
+		if last != nil && last.Status == "failed" {
+			switch {
+			case strings.HasPrefix(trimmed, "#"):
+				diag = append(diag, strings.TrimSpace(strings.TrimPrefix(trimmed, "#")))
+			case trimmed != "---" && trimmed != "..." && strings.HasPrefix(line, " "):
+				diag = append(diag, trimmed)
+			}
+		}
+	}
+	flush()
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if planned < 0 && len(report.Tests) == 0 {
+		return nil, errors.New("no TAP results found")
+	}
+	if missing := planned - len(report.Tests) + bailed; missing > 0 {
+		report.Failed += missing
+		report.Tests = append(report.Tests, TestCaseResult{Name: "missing tests", Status: "failed", Message: fmt.Sprintf("%d planned tests were not run", missing)})
+	}
+	return report, nil
+}
+
+// parseTestReport parses the results of a test suite in the given format.
+func parseTestReport(format string, dat []byte) (*TestReport, error) {
+	switch format {
+	case "junit":
+		return parseJUnit(dat)
+	case "tap":
+		return parseTAP(strings.NewReader(string(dat)))
+	default:
+		return nil, fmt.Errorf("unsupported test result format %q", format)
+	}
+}
+
+// runTestSuite copies the test bundle next to the submission, runs the test runner of the language, and parses its results.
+// The tests run in the container of the submission, with its user and privileges, so a submission can tamper with the test bundle or forge the results.
+// The report is only as trustworthy as the submission, and graders which cannot trust submissions must check results outside of the container.
+func (cs *ContainerSession) runTestSuite(ctx context.Context) (*TestReport, error) {
+	tc := cs.ContainerConfig.Test
+	os := cs.Config.DaemonOS
+	dir := tc.Dir
+	if dir == "" {
+		dir = cs.ContainerConfig.projectDir(os)
+	}
+	tr := packTarball(cs.ContainerConfig.projectEntries(os, cs.Options.TestBundle))
+	err := cs.Container.backend.CopyTo(ctx, cs.Container, dir, tr)
+	tr.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultTestSuiteTimeout
+	if tc.Timeout > 0 {
+		timeout = time.Duration(tc.Timeout * float64(time.Second))
+	}
+	// remove a report left in the container, such as one shipped with the submission, so that it is not mistaken for the results
+	if tc.Report != "" {
+		code, err := cs.Container.ExecTo(ctx, []string{"rm", "-f", tc.Report}, ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			return nil, err
+		}
+		if code != 0 {
+			return nil, fmt.Errorf("failed to remove test report %s", tc.Report)
+		}
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	out := &limitedBuffer{limit: maxTestReport}
+	code, err := cs.Container.ExecTo(tctx, tc.Command, out, out)
+	if tctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, fmt.Errorf("test suite exceeded the time limit of %s", timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Since(start).Seconds()
+
+	// read the results from the report file if the runner writes one, which is missing if the suite did not run
+	dat := out.Bytes()
+	if tc.Report != "" {
+		buf := &limitedBuffer{limit: maxTestReport}
+		rcode, err := cs.Container.ExecTo(ctx, []string{"cat", tc.Report}, buf, ioutil.Discard)
+		if err != nil {
+			return nil, err
+		}
+		dat = nil
+		if rcode == 0 {
+			dat = buf.Bytes()
+		}
+	}
+	report, err := parseTestReport(tc.Format, dat)
+	if err != nil {
+		report = &TestReport{Tests: []TestCaseResult{}}
+	}
+	report.ExitCode, report.Duration = int64(code), duration
+	if len(report.Tests) == 0 {
+		output := out.String()
+		if len(output) > maxTestOutput {
+			output = output[:maxTestOutput]
+		}
+		report.Output = output
+	}
+	return report, nil
+}
+
+// GradeRequest is a request to run the test suite of an instructor against a submission over HTTP.
+type GradeRequest struct {
+	// Lang is the name of the language of the submission.
+	Lang string `json:"lang"`
+
+	// Code is the submitted code, or its project manifest if a project format is selected.
+	Code string `json:"code"`
+
+	// Version is the version of the language (e.g. "3.12").
+	// If empty, the default version is used.
+	Version string `json:"version"`
+
+	// Tests are the files of the test bundle, which are copied into the test directory of the language.
+	Tests []ProjectFile `json:"tests"`
+}
+
+// HandleAPIGrade runs the test suite in the GradeRequest in the body of a POST request against its submission, responding with a RunResponse containing the parsed results once it has finished.
+func (cs *ContainerServer) HandleAPIGrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req GradeRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRunRequest)).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid grade request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Tests) == 0 {
+		http.Error(w, "grade request has no tests", http.StatusBadRequest)
+		return
+	}
+	if len(req.Tests) > maxProjectFiles {
+		http.Error(w, "too many test files", http.StatusBadRequest)
+		return
+	}
+	for i, f := range req.Tests {
+		req.Tests[i].Path, err = cleanProjectPath(f.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	q := r.URL.Query()
+	q.Set("lang", req.Lang)
+	if req.Version != "" {
+		q.Set("version", req.Version)
+	}
+	q.Set("grade", "true")
+	q.Set("streams", "true")
+	q.Set("transport", "rest")
+	r.URL.RawQuery = q.Encode()
+	run := &RunRequest{Lang: req.Lang, Code: req.Code, Version: req.Version}
+	ctx := context.WithValue(r.Context(), runRequestKey{}, run)
+	r = r.WithContext(context.WithValue(ctx, gradeRequestKey{}, &req))
+	cs.serveSession(w, r, true)
+}
+
+// gradeRequestKey is the context key of the GradeRequest of an HTTP test run.
+type gradeRequestKey struct{}
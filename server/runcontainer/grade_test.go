@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJUnit(t *testing.T) {
+	report, err := parseJUnit([]byte(`<?xml version="1.0"?>
+<testsuites>
+	<testsuite name="math">
+		<testcase name="add" classname="MathTest" time="0.01"/>
+		<testcase name="div" classname="MathTest"><failure message="expected 2 but got 3">trace</failure></testcase>
+	</testsuite>
+	<testsuite name="io">
+		<testcase name="read"><error>file not found</error></testcase>
+		<testcase name="write"><skipped/></testcase>
+	</testsuite>
+</testsuites>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []TestCaseResult{
+		{Name: "add", Suite: "MathTest", Status: "passed", Duration: 0.01},
+		{Name: "div", Suite: "MathTest", Status: "failed", Message: "expected 2 but got 3"},
+		{Name: "read", Suite: "io", Status: "failed", Message: "file not found"},
+		{Name: "write", Suite: "io", Status: "skipped"},
+	}
+	if !reflect.DeepEqual(report.Tests, expect) {
+		t.Errorf("expected tests %+v but got %+v", expect, report.Tests)
+	}
+	if report.Passed != 1 || report.Failed != 2 || report.Skipped != 1 {
+		t.Errorf("unexpected counts %+v", report)
+	}
+
+	// a single suite may be the root
+	report, err = parseJUnit([]byte(`<testsuite name="s"><testcase name="a"/></testsuite>`))
+	if err != nil || len(report.Tests) != 1 || report.Tests[0].Suite != "s" {
+		t.Errorf("unexpected report %+v (%v)", report, err)
+	}
+	if _, err := parseJUnit([]byte("not xml")); err == nil {
+		t.Error("expected error for invalid report")
+	}
+}
+
+func TestParseTAP(t *testing.T) {
+	report, err := parseTAP(strings.NewReader(`TAP version 13
+1..5
+ok 1 - adds numbers
+not ok 2 - divides numbers
+  ---
+  message: expected 2
+  ...
+ok 3 # SKIP no network
+not ok 4 - handles unicode # TODO not implemented
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []TestCaseResult{
+		{Name: "adds numbers", Status: "passed"},
+		{Name: "divides numbers", Status: "failed", Message: "message: expected 2"},
+		{Name: "test 3", Status: "skipped", Message: "no network"},
+		{Name: "handles unicode", Status: "skipped", Message: "not implemented"},
+		{Name: "missing tests", Status: "failed", Message: "1 planned tests were not run"},
+	}
+	if !reflect.DeepEqual(report.Tests, expect) {
+		t.Errorf("expected tests %+v but got %+v", expect, report.Tests)
+	}
+	if report.Passed != 1 || report.Failed != 2 || report.Skipped != 2 {
+		t.Errorf("unexpected counts %+v", report)
+	}
+
+	// bailing out stops the stream
+	report, err = parseTAP(strings.NewReader("1..3\nok 1\n# note\nBail out! database down\nok 2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Tests) != 3 || report.Tests[1].Message != "database down" || report.Failed != 3 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if _, err := parseTAP(strings.NewReader("compile error\n")); err == nil {
+		t.Error("expected error for output without results")
+	}
+}
+
+func TestHandleAPIGrade(t *testing.T) {
+	cs := &ContainerServer{}
+	for body, expect := range map[string]string{
+		`{"lang":"python3"}`:                           "grade request has no tests",
+		`{"lang":"python3","tests":[{"path":"../x"}]}`: `invalid project path "../x"`,
+		`{"lang"`: "invalid grade request",
+	} {
+		w := httptest.NewRecorder()
+		cs.HandleAPIGrade(w, httptest.NewRequest(http.MethodPost, "/api/grade", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != expect {
+			t.Errorf("%s: expected %q but got %d %q", body, expect, w.Code, w.Body.String())
+		}
+	}
+
+	// test runs are only served for grade requests
+	if _, err := cs.parseOptions(map[string][]string{"grade": {"true"}, "streams": {"true"}}, true); err == nil {
+		t.Error("expected error for test run over websocket")
+	}
+	if _, err := cs.parseOptions(map[string][]string{"grade": {"true"}, "streams": {"true"}, "transport": {"rest"}}, false); err == nil {
+		t.Error("expected error for test run in a terminal")
+	}
+	opts, err := cs.parseOptions(map[string][]string{"grade": {"true"}, "streams": {"true"}, "transport": {"rest"}}, true)
+	if err != nil || !opts.Grade {
+		t.Errorf("unexpected options %+v (%v)", opts, err)
+	}
+}
+
+func TestTestConfigValidate(t *testing.T) {
+	if err := (&TestConfig{Command: []string{"pytest"}, Format: "junit"}).validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&TestConfig{Format: "tap"}).validate(); err == nil {
+		t.Error("expected error for missing command")
+	}
+	if err := (&TestConfig{Command: []string{"pytest"}, Format: "xml"}).validate(); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
@@ -0,0 +1,191 @@
+//go:build grpc
+// +build grpc
+
+package main
+
+//go:generate protoc --go_out=plugins=grpc:. execpb/exec.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/openrepl/server/runcontainer/execpb"
+)
+
+// serveGRPC serves the gRPC execution API on an address, with TLS if tlsConfig is not nil.
+func serveGRPC(addr string, es *ExecServer, tlsConfig *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	execpb.RegisterRunnerServer(s, grpcRunner{es})
+	return s.Serve(l)
+}
+
+// grpcRunner implements the Runner service with an ExecServer.
+type grpcRunner struct {
+	es *ExecServer
+}
+
+func (gr grpcRunner) StartSession(ctx context.Context, req *execpb.StartSessionRequest) (*execpb.StartSessionResponse, error) {
+	// pass the metadata of the call as the headers of the equivalent websocket request
+	remote := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+	hdr := http.Header{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, name := range []string{"authorization", "user-agent"} {
+			for _, v := range md[name] {
+				hdr.Add(name, v)
+			}
+		}
+	}
+
+	token, err := gr.es.Start(ctx, ExecStart{
+		Lang:     req.Lang,
+		Version:  req.Version,
+		Terminal: req.Terminal,
+		Args:     req.Args,
+		Env:      req.Env,
+		Streams:  req.Streams,
+		Packages: req.Packages,
+		Options:  req.Options,
+	}, remote, hdr)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &execpb.StartSessionResponse{Token: token}, nil
+}
+
+func (gr grpcRunner) Exec(stream execpb.Runner_ExecServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	token, ok := req.Event.(*execpb.ExecRequest_Attach)
+	if !ok {
+		return status.Error(codes.InvalidArgument, "the first request must attach a session")
+	}
+	err = gr.es.Attach(token.Attach, grpcStream{stream})
+	if err == errExecNotFound {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return err
+}
+
+// grpcError converts the rejection of a session to a gRPC status.
+func grpcError(err error) error {
+	ee, ok := err.(*ExecError)
+	if !ok {
+		return err
+	}
+	code := codes.Unknown
+	switch ee.Status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, ee.Message)
+}
+
+// grpcStream is an execStream over an Exec call, which translates openrepl.v3 envelopes to and from protocol buffers.
+type grpcStream struct {
+	stream execpb.Runner_ExecServer
+}
+
+func (gs grpcStream) Send(env Envelope) error {
+	res := &execpb.ExecResponse{}
+	switch env.Type {
+	case "status":
+		var su StatusUpdate
+		err := json.Unmarshal(env.Payload, &su)
+		if err != nil {
+			return err
+		}
+		st := &execpb.Status{
+			Status:  su.Status,
+			Error:   su.Error,
+			Message: su.Message,
+			Code:    su.Code,
+			Session: su.Session,
+			Json:    string(env.Payload),
+		}
+		if su.Status == "exit" && su.ExitCode != nil {
+			st.Exited, st.ExitCode, st.Duration = true, *su.ExitCode, su.Duration
+		}
+		res.Event = &execpb.ExecResponse_Status{Status: st}
+	case "stdout", "stderr":
+		var dp DataPayload
+		err := json.Unmarshal(env.Payload, &dp)
+		if err != nil {
+			return err
+		}
+		out := &execpb.Output{Data: dp.Data, Time: dp.Time}
+		if env.Type == "stdout" {
+			res.Event = &execpb.ExecResponse_Stdout{Stdout: out}
+		} else {
+			res.Event = &execpb.ExecResponse_Stderr{Stderr: out}
+		}
+	default:
+		res.Event = &execpb.ExecResponse_Message{Message: &execpb.Message{Type: env.Type, Json: string(env.Payload)}}
+	}
+	return gs.stream.Send(res)
+}
+
+func (gs grpcStream) Recv() (Envelope, error) {
+	req, err := gs.stream.Recv()
+	if err != nil {
+		return Envelope{}, err
+	}
+	var typ string
+	var v interface{}
+	switch ev := req.Event.(type) {
+	case *execpb.ExecRequest_Code:
+		typ, v = "code", DataPayload{Data: ev.Code}
+	case *execpb.ExecRequest_Stdin:
+		typ, v = "stdin", DataPayload{Data: ev.Stdin}
+	case *execpb.ExecRequest_Eof:
+		typ = "eof"
+	case *execpb.ExecRequest_Resize:
+		typ, v = "resize", ControlMessage{Cols: uint(ev.Resize.Cols), Rows: uint(ev.Resize.Rows)}
+	case *execpb.ExecRequest_Signal:
+		typ, v = "signal", SignalPayload{Signal: ev.Signal}
+	default:
+		return Envelope{}, errors.New("unsupported exec request")
+	}
+	env := Envelope{Type: typ}
+	if v != nil {
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return Envelope{}, err
+		}
+		env.Payload = payload
+	}
+	return env, nil
+}
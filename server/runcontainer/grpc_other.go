@@ -0,0 +1,14 @@
+//go:build !grpc
+// +build !grpc
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// serveGRPC serves the gRPC execution API, which requires building with the grpc tag after generating the execpb package.
+func serveGRPC(addr string, es *ExecServer, tlsConfig *tls.Config) error {
+	return errors.New("gRPC execution API not available: build with -tags grpc")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// readinessTimeout is the time within which the checks of a readiness probe must complete.
+const readinessTimeout = 5 * time.Second
+
+// Readiness is the response of the readiness endpoint, with the result of each check ("ok" or the reason it failed).
+// Details are findings which do not affect readiness, such as images which are pulled when first used.
+type Readiness struct {
+	Ready   bool              `json:"ready"`
+	Checks  map[string]string `json:"checks"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// readiness checks whether the server can accept sessions: it is not draining, the Docker daemon is reachable with the image of every language, and it is under its capacity limit.
+// The daemon is not checked when containers are deployed on another backend.
+// Missing images only make the server unready if they are not pulled when first used.
+func (cs *ContainerServer) readiness(ctx context.Context) Readiness {
+	checks := map[string]error{}
+	var details map[string]string
+	if cs.Draining() {
+		checks["draining"] = errors.New("draining for maintenance")
+	} else {
+		checks["draining"] = nil
+	}
+	if cs.SessionConfig.DockerClient != nil {
+		missing, err := cs.missingImages(ctx)
+		switch {
+		case err != nil:
+			checks["docker"] = err
+		case len(missing) > 0 && cs.SessionConfig.Pulls != nil:
+			checks["docker"] = nil
+			details = map[string]string{"images": "pulled on first use: " + strings.Join(missing, ", ")}
+		case len(missing) > 0:
+			checks["docker"] = errors.New("images unavailable: " + strings.Join(missing, ", "))
+		default:
+			checks["docker"] = nil
+		}
+	}
+	if q := cs.SessionConfig.Capacity; q != nil {
+		used, _ := q.Status()
+		if used >= q.Max {
+			checks["capacity"] = errors.New("at capacity")
+		} else {
+			checks["capacity"] = nil
+		}
+	}
+
+	rd := Readiness{Ready: true, Checks: make(map[string]string, len(checks)), Details: details}
+	for name, err := range checks {
+		if err != nil {
+			rd.Ready = false
+			rd.Checks[name] = err.Error()
+		} else {
+			rd.Checks[name] = "ok"
+		}
+	}
+	return rd
+}
+
+// HandleHealth reports that the server is alive, for liveness probes.
+func (cs *ContainerServer) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// HandleReady reports whether the server can accept sessions, for readiness probes and load balancer health checks.
+// It responds with 503 Service Unavailable if any check fails.
+func (cs *ContainerServer) HandleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	rd := cs.readiness(ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !rd.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(rd)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHandleHealth(t *testing.T) {
+	cs := &ContainerServer{}
+	w := httptest.NewRecorder()
+	cs.HandleHealth(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	q := &CapacityQueue{Max: 1}
+	cs := &ContainerServer{SessionConfig: ContainerSessionConfig{Capacity: q}}
+	probe := func() (int, Readiness) {
+		w := httptest.NewRecorder()
+		cs.HandleReady(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var rd Readiness
+		if err := json.Unmarshal(w.Body.Bytes(), &rd); err != nil {
+			t.Fatalf("invalid response %q: %s", w.Body.String(), err.Error())
+		}
+		return w.Code, rd
+	}
+
+	code, rd := probe()
+	expect := Readiness{Ready: true, Checks: map[string]string{"draining": "ok", "capacity": "ok"}}
+	if code != http.StatusOK || !reflect.DeepEqual(rd, expect) {
+		t.Errorf("expected ready, got %d %+v", code, rd)
+	}
+
+	// a full server is not ready
+	release, err := q.Acquire(context.Background(), 0, func(int) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, rd = probe()
+	if code != http.StatusServiceUnavailable || rd.Ready || rd.Checks["capacity"] != "at capacity" {
+		t.Errorf("expected not ready at capacity, got %d %+v", code, rd)
+	}
+	release()
+
+	// neither is a draining server
+	cs.setDraining(true)
+	code, rd = probe()
+	if code != http.StatusServiceUnavailable || rd.Ready || rd.Checks["draining"] == "ok" || rd.Checks["capacity"] != "ok" {
+		t.Errorf("expected not ready while draining, got %d %+v", code, rd)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JobRecord is the record of a completed run session.
+type JobRecord struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	Language  string    `json:"language"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+
+	// Status is the verdict of the run ("exited", "error" or "timeout").
+	Status string `json:"status"`
+
+	// ExitCode is the exit status of the program, if it exited.
+	ExitCode *int64 `json:"exit_code,omitempty"`
+
+	// Output is the beginning of the program output.
+	Output []byte `json:"output,omitempty"`
+
+	// Truncated is whether the output was truncated.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Usage is the resource usage of the run, and Cost is its cost.
+	// These are only recorded when cost accounting is enabled.
+	Usage *SessionUsage `json:"usage,omitempty"`
+	Cost  float64       `json:"cost,omitempty"`
+}
+
+// JobQuery is a filter on job records.
+// Empty fields match all records.
+type JobQuery struct {
+	Tenant    string
+	Principal string
+	Language  string
+	Status    string
+	Since     time.Time
+	Until     time.Time
+
+	// Limit is the maximum number of records returned.
+	Limit int
+}
+
+// matches checks whether a record matches the query.
+func (q JobQuery) matches(rec JobRecord) bool {
+	switch {
+	case q.Tenant != "" && rec.Tenant != q.Tenant:
+		return false
+	case q.Principal != "" && rec.Principal != q.Principal:
+		return false
+	case q.Language != "" && rec.Language != q.Language:
+		return false
+	case q.Status != "" && rec.Status != q.Status:
+		return false
+	case !q.Since.IsZero() && rec.Finished.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !rec.Finished.Before(q.Until):
+		return false
+	default:
+		return true
+	}
+}
+
+// parseJobQuery parses a query from URL parameters.
+// Times are in RFC 3339 format.
+func parseJobQuery(v url.Values) (JobQuery, error) {
+	q := JobQuery{
+		Tenant:    v.Get("tenant"),
+		Principal: v.Get("principal"),
+		Language:  v.Get("lang"),
+		Status:    v.Get("status"),
+		Limit:     100,
+	}
+	var err error
+	if s := v.Get("since"); s != "" {
+		q.Since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return JobQuery{}, err
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		q.Until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return JobQuery{}, err
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil {
+			return JobQuery{}, err
+		}
+	}
+	return q, nil
+}
+
+// JobHistory is a persistent history of completed run sessions, stored as a file of JSON records.
+// A nil JobHistory discards all records.
+type JobHistory struct {
+	// Path is the path of the history file.
+	Path string
+
+	// MaxOutput is the maximum number of output bytes kept in each record.
+	MaxOutput int
+
+	// Retention is the retention policy applied by the cleaner.
+	// If nil, records are kept forever.
+	Retention *Retention
+
+	lck     sync.Mutex
+	records []JobRecord
+	f       *os.File
+}
+
+// OpenJobHistory opens a history file, loading the existing records.
+func OpenJobHistory(path string, maxOutput int) (*JobHistory, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	jh := &JobHistory{Path: path, MaxOutput: maxOutput, f: f}
+
+	// load records
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<24)
+	for sc.Scan() {
+		var rec JobRecord
+		if json.Unmarshal(sc.Bytes(), &rec) == nil {
+			jh.records = append(jh.records, rec)
+		}
+	}
+	err = sc.Err()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return jh, nil
+}
+
+// Add appends a record to the history.
+func (jh *JobHistory) Add(rec JobRecord) error {
+	if jh == nil {
+		return nil
+	}
+	if len(rec.Output) > jh.MaxOutput {
+		rec.Output = rec.Output[:jh.MaxOutput]
+		rec.Truncated = true
+	}
+	dat, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	jh.lck.Lock()
+	defer jh.lck.Unlock()
+	_, err = jh.f.Write(append(dat, '\n'))
+	if err != nil {
+		return err
+	}
+	jh.records = append(jh.records, rec)
+	return nil
+}
+
+// Query returns the records matching a query, newest first.
+func (jh *JobHistory) Query(q JobQuery) []JobRecord {
+	jh.lck.Lock()
+	defer jh.lck.Unlock()
+	res := []JobRecord{}
+	for i := len(jh.records) - 1; i >= 0 && (q.Limit <= 0 || len(res) < q.Limit); i-- {
+		if q.matches(jh.records[i]) {
+			res = append(res, jh.records[i])
+		}
+	}
+	return res
+}
+
+// Clean deletes the records which are expired under the retention policy, rewriting the history file.
+func (jh *JobHistory) Clean(now time.Time) error {
+	if jh.Retention == nil {
+		return nil
+	}
+	jh.lck.Lock()
+	defer jh.lck.Unlock()
+
+	// select expired records
+	items := make([]retainedItem, len(jh.records))
+	for i, rec := range jh.records {
+		items[i] = retainedItem{
+			key:     strconv.Itoa(i),
+			tenant:  rec.Tenant,
+			created: rec.Finished,
+			size:    int64(len(rec.Output)),
+		}
+	}
+	del := jh.Retention.expired(items, now)
+	if len(del) == 0 {
+		return nil
+	}
+	expired := make(map[string]bool, len(del))
+	for _, k := range del {
+		expired[k] = true
+	}
+	var keep []JobRecord
+	for i, rec := range jh.records {
+		if !expired[strconv.Itoa(i)] {
+			keep = append(keep, rec)
+		}
+	}
+
+	// rewrite the file, replacing it atomically
+	tmp := jh.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, rec := range keep {
+		err = enc.Encode(rec)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, jh.Path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// reopen for appending
+	nf, err := os.OpenFile(jh.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	jh.f.Close()
+	jh.f = nf
+	jh.records = keep
+	return nil
+}
+
+// ServeHTTP serves the records matching the query parameters (tenant, lang, status, since, until, limit) as JSON.
+func (jh *JobHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseJobQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jh.Query(q))
+}
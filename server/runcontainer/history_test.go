@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJobHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.jsonl")
+
+	jh, err := OpenJobHistory(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	jh.Add(JobRecord{ID: "a", Tenant: "t1", Language: "go", Status: "exited", Finished: now.Add(-2 * time.Hour), Output: []byte("hello")})
+	jh.Add(JobRecord{ID: "b", Tenant: "t2", Language: "go", Status: "error", Finished: now.Add(-time.Hour)})
+	jh.Add(JobRecord{ID: "c", Tenant: "t1", Language: "bash", Status: "exited", Finished: now})
+
+	// records persist across reopening
+	jh, err = OpenJobHistory(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := []struct {
+		q      JobQuery
+		expect []string
+	}{
+		{q: JobQuery{}, expect: []string{"c", "b", "a"}},
+		{q: JobQuery{Tenant: "t1"}, expect: []string{"c", "a"}},
+		{q: JobQuery{Language: "go", Status: "error"}, expect: []string{"b"}},
+		{q: JobQuery{Since: now.Add(-90 * time.Minute)}, expect: []string{"c", "b"}},
+		{q: JobQuery{Until: now}, expect: []string{"b", "a"}},
+		{q: JobQuery{Limit: 1}, expect: []string{"c"}},
+	}
+	for _, v := range tbl {
+		var got []string
+		for _, rec := range jh.Query(v.q) {
+			got = append(got, rec.ID)
+		}
+		if len(got) != len(v.expect) {
+			t.Errorf("expected %q but got %q", v.expect, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != v.expect[i] {
+				t.Errorf("expected %q but got %q", v.expect, got)
+				break
+			}
+		}
+	}
+
+	// output is truncated
+	if rec := jh.Query(JobQuery{Limit: 0})[2]; string(rec.Output) != "hell" || !rec.Truncated {
+		t.Errorf("expected truncated output %q but got %q", "hell", rec.Output)
+	}
+
+	// expired records are removed from the file
+	jh.Retention = &Retention{Default: RetentionPolicy{MaxAge: 90 * time.Minute}}
+	err = jh.Clean(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jh, err = OpenJobHistory(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(jh.Query(JobQuery{})); n != 2 {
+		t.Errorf("expected 2 records after cleaning but got %d", n)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// idleSessionsClosed counts the sessions closed for inactivity.
+var idleSessionsClosed = &Counter{
+	Name:   "openrepl_idle_sessions_closed_total",
+	Help:   "Number of sessions closed for inactivity.",
+	Labels: []string{"language"},
+}
+
+func init() {
+	metrics.Register(idleSessionsClosed)
+}
+
+// touch records I/O activity of the program.
+func (c *Container) touch(t time.Time) {
+	atomic.StoreInt64(&c.activity, t.UnixNano())
+}
+
+// LastActivity returns the time of the last input or output of the program, or the creation time if there was none.
+func (c *Container) LastActivity() time.Time {
+	if ns := atomic.LoadInt64(&c.activity); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return c.created
+}
+
+// idleCheck determines whether a session last active at the given time should be warned or closed.
+// It also returns the time until the next check is due.
+func idleCheck(last time.Time, now time.Time, timeout time.Duration, warning time.Duration, warned bool) (warn bool, expired bool, next time.Duration) {
+	idle := now.Sub(last)
+	switch {
+	case idle >= timeout:
+		return false, true, 0
+	case warning <= 0 || warned:
+		return false, false, timeout - idle
+	case idle >= timeout-warning:
+		return true, false, timeout - idle
+	default:
+		return false, false, timeout - warning - idle
+	}
+}
+
+// watchIdle closes the session once its program has had no input or output for the timeout, warning the client beforehand.
+func (cs *ContainerSession) watchIdle(ctx context.Context, timeout time.Duration, warning time.Duration) {
+	cs.Container.touch(time.Now())
+	var warnedAt time.Time
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		// activity since the warning cancels it
+		now, last := time.Now(), cs.Container.LastActivity()
+		if !warnedAt.IsZero() && last.After(warnedAt) {
+			warnedAt = time.Time{}
+		}
+
+		warn, expired, next := idleCheck(last, now, timeout, warning, !warnedAt.IsZero())
+		if expired {
+			msg := fmt.Sprintf("session closed after %v of inactivity", timeout)
+			cs.Events.Record("idle", msg)
+			idleSessionsClosed.Add(1, cs.ContainerConfig.Language)
+			cs.UpdateStatus(StatusUpdate{Status: "idle", Error: msg, Code: codeIdleTimeout})
+			cs.Close()
+			return
+		}
+		if warn {
+			warnedAt = now
+			err := cs.UpdateStatus(StatusUpdate{
+				Status:  "warning",
+				Message: fmt.Sprintf("session will be closed in %v due to inactivity", next.Round(time.Second)),
+				Code:    codeIdleTimeout,
+			})
+			if err != nil {
+				return
+			}
+		}
+		timer.Reset(next)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleCheck(t *testing.T) {
+	last := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	tbl := []struct {
+		idle    time.Duration
+		warning time.Duration
+		warned  bool
+		warn    bool
+		expired bool
+		next    time.Duration
+	}{
+		{0, time.Minute, false, false, false, 9 * time.Minute},
+		{5 * time.Minute, time.Minute, false, false, false, 4 * time.Minute},
+		{9 * time.Minute, time.Minute, false, true, false, time.Minute},
+		{9*time.Minute + 30*time.Second, time.Minute, true, false, false, 30 * time.Second},
+		{10 * time.Minute, time.Minute, true, false, true, 0},
+		{5 * time.Minute, 0, false, false, false, 5 * time.Minute},
+		{11 * time.Minute, 0, false, false, true, 0},
+	}
+	for _, v := range tbl {
+		warn, expired, next := idleCheck(last, last.Add(v.idle), 10*time.Minute, v.warning, v.warned)
+		if warn != v.warn || expired != v.expired || next != v.next {
+			t.Errorf("idle %v (warning %v, warned %v): expected %v %v %v but got %v %v %v",
+				v.idle, v.warning, v.warned, v.warn, v.expired, v.next, warn, expired, next)
+		}
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	created := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := &Container{created: created}
+	if !c.LastActivity().Equal(created) {
+		t.Errorf("expected creation time but got %v", c.LastActivity())
+	}
+	c.touch(created.Add(time.Minute))
+	if !c.LastActivity().Equal(created.Add(time.Minute)) {
+		t.Errorf("expected touched time but got %v", c.LastActivity())
+	}
+}
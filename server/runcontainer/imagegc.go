@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// ImageGC removes language images which are no longer referenced by the configuration.
+// A nil ImageGC never removes images.
+type ImageGC struct {
+	// Client is the client of the Docker daemon holding the images.
+	Client *client.Client
+
+	// Prefix is the repository prefix (e.g. "openrepl/") of the images managed by the collector.
+	Prefix string
+
+	// Dangling is whether untagged images are also collected.
+	Dangling bool
+
+	// MaxUnused is the amount of time for which an unreferenced image must be unused before it is removed.
+	MaxUnused time.Duration
+
+	// Referenced is the list of images referenced by the configuration, which are never removed.
+	Referenced []string
+
+	lck  sync.Mutex
+	used map[string]time.Time
+}
+
+// ImageGCCandidate is an image which is removed by the collector.
+type ImageGCCandidate struct {
+	ID       string    `json:"id"`
+	Tags     []string  `json:"tags,omitempty"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// normalizeImageRef adds the implicit "latest" tag to an image reference.
+func normalizeImageRef(ref string) string {
+	if strings.Contains(ref, "@") {
+		return ref
+	}
+	if strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		return ref
+	}
+	return ref + ":latest"
+}
+
+// languageImages returns the images used by the languages, mapped to the names of the languages using them.
+func languageImages(langs map[string]Language) map[string][]string {
+	users := make(map[string][]string)
+	for name, lang := range langs {
+		imgs := []string{lang.RunContainer.Image, lang.TermContainer.Image, lang.RunContainer.FallbackImage, lang.TermContainer.FallbackImage}
+		for _, v := range lang.Versions {
+			imgs = append(imgs, v.Image, v.TermImage)
+		}
+		for _, img := range imgs {
+			if img != "" && !inList(name, users[img]) {
+				users[img] = append(users[img], name)
+			}
+		}
+	}
+	for _, names := range users {
+		sort.Strings(names)
+	}
+	return users
+}
+
+// manages checks whether an image is managed by the collector.
+func (gc *ImageGC) manages(img types.ImageSummary) bool {
+	refs := append(append([]string(nil), img.RepoTags...), img.RepoDigests...)
+	tagged := false
+	for _, ref := range refs {
+		if ref == "<none>:<none>" || ref == "<none>@<none>" {
+			continue
+		}
+		tagged = true
+		if strings.HasPrefix(ref, gc.Prefix) {
+			return true
+		}
+	}
+	return !tagged && gc.Dangling
+}
+
+// SetReferenced replaces the list of images referenced by the configuration.
+func (gc *ImageGC) SetReferenced(refs []string) {
+	if gc == nil {
+		return
+	}
+	gc.lck.Lock()
+	defer gc.lck.Unlock()
+	gc.Referenced = refs
+}
+
+// referenced checks whether an image is referenced by the configuration.
+func (gc *ImageGC) referenced(img types.ImageSummary) bool {
+	for _, ref := range gc.Referenced {
+		ref = normalizeImageRef(ref)
+		if inList(ref, img.RepoTags) || inList(ref, img.RepoDigests) || ref == img.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// Plan finds the images which would be removed by the collector.
+// Images used by containers (including stopped containers) are marked as used.
+func (gc *ImageGC) Plan(ctx context.Context, now time.Time) ([]ImageGCCandidate, error) {
+	images, err := gc.Client.ImageList(ctx, types.ImageListOptions{All: false})
+	if err != nil {
+		return nil, err
+	}
+	containers, err := gc.Client.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	gc.lck.Lock()
+	defer gc.lck.Unlock()
+	if gc.used == nil {
+		gc.used = make(map[string]time.Time)
+	}
+
+	// mark images of containers as used
+	for _, c := range containers {
+		gc.used[c.ImageID] = now
+	}
+
+	// select unreferenced images which have not been used recently
+	var plan []ImageGCCandidate
+	for _, img := range images {
+		if !gc.manages(img) || gc.referenced(img) {
+			continue
+		}
+		last, ok := gc.used[img.ID]
+		if !ok {
+			// the image has not been seen before, so start counting from now
+			gc.used[img.ID] = now
+			last = now
+		}
+		if now.Sub(last) < gc.MaxUnused {
+			continue
+		}
+		plan = append(plan, ImageGCCandidate{
+			ID:       img.ID,
+			Tags:     img.RepoTags,
+			Size:     img.Size,
+			LastUsed: last,
+		})
+	}
+	return plan, nil
+}
+
+// Collect removes the images selected by Plan.
+func (gc *ImageGC) Collect(ctx context.Context, now time.Time) error {
+	plan, err := gc.Plan(ctx, now)
+	if err != nil {
+		return err
+	}
+	for _, img := range plan {
+		_, err := gc.Client.ImageRemove(ctx, img.ID, types.ImageRemoveOptions{PruneChildren: true})
+		if err != nil {
+			serverLog.Errorf("failed to remove image %s: %s", img.ID, err.Error())
+			continue
+		}
+		serverLog.Printf("removed unused image %s %v", img.ID, img.Tags)
+		gc.lck.Lock()
+		delete(gc.used, img.ID)
+		gc.lck.Unlock()
+	}
+	return nil
+}
+
+// Run periodically collects unused images.
+func (gc *ImageGC) Run(interval time.Duration) {
+	if gc == nil {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for now := range tick.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := gc.Collect(ctx, now)
+		cancel()
+		if err != nil {
+			serverLog.Errorf("failed to collect images: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestNormalizeImageRef(t *testing.T) {
+	tbl := []struct {
+		ref    string
+		expect string
+	}{
+		{ref: "openrepl/python3", expect: "openrepl/python3:latest"},
+		{ref: "openrepl/python3:v2", expect: "openrepl/python3:v2"},
+		{ref: "registry:5000/openrepl/bash", expect: "registry:5000/openrepl/bash:latest"},
+		{ref: "openrepl/bash@sha256:abcd", expect: "openrepl/bash@sha256:abcd"},
+	}
+	for _, v := range tbl {
+		got := normalizeImageRef(v.ref)
+		if got != v.expect {
+			t.Errorf("expected %q but got %q", v.expect, got)
+		}
+	}
+}
+
+func TestImageGCSelection(t *testing.T) {
+	gc := &ImageGC{
+		Prefix:     "openrepl/",
+		Referenced: []string{"openrepl/python3"},
+	}
+	tbl := []struct {
+		img     types.ImageSummary
+		collect bool
+	}{
+		{img: types.ImageSummary{RepoTags: []string{"openrepl/python3:latest"}}, collect: false},
+		{img: types.ImageSummary{RepoTags: []string{"openrepl/python2:latest"}}, collect: true},
+		{img: types.ImageSummary{RepoTags: []string{"postgres:10"}}, collect: false},
+		{img: types.ImageSummary{RepoTags: []string{"<none>:<none>"}}, collect: false},
+	}
+	for _, v := range tbl {
+		got := gc.manages(v.img) && !gc.referenced(v.img)
+		if got != v.collect {
+			t.Errorf("expected collection of %v to be %v", v.img.RepoTags, v.collect)
+		}
+	}
+}
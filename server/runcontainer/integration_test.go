@@ -0,0 +1,227 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/openrepl/server/client"
+)
+
+// canonicalPrograms is a program for each language which prints integrationOutput.
+var canonicalPrograms = map[string]string{
+	"lua":        `print("hello openrepl")`,
+	"bash":       `echo hello openrepl`,
+	"cpp":        "#include <iostream>\nint main() { std::cout << \"hello openrepl\" << std::endl; }\n",
+	"forth":      `.( hello openrepl) cr bye`,
+	"javascript": `console.log("hello openrepl");`,
+	"typescript": `console.log("hello openrepl");`,
+	"python2":    `print "hello openrepl"`,
+	"python3":    `print("hello openrepl")`,
+	"php":        "<?php echo \"hello openrepl\\n\";",
+	"golang":     "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"hello openrepl\") }\n",
+	"haskell":    `main = putStrLn "hello openrepl"`,
+	"powershell": `Write-Output "hello openrepl"`,
+	"sqlite3":    `SELECT 'hello openrepl';`,
+	"psql":       `SELECT 'hello openrepl';`,
+}
+
+// integrationOutput is the output expected from every canonical program.
+const integrationOutput = "hello openrepl"
+
+// integrationTimeout is the maximum duration of a session in the integration tests.
+const integrationTimeout = 2 * time.Minute
+
+// newIntegrationServer starts a server running the configured languages against the Docker daemon from the environment.
+func newIntegrationServer(t *testing.T) (*ContainerServer, *httptest.Server) {
+	dcli, err := DockerConfig{}.NewClient()
+	if err != nil {
+		t.Fatalf("failed to create docker client: %s", err.Error())
+	}
+	info, err := dcli.Info(context.Background())
+	if err != nil {
+		t.Fatalf("failed to connect to docker daemon: %s", err.Error())
+	}
+
+	langs, err := loadLanguages("langs.json", info.OSType, ContainerDefaults{
+		LogDriver: "none",
+		TmpfsSize: "64m",
+	})
+	if err != nil {
+		t.Fatalf("failed to load languages: %s", err.Error())
+	}
+
+	srv := &ContainerServer{
+		SessionConfig: ContainerSessionConfig{
+			OutputBufferSize:     1024,
+			ShutdownTimeout:      10 * time.Second,
+			DockerClient:         dcli,
+			ContainerStopTimeout: 10 * time.Second,
+			StartTimeout:         time.Minute,
+			SessionTimeout:       integrationTimeout,
+			PingRate:             30 * time.Second,
+			DaemonOS:             info.OSType,
+			DaemonArch:           normalizeArch(info.Architecture),
+			Artifacts:            &ArtifactStore{TTL: time.Minute},
+			EventLogs:            &EventLogStore{Max: 100},
+			Sessions:             &SessionRegistry{},
+		},
+		Containers: langs,
+		Locales:    []string{"C.UTF-8"},
+		Timezones:  []string{"UTC"},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run", srv.HandleRun)
+	mux.HandleFunc("/term", srv.HandleTerminal)
+	mux.HandleFunc("/languages", srv.HandleLanguages)
+	return srv, httptest.NewServer(mux)
+}
+
+// runIntegrationSession runs code in a session of the given language, returning the output.
+func runIntegrationSession(t *testing.T, hs *httptest.Server, lang string, code string) string {
+	u, err := url.Parse(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Scheme = "ws"
+	u.Path = "/run"
+	u.RawQuery = url.Values{"lang": {lang}}.Encode()
+
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(integrationTimeout))
+
+	// run through the startup statuses
+	for running := false; !running; {
+		var su StatusUpdate
+		err = ws.ReadJSON(&su)
+		if err != nil {
+			t.Fatalf("failed to read status: %s", err.Error())
+		}
+		switch su.Status {
+		case "ready":
+			err = ws.WriteMessage(websocket.TextMessage, []byte(code))
+			if err != nil {
+				t.Fatalf("failed to send code: %s", err.Error())
+			}
+		case "running":
+			running = true
+		case "error", "capacity":
+			t.Fatalf("session failed with status %q: %s", su.Status, su.Error)
+		}
+	}
+
+	// collect output until the session is closed
+	var out bytes.Buffer
+	for {
+		_, dat, err := ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("session ended abnormally: %s", err.Error())
+			}
+			break
+		}
+		var su StatusUpdate
+		if json.Unmarshal(dat, &su) == nil && su.Status != "" {
+			continue
+		}
+		out.Write(dat)
+	}
+	return out.String()
+}
+
+func TestIntegrationLanguages(t *testing.T) {
+	srv, hs := newIntegrationServer(t)
+	defer hs.Close()
+
+	// the group only returns once all of the parallel sessions have finished
+	t.Run("run", func(t *testing.T) {
+		for name := range srv.Containers {
+			name := name
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+				code, ok := canonicalPrograms[name]
+				if !ok {
+					t.Fatalf("no canonical program for %s", name)
+				}
+				out := runIntegrationSession(t, hs, name, code)
+				if !strings.Contains(out, integrationOutput) {
+					t.Errorf("expected output containing %q but got %q", integrationOutput, out)
+				}
+			})
+		}
+	})
+}
+
+func TestIntegrationClient(t *testing.T) {
+	srv, hs := newIntegrationServer(t)
+	defer hs.Close()
+	if _, ok := srv.Containers["python3"]; !ok {
+		t.Skip("python3 is not configured")
+	}
+	c := &client.Client{URL: hs.URL}
+	ctx, cancel := context.WithTimeout(context.Background(), integrationTimeout)
+	defer cancel()
+
+	t.Run("languages", func(t *testing.T) {
+		langs, err := c.Languages(ctx)
+		if err != nil {
+			t.Fatalf("failed to list languages: %s", err.Error())
+		}
+		if len(langs) != len(srv.Containers) {
+			t.Errorf("expected %d languages but got %d", len(srv.Containers), len(langs))
+		}
+	})
+
+	t.Run("run", func(t *testing.T) {
+		code := "import sys\nname = input()\nprint('hello', name)\nprint('bye', file=sys.stderr)\nsys.exit(3)\n"
+		var stdout, stderr bytes.Buffer
+		res, err := c.RunCode(ctx, client.Options{Lang: "python3", Streams: true}, []byte(code), strings.NewReader("openrepl\n"), &stdout, &stderr)
+		if err != nil {
+			t.Fatalf("run failed: %s", err.Error())
+		}
+		if !strings.Contains(stdout.String(), integrationOutput) || !strings.Contains(stderr.String(), "bye") {
+			t.Errorf("unexpected output %q and %q", stdout.String(), stderr.String())
+		}
+		if res.ExitCode == nil || *res.ExitCode != 3 || res.Session == "" {
+			t.Errorf("unexpected result %+v", res)
+		}
+	})
+
+	t.Run("term", func(t *testing.T) {
+		s, err := c.Terminal(ctx, client.Options{Lang: "python3"})
+		if err != nil {
+			t.Fatalf("failed to start terminal: %s", err.Error())
+		}
+		defer s.Close()
+		err = s.Resize(80, 24)
+		if err != nil {
+			t.Fatalf("failed to resize: %s", err.Error())
+		}
+		_, err = s.Write([]byte("print('hello', 'openrepl')\nexit()\n"))
+		if err != nil {
+			t.Fatalf("failed to write input: %s", err.Error())
+		}
+		var out bytes.Buffer
+		err = s.Stream(&out, &out, nil)
+		if err != nil {
+			t.Fatalf("session ended abnormally: %s", err.Error())
+		}
+		if !strings.Contains(out.String(), integrationOutput) {
+			t.Errorf("expected output containing %q but got %q", integrationOutput, out.String())
+		}
+	})
+}
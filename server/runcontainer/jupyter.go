@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jupyterProtocolVersion is the version of the Jupyter messaging protocol spoken on kernel channels.
+const jupyterProtocolVersion = "5.3"
+
+// jupyterKernel is the state of a Jupyter kernel backed by an HTTP eval session.
+type jupyterKernel struct {
+	name string
+
+	lck         sync.Mutex
+	executions  int
+	connections int
+	busy        bool
+	activity    time.Time
+}
+
+// JupyterKernel is the model of a kernel in the kernel gateway API.
+type JupyterKernel struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	LastActivity   string `json:"last_activity"`
+	ExecutionState string `json:"execution_state"`
+	Connections    int    `json:"connections"`
+}
+
+// model returns the API model of the kernel with the given ID.
+func (k *jupyterKernel) model(id string) JupyterKernel {
+	k.lck.Lock()
+	defer k.lck.Unlock()
+	state := "idle"
+	if k.busy {
+		state = "busy"
+	}
+	return JupyterKernel{
+		ID:             id,
+		Name:           k.name,
+		LastActivity:   k.activity.UTC().Format(time.RFC3339Nano),
+		ExecutionState: state,
+		Connections:    k.connections,
+	}
+}
+
+// attach adds delta to the number of connected channels, returning the new number.
+func (k *jupyterKernel) attach(delta int) int {
+	k.lck.Lock()
+	defer k.lck.Unlock()
+	k.connections += delta
+	return k.connections
+}
+
+// execute marks the kernel busy, returning the execution count of the new execution.
+func (k *jupyterKernel) execute() int {
+	k.lck.Lock()
+	defer k.lck.Unlock()
+	k.executions++
+	k.busy, k.activity = true, time.Now()
+	return k.executions
+}
+
+// idle marks the kernel idle after an execution.
+func (k *jupyterKernel) idle() {
+	k.lck.Lock()
+	defer k.lck.Unlock()
+	k.busy, k.activity = false, time.Now()
+}
+
+// jupyterKernelKey is the context key of the kernel created by a kernel gateway request.
+type jupyterKernelKey struct{}
+
+// kernels returns the connections of the running Jupyter kernels of a principal, sorted by ID.
+func (es *EvalSessionStore) kernels(principal string) []*evalConn {
+	es.lck.Lock()
+	defer es.lck.Unlock()
+	var conns []*evalConn
+	for _, ec := range es.conns {
+		if ec.kernel != nil && ec.principal == principal && !ec.closed() {
+			conns = append(conns, ec)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].token < conns[j].token })
+	return conns
+}
+
+// JupyterKernelSpec describes a kernel which may be started, in the kernelspec format.
+type JupyterKernelSpec struct {
+	Name      string                 `json:"name"`
+	Spec      JupyterKernelSpecInfo  `json:"spec"`
+	Resources map[string]interface{} `json:"resources"`
+}
+
+// JupyterKernelSpecInfo is the content of a kernel.json file.
+type JupyterKernelSpecInfo struct {
+	Language    string            `json:"language"`
+	DisplayName string            `json:"display_name"`
+	Argv        []string          `json:"argv"`
+	Env         map[string]string `json:"env"`
+}
+
+// kernelSpecs returns the kernel specs of the languages which support the eval protocol, and the name of the default kernel.
+func kernelSpecs(langs map[string]Language) (map[string]JupyterKernelSpec, string) {
+	specs := make(map[string]JupyterKernelSpec)
+	var names []string
+	for name, lang := range langs {
+		if lang.TermContainer.Eval == nil {
+			continue
+		}
+		display := lang.DisplayName
+		if display == "" {
+			display = name
+		}
+		specs[name] = JupyterKernelSpec{
+			Name:      name,
+			Spec:      JupyterKernelSpecInfo{Language: name, DisplayName: display, Argv: []string{}, Env: map[string]string{}},
+			Resources: map[string]interface{}{},
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	def := ""
+	if _, ok := specs["python3"]; ok {
+		def = "python3"
+	} else if len(names) > 0 {
+		def = names[0]
+	}
+	return specs, def
+}
+
+// HandleJupyterKernelSpecs lists the available kernels in the format of the kernel gateway.
+func (cs *ContainerServer) HandleJupyterKernelSpecs(w http.ResponseWriter, r *http.Request) {
+	specs, def := kernelSpecs(cs.languages())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Default     string                       `json:"default"`
+		KernelSpecs map[string]JupyterKernelSpec `json:"kernelspecs"`
+	}{def, specs})
+}
+
+// HandleJupyterKernels serves the kernels API of the Jupyter kernel gateway, so that notebook frontends can use languages as kernels.
+// Kernels are HTTP eval sessions, and their channels translate Jupyter messages to evaluations.
+// Clients only see and use the kernels which they started.
+func (cs *ContainerServer) HandleJupyterKernels(w http.ResponseWriter, r *http.Request) {
+	es := cs.SessionConfig.EvalSessions
+	if es == nil {
+		http.Error(w, "Jupyter kernels not available", http.StatusNotImplemented)
+		return
+	}
+	p, _ := requestPrincipal(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/kernels"), "/"), "/")
+
+	// list and start kernels
+	if parts[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			models := []JupyterKernel{}
+			for _, ec := range es.kernels(p.ID) {
+				models = append(models, ec.kernel.model(ec.token))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(models)
+		case http.MethodPost:
+			cs.rejectDraining(cs.limitClients(cs.startKernel))(w, r)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	ec := es.Get(parts[0])
+	if ec == nil || ec.kernel == nil || ec.principal != p.ID || ec.closed() {
+		http.Error(w, "kernel not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ec.kernel.model(ec.token))
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		ec.Close()
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "channels":
+		cs.serveKernelChannels(w, r, ec)
+	case len(parts) == 2 && (parts[1] == "interrupt" || parts[1] == "restart"):
+		http.Error(w, "kernels cannot be "+parts[1]+"ed", http.StatusNotImplemented)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// startKernel starts the kernel named in the body of a POST request as an HTTP eval session, responding with its model once it is running.
+func (cs *ContainerServer) startKernel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, maxEvalRequest)).Decode(&req)
+	if err != nil && err != io.EOF {
+		http.Error(w, "invalid kernel request", http.StatusBadRequest)
+		return
+	}
+	specs, def := kernelSpecs(cs.languages())
+	if req.Name == "" {
+		req.Name = def
+	}
+	if _, ok := specs[req.Name]; !ok {
+		http.Error(w, "no such kernel "+req.Name, http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	q.Set("lang", req.Name)
+	q.Set("eval", "true")
+	q.Set("transport", "http")
+	r.URL.RawQuery = q.Encode()
+	k := &jupyterKernel{name: req.Name, activity: time.Now()}
+	r = r.WithContext(context.WithValue(r.Context(), jupyterKernelKey{}, k))
+	cs.serveSession(w, r, false)
+}
+
+// JupyterHeader is the header of a Jupyter message.
+type JupyterHeader struct {
+	MsgID    string `json:"msg_id"`
+	Session  string `json:"session"`
+	Username string `json:"username"`
+	Date     string `json:"date"`
+	MsgType  string `json:"msg_type"`
+	Version  string `json:"version"`
+}
+
+// JupyterMessage is a Jupyter message sent over the channels websocket of a kernel, tagged with its channel.
+type JupyterMessage struct {
+	Header       JupyterHeader   `json:"header"`
+	ParentHeader json.RawMessage `json:"parent_header"`
+	Metadata     json.RawMessage `json:"metadata"`
+	Content      json.RawMessage `json:"content"`
+	Channel      string          `json:"channel"`
+}
+
+// kernelChannel is a channels websocket of a kernel.
+type kernelChannel struct {
+	conn   ClientConn
+	ec     *evalConn
+	parent *JupyterMessage
+}
+
+// send sends a message in reply to the request being handled.
+func (kc *kernelChannel) send(channel string, msgType string, content interface{}) error {
+	id, err := randomID()
+	if err != nil {
+		return err
+	}
+	parent, err := json.Marshal(kc.parent.Header)
+	if err != nil {
+		return err
+	}
+	cdat, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	return kc.conn.WriteJSON(JupyterMessage{
+		Header: JupyterHeader{
+			MsgID:    id,
+			Session:  kc.parent.Header.Session,
+			Username: kc.parent.Header.Username,
+			Date:     time.Now().UTC().Format(time.RFC3339Nano),
+			MsgType:  msgType,
+			Version:  jupyterProtocolVersion,
+		},
+		ParentHeader: parent,
+		Metadata:     json.RawMessage("{}"),
+		Content:      cdat,
+		Channel:      channel,
+	})
+}
+
+// status publishes the execution state of the kernel.
+func (kc *kernelChannel) status(state string) error {
+	return kc.send("iopub", "status", map[string]string{"execution_state": state})
+}
+
+// serveKernelChannels serves the channels websocket of a kernel until the client disconnects or the kernel ends.
+// The session is kept alive while any channel is connected.
+func (cs *ContainerServer) serveKernelChannels(w http.ResponseWriter, r *http.Request, ec *evalConn) {
+	ws, err := cs.SessionConfig.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := newDeadlineConn(ws, 0, cs.SessionConfig.WriteTimeout, cs.SessionConfig.MaxMessageSize)
+	defer conn.Close()
+
+	es := cs.SessionConfig.EvalSessions
+	ec.kernel.attach(1)
+	ec.stopIdle()
+	defer func() {
+		if ec.kernel.attach(-1) == 0 {
+			ec.watchIdle(es.IdleTimeout)
+		}
+	}()
+
+	// close the websocket when the kernel ends
+	stopch := make(chan struct{})
+	defer close(stopch)
+	go func() {
+		select {
+		case <-ec.hangup:
+			conn.Close()
+		case <-stopch:
+		}
+	}()
+
+	lang := cs.languages()[ec.kernel.name]
+	for {
+		_, dat, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg JupyterMessage
+		if json.Unmarshal(dat, &msg) != nil {
+			continue
+		}
+		kc := &kernelChannel{conn: conn, ec: ec, parent: &msg}
+		err = kc.handle(r.Context(), lang)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// errKernelShutdown is returned after handling a shutdown request.
+var errKernelShutdown = errors.New("kernel shut down")
+
+// handle handles a request received on a channel of the kernel.
+// Requests which the kernel does not support are ignored.
+func (kc *kernelChannel) handle(ctx context.Context, lang Language) error {
+	reply := kc.parent.Header.MsgType
+	if strings.HasSuffix(reply, "_request") {
+		reply = strings.TrimSuffix(reply, "_request") + "_reply"
+	}
+	channel := kc.parent.Channel
+	if channel == "" {
+		channel = "shell"
+	}
+
+	switch kc.parent.Header.MsgType {
+	case "kernel_info_request":
+		err := kc.status("busy")
+		if err != nil {
+			return err
+		}
+		err = kc.send(channel, reply, map[string]interface{}{
+			"status":                 "ok",
+			"protocol_version":       jupyterProtocolVersion,
+			"implementation":         "openrepl",
+			"implementation_version": version,
+			"language_info":          map[string]string{"name": kc.ec.kernel.name, "version": lang.Version, "file_extension": lang.Extension},
+			"banner":                 "",
+		})
+		if err != nil {
+			return err
+		}
+		return kc.status("idle")
+	case "execute_request":
+		return kc.execute(ctx, channel, reply)
+	case "comm_info_request":
+		return kc.send(channel, reply, map[string]interface{}{"status": "ok", "comms": map[string]interface{}{}})
+	case "is_complete_request":
+		return kc.send(channel, reply, map[string]string{"status": "unknown"})
+	case "shutdown_request":
+		err := kc.send(channel, reply, map[string]interface{}{"status": "ok", "restart": false})
+		kc.ec.Close()
+		if err != nil {
+			return err
+		}
+		return errKernelShutdown
+	default:
+		return nil
+	}
+}
+
+// execute evaluates the code of an execute request, publishing its outputs.
+func (kc *kernelChannel) execute(ctx context.Context, channel string, reply string) error {
+	var req struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(kc.parent.Content, &req)
+
+	k := kc.ec.kernel
+	count := k.execute()
+	defer k.idle()
+	err := kc.status("busy")
+	if err != nil {
+		return err
+	}
+	err = kc.send("iopub", "execute_input", map[string]interface{}{"code": req.Code, "execution_count": count})
+	if err != nil {
+		return err
+	}
+
+	// evaluate, ending the channel if the kernel died
+	res, everr := kc.ec.eval(ctx, EvalRequest{Code: req.Code})
+	if everr != nil {
+		res.Error = everr.Error()
+	}
+
+	// publish outputs
+	for _, s := range []struct{ name, text string }{{"stdout", res.Stdout}, {"stderr", res.Stderr}} {
+		if s.text == "" {
+			continue
+		}
+		err = kc.send("iopub", "stream", map[string]string{"name": s.name, "text": s.text})
+		if err != nil {
+			return err
+		}
+	}
+	if res.Value != "" {
+		err = kc.send("iopub", "execute_result", map[string]interface{}{
+			"execution_count": count,
+			"data":            map[string]string{"text/plain": res.Value},
+			"metadata":        map[string]interface{}{},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	content := map[string]interface{}{"status": "ok", "execution_count": count, "user_expressions": map[string]interface{}{}, "payload": []interface{}{}}
+	if res.Error != "" {
+		errContent := map[string]interface{}{"ename": "Error", "evalue": res.Error, "traceback": []string{res.Error}}
+		err = kc.send("iopub", "error", errContent)
+		if err != nil {
+			return err
+		}
+		content = errContent
+		content["status"], content["execution_count"] = "error", count
+	}
+	err = kc.send(channel, reply, content)
+	if err != nil {
+		return err
+	}
+	err = kc.status("idle")
+	if err == nil {
+		err = everr
+	}
+	return err
+}
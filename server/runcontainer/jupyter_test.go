@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestKernelSpecs(t *testing.T) {
+	specs, def := kernelSpecs(map[string]Language{
+		"bash":    {},
+		"julia":   {TermContainer: ContainerConfig{Eval: &EvalConfig{Command: []string{"julia"}}}},
+		"python3": {DisplayName: "Python 3", TermContainer: ContainerConfig{Eval: &EvalConfig{Command: []string{"python"}}}},
+	})
+	if len(specs) != 2 || def != "python3" || specs["python3"].Spec.DisplayName != "Python 3" || specs["julia"].Spec.DisplayName != "julia" {
+		t.Errorf("unexpected kernel specs %+v (default %q)", specs, def)
+	}
+}
+
+func TestJupyterKernelChannels(t *testing.T) {
+	es := &EvalSessionStore{}
+	ec, _ := es.New(&jupyterKernel{name: "python3"}, "")
+	defer ec.Close()
+
+	// simulate a session evaluating code
+	go func() {
+		for {
+			_, dat, err := ec.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req EvalRequest
+			json.Unmarshal(dat, &req)
+			res := EvalResult{ID: req.ID, Stdout: "hi\n", Value: "2"}
+			if req.Code == "fail" {
+				res = EvalResult{ID: req.ID, Error: "NameError: fail"}
+			}
+			ec.WriteJSON(res)
+		}
+	}()
+
+	cs := &ContainerServer{}
+	cs.SessionConfig.EvalSessions = es
+	cs.Containers = map[string]Language{"python3": {Extension: ".py"}}
+	srv := httptest.NewServer(http.HandlerFunc(cs.HandleJupyterKernels))
+	defer srv.Close()
+
+	// the kernel is listed
+	resp, err := http.Get(srv.URL + "/api/kernels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var models []JupyterKernel
+	json.NewDecoder(resp.Body).Decode(&models)
+	resp.Body.Close()
+	if len(models) != 1 || models[0].ID != ec.token || models[0].Name != "python3" || models[0].ExecutionState != "idle" {
+		t.Fatalf("unexpected kernels %+v", models)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/kernels/"+ec.token+"/channels", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// execute cells, collecting the messages up to the reply
+	execute := func(code string) []JupyterMessage {
+		content, _ := json.Marshal(map[string]string{"code": code})
+		err := ws.WriteJSON(JupyterMessage{
+			Header:  JupyterHeader{MsgID: "m1", Session: "s1", MsgType: "execute_request", Version: "5.3"},
+			Content: content,
+			Channel: "shell",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgs []JupyterMessage
+		for {
+			var msg JupyterMessage
+			err := ws.ReadJSON(&msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+			if msg.Header.MsgType == "status" && strings.Contains(string(msg.Content), "idle") {
+				return msgs
+			}
+		}
+	}
+	msgs := execute("print('hi'); 1+1")
+	var types []string
+	for _, msg := range msgs {
+		types = append(types, msg.Channel+":"+msg.Header.MsgType)
+		var parent JupyterHeader
+		json.Unmarshal(msg.ParentHeader, &parent)
+		if parent.MsgID != "m1" || msg.Header.Session != "s1" {
+			t.Errorf("message %s is not a reply to the request", msg.Header.MsgType)
+		}
+	}
+	expect := "iopub:status iopub:execute_input iopub:stream iopub:execute_result shell:execute_reply iopub:status"
+	if strings.Join(types, " ") != expect {
+		t.Errorf("expected messages %s but got %s", expect, strings.Join(types, " "))
+	}
+	var reply struct {
+		Status         string `json:"status"`
+		ExecutionCount int    `json:"execution_count"`
+	}
+	json.Unmarshal(msgs[4].Content, &reply)
+	if reply.Status != "ok" || reply.ExecutionCount != 1 {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+
+	// errors are published and replied with
+	msgs = execute("fail")
+	if len(msgs) != 5 || msgs[2].Header.MsgType != "error" {
+		t.Fatalf("unexpected messages %+v", msgs)
+	}
+	json.Unmarshal(msgs[3].Content, &reply)
+	if reply.Status != "error" || reply.ExecutionCount != 2 {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+}
+
+func TestJupyterKernelsOwner(t *testing.T) {
+	es := &EvalSessionStore{}
+	ec, _ := es.New(&jupyterKernel{name: "python3"}, "alice")
+	defer ec.Close()
+	cs := &ContainerServer{}
+	cs.SessionConfig.EvalSessions = es
+
+	serve := func(method string, path string, principal string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, Principal{ID: principal}))
+		w := httptest.NewRecorder()
+		cs.HandleJupyterKernels(w, r)
+		return w
+	}
+
+	// other clients neither see nor use the kernel
+	if w := serve(http.MethodGet, "/api/kernels", "bob"); strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("kernel listed for another principal: %s", w.Body.String())
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if w := serve(method, "/api/kernels/"+ec.token, "bob"); w.Code != http.StatusNotFound {
+			t.Errorf("%s of another principal's kernel returned status %d", method, w.Code)
+		}
+	}
+	if w := serve(http.MethodGet, "/api/kernels/"+ec.token+"/channels", "bob"); w.Code != http.StatusNotFound {
+		t.Errorf("channels of another principal's kernel returned status %d", w.Code)
+	}
+	if ec.closed() {
+		t.Fatal("kernel closed by another principal")
+	}
+
+	// its owner does
+	var models []JupyterKernel
+	json.NewDecoder(serve(http.MethodGet, "/api/kernels", "alice").Body).Decode(&models)
+	if len(models) != 1 || models[0].ID != ec.token {
+		t.Errorf("unexpected kernels %+v", models)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// deadlineConn is a websocket connection with read and write timeouts, so that connections which silently died (e.g. behind proxies dropping idle connections) fail instead of blocking sessions forever.
+// The read deadline is extended by every message and pong from the client, so it only expires if the client stops answering pings.
+type deadlineConn struct {
+	*websocket.Conn
+
+	// readTimeout is the time without any message or pong after which reads fail.
+	// If zero, reads have no deadline.
+	readTimeout time.Duration
+
+	// writeTimeout is the time after which blocked writes fail.
+	// If zero, writes have no deadline.
+	writeTimeout time.Duration
+}
+
+// errPayloadTooLarge is returned when a client sends a message exceeding the size limit.
+var errPayloadTooLarge = errors.New("payload too large")
+
+// newDeadlineConn wraps a websocket connection with timeouts, starting the read deadline.
+// Messages larger than maxMessage bytes fail reads with errPayloadTooLarge and close the connection; if zero, messages are unlimited.
+func newDeadlineConn(ws *websocket.Conn, readTimeout time.Duration, writeTimeout time.Duration, maxMessage int64) *deadlineConn {
+	if maxMessage > 0 {
+		ws.SetReadLimit(maxMessage)
+	}
+	dc := &deadlineConn{Conn: ws, readTimeout: readTimeout, writeTimeout: writeTimeout}
+	dc.extendRead()
+	dc.SetPongHandler(nil)
+	return dc
+}
+
+// clientConn wraps the websocket connection of a session client, which is pinged every PingRate and must answer within PongTimeout.
+func (sc *ContainerSessionConfig) clientConn(ws *websocket.Conn) *deadlineConn {
+	var readTimeout time.Duration
+	if sc.PingRate > 0 && sc.PongTimeout > 0 {
+		readTimeout = sc.PingRate + sc.PongTimeout
+	}
+	return newDeadlineConn(ws, readTimeout, sc.WriteTimeout, sc.MaxMessageSize)
+}
+
+// extendRead moves the read deadline to readTimeout from now.
+func (dc *deadlineConn) extendRead() {
+	if dc.readTimeout > 0 {
+		dc.Conn.SetReadDeadline(time.Now().Add(dc.readTimeout))
+	}
+}
+
+// startWrite sets the deadline of the next write.
+// Writes are serialized by the session, so the deadline applies to the write which follows.
+func (dc *deadlineConn) startWrite() {
+	if dc.writeTimeout > 0 {
+		dc.Conn.SetWriteDeadline(time.Now().Add(dc.writeTimeout))
+	}
+}
+
+func (dc *deadlineConn) WriteJSON(v interface{}) error {
+	dc.startWrite()
+	return dc.Conn.WriteJSON(v)
+}
+
+func (dc *deadlineConn) WriteMessage(messageType int, data []byte) error {
+	dc.startWrite()
+	return dc.Conn.WriteMessage(messageType, data)
+}
+
+// ReadMessage reads a message, extending the read deadline.
+// Messages exceeding the read limit of the connection fail with errPayloadTooLarge, after which the connection is closed.
+func (dc *deadlineConn) ReadMessage() (int, []byte, error) {
+	// the limit is checked against the frame header by NextReader, and against the data while it is read
+	t, r, err := dc.NextReader()
+	if err == websocket.ErrReadLimit {
+		return t, nil, errPayloadTooLarge
+	}
+	if err != nil {
+		return t, nil, err
+	}
+	dat, err := ioutil.ReadAll(r)
+	if err == websocket.ErrReadLimit {
+		return t, nil, errPayloadTooLarge
+	}
+	return t, dat, err
+}
+
+func (dc *deadlineConn) NextReader() (int, io.Reader, error) {
+	t, r, err := dc.Conn.NextReader()
+	if err == nil {
+		dc.extendRead()
+	}
+	return t, r, err
+}
+
+// SetPongHandler sets the handler of pongs, which also extend the read deadline.
+func (dc *deadlineConn) SetPongHandler(h func(appData string) error) {
+	dc.Conn.SetPongHandler(func(appData string) error {
+		dc.extendRead()
+		if h == nil {
+			return nil
+		}
+		return h(appData)
+	})
+}
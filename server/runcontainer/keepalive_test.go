@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialDeadlineConn connects a client to a server wrapping its side of the connection in a deadlineConn with the given read timeout.
+func dialDeadlineConn(t *testing.T, readTimeout time.Duration, maxMessage int64) (*deadlineConn, *websocket.Conn, func()) {
+	connch := make(chan *deadlineConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		connch <- newDeadlineConn(ws, readTimeout, time.Second, maxMessage)
+	}))
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	dc := <-connch
+	return dc, client, func() {
+		client.Close()
+		dc.Close()
+		srv.Close()
+	}
+}
+
+func TestDeadlineConnDeadClient(t *testing.T) {
+	dc, _, done := dialDeadlineConn(t, 100*time.Millisecond, 0)
+	defer done()
+
+	// a client which never answers fails the read once the timeout passes
+	start := time.Now()
+	_, _, err := dc.NextReader()
+	if err == nil {
+		t.Fatal("expected read to fail")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected read to fail after the timeout, took %s", d)
+	}
+}
+
+func TestDeadlineConnPongs(t *testing.T) {
+	dc, client, done := dialDeadlineConn(t, 100*time.Millisecond, 0)
+	defer done()
+
+	// the client answers pings while reading
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	pongs := make(chan struct{}, 10)
+	dc.SetPongHandler(func(string) error {
+		pongs <- struct{}{}
+		return nil
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		tick := time.NewTicker(30 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				dc.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		client.WriteMessage(websocket.TextMessage, []byte("hi"))
+	}()
+
+	// pongs keep the connection alive past the read timeout
+	_, dat, err := dc.ReadMessage()
+	if err != nil || string(dat) != "hi" {
+		t.Fatalf("unexpected message %q (%v)", dat, err)
+	}
+	if len(pongs) == 0 {
+		t.Error("expected the pong handler to be called")
+	}
+}
+
+func TestDeadlineConnMessageLimit(t *testing.T) {
+	dc, client, done := dialDeadlineConn(t, 0, 4)
+	defer done()
+
+	client.WriteMessage(websocket.TextMessage, []byte("1234"))
+	if _, dat, err := dc.ReadMessage(); err != nil || string(dat) != "1234" {
+		t.Errorf("unexpected message %q (%v)", dat, err)
+	}
+	client.WriteMessage(websocket.BinaryMessage, []byte(strings.Repeat("x", 1000)))
+	if _, _, err := dc.ReadMessage(); err != errPayloadTooLarge {
+		t.Errorf("expected errPayloadTooLarge, got %v", err)
+	}
+
+	// the client is told why by the close message
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := client.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseProtocolError, websocket.CloseMessageTooBig) {
+		t.Errorf("expected close error, got %v", err)
+	}
+}
+
+func TestReceiveCodeLimit(t *testing.T) {
+	conn := &statusConn{runConn: newRunConn([]byte("print('hello world')"))}
+	cs := &ContainerSession{ID: "s1", Client: conn, Config: &ContainerSessionConfig{MaxMessageSize: 8}}
+	if err := cs.receiveCode(); err != errPayloadTooLarge {
+		t.Fatalf("expected errPayloadTooLarge, got %v", err)
+	}
+	last := conn.statuses[len(conn.statuses)-1]
+	if last.Code != codePayloadTooLarge || cs.code != nil {
+		t.Errorf("unexpected status %+v", last)
+	}
+}
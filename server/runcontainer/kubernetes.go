@@ -0,0 +1,858 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/gorilla/websocket"
+)
+
+// KubernetesBackend deploys session containers as Pods through the Kubernetes API, without access to a Docker socket.
+//
+// Each Pod runs an idle process, and the program is started through the exec API once the code has been copied in.
+// Images must therefore contain sh and tar, languages must configure their entrypoint, and services started by the image entrypoint are not running.
+// Network isolation is left to a NetworkPolicy selecting Pods by their "openrepl.network" label, which must exist when the server starts.
+// Host file mounts, security options, health checks, ulimits, cpusets and PIDs limits are not supported.
+// The PIDs limit of Pods is set by the kubelet instead (podPidsLimit).
+type KubernetesBackend struct {
+	// APIServer is the base URL of the API server (e.g. "https://kubernetes.default.svc").
+	APIServer string
+
+	// Namespace is the namespace in which Pods are created.
+	Namespace string
+
+	// Token is the bearer token used to authenticate to the API server.
+	// If TokenFile is set, the token is read from it for every request instead, so that rotated tokens are picked up.
+	Token     string
+	TokenFile string
+
+	// Client is the HTTP client used for API requests.
+	Client *http.Client
+
+	// Dialer is the websocket dialer used for exec streams.
+	Dialer *websocket.Dialer
+
+	// StopTimeout is the timeout for removing Pods after a failed deployment.
+	StopTimeout time.Duration
+
+	// MaxLifetime is the time after which the cluster kills a Pod, so that Pods are not orphaned if the server dies.
+	// If zero, Pods are only removed by the server.
+	MaxLifetime time.Duration
+}
+
+// serviceAccountDir is the directory into which the credentials of the service account are mounted in a Pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// NewInClusterBackend creates a KubernetesBackend using the service account of the Pod the server runs in.
+// If namespace is empty, Pods are created in the namespace of the server.
+func NewInClusterBackend(namespace string) (*KubernetesBackend, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+	ca, err := ioutil.ReadFile(path.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account CA certificate")
+	}
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(path.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	tlsConfig := &tls.Config{RootCAs: pool}
+	return &KubernetesBackend{
+		APIServer: "https://" + net.JoinHostPort(host, port),
+		Namespace: namespace,
+		TokenFile: path.Join(serviceAccountDir, "token"),
+		Client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   time.Minute,
+		},
+		Dialer: &websocket.Dialer{
+			TLSClientConfig:  tlsConfig,
+			HandshakeTimeout: time.Minute,
+		},
+	}, nil
+}
+
+// kubeError is an error status returned by the API server.
+type kubeError struct {
+	Code    int
+	Message string
+}
+
+func (err *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes API error (%d): %s", err.Code, err.Message)
+}
+
+// kubeStatus is a status returned by the API server, which is also sent when an exec stream ends.
+type kubeStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Details struct {
+		Causes []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"causes"`
+	} `json:"details"`
+}
+
+// exitStatus converts the final status of an exec stream into the exit code of the command.
+func (st kubeStatus) exitStatus() (int64, error) {
+	if st.Status == "Success" {
+		return 0, nil
+	}
+	if st.Reason == "NonZeroExitCode" {
+		for _, c := range st.Details.Causes {
+			if c.Reason == "ExitCode" {
+				return strconv.ParseInt(c.Message, 10, 64)
+			}
+		}
+	}
+	return 0, fmt.Errorf("exec failed: %s", st.Message)
+}
+
+// token returns the bearer token used for API requests.
+func (kb *KubernetesBackend) token() (string, error) {
+	if kb.TokenFile == "" {
+		return kb.Token, nil
+	}
+	dat, err := ioutil.ReadFile(kb.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(dat)), nil
+}
+
+// header generates the headers of an API request.
+func (kb *KubernetesBackend) header() (http.Header, error) {
+	hdr := http.Header{}
+	tok, err := kb.token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != "" {
+		hdr.Set("Authorization", "Bearer "+tok)
+	}
+	return hdr, nil
+}
+
+// podPath returns the API path of a Pod.
+func (kb *KubernetesBackend) podPath(name string) string {
+	return "/api/v1/namespaces/" + url.PathEscape(kb.Namespace) + "/pods/" + url.PathEscape(name)
+}
+
+// request sends a JSON request to the API server, decoding the response into out if it is not nil.
+func (kb *KubernetesBackend) request(ctx context.Context, method string, p string, body interface{}, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(dat)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(kb.APIServer, "/")+p, rd)
+	if err != nil {
+		return err
+	}
+	req.Header, err = kb.header()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := kb.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var st kubeStatus
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&st)
+		if st.Message == "" {
+			st.Message = http.StatusText(resp.StatusCode)
+		}
+		return &kubeError{Code: resp.StatusCode, Message: st.Message}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// Minimal representations of the Kubernetes API objects used by the backend.
+type (
+	kubePod struct {
+		APIVersion string         `json:"apiVersion"`
+		Kind       string         `json:"kind"`
+		Metadata   kubeMeta       `json:"metadata"`
+		Spec       kubePodSpec    `json:"spec"`
+		Status     *kubePodStatus `json:"status,omitempty"`
+	}
+	kubeMeta struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels,omitempty"`
+	}
+	kubePodSpec struct {
+		Containers                    []kubeContainer `json:"containers"`
+		Volumes                       []kubeVolume    `json:"volumes,omitempty"`
+		RestartPolicy                 string          `json:"restartPolicy"`
+		AutomountServiceAccountToken  bool            `json:"automountServiceAccountToken"`
+		EnableServiceLinks            bool            `json:"enableServiceLinks"`
+		TerminationGracePeriodSeconds int64           `json:"terminationGracePeriodSeconds"`
+		ActiveDeadlineSeconds         int64           `json:"activeDeadlineSeconds,omitempty"`
+		RuntimeClassName              string          `json:"runtimeClassName,omitempty"`
+	}
+	kubeContainer struct {
+		Name            string              `json:"name"`
+		Image           string              `json:"image"`
+		ImagePullPolicy string              `json:"imagePullPolicy"`
+		Command         []string            `json:"command"`
+		Env             []kubeEnv           `json:"env,omitempty"`
+		WorkingDir      string              `json:"workingDir,omitempty"`
+		Resources       kubeResources       `json:"resources"`
+		SecurityContext kubeSecurityContext `json:"securityContext"`
+		VolumeMounts    []kubeVolumeMount   `json:"volumeMounts,omitempty"`
+	}
+	kubeEnv struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	kubeResources struct {
+		Limits   map[string]string `json:"limits,omitempty"`
+		Requests map[string]string `json:"requests,omitempty"`
+	}
+	kubeSecurityContext struct {
+		AllowPrivilegeEscalation bool              `json:"allowPrivilegeEscalation"`
+		ReadOnlyRootFilesystem   bool              `json:"readOnlyRootFilesystem,omitempty"`
+		RunAsUser                *int64            `json:"runAsUser,omitempty"`
+		RunAsGroup               *int64            `json:"runAsGroup,omitempty"`
+		Capabilities             *kubeCapabilities `json:"capabilities,omitempty"`
+	}
+	kubeCapabilities struct {
+		Add  []string `json:"add,omitempty"`
+		Drop []string `json:"drop,omitempty"`
+	}
+	kubeVolume struct {
+		Name     string `json:"name"`
+		EmptyDir struct {
+			Medium    string `json:"medium,omitempty"`
+			SizeLimit string `json:"sizeLimit,omitempty"`
+		} `json:"emptyDir"`
+	}
+	kubeVolumeMount struct {
+		Name      string `json:"name"`
+		MountPath string `json:"mountPath"`
+	}
+	kubePodStatus struct {
+		Phase             string `json:"phase"`
+		Message           string `json:"message"`
+		ContainerStatuses []struct {
+			State struct {
+				Running *struct{} `json:"running"`
+				Waiting *struct {
+					Reason  string `json:"reason"`
+					Message string `json:"message"`
+				} `json:"waiting"`
+				Terminated *struct {
+					Reason   string `json:"reason"`
+					ExitCode int    `json:"exitCode"`
+				} `json:"terminated"`
+			} `json:"state"`
+		} `json:"containerStatuses"`
+	}
+)
+
+// kubeContainerName is the name of the session container within its Pod.
+const kubeContainerName = "session"
+
+// labelNetwork is the Pod label indicating whether the session may use the network, for use by NetworkPolicies.
+const labelNetwork = "openrepl.network"
+
+// kubeUnsupported checks that a container configuration can be deployed as a Pod.
+// Settings which Pods cannot apply are rejected, so that languages do not run without their limits.
+func kubeUnsupported(cc ContainerConfig) error {
+	switch {
+	case len(cc.Files) > 0:
+		return errors.New("file mounts are not supported on Kubernetes")
+	case len(cc.SecurityOpt) > 0 || cc.SeccompProfile != "":
+		return errors.New("security options are not supported on Kubernetes")
+	case cc.WaitHealthy:
+		return errors.New("health checks are not supported on Kubernetes")
+	case cc.GPU != nil && cc.GPU.Count == 0:
+		return errors.New("the number of GPUs must be set on Kubernetes")
+	case cc.PidsLimit > 0:
+		return errors.New("PIDs limits are not supported on Kubernetes (set podPidsLimit on the kubelet)")
+	case len(cc.Ulimits) > 0:
+		return errors.New("ulimits are not supported on Kubernetes")
+	case cc.Cpuset != "":
+		return errors.New("cpusets are not supported on Kubernetes")
+	case cc.Swappiness != nil || cc.OOMScoreAdj != nil:
+		return errors.New("swappiness and OOM score adjustments are not supported on Kubernetes")
+	}
+	return nil
+}
+
+// pod generates the Pod specification of a session container.
+func (kb *KubernetesBackend) pod(cc ContainerConfig, session string) (kubePod, error) {
+	err := kubeUnsupported(cc)
+	if err != nil {
+		return kubePod{}, err
+	}
+
+	// generate labels
+	labels := make(map[string]string, len(cc.Labels)+3)
+	for k, v := range cc.Labels {
+		labels[k] = v
+	}
+	labels[labelLanguage] = cc.Language
+	labels[labelSession] = session
+	labels[labelNetwork] = strconv.FormatBool(cc.Network)
+
+	ctr := kubeContainer{
+		Name:            kubeContainerName,
+		Image:           cc.Image,
+		ImagePullPolicy: "IfNotPresent",
+		Command:         idleEntrypoint,
+		WorkingDir:      cc.WorkDir,
+		Resources: kubeResources{
+			Limits: map[string]string{
+				"cpu":    "500m",
+				"memory": strconv.FormatInt(cc.memoryLimit(), 10),
+			},
+		},
+	}
+	for _, e := range cc.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		ctr.Env = append(ctr.Env, kubeEnv{Name: kv[0], Value: kv[1]})
+	}
+	if cc.CPUShares > 0 {
+		ctr.Resources.Requests = map[string]string{"cpu": strconv.FormatInt(cc.CPUShares*1000/1024, 10) + "m"}
+	}
+	if cc.StorageSize != "" {
+		size, err := units.RAMInBytes(cc.StorageSize)
+		if err != nil {
+			return kubePod{}, err
+		}
+		ctr.Resources.Limits["ephemeral-storage"] = strconv.FormatInt(size, 10)
+	}
+	if cc.GPU != nil {
+		ctr.Resources.Limits["nvidia.com/gpu"] = strconv.Itoa(cc.GPU.Count)
+	}
+	if len(cc.CapAdd) > 0 || len(cc.CapDrop) > 0 {
+		ctr.SecurityContext.Capabilities = &kubeCapabilities{Add: cc.CapAdd, Drop: cc.CapDrop}
+	}
+	ctr.SecurityContext.ReadOnlyRootFilesystem = cc.ReadonlyRootfs
+	if cc.User != "" {
+		// only numeric users can be set, as the cluster cannot look up names in the image
+		ids := strings.SplitN(cc.User, ":", 2)
+		uid, err := strconv.ParseInt(ids[0], 10, 64)
+		if err != nil {
+			return kubePod{}, errors.New("users must be numeric on Kubernetes")
+		}
+		ctr.SecurityContext.RunAsUser = &uid
+		if len(ids) == 2 {
+			gid, err := strconv.ParseInt(ids[1], 10, 64)
+			if err != nil {
+				return kubePod{}, errors.New("groups must be numeric on Kubernetes")
+			}
+			ctr.SecurityContext.RunAsGroup = &gid
+		}
+	}
+
+	// back tmpfs mounts with memory volumes
+	var vols []kubeVolume
+	tmpfs := cc.tmpfs()
+	paths := make([]string, 0, len(tmpfs))
+	for p := range tmpfs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for i, p := range paths {
+		v := kubeVolume{Name: "tmpfs-" + strconv.Itoa(i)}
+		v.EmptyDir.Medium = "Memory"
+		size, err := tmpfsSize(tmpfs[p])
+		if err != nil {
+			return kubePod{}, err
+		}
+		if size > 0 {
+			v.EmptyDir.SizeLimit = strconv.FormatInt(size, 10)
+		}
+		vols = append(vols, v)
+		ctr.VolumeMounts = append(ctr.VolumeMounts, kubeVolumeMount{Name: v.Name, MountPath: p})
+	}
+
+	pod := kubePod{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Metadata:   kubeMeta{Name: containerName(cc.Language, session, cc.attempt), Labels: labels},
+		Spec: kubePodSpec{
+			Containers:       []kubeContainer{ctr},
+			Volumes:          vols,
+			RestartPolicy:    "Never",
+			RuntimeClassName: cc.Runtime,
+		},
+	}
+	if kb.MaxLifetime > 0 {
+		pod.Spec.ActiveDeadlineSeconds = int64(kb.MaxLifetime / time.Second)
+	}
+	return pod, nil
+}
+
+// kubeNetworkPolicyList is the subset of a list of NetworkPolicies checked by the backend.
+type kubeNetworkPolicyList struct {
+	Items []struct {
+		Metadata kubeMeta `json:"metadata"`
+		Spec     struct {
+			PodSelector struct {
+				MatchLabels      map[string]string `json:"matchLabels"`
+				MatchExpressions []json.RawMessage `json:"matchExpressions"`
+			} `json:"podSelector"`
+			PolicyTypes []string          `json:"policyTypes"`
+			Egress      []json.RawMessage `json:"egress"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// CheckNetworkPolicy checks that a NetworkPolicy of the namespace denies all egress from Pods without network access.
+// Without one, every session Pod can reach the network.
+func (kb *KubernetesBackend) CheckNetworkPolicy(ctx context.Context) error {
+	var list kubeNetworkPolicyList
+	err := kb.request(ctx, http.MethodGet, "/apis/networking.k8s.io/v1/namespaces/"+url.PathEscape(kb.Namespace)+"/networkpolicies", nil, &list)
+	if err != nil {
+		return fmt.Errorf("failed to list NetworkPolicies: %s", err.Error())
+	}
+	for _, np := range list.Items {
+		sel := np.Spec.PodSelector
+		selects := len(sel.MatchExpressions) == 0
+		for k, v := range sel.MatchLabels {
+			selects = selects && k == labelNetwork && v == "false"
+		}
+		if selects && inList("Egress", np.Spec.PolicyTypes) && len(np.Spec.Egress) == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("no NetworkPolicy in namespace %s denies all egress from pods labeled %s=false", kb.Namespace, labelNetwork)
+}
+
+// tmpfsSize returns the size limit in tmpfs mount options, or zero if there is none.
+func tmpfsSize(opts string) (int64, error) {
+	for _, o := range strings.Split(opts, ",") {
+		if strings.HasPrefix(o, "size=") {
+			return units.RAMInBytes(strings.TrimPrefix(o, "size="))
+		}
+	}
+	return 0, nil
+}
+
+// startError returns an error if the Pod can no longer start, and nil while it is starting or running.
+func (st *kubePodStatus) startError() error {
+	if st == nil {
+		return nil
+	}
+	if st.Phase == "Failed" || st.Phase == "Succeeded" {
+		return fmt.Errorf("pod stopped: %s", st.Message)
+	}
+	for _, cs := range st.ContainerStatuses {
+		if w := cs.State.Waiting; w != nil {
+			switch w.Reason {
+			case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CreateContainerError", "CrashLoopBackOff":
+				return fmt.Errorf("container cannot start: %s: %s", w.Reason, w.Message)
+			}
+		}
+		if t := cs.State.Terminated; t != nil {
+			return fmt.Errorf("container exited with status %d: %s", t.ExitCode, t.Reason)
+		}
+	}
+	return nil
+}
+
+// running checks whether the session container of the Pod is running.
+func (st *kubePodStatus) running() bool {
+	return st != nil && st.Phase == "Running" && len(st.ContainerStatuses) > 0 && st.ContainerStatuses[0].State.Running != nil
+}
+
+// waitRunning waits for the session container of a Pod to start.
+func (kb *KubernetesBackend) waitRunning(ctx context.Context, name string) error {
+	tick := time.NewTicker(readinessPollRate)
+	defer tick.Stop()
+	for {
+		var pod kubePod
+		err := kb.request(ctx, http.MethodGet, kb.podPath(name), nil, &pod)
+		if err != nil {
+			return err
+		}
+		if err := pod.Status.startError(); err != nil {
+			return err
+		}
+		if pod.Status.running() {
+			return nil
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Deploy creates a Pod for the session, copies code in with prestart, and then runs the program through the exec API.
+func (kb *KubernetesBackend) Deploy(ctx context.Context, cc ContainerConfig, session string, prestart func(context.Context, *Container) error) (cont *Container, err error) {
+	// count failures which were not caused by the client going away
+	defer func() {
+		if err != nil && ctx.Err() != context.Canceled {
+			deployFailures.Add(1, cc.Language)
+		}
+	}()
+
+	// the program is started through exec, so its command line must be known
+	argv, err := cc.programCommand(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	pod, err := kb.pod(cc, session)
+	if err != nil {
+		return nil, err
+	}
+
+	// create pod
+	t := time.Now()
+	err = kb.request(ctx, http.MethodPost, "/api/v1/namespaces/"+url.PathEscape(kb.Namespace)+"/pods", pod, nil)
+	if err != nil {
+		return nil, err
+	}
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "create")
+	containersCreated.Add(1, cc.Language)
+	cont = &Container{
+		backend:      kb,
+		ID:           pod.Metadata.Name,
+		closetimeout: kb.StopTimeout,
+		lang:         cc.Language,
+		created:      t,
+		session:      session,
+	}
+
+	// cleanup pod on failed startup
+	defer func() {
+		if err != nil {
+			delctx, cancel := context.WithTimeout(context.Background(), kb.StopTimeout)
+			defer cancel()
+			rerr := kb.Remove(delctx, cont)
+			if rerr != nil {
+				Logger{Session: session}.Errorf("failed to remove pod: %s", rerr.Error())
+			} else {
+				containersRemoved.Add(1, cc.Language)
+			}
+		}
+	}()
+
+	// wait for the pod to be scheduled and started
+	t = time.Now()
+	err = kb.waitRunning(ctx, pod.Metadata.Name)
+	if err != nil {
+		return nil, err
+	}
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "start")
+
+	// run prestart hook
+	if prestart != nil {
+		err = prestart(ctx, cont)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// prepare the container before the program starts
+	err = cont.waitReady(ctx, cc)
+	if err != nil {
+		return nil, err
+	}
+	if len(cc.Init) > 0 {
+		err = cont.Exec(ctx, cc.Init)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// start the program
+	t = time.Now()
+	s, err := kb.exec(pod.Metadata.Name, argv, true, true)
+	if err != nil {
+		return nil, err
+	}
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "attach")
+	cont.IO = s
+
+	containersRunning.Add(1, cc.Language)
+	return cont, nil
+}
+
+// Remove deletes the Pod immediately.
+func (kb *KubernetesBackend) Remove(ctx context.Context, c *Container) error {
+	err := kb.request(ctx, http.MethodDelete, kb.podPath(c.ID)+"?gracePeriodSeconds=0", nil, nil)
+	if kerr, ok := err.(*kubeError); ok && kerr.Code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// CopyTo extracts the tarball with tar, which must be present in the image.
+func (kb *KubernetesBackend) CopyTo(ctx context.Context, c *Container, dir string, tr io.Reader) error {
+	var stderr bytes.Buffer
+	code, err := kb.ExecInput(ctx, c, []string{"tar", "-xmf", "-", "-C", dir}, tr, ioutil.Discard, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("failed to extract files (status %d): %s", code, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// ExecInput runs the command through the exec API.
+func (kb *KubernetesBackend) ExecInput(ctx context.Context, c *Container, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	s, err := kb.exec(c.ID, cmd, stdin != nil, false)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	s.stderr = stderr
+
+	// abort the command with the context
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+
+	// send input, closing the input stream once it has been written
+	if stdin != nil {
+		go func() {
+			io.Copy(s, stdin)
+			s.closeStdin()
+		}()
+	}
+
+	_, err = io.Copy(stdout, s)
+	if err != nil {
+		return 0, err
+	}
+	code, err := s.wait(ctx)
+	return int(code), err
+}
+
+// Wait waits for the program stream to end.
+func (kb *KubernetesBackend) Wait(ctx context.Context, c *Container) (int64, error) {
+	s, ok := c.IO.(*kubeStream)
+	if !ok {
+		return 0, errors.New("container has no program stream")
+	}
+	return s.wait(ctx)
+}
+
+// Resize sends the terminal size on the resize channel of the program stream.
+func (kb *KubernetesBackend) Resize(ctx context.Context, c *Container, cols uint, rows uint) error {
+	s, ok := c.IO.(*kubeStream)
+	if !ok {
+		return errors.New("container has no program stream")
+	}
+	return s.resize(cols, rows)
+}
+
+// Channels of the Kubernetes stream protocol, which are the first byte of each message.
+const (
+	kubeChanStdin  = 0
+	kubeChanStdout = 1
+	kubeChanStderr = 2
+	kubeChanStatus = 3
+	kubeChanResize = 4
+	kubeChanClose  = 255
+)
+
+// Versions of the Kubernetes stream protocol.
+// Version 5 adds closing of the input stream, which version 4 servers leave open until the stream ends.
+const (
+	kubeStreamV4 = "v4.channel.k8s.io"
+	kubeStreamV5 = "v5.channel.k8s.io"
+)
+
+// exec starts a command in the session container of a Pod.
+// With a TTY, the output of the command is sent on a single stream.
+func (kb *KubernetesBackend) exec(pod string, cmd []string, stdin bool, tty bool) (*kubeStream, error) {
+	q := url.Values{}
+	q.Set("container", kubeContainerName)
+	for _, arg := range cmd {
+		q.Add("command", arg)
+	}
+	q.Set("stdin", strconv.FormatBool(stdin))
+	q.Set("stdout", "true")
+	q.Set("stderr", strconv.FormatBool(!tty))
+	q.Set("tty", strconv.FormatBool(tty))
+	u := strings.TrimSuffix(kb.APIServer, "/") + kb.podPath(pod) + "/exec?" + q.Encode()
+	u = "ws" + strings.TrimPrefix(u, "http")
+
+	hdr, err := kb.header()
+	if err != nil {
+		return nil, err
+	}
+	var d websocket.Dialer
+	if kb.Dialer != nil {
+		d = *kb.Dialer
+	}
+	d.Subprotocols = []string{kubeStreamV5, kubeStreamV4}
+	ws, resp, err := d.Dial(u, hdr)
+	if err != nil {
+		if resp != nil {
+			return nil, &kubeError{Code: resp.StatusCode, Message: "exec failed: " + err.Error()}
+		}
+		return nil, err
+	}
+	return &kubeStream{ws: ws, v5: ws.Subprotocol() == kubeStreamV5, done: make(chan struct{})}, nil
+}
+
+// kubeStream is the stream of a command run through the exec API.
+// Reads return its standard output, and writes are sent as its standard input.
+type kubeStream struct {
+	ws   *websocket.Conn
+	v5   bool
+	wlck sync.Mutex
+
+	// stderr receives the standard error of the command, which is discarded if nil.
+	stderr io.Writer
+
+	// buf is the unread part of the last output message.
+	buf []byte
+
+	// done is closed once the command has ended, with its exit code or an error.
+	done chan struct{}
+	once sync.Once
+	code int64
+	err  error
+}
+
+// finish records the result of the command.
+func (s *kubeStream) finish(code int64, err error) {
+	s.once.Do(func() {
+		s.code, s.err = code, err
+		close(s.done)
+	})
+}
+
+// wait waits for the command to end and returns its exit code.
+func (s *kubeStream) wait(ctx context.Context) (int64, error) {
+	select {
+	case <-s.done:
+		return s.code, s.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (s *kubeStream) Read(dat []byte) (int, error) {
+	for len(s.buf) == 0 {
+		_, msg, err := s.ws.ReadMessage()
+		if err != nil {
+			s.finish(0, err)
+			if s.err != err {
+				// the command ended before the stream closed
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case kubeChanStdout:
+			s.buf = msg[1:]
+		case kubeChanStderr:
+			if s.stderr != nil {
+				s.stderr.Write(msg[1:])
+			}
+		case kubeChanStatus:
+			var st kubeStatus
+			err := json.Unmarshal(msg[1:], &st)
+			if err != nil {
+				s.finish(0, err)
+			} else {
+				s.finish(st.exitStatus())
+			}
+			return 0, io.EOF
+		}
+	}
+	n := copy(dat, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// send writes a message on a channel.
+func (s *kubeStream) send(channel byte, dat []byte) error {
+	s.wlck.Lock()
+	defer s.wlck.Unlock()
+	return s.ws.WriteMessage(websocket.BinaryMessage, append([]byte{channel}, dat...))
+}
+
+func (s *kubeStream) Write(dat []byte) (int, error) {
+	err := s.send(kubeChanStdin, dat)
+	if err != nil {
+		return 0, err
+	}
+	return len(dat), nil
+}
+
+// closeStdin closes the standard input of the command, if supported by the server.
+func (s *kubeStream) closeStdin() error {
+	if !s.v5 {
+		return nil
+	}
+	return s.send(kubeChanClose, []byte{kubeChanStdin})
+}
+
+// resize changes the terminal size of the command.
+func (s *kubeStream) resize(cols uint, rows uint) error {
+	dat, err := json.Marshal(struct {
+		Width  uint
+		Height uint
+	}{cols, rows})
+	if err != nil {
+		return err
+	}
+	return s.send(kubeChanResize, dat)
+}
+
+func (s *kubeStream) Close() error {
+	return s.ws.Close()
+}
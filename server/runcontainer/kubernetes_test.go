@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKubernetesPod(t *testing.T) {
+	kb := &KubernetesBackend{MaxLifetime: time.Hour}
+	cc := ContainerConfig{
+		Language:    "python3",
+		Image:       "openrepl/python3",
+		Env:         []string{"LANG=C.UTF-8", "EMPTY"},
+		WorkDir:     "/home/runner",
+		MemoryMB:    64,
+		CPUShares:   512,
+		Network:     true,
+		Tmpfs:       map[string]string{"/tmp": "size=16m", "/run": ""},
+		Labels:      map[string]string{"team": "a"},
+		StorageSize: "1g",
+	}
+	pod, err := kb.pod(cc, "abc")
+	if err != nil {
+		t.Fatalf("failed to generate pod: %s", err.Error())
+	}
+	if pod.Metadata.Name != "openrepl-python3-abc" || pod.Spec.RestartPolicy != "Never" || pod.Spec.ActiveDeadlineSeconds != 3600 {
+		t.Errorf("unexpected pod %+v", pod)
+	}
+	labels := pod.Metadata.Labels
+	if labels["team"] != "a" || labels[labelLanguage] != "python3" || labels[labelSession] != "abc" || labels[labelNetwork] != "true" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	ctr := pod.Spec.Containers[0]
+	if ctr.Resources.Limits["memory"] != "67108864" || ctr.Resources.Limits["ephemeral-storage"] != "1073741824" || ctr.Resources.Requests["cpu"] != "500m" {
+		t.Errorf("unexpected resources %+v", ctr.Resources)
+	}
+	if len(ctr.Env) != 2 || ctr.Env[0] != (kubeEnv{"LANG", "C.UTF-8"}) || ctr.Env[1] != (kubeEnv{"EMPTY", ""}) {
+		t.Errorf("unexpected env %+v", ctr.Env)
+	}
+	if len(pod.Spec.Volumes) != 2 || ctr.VolumeMounts[0].MountPath != "/run" || ctr.VolumeMounts[1].MountPath != "/tmp" ||
+		pod.Spec.Volumes[0].EmptyDir.SizeLimit != "" || pod.Spec.Volumes[1].EmptyDir.SizeLimit != "16777216" {
+		t.Errorf("unexpected volumes %+v mounted at %+v", pod.Spec.Volumes, ctr.VolumeMounts)
+	}
+
+	// hardening options map to the security context
+	pod, err = kb.pod(ContainerConfig{User: "1000:2000", ReadonlyRootfs: true, CapDrop: []string{"ALL"}}, "abc")
+	if err != nil {
+		t.Fatalf("failed to generate pod: %s", err.Error())
+	}
+	sc := pod.Spec.Containers[0].SecurityContext
+	if sc.RunAsUser == nil || *sc.RunAsUser != 1000 || sc.RunAsGroup == nil || *sc.RunAsGroup != 2000 || !sc.ReadOnlyRootFilesystem ||
+		sc.Capabilities == nil || len(sc.Capabilities.Drop) != 1 || pod.Spec.Containers[0].VolumeMounts[0].MountPath != "/tmp" {
+		t.Errorf("unexpected security context %+v", sc)
+	}
+
+	// docker-specific options cannot be translated
+	for _, cc := range []ContainerConfig{
+		{SecurityOpt: []string{"seccomp=unconfined"}},
+		{SeccompProfile: "strict.json"},
+		{User: "runner"},
+		{WaitHealthy: true},
+		{GPU: &GPUConfig{}},
+		{Tmpfs: map[string]string{"/tmp": "size=lots"}},
+		{StorageSize: "lots"},
+		{PidsLimit: 64},
+		{Ulimits: map[string]Ulimit{"nofile": {Soft: 64, Hard: 64}}},
+		{Cpuset: "2-7"},
+	} {
+		if _, err := kb.pod(cc, "abc"); err == nil {
+			t.Errorf("config %+v accepted", cc)
+		}
+	}
+}
+
+func TestKubeExitStatus(t *testing.T) {
+	tbl := []struct {
+		status string
+		code   int64
+		ok     bool
+	}{
+		{`{"status": "Success"}`, 0, true},
+		{`{"status": "Failure", "reason": "NonZeroExitCode", "details": {"causes": [{"reason": "ExitCode", "message": "3"}]}}`, 3, true},
+		{`{"status": "Failure", "reason": "InternalError", "message": "no such file"}`, 0, false},
+	}
+	for _, v := range tbl {
+		var st kubeStatus
+		if err := json.Unmarshal([]byte(v.status), &st); err != nil {
+			t.Fatalf("failed to decode status: %s", err.Error())
+		}
+		code, err := st.exitStatus()
+		if code != v.code || (err == nil) != v.ok {
+			t.Errorf("%s: expected %d (ok %v) but got %d (%v)", v.status, v.code, v.ok, code, err)
+		}
+	}
+}
+
+func TestKubePodStartError(t *testing.T) {
+	tbl := []struct {
+		status  string
+		running bool
+		failed  bool
+	}{
+		{`{"phase": "Pending"}`, false, false},
+		{`{"phase": "Pending", "containerStatuses": [{"state": {"waiting": {"reason": "ContainerCreating"}}}]}`, false, false},
+		{`{"phase": "Pending", "containerStatuses": [{"state": {"waiting": {"reason": "ImagePullBackOff"}}}]}`, false, true},
+		{`{"phase": "Running", "containerStatuses": [{"state": {"running": {}}}]}`, true, false},
+		{`{"phase": "Running", "containerStatuses": [{"state": {"terminated": {"exitCode": 1}}}]}`, false, true},
+		{`{"phase": "Failed", "message": "evicted"}`, false, true},
+	}
+	for _, v := range tbl {
+		var st kubePodStatus
+		if err := json.Unmarshal([]byte(v.status), &st); err != nil {
+			t.Fatalf("failed to decode status: %s", err.Error())
+		}
+		if st.running() != v.running || (st.startError() != nil) != v.failed {
+			t.Errorf("%s: expected running %v, failed %v", v.status, v.running, v.failed)
+		}
+	}
+}
+
+func TestKubernetesRemove(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodDelete || r.URL.Query().Get("gracePeriodSeconds") != "0" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/ns/pods/live":
+			w.Write([]byte(`{"kind": "Pod"}`))
+		case "/api/v1/namespaces/ns/pods/gone":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind": "Status", "status": "Failure", "message": "pods \"gone\" not found"}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"kind": "Status", "status": "Failure", "message": "forbidden"}`))
+		}
+	}))
+	defer srv.Close()
+
+	kb := &KubernetesBackend{APIServer: srv.URL, Namespace: "ns", Token: "tok", Client: srv.Client()}
+	for _, name := range []string{"live", "gone"} {
+		if err := kb.Remove(context.Background(), &Container{ID: name}); err != nil {
+			t.Errorf("failed to remove %s: %s", name, err.Error())
+		}
+	}
+	err := kb.Remove(context.Background(), &Container{ID: "other"})
+	if kerr, ok := err.(*kubeError); !ok || kerr.Code != http.StatusForbidden || kerr.Message != "forbidden" {
+		t.Errorf("expected forbidden error but got %v", err)
+	}
+}
+
+func TestKubernetesNetworkPolicy(t *testing.T) {
+	policies := map[string]string{
+		"open":    `{"items": [{"metadata": {"name": "ingress"}, "spec": {"podSelector": {}, "policyTypes": ["Ingress"]}}]}`,
+		"offline": `{"items": [{"metadata": {"name": "offline"}, "spec": {"podSelector": {"matchLabels": {"openrepl.network": "false"}}, "policyTypes": ["Egress"]}}]}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for ns, list := range policies {
+			if r.URL.Path == "/apis/networking.k8s.io/v1/namespaces/"+ns+"/networkpolicies" {
+				w.Write([]byte(list))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	// a policy which does not deny egress is not enough
+	kb := &KubernetesBackend{APIServer: srv.URL, Namespace: "open", Client: srv.Client()}
+	if err := kb.CheckNetworkPolicy(context.Background()); err == nil {
+		t.Error("expected an error without an egress policy")
+	}
+	kb.Namespace = "offline"
+	if err := kb.CheckNetworkPolicy(context.Background()); err != nil {
+		t.Errorf("expected the policy to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+)
+
+// LanguageConfigError is an error in the language configuration file.
+type LanguageConfigError struct {
+	Path string
+
+	// Line is the line of the file at which the error was found, or 0 if it is unknown.
+	Line int
+
+	Msg string
+}
+
+func (e *LanguageConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Msg)
+	}
+	return e.Path + ": " + e.Msg
+}
+
+// parseLanguageConfig decodes the language configuration file, rejecting unknown fields and invalid container configurations.
+// Errors are located at the line of the offending value.
+func parseLanguageConfig(path string, dat []byte) (map[string]Language, error) {
+	var langs map[string]Language
+	err := json.Unmarshal(dat, &langs)
+	switch e := err.(type) {
+	case nil:
+	case *json.SyntaxError:
+		return nil, &LanguageConfigError{Path: path, Line: lineAt(dat, e.Offset), Msg: e.Error()}
+	case *json.UnmarshalTypeError:
+		return nil, &LanguageConfigError{Path: path, Line: lineAt(dat, e.Offset), Msg: fmt.Sprintf("cannot use %s value as %s", e.Value, e.Type)}
+	default:
+		return nil, &LanguageConfigError{Path: path, Msg: err.Error()}
+	}
+
+	// reject unknown fields, which are usually misspelled
+	var raw interface{}
+	err = json.Unmarshal(dat, &raw)
+	if err != nil {
+		return nil, &LanguageConfigError{Path: path, Msg: err.Error()}
+	}
+	if field := unknownField(raw, reflect.TypeOf(langs)); field != nil {
+		return nil, &LanguageConfigError{
+			Path: path,
+			Line: lineAt(dat, locateKey(dat, field)),
+			Msg:  fmt.Sprintf("unknown field %q in %s", field[len(field)-1], strings.Replace(strings.Join(field[:len(field)-1], "."), ".[", "[", -1)),
+		}
+	}
+
+	// check container configurations
+	names := make([]string, 0, len(langs))
+	for name := range langs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lang := langs[name]
+		for _, c := range []struct {
+			key string
+			cc  ContainerConfig
+		}{{"run", lang.RunContainer}, {"term", lang.TermContainer}} {
+			err = c.cc.validate()
+			if err != nil {
+				return nil, &LanguageConfigError{
+					Path: path,
+					Line: lineAt(dat, locateKey(dat, []string{name, c.key})),
+					Msg:  fmt.Sprintf("language %s: %s container: %s", name, c.key, err.Error()),
+				}
+			}
+		}
+	}
+	return langs, nil
+}
+
+// validate checks that the container configuration has an image and command, and that its limits are valid.
+func (cc ContainerConfig) validate() error {
+	if cc.Image == "" && cc.WasmModule == "" && cc.Rootfs == "" {
+		return errors.New("missing image")
+	}
+	if cc.Command == nil {
+		return errors.New("missing cmd (use [] for the default command of the image)")
+	}
+	for _, l := range []struct {
+		name string
+		v    float64
+	}{
+		{"memory_mb", float64(cc.MemoryMB)},
+		{"cpu_shares", float64(cc.CPUShares)},
+		{"pids_limit", float64(cc.PidsLimit)},
+		{"max_run_time", cc.MaxRunTime},
+		{"compile_timeout", cc.CompileTimeout},
+	} {
+		if l.v < 0 {
+			return fmt.Errorf("%s must not be negative", l.name)
+		}
+	}
+	if cc.Swap < -1 {
+		return errors.New("swap must be -1 (unlimited) or a number of bytes")
+	}
+	if cc.Swappiness != nil && (*cc.Swappiness < 0 || *cc.Swappiness > 100) {
+		return errors.New("swappiness must be between 0 and 100")
+	}
+	if cc.OOMScoreAdj != nil && (*cc.OOMScoreAdj < -1000 || *cc.OOMScoreAdj > 1000) {
+		return errors.New("oom_score_adj must be between -1000 and 1000")
+	}
+	if dir := cc.artifactDir(); (len(cc.Artifacts) > 0 || cc.ArtifactArchive) && (dir == "" || path.Clean(dir) == "/") {
+		return errors.New("artifacts need an artifact_dir (or workdir) other than /")
+	}
+	if p := cc.Packages; p != nil && (p.Manifest == "" || len(p.Install) == 0 || len(p.Registries) == 0) {
+		return errors.New("packages need a manifest, cmd and registries")
+	}
+	for _, s := range []struct {
+		name string
+		v    string
+	}{
+		{"tmpfs_size", cc.TmpfsSize},
+		{"workspace_size", cc.WorkspaceSize},
+		{"storage_size", cc.StorageSize},
+	} {
+		if _, err := units.RAMInBytes(s.v); s.v != "" && err != nil {
+			return fmt.Errorf("invalid %s %q", s.name, s.v)
+		}
+	}
+	return nil
+}
+
+// jsonUnmarshaler is the type of values decoding themselves, whose fields are not checked.
+var jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// unknownField finds the first field of a decoded JSON value which does not exist in the type it is decoded into.
+// It returns the path of object keys (and array indices) leading to the field, or nil if every field is known.
+func unknownField(v interface{}, t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshaler) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, key := range objectKeys(obj) {
+			f, ok := jsonField(t, key)
+			if !ok {
+				return []string{key}
+			}
+			if sub := unknownField(obj[key], f.Type); sub != nil {
+				return append([]string{key}, sub...)
+			}
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, key := range objectKeys(obj) {
+			if sub := unknownField(obj[key], t.Elem()); sub != nil {
+				return append([]string{key}, sub...)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, e := range arr {
+			if sub := unknownField(e, t.Elem()); sub != nil {
+				return append([]string{"[" + strconv.Itoa(i) + "]"}, sub...)
+			}
+		}
+	}
+	return nil
+}
+
+// objectKeys returns the keys of a JSON object in order.
+func objectKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonField finds the struct field into which encoding/json decodes an object key, including fields of embedded structs.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			if ef, ok := jsonField(f.Type, key); ok {
+				return ef, true
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// locateKey finds the offset of the last key of a path in a JSON document, by searching for each key after the previous one.
+// Array indices in the path are skipped, so the result may be a later occurrence of the key.
+// Returns -1 if a key is not found.
+func locateKey(dat []byte, path []string) int64 {
+	start, end := -1, 0
+	for _, key := range path {
+		if strings.HasPrefix(key, "[") {
+			continue
+		}
+		name, _ := json.Marshal(key)
+		loc := regexp.MustCompile(regexp.QuoteMeta(string(name)) + `\s*:`).FindIndex(dat[end:])
+		if loc == nil {
+			return -1
+		}
+		start, end = end+loc[0], end+loc[1]
+	}
+	return int64(start)
+}
+
+// lineAt returns the line number of an offset in a document, or 0 if the offset is invalid.
+func lineAt(dat []byte, off int64) int {
+	if off < 0 || off > int64(len(dat)) {
+		return 0
+	}
+	return bytes.Count(dat[:off], []byte("\n")) + 1
+}
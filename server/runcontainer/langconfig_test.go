@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseLanguageConfig(t *testing.T) {
+	dat, err := ioutil.ReadFile("langs.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseLanguageConfig("langs.json", dat)
+	if err != nil {
+		t.Errorf("expected langs.json to be valid, got %v", err)
+	}
+
+	tbl := []struct {
+		name string
+		conf string
+		line int
+		msg  string
+	}{
+		{
+			name: "unknown field",
+			conf: "{\n\"lua\": {\n\"run\": {\"image\": \"openrepl/lua\", \"cmd\": []},\n\"term\": {\n\"imgae\": \"openrepl/lua\", \"cmd\": []}}}",
+			line: 5,
+			msg:  `unknown field "imgae" in lua.term`,
+		},
+		{
+			name: "unknown nested field",
+			conf: "{\"lua\": {\"run\": {\"image\": \"openrepl/lua\", \"cmd\": [],\n\"steps\": [{\"name\": \"build\", \"cmd\": []}, {\"name\": \"run\",\n\"cmmd\": []}]},\n\"term\": {\"image\": \"openrepl/lua\", \"cmd\": []}}}",
+			line: 3,
+			msg:  `unknown field "cmmd" in lua.run.steps[1]`,
+		},
+		{
+			name: "missing cmd",
+			conf: "{\"lua\": {\n\"run\": {\"image\": \"openrepl/lua\"},\n\"term\": {\"image\": \"openrepl/lua\", \"cmd\": []}}}",
+			line: 2,
+			msg:  "language lua: run container: missing cmd (use [] for the default command of the image)",
+		},
+		{
+			name: "missing image",
+			conf: "{\"lua\": {\"run\": {\"image\": \"openrepl/lua\", \"cmd\": []},\n\n\"term\": {\"cmd\": []}}}",
+			line: 3,
+			msg:  "language lua: term container: missing image",
+		},
+		{
+			name: "bad limit",
+			conf: "{\"lua\": {\"run\": {\"image\": \"openrepl/lua\", \"cmd\": [], \"memory_mb\": -1},\n\"term\": {\"image\": \"openrepl/lua\", \"cmd\": []}}}",
+			line: 1,
+			msg:  "language lua: run container: memory_mb must not be negative",
+		},
+		{
+			name: "bad size",
+			conf: "{\"lua\": {\"run\": {\"image\": \"openrepl/lua\", \"cmd\": []},\n\"term\": {\"image\": \"openrepl/lua\", \"cmd\": [], \"tmpfs_size\": \"lots\"}}}",
+			line: 2,
+			msg:  `language lua: term container: invalid tmpfs_size "lots"`,
+		},
+		{
+			name: "artifacts without directory",
+			conf: "{\"lua\": {\"run\": {\"image\": \"openrepl/lua\", \"cmd\": [],\n\"artifacts\": [\"*.png\"]},\n\"term\": {\"image\": \"openrepl/lua\", \"cmd\": []}}}",
+			line: 1,
+			msg:  "language lua: run container: artifacts need an artifact_dir (or workdir) other than /",
+		},
+		{
+			name: "wrong type",
+			conf: "{\"lua\": {\"run\": {\"image\": \"openrepl/lua\", \"cmd\": []},\n\"term\": {\"image\": \"openrepl/lua\",\n\"cmd\": \"lua\"}}}",
+			line: 3,
+		},
+	}
+	for _, tc := range tbl {
+		_, err := parseLanguageConfig("langs.json", []byte(tc.conf))
+		lerr, ok := err.(*LanguageConfigError)
+		switch {
+		case !ok:
+			t.Errorf("%s: expected configuration error, got %v", tc.name, err)
+		case lerr.Line != tc.line:
+			t.Errorf("%s: expected error at line %d, got %v", tc.name, tc.line, err)
+		case tc.msg != "" && lerr.Msg != tc.msg:
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.msg, lerr.Msg)
+		}
+	}
+}
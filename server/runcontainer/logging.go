@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// logEntry is a log line in the JSON format.
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Msg     string `json:"msg"`
+	Session string `json:"session,omitempty"`
+}
+
+// Logger writes log lines at an explicit level, attributed to a session if Session is set.
+// In the text format, lines of sessions are prefixed with "session <id>: ", and the level is not shown.
+type Logger struct {
+	Session string
+}
+
+// serverLog is the logger of lines which do not belong to a session.
+var serverLog Logger
+
+// Printf logs a line at the info level.
+func (l Logger) Printf(format string, args ...interface{}) {
+	l.output("info", fmt.Sprintf(format, args...))
+}
+
+// Errorf logs a line reporting a failure at the error level.
+func (l Logger) Errorf(format string, args ...interface{}) {
+	l.output("error", fmt.Sprintf(format, args...))
+}
+
+func (l Logger) output(level string, msg string) {
+	if w := jsonLog; w != nil {
+		w.writeEntry(logEntry{Time: time.Now().UTC().Format(time.RFC3339Nano), Level: level, Msg: msg, Session: l.Session})
+		return
+	}
+	if l.Session != "" {
+		msg = "session " + l.Session + ": " + msg
+	}
+	log.Print(msg)
+}
+
+// logger returns the logger of the session.
+func (cs *ContainerSession) logger() Logger {
+	return Logger{Session: cs.ID}
+}
+
+// jsonLogWriter writes log lines as JSON objects, for log aggregators.
+// As the output of the standard logger, it writes the lines which are not written through a Logger at the info level.
+// The standard logger must not add a prefix or flags, as the entries carry their own time.
+type jsonLogWriter struct {
+	out io.Writer
+
+	lck sync.Mutex
+}
+
+// jsonLog is the writer of the JSON format, or nil if logs are written as text.
+var jsonLog *jsonLogWriter
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	err := w.writeEntry(logEntry{Time: time.Now().UTC().Format(time.RFC3339Nano), Level: "info", Msg: string(bytes.TrimSuffix(p, []byte("\n")))})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeEntry writes an entry as a line.
+func (w *jsonLogWriter) writeEntry(e logEntry) error {
+	dat, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	w.lck.Lock()
+	defer w.lck.Unlock()
+	_, err = w.out.Write(append(dat, '\n'))
+	return err
+}
+
+// setLogFormat configures logging to write in a format ("text" or "json") to out.
+// It must be called before anything is logged.
+func setLogFormat(format string, out io.Writer) error {
+	switch format {
+	case "", "text":
+		jsonLog = nil
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(out)
+	case "json":
+		jsonLog = &jsonLogWriter{out: out}
+		log.SetFlags(0)
+		log.SetOutput(jsonLog)
+	default:
+		return fmt.Errorf("unsupported log format %q", format)
+	}
+	return nil
+}
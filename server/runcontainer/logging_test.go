@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	err := setLogFormat("json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setLogFormat("text", os.Stderr)
+
+	Logger{Session: "abc"}.Errorf("failed to record job: %s", "disk full")
+	Logger{Session: "abc"}.Printf("rejected: %s", "no error")
+	serverLog.Errorf("failed to collect images: %s", "timeout")
+	log.Printf("session %s: failed to %s", "def", "start")
+	expect := []logEntry{
+		{Level: "error", Msg: "failed to record job: disk full", Session: "abc"},
+		{Level: "info", Msg: "rejected: no error", Session: "abc"},
+		{Level: "error", Msg: "failed to collect images: timeout"},
+		// lines of the standard logger are not parsed
+		{Level: "info", Msg: "session def: failed to start"},
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(expect) {
+		t.Fatalf("expected %d entries, got %q", len(expect), buf.String())
+	}
+	for i, line := range lines {
+		var e logEntry
+		err = json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatalf("invalid entry %q: %s", line, err.Error())
+		}
+		if e.Time == "" {
+			t.Errorf("entry %q has no time", line)
+		}
+		e.Time = ""
+		if e != expect[i] {
+			t.Errorf("expected %+v but got %+v", expect[i], e)
+		}
+	}
+
+	if err := setLogFormat("xml", &buf); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestTextLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	err := setLogFormat("text", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setLogFormat("text", os.Stderr)
+	log.SetFlags(0)
+
+	Logger{Session: "abc"}.Errorf("failed to record job: %s", "disk full")
+	serverLog.Printf("shutdown complete")
+	if out := buf.String(); out != "session abc: failed to record job: disk full\nshutdown complete\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
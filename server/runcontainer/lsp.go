@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gorilla/websocket"
+)
+
+// maxLSPMessage is the maximum size of a message from the language server.
+const maxLSPMessage = 16 << 20
+
+// LSPConfig is a configuration of the language server of a language.
+type LSPConfig struct {
+	// Command is the full command line of the language server (e.g. ["pylsp"]), which speaks JSON-RPC over stdio with Content-Length framing.
+	// It is run inside the session container, so that it sees the files of the session.
+	Command []string `json:"cmd"`
+}
+
+// readLSPMessage reads the body of a message framed with LSP base protocol headers.
+func readLSPMessage(r *bufio.Reader) ([]byte, error) {
+	hdr, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(hdr.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, errors.New("invalid Content-Length header from language server")
+	}
+	if n > maxLSPMessage {
+		return nil, fmt.Errorf("language server message of %d bytes exceeds the limit", n)
+	}
+	dat := make([]byte, n)
+	_, err = io.ReadFull(r, dat)
+	return dat, err
+}
+
+// writeLSPMessage writes a message framed with LSP base protocol headers.
+func writeLSPMessage(w io.Writer, dat []byte) error {
+	_, err := io.WriteString(w, "Content-Length: "+strconv.Itoa(len(dat))+"\r\n\r\n")
+	if err == nil {
+		_, err = w.Write(dat)
+	}
+	return err
+}
+
+// startLanguageServer starts the language server in the session container, returning its connection and its demultiplexed stdout.
+func (cs *ContainerSession) startLanguageServer(ctx context.Context) (types.HijackedResponse, *bufio.Reader, error) {
+	c := cs.Container
+	if c.cli == nil {
+		return types.HijackedResponse{}, nil, errRequiresDocker
+	}
+	ex, err := c.cli.ContainerExecCreate(ctx, c.ID, types.ExecConfig{
+		Cmd:          cs.ContainerConfig.LSP.Command,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return types.HijackedResponse{}, nil, err
+	}
+	resp, err := c.cli.ContainerExecAttach(ctx, ex.ID, types.ExecStartCheck{})
+	if err != nil {
+		return types.HijackedResponse{}, nil, err
+	}
+
+	// demultiplex stdout, discarding the logs of the server
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, ioutil.Discard, resp.Reader)
+		if err == nil {
+			err = io.EOF
+		}
+		pw.CloseWithError(err)
+	}()
+	return resp, bufio.NewReader(pr), nil
+}
+
+// proxyLSP forwards messages between a websocket client, which sends one JSON-RPC message per text message, and a language server until either side closes.
+func proxyLSP(conn ClientConn, in io.Writer, out *bufio.Reader) error {
+	errch := make(chan error, 2)
+	go func() {
+		for {
+			dat, err := readLSPMessage(out)
+			if err == nil {
+				err = conn.WriteMessage(websocket.TextMessage, dat)
+			}
+			if err != nil {
+				errch <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			t, dat, err := conn.ReadMessage()
+			if err == nil && t == websocket.TextMessage {
+				err = writeLSPMessage(in, dat)
+			}
+			if err != nil {
+				errch <- err
+				return
+			}
+		}
+	}()
+	return <-errch
+}
+
+// HandleLSP proxies a websocket to the language server of the session selected by the session query parameter.
+// The token query parameter must be the LSP token sent to the client of the session with the running status.
+// Only one language server runs per session at a time.
+func (cs *ContainerServer) HandleLSP(w http.ResponseWriter, r *http.Request) {
+	var sess *ContainerSession
+	if cs.SessionConfig.Sessions != nil {
+		sess = cs.SessionConfig.Sessions.Get(r.URL.Query().Get("session"))
+	}
+	tok := r.URL.Query().Get("token")
+	if sess == nil || sess.lspToken == "" || subtle.ConstantTimeCompare([]byte(tok), []byte(sess.lspToken)) != 1 {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if sess.State() != stateRunning {
+		http.Error(w, "session is not running", http.StatusConflict)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&sess.lspActive, 0, 1) {
+		http.Error(w, "language server already connected", http.StatusConflict)
+		return
+	}
+	defer atomic.StoreInt32(&sess.lspActive, 0)
+
+	ws, err := cs.SessionConfig.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := newDeadlineConn(ws, 0, cs.SessionConfig.WriteTimeout, cs.SessionConfig.MaxMessageSize)
+	defer conn.Close()
+
+	resp, out, err := sess.startLanguageServer(context.Background())
+	if err != nil {
+		sess.logger().Errorf("failed to start language server: %s", err.Error())
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "failed to start language server"))
+		return
+	}
+	defer resp.Close()
+	sess.Events.Record("lsp_start", "")
+	err = proxyLSP(conn, resp.Conn, out)
+	sess.Events.Record("lsp_end", "")
+	if _, ok := err.(*websocket.CloseError); !ok && err != io.EOF {
+		sess.logger().Printf("language server connection ended: %s", err.Error())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLSPFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, msg := range []string{`{"jsonrpc":"2.0","id":1,"method":"initialize"}`, `{"jsonrpc":"2.0","method":"exit"}`} {
+		if err := writeLSPMessage(&buf, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(&buf)
+	dat, err := readLSPMessage(r)
+	if err != nil || string(dat) != `{"jsonrpc":"2.0","id":1,"method":"initialize"}` {
+		t.Errorf("unexpected message %q (%v)", dat, err)
+	}
+	dat, err = readLSPMessage(r)
+	if err != nil || string(dat) != `{"jsonrpc":"2.0","method":"exit"}` {
+		t.Errorf("unexpected message %q (%v)", dat, err)
+	}
+	if _, err := readLSPMessage(r); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// servers may send other headers, but must send a valid length
+	dat, err = readLSPMessage(bufio.NewReader(strings.NewReader("Content-Type: application/vscode-jsonrpc; charset=utf-8\r\nContent-Length: 2\r\n\r\n{}")))
+	if err != nil || string(dat) != "{}" {
+		t.Errorf("unexpected message %q (%v)", dat, err)
+	}
+	for _, hdr := range []string{"Content-Length: x\r\n\r\n", "Content-Length: 999999999\r\n\r\n"} {
+		if _, err := readLSPMessage(bufio.NewReader(strings.NewReader(hdr))); err == nil {
+			t.Errorf("%q: expected error", hdr)
+		}
+	}
+}
+
+func TestProxyLSP(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- ws
+	}))
+	defer srv.Close()
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ws := <-conns
+
+	// the fake server answers each request with a framed response
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	go func() {
+		r := bufio.NewReader(inr)
+		for {
+			dat, err := readLSPMessage(r)
+			if err != nil {
+				outw.CloseWithError(err)
+				return
+			}
+			writeLSPMessage(outw, bytes.Replace(dat, []byte("request"), []byte("response"), 1))
+		}
+	}()
+	done := make(chan error, 1)
+	go func() { done <- proxyLSP(ws, inw, bufio.NewReader(outr)) }()
+
+	client.WriteMessage(websocket.TextMessage, []byte(`{"request":1}`))
+	_, dat, err := client.ReadMessage()
+	if err != nil || string(dat) != `{"response":1}` {
+		t.Errorf("unexpected response %q (%v)", dat, err)
+	}
+
+	// the proxy ends when the server exits
+	inw.CloseWithError(io.EOF)
+	client.WriteMessage(websocket.TextMessage, []byte(`{"request":2}`))
+	if err := <-done; err == nil {
+		t.Error("expected the proxy to end with an error")
+	}
+}
+
+func TestHandleLSPToken(t *testing.T) {
+	cs := &ContainerServer{}
+	cs.SessionConfig.Sessions = &SessionRegistry{}
+	sess := &ContainerSession{ID: "s1", lspToken: "secret"}
+	cs.SessionConfig.Sessions.Add(sess)
+	for _, q := range []string{"session=s1&token=wrong", "session=s2&token=secret", "session=s1"} {
+		w := httptest.NewRecorder()
+		cs.HandleLSP(w, httptest.NewRequest(http.MethodGet, "/lsp?"+q, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", q, w.Code)
+		}
+	}
+
+	// sessions which are not running yet have no language server
+	w := httptest.NewRecorder()
+	cs.HandleLSP(w, httptest.NewRequest(http.MethodGet, "/lsp?session=s1&token=secret", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", w.Code)
+	}
+}
@@ -1,39 +1,1127 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 )
 
 func main() {
-	dcli, err := client.NewEnvClient()
+	// validate the configuration instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:], os.Stdout))
+	}
+
+	var conf Config
+	var locales string
+	var timezones string
+	var envAllow string
+	var envDeny string
+	var gpuSessions int
+	var gpuDevices int
+	var assetDir string
+	var logDriver string
+	var logFormat string
+	var logOpts string
+	var adminToken string
+	var alertWebhook string
+	var labels string
+	var minFreeMem int64
+	var minFreeDisk int64
+	var cpuset string
+	var cgroupRoot string
+	var trafficControl string
+	var egressFirewall string
+	var egressAllow string
+	var egressResolvers string
+	var packageRepo string
+	var packageTTL time.Duration
+	var maxPackageImages int
+	var prepull bool
+	var prepullInterval time.Duration
+	var workspaceTTL time.Duration
+	var maxWorkspaces int
+	var workspaceSizeMB int64
+	var pullMissing bool
+	var pullTimeout time.Duration
+	var registryAuth string
+	var reloadInterval time.Duration
+	var allowedOrigins string
+	var instanceID string
+	var orphanInterval time.Duration
+	var tmpfsSize string
+	var storageSize string
+	var defaultRuntime string
+	var retention string
+	var tenantRetention string
+	var statsdAddr string
+	var statsdPrefix string
+	var otlpEndpoint string
+	var redisURL string
+	var wasmtime string
+	var wasmModules string
+	var wasmWorkDir string
+	var wasmFuel uint64
+	var wasmDiskMB int64
+	var firecracker string
+	var firecrackerKernel string
+	var firecrackerBootArgs string
+	var firecrackerRootfs string
+	var firecrackerWorkDir string
+	var firecrackerJailer string
+	var firecrackerUID int
+	var firecrackerUIDs int
+	var clusterURL string
+	var clusterMaxSessions int
+	var otlpHeaders string
+	var traceService string
+	var dockerConfig DockerConfig
+	var deployConcurrency int
+	var deployRetries int
+	var chaos string
+	var docsURL string
+	var imageGCPrefix string
+	var imageGCAfter time.Duration
+	var imageGCDangling bool
+	var dockerDiskPrune int64
+	var dockerDiskLimit int64
+	var maintenance string
+	var historyPath string
+	var recordingsPath string
+	var policyRules string
+	var policyWebhook string
+	var policyFailOpen bool
+	var auditSink string
+	var auditCode bool
+	var auditRedact string
+	var auditSample float64
+	var webhookURL string
+	var webhookSecret string
+	var webhookRetries int
+	var recordingsEndpoint string
+	var recordingsRegion string
+	var historyOutput int
+	var resultCacheTTL time.Duration
+	var maxRunTime time.Duration
+	var schedulesPath string
+	var storeURL string
+	var scheduleMaxDuration time.Duration
+	var scheduleConcurrency int
+	var maxSchedules int
+	var resultCacheSize int
+	var assignmentsPath string
+	var claimToken string
+	var churnSpike float64
+	var churnFailures float64
+	var costRates CostRates
+	var receiptKey string
+	var receiptKeyID string
+	var recordDiffs bool
+	var maxArtifactFile int64
+	var maxArtifactTotal int64
+	var backend string
+	var apiKeys string
+	var jwtAuth JWTAuthenticator
+	var jwtHMACKey string
+	var jwtRSAKey string
+	var idleTimeout time.Duration
+	var idleWarning time.Duration
+	var maxContainers int
+	var queueTimeout time.Duration
+	var tenantPriority string
+	var clientSessions int
+	var pairParticipants int
+	var quotaSessions int
+	var quotaSeconds float64
+	var gpuQuotaSessions int
+	var gpuQuotaSeconds float64
+	var clientRate float64
+	var clientBurst int
+	var trustedProxies string
+	var kubeNamespace string
+	var maxOutput int64
+	var outputRate int64
+	var outputBurst int64
+	var outputKill bool
+	conf.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&allowedOrigins, "allowed-origins", "", "comma-separated origins (e.g. https://repl.example.com or https://*.example.com, * for all) allowed to connect from browsers and make CORS requests (same origin only if empty)")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&instanceID, "instance-id", hostname, "ID of the server instance, with which its containers are labeled so that orphaned containers can be removed")
+	flag.DurationVar(&orphanInterval, "orphan-gc-interval", 10*time.Minute, "interval at which containers without a live session are removed (only at startup if zero)")
+	flag.StringVar(&locales, "locales", "C.UTF-8,en_US.UTF-8", "comma-separated list of locales which clients may request")
+	flag.StringVar(&timezones, "timezones", "UTC", "comma-separated list of timezones which clients may request")
+	flag.StringVar(&envAllow, "client-env-allow", "*", "comma-separated names (a trailing * matches any suffix) of environment variables which clients may set (none if empty)")
+	flag.StringVar(&envDeny, "client-env-deny", "", "comma-separated names of environment variables which clients may not set, in addition to those controlling the sandbox")
+	flag.IntVar(&gpuSessions, "gpu-sessions", 0, "maximum number of concurrent GPU sessions")
+	flag.IntVar(&gpuDevices, "gpus", 0, "number of GPUs of the Docker host, which are allocated to the GPU sessions requesting a number of GPUs")
+	flag.StringVar(&assetDir, "assets", "/var/lib/openrepl/assets", "directory on the Docker host containing language asset files")
+	flag.StringVar(&logDriver, "log-driver", "", "Docker log driver for session containers (daemon default if empty)")
+	flag.StringVar(&logFormat, "log-format", "text", "format of the server log (text, or json for log aggregators)")
+	flag.StringVar(&logOpts, "log-opts", "", "comma-separated key=value options for the log driver")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("OPENREPL_ADMIN_TOKEN"), "bearer token for admin endpoints (disabled if empty)")
+	flag.StringVar(&claimToken, "claim-token", os.Getenv("OPENREPL_CLAIM_TOKEN"), "bearer token for claiming warm containers (disabled if empty)")
+	flag.StringVar(&receiptKey, "receipt-key", os.Getenv("OPENREPL_RECEIPT_KEY"), "HMAC key signing execution receipts (disabled if empty)")
+	flag.StringVar(&receiptKeyID, "receipt-key-id", "", "identifier of the receipt key included in receipts")
+	flag.StringVar(&alertWebhook, "alert-webhook", "", "Slack-compatible webhook URL for error alerts (disabled if empty)")
+	flag.StringVar(&labels, "labels", "", "comma-separated key=value labels attached to every session container")
+	flag.Int64Var(&minFreeMem, "min-free-memory", 256, "minimum available host memory in MB required to start a session (ignored unless the Docker daemon runs on this host)")
+	flag.Int64Var(&minFreeDisk, "min-free-disk", 1024, "minimum free disk space in MB (on the filesystem containing /tmp) required to start a session")
+	flag.StringVar(&cpuset, "cpuset", "", "CPUs (e.g. \"2-7\") reserved for session containers (all CPUs if empty)")
+	flag.StringVar(&cgroupRoot, "cgroup-root", "", "path of the host cgroup v2 hierarchy, used for cgroup v2 controls with the cgroupfs driver of the Docker daemon (disabled if empty)")
+	flag.StringVar(&trafficControl, "traffic-control", "", "path of the tc binary used to limit the network rate of sessions, which requires running on the Docker host with CAP_NET_ADMIN (disabled if empty)")
+	flag.StringVar(&egressFirewall, "egress-firewall", "", "path of the iptables binary used to restrict the destinations of networked sessions, which requires running on the Docker host with CAP_NET_ADMIN (disabled if empty)")
+	flag.StringVar(&packageRepo, "package-repo", "", "image repository (e.g. openrepl/packages) in which the dependencies installed for runs are cached (dependencies disabled if empty)")
+	flag.DurationVar(&packageTTL, "package-ttl", 7*24*time.Hour, "time after which an unused image of installed dependencies is removed (kept if zero)")
+	flag.IntVar(&maxPackageImages, "max-package-images", 0, "maximum number of images of installed dependencies, beyond which the least recently used are removed (unlimited if zero)")
+	flag.StringVar(&egressAllow, "egress-allow", "", "comma-separated domains and CIDRs which networked languages without their own allow-list may reach (unrestricted if empty)")
+	flag.StringVar(&egressResolvers, "egress-resolvers", "", "comma-separated IPv4 addresses of the DNS servers which restricted sessions may query (nameservers of /etc/resolv.conf if empty)")
+	flag.BoolVar(&prepull, "prepull", false, "pull missing language images before accepting sessions")
+	flag.DurationVar(&prepullInterval, "prepull-interval", 0, "interval at which all language images are pulled again to pick up updated tags (disabled if zero)")
+	flag.BoolVar(&pullMissing, "pull-missing", true, "pull missing images when a session first uses them, sending the progress to the client")
+	flag.StringVar(&registryAuth, "registry-auth", "", "Docker config file with the credentials of private image registries ($DOCKER_CONFIG/config.json or ~/.docker/config.json if empty)")
+	flag.DurationVar(&pullTimeout, "pull-timeout", 10*time.Minute, "maximum duration of an image pull started by a session")
+	flag.DurationVar(&reloadInterval, "reload-interval", 0, "interval at which the language configuration is checked for changes and reloaded (only reloaded on SIGHUP or through the admin API if zero)")
+	flag.StringVar(&defaultRuntime, "runtime", "", "OCI runtime (e.g. runsc or kata-runtime) of languages which do not set one (daemon default if empty)")
+	flag.DurationVar(&workspaceTTL, "workspace-ttl", 0, "time for which a workspace shared between terminals and runs is kept after its last session ends (shared workspaces disabled if zero)")
+	flag.IntVar(&maxWorkspaces, "max-workspaces", 100, "maximum number of shared workspaces (unlimited if zero)")
+	flag.Int64Var(&workspaceSizeMB, "workspace-size", 256, "size limit of a shared workspace in MB")
+	flag.StringVar(&tmpfsSize, "tmpfs-size", "64m", "default size limit of tmpfs mounts in session containers")
+	flag.StringVar(&storageSize, "storage-size", "", "default size limit of the writable layer of session containers (requires a storage driver with quota support)")
+	flag.StringVar(&retention, "retention", "24h:", "retention policy of stored session data in maxage:maxbytes form")
+	flag.StringVar(&tenantRetention, "tenant-retention", "", "comma-separated tenant=maxage:maxbytes retention overrides")
+	flag.StringVar(&statsdAddr, "statsd", "", "address (host:port) of a StatsD server receiving metrics (disabled if empty)")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", "", "prefix of metric names sent to StatsD")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "URL of an OpenTelemetry collector receiving trace spans over OTLP/HTTP (e.g. http://localhost:4318/v1/traces; tracing disabled if empty)")
+	flag.StringVar(&otlpHeaders, "otlp-headers", "", "comma-separated key=value headers sent to the OpenTelemetry collector")
+	flag.StringVar(&wasmtime, "wasmtime", "", "path of the wasmtime binary running languages with the wasm backend (wasm backend disabled if empty)")
+	flag.StringVar(&wasmModules, "wasm-modules", "/var/lib/openrepl/wasm", "directory containing the WASI modules of languages using the wasm backend")
+	flag.StringVar(&wasmWorkDir, "wasm-workdir", "", "directory in which the sandbox directories of wasm sessions are created (system temporary directory if empty)")
+	flag.Uint64Var(&wasmFuel, "wasm-fuel", 0, "amount of fuel (roughly WebAssembly instructions) a wasm module may consume (disabled if zero)")
+	flag.Int64Var(&wasmDiskMB, "wasm-disk", 64, "size limit in MB of the sandbox directory of wasm sessions whose language sets no workspace size (disabled if zero)")
+	flag.StringVar(&firecracker, "firecracker", "", "path of the firecracker binary running languages with the firecracker backend (firecracker backend disabled if empty)")
+	flag.StringVar(&firecrackerKernel, "firecracker-kernel", "/var/lib/openrepl/firecracker/vmlinux", "path of the guest kernel of microVMs")
+	flag.StringVar(&firecrackerBootArgs, "firecracker-boot-args", "init=/sbin/openrepl-init", "additional kernel command line arguments of microVMs")
+	flag.StringVar(&firecrackerRootfs, "firecracker-rootfs", "/var/lib/openrepl/firecracker", "directory containing the root filesystem images of languages using the firecracker backend")
+	flag.StringVar(&firecrackerWorkDir, "firecracker-workdir", "", "base directory of the chroots of microVMs, on the filesystem of the kernel and root filesystem images (system temporary directory if empty)")
+	flag.StringVar(&firecrackerJailer, "firecracker-jailer", "/usr/bin/jailer", "path of the jailer binary starting microVMs")
+	flag.IntVar(&firecrackerUID, "firecracker-uid", 100000, "first user and group ID of microVMs, each of which runs as an ID of its own")
+	flag.IntVar(&firecrackerUIDs, "firecracker-uids", 1000, "number of user IDs of microVMs, which limits the number of microVMs")
+	flag.StringVar(&redisURL, "redis", "", "URL of the Redis server coordinating a cluster of instances (e.g. redis://:password@redis:6379/0; clustering disabled if empty)")
+	flag.StringVar(&clusterURL, "cluster-url", "", "base URL at which other instances of the cluster reach this one (e.g. http://10.0.0.5:8080)")
+	flag.IntVar(&clusterMaxSessions, "cluster-max-sessions", 0, "maximum number of sessions across the cluster (unlimited if zero)")
+	flag.StringVar(&traceService, "trace-service", "openrepl", "service name of exported trace spans")
+	flag.StringVar(&dockerConfig.Host, "docker-host", "", "address of the Docker or Podman daemon (DOCKER_HOST, or CONTAINER_HOST with podman, if empty)")
+	flag.StringVar(&dockerConfig.APIVersion, "docker-api-version", "", "Docker API version")
+	flag.StringVar(&dockerConfig.TLSCA, "docker-tls-ca", "", "CA certificate used to verify the Docker daemon")
+	flag.StringVar(&dockerConfig.TLSCert, "docker-tls-cert", "", "client certificate used to authenticate to the Docker daemon")
+	flag.StringVar(&dockerConfig.TLSKey, "docker-tls-key", "", "client key used to authenticate to the Docker daemon")
+	flag.DurationVar(&dockerConfig.DialTimeout, "docker-dial-timeout", 0, "timeout for connecting to the Docker daemon (none if zero)")
+	flag.IntVar(&dockerConfig.MaxIdleConns, "docker-max-idle-conns", 100, "maximum number of idle connections to the Docker daemon")
+	flag.DurationVar(&dockerConfig.IdleConnTimeout, "docker-idle-timeout", 90*time.Second, "time after which idle Docker connections are closed")
+	flag.IntVar(&deployConcurrency, "deploy-concurrency", 8, "maximum number of concurrent container deployments (unlimited if zero)")
+	flag.IntVar(&deployRetries, "deploy-retries", 2, "number of times a deployment is retried after a transient daemon error")
+	flag.StringVar(&docsURL, "docs-url", "", "base URL of the error code documentation linked from error statuses (disabled if empty)")
+	flag.StringVar(&imageGCPrefix, "image-gc-prefix", "openrepl/", "repository prefix of the images removed by image garbage collection")
+	flag.DurationVar(&imageGCAfter, "image-gc-after", 0, "time after which unreferenced images are removed (disabled if zero)")
+	flag.BoolVar(&imageGCDangling, "image-gc-dangling", false, "also remove untagged images in image garbage collection")
+	flag.Int64Var(&dockerDiskPrune, "docker-disk-prune", 0, "Docker disk usage in MB above which unused data is pruned (disabled if zero)")
+	flag.Int64Var(&dockerDiskLimit, "docker-disk-limit", 0, "Docker disk usage in MB above which new sessions are rejected (disabled if zero)")
+	flag.StringVar(&maintenance, "maintenance", "", "comma-separated day@hh:mm/duration maintenance windows in UTC (e.g. sun@03:00/1h or daily@04:30/30m)")
+	flag.StringVar(&policyRules, "policy-rules", "", "JSON file of size and pattern rules against which run submissions are checked (disabled if empty)")
+	flag.StringVar(&policyWebhook, "policy-webhook", "", "URL of a webhook which accepts or rejects run submissions (disabled if empty)")
+	flag.BoolVar(&policyFailOpen, "policy-fail-open", false, "run submissions when the policy webhook fails, rather than rejecting them")
+	flag.StringVar(&auditSink, "audit", "", "file path, \"syslog\" or webhook URL to which the executed code is audited (disabled if empty)")
+	flag.BoolVar(&auditCode, "audit-code", false, "include the code itself in audit records, rather than only its hash")
+	flag.StringVar(&auditRedact, "audit-redact", "", "regular expression matching the parts of audited code which are redacted")
+	flag.Float64Var(&auditSample, "audit-sample", 1, "fraction of sessions which are audited")
+	flag.StringVar(&webhookURL, "webhook", "", "URL of a webhook notified of the start, completion, timeout and failure of sessions (disabled if empty)")
+	flag.StringVar(&webhookSecret, "webhook-secret", os.Getenv("OPENREPL_WEBHOOK_SECRET"), "HMAC key signing webhook notifications (unsigned if empty)")
+	flag.IntVar(&webhookRetries, "webhook-retries", 5, "number of times a failed webhook notification is retried with exponential backoff")
+	flag.StringVar(&recordingsPath, "recordings", "", "directory or s3://bucket/prefix URL in which terminal recordings are stored (disabled if empty)")
+	flag.StringVar(&recordingsEndpoint, "recordings-s3-endpoint", "https://s3.amazonaws.com", "endpoint of the S3-compatible service storing recordings")
+	flag.StringVar(&recordingsRegion, "recordings-s3-region", "us-east-1", "region of the S3 bucket storing recordings")
+	flag.StringVar(&historyPath, "history", "", "path of the file storing the history of completed runs (disabled if empty)")
+	flag.StringVar(&schedulesPath, "schedules", "", "JSON file in which scheduled snippet runs are saved (scheduling disabled if empty)")
+	flag.StringVar(&storeURL, "store-url", "http://store", "base URL of the code store from which scheduled snippets are loaded")
+	flag.DurationVar(&scheduleMaxDuration, "schedule-max-duration", 5*time.Minute, "maximum duration of a scheduled run")
+	flag.IntVar(&scheduleConcurrency, "schedule-concurrency", 2, "maximum number of concurrent scheduled runs of each tenant")
+	flag.IntVar(&maxSchedules, "max-schedules", 20, "maximum number of schedules of each tenant (unlimited if 0)")
+	flag.DurationVar(&maxRunTime, "max-run-time", 10*time.Minute, "maximum time for which a run may execute before its container is killed (unlimited if 0)")
+	flag.DurationVar(&resultCacheTTL, "result-cache-ttl", 0, "time for which results of graded submissions are cached and reused for identical submissions (disabled if 0)")
+	flag.IntVar(&resultCacheSize, "result-cache-size", 10000, "maximum number of cached results of graded submissions")
+	flag.IntVar(&historyOutput, "history-output", 4096, "maximum number of output bytes stored for each run in the history")
+	flag.StringVar(&assignmentsPath, "assignments", "", "path of the file storing assignments (kept in memory if empty)")
+	flag.Float64Var(&churnSpike, "churn-spike", 3, "ratio to the average container creation rate above which a churn alert is raised (disabled if zero)")
+	flag.Float64Var(&churnFailures, "churn-failure-ratio", 0.5, "ratio of failed deployments to created containers above which an alert is raised (disabled if zero)")
+	flag.Float64Var(&costRates.CPU, "cost-cpu", 0, "price of a CPU-second used by a session")
+	flag.Float64Var(&costRates.Memory, "cost-memory", 0, "price of a GB-second of memory used by a session")
+	flag.Float64Var(&costRates.Duration, "cost-duration", 0, "price of a second of session time (cost accounting is disabled if all prices are zero)")
+	flag.Int64Var(&maxArtifactFile, "max-artifact-size", 8, "maximum size in MB of a single artifact collected from a run (unlimited if zero)")
+	flag.Int64Var(&maxArtifactTotal, "max-artifact-total", 16, "maximum total size in MB of the artifacts collected from a run")
+	flag.Int64Var(&maxOutput, "max-output", 0, "maximum output in MB sent to the client in a session (unlimited if zero)")
+	flag.Int64Var(&outputRate, "output-rate", 0, "maximum output rate in KB per second of a session (unlimited if zero)")
+	flag.Int64Var(&outputBurst, "output-burst", 0, "number of output KB which a session may send at once above the output rate")
+	flag.BoolVar(&outputKill, "output-limit-kill", false, "kill programs whose output exceeds a limit instead of truncating the output")
+	flag.BoolVar(&recordDiffs, "record-diffs", false, "record the filesystem changes of every run in the event log and metrics")
+	flag.IntVar(&quotaSessions, "quota-sessions-per-hour", 0, "maximum number of sessions each authenticated principal may start per hour (unlimited if zero)")
+	flag.Float64Var(&quotaSeconds, "quota-seconds-per-day", 0, "maximum execution time in seconds of the sessions of each authenticated principal per day (unlimited if zero)")
+	flag.IntVar(&gpuQuotaSessions, "gpu-quota-sessions-per-hour", 0, "maximum number of GPU sessions each authenticated principal may start per hour (unlimited if zero)")
+	flag.Float64Var(&gpuQuotaSeconds, "gpu-quota-seconds-per-day", 0, "maximum execution time in seconds of the GPU sessions of each authenticated principal per day (unlimited if zero)")
+	flag.IntVar(&pairParticipants, "pair-participants", 8, "maximum number of clients attached to a pair-programming session, including the host (unlimited if zero)")
+	flag.IntVar(&clientSessions, "client-sessions", 0, "maximum number of concurrent sessions per client IP address (unlimited if zero)")
+	flag.Float64Var(&clientRate, "client-rate", 0, "number of sessions per minute which a client IP address may start (unlimited if zero)")
+	flag.IntVar(&clientBurst, "client-burst", 5, "number of sessions which a client IP address may start at once")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "comma-separated CIDRs of reverse proxies whose X-Forwarded-For headers identify clients")
+	flag.IntVar(&maxContainers, "max-containers", 0, "maximum number of session containers, beyond which sessions are queued (unlimited if zero)")
+	flag.DurationVar(&queueTimeout, "queue-timeout", 5*time.Minute, "maximum time a session waits for capacity")
+	flag.StringVar(&tenantPriority, "tenant-priority", "", "comma-separated tenant=priority pairs ordering the capacity queue (higher first, 0 by default)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 30*time.Minute, "time without input or output after which terminal sessions are closed (disabled if zero)")
+	flag.DurationVar(&idleWarning, "idle-warning", time.Minute, "time before closing an idle session at which the client is warned")
+	flag.StringVar(&apiKeys, "api-keys", "", "JSON file of API keys accepted for sessions")
+	flag.StringVar(&jwtHMACKey, "jwt-hmac-key", "", "file containing the key of HS256 tokens accepted for sessions")
+	flag.StringVar(&jwtRSAKey, "jwt-rsa-key", "", "PEM file containing the public key of RS256 tokens accepted for sessions")
+	flag.StringVar(&jwtAuth.Issuer, "jwt-issuer", "", "required issuer of session tokens (not checked if empty)")
+	flag.StringVar(&jwtAuth.Audience, "jwt-audience", "", "required audience of session tokens (not checked if empty)")
+	flag.StringVar(&jwtAuth.TenantClaim, "jwt-tenant-claim", "tenant", "claim of session tokens containing the tenant of the client")
+	flag.DurationVar(&jwtAuth.Leeway, "jwt-leeway", time.Minute, "clock skew tolerated when checking the expiry of session tokens")
+	flag.StringVar(&backend, "backend", os.Getenv("OPENREPL_BACKEND"), "container backend on which sessions run (docker, podman or kubernetes; docker if empty)")
+	flag.StringVar(&kubeNamespace, "kube-namespace", "", "namespace in which session pods are created by the kubernetes backend (namespace of the server if empty)")
+	flag.StringVar(&chaos, "chaos", "", "comma-separated key=value failure injection options for development (deploy_delay, attach_fail, kill, kill_window, drop)")
+	err := parseFlags(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		panic(err)
+	}
+	err = setLogFormat(logFormat, os.Stderr)
 	if err != nil {
 		panic(err)
 	}
+
+	// parse retention policies
+	defaultRetention, err := parseRetentionPolicy(retention)
+	if err != nil {
+		panic(err)
+	}
+	tenantRetentions, err := parseTenantRetention(tenantRetention)
+	if err != nil {
+		panic(err)
+	}
+
+	// parse client limits
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		panic(err)
+	}
+	if clientBurst < 1 {
+		clientBurst = 1
+	}
+
+	// parse queue priorities
+	priorities, err := parseTenantPriorities(tenantPriority)
+	if err != nil {
+		panic(err)
+	}
+
+	// load credentials of session clients
+	var auth Authenticators
+	if apiKeys != "" {
+		keys, err := LoadAPIKeys(apiKeys)
+		if err != nil {
+			panic(err)
+		}
+		auth = append(auth, keys)
+	}
+	if jwtHMACKey != "" || jwtRSAKey != "" {
+		if jwtHMACKey != "" {
+			key, err := ioutil.ReadFile(jwtHMACKey)
+			if err != nil {
+				panic(err)
+			}
+			jwtAuth.HMACKey = bytes.TrimSpace(key)
+		}
+		if jwtRSAKey != "" {
+			jwtAuth.RSAKey, err = LoadRSAPublicKey(jwtRSAKey)
+			if err != nil {
+				panic(err)
+			}
+		}
+		auth = append(auth, &jwtAuth)
+	}
+
+	// parse maintenance windows
+	windows, err := parseMaintenanceWindows(maintenance)
+	if err != nil {
+		panic(err)
+	}
+
+	// parse failure injection options
+	chaosConfig, err := parseChaos(chaos)
+	if err != nil {
+		panic(err)
+	}
+	if chaosConfig != nil {
+		serverLog.Printf("chaos mode enabled: failures will be injected")
+	}
+
+	// export metrics to StatsD
+	if statsdAddr != "" {
+		sink, err := NewStatsdSink(statsdAddr, statsdPrefix)
+		if err != nil {
+			panic(err)
+		}
+		metrics.AddSink(sink)
+	}
+
+	// connect to the container backend
+	var dcli *client.Client
+	var kube *KubernetesBackend
+	switch backend {
+	case "", "docker", "podman":
+		dockerConfig.Podman = backend == "podman"
+		dcli, err = dockerConfig.NewClient()
+		if err != nil {
+			panic(err)
+		}
+	case "kubernetes":
+		kube, err = NewInClusterBackend(kubeNamespace)
+		if err != nil {
+			panic(err)
+		}
+		if cpuset != "" {
+			panic("cpusets are not supported by the kubernetes backend")
+		}
+		if cgroupRoot != "" || trafficControl != "" || egressFirewall != "" || packageRepo != "" || workspaceTTL > 0 || prepull || prepullInterval > 0 || imageGCAfter > 0 || dockerDiskPrune > 0 || dockerDiskLimit > 0 ||
+			len(windows) > 0 || recordDiffs || costRates != (CostRates{}) {
+			panic("cgroup and traffic controls, dependency installation, shared workspaces, image management, disk monitoring, maintenance, diff recording and cost accounting require the docker backend")
+		}
+	case "containerd":
+		panic("containerd has no Docker-compatible API; run sessions on containerd through the kubernetes backend")
+	default:
+		panic("unknown container backend " + backend)
+	}
+
+	// load the credentials of private registries
+	var registries *RegistryAuth
+	if dcli != nil {
+		path := registryAuth
+		if path == "" {
+			path = defaultDockerConfig()
+		}
+		registries, err = LoadRegistryAuth(path)
+		if err != nil && (registryAuth != "" || !os.IsNotExist(err)) {
+			panic(err)
+		}
+	}
+
 	srv := &ContainerServer{
 		SessionConfig: ContainerSessionConfig{
-			OutputBufferSize:     1024,
-			ShutdownTimeout:      10 * time.Second,
+			OutputBufferSize:     conf.OutputBufferSize,
+			ShutdownTimeout:      conf.ShutdownTimeout,
 			DockerClient:         dcli,
-			ContainerStopTimeout: time.Minute,
-			StartTimeout:         time.Minute,
-			SessionTimeout:       time.Hour,
-			PingRate:             30 * time.Second,
+			Registries:           registries,
+			Chaos:                chaosConfig,
+			DocsBaseURL:          docsURL,
+			Polls:                &PollStore{Timeout: conf.PollTimeout},
+			EvalSessions:         &EvalSessionStore{IdleTimeout: conf.EvalIdleTimeout},
+			DeployRetries:        deployRetries,
+			ContainerStopTimeout: conf.ContainerStopTimeout,
+			StartTimeout:         conf.StartTimeout,
+			SessionTimeout:       conf.SessionTimeout,
+			IdleTimeout:          idleTimeout,
+			IdleWarning:          idleWarning,
+			MaxRunTime:           maxRunTime,
+			PingRate:             conf.PingRate,
+			PongTimeout:          conf.PongTimeout,
+			WriteTimeout:         conf.WriteTimeout,
+			MaxMessageSize:       conf.MaxMessageSize,
+			Artifacts:            &ArtifactStore{TTL: conf.ArtifactTTL},
+			MaxArtifactBytes:     maxArtifactTotal << 20,
+			MaxArtifactFileBytes: maxArtifactFile << 20,
+			RecordDiffs:          recordDiffs,
+			EventLogs: &EventLogStore{
+				Max: conf.MaxEventLogs,
+				Retention: &Retention{
+					Default: defaultRetention,
+					Tenants: tenantRetentions,
+				},
+			},
+			Sessions:         &SessionRegistry{},
+			PairParticipants: pairParticipants,
+			Capacity:         &CapacityQueue{Max: maxContainers},
+			QueueTimeout:     queueTimeout,
+			TenantPriorities: priorities,
+			Clients: &ClientLimiter{
+				MaxSessions:    clientSessions,
+				Rate:           clientRate / 60,
+				Burst:          clientBurst,
+				TrustedProxies: proxies,
+			},
+			Resources: &ResourceGuard{
+				MinFreeMemory: minFreeMem << 20,
+				MinFreeDisk:   minFreeDisk << 20,
+				DiskPath:      "/tmp",
+			},
+		},
+		Locales:           strings.Split(locales, ","),
+		Timezones:         strings.Split(timezones, ","),
+		Env:               parseEnvPolicy(envAllow, envDeny),
+		MaxBenchmarkRuns:  conf.MaxBenchmarkRuns,
+		DeterministicTime: conf.DeterministicTime,
+		AdminToken:        adminToken,
+		ClaimToken:        claimToken,
+		Claims:            &ClaimStore{TTL: conf.ClaimTTL, Max: conf.MaxClaims},
+	}
+	if len(auth) > 0 {
+		srv.Auth = auth
+	}
+
+	// the memory of this host is not the memory of a remote daemon, which has no API reporting its available memory
+	if kube != nil || (dcli != nil && !dockerConfig.Local()) {
+		if minFreeMem > 0 {
+			serverLog.Printf("ignoring -min-free-memory, as containers do not run on this host")
+		}
+		srv.SessionConfig.Resources.MinFreeMemory = 0
+	}
+
+	if quotaSessions > 0 || quotaSeconds > 0 {
+		srv.SessionConfig.Quotas = &Quotas{
+			SessionsPerHour: quotaSessions,
+			SecondsPerDay:   quotaSeconds,
+			Store:           &MemQuotaStore{},
+		}
+	}
+	if gpuQuotaSessions > 0 || gpuQuotaSeconds > 0 {
+		srv.SessionConfig.GPUQuotas = &Quotas{
+			SessionsPerHour: gpuQuotaSessions,
+			SecondsPerDay:   gpuQuotaSeconds,
+			Store:           &MemQuotaStore{},
+		}
+	}
+	if conf.ResumeGrace > 0 {
+		srv.SessionConfig.Resumes = &ResumeStore{Grace: conf.ResumeGrace}
+	}
+	if dcli != nil && pullMissing {
+		srv.SessionConfig.Pulls = &ImagePuller{Client: dcli, Auth: registries, Timeout: pullTimeout}
+	}
+	if maxOutput > 0 || outputRate > 0 {
+		srv.SessionConfig.Output = &OutputLimit{
+			MaxBytes: maxOutput << 20,
+			Rate:     outputRate << 10,
+			Burst:    outputBurst << 10,
+			Kill:     outputKill,
+		}
+	}
+	if deployConcurrency > 0 {
+		srv.SessionConfig.DeploySlots = make(semaphore, deployConcurrency)
+	}
+	if gpuSessions > 0 {
+		srv.SessionConfig.GPUs = &GPUPool{Sessions: gpuSessions, Devices: gpuDevices, Scheduled: kube != nil}
+	}
+	srv.SessionConfig.Alerts = &Alerter{
+		URL:      alertWebhook,
+		Window:   5 * time.Minute,
+		Cooldown: 30 * time.Minute,
+		Thresholds: map[string]int{
+			"deploy_failure":       10,
+			"daemon_unreachable":   2,
+			"orphans_removed":      20,
+			"fallback_image":       1,
+			"container_churn":      1,
+			"deploy_failure_ratio": 1,
 		},
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if kube != nil {
+		kube.StopTimeout = srv.SessionConfig.ContainerStopTimeout
+		kube.MaxLifetime = srv.SessionConfig.SessionTimeout + srv.SessionConfig.ContainerStopTimeout
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = kube.CheckNetworkPolicy(ctx)
+		cancel()
+		if err != nil {
+			panic(err)
+		}
+		srv.SessionConfig.Backend = kube
+	} else {
+		srv.SessionConfig.Daemon = &DockerHost{Name: "default", Client: dcli}
+	}
+
+	// detect the platform used by the daemon
+	// kubernetes session pods are scheduled on linux nodes of the server architecture
+	info := types.Info{OSType: "linux", Architecture: runtime.GOARCH}
+	if dcli != nil {
+		info, err = dcli.Info(context.Background())
+		if err != nil {
+			panic(err)
+		}
+	}
+	srv.SessionConfig.DaemonOS = info.OSType
+	srv.SessionConfig.DaemonArch = normalizeArch(info.Architecture)
+
+	// use cgroup v2 controls if available
+	if cgroupRoot != "" {
+		cgfs, err := openCgroupFS(cgroupRoot, info.CgroupDriver)
+		if err != nil {
+			serverLog.Errorf("cgroup v2 controls disabled: %s", err.Error())
+		}
+		srv.SessionConfig.Cgroups = cgfs
+	}
+
+	// limit network rates with tc if enabled
+	if trafficControl != "" {
+		srv.SessionConfig.Traffic = &TrafficShaper{Command: trafficControl}
+	}
+
+	// restrict the egress of networked sessions with iptables if enabled
+	if egressFirewall != "" {
+		resolvers := splitNames(egressResolvers)
+		if len(resolvers) == 0 {
+			resolvers, err = readResolvers("/etc/resolv.conf")
+			if err != nil {
+				panic(err)
+			}
+		}
+		srv.SessionConfig.Egress = &EgressFirewall{Command: egressFirewall, Default: splitNames(egressAllow), Resolvers: resolvers}
+	}
+
+	// install the dependencies of runs into cached images if enabled
+	if packageRepo != "" {
+		if srv.SessionConfig.Egress == nil {
+			panic("dependency installation requires the egress firewall (-egress-firewall)")
+		}
+		srv.SessionConfig.Packages = &PackageCache{
+			Client:     dcli,
+			Repository: packageRepo,
+			Egress:     srv.SessionConfig.Egress,
+			TTL:        packageTTL,
+			MaxImages:  maxPackageImages,
+		}
+		if packageTTL > 0 || maxPackageImages > 0 {
+			go srv.SessionConfig.Packages.Run(time.Hour)
+		}
+	}
+
+	// coordinate with the other instances of the cluster if enabled
+	if redisURL != "" {
+		rcli, err := ParseRedisURL(redisURL)
+		if err != nil {
+			panic(err)
+		}
+		srv.SessionConfig.Cluster = &Cluster{
+			Redis:       rcli,
+			Prefix:      "openrepl:",
+			Node:        instanceID,
+			URL:         clusterURL,
+			Platform:    srv.SessionConfig.Platform(),
+			TTL:         30 * time.Second,
+			MaxSessions: clusterMaxSessions,
+			Sessions:    srv.SessionConfig.Sessions,
+		}
+		go srv.SessionConfig.Cluster.Run()
+	}
+
+	// trace the session lifecycle if enabled
+	if otlpEndpoint != "" {
+		srv.SessionConfig.Tracer = &Tracer{
+			Endpoint: otlpEndpoint,
+			Headers:  parseKeyValues(otlpHeaders),
+			Service:  traceService,
+			Client:   &http.Client{Timeout: 10 * time.Second},
+		}
+		go srv.SessionConfig.Tracer.Run(5 * time.Second)
+	}
+
+	// load languages, labeling containers with the server instance
+	containerLabels := parseKeyValues(labels)
+	if containerLabels == nil {
+		containerLabels = make(map[string]string)
+	}
+	containerLabels[labelServer] = instanceID
+	defaults := ContainerDefaults{
+		AssetDir:    assetDir,
+		LogDriver:   logDriver,
+		LogOpts:     parseKeyValues(logOpts),
+		Labels:      containerLabels,
+		Cpuset:      cpuset,
+		TmpfsSize:   tmpfsSize,
+		StorageSize: storageSize,
+		Runtime:     defaultRuntime,
+	}
+	srv.Languages = &LanguageLoader{
+		Path:       conf.LanguagesPath,
+		OSType:     info.OSType,
+		Arch:       srv.SessionConfig.DaemonArch,
+		Defaults:   defaults,
+		Kubernetes: kube != nil,
 	}
-	f, err := os.Open("langs.json")
+	if dcli != nil {
+		srv.Languages.Runtimes = info.Runtimes
+		if srv.Languages.Runtimes == nil {
+			srv.Languages.Runtimes = map[string]types.Runtime{}
+		}
+	}
+
+	// run languages compiled to WebAssembly in wasmtime if enabled
+	if wasmtime != "" {
+		wasm := &WasmBackend{
+			Command:     wasmtime,
+			ModuleDir:   wasmModules,
+			WorkDir:     wasmWorkDir,
+			Fuel:        wasmFuel,
+			DiskLimit:   wasmDiskMB << 20,
+			StopTimeout: srv.SessionConfig.ContainerStopTimeout,
+		}
+		err = wasm.Clean()
+		if err != nil {
+			serverLog.Errorf("failed to remove leftover wasm sandboxes: %s", err.Error())
+		}
+		srv.SessionConfig.Backends = map[string]ContainerBackend{"wasm": wasm}
+		srv.Languages.Backends = map[string]bool{"wasm": true}
+	}
+
+	// run languages in Firecracker microVMs if enabled
+	if firecracker != "" {
+		if firecrackerJailer == "" || firecrackerUID <= 0 || firecrackerUIDs <= 0 {
+			panic("the firecracker backend requires the jailer (-firecracker-jailer) and unprivileged user IDs (-firecracker-uid, -firecracker-uids)")
+		}
+		fc := &FirecrackerBackend{
+			Command:     firecracker,
+			Jailer:      firecrackerJailer,
+			UID:         firecrackerUID,
+			UIDs:        firecrackerUIDs,
+			Kernel:      firecrackerKernel,
+			BootArgs:    firecrackerBootArgs,
+			RootfsDir:   firecrackerRootfs,
+			WorkDir:     firecrackerWorkDir,
+			StopTimeout: srv.SessionConfig.ContainerStopTimeout,
+		}
+		err = fc.Clean()
+		if err != nil {
+			serverLog.Errorf("failed to remove leftover microVM directories: %s", err.Error())
+		}
+		if srv.SessionConfig.Backends == nil {
+			srv.SessionConfig.Backends = map[string]ContainerBackend{}
+			srv.Languages.Backends = map[string]bool{}
+		}
+		srv.SessionConfig.Backends["firecracker"] = fc
+		srv.Languages.Backends["firecracker"] = true
+	}
+	srv.Containers, err = srv.Languages.Load()
 	if err != nil {
 		panic(err)
 	}
-	err = json.NewDecoder(f).Decode(&srv.Containers)
+
+	// reload languages on SIGHUP, and when the file changes if enabled
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			srv.ReloadLanguages()
+		}
+	}()
+	if reloadInterval > 0 {
+		go srv.WatchLanguages(reloadInterval)
+	}
+
+	// remove containers left behind by a previous run of this instance
+	if dcli != nil {
+		srv.SessionConfig.Orphans = &OrphanCollector{
+			Client:   dcli,
+			Instance: instanceID,
+			Grace:    2 * conf.StartTimeout,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = srv.SessionConfig.Orphans.Collect(ctx, 0)
+		cancel()
+		if err != nil {
+			serverLog.Errorf("failed to remove orphaned containers: %s", err.Error())
+		}
+		if orphanInterval > 0 {
+			go srv.SessionConfig.Orphans.Run(orphanInterval)
+		}
+	}
+
+	// share workspaces between the terminals and runs of a client
+	if dcli != nil && workspaceTTL > 0 {
+		if workspaceSizeMB <= 0 {
+			panic("shared workspaces require a size limit (-workspace-size)")
+		}
+		srv.SessionConfig.Workspaces = &WorkspaceStore{
+			Client:   dcli,
+			TTL:      workspaceTTL,
+			Max:      maxWorkspaces,
+			Size:     workspaceSizeMB << 20,
+			Instance: instanceID,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = srv.SessionConfig.Workspaces.RemoveOrphans(ctx)
+		cancel()
+		if err != nil {
+			serverLog.Errorf("failed to remove orphaned workspaces: %s", err.Error())
+		}
+		go srv.SessionConfig.Workspaces.Run(time.Minute)
+	}
+
+	// pull missing images before accepting sessions, so that no session waits on a cold pull
+	if prepull {
+		for _, res := range srv.pullImages(context.Background(), PullRequest{Missing: true}) {
+			if res.Status == "pulled" {
+				serverLog.Printf("pulled image %s in %.1fs", res.Image, res.Duration)
+			}
+		}
+	}
+	if prepullInterval > 0 {
+		go srv.RunPrepull(prepullInterval)
+	}
+
+	// monitor disk usage of the daemon
+	if dockerDiskPrune > 0 || dockerDiskLimit > 0 {
+		srv.SessionConfig.Resources.Docker = &DiskMonitor{
+			Client:      dcli,
+			PruneAbove:  dockerDiskPrune << 20,
+			RejectAbove: dockerDiskLimit << 20,
+		}
+		go srv.SessionConfig.Resources.Docker.Run(time.Minute)
+	}
+
+	// remove images which are no longer used
+	if imageGCAfter > 0 {
+		var refs []string
+		for img := range languageImages(srv.Containers) {
+			refs = append(refs, img)
+		}
+		srv.ImageGC = &ImageGC{
+			Client:     dcli,
+			Prefix:     imageGCPrefix,
+			Dangling:   imageGCDangling,
+			MaxUnused:  imageGCAfter,
+			Referenced: refs,
+		}
+		go srv.ImageGC.Run(time.Hour)
+	}
+
+	// perform scheduled maintenance
+	go srv.RunMaintenance(windows)
+
+	// keep the history of completed runs
+	if historyPath != "" {
+		history, err := OpenJobHistory(historyPath, historyOutput)
+		if err != nil {
+			panic(err)
+		}
+		history.Retention = srv.SessionConfig.EventLogs.Retention
+		srv.SessionConfig.History = history
+		go func() {
+			for now := range time.Tick(time.Hour) {
+				err := history.Clean(now)
+				if err != nil {
+					serverLog.Errorf("failed to clean job history: %s", err.Error())
+				}
+			}
+		}()
+	}
+
+	// check submissions before running them
+	if policyRules != "" {
+		rules, err := LoadRulePolicy(policyRules)
+		if err != nil {
+			panic(err)
+		}
+		srv.SessionConfig.Policy = append(srv.SessionConfig.Policy, rules)
+	}
+	if policyWebhook != "" {
+		srv.SessionConfig.Policy = append(srv.SessionConfig.Policy, &WebhookPolicy{
+			URL:      policyWebhook,
+			Client:   &http.Client{Timeout: policyTimeout},
+			FailOpen: policyFailOpen,
+		})
+	}
+
+	// audit executed code
+	if auditSink != "" {
+		sink, err := openAuditSink(auditSink)
+		if err != nil {
+			panic(err)
+		}
+		srv.SessionConfig.Audit = &Auditor{Sink: sink, IncludeCode: auditCode, SampleRate: auditSample}
+		if auditRedact != "" {
+			srv.SessionConfig.Audit.Redact, err = regexp.Compile(auditRedact)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	// notify the webhook of session lifecycle events
+	if webhookURL != "" {
+		srv.SessionConfig.Webhooks = NewWebhooks(webhookURL, []byte(webhookSecret), webhookQueueSize)
+		srv.SessionConfig.Webhooks.Retries = webhookRetries
+		go srv.SessionConfig.Webhooks.Run()
+	}
+
+	// record terminal sessions
+	switch {
+	case strings.HasPrefix(recordingsPath, "s3://"):
+		store, err := parseS3URL(recordingsPath)
+		if err != nil {
+			panic(err)
+		}
+		store.Endpoint, store.Region = recordingsEndpoint, recordingsRegion
+		store.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		store.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		store.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		store.Client = &http.Client{Timeout: time.Minute}
+		srv.SessionConfig.Recordings = store
+	case recordingsPath != "":
+		err := os.MkdirAll(recordingsPath, 0700)
+		if err != nil {
+			panic(err)
+		}
+		srv.SessionConfig.Recordings = DirRecordingStore{Dir: recordingsPath}
+	}
+
+	// reuse results of identical graded submissions
+	if resultCacheTTL > 0 {
+		srv.SessionConfig.Results = &ResultCache{TTL: resultCacheTTL, MaxEntries: resultCacheSize}
+	}
+
+	// sign execution receipts
+	if receiptKey != "" {
+		srv.SessionConfig.Receipts = &ReceiptSigner{KeyID: receiptKeyID, Key: []byte(receiptKey)}
+	}
+
+	// account for session costs
+	if costRates != (CostRates{}) {
+		srv.SessionConfig.Costs = &CostLedger{Rates: costRates}
+	}
+
+	// load assignments
+	srv.Assignments, err = OpenAssignmentStore(assignmentsPath)
 	if err != nil {
 		panic(err)
 	}
-	http.HandleFunc("/term", srv.HandleTerminal)
-	http.HandleFunc("/run", srv.HandleRun)
-	panic(http.ListenAndServe(":80", nil))
+
+	// run saved snippets on schedules
+	var scheduler *Scheduler
+	if schedulesPath != "" {
+		if srv.Auth == nil {
+			panic("scheduling requires authentication (-api-keys or -jwt-*)")
+		}
+		store, err := OpenScheduleStore(schedulesPath)
+		if err != nil {
+			panic(err)
+		}
+		scheduler = &Scheduler{
+			Store:         store,
+			Server:        srv,
+			StoreURL:      storeURL,
+			MaxDuration:   scheduleMaxDuration,
+			MaxConcurrent: scheduleConcurrency,
+			MaxSchedules:  maxSchedules,
+			Client:        &http.Client{Timeout: 30 * time.Second},
+		}
+		go scheduler.Run()
+	}
+
+	// clean up expired session data
+	go srv.SessionConfig.EventLogs.RunCleaner(time.Minute)
+	go srv.SessionConfig.Artifacts.RunCleaner(time.Minute)
+	go srv.SessionConfig.Polls.Run(10 * time.Second)
+
+	// watch for abnormal container churn
+	churn := &ChurnMonitor{
+		Window:          5 * time.Minute,
+		SpikeFactor:     churnSpike,
+		MaxFailureRatio: churnFailures,
+		MinCreates:      20,
+		Alerts:          srv.SessionConfig.Alerts,
+	}
+	go churn.Run()
+
+	// watch for daemon outages
+	if srv.SessionConfig.Daemon != nil {
+		go monitorDaemon(srv.SessionConfig.Daemon, 30*time.Second, srv.SessionConfig.Alerts)
+	}
+
+	srv.register(http.DefaultServeMux, srv.routes(scheduler))
+
+	// drain sessions on SIGTERM or SIGINT, exiting immediately on a second signal
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-term
+		go func() {
+			<-term
+			serverLog.Printf("forced exit")
+			os.Exit(1)
+		}()
+		srv.Shutdown(conf.DrainTimeout)
+		fctx, fcancel := context.WithTimeout(context.Background(), 10*time.Second)
+		srv.SessionConfig.Tracer.Flush(fctx)
+		fcancel()
+		os.Exit(0)
+	}()
+
+	// check the origins of browser clients
+	origins := parseOrigins(allowedOrigins)
+	if origins != nil {
+		srv.SessionConfig.Upgrader.CheckOrigin = origins.CheckOrigin
+	}
+	handler := origins.CORS(http.DefaultServeMux)
+
+	// load the TLS certificate
+	var certs *CertReloader
+	if conf.TLSCert != "" {
+		certs, err = NewCertReloader(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// serve the gRPC execution API alongside HTTP
+	if conf.GRPCListenAddr != "" {
+		srv.Exec = &ExecServer{Server: srv}
+		var tlsConfig *tls.Config
+		if certs != nil {
+			tlsConfig = certs.tlsConfig()
+		}
+		go func() {
+			panic(serveGRPC(conf.GRPCListenAddr, srv.Exec, tlsConfig))
+		}()
+	}
+
+	if certs == nil {
+		panic(http.ListenAndServe(conf.ListenAddr, handler))
+	}
+
+	// serve TLS, redirecting plain HTTP
+	if conf.TLSRedirectAddr != "" {
+		_, port, err := net.SplitHostPort(conf.ListenAddr)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			panic(http.ListenAndServe(conf.TLSRedirectAddr, redirectHandler(conf.ACMEWebroot, port)))
+		}()
+	}
+	server := &http.Server{Addr: conf.ListenAddr, Handler: handler, TLSConfig: certs.tlsConfig()}
+	panic(server.ListenAndServeTLS("", ""))
+}
+
+// loadLanguages loads the language configuration file, applying the server defaults.
+// Languages which require a different container operating system than osType are disabled.
+func loadLanguages(path string, osType string, defaults ContainerDefaults) (map[string]Language, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	langs, err := parseLanguageConfig(path, dat)
+	if err != nil {
+		return nil, err
+	}
+
+	// disable languages which the daemon cannot run
+	for name, lang := range langs {
+		if lang.ContainerOS() != osType {
+			serverLog.Printf("disabling %s: requires %s containers", name, lang.ContainerOS())
+			delete(langs, name)
+		}
+	}
+
+	// apply server defaults
+	for name, lang := range langs {
+		for v, lv := range lang.Versions {
+			if lv.Image == "" || v == lang.Version {
+				return nil, fmt.Errorf("language %s: version %s must have an image, and differ from the default version", name, v)
+			}
+		}
+		for p, iv := range lang.Variants {
+			if iv.Image == "" || strings.Count(p, "/") != 1 {
+				return nil, fmt.Errorf("language %s: variant %s must be an os/arch platform with an image", name, p)
+			}
+		}
+		if tc := lang.RunContainer.Test; tc != nil {
+			err = tc.validate()
+			if err != nil {
+				return nil, fmt.Errorf("language %s: %s", name, err.Error())
+			}
+		}
+		for _, lc := range []*LSPConfig{lang.RunContainer.LSP, lang.TermContainer.LSP} {
+			if lc != nil && len(lc.Command) == 0 {
+				return nil, fmt.Errorf("language %s: language server has no command", name)
+			}
+		}
+		if ec := lang.TermContainer.Eval; ec != nil {
+			err = ec.validate()
+			if err != nil {
+				return nil, fmt.Errorf("language %s: %s", name, err.Error())
+			}
+		}
+		for _, cf := range []*CodeFileConfig{lang.RunContainer.CodeFile, lang.TermContainer.CodeFile} {
+			if cf == nil {
+				continue
+			}
+			err = cf.validate(lang.ContainerOS())
+			if err != nil {
+				return nil, fmt.Errorf("language %s: %s", name, err.Error())
+			}
+		}
+		if tc := lang.TermContainer; tc.RequirePrompt && tc.Prompt == "" {
+			return nil, fmt.Errorf("language %s: require_prompt is set without a prompt", name)
+		}
+		if _, err := regexp.Compile(lang.TermContainer.Prompt); err != nil {
+			return nil, fmt.Errorf("language %s: invalid prompt: %s", name, err.Error())
+		}
+		lang.RunContainer.Language = name
+		lang.TermContainer.Language = name
+		lang.RunContainer.Deprecation = lang.deprecationWarning(name)
+		lang.TermContainer.Deprecation = lang.deprecationWarning(name)
+		lang.RunContainer.applyDefaults(defaults)
+		lang.TermContainer.applyDefaults(defaults)
+
+		// load seccomp profiles
+		dir := filepath.Dir(path)
+		err = lang.RunContainer.loadSeccompProfile(dir)
+		if err == nil {
+			err = lang.TermContainer.loadSeccompProfile(dir)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("language %s: failed to load seccomp profile: %s", name, err.Error())
+		}
+		langs[name] = lang
+	}
+
+	return langs, nil
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs.
+func parseKeyValues(str string) map[string]string {
+	if str == "" {
+		return nil
+	}
+	m := make(map[string]string)
+	for _, kv := range strings.Split(str, ",") {
+		spl := strings.SplitN(kv, "=", 2)
+		if len(spl) == 2 {
+			m[spl[0]] = spl[1]
+		} else {
+			m[spl[0]] = ""
+		}
+	}
+	return m
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaintenanceWindow is a recurring period during which the server performs maintenance.
+type MaintenanceWindow struct {
+	// Weekday is the day of the week on which the window starts, or -1 for every day.
+	Weekday time.Weekday
+
+	// Start is the time of day (in UTC) at which the window starts.
+	Start time.Duration
+
+	// Duration is the length of the window.
+	Duration time.Duration
+}
+
+// weekdays maps the abbreviated day names accepted in maintenance windows to weekdays.
+var weekdays = map[string]time.Weekday{
+	"daily": -1,
+	"sun":   time.Sunday,
+	"mon":   time.Monday,
+	"tue":   time.Tuesday,
+	"wed":   time.Wednesday,
+	"thu":   time.Thursday,
+	"fri":   time.Friday,
+	"sat":   time.Saturday,
+}
+
+// parseMaintenanceWindow parses a maintenance window in day@hh:mm/duration form (e.g. "sun@03:00/1h" or "daily@04:30/30m").
+func parseMaintenanceWindow(str string) (MaintenanceWindow, error) {
+	spl := strings.SplitN(str, "@", 2)
+	if len(spl) != 2 {
+		return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window %q", str)
+	}
+	day, ok := weekdays[strings.ToLower(spl[0])]
+	if !ok {
+		return MaintenanceWindow{}, fmt.Errorf("invalid day %q in maintenance window", spl[0])
+	}
+	spl = strings.SplitN(spl[1], "/", 2)
+	if len(spl) != 2 {
+		return MaintenanceWindow{}, fmt.Errorf("missing duration in maintenance window %q", str)
+	}
+	start, err := time.Parse("15:04", spl[0])
+	if err != nil {
+		return MaintenanceWindow{}, fmt.Errorf("invalid start in maintenance window %q", str)
+	}
+	dur, err := time.ParseDuration(spl[1])
+	if err != nil || dur <= 0 {
+		return MaintenanceWindow{}, fmt.Errorf("invalid duration in maintenance window %q", str)
+	}
+	return MaintenanceWindow{
+		Weekday:  day,
+		Start:    time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+		Duration: dur,
+	}, nil
+}
+
+// parseMaintenanceWindows parses a comma-separated list of maintenance windows.
+func parseMaintenanceWindows(str string) ([]MaintenanceWindow, error) {
+	if str == "" {
+		return nil, nil
+	}
+	var windows []MaintenanceWindow
+	for _, s := range strings.Split(str, ",") {
+		w, err := parseMaintenanceWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// active returns the start of the occurrence of the window containing t, if any.
+func (mw MaintenanceWindow) active(t time.Time) (time.Time, bool) {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	// the window may have started on a previous day
+	for d := 0; time.Duration(d)*24*time.Hour < mw.Duration+24*time.Hour; d++ {
+		start := midnight.AddDate(0, 0, -d).Add(mw.Start)
+		if mw.Weekday >= 0 && start.Weekday() != mw.Weekday {
+			continue
+		}
+		if !t.Before(start) && t.Before(start.Add(mw.Duration)) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Draining checks whether the server is rejecting new sessions for maintenance.
+func (cs *ContainerServer) Draining() bool {
+	return atomic.LoadInt32(&cs.draining) != 0
+}
+
+// setDraining starts or stops rejecting new sessions.
+func (cs *ContainerServer) setDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&cs.draining, v)
+}
+
+// maintenancePollRate is the interval at which maintenance windows and session counts are checked.
+const maintenancePollRate = 5 * time.Second
+
+// waitIdle waits until there are no active sessions, returning false if the context expires first.
+func (cs *ContainerServer) waitIdle(ctx context.Context) bool {
+	tick := time.NewTicker(maintenancePollRate)
+	defer tick.Stop()
+	for {
+		if cs.SessionConfig.Sessions == nil || len(cs.SessionConfig.Sessions.List()) == 0 {
+			return true
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// refreshImages pulls the latest version of every language image.
+// Images which cannot be pulled (e.g. locally built images) are kept as they are.
+func (cs *ContainerServer) refreshImages(ctx context.Context) {
+	for img := range languageImages(cs.languages()) {
+		err := pullImage(ctx, cs.SessionConfig.DockerClient, cs.SessionConfig.Registries, img)
+		if err != nil {
+			serverLog.Errorf("failed to refresh image %s: %s", img, err.Error())
+		}
+	}
+}
+
+// missingImages checks that the daemon is reachable, returning the images of languages which are not available on it.
+func (cs *ContainerServer) missingImages(ctx context.Context) ([]string, error) {
+	cli := cs.SessionConfig.DockerClient
+	_, err := cli.Ping(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for img := range languageImages(cs.languages()) {
+		_, _, err := cli.ImageInspectWithRaw(ctx, img)
+		if err != nil {
+			missing = append(missing, img)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// selfTest checks that the daemon is reachable and that the image of every language is available.
+func (cs *ContainerServer) selfTest(ctx context.Context) error {
+	missing, err := cs.missingImages(ctx)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errors.New("images unavailable: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// runMaintenance drains the server and performs maintenance until the deadline, then resumes.
+func (cs *ContainerServer) runMaintenance(deadline time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// stop accepting sessions and wait for active sessions to finish
+	serverLog.Printf("entering maintenance: draining sessions")
+	cs.setDraining(true)
+	defer func() {
+		cs.setDraining(false)
+		serverLog.Printf("maintenance complete: accepting sessions")
+	}()
+	if !cs.waitIdle(ctx) {
+		serverLog.Printf("maintenance skipped: sessions still active at the end of the window")
+		return
+	}
+
+	// refresh and prune images
+	cs.refreshImages(ctx)
+	if dm := cs.SessionConfig.Resources; dm != nil && dm.Docker != nil {
+		_, err := dm.Docker.prune(ctx)
+		if err != nil {
+			serverLog.Errorf("failed to prune docker data: %s", err.Error())
+		}
+	}
+	if cs.ImageGC != nil {
+		err := cs.ImageGC.Collect(ctx, time.Now())
+		if err != nil {
+			serverLog.Errorf("failed to collect images: %s", err.Error())
+		}
+	}
+
+	// check that sessions can still be started
+	err := cs.selfTest(ctx)
+	if err != nil {
+		serverLog.Errorf("maintenance self-test failed: %s", err.Error())
+		cs.SessionConfig.Alerts.Record("maintenance_failed", err.Error())
+	}
+}
+
+// RunMaintenance performs maintenance once during each occurrence of the windows.
+func (cs *ContainerServer) RunMaintenance(windows []MaintenanceWindow) {
+	if len(windows) == 0 {
+		return
+	}
+	done := make(map[time.Time]bool)
+	tick := time.NewTicker(maintenancePollRate)
+	defer tick.Stop()
+	for now := range tick.C {
+		for _, w := range windows {
+			start, ok := w.active(now)
+			if !ok || done[start] {
+				continue
+			}
+			done[start] = true
+			cs.runMaintenance(start.Add(w.Duration))
+		}
+
+		// forget occurrences which have ended
+		for start := range done {
+			if now.Sub(start) > 8*24*time.Hour {
+				delete(done, start)
+			}
+		}
+	}
+}
+
+// rejectDraining wraps a handler so that it rejects requests while the server is draining.
+func (cs *ContainerServer) rejectDraining(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cs.Draining() {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "server is under maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowActive(t *testing.T) {
+	// 2018-01-07 is a Sunday
+	sunday := time.Date(2018, 1, 7, 0, 0, 0, 0, time.UTC)
+	tbl := []struct {
+		window string
+		t      time.Time
+		start  time.Time
+		active bool
+	}{
+		{
+			window: "sun@03:00/1h",
+			t:      sunday.Add(3*time.Hour + 30*time.Minute),
+			start:  sunday.Add(3 * time.Hour),
+			active: true,
+		},
+		{
+			window: "sun@03:00/1h",
+			t:      sunday.Add(4 * time.Hour),
+			active: false,
+		},
+		{
+			window: "mon@03:00/1h",
+			t:      sunday.Add(3*time.Hour + 30*time.Minute),
+			active: false,
+		},
+		{
+			window: "sat@23:00/2h",
+			t:      sunday.Add(30 * time.Minute),
+			start:  sunday.Add(-time.Hour),
+			active: true,
+		},
+		{
+			window: "daily@04:30/30m",
+			t:      sunday.Add(48*time.Hour + 4*time.Hour + 45*time.Minute),
+			start:  sunday.Add(48*time.Hour + 4*time.Hour + 30*time.Minute),
+			active: true,
+		},
+	}
+	for _, v := range tbl {
+		w, err := parseMaintenanceWindow(v.window)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", v.window, err.Error())
+			continue
+		}
+		start, ok := w.active(v.t)
+		if ok != v.active || !start.Equal(v.start) {
+			t.Errorf("expected %q at %s to be active=%v from %s but got active=%v from %s", v.window, v.t, v.active, v.start, ok, start)
+		}
+	}
+}
+
+func TestParseMaintenanceWindowInvalid(t *testing.T) {
+	for _, str := range []string{"", "sun", "sun@03:00", "someday@03:00/1h", "sun@25:00/1h", "sun@03:00/-1h"} {
+		_, err := parseMaintenanceWindow(str)
+		if err == nil {
+			t.Errorf("expected error parsing %q", str)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a collection of time series which can be exported in the Prometheus text format.
+type metric interface {
+	writeMetric(w io.Writer)
+}
+
+// MetricSink receives every observation of the metrics in a registry, for push-based exporters.
+type MetricSink interface {
+	// Observe is called with the metric name, label names, label values, and observed value.
+	Observe(name string, labels []string, values []string, v float64)
+}
+
+// GaugeSink is a MetricSink which also receives gauge values.
+// Sinks which do not implement it only receive histogram observations.
+type GaugeSink interface {
+	MetricSink
+
+	// SetGauge is called with the metric name, label names, label values, and new value of a gauge.
+	SetGauge(name string, labels []string, values []string, v float64)
+}
+
+// CounterSink is a MetricSink which also receives counter increments.
+// Sinks which do not implement it do not receive counters.
+type CounterSink interface {
+	MetricSink
+
+	// AddCounter is called with the metric name, label names, label values, and increment of a counter.
+	AddCounter(name string, labels []string, values []string, v float64)
+}
+
+// MetricRegistry is a set of metrics exported in the Prometheus text format.
+type MetricRegistry struct {
+	lck     sync.Mutex
+	metrics []metric
+	sinks   []MetricSink
+}
+
+// Register adds a metric to the registry.
+func (mr *MetricRegistry) Register(m metric) {
+	mr.lck.Lock()
+	defer mr.lck.Unlock()
+	mr.metrics = append(mr.metrics, m)
+	switch m := m.(type) {
+	case *Histogram:
+		m.registry = mr
+	case *Gauge:
+		m.registry = mr
+	case *Counter:
+		m.registry = mr
+	}
+}
+
+// AddSink adds a sink which receives all future observations.
+func (mr *MetricRegistry) AddSink(s MetricSink) {
+	mr.lck.Lock()
+	defer mr.lck.Unlock()
+	mr.sinks = append(mr.sinks, s)
+}
+
+// observe forwards an observation to the sinks.
+func (mr *MetricRegistry) observe(name string, labels []string, values []string, v float64) {
+	if mr == nil {
+		return
+	}
+	mr.lck.Lock()
+	sinks := mr.sinks
+	mr.lck.Unlock()
+	for _, s := range sinks {
+		s.Observe(name, labels, values, v)
+	}
+}
+
+// setGauge forwards a gauge value to the sinks supporting gauges.
+func (mr *MetricRegistry) setGauge(name string, labels []string, values []string, v float64) {
+	if mr == nil {
+		return
+	}
+	mr.lck.Lock()
+	sinks := mr.sinks
+	mr.lck.Unlock()
+	for _, s := range sinks {
+		if gs, ok := s.(GaugeSink); ok {
+			gs.SetGauge(name, labels, values, v)
+		}
+	}
+}
+
+// addCounter forwards a counter increment to the sinks supporting counters.
+func (mr *MetricRegistry) addCounter(name string, labels []string, values []string, v float64) {
+	if mr == nil {
+		return
+	}
+	mr.lck.Lock()
+	sinks := mr.sinks
+	mr.lck.Unlock()
+	for _, s := range sinks {
+		if cs, ok := s.(CounterSink); ok {
+			cs.AddCounter(name, labels, values, v)
+		}
+	}
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (mr *MetricRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mr.lck.Lock()
+	metrics := make([]metric, len(mr.metrics))
+	copy(metrics, mr.metrics)
+	mr.lck.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.writeMetric(bw)
+	}
+	bw.Flush()
+}
+
+// labelEscaper escapes label values in the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats a set of label pairs, with optional extra pairs appended.
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+len(extra)/2)
+	for i, n := range names {
+		parts = append(parts, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatFloat formats a sample value in the text exposition format.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// seriesKey generates a map key from a set of label values.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// sortedKeys returns the keys of a series map in sorted order.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Histogram is a Prometheus histogram partitioned by labels.
+type Histogram struct {
+	// Name is the name of the metric.
+	Name string
+
+	// Help is the description of the metric.
+	Help string
+
+	// Labels is the list of label names.
+	Labels []string
+
+	// Buckets is the sorted list of bucket upper bounds.
+	Buckets []float64
+
+	lck      sync.Mutex
+	values   map[string][]string
+	series   map[string]*histogramSeries
+	registry *MetricRegistry
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe records a value in the series with the given label values.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.registry.observe(h.Name, h.Labels, labels, v)
+
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	if h.series == nil {
+		h.series = make(map[string]*histogramSeries)
+		h.values = make(map[string][]string)
+	}
+	key := seriesKey(labels)
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.Buckets))}
+		h.series[key] = s
+		h.values[key] = append([]string(nil), labels...)
+	}
+	for i, b := range h.Buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) writeMetric(w io.Writer) {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name)
+	for _, k := range sortedKeys(h.values) {
+		s, lv := h.series[k], h.values[k]
+		for i, b := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, lv, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, lv, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, formatLabels(h.Labels, lv), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, formatLabels(h.Labels, lv), s.count)
+	}
+}
+
+// Gauge is a Prometheus gauge partitioned by labels.
+type Gauge struct {
+	// Name is the name of the metric.
+	Name string
+
+	// Help is the description of the metric.
+	Help string
+
+	// Labels is the list of label names.
+	Labels []string
+
+	lck      sync.Mutex
+	values   map[string][]string
+	series   map[string]float64
+	registry *MetricRegistry
+}
+
+// Set sets the value of the series with the given label values.
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.registry.setGauge(g.Name, g.Labels, labels, v)
+
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	g.series[g.key(labels)] = v
+}
+
+// Add adds to the value of the series with the given label values, for gauges which count things.
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.lck.Lock()
+	key := g.key(labels)
+	g.series[key] += v
+	v = g.series[key]
+	g.lck.Unlock()
+
+	g.registry.setGauge(g.Name, g.Labels, labels, v)
+}
+
+// key returns the key of the series with the given label values, creating the series if it does not exist.
+// The lock must be held.
+func (g *Gauge) key(labels []string) string {
+	if g.series == nil {
+		g.series = make(map[string]float64)
+		g.values = make(map[string][]string)
+	}
+	key := seriesKey(labels)
+	if _, ok := g.series[key]; !ok {
+		g.values[key] = append([]string(nil), labels...)
+	}
+	return key
+}
+
+func (g *Gauge) writeMetric(w io.Writer) {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.Name, g.Help, g.Name)
+	for _, k := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.Name, formatLabels(g.Labels, g.values[k]), formatFloat(g.series[k]))
+	}
+}
+
+// Counter is a Prometheus counter partitioned by labels.
+type Counter struct {
+	// Name is the name of the metric.
+	Name string
+
+	// Help is the description of the metric.
+	Help string
+
+	// Labels is the list of label names.
+	Labels []string
+
+	lck      sync.Mutex
+	values   map[string][]string
+	series   map[string]float64
+	registry *MetricRegistry
+}
+
+// Add increments the series with the given label values.
+func (c *Counter) Add(v float64, labels ...string) {
+	c.registry.addCounter(c.Name, c.Labels, labels, v)
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if c.series == nil {
+		c.series = make(map[string]float64)
+		c.values = make(map[string][]string)
+	}
+	key := seriesKey(labels)
+	if _, ok := c.series[key]; !ok {
+		c.values[key] = append([]string(nil), labels...)
+	}
+	c.series[key] += v
+}
+
+// Totals returns the current value of every series, keyed by the label values joined as in seriesKey.
+func (c *Counter) Totals() map[string]float64 {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	totals := make(map[string]float64, len(c.series))
+	for k, v := range c.series {
+		totals[k] = v
+	}
+	return totals
+}
+
+func (c *Counter) writeMetric(w io.Writer) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.Name, formatLabels(c.Labels, c.values[k]), formatFloat(c.series[k]))
+	}
+}
+
+// latencyBuckets are histogram buckets suitable for container operation latencies, in seconds.
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics is the registry of metrics exported by the server.
+var metrics = &MetricRegistry{}
+
+// deployLatency records the duration of each phase of container deployment.
+var deployLatency = &Histogram{
+	Name:    "openrepl_deploy_duration_seconds",
+	Help:    "Duration of container deployment phases.",
+	Labels:  []string{"language", "phase"},
+	Buckets: latencyBuckets,
+}
+
+func init() {
+	metrics.Register(deployLatency)
+}
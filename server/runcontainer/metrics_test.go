@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{
+		Name:    "test_seconds",
+		Help:    "A test histogram.",
+		Labels:  []string{"language"},
+		Buckets: []float64{0.5, 1},
+	}
+	h.Observe(0.25, "go")
+	h.Observe(0.75, "go")
+	h.Observe(2, "go")
+	h.Observe(0.1, `a"b`)
+
+	buf := bytes.NewBuffer(nil)
+	h.writeMetric(buf)
+	expect := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{language="a\"b",le="0.5"} 1
+test_seconds_bucket{language="a\"b",le="1"} 1
+test_seconds_bucket{language="a\"b",le="+Inf"} 1
+test_seconds_sum{language="a\"b"} 0.1
+test_seconds_count{language="a\"b"} 1
+test_seconds_bucket{language="go",le="0.5"} 1
+test_seconds_bucket{language="go",le="1"} 2
+test_seconds_bucket{language="go",le="+Inf"} 3
+test_seconds_sum{language="go"} 3
+test_seconds_count{language="go"} 3
+`
+	if got := buf.String(); got != expect {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expect, got)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	g := &Gauge{
+		Name:   "test_bytes",
+		Help:   "A test gauge.",
+		Labels: []string{"type"},
+	}
+	g.Set(1, "images")
+	g.Set(5, "volumes")
+	g.Set(2, "images")
+	g.Add(3, "build_cache")
+	g.Add(-1, "build_cache")
+
+	buf := bytes.NewBuffer(nil)
+	g.writeMetric(buf)
+	expect := `# HELP test_bytes A test gauge.
+# TYPE test_bytes gauge
+test_bytes{type="build_cache"} 2
+test_bytes{type="images"} 2
+test_bytes{type="volumes"} 5
+`
+	if got := buf.String(); got != expect {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expect, got)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := &Counter{
+		Name:   "test_total",
+		Help:   "A test counter.",
+		Labels: []string{"language"},
+	}
+	c.Add(1, "go")
+	c.Add(2, "bash")
+	c.Add(1, "go")
+
+	buf := bytes.NewBuffer(nil)
+	c.writeMetric(buf)
+	expect := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{language="bash"} 2
+test_total{language="go"} 2
+`
+	if got := buf.String(); got != expect {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expect, got)
+	}
+	if totals := c.Totals(); totals["go"] != 2 || totals["bash"] != 2 {
+		t.Errorf("unexpected totals %v", totals)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+)
+
+// NetworkLimits limits the traffic of a networked container.
+type NetworkLimits struct {
+	// Rate is the maximum upload and download rate in bytes per second, which is enforced with tc on the session bridge.
+	// If zero, or if traffic control is disabled on the server, the rate is not limited.
+	Rate int64 `json:"rate,omitempty"`
+
+	// MaxBytes is the total number of bytes which the session may send and receive, after which it is terminated.
+	// If zero, the total is not limited.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// sessionBridge returns the name of the bridge interface of a session network.
+// Interface names are limited to 15 characters.
+func sessionBridge(session string) string {
+	name := "or-" + session
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// TrafficShaper limits the rate of session networks with tc.
+// This requires the server to run on the Docker host with CAP_NET_ADMIN.
+// A nil TrafficShaper does not limit rates.
+type TrafficShaper struct {
+	// Command is the path of the tc binary.
+	Command string
+}
+
+// shapeBurst is the burst size used by rate limits.
+const shapeBurst = "32kb"
+
+// apply limits the rate of traffic through a session bridge in both directions.
+// Traffic leaving the bridge (downloads) is shaped, and traffic entering it (uploads) is policed.
+func (ts *TrafficShaper) apply(bridge string, rate int64) error {
+	if ts == nil || rate <= 0 {
+		return nil
+	}
+	// tc uses "bps" for bytes per second
+	r := strconv.FormatInt(rate, 10) + "bps"
+	cmds := [][]string{
+		{"qdisc", "add", "dev", bridge, "root", "tbf", "rate", r, "burst", shapeBurst, "latency", "400ms"},
+		{"qdisc", "add", "dev", bridge, "handle", "ffff:", "ingress"},
+		{"filter", "add", "dev", bridge, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0", "police", "rate", r, "burst", shapeBurst, "drop", "flowid", ":1"},
+	}
+	for _, args := range cmds {
+		out, err := exec.Command(ts.Command, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("tc %v: %s: %s", args[:2], err.Error(), out)
+		}
+	}
+	return nil
+}
+
+// networkBytes returns the total number of bytes sent and received on all interfaces in a stats sample.
+func networkBytes(st *types.StatsJSON) int64 {
+	var n uint64
+	for _, ns := range st.Networks {
+		n += ns.RxBytes + ns.TxBytes
+	}
+	return int64(n)
+}
+
+// watchNetwork terminates the session once it exceeds its traffic budget, until the context is cancelled.
+func (cs *ContainerSession) watchNetwork(ctx context.Context) {
+	limit := cs.ContainerConfig.NetworkLimits.MaxBytes
+	exceeded := false
+	err := cs.Container.streamStats(ctx, func(st *types.StatsJSON) bool {
+		exceeded = networkBytes(st) > limit
+		return !exceeded
+	})
+	if err != nil {
+		cs.logger().Errorf("failed to watch network traffic: %s", err.Error())
+		return
+	}
+	if !exceeded {
+		return
+	}
+
+	// notify client and terminate
+	msg := fmt.Sprintf("network traffic limit of %d bytes exceeded", limit)
+	cs.Events.Record("network_budget_exceeded", msg)
+	cs.UpdateStatus(StatusUpdate{Status: "network_budget_exceeded", Error: msg, Code: codeNetworkBudget})
+	cs.Close()
+}
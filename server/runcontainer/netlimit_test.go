@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestNetworkBytes(t *testing.T) {
+	st := &types.StatsJSON{Networks: map[string]types.NetworkStats{
+		"eth0": {RxBytes: 100, TxBytes: 20},
+		"eth1": {RxBytes: 3, TxBytes: 4},
+	}}
+	if n := networkBytes(st); n != 127 {
+		t.Errorf("expected 127 bytes, got %d", n)
+	}
+	if n := networkBytes(&types.StatsJSON{}); n != 0 {
+		t.Errorf("expected 0 bytes without networks, got %d", n)
+	}
+}
+
+func TestSessionBridge(t *testing.T) {
+	name := sessionBridge("0123456789abcdef0123456789abcdef")
+	if name != "or-0123456789ab" {
+		t.Errorf("unexpected bridge name %q", name)
+	}
+	if name := sessionBridge("abc"); name != "or-abc" {
+		t.Errorf("unexpected bridge name %q", name)
+	}
+}
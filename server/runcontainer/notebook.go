@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// NotebookRequest is a request sent by a notebook client.
+type NotebookRequest struct {
+	// Op is the operation, which is "execute" (the default) to run a cell, or "restart" to start a fresh interpreter.
+	Op string `json:"op,omitempty"`
+
+	// Cell is the ID of the cell chosen by the client, which is copied into the result.
+	Cell string `json:"cell,omitempty"`
+
+	// Code is the source of the cell.
+	Code string `json:"code,omitempty"`
+}
+
+// NotebookOutput is an output of a cell.
+type NotebookOutput struct {
+	// Type is "stdout", "stderr", "result" (the value of the final expression) or "error".
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// NotebookResult is the result of executing a cell.
+type NotebookResult struct {
+	Cell string `json:"cell,omitempty"`
+
+	// ExecutionCount is the number of cells executed by the interpreter so far, including this one.
+	// It is reset when the interpreter is restarted.
+	ExecutionCount int `json:"execution_count"`
+
+	// Status is "ok" or "error".
+	Status  string           `json:"status"`
+	Outputs []NotebookOutput `json:"outputs"`
+
+	// Duration is the time taken to execute the cell in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// NotebookRestart is the message sent to the client after the interpreter restarts.
+type NotebookRestart struct {
+	Restarted bool `json:"restarted"`
+}
+
+// notebookResult converts the result of an evaluation into a cell result.
+func notebookResult(cell string, count int, res EvalResult) NotebookResult {
+	nr := NotebookResult{
+		Cell:           cell,
+		ExecutionCount: count,
+		Status:         "ok",
+		Outputs:        []NotebookOutput{},
+		Duration:       res.Duration,
+	}
+	if res.Stdout != "" {
+		nr.Outputs = append(nr.Outputs, NotebookOutput{Type: "stdout", Text: res.Stdout})
+	}
+	if res.Stderr != "" {
+		nr.Outputs = append(nr.Outputs, NotebookOutput{Type: "stderr", Text: res.Stderr})
+	}
+	if res.Value != "" {
+		nr.Outputs = append(nr.Outputs, NotebookOutput{Type: "result", Text: res.Value})
+	}
+	if res.Error != "" {
+		nr.Status = "error"
+		nr.Outputs = append(nr.Outputs, NotebookOutput{Type: "error", Text: res.Error})
+	}
+	return nr
+}
+
+// runNotebook runs the session as a notebook kernel until an error occurs, closing afterwards.
+// Cells are executed in the order in which they are received, by an interpreter which is kept for the whole session.
+func (cs *ContainerSession) runNotebook(ctx context.Context) error {
+	errch := make(chan error, 1)
+
+	// start ping-pong
+	cs.runPing(errch)
+
+	// start interpreter
+	d, err := cs.startEvalDriver(ctx)
+	if err != nil {
+		cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error()}, "")
+		cs.Close()
+		return err
+	}
+	// dlck guards replacement of the interpreter on restart
+	var dlck sync.Mutex
+
+	// stop execution when the session times out or the client stalls
+	stopch := make(chan struct{})
+	defer close(stopch)
+	go func() {
+		select {
+		case <-errch:
+			cs.Client.Close()
+		case <-ctx.Done():
+			cs.Client.Close()
+		case <-stopch:
+		}
+		dlck.Lock()
+		d.conn.Close()
+		dlck.Unlock()
+	}()
+
+	count := 0
+	for {
+		// read request
+		var t int
+		var dat []byte
+		t, dat, err = cs.Client.ReadMessage()
+		if err != nil {
+			break
+		}
+		if t != websocket.TextMessage {
+			continue
+		}
+		var req NotebookRequest
+		err = json.Unmarshal(dat, &req)
+		if err != nil {
+			cs.UpdateStatus(StatusUpdate{Status: "error", Error: "invalid notebook request"})
+			continue
+		}
+
+		var resp interface{}
+		switch req.Op {
+		case "", "execute":
+			// execute cell
+			count++
+			cs.Events.Record("cell", req.Cell)
+			var res EvalResult
+			res, err = d.eval(EvalRequest{ID: req.Cell, Code: req.Code})
+			if err == nil {
+				resp = notebookResult(req.Cell, count, res)
+			}
+		case "restart":
+			// replace the interpreter, discarding its state
+			cs.Events.Record("restart", "")
+			dlck.Lock()
+			d.conn.Close()
+			var nd *evalDriver
+			nd, err = cs.startEvalDriver(ctx)
+			if err == nil {
+				d = nd
+				count = 0
+				resp = NotebookRestart{Restarted: true}
+			}
+			dlck.Unlock()
+		default:
+			cs.UpdateStatus(StatusUpdate{Status: "error", Error: "unknown notebook operation " + req.Op})
+			continue
+		}
+		if err != nil {
+			cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error()}, "")
+			break
+		}
+
+		// send result
+		cs.wlck.Lock()
+		err = cs.Client.WriteJSON(resp)
+		cs.wlck.Unlock()
+		if err != nil {
+			break
+		}
+	}
+
+	// close session
+	cs.Close()
+
+	if _, ok := err.(*websocket.CloseError); ok {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNotebookResult(t *testing.T) {
+	tbl := []struct {
+		res     EvalResult
+		status  string
+		outputs []NotebookOutput
+	}{
+		{
+			res:     EvalResult{},
+			status:  "ok",
+			outputs: []NotebookOutput{},
+		},
+		{
+			res:    EvalResult{Stdout: "hi\n", Value: "3"},
+			status: "ok",
+			outputs: []NotebookOutput{
+				{Type: "stdout", Text: "hi\n"},
+				{Type: "result", Text: "3"},
+			},
+		},
+		{
+			res:    EvalResult{Stderr: "warning\n", Error: "NameError"},
+			status: "error",
+			outputs: []NotebookOutput{
+				{Type: "stderr", Text: "warning\n"},
+				{Type: "error", Text: "NameError"},
+			},
+		},
+	}
+	for _, v := range tbl {
+		nr := notebookResult("c1", 2, v.res)
+		if nr.Cell != "c1" || nr.ExecutionCount != 2 {
+			t.Errorf("cell metadata not copied: %+v", nr)
+		}
+		if nr.Status != v.status || !reflect.DeepEqual(nr.Outputs, v.outputs) {
+			t.Errorf("converting %+v: expected %s %v but got %s %v", v.res, v.status, v.outputs, nr.Status, nr.Outputs)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OriginPolicy is the allow-list of the web origins from which browsers may connect to the server.
+// It is enforced on websocket upgrades, and controls the CORS headers of plain HTTP endpoints.
+type OriginPolicy struct {
+	// Origins are the allowed origins (e.g. "https://repl.example.com").
+	// The host may start with a "*." wildcard matching any subdomain, and "*" allows all origins.
+	Origins []string
+
+	// MaxAge is the time for which browsers may cache the result of a preflight request.
+	MaxAge time.Duration
+}
+
+// parseOrigins parses a comma-separated allow-list of origins.
+// Returns nil if the list is empty, in which case only same-origin websocket connections are accepted.
+func parseOrigins(str string) *OriginPolicy {
+	if str == "" {
+		return nil
+	}
+	op := &OriginPolicy{MaxAge: 10 * time.Minute}
+	for _, o := range strings.Split(str, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			op.Origins = append(op.Origins, strings.ToLower(strings.TrimSuffix(o, "/")))
+		}
+	}
+	return op
+}
+
+// Allowed checks whether an Origin header value is in the allow-list.
+func (op *OriginPolicy) Allowed(origin string) bool {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	for _, o := range op.Origins {
+		if o == "*" || o == u.Scheme+"://"+u.Host {
+			return true
+		}
+		if pfx := u.Scheme + "://*."; strings.HasPrefix(o, pfx) && strings.HasSuffix(u.Host, "."+strings.TrimPrefix(o, pfx)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin checks the origin of a websocket upgrade, for use as websocket.Upgrader.CheckOrigin.
+// Requests without an Origin header do not come from browsers, and are accepted.
+func (op *OriginPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || op.Allowed(origin)
+}
+
+// corsHeaders are the request headers which cross-origin clients may send.
+const corsHeaders = "Authorization, Content-Type, X-Api-Key"
+
+// CORS wraps a handler so that allowed origins may make cross-origin requests, answering preflight requests.
+// Admin endpoints and metrics are never exposed to other origins.
+// A nil OriginPolicy adds no CORS headers.
+func (op *OriginPolicy) CORS(h http.Handler) http.Handler {
+	if op == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || strings.HasPrefix(r.URL.Path, "/admin") || r.URL.Path == "/metrics" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !op.Allowed(origin) {
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+		// answer preflight requests
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(op.MaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
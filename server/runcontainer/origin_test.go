@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	op := parseOrigins("https://repl.example.com, https://*.school.edu/,http://localhost:3000")
+	tbl := map[string]bool{
+		"https://repl.example.com":      true,
+		"https://REPL.example.com":      true,
+		"http://repl.example.com":       false,
+		"https://evil.example.com":      false,
+		"https://cs.school.edu":         true,
+		"https://a.cs.school.edu":       true,
+		"https://school.edu":            false,
+		"https://evilschool.edu":        false,
+		"http://localhost:3000":         true,
+		"http://localhost:3001":         false,
+		"null":                          false,
+		"https://repl.example.com.evil": false,
+	}
+	for origin, ok := range tbl {
+		if op.Allowed(origin) != ok {
+			t.Errorf("%s: expected allowed %v", origin, ok)
+		}
+	}
+	if !parseOrigins("*").Allowed("https://anything.test") || parseOrigins("") != nil {
+		t.Error("unexpected wildcard policy")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	h := parseOrigins("https://repl.example.com").CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	tbl := []struct {
+		method string
+		path   string
+		origin string
+		status int
+		allow  string
+	}{
+		{http.MethodGet, "/languages", "https://repl.example.com", http.StatusTeapot, "https://repl.example.com"},
+		{http.MethodOptions, "/sessions", "https://repl.example.com", http.StatusNoContent, "https://repl.example.com"},
+		{http.MethodOptions, "/sessions", "https://evil.test", http.StatusForbidden, ""},
+		{http.MethodGet, "/languages", "https://evil.test", http.StatusTeapot, ""},
+		{http.MethodGet, "/admin/sessions", "https://repl.example.com", http.StatusTeapot, ""},
+		{http.MethodGet, "/languages", "", http.StatusTeapot, ""},
+	}
+	for _, v := range tbl {
+		req := httptest.NewRequest(v.method, v.path, nil)
+		if v.origin != "" {
+			req.Header.Set("Origin", v.origin)
+		}
+		if v.method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != v.status || w.Header().Get("Access-Control-Allow-Origin") != v.allow {
+			t.Errorf("%s %s from %q: expected %d %q but got %d %q", v.method, v.path, v.origin, v.status, v.allow, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+}
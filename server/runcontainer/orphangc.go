@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// labelServer is the label identifying the server instance which deployed a session container.
+const labelServer = "openrepl.server"
+
+// orphansRemoved counts the session containers removed without a live session.
+var orphansRemoved = &Counter{
+	Name: "openrepl_orphan_containers_removed_total",
+	Help: "Number of session containers removed because they had no live session.",
+}
+
+func init() {
+	metrics.Register(orphansRemoved)
+}
+
+// OrphanCollector removes the session containers of this server instance which have no live session, such as those left behind by a crash.
+// A nil OrphanCollector tracks and removes nothing.
+type OrphanCollector struct {
+	// Client is the client of the Docker daemon running the containers.
+	Client *client.Client
+
+	// Instance is the ID of the server instance, with which its containers are labeled.
+	// Containers of other instances sharing the daemon are never removed.
+	Instance string
+
+	// Grace is the minimum age of removed containers, so that containers which are still being deployed are kept.
+	Grace time.Duration
+
+	lck  sync.Mutex
+	live map[string]*Container
+}
+
+// track records a container deployed for a live session.
+func (oc *OrphanCollector) track(c *Container) {
+	if oc == nil {
+		return
+	}
+	oc.lck.Lock()
+	defer oc.lck.Unlock()
+	if oc.live == nil {
+		oc.live = make(map[string]*Container)
+	}
+	oc.live[c.ID] = c
+}
+
+// isClosed checks whether the container has been closed.
+func (c *Container) isClosed() bool {
+	c.clck.Lock()
+	defer c.clck.Unlock()
+	return c.closed
+}
+
+// orphans selects the containers which are not live and are older than the minimum age, forgetting closed containers.
+func (oc *OrphanCollector) orphans(list []types.Container, now time.Time, minAge time.Duration) []types.Container {
+	oc.lck.Lock()
+	for id, c := range oc.live {
+		if c.isClosed() {
+			delete(oc.live, id)
+		}
+	}
+	live := make(map[string]bool, len(oc.live))
+	for id := range oc.live {
+		live[id] = true
+	}
+	oc.lck.Unlock()
+
+	var orphans []types.Container
+	for _, c := range list {
+		if live[c.ID] || c.Labels[labelServer] != oc.Instance || now.Sub(time.Unix(c.Created, 0)) < minAge {
+			continue
+		}
+		orphans = append(orphans, c)
+	}
+	return orphans
+}
+
+// Collect removes the orphaned containers older than minAge, along with their unused session networks.
+func (oc *OrphanCollector) Collect(ctx context.Context, minAge time.Duration) error {
+	if oc == nil {
+		return nil
+	}
+	args := filters.NewArgs()
+	args.Add("label", labelServer+"="+oc.Instance)
+	list, err := oc.Client.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return err
+	}
+	for _, c := range oc.orphans(list, time.Now(), minAge) {
+		err := oc.Client.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true})
+		if err != nil && !client.IsErrNotFound(err) {
+			serverLog.Errorf("failed to remove orphaned container %s: %s", c.ID, err.Error())
+			continue
+		}
+		Logger{Session: c.Labels[labelSession]}.Printf("removed orphaned container %s", c.ID)
+		orphansRemoved.Add(1)
+	}
+	_, err = oc.Client.NetworksPrune(ctx, args)
+	return err
+}
+
+// Run periodically removes orphaned containers.
+func (oc *OrphanCollector) Run(interval time.Duration) {
+	if oc == nil {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := oc.Collect(ctx, oc.Grace)
+		cancel()
+		if err != nil {
+			serverLog.Errorf("failed to collect orphaned containers: %s", err.Error())
+		}
+	}
+}
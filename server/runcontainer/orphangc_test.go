@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestOrphans(t *testing.T) {
+	now := time.Unix(10000, 0)
+	oc := &OrphanCollector{Instance: "a"}
+	oc.track(&Container{ID: "live"})
+	oc.track(&Container{ID: "closed", closed: true})
+	list := []types.Container{
+		{ID: "live", Created: 0, Labels: map[string]string{labelServer: "a"}},
+		{ID: "closed", Created: 0, Labels: map[string]string{labelServer: "a"}},
+		{ID: "orphan", Created: 0, Labels: map[string]string{labelServer: "a"}},
+		{ID: "other", Created: 0, Labels: map[string]string{labelServer: "b"}},
+		{ID: "young", Created: now.Unix() - 5, Labels: map[string]string{labelServer: "a"}},
+	}
+	var ids []string
+	for _, c := range oc.orphans(list, now, time.Minute) {
+		ids = append(ids, c.ID)
+	}
+	if len(ids) != 2 || ids[0] != "closed" || ids[1] != "orphan" {
+		t.Errorf("expected orphans [closed orphan] but got %v", ids)
+	}
+	if _, ok := oc.live["closed"]; ok {
+		t.Error("closed container is still tracked")
+	}
+
+	// at startup, containers of any age are removed
+	if n := len(oc.orphans(list, now, 0)); n != 3 {
+		t.Errorf("expected 3 orphans without minimum age but got %d", n)
+	}
+
+	// a nil collector tracks nothing
+	var nilc *OrphanCollector
+	nilc.track(&Container{ID: "x"})
+}
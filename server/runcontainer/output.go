@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// OutputLimit limits the volume of program output sent to the client in each session.
+type OutputLimit struct {
+	// MaxBytes is the maximum number of output bytes sent in a session.
+	// If zero, the total output is not limited.
+	MaxBytes int64
+
+	// Rate is the sustained output rate in bytes per second, and Burst is the number of bytes which may be sent at once.
+	// If Rate is zero, the output rate is not limited, and if Burst is less than Rate, it is treated as Rate.
+	Rate  int64
+	Burst int64
+
+	// Kill is whether the program is killed once its output exceeds a limit.
+	// Otherwise, the excess output is dropped and the program continues.
+	Kill bool
+}
+
+// outputMeter tracks the output of a session against an OutputLimit.
+type outputMeter struct {
+	sent   int64
+	tokens float64
+	last   time.Time
+
+	// capped and throttled are set once output has been dropped due to the total and rate limits.
+	capped    bool
+	throttled bool
+}
+
+// errOutputLimit is the error with which the output of a killed program ends.
+var errOutputLimit = errors.New("output limit exceeded")
+
+// outputTruncated counts the sessions whose output was truncated or killed for exceeding a limit.
+var outputTruncated = &Counter{
+	Name:   "openrepl_output_truncated_total",
+	Help:   "Number of sessions whose output exceeded a limit.",
+	Labels: []string{"language"},
+}
+
+func init() {
+	metrics.Register(outputTruncated)
+}
+
+// limit returns the number of bytes of an n-byte chunk of output which may be sent now.
+// If the chunk is the first to exceed a limit, an explanation is also returned.
+func (m *outputMeter) limit(l *OutputLimit, n int, now time.Time) (int, string) {
+	if l == nil {
+		return n, ""
+	}
+	keep := int64(n)
+	var notice string
+
+	// apply total limit
+	if l.MaxBytes > 0 && m.sent+keep > l.MaxBytes {
+		keep = l.MaxBytes - m.sent
+		if !m.capped {
+			m.capped = true
+			notice = fmt.Sprintf("output exceeded the limit of %s", units.BytesSize(float64(l.MaxBytes)))
+		}
+	}
+
+	// apply rate limit
+	if l.Rate > 0 {
+		burst := l.Burst
+		if burst < l.Rate {
+			burst = l.Rate
+		}
+		if m.last.IsZero() {
+			m.tokens = float64(burst)
+		} else {
+			m.tokens += now.Sub(m.last).Seconds() * float64(l.Rate)
+			if m.tokens > float64(burst) {
+				m.tokens = float64(burst)
+			}
+		}
+		m.last = now
+		if float64(keep) > m.tokens {
+			keep = int64(m.tokens)
+			if !m.throttled && notice == "" {
+				m.throttled = true
+				notice = fmt.Sprintf("output exceeded the rate limit of %s/s", units.BytesSize(float64(l.Rate)))
+			}
+		}
+		m.tokens -= float64(keep)
+	}
+
+	m.sent += keep
+	return int(keep), notice
+}
+
+// limitOutput notifies the client that output exceeded a limit, killing the program if configured.
+func (cs *ContainerSession) limitOutput(notice string) error {
+	cs.Events.Record("output_limit", notice)
+	outputTruncated.Add(1, cs.ContainerConfig.Language)
+	if cs.Config.Output.Kill {
+		cs.UpdateStatus(StatusUpdate{Status: "output_limit", Error: notice, Code: codeOutputLimit})
+		cs.Close()
+		return errOutputLimit
+	}
+	return cs.UpdateStatus(StatusUpdate{
+		Status:  "output_truncated",
+		Message: notice + "; excess output is dropped",
+		Code:    codeOutputLimit,
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutputMeter(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	tbl := []struct {
+		limit  *OutputLimit
+		chunks []int
+		after  []time.Duration
+		keep   []int
+		notice []bool
+	}{
+		{nil, []int{100, 100}, []time.Duration{0, 0}, []int{100, 100}, []bool{false, false}},
+		{&OutputLimit{MaxBytes: 150}, []int{100, 100, 100}, []time.Duration{0, 0, 0}, []int{100, 50, 0}, []bool{false, true, false}},
+		{&OutputLimit{Rate: 100, Burst: 200}, []int{150, 100, 100, 100}, []time.Duration{0, 0, time.Second, 10 * time.Second}, []int{150, 50, 100, 100}, []bool{false, true, false, false}},
+		{&OutputLimit{Rate: 100}, []int{150}, []time.Duration{0}, []int{100}, []bool{true}},
+	}
+	for i, v := range tbl {
+		var m outputMeter
+		for j, n := range v.chunks {
+			keep, notice := m.limit(v.limit, n, start.Add(v.after[j]))
+			if keep != v.keep[j] || (notice != "") != v.notice[j] {
+				t.Errorf("case %d chunk %d: expected %d bytes (notice %v) but got %d (%q)", i, j, v.keep[j], v.notice[j], keep, notice)
+			}
+		}
+	}
+}
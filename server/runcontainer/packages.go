@@ -0,0 +1,455 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// defaultInstallTimeout is the maximum duration of a dependency installation whose PackageConfig does not specify one.
+const defaultInstallTimeout = 5 * time.Minute
+
+// maxManifestSize is the maximum size of a dependency manifest in bytes.
+const maxManifestSize = 64 << 10
+
+// installLogTail is the number of lines of installer output included in the error of a failed installation.
+const installLogTail = "20"
+
+// labelPackages is the label of dependency images and their installation containers, which is set to the image tag.
+const labelPackages = "openrepl.packages"
+
+// errPackagesUnsupported is returned when a run has a dependency manifest but its language cannot install dependencies.
+var errPackagesUnsupported = errors.New("dependencies are not supported for this language")
+
+// errPackagesUnrestricted is returned when dependencies would be installed without restricting the network to the registries of the language.
+var errPackagesUnrestricted = errors.New("dependency installation requires the egress firewall and package registries")
+
+// packageInstalls counts the dependency manifests of runs by result ("cached", "installed" or "failed").
+var packageInstalls = &Counter{
+	Name:   "openrepl_package_installs_total",
+	Help:   "Number of dependency manifests of runs, by language and result.",
+	Labels: []string{"language", "result"},
+}
+
+func init() {
+	metrics.Register(packageInstalls)
+}
+
+// PackageConfig is a configuration for installing the dependencies of runs (e.g. with pip or npm).
+type PackageConfig struct {
+	// Manifest is the absolute path at which the dependency manifest (e.g. "/home/runner/requirements.txt") is written.
+	Manifest string `json:"manifest"`
+
+	// Install is the full command line installing the dependencies in the manifest.
+	// The image entrypoint is not used.
+	Install []string `json:"cmd"`
+
+	// Registries are the domains, IP addresses and CIDRs of the package registries, which are the only destinations reachable during the installation.
+	Registries []string `json:"registries"`
+
+	// Timeout is the maximum duration of the installation in seconds.
+	// If zero, defaultInstallTimeout is used.
+	Timeout float64 `json:"timeout,omitempty"`
+}
+
+// timeout returns the maximum duration of the installation.
+func (pc *PackageConfig) timeout() time.Duration {
+	if pc.Timeout == 0 {
+		return defaultInstallTimeout
+	}
+	return time.Duration(pc.Timeout * float64(time.Second))
+}
+
+// InstallError is an error reporting that the install command of a language failed.
+type InstallError struct {
+	// Code is the exit status of the install command.
+	Code int64
+
+	// Output is the end of the output of the install command.
+	Output string
+}
+
+func (ie *InstallError) Error() string {
+	msg := fmt.Sprintf("dependency installation failed with status %d", ie.Code)
+	if ie.Output != "" {
+		msg += ":\n" + ie.Output
+	}
+	return msg
+}
+
+// PackageCache installs the dependencies of runs into images, which are reused by runs of the same tenant with the same manifest.
+// Images are tagged with the hash of the tenant, the base image, the install command and the manifest.
+// A nil PackageCache does not install dependencies.
+type PackageCache struct {
+	Client *client.Client
+
+	// Repository is the repository (e.g. "openrepl/packages") of the dependency images.
+	Repository string
+
+	// Egress restricts the network of installations to the registries of their language.
+	Egress *EgressFirewall
+
+	// TTL is the time after which an image which has not been used is removed.
+	// If zero, images are only removed to keep at most MaxImages.
+	TTL time.Duration
+
+	// MaxImages is the maximum number of cached images, beyond which the least recently used are removed.
+	// If zero, the number of images is unlimited.
+	MaxImages int
+
+	lck      sync.Mutex
+	installs map[string]*packageInstall
+	used     map[string]time.Time
+}
+
+// packageInstall is an installation in progress, which concurrent runs with the same manifest wait for.
+type packageInstall struct {
+	done chan struct{}
+	err  error
+}
+
+// imageTag returns the tag of the image with the dependencies of a manifest installed on top of a base image for a tenant.
+// Tenants do not share images, so that an installation cannot affect the runs of other tenants.
+func (pc *PackageCache) imageTag(tenant string, base string, pkgs *PackageConfig, manifest []byte) (string, error) {
+	dat, err := json.Marshal(struct {
+		Tenant   string
+		Base     string
+		Path     string
+		Install  []string
+		Manifest []byte
+	}{tenant, base, pkgs.Manifest, pkgs.Install, manifest})
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(dat)
+	return pc.Repository + ":" + hex.EncodeToString(h[:20]), nil
+}
+
+// Image returns the image with the dependencies of a manifest installed on top of the image of the language, installing them if they are not cached.
+// Concurrent requests for the same manifest share a single installation.
+func (pc *PackageCache) Image(ctx context.Context, cc ContainerConfig, session string, tenant string, manifest []byte) (img string, cached bool, err error) {
+	if pc.Egress == nil || len(cc.Packages.Registries) == 0 {
+		return "", false, errPackagesUnrestricted
+	}
+	base, _, err := pc.Client.ImageInspectWithRaw(ctx, cc.Image)
+	if err != nil {
+		return "", false, err
+	}
+	tag, err := pc.imageTag(tenant, base.ID, cc.Packages, manifest)
+	if err != nil {
+		return "", false, err
+	}
+	pc.markUsed(tag, time.Now())
+
+	// use the cached image
+	_, _, err = pc.Client.ImageInspectWithRaw(ctx, tag)
+	switch {
+	case err == nil:
+		return tag, true, nil
+	case !client.IsErrNotFound(err):
+		return "", false, err
+	}
+
+	// wait for an installation in progress, or start one
+	pc.lck.Lock()
+	in := pc.installs[tag]
+	if in != nil {
+		pc.lck.Unlock()
+		select {
+		case <-in.done:
+			return tag, true, in.err
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		}
+	}
+	if pc.installs == nil {
+		pc.installs = make(map[string]*packageInstall)
+	}
+	in = &packageInstall{done: make(chan struct{})}
+	pc.installs[tag] = in
+	pc.lck.Unlock()
+
+	in.err = pc.install(ctx, cc, base.Config, tag, session, manifest)
+
+	pc.lck.Lock()
+	delete(pc.installs, tag)
+	pc.lck.Unlock()
+	close(in.done)
+	return tag, false, in.err
+}
+
+// install runs the install command in a container of the language, and commits the container to the tagged image.
+// The entrypoint and command of the base image are kept.
+func (pc *PackageCache) install(ctx context.Context, cc ContainerConfig, base *container.Config, tag string, session string, manifest []byte) error {
+	// generate labels
+	labels := make(map[string]string, len(cc.Labels)+2)
+	for k, v := range cc.Labels {
+		labels[k] = v
+	}
+	labels[labelLanguage] = cc.Language
+	labels[labelPackages] = tag
+
+	// create the container on a network of its own, from which only the registries are reachable
+	netid, err := createSessionNetwork(ctx, pc.Client, session, labels)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		nerr := pc.Client.NetworkRemove(context.Background(), netid)
+		if nerr != nil {
+			Logger{Session: session}.Errorf("failed to remove installation network: %s", nerr.Error())
+		}
+	}()
+	cfg := &container.Config{
+		Image:      cc.Image,
+		Entrypoint: cc.Packages.Install,
+		Env:        cc.Env,
+		WorkingDir: cc.WorkDir,
+		User:       cc.User,
+		Labels:     labels,
+	}
+	hcfg := &container.HostConfig{
+		Runtime:     cc.Runtime,
+		SecurityOpt: cc.securityOpts(),
+		CapAdd:      cc.CapAdd,
+		CapDrop:     cc.CapDrop,
+		StorageOpt:  cc.storageOpt(),
+		NetworkMode: container.NetworkMode(netid),
+		Resources: container.Resources{
+			NanoCPUs:   int64(time.Second/time.Nanosecond) / 2,
+			Memory:     cc.memoryLimit(),
+			MemorySwap: cc.memorySwap(),
+			CpusetCpus: cc.Cpuset,
+			PidsLimit:  cc.pidsLimit(),
+			Ulimits:    cc.ulimits(),
+		},
+	}
+	c, err := pc.Client.ContainerCreate(ctx, cfg, hcfg, nil, containerName(cc.Language, session, 0)+"-install")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		rerr := pc.Client.ContainerRemove(context.Background(), c.ID, types.ContainerRemoveOptions{Force: true})
+		if rerr != nil {
+			serverLog.Errorf("failed to remove installation container: %s", rerr.Error())
+		}
+	}()
+
+	// write the manifest
+	dir, name := path.Split(cc.Packages.Manifest)
+	tr := packTarball([]tarEntry{{&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(manifest)),
+		ModTime:  time.Now(),
+	}, manifest}})
+	err = pc.Client.CopyToContainer(ctx, c.ID, dir, tr, types.CopyToContainerOptions{})
+	tr.Close()
+	if err != nil {
+		return err
+	}
+
+	// restrict the network to the registries
+	err = pc.Egress.apply(ctx, session, cc.Packages.Registries)
+	if err != nil {
+		return err
+	}
+	defer pc.Egress.remove(session)
+
+	// run the install command
+	waitch, errch := pc.Client.ContainerWait(ctx, c.ID, container.WaitConditionNextExit)
+	err = pc.Client.ContainerStart(ctx, c.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return err
+	}
+	var code int64
+	select {
+	case exit := <-waitch:
+		code = exit.StatusCode
+	case err := <-errch:
+		return err
+	}
+	if code != 0 {
+		return &InstallError{Code: code, Output: pc.logs(ctx, c.ID)}
+	}
+
+	// commit the installed dependencies, restoring the entrypoint and command of the base image
+	changes, err := imageCommandChanges(base)
+	if err != nil {
+		return err
+	}
+	_, err = pc.Client.ContainerCommit(ctx, c.ID, types.ContainerCommitOptions{
+		Reference: tag,
+		Comment:   "dependencies of " + cc.Language,
+		Changes:   changes,
+	})
+	return err
+}
+
+// markUsed records the time at which an image was last used.
+func (pc *PackageCache) markUsed(tag string, now time.Time) {
+	pc.lck.Lock()
+	defer pc.lck.Unlock()
+	if pc.used == nil {
+		pc.used = make(map[string]time.Time)
+	}
+	pc.used[tag] = now
+}
+
+// packageImage is a cached image of dependencies.
+type packageImage struct {
+	id       string
+	tag      string
+	lastUsed time.Time
+}
+
+// expired selects the images which are removed by Collect: those unused for TTL, and the least recently used beyond MaxImages.
+// Images which have not been used since the server started count as used when they were created.
+func (pc *PackageCache) expired(images []types.ImageSummary, now time.Time) []packageImage {
+	pc.lck.Lock()
+	defer pc.lck.Unlock()
+	var imgs []packageImage
+	for _, img := range images {
+		tag := img.Labels[labelPackages]
+		last, ok := pc.used[tag]
+		if !ok {
+			last = time.Unix(img.Created, 0)
+		}
+		imgs = append(imgs, packageImage{id: img.ID, tag: tag, lastUsed: last})
+	}
+	sort.Slice(imgs, func(i, j int) bool { return imgs[i].lastUsed.After(imgs[j].lastUsed) })
+
+	var remove []packageImage
+	for i, img := range imgs {
+		if (pc.TTL > 0 && now.Sub(img.lastUsed) >= pc.TTL) || (pc.MaxImages > 0 && i >= pc.MaxImages) {
+			remove = append(remove, img)
+			delete(pc.used, img.tag)
+		}
+	}
+	return remove
+}
+
+// Collect removes the images selected by expired.
+func (pc *PackageCache) Collect(ctx context.Context, now time.Time) error {
+	args := filters.NewArgs()
+	args.Add("label", labelPackages)
+	images, err := pc.Client.ImageList(ctx, types.ImageListOptions{Filters: args})
+	if err != nil {
+		return err
+	}
+	for _, img := range pc.expired(images, now) {
+		_, err := pc.Client.ImageRemove(ctx, img.id, types.ImageRemoveOptions{PruneChildren: true})
+		if err != nil {
+			serverLog.Errorf("failed to remove dependency image %s: %s", img.tag, err.Error())
+		}
+	}
+	return nil
+}
+
+// Run periodically removes unused dependency images.
+func (pc *PackageCache) Run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for now := range tick.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := pc.Collect(ctx, now)
+		cancel()
+		if err != nil {
+			serverLog.Errorf("failed to collect dependency images: %s", err.Error())
+		}
+	}
+}
+
+// imageCommandChanges generates the Dockerfile instructions restoring the entrypoint and command of an image.
+func imageCommandChanges(cfg *container.Config) ([]string, error) {
+	var entrypoint, cmd []string
+	if cfg != nil {
+		entrypoint, cmd = cfg.Entrypoint, cfg.Cmd
+	}
+	if entrypoint == nil {
+		entrypoint = []string{}
+	}
+	if cmd == nil {
+		cmd = []string{}
+	}
+	edat, err := json.Marshal(entrypoint)
+	if err != nil {
+		return nil, err
+	}
+	cdat, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"ENTRYPOINT " + string(edat), "CMD " + string(cdat)}, nil
+}
+
+// logs returns the end of the output of a container, or an empty string if it cannot be read.
+func (pc *PackageCache) logs(ctx context.Context, id string) string {
+	rc, err := pc.Client.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       installLogTail,
+	})
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	stdcopy.StdCopy(&buf, &buf, rc)
+	return string(bytes.TrimSpace(buf.Bytes()))
+}
+
+// installPackages installs the dependencies of the run, switching the session to the image holding them.
+func (cs *ContainerSession) installPackages() error {
+	cc := cs.ContainerConfig
+	if cc.Packages == nil || cs.Config.Packages == nil {
+		return errPackagesUnsupported
+	}
+	if len(cs.Options.Packages) > maxManifestSize {
+		return fmt.Errorf("dependency manifest exceeds %d bytes", maxManifestSize)
+	}
+	err := cs.UpdateStatus(StatusUpdate{Status: "installing"})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cc.Packages.timeout())
+	defer cancel()
+	err = cs.pullImage(ctx, cc.Image)
+	if err != nil {
+		return err
+	}
+	cs.Events.Record("install_start", "")
+	img, cached, err := cs.Config.Packages.Image(ctx, cc, cs.ID, cs.Tenant, cs.Options.Packages)
+	if err != nil {
+		packageInstalls.Add(1, cc.Language, "failed")
+		cs.Events.Record("install_failed", err.Error())
+		return err
+	}
+	result := "installed"
+	if cached {
+		result = "cached"
+	}
+	packageInstalls.Add(1, cc.Language, result)
+	cs.Events.Record("install_end", result)
+
+	// the fallback image does not have the dependencies
+	cs.ContainerConfig.Image, cs.ContainerConfig.FallbackImage = img, ""
+	return nil
+}
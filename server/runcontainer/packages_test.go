@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestPackageImageTag(t *testing.T) {
+	pc := &PackageCache{Repository: "openrepl/packages"}
+	pkgs := &PackageConfig{Manifest: "/tmp/requirements.txt", Install: []string{"pip", "install", "-r", "/tmp/requirements.txt"}}
+	tag, err := pc.imageTag("alice", "sha256:abc", pkgs, []byte("requests\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tag, "openrepl/packages:") || len(tag) != len("openrepl/packages:")+40 {
+		t.Errorf("unexpected tag %q", tag)
+	}
+	same, _ := pc.imageTag("alice", "sha256:abc", pkgs, []byte("requests\n"))
+	if same != tag {
+		t.Errorf("tag is not deterministic: %q != %q", same, tag)
+	}
+	for _, other := range []string{
+		mustTag(t, pc, "alice", "sha256:def", pkgs, "requests\n"),
+		mustTag(t, pc, "alice", "sha256:abc", pkgs, "numpy\n"),
+		mustTag(t, pc, "bob", "sha256:abc", pkgs, "requests\n"),
+		mustTag(t, pc, "alice", "sha256:abc", &PackageConfig{Manifest: pkgs.Manifest, Install: []string{"pip", "install", "--user"}}, "requests\n"),
+	} {
+		if other == tag {
+			t.Errorf("different installation has the same tag %q", tag)
+		}
+	}
+}
+
+func mustTag(t *testing.T, pc *PackageCache, tenant string, base string, pkgs *PackageConfig, manifest string) string {
+	tag, err := pc.imageTag(tenant, base, pkgs, []byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tag
+}
+
+func TestImageCommandChanges(t *testing.T) {
+	changes, err := imageCommandChanges(&container.Config{Entrypoint: []string{"python"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{`ENTRYPOINT ["python"]`, `CMD []`}; !reflect.DeepEqual(changes, expect) {
+		t.Errorf("expected %q, got %q", expect, changes)
+	}
+	changes, err = imageCommandChanges(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{`ENTRYPOINT []`, `CMD []`}; !reflect.DeepEqual(changes, expect) {
+		t.Errorf("expected %q, got %q", expect, changes)
+	}
+}
+
+func TestInstallError(t *testing.T) {
+	err := &InstallError{Code: 1, Output: "No matching distribution found for nope"}
+	if msg := err.Error(); msg != "dependency installation failed with status 1:\nNo matching distribution found for nope" {
+		t.Errorf("unexpected message %q", msg)
+	}
+	if timeout := (&PackageConfig{}).timeout(); timeout != defaultInstallTimeout {
+		t.Errorf("unexpected default timeout %s", timeout)
+	}
+	if timeout := (&PackageConfig{Timeout: 30}).timeout(); timeout != 30*time.Second {
+		t.Errorf("unexpected timeout %s", timeout)
+	}
+}
+
+func TestPackageImagesExpired(t *testing.T) {
+	now := time.Now()
+	pc := &PackageCache{TTL: time.Hour, MaxImages: 2}
+	pc.markUsed("a", now.Add(-time.Minute))
+	pc.markUsed("b", now.Add(-2*time.Hour))
+	pc.markUsed("c", now.Add(-3*time.Minute))
+	images := []types.ImageSummary{
+		{ID: "1", Labels: map[string]string{labelPackages: "a"}},
+		{ID: "2", Labels: map[string]string{labelPackages: "b"}},
+		{ID: "3", Labels: map[string]string{labelPackages: "c"}},
+		{ID: "4", Labels: map[string]string{labelPackages: "d"}, Created: now.Add(-2 * time.Minute).Unix()},
+	}
+
+	// b is unused for longer than the TTL, and c is the least recently used beyond the maximum
+	var removed []string
+	for _, img := range pc.expired(images, now) {
+		removed = append(removed, img.id)
+	}
+	if expect := []string{"3", "2"}; !reflect.DeepEqual(removed, expect) {
+		t.Errorf("expected images %v to be removed, got %v", expect, removed)
+	}
+	if _, ok := pc.used["b"]; ok {
+		t.Error("removed image is still marked as used")
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// PairRequest is a control message sent by a participant of a pair-programming session.
+// In pair-programming sessions, terminal input is sent in binary messages, and text messages are control messages.
+type PairRequest struct {
+	// Op is the operation, which is "handoff" to give control of the terminal to another participant.
+	// Only the driver and the host may hand off control.
+	Op string `json:"op"`
+
+	// To is the ID of the participant receiving control.
+	To string `json:"to,omitempty"`
+
+	// ControlMessage is a terminal control message, which is sent instead of an operation.
+	ControlMessage
+}
+
+// PairParticipant is a client attached to a pair-programming session.
+type PairParticipant struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// PairState is the state of a pair-programming session, which is sent to every participant when it changes.
+type PairState struct {
+	// You is the ID of the participant receiving the state.
+	You string `json:"you"`
+
+	// Role is the role of the participant receiving the state, which is "driver" or "observer".
+	Role string `json:"role"`
+
+	// Driver is the ID of the participant whose input is forwarded to the terminal.
+	Driver string `json:"driver"`
+
+	Participants []PairParticipant `json:"participants"`
+
+	// Owner is the token with which the host creates invitations, which is only sent to the host.
+	Owner string `json:"owner,omitempty"`
+
+	// MaxParticipants is the maximum number of participants, including the host, or zero if unlimited.
+	MaxParticipants int `json:"max_participants,omitempty"`
+}
+
+// PairInvite is an invitation to join a pair-programming session.
+type PairInvite struct {
+	// Token is passed in the token query parameter of the join websocket.
+	// It can only be used once.
+	Token string `json:"token"`
+
+	// Role is the role of the participant on joining.
+	// A driver invitation gives control of the terminal to the participant who redeems it.
+	Role string `json:"role"`
+
+	Expires time.Time `json:"expires"`
+}
+
+const (
+	// defaultInviteTTL is the lifetime of invitations which do not specify one.
+	defaultInviteTTL = 15 * time.Minute
+
+	// maxInviteTTL is the maximum lifetime of an invitation.
+	maxInviteTTL = 24 * time.Hour
+
+	// maxInvites is the maximum number of outstanding invitations of a session.
+	maxInvites = 32
+)
+
+var (
+	errNotDriver      = errors.New("only the driver or the host may hand off control")
+	errNoParticipant  = errors.New("no such participant")
+	errTooManyInvites = errors.New("too many outstanding invitations")
+	errPairFull       = errors.New("session has reached its participant limit")
+	errPairEnded      = errors.New("session has ended")
+)
+
+// pairHost is the ID of the participant which started the session.
+const pairHost = "host"
+
+// maxPairName is the maximum length of a participant name.
+const maxPairName = 64
+
+// pairQueueSize is the number of output messages queued for a participant, beyond which it is disconnected.
+// Slow participants are thereby dropped instead of blocking the output of the session.
+const pairQueueSize = 256
+
+// pairClient is a participant of a pair-programming session.
+type pairClient struct {
+	PairParticipant
+	conn ClientConn
+
+	// wlck serializes writes to the connection.
+	wlck *sync.Mutex
+
+	// out queues the terminal output sent to a participant other than the host until left is closed.
+	out  chan []byte
+	left chan struct{}
+}
+
+// writeOutput sends the queued output to a participant until it leaves, disconnecting it if a write fails.
+func (pc *pairClient) writeOutput() {
+	for {
+		select {
+		case dat := <-pc.out:
+			pc.wlck.Lock()
+			err := pc.conn.WriteMessage(websocket.TextMessage, dat)
+			pc.wlck.Unlock()
+			if err != nil {
+				pc.conn.Close()
+				return
+			}
+		case <-pc.left:
+			return
+		}
+	}
+}
+
+func (pc *pairClient) writeJSON(v interface{}) error {
+	pc.wlck.Lock()
+	defer pc.wlck.Unlock()
+	return pc.conn.WriteJSON(v)
+}
+
+// Pairing tracks the participants of a pair-programming session.
+// Only the input of the driver is forwarded to the terminal, and all participants receive its output.
+// A nil Pairing has no participants other than the client of the session.
+type Pairing struct {
+	token string
+	host  *pairClient
+
+	// max is the maximum number of participants including the host, or zero if unlimited.
+	max int
+
+	// inlck serializes input written to the container.
+	inlck sync.Mutex
+
+	lck     sync.Mutex
+	clients []*pairClient
+	driver  string
+	nextID  int
+	closed  bool
+	invites map[string]PairInvite
+}
+
+// newPairing creates a Pairing in which the client of the session is the host and initial driver.
+// At most max clients may participate, including the host, unless max is zero.
+func newPairing(cs *ContainerSession, max int) (*Pairing, error) {
+	token, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	host := &pairClient{
+		PairParticipant: PairParticipant{ID: pairHost},
+		conn:            cs.Client,
+		wlck:            &cs.wlck,
+	}
+	return &Pairing{
+		token:   token,
+		host:    host,
+		max:     max,
+		clients: []*pairClient{host},
+		driver:  pairHost,
+		invites: make(map[string]PairInvite),
+	}, nil
+}
+
+// checkOwner checks the owner token of the host.
+func (p *Pairing) checkOwner(token string) bool {
+	return p != nil && subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) == 1
+}
+
+// invite creates an invitation to join the session with the given role.
+func (p *Pairing) invite(role string, ttl time.Duration, now time.Time) (PairInvite, error) {
+	token, err := randomID()
+	if err != nil {
+		return PairInvite{}, err
+	}
+	inv := PairInvite{Token: token, Role: role, Expires: now.Add(ttl)}
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	p.pruneInvites(now)
+	if len(p.invites) >= maxInvites {
+		return PairInvite{}, errTooManyInvites
+	}
+	p.invites[token] = inv
+	return inv, nil
+}
+
+// redeem consumes an invitation, returning the role of the participant.
+// Returns false if the invitation does not exist or has expired.
+func (p *Pairing) redeem(token string, now time.Time) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	p.pruneInvites(now)
+	inv, ok := p.invites[token]
+	if !ok {
+		return "", false
+	}
+	delete(p.invites, token)
+	return inv.Role, true
+}
+
+// pruneInvites removes expired invitations.
+// The lock must be held.
+func (p *Pairing) pruneInvites(now time.Time) {
+	for k, inv := range p.invites {
+		if !now.Before(inv.Expires) {
+			delete(p.invites, k)
+		}
+	}
+}
+
+// full checks whether the session has reached its participant limit.
+func (p *Pairing) full() bool {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return p.max > 0 && len(p.clients) >= p.max
+}
+
+// join adds a participant with the given role.
+func (p *Pairing) join(conn ClientConn, name string, role string) (*pairClient, error) {
+	if len(name) > maxPairName {
+		name = name[:maxPairName]
+	}
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	switch {
+	case p.closed:
+		return nil, errPairEnded
+	case p.max > 0 && len(p.clients) >= p.max:
+		return nil, errPairFull
+	}
+	p.nextID++
+	pc := &pairClient{
+		PairParticipant: PairParticipant{ID: strconv.Itoa(p.nextID), Name: name},
+		conn:            conn,
+		wlck:            &sync.Mutex{},
+		out:             make(chan []byte, pairQueueSize),
+		left:            make(chan struct{}),
+	}
+	go pc.writeOutput()
+	p.clients = append(p.clients, pc)
+	if role == "driver" {
+		p.driver = pc.ID
+	}
+	return pc, nil
+}
+
+// leave removes a participant, returning control to the host if it was the driver.
+func (p *Pairing) leave(pc *pairClient) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	for i, c := range p.clients {
+		if c == pc {
+			p.clients = append(p.clients[:i], p.clients[i+1:]...)
+			close(pc.left)
+			break
+		}
+	}
+	if p.driver == pc.ID {
+		p.driver = pairHost
+	}
+}
+
+// isDriver checks whether a participant is the driver.
+func (p *Pairing) isDriver(id string) bool {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return p.driver == id
+}
+
+// handoff gives control of the terminal to another participant.
+func (p *Pairing) handoff(from string, to string) error {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	if from != p.driver && from != pairHost {
+		return errNotDriver
+	}
+	for _, c := range p.clients {
+		if c.ID == to {
+			p.driver = to
+			return nil
+		}
+	}
+	return errNoParticipant
+}
+
+// peers returns the participants other than the host.
+func (p *Pairing) peers() []*pairClient {
+	if p == nil {
+		return nil
+	}
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return append([]*pairClient(nil), p.clients[1:]...)
+}
+
+// broadcastOutput queues terminal output for the participants other than the host, disconnecting those whose queue is full.
+func (p *Pairing) broadcastOutput(dat []byte) {
+	peers := p.peers()
+	if len(peers) == 0 {
+		return
+	}
+	dat = append([]byte(nil), dat...)
+	for _, pc := range peers {
+		select {
+		case pc.out <- dat:
+		default:
+			pc.conn.Close()
+		}
+	}
+}
+
+// broadcastState sends the current state to every participant.
+func (p *Pairing) broadcastState() {
+	p.lck.Lock()
+	clients := append([]*pairClient(nil), p.clients...)
+	participants := make([]PairParticipant, len(clients))
+	for i, c := range clients {
+		participants[i] = c.PairParticipant
+	}
+	driver, max := p.driver, p.max
+	p.lck.Unlock()
+
+	for _, c := range clients {
+		st := &PairState{
+			You:          c.ID,
+			Role:         "observer",
+			Driver:       driver,
+			Participants: participants,
+
+			MaxParticipants: max,
+		}
+		if c.ID == driver {
+			st.Role = "driver"
+		}
+		if c.ID == pairHost {
+			st.Owner = p.token
+		}
+		c.writeJSON(StatusUpdate{Status: "pair", Pair: st})
+	}
+}
+
+// close disconnects the participants other than the host.
+func (p *Pairing) close() {
+	if p == nil {
+		return
+	}
+	p.lck.Lock()
+	p.closed = true
+	p.lck.Unlock()
+	for _, pc := range p.peers() {
+		pc.conn.Close()
+	}
+}
+
+// pairInput handles a message from a participant of a pair-programming session.
+// Control messages are applied, and terminal input is forwarded to the container if the participant is the driver.
+func (cs *ContainerSession) pairInput(pc *pairClient, t int, r io.Reader) error {
+	p := cs.pairing
+	if t == websocket.TextMessage {
+		var req PairRequest
+		err := json.NewDecoder(io.LimitReader(r, 4096)).Decode(&req)
+		if err == nil && req.Type == "resize" {
+			// only the driver controls the terminal size
+			if !p.isDriver(pc.ID) {
+				return pc.writeJSON(StatusUpdate{Status: "error", Error: "only the driver may resize the terminal"})
+			}
+			err = cs.applyControl(req.ControlMessage)
+			if err != nil {
+				return pc.writeJSON(StatusUpdate{Status: "error", Error: err.Error()})
+			}
+			return nil
+		}
+		if err != nil || req.Op != "handoff" {
+			return pc.writeJSON(StatusUpdate{Status: "error", Error: "invalid pair request"})
+		}
+		err = p.handoff(pc.ID, req.To)
+		if err != nil {
+			return pc.writeJSON(StatusUpdate{Status: "error", Error: err.Error()})
+		}
+		cs.Events.Record("handoff", pc.ID+" "+req.To)
+		p.broadcastState()
+		return nil
+	}
+	if !p.isDriver(pc.ID) {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	p.inlck.Lock()
+	defer p.inlck.Unlock()
+	return cs.writeInput(r)
+}
+
+// servePeer serves a participant who joined the session, until it disconnects.
+func (cs *ContainerSession) servePeer(conn ClientConn, name string, role string) {
+	defer conn.Close()
+	pc, err := cs.pairing.join(conn, name, role)
+	if err != nil {
+		conn.WriteJSON(StatusUpdate{Status: "error", Error: err.Error()})
+		return
+	}
+	cs.Events.Record("pair_join", pc.ID+" "+role)
+	cs.pairing.broadcastState()
+	defer func() {
+		cs.pairing.leave(pc)
+		cs.Events.Record("pair_leave", pc.ID)
+		cs.pairing.broadcastState()
+	}()
+
+	for {
+		t, r, err := conn.NextReader()
+		if err != nil || t == websocket.CloseMessage {
+			return
+		}
+		err = cs.pairInput(pc, t, r)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// pairSession looks up the pair-programming session selected by the session query parameter.
+// Returns nil if there is no such session.
+func (cs *ContainerServer) pairSession(r *http.Request) *ContainerSession {
+	if cs.SessionConfig.Sessions == nil {
+		return nil
+	}
+	sess := cs.SessionConfig.Sessions.Get(r.URL.Query().Get("session"))
+	if sess == nil || sess.pairing == nil {
+		return nil
+	}
+	return sess
+}
+
+// HandleInvite creates an invitation to the pair-programming session selected by the session query parameter.
+// The request requires the owner token of the session as a bearer token.
+// The role query parameter is "observer" (the default) or "driver", and the ttl query parameter is the lifetime of the invitation (e.g. "30m").
+func (cs *ContainerServer) HandleInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	sess := cs.pairSession(r)
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if sess == nil || !sess.pairing.checkOwner(tok) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	// parse invitation options
+	q := r.URL.Query()
+	role := q.Get("role")
+	switch role {
+	case "":
+		role = "observer"
+	case "observer", "driver":
+	default:
+		http.Error(w, fmt.Sprintf("invalid role %q", role), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultInviteTTL
+	if s := q.Get("ttl"); s != "" {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl <= 0 || ttl > maxInviteTTL {
+			http.Error(w, fmt.Sprintf("ttl must be a duration of at most %s", maxInviteTTL), http.StatusBadRequest)
+			return
+		}
+	}
+
+	inv, err := sess.pairing.invite(role, ttl, time.Now())
+	switch {
+	case err == errTooManyInvites:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		sess.logger().Errorf("failed to create invitation: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sess.Events.Record("pair_invite", role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+// HandleJoin attaches a websocket client to a running pair-programming session.
+// The session is selected by the session query parameter, and the token query parameter must be an invitation to it.
+func (cs *ContainerServer) HandleJoin(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sess := cs.pairSession(r)
+	if sess != nil && sess.pairing.full() {
+		// keep the invitation for when a participant leaves
+		http.Error(w, errPairFull.Error(), http.StatusConflict)
+		return
+	}
+	var role string
+	ok := false
+	if sess != nil {
+		role, ok = sess.pairing.redeem(q.Get("token"), time.Now())
+	}
+	if !ok {
+		http.Error(w, "invitation not found or expired", http.StatusNotFound)
+		return
+	}
+	ws, err := cs.SessionConfig.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	// participants are not pinged, so only their writes time out
+	sess.servePeer(newDeadlineConn(ws, 0, cs.SessionConfig.WriteTimeout, cs.SessionConfig.MaxMessageSize), q.Get("name"), role)
+}
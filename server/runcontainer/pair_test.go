@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPairing(t *testing.T) {
+	host := newEvalConn("host", nil)
+	cs := &ContainerSession{Client: host}
+	p, err := newPairing(cs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := p.join(newEvalConn("alice", nil), "alice", "observer")
+	bob, _ := p.join(newEvalConn("bob", nil), "bob", "observer")
+
+	// only the driver and the host may hand off control
+	if err := p.handoff(alice.ID, alice.ID); err != errNotDriver {
+		t.Fatalf("expected observer handoff to fail but got %v", err)
+	}
+	if err := p.handoff(pairHost, "42"); err != errNoParticipant {
+		t.Fatalf("expected handoff to a missing participant to fail but got %v", err)
+	}
+	if err := p.handoff(pairHost, alice.ID); err != nil || !p.isDriver(alice.ID) {
+		t.Fatalf("failed to hand off to alice: %v", err)
+	}
+	if err := p.handoff(alice.ID, bob.ID); err != nil || !p.isDriver(bob.ID) {
+		t.Fatalf("failed to hand off to bob: %v", err)
+	}
+
+	// the state is sent to everyone, with the owner token only sent to the host
+	p.broadcastState()
+	hs := (<-host.out).(StatusUpdate).Pair
+	if hs.Role != "observer" || hs.Driver != bob.ID || hs.Owner != p.token || len(hs.Participants) != 3 {
+		t.Fatalf("unexpected host state %+v", hs)
+	}
+	bs := (<-bob.conn.(*evalConn).out).(StatusUpdate).Pair
+	if bs.You != bob.ID || bs.Role != "driver" || bs.Owner != "" {
+		t.Fatalf("unexpected driver state %+v", bs)
+	}
+
+	// control returns to the host when the driver leaves
+	p.leave(bob)
+	if !p.isDriver(pairHost) || len(p.peers()) != 1 {
+		t.Fatal("expected the host to drive after the driver left")
+	}
+
+	// no one can join once the session has ended
+	p.close()
+	if _, err := p.join(newEvalConn("carol", nil), "carol", "observer"); err != errPairEnded {
+		t.Fatal("joined a closed session")
+	}
+	if !alice.conn.(*evalConn).closed() {
+		t.Fatal("participant not disconnected when the session ended")
+	}
+}
+
+func TestPairInvites(t *testing.T) {
+	cs := &ContainerSession{Client: newEvalConn("host", nil)}
+	p, err := newPairing(cs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	inv, err := p.invite("driver", time.Minute, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := p.invite("observer", time.Minute, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// invitations can be redeemed once before they expire
+	if role, ok := p.redeem(inv.Token, now.Add(30*time.Second)); !ok || role != "driver" {
+		t.Fatalf("failed to redeem invitation: %q %v", role, ok)
+	}
+	if _, ok := p.redeem(inv.Token, now.Add(30*time.Second)); ok {
+		t.Fatal("redeemed an invitation twice")
+	}
+	if _, ok := p.redeem(expired.Token, now.Add(time.Minute)); ok {
+		t.Fatal("redeemed an expired invitation")
+	}
+	if p.checkOwner(inv.Token) || !p.checkOwner(p.token) {
+		t.Fatal("owner token check failed")
+	}
+
+	// a driver invitation gives control on joining
+	pc, _ := p.join(newEvalConn("alice", nil), "alice", "driver")
+	if !p.isDriver(pc.ID) {
+		t.Fatal("driver invitation did not give control")
+	}
+
+	// outstanding invitations are limited
+	for i := 0; i <= maxInvites; i++ {
+		_, err = p.invite("observer", time.Minute, now)
+	}
+	if err != errTooManyInvites {
+		t.Fatalf("expected too many invitations but got %v", err)
+	}
+}
+
+func TestPairParticipantLimit(t *testing.T) {
+	cs := &ContainerSession{Client: newEvalConn("host", nil)}
+	p, err := newPairing(cs, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := p.join(newEvalConn("alice", nil), "alice", "observer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the host counts towards the limit
+	if !p.full() {
+		t.Fatal("expected session to be full")
+	}
+	if _, err := p.join(newEvalConn("bob", nil), "bob", "observer"); err != errPairFull {
+		t.Fatalf("expected join of a full session to fail but got %v", err)
+	}
+
+	// a participant may join once another leaves
+	p.leave(alice)
+	if _, err := p.join(newEvalConn("bob", nil), "bob", "observer"); err != nil {
+		t.Fatalf("failed to join after a participant left: %v", err)
+	}
+}
+
+// stalledConn is a participant connection whose writes block until it is closed.
+type stalledConn struct {
+	*evalConn
+}
+
+func (sc stalledConn) WriteMessage(messageType int, data []byte) error {
+	<-sc.hangup
+	return errEvalSessionClosed
+}
+
+func TestPairSlowParticipant(t *testing.T) {
+	cs := &ContainerSession{Client: newEvalConn("host", nil)}
+	p, err := newPairing(cs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := stalledConn{newEvalConn("alice", nil)}
+	alice, err := p.join(conn, "alice", "observer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.leave(alice)
+
+	// output is not blocked by a participant which stopped reading, which is disconnected once its queue is full
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < pairQueueSize+2; i++ {
+			p.broadcastOutput([]byte("x"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("output blocked by a slow participant")
+	}
+	if !conn.closed() {
+		t.Error("expected slow participant to be disconnected")
+	}
+}
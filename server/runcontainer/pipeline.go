@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Step is a step of a run pipeline (e.g. generate, compile, test, run).
+type Step struct {
+	// Name is the name of the step, which is reported to the client.
+	Name string `json:"name"`
+
+	// Command is the full command line of the step.
+	// The image entrypoint is not used, and command placeholders are expanded.
+	Command []string `json:"cmd"`
+
+	// Timeout is the maximum duration of the step in seconds.
+	// If zero, the step is only limited by the session timeout.
+	Timeout float64 `json:"timeout,omitempty"`
+
+	// OnFailure is the action taken when the step exits with a non-zero status or times out.
+	// It is either "abort" (the default), which stops the pipeline, or "continue".
+	OnFailure string `json:"on_failure,omitempty"`
+}
+
+// Hook is a command executed inside the container before or after the user run (e.g. to start a database or collect coverage).
+type Hook struct {
+	// Command is the full command line of the hook.
+	Command []string `json:"cmd"`
+
+	// Output selects whether the output of the hook is "hidden" (the default) or "forward"ed to the client.
+	Output string `json:"output,omitempty"`
+}
+
+// withCommandVars returns a copy of the Hook with the command placeholders expanded.
+func (h *Hook) withCommandVars(vars CommandVars) *Hook {
+	if h == nil {
+		return nil
+	}
+	nh := *h
+	nh.Command = expandArgs(h.Command, vars)
+	return &nh
+}
+
+// runHook runs a hook, forwarding its output if configured.
+func (cs *ContainerSession) runHook(ctx context.Context, in *execInput, name string, hook Hook) error {
+	cs.Events.Record("hook_start", name)
+	if hook.Output == "forward" {
+		_, err := cs.runStep(ctx, in, Step{Name: name, Command: hook.Command})
+		return err
+	}
+	code, err := cs.Container.ExecTo(ctx, hook.Command, ioutil.Discard, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("%s hook failed with status %d", name, code)
+	}
+	return nil
+}
+
+// usesPipeline checks whether the container configuration runs its program as a pipeline of execs.
+func (cc ContainerConfig) usesPipeline() bool {
+	return len(cc.Steps) > 0 || len(cc.Compile) > 0 || cc.Setup != nil || cc.Teardown != nil
+}
+
+// pipelineSteps returns the steps of the pipeline run by the session.
+// Without explicit steps, the program is run as a single step.
+func (cs *ContainerSession) pipelineSteps() []Step {
+	if len(cs.ContainerConfig.Steps) > 0 {
+		return cs.ContainerConfig.Steps
+	}
+	return []Step{{Name: "run", Command: cs.progArgv, OnFailure: "continue"}}
+}
+
+// runStep runs a single step of the pipeline.
+// Exceeding the timeout is reported as a failure.
+func (cs *ContainerSession) runStep(ctx context.Context, in *execInput, step Step) (int64, error) {
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(step.Timeout*float64(time.Second)))
+		defer cancel()
+	}
+
+	// start step
+	run, err := cs.startExec(ctx, step.Command)
+	if err != nil {
+		return 0, err
+	}
+	in.set(run)
+	defer in.set(nil)
+
+	// wait for step to exit
+	select {
+	case <-run.done:
+	case <-ctx.Done():
+		cs.stopExec(context.Background(), run)
+		return 0, fmt.Errorf("step %s timed out", step.Name)
+	}
+	if !run.exited {
+		return 0, errors.New("lost connection to step " + step.Name)
+	}
+	if run.code != 0 {
+		return run.code, fmt.Errorf("step %s failed with status %d", step.Name, run.code)
+	}
+	return 0, nil
+}
+
+// runPipeline runs the steps of the pipeline in order, closing afterwards.
+// Client input is sent to the current step.
+func (cs *ContainerSession) runPipeline(ctx context.Context) error {
+	errch := make(chan error, 2)
+	in := &execInput{}
+
+	// start ping-pong and client input
+	cs.runPing(errch)
+	go cs.runExecInput(ctx, in, nil, errch)
+
+	// stop the pipeline when the client disconnects
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-errch
+		cancel()
+
+		// ignore second error
+		<-errch
+	}()
+
+	// run setup hook
+	var code int64
+	var err error
+	if setup := cs.ContainerConfig.Setup; setup != nil {
+		err = cs.runHook(pctx, in, "setup", *setup)
+		if err != nil && pctx.Err() == nil {
+			cs.abort("error", err.Error(), StatusUpdate{Status: "error", Error: err.Error()}, "")
+			cs.Close()
+			return err
+		}
+	}
+
+	// compile the code, running the steps only if compilation succeeds
+	if len(cs.ContainerConfig.Compile) > 0 && pctx.Err() == nil {
+		code, err = cs.compile(pctx, in)
+		if err != nil {
+			cs.Close()
+			if pctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+
+	// run steps
+	for _, step := range cs.pipelineSteps() {
+		if pctx.Err() != nil {
+			break
+		}
+		err = cs.UpdateStatus(StatusUpdate{Status: "step", Step: step.Name})
+		if err != nil {
+			break
+		}
+		cs.Events.Record("step_start", step.Name)
+		code, err = cs.runStep(pctx, in, step)
+		if err != nil && pctx.Err() == nil {
+			cs.Events.Record("step_failed", err.Error())
+			cs.UpdateStatus(StatusUpdate{Status: "step_failed", Step: step.Name, Error: err.Error(), Code: codeStepFailed, ExitCode: &code})
+			if step.OnFailure == "continue" {
+				err = nil
+				continue
+			}
+		}
+		if err != nil {
+			break
+		}
+		cs.UpdateStatus(StatusUpdate{Status: "step_done", Step: step.Name, ExitCode: &code})
+	}
+
+	// run teardown hook, even if a step failed
+	if teardown := cs.ContainerConfig.Teardown; teardown != nil && pctx.Err() == nil {
+		terr := cs.runHook(pctx, in, "teardown", *teardown)
+		if terr != nil {
+			cs.Events.Record("error", terr.Error())
+		}
+	}
+
+	// collect artifacts once the pipeline has completed
+	if err == nil && cs.collectsArtifacts() {
+		aerr := cs.sendArtifacts(ctx, code)
+		if aerr != nil {
+			cs.Events.Record("error", aerr.Error())
+		}
+	}
+
+	// close session
+	cs.Close()
+
+	if pctx.Err() != nil {
+		return nil
+	}
+	return err
+}
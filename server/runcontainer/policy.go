@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// policyTimeout is the timeout for checking a submission against the execution policy.
+const policyTimeout = 5 * time.Second
+
+// policyRejections counts the submissions rejected by the execution policy.
+var policyRejections = &Counter{
+	Name:   "openrepl_policy_rejections_total",
+	Help:   "Number of submissions rejected by the execution policy, by hook.",
+	Labels: []string{"hook"},
+}
+
+func init() {
+	metrics.Register(policyRejections)
+}
+
+// PolicyRequest is a submission checked against the execution policy before its container is created.
+type PolicyRequest struct {
+	Session   string `json:"session"`
+	Language  string `json:"language"`
+	Tenant    string `json:"tenant,omitempty"`
+	Principal string `json:"principal,omitempty"`
+	Remote    string `json:"remote"`
+	Code      string `json:"code"`
+}
+
+// PolicyHook checks a submission before it is run.
+type PolicyHook interface {
+	// Check returns a *PolicyRejection if the submission must not run, or another error if it could not be checked.
+	Check(ctx context.Context, req PolicyRequest) error
+}
+
+// PolicyRejection is an error rejecting a submission, whose reason is relayed to the client.
+type PolicyRejection struct {
+	// Hook is the name of the hook which rejected the submission.
+	Hook string
+
+	Reason string
+}
+
+func (pr *PolicyRejection) Error() string {
+	return "submission rejected: " + pr.Reason
+}
+
+// Policy is a list of hooks, all of which must accept a submission.
+// A nil Policy accepts every submission.
+type Policy []PolicyHook
+
+// Check checks a submission against every hook, stopping at the first rejection.
+func (p Policy) Check(ctx context.Context, req PolicyRequest) error {
+	for _, h := range p {
+		err := h.Check(ctx, req)
+		if pr, ok := err.(*PolicyRejection); ok {
+			policyRejections.Add(1, pr.Hook)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PolicyRule rejects code matching a pattern.
+type PolicyRule struct {
+	// Name identifies the rule in logs, and Reason is sent to the client.
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+
+	Pattern string `json:"pattern"`
+
+	// Languages are the languages to which the rule applies.
+	// If empty, it applies to every language.
+	Languages []string `json:"languages,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// RulePolicy is a PolicyHook applying built-in size and pattern rules.
+type RulePolicy struct {
+	// MaxSize is the maximum size of the code in bytes.
+	// If zero, the size is unlimited.
+	MaxSize int `json:"max_size"`
+
+	Rules []PolicyRule `json:"rules"`
+}
+
+// LoadRulePolicy loads a RulePolicy from a JSON file, compiling its patterns.
+func LoadRulePolicy(path string) (*RulePolicy, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rp RulePolicy
+	err = json.Unmarshal(dat, &rp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy rules: %s", err.Error())
+	}
+	for i := range rp.Rules {
+		r := &rp.Rules[i]
+		r.re, err = regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of policy rule %q: %s", r.Name, err.Error())
+		}
+	}
+	return &rp, nil
+}
+
+func (rp *RulePolicy) Check(ctx context.Context, req PolicyRequest) error {
+	if rp.MaxSize > 0 && len(req.Code) > rp.MaxSize {
+		return &PolicyRejection{Hook: "size", Reason: fmt.Sprintf("code exceeds %d bytes", rp.MaxSize)}
+	}
+	for _, r := range rp.Rules {
+		if len(r.Languages) > 0 && !inList(req.Language, r.Languages) {
+			continue
+		}
+		if r.re != nil && r.re.MatchString(req.Code) {
+			reason := r.Reason
+			if reason == "" {
+				reason = "code matches a blocked pattern"
+			}
+			return &PolicyRejection{Hook: "rule:" + r.Name, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// PolicyVerdict is the response of a policy webhook.
+type PolicyVerdict struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// WebhookPolicy is a PolicyHook which posts submissions to an external service, which responds with a PolicyVerdict.
+type WebhookPolicy struct {
+	URL    string
+	Client *http.Client
+
+	// FailOpen is whether submissions are accepted when the webhook fails.
+	// Otherwise, they are rejected.
+	FailOpen bool
+}
+
+func (wp *WebhookPolicy) Check(ctx context.Context, req PolicyRequest) error {
+	v, err := wp.post(ctx, req)
+	switch {
+	case err != nil && wp.FailOpen:
+		return nil
+	case err != nil:
+		return fmt.Errorf("policy webhook failed: %s", err.Error())
+	case !v.Allow:
+		reason := v.Reason
+		if reason == "" {
+			reason = "rejected by policy"
+		}
+		return &PolicyRejection{Hook: "webhook", Reason: reason}
+	default:
+		return nil
+	}
+}
+
+// post sends a submission to the webhook.
+func (wp *WebhookPolicy) post(ctx context.Context, req PolicyRequest) (PolicyVerdict, error) {
+	dat, err := json.Marshal(req)
+	if err != nil {
+		return PolicyVerdict{}, err
+	}
+	hreq, err := http.NewRequest(http.MethodPost, wp.URL, bytes.NewReader(dat))
+	if err != nil {
+		return PolicyVerdict{}, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := wp.Client.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return PolicyVerdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return PolicyVerdict{}, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	var v PolicyVerdict
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&v)
+	if err != nil {
+		return PolicyVerdict{}, err
+	}
+	return v, nil
+}
+
+// checkPolicy checks the code of the session against the execution policy.
+func (cs *ContainerSession) checkPolicy() error {
+	ctx, cancel := context.WithTimeout(context.Background(), policyTimeout)
+	defer cancel()
+	return cs.Config.Policy.Check(ctx, PolicyRequest{
+		Session:   cs.ID,
+		Language:  cs.ContainerConfig.Language,
+		Tenant:    cs.Tenant,
+		Principal: cs.Options.Principal,
+		Remote:    remoteIP(cs.Remote),
+		Code:      string(cs.code),
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRulePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"max_size": 64,
+		"rules": [
+			{"name": "miner", "pattern": "stratum\\+tcp://", "reason": "cryptocurrency mining is not allowed"},
+			{"name": "fork", "pattern": ":\\(\\)\\{", "languages": ["bash"]}
+		]
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := LoadRulePolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tbl := []struct {
+		lang   string
+		code   string
+		reject string
+	}{
+		{"python3", "print(1)", ""},
+		{"python3", strings.Repeat("x", 65), "size"},
+		{"python3", `connect("stratum+tcp://pool")`, "rule:miner"},
+		{"bash", ":(){ :|:& };:", "rule:fork"},
+		{"python3", ":(){ :|:& };:", ""},
+	}
+	for _, tc := range tbl {
+		err := Policy{rp}.Check(context.Background(), PolicyRequest{Language: tc.lang, Code: tc.code})
+		pr, _ := err.(*PolicyRejection)
+		switch {
+		case tc.reject == "" && err != nil:
+			t.Errorf("%s %q: unexpected error %v", tc.lang, tc.code, err)
+		case tc.reject != "" && (pr == nil || pr.Hook != tc.reject):
+			t.Errorf("%s %q: expected rejection by %s, got %v", tc.lang, tc.code, tc.reject, err)
+		}
+	}
+}
+
+func TestWebhookPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req PolicyRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Code {
+		case "fail":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case "bad":
+			json.NewEncoder(w).Encode(PolicyVerdict{Reason: "known payload"})
+		default:
+			json.NewEncoder(w).Encode(PolicyVerdict{Allow: true})
+		}
+	}))
+	defer srv.Close()
+	wp := &WebhookPolicy{URL: srv.URL, Client: srv.Client()}
+
+	if err := wp.Check(context.Background(), PolicyRequest{Code: "good"}); err != nil {
+		t.Errorf("expected submission to be accepted, got %v", err)
+	}
+	err := wp.Check(context.Background(), PolicyRequest{Code: "bad"})
+	if pr, ok := err.(*PolicyRejection); !ok || pr.Reason != "known payload" {
+		t.Errorf("expected rejection with the webhook reason, got %v", err)
+	}
+
+	// failures reject submissions unless the policy fails open
+	err = wp.Check(context.Background(), PolicyRequest{Code: "fail"})
+	if _, ok := err.(*PolicyRejection); ok || err == nil {
+		t.Errorf("expected webhook failure, got %v", err)
+	}
+	wp.FailOpen = true
+	if err := wp.Check(context.Background(), PolicyRequest{Code: "fail"}); err != nil {
+		t.Errorf("expected failing webhook to accept submission, got %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ClientConn is a message-based connection to the client of a session.
+// It is implemented by *websocket.Conn and by the long-polling fallback transport.
+type ClientConn interface {
+	WriteJSON(v interface{}) error
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	ReadMessage() (messageType int, p []byte, err error)
+	NextReader() (messageType int, r io.Reader, err error)
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+// errPollClosed is returned when using a long-polling connection after it has been closed.
+var errPollClosed = errors.New("poll connection closed")
+
+// pollBufferSize is the amount of unacknowledged output after which writes to a long-polling client block.
+const pollBufferSize = 1 << 20
+
+// pollStallTimeout is the amount of time after which a client which does not fetch buffered output is disconnected.
+const pollStallTimeout = time.Minute
+
+// pollIdleGrace is the amount of time beyond the poll timeout after which a client which has not made any request is disconnected.
+// This includes clients which never poll after starting a session.
+const pollIdleGrace = time.Minute
+
+// maxPollInput is the maximum size of a message sent by a long-polling client.
+const maxPollInput = 1 << 20
+
+// PollMessage is a message sent to a long-polling client.
+type PollMessage struct {
+	// Seq is the sequence number of the message.
+	Seq int64 `json:"seq"`
+
+	// Type is the type of the message ("text", "binary" or "close").
+	Type string `json:"type"`
+
+	// Data is the content of the message.
+	Data []byte `json:"data,omitempty"`
+}
+
+// PollResponse is the response to a poll request.
+type PollResponse struct {
+	// Messages is the list of messages starting at the requested cursor.
+	Messages []PollMessage `json:"messages"`
+
+	// Closed is whether the connection has been closed, in which case no further messages follow.
+	Closed bool `json:"closed,omitempty"`
+}
+
+// PollSession is the response to starting a long-polling session.
+type PollSession struct {
+	// Token identifies the connection in poll requests.
+	Token string `json:"token"`
+}
+
+// pollInput is a message received from a long-polling client.
+type pollInput struct {
+	t   int
+	dat []byte
+}
+
+// pollConn is a ClientConn over which the client receives output by polling with a cursor and sends input with POST requests.
+type pollConn struct {
+	token string
+
+	lck    sync.Mutex
+	out    []PollMessage
+	seq    int64
+	size   int
+	closed bool
+	wake   chan struct{}
+	pong   func(string) error
+
+	// active is the time of the last request by the client.
+	active time.Time
+
+	in     chan pollInput
+	hangup chan struct{}
+}
+
+func newPollConn(token string) *pollConn {
+	return &pollConn{
+		token:  token,
+		active: time.Now(),
+		wake:   make(chan struct{}),
+		in:     make(chan pollInput, 16),
+		hangup: make(chan struct{}),
+	}
+}
+
+// notify wakes up everything waiting on the connection.
+// The lock must be held.
+func (pc *pollConn) notify() {
+	close(pc.wake)
+	pc.wake = make(chan struct{})
+}
+
+// hang disconnects the client, unblocking reads.
+// The lock must be held.
+func (pc *pollConn) hang() {
+	if !pc.closed {
+		pc.closed = true
+		close(pc.hangup)
+		pc.notify()
+	}
+}
+
+func (pc *pollConn) WriteMessage(messageType int, data []byte) error {
+	var typ string
+	switch messageType {
+	case websocket.TextMessage:
+		typ = "text"
+	case websocket.BinaryMessage:
+		typ = "binary"
+	case websocket.CloseMessage:
+		typ = "close"
+		data = nil
+	default:
+		return errors.New("unsupported message type")
+	}
+
+	pc.lck.Lock()
+	defer pc.lck.Unlock()
+
+	// wait for the client to catch up, disconnecting stalled clients
+	if pc.size > pollBufferSize {
+		timer := time.NewTimer(pollStallTimeout)
+		defer timer.Stop()
+		for pc.size > pollBufferSize && !pc.closed {
+			wake := pc.wake
+			pc.lck.Unlock()
+			select {
+			case <-wake:
+				pc.lck.Lock()
+			case <-timer.C:
+				pc.lck.Lock()
+				pc.hang()
+			}
+		}
+	}
+	if pc.closed {
+		return errPollClosed
+	}
+
+	pc.out = append(pc.out, PollMessage{
+		Seq:  pc.seq,
+		Type: typ,
+		Data: append([]byte(nil), data...),
+	})
+	pc.seq++
+	pc.size += len(data)
+	pc.notify()
+	return nil
+}
+
+func (pc *pollConn) WriteJSON(v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return pc.WriteMessage(websocket.TextMessage, dat)
+}
+
+// WriteControl discards control messages, as polls are treated as pongs.
+func (pc *pollConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	select {
+	case <-pc.hangup:
+		return errPollClosed
+	default:
+		return nil
+	}
+}
+
+func (pc *pollConn) ReadMessage() (int, []byte, error) {
+	select {
+	case msg := <-pc.in:
+		return msg.t, msg.dat, nil
+	case <-pc.hangup:
+		return 0, nil, errPollClosed
+	}
+}
+
+func (pc *pollConn) NextReader() (int, io.Reader, error) {
+	t, dat, err := pc.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return t, bytes.NewReader(dat), nil
+}
+
+// SetPongHandler sets the handler called on every request by the client.
+func (pc *pollConn) SetPongHandler(h func(appData string) error) {
+	pc.lck.Lock()
+	defer pc.lck.Unlock()
+	pc.pong = h
+}
+
+func (pc *pollConn) Close() error {
+	pc.lck.Lock()
+	defer pc.lck.Unlock()
+	pc.hang()
+	return nil
+}
+
+// touch records activity by the client.
+func (pc *pollConn) touch() {
+	pc.lck.Lock()
+	pong := pc.pong
+	pc.active = time.Now()
+	pc.lck.Unlock()
+	if pong != nil {
+		pong("")
+	}
+}
+
+// push queues a message sent by the client.
+func (pc *pollConn) push(t int, dat []byte) error {
+	pc.touch()
+	select {
+	case pc.in <- pollInput{t, dat}:
+		return nil
+	case <-pc.hangup:
+		return errPollClosed
+	}
+}
+
+// poll acknowledges the messages before the cursor and waits for new messages.
+func (pc *pollConn) poll(cursor int64, timeout time.Duration) PollResponse {
+	pc.touch()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	pc.lck.Lock()
+	defer pc.lck.Unlock()
+	for {
+		// drop acknowledged messages
+		n := 0
+		for n < len(pc.out) && pc.out[n].Seq < cursor {
+			if pc.out[n].Type == "close" {
+				// the client has seen the close message
+				pc.hang()
+			}
+			pc.size -= len(pc.out[n].Data)
+			n++
+		}
+		if n > 0 {
+			pc.out = pc.out[n:]
+			pc.notify()
+		}
+
+		if len(pc.out) > 0 || pc.closed {
+			return PollResponse{
+				Messages: append([]PollMessage(nil), pc.out...),
+				Closed:   pc.closed,
+			}
+		}
+
+		// wait for messages
+		wake := pc.wake
+		pc.lck.Unlock()
+		select {
+		case <-wake:
+			pc.lck.Lock()
+		case <-timer.C:
+			pc.lck.Lock()
+			return PollResponse{Messages: []PollMessage{}}
+		}
+	}
+}
+
+// PollStore keeps the connections of long-polling clients.
+type PollStore struct {
+	lck   sync.Mutex
+	conns map[string]*pollConn
+
+	// Timeout is the maximum amount of time for which a poll request waits for messages.
+	Timeout time.Duration
+}
+
+// New creates a long-polling connection.
+func (ps *PollStore) New() (*pollConn, error) {
+	token, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	pc := newPollConn(token)
+
+	ps.lck.Lock()
+	defer ps.lck.Unlock()
+	if ps.conns == nil {
+		ps.conns = make(map[string]*pollConn)
+	}
+	ps.conns[token] = pc
+	return pc, nil
+}
+
+// release removes a connection once the client has had time to fetch the final messages.
+func (ps *PollStore) release(pc *pollConn) {
+	pc.Close()
+	time.AfterFunc(ps.Timeout, func() {
+		ps.lck.Lock()
+		defer ps.lck.Unlock()
+		delete(ps.conns, pc.token)
+	})
+}
+
+// Reap disconnects the clients which have not made a request for longer than the poll timeout and pollIdleGrace.
+func (ps *PollStore) Reap(now time.Time) {
+	ps.lck.Lock()
+	conns := make([]*pollConn, 0, len(ps.conns))
+	for _, pc := range ps.conns {
+		conns = append(conns, pc)
+	}
+	ps.lck.Unlock()
+	for _, pc := range conns {
+		pc.lck.Lock()
+		if now.Sub(pc.active) > ps.Timeout+pollIdleGrace {
+			pc.hang()
+		}
+		pc.lck.Unlock()
+	}
+}
+
+// Run periodically disconnects idle clients.
+func (ps *PollStore) Run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for now := range tick.C {
+		ps.Reap(now)
+	}
+}
+
+// Len returns the number of long-polling connections.
+func (ps *PollStore) Len() int {
+	ps.lck.Lock()
+	defer ps.lck.Unlock()
+	return len(ps.conns)
+}
+
+// Get looks up a long-polling connection by token.
+// Returns nil if the connection does not exist.
+func (ps *PollStore) Get(token string) *pollConn {
+	ps.lck.Lock()
+	defer ps.lck.Unlock()
+	return ps.conns[token]
+}
+
+// ServeHTTP serves poll requests.
+// GET receives the messages starting at the cursor, POST sends a message, and DELETE disconnects.
+func (ps *PollStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	pc := ps.Get(q.Get("token"))
+	if pc == nil {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var cursor int64
+		if c := q.Get("cursor"); c != "" {
+			var err error
+			cursor, err = strconv.ParseInt(c, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pc.poll(cursor, ps.Timeout))
+	case http.MethodPost:
+		dat, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPollInput))
+		if err != nil {
+			http.Error(w, "failed to read message", http.StatusBadRequest)
+			return
+		}
+		t := websocket.TextMessage
+		if q.Get("type") == "binary" {
+			t = websocket.BinaryMessage
+		}
+		err = pc.push(t, dat)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		pc.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPollConn(t *testing.T) {
+	pc := newPollConn("test")
+
+	// messages are kept until acknowledged
+	pc.WriteMessage(websocket.TextMessage, []byte("a"))
+	pc.WriteMessage(websocket.TextMessage, []byte("b"))
+	res := pc.poll(0, time.Second)
+	if len(res.Messages) != 2 || string(res.Messages[0].Data) != "a" || string(res.Messages[1].Data) != "b" {
+		t.Fatalf("expected messages a and b but got %+v", res)
+	}
+	res = pc.poll(1, time.Second)
+	if len(res.Messages) != 1 || res.Messages[0].Seq != 1 {
+		t.Fatalf("expected message 1 but got %+v", res)
+	}
+
+	// empty polls time out
+	res = pc.poll(2, 10*time.Millisecond)
+	if len(res.Messages) != 0 || res.Closed {
+		t.Fatalf("expected no messages but got %+v", res)
+	}
+
+	// input is delivered to readers
+	go pc.push(websocket.BinaryMessage, []byte("in"))
+	typ, dat, err := pc.ReadMessage()
+	if err != nil || typ != websocket.BinaryMessage || string(dat) != "in" {
+		t.Fatalf("expected binary message %q but got %d %q (%v)", "in", typ, dat, err)
+	}
+
+	// acknowledging the close message disconnects readers
+	pc.WriteMessage(websocket.CloseMessage, []byte("ignored"))
+	res = pc.poll(2, time.Second)
+	if len(res.Messages) != 1 || res.Messages[0].Type != "close" {
+		t.Fatalf("expected close message but got %+v", res)
+	}
+	pc.poll(3, time.Second)
+	_, _, err = pc.ReadMessage()
+	if err != errPollClosed {
+		t.Fatalf("expected %v but got %v", errPollClosed, err)
+	}
+}
+
+func TestPollStoreReap(t *testing.T) {
+	ps := &PollStore{Timeout: 30 * time.Second}
+	idle, _ := ps.New()
+	active, _ := ps.New()
+	now := idle.active.Add(ps.Timeout + pollIdleGrace + time.Second)
+	active.active = now.Add(-ps.Timeout)
+
+	// clients which have not made a request since the grace period are disconnected
+	ps.Reap(now)
+	if _, _, err := idle.ReadMessage(); err != errPollClosed {
+		t.Errorf("expected idle connection to be closed, got %v", err)
+	}
+	active.lck.Lock()
+	closed := active.closed
+	active.lck.Unlock()
+	if closed {
+		t.Error("active connection was closed")
+	}
+}
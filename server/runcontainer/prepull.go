@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// imagePulls counts image pulls made ahead of use.
+var imagePulls = &Counter{
+	Name:   "openrepl_image_prepulls_total",
+	Help:   "Number of images pulled ahead of use, by result.",
+	Labels: []string{"result"},
+}
+
+// imageLastPull records the time of the last pull of each image, and imagePullOK whether it succeeded.
+var imageLastPull = &Gauge{
+	Name:   "openrepl_image_last_pull_timestamp_seconds",
+	Help:   "Unix time of the last pull of an image.",
+	Labels: []string{"image"},
+}
+
+var imagePullOK = &Gauge{
+	Name:   "openrepl_image_last_pull_success",
+	Help:   "Whether the last pull of an image succeeded (1) or failed (0).",
+	Labels: []string{"image"},
+}
+
+func init() {
+	metrics.Register(imagePulls)
+	metrics.Register(imageLastPull)
+	metrics.Register(imagePullOK)
+}
+
+// pullImage pulls an image, waiting for the pull to complete.
+func pullImage(ctx context.Context, cli *client.Client, auth *RegistryAuth, img string) error {
+	return pullImageProgress(ctx, cli, auth, img, nil)
+}
+
+// PullRequest is a request to distribute images to the host ahead of use.
+// A rollout sends it to every executor before activating a configuration which uses new or updated images.
+type PullRequest struct {
+	// Images is the set of images to pull.
+	// If empty, the images of all configured languages are pulled.
+	Images []string `json:"images,omitempty"`
+
+	// Missing is whether only images which are not already present are pulled.
+	// Otherwise, present images are pulled again to pick up updated tags.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// PullResult is the result of pulling an image.
+type PullResult struct {
+	Image string `json:"image"`
+
+	// Status is "pulled", "present" (if skipped) or "failed".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Time is the time at which the pull completed.
+	Time time.Time `json:"time"`
+
+	// Duration is the time spent pulling, in seconds.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// pullTargets returns the deduplicated and sorted set of images to pull for a request.
+func (req PullRequest) pullTargets(langs map[string]Language) []string {
+	imgs := req.Images
+	if len(imgs) == 0 {
+		for img := range languageImages(langs) {
+			imgs = append(imgs, img)
+		}
+	}
+	var targets []string
+	for _, img := range imgs {
+		if img != "" && !inList(img, targets) {
+			targets = append(targets, img)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// pullImages pulls the requested images one at a time, so that pulls do not starve running sessions of bandwidth.
+func (cs *ContainerServer) pullImages(ctx context.Context, req PullRequest) []PullResult {
+	cli := cs.SessionConfig.DockerClient
+	targets := req.pullTargets(cs.languages())
+	results := make([]PullResult, 0, len(targets))
+	for _, img := range targets {
+		res := PullResult{Image: img}
+		if req.Missing {
+			_, _, err := cli.ImageInspectWithRaw(ctx, img)
+			if err == nil {
+				res.Status = "present"
+				results = append(results, res)
+				continue
+			}
+		}
+		t := time.Now()
+		err := pullImage(ctx, cli, cs.SessionConfig.Registries, img)
+		res.Time = time.Now()
+		res.Duration = res.Time.Sub(t).Seconds()
+		if err != nil {
+			serverLog.Errorf("failed to pull image %s: %s", img, err.Error())
+			res.Status, res.Error = "failed", err.Error()
+		} else {
+			res.Status = "pulled"
+		}
+		imagePulls.Add(1, res.Status)
+		cs.recordPull(res)
+		results = append(results, res)
+	}
+	return results
+}
+
+// recordPull keeps the result of the last pull of an image.
+func (cs *ContainerServer) recordPull(res PullResult) {
+	ok := 0.0
+	if res.Status == "pulled" {
+		ok = 1
+	}
+	imageLastPull.Set(float64(res.Time.Unix()), res.Image)
+	imagePullOK.Set(ok, res.Image)
+
+	cs.pullLck.Lock()
+	defer cs.pullLck.Unlock()
+	if cs.lastPulls == nil {
+		cs.lastPulls = make(map[string]PullResult)
+	}
+	cs.lastPulls[res.Image] = res
+}
+
+// lastPull returns the result of the last pull of an image, or nil if it has not been pulled since the server started.
+func (cs *ContainerServer) lastPull(img string) *PullResult {
+	cs.pullLck.Lock()
+	defer cs.pullLck.Unlock()
+	res, ok := cs.lastPulls[img]
+	if !ok {
+		return nil
+	}
+	return &res
+}
+
+// RunPrepull periodically pulls the images of all configured languages again, so that updated tags are picked up before sessions use them.
+func (cs *ContainerServer) RunPrepull(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		var failed int
+		for _, res := range cs.pullImages(context.Background(), PullRequest{}) {
+			if res.Status == "failed" {
+				failed++
+			}
+		}
+		if failed > 0 {
+			serverLog.Errorf("scheduled image pull: %d images failed to pull", failed)
+		}
+	}
+}
+
+// HandleAdminPull pulls images onto the host, responding once every pull has completed.
+// The response status is 502 if any pull failed, so that a rollout can hold back activation.
+func (cs *ContainerServer) HandleAdminPull(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if cs.SessionConfig.DockerClient == nil {
+		http.Error(w, "image pulls "+errRequiresDocker.Error(), http.StatusNotImplemented)
+		return
+	}
+	var req PullRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "failed to decode pull request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := cs.pullImages(r.Context(), req)
+	status := http.StatusOK
+	for _, res := range results {
+		if res.Status == "failed" {
+			status = http.StatusBadGateway
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPullTargets(t *testing.T) {
+	langs := map[string]Language{
+		"python": {RunContainer: ContainerConfig{Image: "openrepl/python"}, TermContainer: ContainerConfig{Image: "openrepl/python"}},
+		"go":     {RunContainer: ContainerConfig{Image: "openrepl/go", FallbackImage: "golang"}},
+	}
+	tests := []struct {
+		name   string
+		req    PullRequest
+		expect []string
+	}{
+		{"all languages", PullRequest{}, []string{"golang", "openrepl/go", "openrepl/python"}},
+		{"requested", PullRequest{Images: []string{"openrepl/rust:2", "", "openrepl/ada", "openrepl/rust:2"}}, []string{"openrepl/ada", "openrepl/rust:2"}},
+	}
+	for _, test := range tests {
+		targets := test.req.pullTargets(langs)
+		if !reflect.DeepEqual(targets, test.expect) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expect, targets)
+		}
+	}
+}
+
+func TestRecordPull(t *testing.T) {
+	var cs ContainerServer
+	if res := cs.lastPull("openrepl/python"); res != nil {
+		t.Errorf("expected no pull, got %+v", res)
+	}
+	cs.recordPull(PullResult{Image: "openrepl/python", Status: "failed", Error: "timeout"})
+	cs.recordPull(PullResult{Image: "openrepl/python", Status: "pulled"})
+	res := cs.lastPull("openrepl/python")
+	if res == nil || res.Status != "pulled" || res.Error != "" {
+		t.Errorf("expected last pull to succeed, got %+v", res)
+	}
+	if res := cs.lastPull("openrepl/go"); res != nil {
+		t.Errorf("expected no pull of other image, got %+v", res)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ProjectConfig is a configuration for running multi-file projects.
+type ProjectConfig struct {
+	// Dir is the directory into which project files are extracted, which is also the working directory of the program.
+	// If empty, WorkDir is used, or the root directory if that is also empty.
+	Dir string `json:"dir,omitempty"`
+
+	// Entry is the path of the file which is run, relative to Dir.
+	// Clients may select a different entry file.
+	Entry string `json:"entry,omitempty"`
+}
+
+// ProjectFile is a file of a multi-file project.
+type ProjectFile struct {
+	// Path is the path of the file, relative to the project directory.
+	Path string `json:"path"`
+
+	Contents string `json:"contents"`
+
+	// Executable is whether the file may be executed.
+	Executable bool `json:"executable,omitempty"`
+}
+
+// Limits on the size of projects, which apply after decompression.
+const (
+	maxProjectFiles = 1000
+	maxProjectSize  = 32 << 20
+)
+
+// cleanProjectPath validates and normalizes a path within a project.
+func cleanProjectPath(p string) (string, error) {
+	if p == "" || path.IsAbs(p) || strings.Contains(p, `\`) {
+		return "", fmt.Errorf("invalid project path %q", p)
+	}
+	clean := path.Clean(p)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid project path %q", p)
+	}
+	return clean, nil
+}
+
+// parseProject decodes project files uploaded as a tarball (optionally gzipped) or as a JSON manifest.
+// Paths are normalized and checked to stay within the project directory.
+func parseProject(format string, dat []byte) ([]ProjectFile, error) {
+	var files []ProjectFile
+	switch format {
+	case "json":
+		err := json.Unmarshal(dat, &files)
+		if err != nil {
+			return nil, fmt.Errorf("invalid project manifest: %s", err.Error())
+		}
+	case "tar":
+		var err error
+		files, err = readProjectTarball(dat)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported project format %q", format)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("project contains no files")
+	}
+	if len(files) > maxProjectFiles {
+		return nil, fmt.Errorf("project contains more than %d files", maxProjectFiles)
+	}
+	seen := make(map[string]bool)
+	var size int
+	for i, f := range files {
+		p, err := cleanProjectPath(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if seen[p] {
+			return nil, fmt.Errorf("duplicate project path %q", p)
+		}
+		seen[p] = true
+		size += len(f.Contents)
+		if size > maxProjectSize {
+			return nil, fmt.Errorf("project exceeds %d bytes", maxProjectSize)
+		}
+		files[i].Path = p
+	}
+	for p := range seen {
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			if seen[d] {
+				return nil, fmt.Errorf("project path %q is both a file and a directory", d)
+			}
+		}
+	}
+	return files, nil
+}
+
+// readProjectTarball reads the regular files of a tarball, ignoring directory entries.
+func readProjectTarball(dat []byte) ([]ProjectFile, error) {
+	var r io.Reader = bytes.NewReader(dat)
+	if len(dat) >= 2 && dat[0] == 0x1f && dat[1] == 0x8b {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid project tarball: %s", err.Error())
+		}
+		r = gr
+	}
+	// the limit is checked again on the decoded files
+	tr := tar.NewReader(io.LimitReader(r, maxProjectSize+1))
+
+	var files []ProjectFile
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid project tarball: %s", err.Error())
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			return nil, fmt.Errorf("unsupported file type in project tarball: %s", hdr.Name)
+		}
+		if len(files) == maxProjectFiles {
+			return nil, fmt.Errorf("project contains more than %d files", maxProjectFiles)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid project tarball: %s", err.Error())
+		}
+		files = append(files, ProjectFile{
+			Path:       strings.TrimPrefix(hdr.Name, "./"),
+			Contents:   string(contents),
+			Executable: hdr.Mode&0111 != 0,
+		})
+	}
+	return files, nil
+}
+
+// projectDir returns the directory into which project files are extracted on the given container operating system.
+func (cc ContainerConfig) projectDir(os string) string {
+	switch {
+	case cc.Project != nil && cc.Project.Dir != "":
+		return cc.Project.Dir
+	case cc.WorkDir != "":
+		return cc.WorkDir
+	default:
+		return codeDir(os)
+	}
+}
+
+// withProject returns a copy of the ContainerConfig which runs a project from its project directory.
+// Returns the path of the entry file relative to the project directory, which is the configured entry unless one is given.
+func (cc ContainerConfig) withProject(os string, entry string) (ContainerConfig, string, error) {
+	if cc.Project == nil || os == "windows" {
+		return cc, "", errors.New("projects are not supported for this language")
+	}
+	if entry == "" {
+		entry = cc.Project.Entry
+	}
+	if entry == "" {
+		return cc, "", errors.New("an entry file is required")
+	}
+	entry, err := cleanProjectPath(entry)
+	if err != nil {
+		return cc, "", err
+	}
+	cc.WorkDir = cc.projectDir(os)
+	return cc, entry, nil
+}
+
+// projectEntries generates the tar entries of project files, preceded by their parent directories.
+// Files take the ownership and mode of the code file, and executable files are also executable in the container.
+func (cc ContainerConfig) projectEntries(os string, files []ProjectFile) []tarEntry {
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		for d := path.Dir(f.Path); d != "."; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+	dirList := make([]string, 0, len(dirs))
+	for d := range dirs {
+		dirList = append(dirList, d)
+	}
+	sort.Strings(dirList)
+
+	entries := make([]tarEntry, 0, len(dirList)+len(files))
+	for _, d := range dirList {
+		hdr := cc.codeHeader(os, 0)
+		hdr.Typeflag, hdr.Name, hdr.Mode = tar.TypeDir, d+"/", 0755
+		entries = append(entries, tarEntry{hdr: hdr})
+	}
+	for _, f := range files {
+		hdr := cc.codeHeader(os, int64(len(f.Contents)))
+		hdr.Name = f.Path
+		if f.Executable {
+			hdr.Mode |= 0111
+		}
+		entries = append(entries, tarEntry{hdr: hdr, dat: []byte(f.Contents)})
+	}
+	return entries
+}
+
+// copyProject copies project files into the container.
+// Files from earlier uploads (in watch mode) which are not replaced are left in place.
+func (cs *ContainerSession) copyProject(ctx context.Context, c *Container, dat []byte) error {
+	os := cs.Config.DaemonOS
+	cc := cs.ContainerConfig
+	files, err := parseProject(cs.Options.Project, dat)
+	if err != nil {
+		return err
+	}
+
+	// the entry file must be part of the project
+	var found bool
+	for _, f := range files {
+		found = found || f.Path == cs.Options.Entry
+	}
+	if !found {
+		return fmt.Errorf("entry file %s is not part of the project", cs.Options.Entry)
+	}
+
+	dir := cc.projectDir(os)
+	entries := cc.projectEntries(os, files)
+	tr := packTarball(entries)
+	defer tr.Close()
+	err = c.backend.CopyTo(ctx, c, dir, tr)
+	if err != nil {
+		return err
+	}
+
+	// remember the paths written, so that they are left out of diff reports
+	paths := make([]string, len(entries))
+	for i, e := range entries {
+		paths[i] = path.Join(dir, e.hdr.Name)
+	}
+	cs.projectPaths = paths
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+// tarball generates a tarball of project files, with directories as empty-bodied entries.
+func tarball(t *testing.T, gz bool, entries ...tarEntry) []byte {
+	dat, err := ioutil.ReadAll(packTarball(entries))
+	if err != nil {
+		t.Fatalf("failed to pack tarball: %s", err.Error())
+	}
+	if !gz {
+		return dat
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(dat)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestParseProject(t *testing.T) {
+	dir := tarEntry{hdr: &tar.Header{Name: "lib/", Typeflag: tar.TypeDir, Mode: 0755}}
+	main := tarEntry{hdr: &tar.Header{Name: "./main.py", Mode: 0644, Size: 6}, dat: []byte("import")}
+	lib := tarEntry{hdr: &tar.Header{Name: "lib/run.sh", Mode: 0755, Size: 2}, dat: []byte("ls")}
+	for _, gz := range []bool{false, true} {
+		files, err := parseProject("tar", tarball(t, gz, dir, main, lib))
+		if err != nil {
+			t.Fatalf("failed to parse tarball: %s", err.Error())
+		}
+		if len(files) != 2 || files[0] != (ProjectFile{"main.py", "import", false}) || files[1] != (ProjectFile{"lib/run.sh", "ls", true}) {
+			t.Errorf("unexpected files %+v", files)
+		}
+	}
+
+	files, err := parseProject("json", []byte(`[{"path": "src//main.go", "contents": "package main"}, {"path": "go.mod", "contents": "module x"}]`))
+	if err != nil {
+		t.Fatalf("failed to parse manifest: %s", err.Error())
+	}
+	if len(files) != 2 || files[0].Path != "src/main.go" || files[1].Contents != "module x" {
+		t.Errorf("unexpected files %+v", files)
+	}
+
+	// paths must stay within the project directory
+	link := tarEntry{hdr: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}
+	bad := []struct {
+		format string
+		dat    []byte
+	}{
+		{"json", []byte(`[]`)},
+		{"json", []byte(`{"path": "main.py"}`)},
+		{"json", []byte(`[{"path": "../main.py"}]`)},
+		{"json", []byte(`[{"path": "a/../../main.py"}]`)},
+		{"json", []byte(`[{"path": "/etc/passwd"}]`)},
+		{"json", []byte(`[{"path": "."}]`)},
+		{"json", []byte(`[{"path": "a\\b"}]`)},
+		{"json", []byte(`[{"path": "a"}, {"path": "./a"}]`)},
+		{"json", []byte(`[{"path": "a"}, {"path": "a/b"}]`)},
+		{"tar", tarball(t, false, link)},
+		{"tar", []byte("not a tarball")},
+		{"zip", []byte(`[]`)},
+	}
+	for _, v := range bad {
+		if _, err := parseProject(v.format, v.dat); err == nil {
+			t.Errorf("invalid %s project %q accepted", v.format, v.dat)
+		}
+	}
+}
+
+func TestWithProject(t *testing.T) {
+	tbl := []struct {
+		cc    ContainerConfig
+		entry string
+		dir   string
+		file  string
+	}{
+		{ContainerConfig{Project: &ProjectConfig{Dir: "/src", Entry: "main.py"}}, "", "/src", "main.py"},
+		{ContainerConfig{Project: &ProjectConfig{Dir: "/src", Entry: "main.py"}}, "./cmd/tool.py", "/src", "cmd/tool.py"},
+		{ContainerConfig{WorkDir: "/home/runner", Project: &ProjectConfig{Entry: "main.py"}}, "", "/home/runner", "main.py"},
+		{ContainerConfig{Project: &ProjectConfig{}}, "run.sh", "/", "run.sh"},
+	}
+	for _, v := range tbl {
+		cc, entry, err := v.cc.withProject("linux", v.entry)
+		if err != nil {
+			t.Errorf("%+v: %s", v.cc.Project, err.Error())
+			continue
+		}
+		if cc.WorkDir != v.dir || entry != v.file {
+			t.Errorf("%+v: expected %s in %s but got %s in %s", v.cc.Project, v.file, v.dir, entry, cc.WorkDir)
+		}
+	}
+
+	for _, v := range []struct {
+		cc    ContainerConfig
+		os    string
+		entry string
+	}{
+		{ContainerConfig{}, "linux", "main.py"},
+		{ContainerConfig{Project: &ProjectConfig{}}, "linux", ""},
+		{ContainerConfig{Project: &ProjectConfig{Entry: "main.py"}}, "windows", ""},
+		{ContainerConfig{Project: &ProjectConfig{Entry: "main.py"}}, "linux", "../main.py"},
+	} {
+		if _, _, err := v.cc.withProject(v.os, v.entry); err == nil {
+			t.Errorf("%+v on %s: entry %q accepted", v.cc.Project, v.os, v.entry)
+		}
+	}
+}
+
+func TestProjectEntries(t *testing.T) {
+	cc := ContainerConfig{CodeFile: &CodeFileConfig{UID: 1000, GID: 1000}}
+	entries := cc.projectEntries("linux", []ProjectFile{
+		{Path: "main.py", Contents: "hi"},
+		{Path: "pkg/sub/run.sh", Contents: "ls", Executable: true},
+	})
+	expect := []struct {
+		name string
+		mode int64
+		typ  byte
+	}{
+		{"pkg/", 0755, tar.TypeDir},
+		{"pkg/sub/", 0755, tar.TypeDir},
+		{"main.py", 0444, 0},
+		{"pkg/sub/run.sh", 0555, 0},
+	}
+	if len(entries) != len(expect) {
+		t.Fatalf("expected %d entries but got %d", len(expect), len(entries))
+	}
+	for i, e := range expect {
+		hdr := entries[i].hdr
+		if hdr.Name != e.name || hdr.Mode != e.mode || hdr.Typeflag != e.typ || hdr.Uid != 1000 || hdr.Gid != 1000 {
+			t.Errorf("entry %d: unexpected header %+v", i, hdr)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a local TCP connection, which unlike net.Pipe supports deadlines.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestWaitPrompt(t *testing.T) {
+	repl, container := tcpPair(t)
+	defer repl.Close()
+	defer container.Close()
+	cs := &ContainerSession{
+		Config:          &ContainerSessionConfig{OutputBufferSize: 16},
+		ContainerConfig: ContainerConfig{Prompt: ">>> $"},
+		Container:       &Container{IO: container},
+	}
+
+	// output before the prompt is kept for the client
+	go repl.Write([]byte("Python 3.12\n>>> "))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cs.waitPrompt(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if string(cs.pending) != "Python 3.12\n>>> " {
+		t.Errorf("unexpected pending output %q", cs.pending)
+	}
+
+	// a REPL which never prints its prompt times out
+	cs.pending = nil
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cs.waitPrompt(ctx); err == nil {
+		t.Error("expected timeout waiting for the prompt")
+	}
+}
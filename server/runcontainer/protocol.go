@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocolV3 is the subprotocol in which every message in either direction is a JSON Envelope sent as a text message.
+// Clients which do not offer it keep speaking the legacy protocols.
+const protocolV3 = "openrepl.v3"
+
+// Envelope is a message of the openrepl.v3 protocol.
+type Envelope struct {
+	// Type is the kind of message.
+	// The server sends "status", "stdout", "stderr", "eval_result", "notebook" and "message" messages.
+	// The client sends "code", "stdin", "resize", "signal", "eof", and "eval" or "notebook" requests in eval and notebook sessions.
+	Type string `json:"type"`
+
+	// Payload is the content of the message, whose format depends on the type.
+	// Status messages carry a StatusUpdate, and code, input and output carry a DataPayload.
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// DataPayload is the payload of messages carrying code, input or output.
+type DataPayload struct {
+	// Data is the content, which is base64-encoded in JSON.
+	Data []byte `json:"data"`
+
+	// Time is the number of seconds since the start of the session at which output was received, in timestamped output mode.
+	Time float64 `json:"t,omitempty"`
+}
+
+// SignalPayload is the payload of a signal message.
+type SignalPayload struct {
+	// Signal is the name of the signal (e.g. "SIGINT" or "INT").
+	Signal string `json:"signal"`
+}
+
+// envelopeConn is a ClientConn speaking the openrepl.v3 protocol over a connection.
+// Messages are translated to and from the openrepl.v2 messages handled by sessions, so that input is a binary message and controls are text messages.
+type envelopeConn struct {
+	conn ClientConn
+
+	// requests is set in eval and notebook sessions, which only accept code and requests.
+	requests bool
+
+	// wlck serializes writes, which are also made while reading to report invalid messages.
+	wlck sync.Mutex
+}
+
+func newEnvelopeConn(conn ClientConn, requests bool) *envelopeConn {
+	return &envelopeConn{conn: conn, requests: requests}
+}
+
+// send sends an envelope with a JSON-encoded payload.
+func (ec *envelopeConn) send(typ string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dat, err := json.Marshal(Envelope{Type: typ, Payload: payload})
+	if err != nil {
+		return err
+	}
+	ec.wlck.Lock()
+	defer ec.wlck.Unlock()
+	return ec.conn.WriteMessage(websocket.TextMessage, dat)
+}
+
+func (ec *envelopeConn) WriteJSON(v interface{}) error {
+	switch v := v.(type) {
+	case StatusUpdate:
+		return ec.send("status", v)
+	case OutputEvent:
+		typ := v.Stream
+		if typ == "" {
+			typ = "stdout"
+		}
+		return ec.send(typ, DataPayload{Data: v.Data, Time: v.Time})
+	case EvalResult:
+		return ec.send("eval_result", v)
+	case NotebookResult, NotebookRestart:
+		return ec.send("notebook", v)
+	default:
+		return ec.send("message", v)
+	}
+}
+
+// WriteMessage sends raw terminal output as stdout, and passes the close message through.
+func (ec *envelopeConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		ec.wlck.Lock()
+		defer ec.wlck.Unlock()
+		return ec.conn.WriteMessage(messageType, data)
+	}
+	return ec.send("stdout", DataPayload{Data: data})
+}
+
+func (ec *envelopeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return ec.conn.WriteControl(messageType, data, deadline)
+}
+
+// ReadMessage reads the next envelope, returning it as a legacy message.
+// Invalid envelopes are answered with a warning and skipped.
+func (ec *envelopeConn) ReadMessage() (int, []byte, error) {
+	for {
+		t, dat, err := ec.conn.ReadMessage()
+		if err != nil || t == websocket.CloseMessage {
+			return t, dat, err
+		}
+		var env Envelope
+		if t != websocket.TextMessage || json.Unmarshal(dat, &env) != nil {
+			err = ec.warn("invalid message envelope")
+		} else {
+			t, dat, err = ec.translate(env)
+			if err == nil {
+				return t, dat, nil
+			}
+			err = ec.warn(err.Error())
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// warn sends a warning about a message from the client.
+func (ec *envelopeConn) warn(msg string) error {
+	return ec.send("status", StatusUpdate{Status: "warning", Message: msg})
+}
+
+// translate converts an envelope to the corresponding legacy message.
+func (ec *envelopeConn) translate(env Envelope) (int, []byte, error) {
+	switch {
+	case env.Type == "code" || (env.Type == "stdin" && !ec.requests):
+		var dp DataPayload
+		if err := json.Unmarshal(env.Payload, &dp); err != nil {
+			return 0, nil, fmt.Errorf("invalid %s payload", env.Type)
+		}
+		return websocket.BinaryMessage, dp.Data, nil
+	case (env.Type == "eval" || env.Type == "notebook") && ec.requests:
+		return websocket.TextMessage, env.Payload, nil
+	case ec.requests:
+	case env.Type == "resize":
+		var msg ControlMessage
+		if err := json.Unmarshal(env.Payload, &msg); err != nil {
+			return 0, nil, fmt.Errorf("invalid %s payload", env.Type)
+		}
+		return controlMessage(ControlMessage{Type: "resize", Cols: msg.Cols, Rows: msg.Rows})
+	case env.Type == "signal":
+		var sp SignalPayload
+		if err := json.Unmarshal(env.Payload, &sp); err != nil {
+			return 0, nil, fmt.Errorf("invalid %s payload", env.Type)
+		}
+		return controlMessage(ControlMessage{Type: "signal", Signal: sp.Signal})
+	case env.Type == "eof":
+		return controlMessage(ControlMessage{Type: "eof"})
+	}
+	return 0, nil, fmt.Errorf("unsupported message type %q", env.Type)
+}
+
+// controlMessage encodes a ControlMessage as a legacy text message.
+func controlMessage(msg ControlMessage) (int, []byte, error) {
+	dat, err := json.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, dat, nil
+}
+
+func (ec *envelopeConn) NextReader() (int, io.Reader, error) {
+	t, dat, err := ec.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return t, bytes.NewReader(dat), nil
+}
+
+func (ec *envelopeConn) SetPongHandler(h func(appData string) error) {
+	ec.conn.SetPongHandler(h)
+}
+
+func (ec *envelopeConn) Close() error {
+	return ec.conn.Close()
+}
+
+// allowedSignals are the signals which clients may send to the program.
+var allowedSignals = []string{"INT", "TERM", "HUP", "QUIT", "KILL", "USR1", "USR2"}
+
+// signal sends a signal to the program of the container.
+func (cs *ContainerSession) signal(sig string) error {
+	sig = strings.TrimPrefix(strings.ToUpper(sig), "SIG")
+	if !inList(sig, allowedSignals) {
+		return fmt.Errorf("signal %q not supported", sig)
+	}
+	c := cs.Container
+	if c.cli == nil {
+		return errRequiresDocker
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resizeTimeout)
+	defer cancel()
+	return c.cli.ContainerKill(ctx, c.ID, sig)
+}
+
+// endInput ends the input of the program, which is an end-of-transmission character on a terminal.
+func (cs *ContainerSession) endInput() error {
+	if !cs.ContainerConfig.noTTY {
+		_, err := cs.Container.Write([]byte{4})
+		return err
+	}
+	return cs.Container.closeInput()
+}
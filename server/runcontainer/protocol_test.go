@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// queueConn is a ClientConn which returns queued messages and records written messages.
+type queueConn struct {
+	in  [][]byte
+	out [][]byte
+}
+
+func (qc *queueConn) WriteJSON(v interface{}) error {
+	dat, err := json.Marshal(v)
+	qc.out = append(qc.out, dat)
+	return err
+}
+func (qc *queueConn) WriteMessage(t int, dat []byte) error {
+	qc.out = append(qc.out, dat)
+	return nil
+}
+func (qc *queueConn) WriteControl(int, []byte, time.Time) error { return nil }
+func (qc *queueConn) ReadMessage() (int, []byte, error) {
+	if len(qc.in) == 0 {
+		return 0, nil, errors.New("closed")
+	}
+	dat := qc.in[0]
+	qc.in = qc.in[1:]
+	return websocket.TextMessage, dat, nil
+}
+func (qc *queueConn) NextReader() (int, io.Reader, error) { return 0, nil, errors.New("closed") }
+func (qc *queueConn) SetPongHandler(func(string) error)   {}
+func (qc *queueConn) Close() error                        { return nil }
+
+func TestEnvelopeConnRead(t *testing.T) {
+	qc := &queueConn{in: [][]byte{
+		[]byte(`{"type":"code","payload":{"data":"cHJpbnQoMSk="}}`),
+		[]byte(`not json`),
+		[]byte(`{"type":"teleport"}`),
+		[]byte(`{"type":"stdin","payload":{"data":"aGkK"}}`),
+		[]byte(`{"type":"resize","payload":{"cols":80,"rows":24}}`),
+		[]byte(`{"type":"signal","payload":{"signal":"SIGINT"}}`),
+		[]byte(`{"type":"eof"}`),
+	}}
+	ec := newEnvelopeConn(qc, false)
+	expect := []struct {
+		t   int
+		dat string
+	}{
+		{websocket.BinaryMessage, "print(1)"},
+		{websocket.BinaryMessage, "hi\n"},
+		{websocket.TextMessage, `{"type":"resize","cols":80,"rows":24}`},
+		{websocket.TextMessage, `{"type":"signal","signal":"SIGINT"}`},
+		{websocket.TextMessage, `{"type":"eof"}`},
+	}
+	for _, e := range expect {
+		typ, dat, err := ec.ReadMessage()
+		if err != nil || typ != e.t || string(dat) != e.dat {
+			t.Errorf("expected %d %q but got %d %q %v", e.t, e.dat, typ, dat, err)
+		}
+	}
+	if _, _, err := ec.ReadMessage(); err == nil {
+		t.Error("expected error at end of input")
+	}
+
+	// invalid messages were answered with warnings
+	if len(qc.out) != 2 {
+		t.Fatalf("expected 2 warnings but got %q", qc.out)
+	}
+	var env Envelope
+	var su StatusUpdate
+	if json.Unmarshal(qc.out[1], &env) != nil || json.Unmarshal(env.Payload, &su) != nil || env.Type != "status" || su.Message != `unsupported message type "teleport"` {
+		t.Errorf("unexpected warning %q", qc.out[1])
+	}
+}
+
+func TestEnvelopeConnRequests(t *testing.T) {
+	qc := &queueConn{in: [][]byte{
+		[]byte(`{"type":"resize","payload":{"cols":80,"rows":24}}`),
+		[]byte(`{"type":"eval","payload":{"id":"1","code":"1+1"}}`),
+	}}
+	ec := newEnvelopeConn(qc, true)
+	typ, dat, err := ec.ReadMessage()
+	if err != nil || typ != websocket.TextMessage || string(dat) != `{"id":"1","code":"1+1"}` {
+		t.Errorf("expected eval request but got %d %q %v", typ, dat, err)
+	}
+	if len(qc.out) != 1 {
+		t.Errorf("expected resize to be rejected but got %q", qc.out)
+	}
+}
+
+func TestEnvelopeConnWrite(t *testing.T) {
+	qc := &queueConn{}
+	ec := newEnvelopeConn(qc, false)
+	ec.WriteJSON(StatusUpdate{Status: "running"})
+	ec.WriteJSON(OutputEvent{Stream: "stderr", Data: []byte("x"), Time: 1})
+	ec.WriteMessage(websocket.TextMessage, []byte("y"))
+	ec.WriteJSON(EvalResult{ID: "1", Value: "2"})
+	expect := []string{
+		`{"type":"status","payload":{"status":"running"}}`,
+		`{"type":"stderr","payload":{"data":"eA==","t":1}}`,
+		`{"type":"stdout","payload":{"data":"eQ=="}}`,
+		`{"type":"eval_result","payload":{"id":"1","value":"2","stdout":"","stderr":"","duration":0}}`,
+	}
+	if len(qc.out) != len(expect) {
+		t.Fatalf("expected %d messages but got %q", len(expect), qc.out)
+	}
+	for i, e := range expect {
+		if string(qc.out[i]) != e {
+			t.Errorf("expected %s but got %s", e, qc.out[i])
+		}
+	}
+}
+
+// halfCloseIO is a container stream recording input and whether its write side was closed.
+type halfCloseIO struct {
+	in          []byte
+	writeClosed bool
+}
+
+func (h *halfCloseIO) Read([]byte) (int, error) { return 0, io.EOF }
+func (h *halfCloseIO) Write(dat []byte) (int, error) {
+	h.in = append(h.in, dat...)
+	return len(dat), nil
+}
+func (h *halfCloseIO) Close() error      { return nil }
+func (h *halfCloseIO) CloseWrite() error { h.writeClosed = true; return nil }
+
+func TestEndInput(t *testing.T) {
+	// a terminal reads an end-of-transmission character
+	tty := &halfCloseIO{}
+	cs := &ContainerSession{Container: &Container{IO: tty}}
+	if err := cs.applyControl(ControlMessage{Type: "eof"}); err != nil || string(tty.in) != "\x04" || tty.writeClosed {
+		t.Errorf("unexpected terminal input %q (closed %v, err %v)", tty.in, tty.writeClosed, err)
+	}
+
+	// the input of a program without a terminal is closed
+	pipe := &halfCloseIO{}
+	cs = &ContainerSession{Container: &Container{IO: pipe}, ContainerConfig: ContainerConfig{noTTY: true}}
+	if err := cs.applyControl(ControlMessage{Type: "eof"}); err != nil || len(pipe.in) != 0 || !pipe.writeClosed {
+		t.Errorf("unexpected input %q (closed %v, err %v)", pipe.in, pipe.writeClosed, err)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	cs := &ContainerSession{Container: &Container{}}
+	if err := cs.signal("SIGSTOP"); err == nil {
+		t.Error("disallowed signal accepted")
+	}
+	if err := cs.signal("sigint"); err != errRequiresDocker {
+		t.Errorf("expected errRequiresDocker without a Docker client but got %v", err)
+	}
+}
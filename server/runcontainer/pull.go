@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// PullProgress is the progress of an image pull, aggregated over its layers.
+type PullProgress struct {
+	Image string `json:"image"`
+
+	// Current and Total are the number of bytes downloaded so far and the total size of the layers being downloaded.
+	// The total grows as the sizes of the layers become known.
+	Current int64 `json:"current"`
+	Total   int64 `json:"total,omitempty"`
+}
+
+// pullMessage is a message of the JSON progress stream of an image pull.
+type pullMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+// readPullProgress reads the progress stream of a pull, calling update (if not nil) with the aggregate progress after every message.
+// Errors reported in the stream are returned.
+func readPullProgress(r io.Reader, img string, update func(PullProgress)) error {
+	type layer struct{ current, total int64 }
+	layers := map[string]*layer{}
+	dec := json.NewDecoder(r)
+	for {
+		var msg pullMessage
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if msg.ID == "" {
+			continue
+		}
+
+		// track layer progress
+		l := layers[msg.ID]
+		if l == nil {
+			l = &layer{}
+			layers[msg.ID] = l
+		}
+		switch msg.Status {
+		case "Downloading":
+			l.current, l.total = msg.Progress.Current, msg.Progress.Total
+		case "Download complete", "Pull complete", "Already exists":
+			l.current = l.total
+		}
+		if update == nil {
+			continue
+		}
+		p := PullProgress{Image: img}
+		for _, l := range layers {
+			p.Current += l.current
+			p.Total += l.total
+		}
+		update(p)
+	}
+}
+
+// pullImageProgress pulls an image with the credentials of its registry, calling update (if not nil) as the pull progresses.
+func pullImageProgress(ctx context.Context, cli *client.Client, auth *RegistryAuth, img string, update func(PullProgress)) error {
+	cred, err := auth.encoded(ctx, img)
+	if err != nil {
+		return err
+	}
+	rc, err := cli.ImagePull(ctx, img, types.ImagePullOptions{RegistryAuth: cred})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return readPullProgress(rc, img, update)
+}
+
+// imagePullsOnDemand counts images pulled when a session first used them.
+var imagePullsOnDemand = &Counter{
+	Name:   "openrepl_image_pulls_on_demand_total",
+	Help:   "Number of missing images pulled when a session first used them, by result.",
+	Labels: []string{"result"},
+}
+
+func init() {
+	metrics.Register(imagePullsOnDemand)
+}
+
+// pullProgressRate is the rate at which the progress of a pull is sent to waiting sessions.
+const pullProgressRate = time.Second
+
+// ImagePuller pulls images which are missing when they are first used by a session.
+// Sessions waiting for the same image share a single pull.
+type ImagePuller struct {
+	// Client is the Docker client used to pull images.
+	Client *client.Client
+
+	// Auth provides the credentials of private registries.
+	// If nil, images are pulled anonymously.
+	Auth *RegistryAuth
+
+	// Timeout is the maximum duration of a pull.
+	// If zero, pulls are not limited.
+	Timeout time.Duration
+
+	lck   sync.Mutex
+	pulls map[string]*imagePull
+}
+
+// imagePull is an image pull in progress.
+type imagePull struct {
+	done chan struct{}
+	err  error
+
+	lck      sync.Mutex
+	progress PullProgress
+}
+
+func (p *imagePull) update(progress PullProgress) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	p.progress = progress
+}
+
+func (p *imagePull) status() PullProgress {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return p.progress
+}
+
+// Ensure pulls an image if it is not present, reporting the progress of the pull about once per second.
+// The pull continues in the background if the context expires, so that other sessions may use it.
+// A nil ImagePuller does not pull images.
+func (ip *ImagePuller) Ensure(ctx context.Context, img string, progress func(PullProgress) error) error {
+	if ip == nil || img == "" {
+		return nil
+	}
+	_, _, err := ip.Client.ImageInspectWithRaw(ctx, img)
+	if err == nil || !client.IsErrNotFound(err) {
+		return err
+	}
+
+	p := ip.start(img)
+	tick := time.NewTicker(pullProgressRate)
+	defer tick.Stop()
+	err = progress(p.status())
+	for err == nil {
+		select {
+		case <-p.done:
+			return p.err
+		case <-tick.C:
+			err = progress(p.status())
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// start starts pulling an image, or returns the pull of the image which is already in progress.
+func (ip *ImagePuller) start(img string) *imagePull {
+	ip.lck.Lock()
+	defer ip.lck.Unlock()
+	if p, ok := ip.pulls[img]; ok {
+		return p
+	}
+	if ip.pulls == nil {
+		ip.pulls = make(map[string]*imagePull)
+	}
+	p := &imagePull{done: make(chan struct{}), progress: PullProgress{Image: img}}
+	ip.pulls[img] = p
+	go func() {
+		ctx := context.Background()
+		if ip.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, ip.Timeout)
+			defer cancel()
+		}
+		t := time.Now()
+		p.err = pullImageProgress(ctx, ip.Client, ip.Auth, img, p.update)
+		if p.err != nil {
+			serverLog.Errorf("failed to pull image %s: %s", img, p.err.Error())
+			imagePullsOnDemand.Add(1, "failed")
+		} else {
+			serverLog.Printf("pulled image %s in %v", img, time.Since(t).Round(time.Millisecond))
+			imagePullsOnDemand.Add(1, "pulled")
+		}
+
+		ip.lck.Lock()
+		delete(ip.pulls, img)
+		ip.lck.Unlock()
+		close(p.done)
+	}()
+	return p
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadPullProgress(t *testing.T) {
+	stream := `{"status": "Pulling from openrepl/python3", "id": "latest"}
+{"status": "Pulling fs layer", "id": "a"}
+{"status": "Already exists", "id": "b"}
+{"status": "Downloading", "id": "a", "progressDetail": {"current": 100, "total": 400}}
+{"status": "Downloading", "id": "c", "progressDetail": {"current": 50, "total": 100}}
+{"status": "Download complete", "id": "c"}
+{"status": "Digest: sha256:abc"}
+`
+	var got []PullProgress
+	err := readPullProgress(strings.NewReader(stream), "openrepl/python3", func(p PullProgress) { got = append(got, p) })
+	if err != nil {
+		t.Fatalf("failed to read progress: %s", err.Error())
+	}
+	last := got[len(got)-1]
+	if len(got) != 6 || last != (PullProgress{Image: "openrepl/python3", Current: 200, Total: 500}) {
+		t.Errorf("unexpected progress %+v", got)
+	}
+
+	err = readPullProgress(strings.NewReader(`{"status": "Pulling fs layer", "id": "a"}
+{"error": "unauthorized: authentication required"}
+`), "private/img", nil)
+	if err == nil || err.Error() != "unauthorized: authentication required" {
+		t.Errorf("expected pull error but got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QuotaUsage is the consumption of a principal in a quota period.
+type QuotaUsage struct {
+	// Sessions is the number of sessions started.
+	Sessions int
+
+	// Seconds is the total execution time of the containers of the sessions.
+	Seconds float64
+}
+
+// QuotaStore keeps the consumption of principals.
+// Usage is kept in periods identified by their start time, which are hours for sessions and days for execution time.
+type QuotaStore interface {
+	// Usage returns the usage of a principal in the period starting at start.
+	Usage(principal string, start time.Time) (QuotaUsage, error)
+
+	// Add adds to the usage of a principal in the period starting at start.
+	Add(principal string, start time.Time, u QuotaUsage) error
+}
+
+// QuotaError is an error rejecting a session of a principal over quota.
+type QuotaError struct {
+	Msg string
+
+	// RetryAfter is the time after which the quota is reset.
+	RetryAfter time.Duration
+}
+
+func (qe *QuotaError) Error() string {
+	return qe.Msg
+}
+
+// Quotas limits the consumption of each authenticated principal.
+// A nil Quotas does not limit principals.
+type Quotas struct {
+	// SessionsPerHour is the maximum number of sessions a principal may start in each hour.
+	// If zero, the number of sessions is unlimited.
+	SessionsPerHour int
+
+	// SecondsPerDay is the maximum total execution time in seconds of the sessions of a principal in each day (UTC).
+	// If zero, the execution time is unlimited.
+	SecondsPerDay float64
+
+	Store QuotaStore
+}
+
+// Acquire counts a new session of a principal, returning a *QuotaError if the principal is over quota.
+// Sessions without a principal are not limited.
+func (q *Quotas) Acquire(principal string, now time.Time) error {
+	err := q.check(principal, now)
+	if err != nil {
+		return err
+	}
+	return q.count(principal, now)
+}
+
+// check checks whether a principal may start a new session, returning a *QuotaError if it is over quota.
+func (q *Quotas) check(principal string, now time.Time) error {
+	if q == nil || principal == "" {
+		return nil
+	}
+	now = now.UTC()
+	hour, day := now.Truncate(time.Hour), now.Truncate(24*time.Hour)
+
+	// check quotas
+	if q.SecondsPerDay > 0 {
+		u, err := q.Store.Usage(principal, day)
+		if err != nil {
+			return err
+		}
+		if u.Seconds >= q.SecondsPerDay {
+			return &QuotaError{
+				Msg:        fmt.Sprintf("daily quota of %g execution seconds exceeded", q.SecondsPerDay),
+				RetryAfter: day.Add(24 * time.Hour).Sub(now),
+			}
+		}
+	}
+	if q.SessionsPerHour > 0 {
+		u, err := q.Store.Usage(principal, hour)
+		if err != nil {
+			return err
+		}
+		if u.Sessions >= q.SessionsPerHour {
+			return &QuotaError{
+				Msg:        fmt.Sprintf("hourly quota of %d sessions exceeded", q.SessionsPerHour),
+				RetryAfter: hour.Add(time.Hour).Sub(now),
+			}
+		}
+	}
+	return nil
+}
+
+// count counts a new session of a principal in the current hour.
+func (q *Quotas) count(principal string, now time.Time) error {
+	if q == nil || principal == "" {
+		return nil
+	}
+	return q.Store.Add(principal, now.UTC().Truncate(time.Hour), QuotaUsage{Sessions: 1})
+}
+
+// AcquireGPU counts a new GPU session of a principal against the GPU quotas, and against the quotas of all sessions.
+// Both quotas are checked before the session is counted, so that a session rejected by one of them does not count against the other.
+// Unlike other sessions, GPU sessions without a principal are rejected, as they could not be limited.
+func (q *Quotas) AcquireGPU(principal string, all *Quotas, now time.Time) error {
+	if q != nil && principal == "" {
+		return &QuotaError{Msg: "GPU sessions require authentication"}
+	}
+	for _, qs := range []*Quotas{q, all} {
+		err := qs.check(principal, now)
+		if err != nil {
+			return err
+		}
+	}
+	err := q.count(principal, now)
+	if err != nil {
+		return err
+	}
+	return all.count(principal, now)
+}
+
+// AddTime adds the execution time of a session of a principal to the day in which it ended.
+func (q *Quotas) AddTime(principal string, d time.Duration, now time.Time) error {
+	if q == nil || principal == "" {
+		return nil
+	}
+	return q.Store.Add(principal, now.UTC().Truncate(24*time.Hour), QuotaUsage{Seconds: d.Seconds()})
+}
+
+// quotaKey identifies the usage of a principal in a period.
+type quotaKey struct {
+	principal string
+	start     int64
+}
+
+// quotaRetention is the age of periods after which the MemQuotaStore drops them.
+const quotaRetention = 48 * time.Hour
+
+// MemQuotaStore is an in-memory QuotaStore.
+type MemQuotaStore struct {
+	lck       sync.Mutex
+	usage     map[quotaKey]QuotaUsage
+	lastSweep time.Time
+}
+
+func (ms *MemQuotaStore) Usage(principal string, start time.Time) (QuotaUsage, error) {
+	ms.lck.Lock()
+	defer ms.lck.Unlock()
+	return ms.usage[quotaKey{principal, start.Unix()}], nil
+}
+
+func (ms *MemQuotaStore) Add(principal string, start time.Time, u QuotaUsage) error {
+	ms.lck.Lock()
+	defer ms.lck.Unlock()
+	if ms.usage == nil {
+		ms.usage = make(map[quotaKey]QuotaUsage)
+	}
+
+	// drop old periods
+	if now := time.Now(); now.Sub(ms.lastSweep) > time.Hour {
+		for k := range ms.usage {
+			if now.Sub(time.Unix(k.start, 0)) > quotaRetention {
+				delete(ms.usage, k)
+			}
+		}
+		ms.lastSweep = now
+	}
+
+	k := quotaKey{principal, start.Unix()}
+	cur := ms.usage[k]
+	cur.Sessions += u.Sessions
+	cur.Seconds += u.Seconds
+	ms.usage[k] = cur
+	return nil
+}
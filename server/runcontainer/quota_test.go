@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	q := &Quotas{SessionsPerHour: 2, SecondsPerDay: 60, Store: &MemQuotaStore{}}
+	now := time.Date(2018, 8, 11, 10, 30, 0, 0, time.UTC)
+
+	// sessions are limited per hour
+	for i := 0; i < 2; i++ {
+		if err := q.Acquire("alice", now); err != nil {
+			t.Fatalf("session %d rejected: %v", i, err)
+		}
+	}
+	err := q.Acquire("alice", now)
+	qe, ok := err.(*QuotaError)
+	if !ok || qe.RetryAfter != 30*time.Minute {
+		t.Fatalf("expected quota error with a retry after the end of the hour, got %v", err)
+	}
+	if err := q.Acquire("bob", now); err != nil {
+		t.Fatalf("quotas of principals are not independent: %v", err)
+	}
+	if err := q.Acquire("alice", now.Add(time.Hour)); err != nil {
+		t.Fatalf("hourly quota not reset: %v", err)
+	}
+
+	// execution time is limited per day
+	q.AddTime("bob", time.Minute, now)
+	err = q.Acquire("bob", now.Add(time.Hour))
+	if qe, ok := err.(*QuotaError); !ok || qe.RetryAfter != 12*time.Hour+30*time.Minute {
+		t.Fatalf("expected quota error with a retry after the end of the day, got %v", err)
+	}
+	if err := q.Acquire("bob", now.Add(24*time.Hour)); err != nil {
+		t.Fatalf("daily quota not reset: %v", err)
+	}
+
+	// anonymous sessions are not limited
+	for i := 0; i < 3; i++ {
+		if err := q.Acquire("", now); err != nil {
+			t.Fatalf("anonymous session rejected: %v", err)
+		}
+	}
+}
+
+func TestGPUQuotas(t *testing.T) {
+	q := &Quotas{SessionsPerHour: 1, Store: &MemQuotaStore{}}
+	all := &Quotas{SessionsPerHour: 2, Store: &MemQuotaStore{}}
+	now := time.Date(2018, 8, 11, 10, 30, 0, 0, time.UTC)
+	if err := q.AcquireGPU("alice", all, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.AcquireGPU("alice", all, now).(*QuotaError); !ok {
+		t.Error("expected GPU quota error")
+	}
+
+	// the rejected GPU session does not count against the quotas of all sessions
+	if err := all.Acquire("alice", now); err != nil {
+		t.Errorf("rejected GPU session was counted: %v", err)
+	}
+
+	// a session rejected by the quotas of all sessions does not count against the GPU quotas
+	if err := all.Acquire("carol", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := all.Acquire("carol", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.AcquireGPU("carol", all, now).(*QuotaError); !ok {
+		t.Error("expected quota error")
+	}
+	if err := q.Acquire("carol", now); err != nil {
+		t.Errorf("rejected session was counted against the GPU quotas: %v", err)
+	}
+
+	// anonymous GPU sessions cannot be limited, so they are rejected
+	if _, ok := q.AcquireGPU("", all, now).(*QuotaError); !ok {
+		t.Error("expected anonymous GPU session to be rejected")
+	}
+	if err := (*Quotas)(nil).AcquireGPU("", nil, now); err != nil {
+		t.Errorf("expected no limits without GPU quotas, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Receipt is a signed record of a completed run.
+// Downstream systems holding the signing key can verify that a result was produced by the server and not altered by the client.
+type Receipt struct {
+	Session  string `json:"session"`
+	Language string `json:"language"`
+
+	// CodeHash and OutputHash are the hex SHA-256 hashes of the submitted code and of the complete program output.
+	CodeHash   string `json:"code_sha256"`
+	OutputHash string `json:"output_sha256"`
+
+	ExitCode int64     `json:"exit_code"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// KeyID identifies the key which signed the receipt, so that keys can be rotated.
+	KeyID string `json:"key_id,omitempty"`
+
+	// Signature is the base64 HMAC-SHA256 of the payload of the receipt.
+	Signature string `json:"signature"`
+}
+
+// receiptVersion is the first line of the signed payload of a receipt.
+const receiptVersion = "openrepl-receipt-v1"
+
+// payload returns the signed form of the receipt.
+// The fields are joined by newlines in a fixed order, with times in RFC 3339 format, so that it can easily be reproduced by verifiers.
+func (rc Receipt) payload() []byte {
+	return []byte(strings.Join([]string{
+		receiptVersion,
+		rc.KeyID,
+		rc.Session,
+		rc.Language,
+		rc.CodeHash,
+		rc.OutputHash,
+		strconv.FormatInt(rc.ExitCode, 10),
+		rc.Started.UTC().Format(time.RFC3339Nano),
+		rc.Finished.UTC().Format(time.RFC3339Nano),
+	}, "\n"))
+}
+
+// ReceiptSigner signs execution receipts with a shared HMAC key.
+// A nil ReceiptSigner does not issue receipts.
+type ReceiptSigner struct {
+	// KeyID is the identifier of the key included in receipts.
+	KeyID string
+
+	// Key is the HMAC key.
+	Key []byte
+}
+
+func (rs *ReceiptSigner) mac(rc Receipt) []byte {
+	m := hmac.New(sha256.New, rs.Key)
+	m.Write(rc.payload())
+	return m.Sum(nil)
+}
+
+// Sign sets the key ID and signature of a receipt.
+func (rs *ReceiptSigner) Sign(rc *Receipt) {
+	rc.KeyID = rs.KeyID
+	rc.Signature = base64.StdEncoding.EncodeToString(rs.mac(*rc))
+}
+
+// Verify checks the signature of a receipt.
+func (rs *ReceiptSigner) Verify(rc Receipt) bool {
+	sig, err := base64.StdEncoding.DecodeString(rc.Signature)
+	if err != nil || rc.KeyID != rs.KeyID {
+		return false
+	}
+	return hmac.Equal(sig, rs.mac(rc))
+}
+
+// sendReceipt sends the signed receipt of the completed run to the client.
+func (cs *ContainerSession) sendReceipt(code int64) error {
+	codeHash := sha256.Sum256(cs.code)
+	rc := Receipt{
+		Session:    cs.ID,
+		Language:   cs.ContainerConfig.Language,
+		CodeHash:   hex.EncodeToString(codeHash[:]),
+		OutputHash: hex.EncodeToString(cs.outputHash.Sum(nil)),
+		ExitCode:   code,
+		Started:    cs.started,
+		Finished:   time.Now(),
+	}
+	cs.Config.Receipts.Sign(&rc)
+	cs.Events.Record("receipt", rc.OutputHash)
+	return cs.UpdateStatus(StatusUpdate{Status: "receipt", Receipt: &rc})
+}
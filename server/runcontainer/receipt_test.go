@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceiptSigner(t *testing.T) {
+	rs := &ReceiptSigner{KeyID: "k1", Key: []byte("secret")}
+	rc := Receipt{
+		Session:    "abc",
+		Language:   "python",
+		CodeHash:   "c0de",
+		OutputHash: "0u7",
+		ExitCode:   0,
+		Started:    time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		Finished:   time.Date(2018, 1, 1, 0, 0, 1, 0, time.UTC),
+	}
+	rs.Sign(&rc)
+	if rc.KeyID != "k1" || rc.Signature == "" {
+		t.Fatalf("receipt not signed: %+v", rc)
+	}
+	if !rs.Verify(rc) {
+		t.Fatal("valid receipt rejected")
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Receipt)
+	}{
+		{"exit code", func(rc *Receipt) { rc.ExitCode = 1 }},
+		{"output", func(rc *Receipt) { rc.OutputHash = "f00" }},
+		{"finish time", func(rc *Receipt) { rc.Finished = rc.Finished.Add(time.Second) }},
+		{"key", func(rc *Receipt) { rc.KeyID = "k2" }},
+		{"signature", func(rc *Receipt) { rc.Signature = "!" }},
+	}
+	for _, test := range tests {
+		tampered := rc
+		test.modify(&tampered)
+		if rs.Verify(tampered) {
+			t.Errorf("receipt with tampered %s accepted", test.name)
+		}
+	}
+
+	// a different key does not verify the receipt
+	other := &ReceiptSigner{KeyID: "k1", Key: []byte("other")}
+	if other.Verify(rc) {
+		t.Error("receipt verified with the wrong key")
+	}
+}
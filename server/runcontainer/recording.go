@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRecordingSize is the maximum size of a recording, beyond which further events are dropped.
+const maxRecordingSize = 16 << 20
+
+// errRecordingNotFound is returned when loading a recording which does not exist.
+var errRecordingNotFound = errors.New("recording not found")
+
+// recordingIDPattern matches valid recording IDs, which are session IDs.
+var recordingIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// RecordingStore persists session recordings.
+type RecordingStore interface {
+	// Save stores the recording of a session.
+	Save(id string, dat []byte) error
+
+	// Load loads the recording of a session.
+	// Returns errRecordingNotFound if there is no such recording.
+	Load(id string) ([]byte, error)
+}
+
+// RecordingHeader is the header line of a recording in asciicast v2 format.
+type RecordingHeader struct {
+	Version   int               `json:"version"`
+	Width     uint              `json:"width"`
+	Height    uint              `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recording is a recording of the terminal I/O of a session in asciicast v2 format.
+// A nil Recording records nothing.
+type Recording struct {
+	lck       sync.Mutex
+	started   time.Time
+	buf       bytes.Buffer
+	truncated bool
+}
+
+// newRecording starts a recording of a terminal with the given initial size.
+func newRecording(title string, width uint, height uint, now time.Time) *Recording {
+	rec := &Recording{started: now}
+	dat, _ := json.Marshal(RecordingHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: now.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm"},
+	})
+	rec.buf.Write(dat)
+	rec.buf.WriteByte('\n')
+	return rec
+}
+
+// event records an event of the given kind ("o" for output, "i" for input or "r" for resize).
+func (rec *Recording) event(kind string, dat string) {
+	if rec == nil {
+		return
+	}
+	rec.lck.Lock()
+	defer rec.lck.Unlock()
+	if rec.truncated {
+		return
+	}
+	line, err := json.Marshal([]interface{}{time.Since(rec.started).Seconds(), kind, dat})
+	if err != nil {
+		return
+	}
+	if rec.buf.Len()+len(line)+1 > maxRecordingSize {
+		rec.truncated = true
+		return
+	}
+	rec.buf.Write(line)
+	rec.buf.WriteByte('\n')
+}
+
+// output records output of the terminal.
+func (rec *Recording) output(dat []byte) {
+	rec.event("o", string(dat))
+}
+
+// input records input to the terminal.
+func (rec *Recording) input(dat []byte) {
+	rec.event("i", string(dat))
+}
+
+// resize records a change of the terminal size.
+func (rec *Recording) resize(cols uint, rows uint) {
+	rec.event("r", strconv.FormatUint(uint64(cols), 10)+"x"+strconv.FormatUint(uint64(rows), 10))
+}
+
+// Bytes returns the contents of the recording.
+func (rec *Recording) Bytes() []byte {
+	rec.lck.Lock()
+	defer rec.lck.Unlock()
+	return append([]byte(nil), rec.buf.Bytes()...)
+}
+
+// recordingWriter records the data written through it as input.
+type recordingWriter struct {
+	rec *Recording
+}
+
+func (rw recordingWriter) Write(dat []byte) (int, error) {
+	rw.rec.input(dat)
+	return len(dat), nil
+}
+
+// writeInput copies input from the client to the container, recording it if the session is recorded.
+func (cs *ContainerSession) writeInput(r io.Reader) error {
+	if cs.recording != nil {
+		r = io.TeeReader(r, recordingWriter{cs.recording})
+	}
+	_, err := io.Copy(cs.Container, r)
+	return err
+}
+
+// saveRecording stores the recording of the session.
+func (cs *ContainerSession) saveRecording() {
+	if cs.recording == nil || cs.Config.Recordings == nil {
+		return
+	}
+	err := cs.Config.Recordings.Save(cs.ID, cs.recording.Bytes())
+	if err != nil {
+		cs.logger().Errorf("failed to save recording: %s", err.Error())
+		return
+	}
+	cs.Events.Record("recording", "")
+}
+
+// DirRecordingStore stores recordings as files in a directory.
+type DirRecordingStore struct {
+	Dir string
+}
+
+// path returns the path of the file of a recording.
+func (ds DirRecordingStore) path(id string) string {
+	return filepath.Join(ds.Dir, id+".cast")
+}
+
+// Save writes a recording to a temporary file, and then moves it into place.
+func (ds DirRecordingStore) Save(id string, dat []byte) error {
+	f, err := ioutil.TempFile(ds.Dir, ".recording")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(dat)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), ds.path(id))
+}
+
+func (ds DirRecordingStore) Load(id string) ([]byte, error) {
+	dat, err := ioutil.ReadFile(ds.path(id))
+	if os.IsNotExist(err) {
+		return nil, errRecordingNotFound
+	}
+	return dat, err
+}
+
+// HandleAdminRecordings serves the recording of a session in asciicast v2 format (GET /admin/recordings/{id}).
+func (cs *ContainerServer) HandleAdminRecordings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	store := cs.SessionConfig.Recordings
+	if store == nil {
+		http.Error(w, "recording disabled", http.StatusNotFound)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/admin/recordings/")
+	if !recordingIDPattern.MatchString(id) {
+		http.Error(w, "invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	dat, err := store.Load(id)
+	switch {
+	case err == errRecordingNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		serverLog.Errorf("failed to load recording %s: %s", id, err.Error())
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Write(dat)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecording(t *testing.T) {
+	rec := newRecording("python3", defaultTermCols, defaultTermRows, time.Now())
+	rec.output([]byte(">>> "))
+	rec.input([]byte("1+1\r"))
+	rec.resize(100, 40)
+
+	sc := bufio.NewScanner(bytes.NewReader(rec.Bytes()))
+	if !sc.Scan() {
+		t.Fatal("recording has no header")
+	}
+	var hdr RecordingHeader
+	if err := json.Unmarshal(sc.Bytes(), &hdr); err != nil || hdr.Version != 2 || hdr.Width != 80 || hdr.Height != 24 || hdr.Title != "python3" {
+		t.Fatalf("unexpected header %s", sc.Bytes())
+	}
+	expect := [][2]string{{"o", ">>> "}, {"i", "1+1\r"}, {"r", "100x40"}}
+	for _, e := range expect {
+		if !sc.Scan() {
+			t.Fatalf("missing %s event", e[0])
+		}
+		var ev []interface{}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil || len(ev) != 3 {
+			t.Fatalf("invalid event %s", sc.Bytes())
+		}
+		if _, ok := ev[0].(float64); !ok || ev[1] != e[0] || ev[2] != e[1] {
+			t.Errorf("expected %q event %q, got %s", e[0], e[1], sc.Bytes())
+		}
+	}
+	if sc.Scan() {
+		t.Errorf("unexpected event %s", sc.Bytes())
+	}
+
+	// events beyond the size limit are dropped
+	chunk := make([]byte, maxRecordingSize/4)
+	for i := 0; i < 5; i++ {
+		rec.output(chunk)
+	}
+	if n := len(rec.Bytes()); n > maxRecordingSize || !rec.truncated {
+		t.Errorf("expected recording to be truncated, got %d bytes", n)
+	}
+
+	// a nil recording records nothing
+	var none *Recording
+	none.output([]byte("x"))
+}
+
+func TestDirRecordingStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := DirRecordingStore{Dir: dir}
+
+	if _, err := store.Load("abc"); err != errRecordingNotFound {
+		t.Fatalf("expected %v, got %v", errRecordingNotFound, err)
+	}
+	if err := store.Save("abc", []byte("cast")); err != nil {
+		t.Fatal(err)
+	}
+	dat, err := store.Load("abc")
+	if err != nil || string(dat) != "cast" {
+		t.Fatalf("expected saved recording, got %q (%v)", dat, err)
+	}
+}
+
+func TestS3RecordingStore(t *testing.T) {
+	var lck sync.Mutex
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Date") == "" {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		lck.Lock()
+		defer lck.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		case http.MethodGet:
+			dat, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(dat)
+		}
+	}))
+	defer srv.Close()
+
+	store, err := parseS3URL("s3://casts/course")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Endpoint, store.Region = srv.URL, "us-east-1"
+	store.AccessKey, store.SecretKey = "AKID", "secret"
+
+	if err := store.Save("abc", []byte("cast")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects["/casts/course/abc.cast"]; !ok {
+		t.Fatalf("recording not stored at the expected key: %v", objects)
+	}
+	dat, err := store.Load("abc")
+	if err != nil || string(dat) != "cast" {
+		t.Fatalf("expected saved recording, got %q (%v)", dat, err)
+	}
+	if _, err := store.Load("def"); err != errRecordingNotFound {
+		t.Fatalf("expected %v, got %v", errRecordingNotFound, err)
+	}
+}
+
+func TestHandleAdminRecordings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := DirRecordingStore{Dir: dir}
+	store.Save("abc", []byte("cast"))
+	cs := &ContainerServer{SessionConfig: ContainerSessionConfig{Recordings: store}}
+
+	tbl := []struct {
+		path   string
+		status int
+	}{
+		{"/admin/recordings/abc", http.StatusOK},
+		{"/admin/recordings/def", http.StatusNotFound},
+		{"/admin/recordings/..%2fabc", http.StatusBadRequest},
+	}
+	for _, tc := range tbl {
+		w := httptest.NewRecorder()
+		cs.HandleAdminRecordings(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.status, w.Code)
+		}
+	}
+}
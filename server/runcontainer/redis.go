@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errRedisNil is returned when a key does not exist.
+var errRedisNil = errors.New("redis: nil")
+
+// redisError is an error reply of the Redis server.
+type redisError string
+
+func (re redisError) Error() string {
+	return "redis: " + string(re)
+}
+
+// RedisClient is a minimal client of the Redis protocol (RESP2), which sends commands over a single connection.
+// The connection is opened on first use, and reopened after it fails.
+type RedisClient struct {
+	// Addr is the address (host:port) of the server.
+	Addr string
+
+	// Password authenticates to the server, and DB selects the database.
+	// If the password is empty, no authentication is performed.
+	Password string
+	DB       int
+
+	// Timeout is the timeout of dialing and of each command, which is also bounded by the context.
+	Timeout time.Duration
+
+	lck  sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// ParseRedisURL parses a Redis URL (e.g. "redis://:password@localhost:6379/0").
+func ParseRedisURL(str string) (*RedisClient, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, errors.New("unsupported redis URL scheme " + u.Scheme)
+	}
+	rc := &RedisClient{Addr: u.Host, Timeout: 5 * time.Second}
+	if !strings.Contains(u.Host, ":") {
+		rc.Addr = u.Host + ":6379"
+	}
+	if u.User != nil {
+		rc.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		rc.DB, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, errors.New("invalid redis database " + db)
+		}
+	}
+	return rc, nil
+}
+
+// dial opens the connection, authenticating and selecting the database.
+// The lock must be held.
+func (rc *RedisClient) dial(ctx context.Context) error {
+	d := net.Dialer{Timeout: rc.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", rc.Addr)
+	if err != nil {
+		return err
+	}
+	rc.conn, rc.rd = conn, bufio.NewReader(conn)
+	if rc.Password != "" {
+		if _, err := rc.roundTrip(ctx, "AUTH", rc.Password); err != nil {
+			rc.reset()
+			return err
+		}
+	}
+	if rc.DB != 0 {
+		if _, err := rc.roundTrip(ctx, "SELECT", strconv.Itoa(rc.DB)); err != nil {
+			rc.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+// reset closes a failed connection.
+// The lock must be held.
+func (rc *RedisClient) reset() {
+	if rc.conn != nil {
+		rc.conn.Close()
+	}
+	rc.conn, rc.rd = nil, nil
+}
+
+// Do sends a command and returns its reply, which is a string, an int64, a []interface{} of replies, or nil for a missing value.
+// Error replies are returned as errors.
+func (rc *RedisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	if rc.conn == nil {
+		if err := rc.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := rc.roundTrip(ctx, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		rc.reset()
+	}
+	return reply, err
+}
+
+// roundTrip writes a command and reads its reply.
+// The lock must be held.
+func (rc *RedisClient) roundTrip(ctx context.Context, args ...string) (interface{}, error) {
+	var deadline time.Time
+	if rc.Timeout > 0 {
+		deadline = time.Now().Add(rc.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	rc.conn.SetDeadline(deadline)
+
+	var buf []byte
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, a...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := rc.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRedisReply(rc.rd)
+}
+
+// readRedisReply reads a RESP2 reply.
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+	typ, body := line[0], line[1:len(line)-2]
+	switch typ {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		dat := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, dat); err != nil {
+			return nil, err
+		}
+		return string(dat[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			arr[i], err = readRedisReply(rd)
+			if _, ok := err.(redisError); err != nil && !ok {
+				return nil, err
+			}
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+}
+
+// Get returns the value of a key, or errRedisNil if it does not exist.
+func (rc *RedisClient) Get(ctx context.Context, key string) (string, error) {
+	reply, err := rc.Do(ctx, "GET", key)
+	if err != nil {
+		return "", err
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return "", errRedisNil
+	}
+	return s, nil
+}
+
+// Set sets the value of a key, which expires after the ttl.
+func (rc *RedisClient) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	_, err := rc.Do(ctx, "SET", key, value, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+// Del deletes keys.
+func (rc *RedisClient) Del(ctx context.Context, keys ...string) error {
+	_, err := rc.Do(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// Scan returns the values of all keys matching a pattern.
+// Keys which expire while they are scanned are skipped.
+func (rc *RedisClient) Scan(ctx context.Context, pattern string) ([]string, error) {
+	var values []string
+	cursor := "0"
+	for {
+		reply, err := rc.Do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		arr, ok := reply.([]interface{})
+		if !ok || len(arr) != 2 {
+			return nil, errors.New("redis: invalid SCAN reply")
+		}
+		cursor, _ = arr[0].(string)
+		keys, _ := arr[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"MGET"}
+			for _, k := range keys {
+				if s, ok := k.(string); ok {
+					args = append(args, s)
+				}
+			}
+			reply, err := rc.Do(ctx, args...)
+			if err != nil {
+				return nil, err
+			}
+			vals, _ := reply.([]interface{})
+			for _, v := range vals {
+				if s, ok := v.(string); ok {
+					values = append(values, s)
+				}
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return values, nil
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-memory server of the Redis commands used by the cluster.
+type fakeRedis struct {
+	password string
+
+	lck  sync.Mutex
+	data map[string]string
+	ttls map[string]time.Duration
+	ln   net.Listener
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{password: password, data: map[string]string{}, ttls: map[string]time.Duration{}, ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) Addr() string {
+	return fr.ln.Addr().String()
+}
+
+func (fr *fakeRedis) Close() {
+	fr.ln.Close()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := fr.password == ""
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+		arr, _ := reply.([]interface{})
+		args := make([]string, len(arr))
+		for i, a := range arr {
+			args[i], _ = a.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		switch cmd {
+		case "AUTH":
+			if args[1] != fr.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			io.WriteString(conn, "+OK\r\n")
+		case "SELECT":
+			io.WriteString(conn, "+OK\r\n")
+		default:
+			io.WriteString(conn, fr.do(cmd, args[1:]))
+		}
+	}
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func (fr *fakeRedis) do(cmd string, args []string) string {
+	fr.lck.Lock()
+	defer fr.lck.Unlock()
+	switch cmd {
+	case "GET":
+		v, ok := fr.data[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v)
+	case "SET":
+		fr.data[args[0]] = args[1]
+		if len(args) == 4 && args[2] == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			fr.ttls[args[0]] = time.Duration(ms) * time.Millisecond
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, k := range args {
+			if _, ok := fr.data[k]; ok {
+				delete(fr.data, k)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "SCAN":
+		var keys []string
+		for k := range fr.data {
+			if ok, _ := path.Match(args[2], k); ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		s := "*2\r\n" + bulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, k := range keys {
+			s += bulk(k)
+		}
+		return s
+	case "MGET":
+		s := "*" + strconv.Itoa(len(args)) + "\r\n"
+		for _, k := range args {
+			if v, ok := fr.data[k]; ok {
+				s += bulk(v)
+			} else {
+				s += "$-1\r\n"
+			}
+		}
+		return s
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd)
+	}
+}
+
+func TestParseRedisURL(t *testing.T) {
+	rc, err := ParseRedisURL("redis://:secret@redis/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Addr != "redis:6379" || rc.Password != "secret" || rc.DB != 2 {
+		t.Errorf("unexpected client %+v", rc)
+	}
+	for _, s := range []string{"http://redis", "redis://redis/x"} {
+		if _, err := ParseRedisURL(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	fr := newFakeRedis(t, "secret")
+	defer fr.Close()
+	rc := &RedisClient{Addr: fr.Addr(), Password: "secret", Timeout: time.Second}
+	ctx := context.Background()
+
+	if _, err := rc.Get(ctx, "a"); err != errRedisNil {
+		t.Errorf("expected errRedisNil, got %v", err)
+	}
+	if err := rc.Set(ctx, "a", "1\r\n2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if fr.ttls["a"] != time.Minute {
+		t.Errorf("expected TTL of a minute, got %v", fr.ttls["a"])
+	}
+	if v, err := rc.Get(ctx, "a"); v != "1\r\n2" || err != nil {
+		t.Errorf("unexpected value %q (%v)", v, err)
+	}
+	rc.Set(ctx, "b", "2", time.Minute)
+	rc.Set(ctx, "c:x", "3", time.Minute)
+	vals, err := rc.Scan(ctx, "[ab]")
+	if err != nil || strings.Join(vals, ",") != "1\r\n2,2" {
+		t.Errorf("unexpected scan %q (%v)", vals, err)
+	}
+	if err := rc.Del(ctx, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Get(ctx, "b"); err != errRedisNil {
+		t.Errorf("expected deleted key, got %v", err)
+	}
+
+	// error replies are returned without dropping the connection
+	if _, err := rc.Do(ctx, "FLUSHALL"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("expected error reply, got %v", err)
+	}
+	if v, err := rc.Get(ctx, "c:x"); v != "3" || err != nil {
+		t.Errorf("unexpected value %q (%v)", v, err)
+	}
+
+	// authentication failures are reported
+	bad := &RedisClient{Addr: fr.Addr(), Password: "wrong", Timeout: time.Second}
+	if _, err := bad.Get(ctx, "c:x"); err == nil {
+		t.Error("expected authentication error")
+	}
+}
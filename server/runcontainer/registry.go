@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// SessionRegistry tracks the active sessions.
+type SessionRegistry struct {
+	lck      sync.Mutex
+	sessions map[string]*ContainerSession
+}
+
+// Add registers an active session.
+func (sr *SessionRegistry) Add(cs *ContainerSession) {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	if sr.sessions == nil {
+		sr.sessions = make(map[string]*ContainerSession)
+	}
+	sr.sessions[cs.ID] = cs
+}
+
+// Remove unregisters a session.
+func (sr *SessionRegistry) Remove(id string) {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	delete(sr.sessions, id)
+}
+
+// Get looks up an active session by ID.
+// Returns nil if there is no such session.
+func (sr *SessionRegistry) Get(id string) *ContainerSession {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	return sr.sessions[id]
+}
+
+// List returns the active sessions.
+func (sr *SessionRegistry) List() []*ContainerSession {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	sessions := make([]*ContainerSession, 0, len(sr.sessions))
+	for _, cs := range sr.sessions {
+		sessions = append(sessions, cs)
+	}
+	return sessions
+}
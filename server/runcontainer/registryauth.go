@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// dockerHubAuthKey is the key under which Docker Hub credentials are stored in Docker config files.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// RegistryAuth provides the credentials used to pull images from private registries.
+// It is loaded from a file in the format of the Docker client config file (~/.docker/config.json).
+type RegistryAuth struct {
+	// Auths are the credentials of each registry, keyed by registry host.
+	// Besides the base64-encoded "user:password" auth field, entries may set username and password or identitytoken.
+	Auths map[string]types.AuthConfig `json:"auths"`
+
+	// CredHelpers are the credential helpers (e.g. "ecr-login" for docker-credential-ecr-login) of each registry host.
+	// CredsStore is the helper used for registries without credentials or a helper of their own.
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// LoadRegistryAuth loads registry credentials from a Docker config file.
+func LoadRegistryAuth(path string) (*RegistryAuth, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ra RegistryAuth
+	err = json.Unmarshal(dat, &ra)
+	if err != nil {
+		return nil, err
+	}
+
+	// normalize registry keys
+	auths := make(map[string]types.AuthConfig, len(ra.Auths))
+	for k, a := range ra.Auths {
+		auths[registryKey(k)] = a
+	}
+	ra.Auths = auths
+	helpers := make(map[string]string, len(ra.CredHelpers))
+	for k, h := range ra.CredHelpers {
+		helpers[registryKey(k)] = h
+	}
+	ra.CredHelpers = helpers
+	return &ra, nil
+}
+
+// defaultDockerConfig returns the path of the Docker config file of the current user, which is in $DOCKER_CONFIG or ~/.docker.
+func defaultDockerConfig() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// registryKey normalizes a registry address from a config file (e.g. "https://ghcr.io/" or "https://index.docker.io/v1/") to a host.
+func registryKey(addr string) string {
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "https://"), "http://")
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		addr = addr[:i]
+	}
+	if addr == "index.docker.io" || addr == "registry-1.docker.io" {
+		addr = "docker.io"
+	}
+	return addr
+}
+
+// registryServer returns the server address of a registry host, under which the daemon and credential helpers know it.
+func registryServer(host string) string {
+	if host == "docker.io" {
+		return dockerHubAuthKey
+	}
+	return host
+}
+
+// imageRegistry returns the host of the registry from which an image is pulled.
+// As in Docker, the first component of the name is a host if it contains a dot or port, or is localhost.
+// Other images are pulled from Docker Hub.
+func imageRegistry(img string) string {
+	i := strings.IndexByte(img, '/')
+	if i < 0 {
+		return "docker.io"
+	}
+	host := img[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "docker.io"
+	}
+	return registryKey(host)
+}
+
+// credentials returns the credentials of the registry of an image, or false if the registry needs none.
+func (ra *RegistryAuth) credentials(ctx context.Context, img string) (types.AuthConfig, bool, error) {
+	if ra == nil {
+		return types.AuthConfig{}, false, nil
+	}
+	host := imageRegistry(img)
+	if a, ok := ra.Auths[host]; ok && (a.Auth != "" || a.Username != "" || a.IdentityToken != "") {
+		// decode user:password
+		if a.Auth != "" {
+			dat, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return types.AuthConfig{}, false, errors.New("invalid auth of registry " + host)
+			}
+			user := strings.SplitN(string(dat), ":", 2)
+			if len(user) != 2 {
+				return types.AuthConfig{}, false, errors.New("invalid auth of registry " + host)
+			}
+			a.Username, a.Password, a.Auth = user[0], user[1], ""
+		}
+		a.ServerAddress = registryServer(host)
+		return a, true, nil
+	}
+	helper := ra.CredHelpers[host]
+	if helper == "" {
+		helper = ra.CredsStore
+	}
+	if helper == "" {
+		return types.AuthConfig{}, false, nil
+	}
+	return helperCredentials(ctx, helper, host)
+}
+
+// helperCredentials gets the credentials of a registry from a Docker credential helper.
+func helperCredentials(ctx context.Context, helper string, host string) (types.AuthConfig, bool, error) {
+	server := registryServer(host)
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = strings.TrimSpace(string(out))
+		}
+		if strings.Contains(msg, "credentials not found") {
+			// the helper has no credentials for the registry
+			return types.AuthConfig{}, false, nil
+		}
+		return types.AuthConfig{}, false, errors.New("credential helper " + helper + " failed: " + msg)
+	}
+	var cred struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(out, &cred)
+	if err != nil {
+		return types.AuthConfig{}, false, err
+	}
+	a := types.AuthConfig{Username: cred.Username, Password: cred.Secret, ServerAddress: server}
+	if cred.Username == "<token>" {
+		a = types.AuthConfig{IdentityToken: cred.Secret, ServerAddress: server}
+	}
+	return a, true, nil
+}
+
+// encoded returns the encoded credentials of the registry of an image, as sent to the daemon along with a pull.
+// Returns an empty string if the registry needs no credentials.
+func (ra *RegistryAuth) encoded(ctx context.Context, img string) (string, error) {
+	a, ok, err := ra.credentials(ctx, img)
+	if err != nil || !ok {
+		return "", err
+	}
+	dat, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(dat), nil
+}
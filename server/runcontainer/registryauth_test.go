@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestImageRegistry(t *testing.T) {
+	tbl := map[string]string{
+		"python":                      "docker.io",
+		"openrepl/python3:latest":     "docker.io",
+		"ghcr.io/openrepl/python3":    "ghcr.io",
+		"localhost:5000/python3":      "localhost:5000",
+		"localhost/python3":           "localhost",
+		"123.dkr.ecr.aws.com/python3": "123.dkr.ecr.aws.com",
+		"index.docker.io/library/go":  "docker.io",
+	}
+	for img, host := range tbl {
+		if got := imageRegistry(img); got != host {
+			t.Errorf("%s: expected registry %s but got %s", img, host, got)
+		}
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registryauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// install a fake credential helper
+	helper := "#!/bin/sh\nread server\n[ \"$server\" = 123.dkr.ecr.aws.com ] || { echo credentials not found in native keychain; exit 1; }\necho '{\"ServerURL\": \"'$server'\", \"Username\": \"AWS\", \"Secret\": \"tok\"}'\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	conf := `{
+		"auths": {
+			"https://ghcr.io/": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("bot:secret")) + `"},
+			"https://index.docker.io/v1/": {}
+		},
+		"credHelpers": {"123.dkr.ecr.aws.com": "test"},
+		"credsStore": "test"
+	}`
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(conf), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra, err := LoadRegistryAuth(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err.Error())
+	}
+
+	tbl := []struct {
+		img  string
+		auth types.AuthConfig
+	}{
+		{"ghcr.io/openrepl/python3", types.AuthConfig{Username: "bot", Password: "secret", ServerAddress: "ghcr.io"}},
+		{"123.dkr.ecr.aws.com/python3", types.AuthConfig{Username: "AWS", Password: "tok", ServerAddress: "123.dkr.ecr.aws.com"}},
+		{"openrepl/python3", types.AuthConfig{}},
+	}
+	for _, v := range tbl {
+		enc, err := ra.encoded(context.Background(), v.img)
+		if err != nil {
+			t.Errorf("%s: failed to get credentials: %s", v.img, err.Error())
+			continue
+		}
+		var got types.AuthConfig
+		if enc != "" {
+			dat, err := base64.URLEncoding.DecodeString(enc)
+			if err != nil || json.Unmarshal(dat, &got) != nil {
+				t.Errorf("%s: invalid encoded credentials %q", v.img, enc)
+			}
+		}
+		if got != v.auth {
+			t.Errorf("%s: expected %+v but got %+v", v.img, v.auth, got)
+		}
+	}
+}
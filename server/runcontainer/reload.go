@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// LanguageLoader loads the language configuration file, so that it can be reloaded while the server is running.
+type LanguageLoader struct {
+	// Path is the path of the language configuration file.
+	Path string
+
+	// OSType is the operating system of the containers run by the daemon.
+	OSType string
+
+	// Arch is the normalized CPU architecture of the daemon, which selects the image variants of languages.
+	// If empty, the default images are used.
+	Arch string
+
+	// Defaults are the server defaults applied to every container.
+	Defaults ContainerDefaults
+
+	// Runtimes are the OCI runtimes installed on the daemon.
+	// Languages using other runtimes are disabled. If nil, runtimes are not checked.
+	Runtimes map[string]types.Runtime
+
+	// Backends are the names of the configured backends which languages may select.
+	// Languages selecting other backends are disabled.
+	Backends map[string]bool
+
+	// Kubernetes is whether the default backend deploys Pods.
+	// Languages with settings which Pods cannot apply are disabled.
+	Kubernetes bool
+}
+
+// Load loads and validates the language configuration.
+func (ll *LanguageLoader) Load() (map[string]Language, error) {
+	langs, err := loadLanguages(ll.Path, ll.OSType, ll.Defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	// select the images built for the platform of the daemon
+	if ll.Arch != "" {
+		for name, lang := range langs {
+			langs[name] = lang.withPlatform(ll.OSType + "/" + ll.Arch)
+		}
+	}
+
+	// disable languages whose runtime is not installed on the daemon
+	if ll.Runtimes != nil {
+		for name, lang := range langs {
+			for _, rt := range []string{lang.RunContainer.Runtime, lang.TermContainer.Runtime} {
+				if _, ok := ll.Runtimes[rt]; rt != "" && !ok {
+					serverLog.Printf("disabling %s: runtime %s is not available", name, rt)
+					delete(langs, name)
+					break
+				}
+			}
+		}
+	}
+
+	// disable languages whose backend is not configured
+	for name, lang := range langs {
+		for _, b := range []string{lang.RunContainer.Backend, lang.TermContainer.Backend} {
+			if b != "" && !ll.Backends[b] {
+				serverLog.Printf("disabling %s: backend %s is not configured", name, b)
+				delete(langs, name)
+				break
+			}
+		}
+	}
+
+	// disable languages which cannot run as Pods
+	if ll.Kubernetes {
+		for name, lang := range langs {
+			for _, cc := range []ContainerConfig{lang.RunContainer, lang.TermContainer} {
+				if err := kubeUnsupported(cc); cc.Backend == "" && err != nil {
+					serverLog.Errorf("disabling %s: %s", name, err.Error())
+					delete(langs, name)
+					break
+				}
+			}
+		}
+	}
+
+	if len(langs) == 0 {
+		return nil, errors.New("no languages available in " + ll.Path)
+	}
+	return langs, nil
+}
+
+// languages returns the current language configuration.
+// The returned map must not be modified.
+func (cs *ContainerServer) languages() map[string]Language {
+	cs.langLck.RLock()
+	defer cs.langLck.RUnlock()
+	return cs.Containers
+}
+
+// setLanguages replaces the language configuration.
+// Sessions which are already running keep the configuration with which they started.
+func (cs *ContainerServer) setLanguages(langs map[string]Language) {
+	cs.langLck.Lock()
+	cs.Containers = langs
+	cs.langLck.Unlock()
+
+	// keep the images of new languages
+	var refs []string
+	for img := range languageImages(langs) {
+		refs = append(refs, img)
+	}
+	cs.ImageGC.SetReferenced(refs)
+}
+
+// LanguageChanges is the set of languages changed by a reload.
+type LanguageChanges struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// diffLanguages finds the languages which differ between two configurations.
+func diffLanguages(old map[string]Language, new map[string]Language) LanguageChanges {
+	changes := LanguageChanges{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for name, lang := range new {
+		prev, ok := old[name]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, name)
+		case !reflect.DeepEqual(prev, lang):
+			changes.Changed = append(changes.Changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+	return changes
+}
+
+// languageReloads counts reloads of the language configuration.
+var languageReloads = &Counter{
+	Name:   "openrepl_language_reloads_total",
+	Help:   "Number of reloads of the language configuration, by result.",
+	Labels: []string{"result"},
+}
+
+func init() {
+	metrics.Register(languageReloads)
+}
+
+// ReloadLanguages reloads the language configuration, applying it to new sessions.
+// If the new configuration is invalid, the current configuration is kept.
+func (cs *ContainerServer) ReloadLanguages() (LanguageChanges, error) {
+	if cs.Languages == nil {
+		return LanguageChanges{}, errors.New("language reloading is not configured")
+	}
+	cs.reloadLck.Lock()
+	defer cs.reloadLck.Unlock()
+	langs, err := cs.Languages.Load()
+	if err != nil {
+		languageReloads.Add(1, "failed")
+		serverLog.Errorf("failed to reload languages: %s", err.Error())
+		return LanguageChanges{}, err
+	}
+	changes := diffLanguages(cs.languages(), langs)
+	cs.setLanguages(langs)
+	languageReloads.Add(1, "ok")
+	serverLog.Printf("reloaded languages: added %v, removed %v, changed %v", changes.Added, changes.Removed, changes.Changed)
+	return changes, nil
+}
+
+// WatchLanguages reloads the language configuration whenever the modification time of the file changes.
+func (cs *ContainerServer) WatchLanguages(interval time.Duration) {
+	var mtime time.Time
+	if fi, err := os.Stat(cs.Languages.Path); err == nil {
+		mtime = fi.ModTime()
+	}
+	for range time.Tick(interval) {
+		fi, err := os.Stat(cs.Languages.Path)
+		if err != nil || fi.ModTime().Equal(mtime) {
+			continue
+		}
+		mtime = fi.ModTime()
+		cs.ReloadLanguages()
+	}
+}
+
+// HandleAdminReload reloads the language configuration (POST /admin/reload), responding with the changed languages.
+// The response status is 422 if the new configuration is invalid, in which case the current configuration is kept.
+func (cs *ContainerServer) HandleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	changes, err := cs.ReloadLanguages()
+	if err != nil {
+		http.Error(w, "failed to reload languages: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestReloadLanguages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "langs.json")
+	write := func(conf string) {
+		if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"lua": {"run": {"cmd": [], "image": "openrepl/lua"}, "term": {"cmd": [], "image": "openrepl/lua"}},
+		"bash": {"run": {"cmd": [], "image": "openrepl/bash"}, "term": {"cmd": [], "image": "openrepl/bash"}}}`)
+	srv := &ContainerServer{Languages: &LanguageLoader{Path: path, OSType: "linux", Runtimes: map[string]types.Runtime{"runc": {}}}}
+	srv.Containers, err = srv.Languages.Load()
+	if err != nil {
+		t.Fatalf("failed to load languages: %s", err.Error())
+	}
+
+	// languages with unavailable runtimes are disabled
+	write(`{"lua": {"run": {"cmd": [], "image": "openrepl/lua:5.3"}, "term": {"cmd": [], "image": "openrepl/lua"}},
+		"python3": {"run": {"cmd": [], "image": "openrepl/python3"}, "term": {"cmd": [], "image": "openrepl/python3"}},
+		"go": {"run": {"cmd": [], "image": "openrepl/go", "runtime": "runsc"}, "term": {"cmd": [], "image": "openrepl/go"}}}`)
+	changes, err := srv.ReloadLanguages()
+	if err != nil {
+		t.Fatalf("failed to reload languages: %s", err.Error())
+	}
+	expect := LanguageChanges{Added: []string{"python3"}, Removed: []string{"bash"}, Changed: []string{"lua"}}
+	if !reflect.DeepEqual(changes, expect) {
+		t.Errorf("expected changes %+v but got %+v", expect, changes)
+	}
+	if _, ok := srv.languages()["python3"]; !ok || len(srv.languages()) != 2 {
+		t.Errorf("unexpected languages %v", srv.languages())
+	}
+
+	// invalid configurations are rejected and the current configuration is kept
+	for _, conf := range []string{`{"lua": `, `{}`} {
+		write(conf)
+		w := httptest.NewRecorder()
+		srv.HandleAdminReload(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected status %d but got %d", conf, http.StatusUnprocessableEntity, w.Code)
+		}
+	}
+	if len(srv.languages()) != 2 {
+		t.Errorf("configuration replaced by invalid configuration: %v", srv.languages())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ControlMessage is a message controlling the terminal, which is sent by the client as a text message.
+type ControlMessage struct {
+	// Type is the kind of control message, which is "resize" to change the terminal size, "signal" to signal the program, or "eof" to end its input.
+	Type string `json:"type"`
+
+	// Cols and Rows are the terminal size of a resize message.
+	Cols uint `json:"cols,omitempty"`
+	Rows uint `json:"rows,omitempty"`
+
+	// Signal is the signal (e.g. "SIGINT") of a signal message.
+	Signal string `json:"signal,omitempty"`
+}
+
+// maxTermSize is the maximum number of columns or rows of a terminal.
+const maxTermSize = 1000
+
+// defaultTermCols and defaultTermRows are the terminal size of a container until the client resizes it.
+const (
+	defaultTermCols = 80
+	defaultTermRows = 24
+)
+
+// resizeTimeout is the timeout for resizing the terminal of a container.
+const resizeTimeout = 10 * time.Second
+
+// controlMessages checks whether the client sends text messages as control messages rather than terminal input.
+func (cs *ContainerSession) controlMessages() bool {
+	return cs.Protocol == "openrepl.v2" || cs.Protocol == protocolV3
+}
+
+// resize changes the terminal size of the container.
+func (cs *ContainerSession) resize(cols uint, rows uint) error {
+	if cols == 0 || rows == 0 || cols > maxTermSize || rows > maxTermSize {
+		return fmt.Errorf("terminal size must be between 1 and %d", maxTermSize)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resizeTimeout)
+	defer cancel()
+	c := cs.Container
+	return c.backend.Resize(ctx, c, cols, rows)
+}
+
+// handleControl applies a control message sent by the client.
+// Invalid messages are reported to the client without ending the session.
+func (cs *ContainerSession) handleControl(r io.Reader) error {
+	var msg ControlMessage
+	err := json.NewDecoder(io.LimitReader(r, 4096)).Decode(&msg)
+	if err != nil {
+		return cs.UpdateStatus(StatusUpdate{Status: "warning", Message: "invalid control message"})
+	}
+	err = cs.applyControl(msg)
+	if err != nil {
+		return cs.UpdateStatus(StatusUpdate{Status: "warning", Message: err.Error()})
+	}
+	return nil
+}
+
+// applyControl applies a decoded control message.
+func (cs *ContainerSession) applyControl(msg ControlMessage) error {
+	switch msg.Type {
+	case "resize":
+		err := cs.resize(msg.Cols, msg.Rows)
+		if err != nil {
+			return errors.New("failed to resize terminal: " + err.Error())
+		}
+		cs.recording.resize(msg.Cols, msg.Rows)
+		return nil
+	case "signal":
+		cs.Events.Record("signal", msg.Signal)
+		err := cs.signal(msg.Signal)
+		if err != nil {
+			return errors.New("failed to send signal: " + err.Error())
+		}
+		return nil
+	case "eof":
+		cs.Events.Record("eof", "")
+		err := cs.endInput()
+		if err != nil {
+			return errors.New("failed to end input: " + err.Error())
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown control message %q", msg.Type)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestNegotiateSubprotocol(t *testing.T) {
+	tbl := []struct {
+		offered []string
+		expect  string
+		ok      bool
+	}{
+		{nil, "openrepl.v1", true},
+		{[]string{"openrepl.v1"}, "openrepl.v1", true},
+		{[]string{"openrepl.v1", "openrepl.v2"}, "openrepl.v2", true},
+		{[]string{"openrepl.v1", "openrepl.v3"}, "openrepl.v3", true},
+		{[]string{"openrepl.v0"}, "", false},
+	}
+	for _, v := range tbl {
+		proto, ok := negotiateSubprotocol(v.offered)
+		if proto != v.expect || ok != v.ok {
+			t.Errorf("%v: expected %q (%v) but got %q (%v)", v.offered, v.expect, v.ok, proto, ok)
+		}
+	}
+}
+
+func TestInvalidControl(t *testing.T) {
+	cs := &ContainerSession{Protocol: "openrepl.v2"}
+	for _, msg := range []ControlMessage{
+		{Type: "resize", Cols: 0, Rows: 24},
+		{Type: "resize", Cols: 80, Rows: maxTermSize + 1},
+		{Type: "scroll"},
+		{Type: "signal", Signal: "SIGSEGV"},
+	} {
+		if err := cs.applyControl(msg); err == nil {
+			t.Errorf("invalid control message %+v accepted", msg)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errResourceUnsupported is returned when host resources cannot be measured on this platform.
+var errResourceUnsupported = errors.New("resource measurement not supported on this platform")
+
+// ResourceGuard rejects new sessions when the host is low on resources.
+// A nil ResourceGuard accepts all sessions.
+type ResourceGuard struct {
+	// MinFreeMemory is the minimum amount of available memory in bytes required to start a session.
+	MinFreeMemory int64
+
+	// MinFreeDisk is the minimum amount of free disk space in bytes required to start a session.
+	MinFreeDisk int64
+
+	// DiskPath is a path on the filesystem used for the disk space check.
+	DiskPath string
+
+	// Docker is the monitor of the disk space used by the Docker daemon.
+	// If nil, the disk usage of the daemon is not checked.
+	Docker *DiskMonitor
+}
+
+// Check checks whether there are enough resources available to start a new session.
+// Resources which cannot be measured are not checked.
+func (rg *ResourceGuard) Check() error {
+	if rg == nil {
+		return nil
+	}
+
+	// check memory
+	if rg.MinFreeMemory > 0 {
+		mem, err := freeMemory()
+		switch {
+		case err == errResourceUnsupported:
+		case err != nil:
+			return err
+		case mem < rg.MinFreeMemory:
+			return fmt.Errorf("insufficient memory: %d MB available", mem>>20)
+		}
+	}
+
+	// check disk
+	if rg.MinFreeDisk > 0 {
+		disk, err := freeDisk(rg.DiskPath)
+		switch {
+		case err == errResourceUnsupported:
+		case err != nil:
+			return err
+		case disk < rg.MinFreeDisk:
+			return fmt.Errorf("insufficient disk space: %d MB available", disk>>20)
+		}
+	}
+
+	// check disk usage of the daemon
+	return rg.Docker.Check()
+}
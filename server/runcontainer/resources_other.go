@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// freeMemory returns the amount of available memory on the host in bytes.
+func freeMemory() (int64, error) {
+	return 0, errResourceUnsupported
+}
+
+// freeDisk returns the amount of disk space available on the filesystem containing path.
+func freeDisk(path string) (int64, error) {
+	return 0, errResourceUnsupported
+}
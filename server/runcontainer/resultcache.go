@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// resultCacheLookups counts lookups in the result cache.
+var resultCacheLookups = &Counter{
+	Name:   "openrepl_result_cache_lookups_total",
+	Help:   "Number of graded submissions looked up in the result cache, by result.",
+	Labels: []string{"language", "result"},
+}
+
+func init() {
+	metrics.Register(resultCacheLookups)
+}
+
+// ResultKey identifies the result of grading a submission.
+// Identical submissions graded against the same image and inputs produce the same key.
+type ResultKey struct {
+	Language string
+
+	// Image is the ID of the image which ran the submission.
+	Image string
+
+	// Code is the SHA-256 hash of the submitted code.
+	Code string
+
+	// Input is the SHA-256 hash of the test inputs and of the command running the submission.
+	Input string
+}
+
+// resultEntry is a cached result.
+type resultEntry struct {
+	res     *GradeResult
+	expires time.Time
+}
+
+// ResultCache caches the results of graded submissions, so that resubmitting an identical solution does not run it again.
+// A nil ResultCache caches nothing.
+type ResultCache struct {
+	// TTL is the time for which a result is kept.
+	TTL time.Duration
+
+	// MaxEntries is the maximum number of cached results.
+	// If zero, the number of results is not limited.
+	MaxEntries int
+
+	lck     sync.Mutex
+	entries map[ResultKey]resultEntry
+}
+
+// Get returns the cached result of a submission, or nil if it is not cached.
+func (rc *ResultCache) Get(key ResultKey, now time.Time) *GradeResult {
+	if rc == nil {
+		return nil
+	}
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	e, ok := rc.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return nil
+	}
+	return e.res
+}
+
+// Put caches the result of a submission.
+func (rc *ResultCache) Put(key ResultKey, res *GradeResult, now time.Time) {
+	if rc == nil {
+		return
+	}
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	if rc.entries == nil {
+		rc.entries = make(map[ResultKey]resultEntry)
+	}
+
+	// remove expired results, and the results closest to expiry if the cache is full
+	for k, e := range rc.entries {
+		if !now.Before(e.expires) {
+			delete(rc.entries, k)
+		}
+	}
+	for rc.MaxEntries > 0 && len(rc.entries) >= rc.MaxEntries {
+		var oldest ResultKey
+		var oldestExpiry time.Time
+		for k, e := range rc.entries {
+			if oldestExpiry.IsZero() || e.expires.Before(oldestExpiry) {
+				oldest, oldestExpiry = k, e.expires
+			}
+		}
+		delete(rc.entries, oldest)
+	}
+
+	rc.entries[key] = resultEntry{res: res, expires: now.Add(rc.TTL)}
+}
+
+// hashJSON returns the hex-encoded SHA-256 hash of the JSON encoding of v.
+func hashJSON(v interface{}) (string, error) {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(dat)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// resultKey computes the cache key of the graded submission.
+func (cs *ContainerSession) resultKey(ctx context.Context) (ResultKey, error) {
+	cc := cs.ContainerConfig
+	inspect, _, err := cs.Config.DockerClient.ImageInspectWithRaw(ctx, cc.Image)
+	if err != nil {
+		return ResultKey{}, err
+	}
+	a := cs.Options.Assignment
+	input, err := hashJSON(struct {
+		Tests       []AssignmentTest
+		HiddenTests []AssignmentTest
+		Entrypoint  []string
+		Command     []string
+		Env         []string
+		Packages    []byte
+	}{a.Tests, a.HiddenTests, cc.Entrypoint, cc.Command, cc.Env, cs.Options.Packages})
+	if err != nil {
+		return ResultKey{}, err
+	}
+	code := sha256.Sum256(cs.code)
+	return ResultKey{
+		Language: cc.Language,
+		Image:    inspect.ID,
+		Code:     hex.EncodeToString(code[:]),
+		Input:    input,
+	}, nil
+}
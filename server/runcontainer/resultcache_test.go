@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	rc := &ResultCache{TTL: time.Minute, MaxEntries: 2}
+	a := ResultKey{Language: "python", Image: "sha256:1", Code: "a", Input: "x"}
+	b := ResultKey{Language: "python", Image: "sha256:1", Code: "b", Input: "x"}
+	c := ResultKey{Language: "python", Image: "sha256:2", Code: "a", Input: "x"}
+
+	rc.Put(a, &GradeResult{Passed: 1}, now)
+	if res := rc.Get(a, now.Add(30*time.Second)); res == nil || res.Passed != 1 {
+		t.Errorf("expected cached result, got %v", res)
+	}
+	if res := rc.Get(c, now); res != nil {
+		t.Error("result reused for a different image")
+	}
+	if res := rc.Get(a, now.Add(time.Minute)); res != nil {
+		t.Error("expired result returned")
+	}
+
+	// the result closest to expiry is evicted when the cache is full
+	rc.Put(b, &GradeResult{Passed: 2}, now.Add(10*time.Second))
+	rc.Put(c, &GradeResult{Passed: 3}, now.Add(20*time.Second))
+	if rc.Get(a, now.Add(20*time.Second)) != nil {
+		t.Error("oldest result not evicted")
+	}
+	if rc.Get(b, now.Add(20*time.Second)) == nil || rc.Get(c, now.Add(20*time.Second)) == nil {
+		t.Error("newer results evicted")
+	}
+
+	// a nil cache caches nothing
+	var nilcache *ResultCache
+	nilcache.Put(a, &GradeResult{}, now)
+	if nilcache.Get(a, now) != nil {
+		t.Error("nil cache returned a result")
+	}
+}
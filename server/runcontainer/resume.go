@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errResumeExpired is returned when the client of a resumable session did not reattach within the grace period.
+var errResumeExpired = errors.New("client did not reattach")
+
+// resumeBufferSize is the amount of output kept for a detached client, beyond which the oldest output is dropped.
+const resumeBufferSize = 1 << 20
+
+// sessionsResumed counts the sessions to which a client reattached.
+var sessionsResumed = &Counter{
+	Name: "openrepl_sessions_resumed_total",
+	Help: "Number of times a client reattached to a session after losing its connection.",
+}
+
+func init() {
+	metrics.Register(sessionsResumed)
+}
+
+// resumeMessage is a message written while the client was detached.
+type resumeMessage struct {
+	t   int
+	dat []byte
+}
+
+// resumableConn is a ClientConn which survives the loss of the client connection, so that the client can reattach within a grace period.
+// Messages written while the client is detached are buffered and replayed once it reattaches.
+// A normal close by the client ends the session immediately.
+type resumableConn struct {
+	token     string
+	proto     string
+	principal string
+	grace     time.Duration
+
+	lck      sync.Mutex
+	conn     ClientConn
+	wake     chan struct{}
+	pong     func(string) error
+	buf      []resumeMessage
+	size     int
+	dropped  bool
+	detaches int
+	closed   bool
+	hangup   chan struct{}
+}
+
+func newResumableConn(token string, conn ClientConn, proto string, principal string, grace time.Duration) *resumableConn {
+	return &resumableConn{
+		token:     token,
+		proto:     proto,
+		principal: principal,
+		grace:     grace,
+		conn:      conn,
+		wake:      make(chan struct{}),
+		hangup:    make(chan struct{}),
+	}
+}
+
+// notify wakes up readers waiting for a client.
+// The lock must be held.
+func (rc *resumableConn) notify() {
+	close(rc.wake)
+	rc.wake = make(chan struct{})
+}
+
+// hang ends the session, closing the client connection.
+// The lock must be held.
+func (rc *resumableConn) hang() {
+	if rc.closed {
+		return
+	}
+	rc.closed = true
+	close(rc.hangup)
+	if rc.conn != nil {
+		rc.conn.Close()
+		rc.conn = nil
+	}
+	rc.notify()
+}
+
+// detach drops a client connection which failed, ending the session unless a client reattaches within the grace period.
+// The lock must be held.
+func (rc *resumableConn) detach(conn ClientConn) {
+	if rc.conn != conn || conn == nil {
+		return
+	}
+	conn.Close()
+	rc.conn = nil
+	rc.detaches++
+	gen := rc.detaches
+	time.AfterFunc(rc.grace, func() {
+		rc.lck.Lock()
+		defer rc.lck.Unlock()
+		if rc.conn == nil && rc.detaches == gen {
+			rc.hang()
+		}
+	})
+	rc.notify()
+}
+
+// queue buffers a message for a detached client, dropping the oldest messages beyond resumeBufferSize.
+// The lock must be held.
+func (rc *resumableConn) queue(t int, dat []byte) {
+	rc.buf = append(rc.buf, resumeMessage{t, append([]byte(nil), dat...)})
+	rc.size += len(dat)
+	for rc.size > resumeBufferSize && len(rc.buf) > 1 {
+		rc.size -= len(rc.buf[0].dat)
+		rc.buf = rc.buf[1:]
+		rc.dropped = true
+	}
+}
+
+func (rc *resumableConn) WriteMessage(messageType int, data []byte) error {
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	if rc.closed {
+		return errResumeExpired
+	}
+	if rc.conn != nil {
+		err := rc.conn.WriteMessage(messageType, data)
+		if err == nil {
+			return nil
+		}
+		rc.detach(rc.conn)
+	}
+	rc.queue(messageType, data)
+	return nil
+}
+
+func (rc *resumableConn) WriteJSON(v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return rc.WriteMessage(websocket.TextMessage, dat)
+}
+
+// WriteControl answers pings itself while the client is detached, so that the session does not treat it as stalled.
+func (rc *resumableConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	rc.lck.Lock()
+	conn, pong, closed := rc.conn, rc.pong, rc.closed
+	rc.lck.Unlock()
+	if closed {
+		return errResumeExpired
+	}
+	if conn != nil {
+		err := conn.WriteControl(messageType, data, deadline)
+		if err == nil {
+			return nil
+		}
+		rc.lck.Lock()
+		rc.detach(conn)
+		rc.lck.Unlock()
+	}
+	if pong != nil && messageType == websocket.PingMessage {
+		pong(string(data))
+	}
+	return nil
+}
+
+// ReadMessage reads the next message from the client, waiting for a client to reattach if the connection was lost.
+func (rc *resumableConn) ReadMessage() (int, []byte, error) {
+	for {
+		rc.lck.Lock()
+		for rc.conn == nil && !rc.closed {
+			wake := rc.wake
+			rc.lck.Unlock()
+			<-wake
+			rc.lck.Lock()
+		}
+		conn, closed := rc.conn, rc.closed
+		rc.lck.Unlock()
+		if closed {
+			return 0, nil, errResumeExpired
+		}
+
+		t, dat, err := conn.ReadMessage()
+		if err == nil {
+			return t, dat, nil
+		}
+		rc.lck.Lock()
+		if ce, ok := err.(*websocket.CloseError); ok && ce.Code == websocket.CloseNormalClosure && rc.conn == conn {
+			// the client ended the session
+			rc.hang()
+			rc.lck.Unlock()
+			return 0, nil, err
+		}
+		rc.detach(conn)
+		rc.lck.Unlock()
+	}
+}
+
+func (rc *resumableConn) NextReader() (int, io.Reader, error) {
+	t, dat, err := rc.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return t, bytes.NewReader(dat), nil
+}
+
+func (rc *resumableConn) SetPongHandler(h func(appData string) error) {
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	rc.pong = h
+	if rc.conn != nil {
+		rc.conn.SetPongHandler(h)
+	}
+}
+
+func (rc *resumableConn) Close() error {
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	rc.hang()
+	return nil
+}
+
+// attach attaches a new client connection, replacing the current one, and replays the buffered messages.
+func (rc *resumableConn) attach(conn ClientConn) error {
+	rc.lck.Lock()
+	defer rc.lck.Unlock()
+	if rc.closed {
+		return errResumeExpired
+	}
+	if rc.conn != nil {
+		rc.conn.Close()
+	}
+	rc.conn = nil
+	if rc.pong != nil {
+		conn.SetPongHandler(rc.pong)
+	}
+
+	// replay output
+	su := StatusUpdate{Status: "resumed"}
+	if rc.dropped {
+		su.Message = "output was dropped while disconnected"
+	}
+	dat, err := json.Marshal(su)
+	if err == nil && rc.proto == protocolV3 {
+		dat, err = json.Marshal(Envelope{Type: "status", Payload: dat})
+	}
+	if err != nil {
+		return err
+	}
+	err = conn.WriteMessage(websocket.TextMessage, dat)
+	for _, m := range rc.buf {
+		if err != nil {
+			break
+		}
+		err = conn.WriteMessage(m.t, m.dat)
+	}
+	if err != nil {
+		// keep waiting for another client
+		rc.conn = conn
+		rc.detach(conn)
+		return err
+	}
+	rc.buf, rc.size, rc.dropped = nil, 0, false
+	rc.conn = conn
+	rc.notify()
+	sessionsResumed.Add(1)
+	return nil
+}
+
+// ResumeStore keeps the resumable sessions of websocket clients.
+type ResumeStore struct {
+	// Grace is the amount of time for which a session is kept after its client loses the connection.
+	Grace time.Duration
+
+	lck   sync.Mutex
+	conns map[string]*resumableConn
+}
+
+// New makes a client connection resumable.
+func (rs *ResumeStore) New(conn ClientConn, proto string, principal string) (*resumableConn, error) {
+	token, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	rc := newResumableConn(token, conn, proto, principal, rs.Grace)
+
+	rs.lck.Lock()
+	defer rs.lck.Unlock()
+	if rs.conns == nil {
+		rs.conns = make(map[string]*resumableConn)
+	}
+	rs.conns[token] = rc
+	return rc, nil
+}
+
+// remove removes a connection once its session has ended.
+func (rs *ResumeStore) remove(rc *resumableConn) {
+	rc.Close()
+	rs.lck.Lock()
+	defer rs.lck.Unlock()
+	delete(rs.conns, rc.token)
+}
+
+// Get looks up a resumable connection by token.
+// Returns nil if the connection does not exist.
+func (rs *ResumeStore) Get(token string) *resumableConn {
+	if rs == nil {
+		return nil
+	}
+	rs.lck.Lock()
+	defer rs.lck.Unlock()
+	return rs.conns[token]
+}
+
+// serveResume reattaches a websocket client to the session with the given resume token.
+func (sc *ContainerSessionConfig) serveResume(w http.ResponseWriter, r *http.Request, token string) {
+	rc := sc.Resumes.Get(token)
+	if rc == nil && sc.Cluster.serveRemoteResume(w, r, token) {
+		return
+	}
+	if rc == nil {
+		http.Error(w, "session not found or expired", http.StatusNotFound)
+		return
+	}
+	if p, _ := requestPrincipal(r); p.ID != rc.principal {
+		http.Error(w, "session belongs to another client", http.StatusForbidden)
+		return
+	}
+
+	// speak the protocol of the session
+	offered := websocket.Subprotocols(r)
+	if !(len(offered) == 0 && rc.proto == defaultSubprotocol) && !inList(rc.proto, offered) {
+		http.Error(w, "session requires protocol "+rc.proto, http.StatusBadRequest)
+		return
+	}
+	var hdr http.Header
+	if len(offered) > 0 {
+		hdr = http.Header{"Sec-Websocket-Protocol": {rc.proto}}
+	}
+
+	ws, err := sc.Upgrader.Upgrade(w, r, hdr)
+	if err != nil {
+		serverLog.Errorf("failed to upgrade: %s", err.Error())
+		websocketErrors.Add(1, "upgrade")
+		return
+	}
+	err = rc.attach(sc.clientConn(ws))
+	if err != nil {
+		serverLog.Errorf("failed to reattach client: %s", err.Error())
+	}
+}
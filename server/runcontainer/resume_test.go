@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// failConn is a ClientConn whose every operation fails with an error.
+type failConn struct {
+	err error
+}
+
+func (fc failConn) WriteJSON(interface{}) error               { return fc.err }
+func (fc failConn) WriteMessage(int, []byte) error            { return fc.err }
+func (fc failConn) WriteControl(int, []byte, time.Time) error { return fc.err }
+func (fc failConn) ReadMessage() (int, []byte, error)         { return 0, nil, fc.err }
+func (fc failConn) NextReader() (int, io.Reader, error)       { return 0, nil, fc.err }
+func (fc failConn) SetPongHandler(func(string) error)         {}
+func (fc failConn) Close() error                              { return nil }
+
+func TestResumableConnReplay(t *testing.T) {
+	rc := newResumableConn("tok", failConn{errors.New("connection reset")}, defaultSubprotocol, "", time.Minute)
+	if err := rc.WriteMessage(websocket.BinaryMessage, []byte("hello")); err != nil {
+		t.Fatalf("write while detached failed: %s", err.Error())
+	}
+
+	qc := &queueConn{in: [][]byte{[]byte("input")}}
+	if err := rc.attach(qc); err != nil {
+		t.Fatalf("attach failed: %s", err.Error())
+	}
+	if len(qc.out) != 2 {
+		t.Fatalf("expected status and replayed output, got %q", qc.out)
+	}
+	var su StatusUpdate
+	if err := json.Unmarshal(qc.out[0], &su); err != nil || su.Status != "resumed" {
+		t.Errorf("expected resumed status, got %s", qc.out[0])
+	}
+	if string(qc.out[1]) != "hello" {
+		t.Errorf("expected replayed output %q, got %q", "hello", qc.out[1])
+	}
+
+	_, dat, err := rc.ReadMessage()
+	if err != nil || string(dat) != "input" {
+		t.Errorf("expected input from reattached client, got %q (%v)", dat, err)
+	}
+}
+
+func TestResumableConnNormalClose(t *testing.T) {
+	rc := newResumableConn("tok", failConn{&websocket.CloseError{Code: websocket.CloseNormalClosure}}, defaultSubprotocol, "", time.Minute)
+	if _, _, err := rc.ReadMessage(); err == nil || err == errResumeExpired {
+		t.Fatalf("expected close error, got %v", err)
+	}
+	if err := rc.attach(&queueConn{}); err != errResumeExpired {
+		t.Errorf("expected closed session to reject attach, got %v", err)
+	}
+}
+
+func TestResumableConnExpire(t *testing.T) {
+	rc := newResumableConn("tok", failConn{errors.New("connection reset")}, defaultSubprotocol, "", 10*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := rc.ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != errResumeExpired {
+			t.Errorf("expected %v, got %v", errResumeExpired, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not expire")
+	}
+}
+
+func TestResumableConnDrop(t *testing.T) {
+	rc := newResumableConn("tok", failConn{errors.New("connection reset")}, defaultSubprotocol, "", time.Minute)
+	chunk := make([]byte, resumeBufferSize/2)
+	for i := 0; i < 4; i++ {
+		rc.WriteMessage(websocket.BinaryMessage, chunk)
+	}
+	if rc.size > resumeBufferSize || !rc.dropped {
+		t.Errorf("expected buffer to be bounded, got %d bytes (dropped=%v)", rc.size, rc.dropped)
+	}
+
+	qc := &queueConn{}
+	rc.attach(qc)
+	var su StatusUpdate
+	if err := json.Unmarshal(qc.out[0], &su); err != nil || su.Message == "" {
+		t.Errorf("expected status to report dropped output, got %s", qc.out[0])
+	}
+}
+
+func TestServeResumeNotFound(t *testing.T) {
+	sc := &ContainerSessionConfig{Resumes: &ResumeStore{Grace: time.Minute}}
+	w := httptest.NewRecorder()
+	sc.serveResume(w, httptest.NewRequest(http.MethodGet, "/api/run?session=missing", nil), "missing")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy limits how long and how much stored session data (e.g. event logs) is kept.
+type RetentionPolicy struct {
+	// MaxAge is the maximum age of stored data.
+	// If zero, data does not expire.
+	MaxAge time.Duration
+
+	// MaxBytes is the maximum total size of stored data.
+	// If zero, the size is not limited.
+	MaxBytes int64
+}
+
+// Retention is a default RetentionPolicy with per-tenant overrides.
+type Retention struct {
+	// Default is the policy used for tenants without an override.
+	Default RetentionPolicy
+
+	// Tenants is a map of tenant names to policies.
+	Tenants map[string]RetentionPolicy
+}
+
+// For returns the policy used for a tenant.
+func (r *Retention) For(tenant string) RetentionPolicy {
+	if p, ok := r.Tenants[tenant]; ok {
+		return p
+	}
+	return r.Default
+}
+
+// retainedItem is an item of stored data considered by the cleaner.
+type retainedItem struct {
+	key     string
+	tenant  string
+	created time.Time
+	size    int64
+}
+
+// expired selects the items which must be deleted under the retention policies.
+// Within each tenant, items older than MaxAge are deleted, and then the oldest items until the total is within MaxBytes.
+func (r *Retention) expired(items []retainedItem, now time.Time) []string {
+	// group items by tenant, oldest first
+	sort.Slice(items, func(i, j int) bool { return items[i].created.Before(items[j].created) })
+	groups := make(map[string][]retainedItem)
+	for _, it := range items {
+		groups[it.tenant] = append(groups[it.tenant], it)
+	}
+
+	var del []string
+	for tenant, group := range groups {
+		p := r.For(tenant)
+		var total int64
+		for _, it := range group {
+			total += it.size
+		}
+		for _, it := range group {
+			tooOld := p.MaxAge > 0 && now.Sub(it.created) > p.MaxAge
+			tooBig := p.MaxBytes > 0 && total > p.MaxBytes
+			if !tooOld && !tooBig {
+				break
+			}
+			del = append(del, it.key)
+			total -= it.size
+		}
+	}
+	return del
+}
+
+// parseRetentionPolicy parses a policy in "maxage:maxbytes" form (e.g. "24h:104857600").
+// Either part may be empty to leave it unlimited.
+func parseRetentionPolicy(str string) (RetentionPolicy, error) {
+	var p RetentionPolicy
+	spl := strings.SplitN(str, ":", 2)
+	if spl[0] != "" {
+		age, err := time.ParseDuration(spl[0])
+		if err != nil {
+			return p, fmt.Errorf("invalid retention age %q", spl[0])
+		}
+		p.MaxAge = age
+	}
+	if len(spl) == 2 && spl[1] != "" {
+		size, err := strconv.ParseInt(spl[1], 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid retention size %q", spl[1])
+		}
+		p.MaxBytes = size
+	}
+	return p, nil
+}
+
+// parseTenantRetention parses a comma-separated list of tenant=policy pairs.
+func parseTenantRetention(str string) (map[string]RetentionPolicy, error) {
+	m := make(map[string]RetentionPolicy)
+	for tenant, pol := range parseKeyValues(str) {
+		p, err := parseRetentionPolicy(pol)
+		if err != nil {
+			return nil, err
+		}
+		m[tenant] = p
+	}
+	return m, nil
+}
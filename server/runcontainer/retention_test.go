@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Now()
+	items := []retainedItem{
+		{key: "a", tenant: "", created: now.Add(-3 * time.Hour), size: 10},
+		{key: "b", tenant: "", created: now.Add(-30 * time.Minute), size: 10},
+		{key: "c", tenant: "", created: now.Add(-10 * time.Minute), size: 10},
+		{key: "d", tenant: "big", created: now.Add(-3 * time.Hour), size: 100},
+	}
+	tbl := []struct {
+		retention Retention
+		expect    []string
+	}{
+		{
+			retention: Retention{},
+			expect:    nil,
+		},
+		{
+			retention: Retention{Default: RetentionPolicy{MaxAge: time.Hour}},
+			expect:    []string{"a", "d"},
+		},
+		{
+			retention: Retention{Default: RetentionPolicy{MaxBytes: 15}},
+			expect:    []string{"a", "b", "d"},
+		},
+		{
+			retention: Retention{
+				Default: RetentionPolicy{MaxAge: time.Hour},
+				Tenants: map[string]RetentionPolicy{"big": {}},
+			},
+			expect: []string{"a"},
+		},
+	}
+	for _, v := range tbl {
+		got := v.retention.expired(append([]retainedItem(nil), items...), now)
+		sort.Strings(got)
+		if !reflect.DeepEqual(v.expect, got) {
+			t.Errorf("expected %q but got %q", v.expect, got)
+		}
+	}
+}
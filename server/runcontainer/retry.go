@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// transientMessages are fragments of daemon error messages which indicate a temporary failure.
+var transientMessages = []string{
+	"Conflict.",
+	"i/o timeout",
+	"connection reset",
+	"Internal Server Error",
+	"Service Unavailable",
+	"Bad Gateway",
+	"device or resource busy",
+}
+
+// isTransient checks whether a daemon error is likely to succeed if retried.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == errChaosAttach || client.IsErrConnectionFailed(err) {
+		return true
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return true
+	}
+	msg := err.Error()
+	for _, m := range transientMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// deployRetryDelay is the delay before the first retry of a deployment, which doubles with each retry.
+const deployRetryDelay = 500 * time.Millisecond
+
+// waitRetry waits before retry number n (starting at 1), returning false if the context expires first.
+func waitRetry(ctx context.Context, n int) bool {
+	timer := time.NewTimer(deployRetryDelay << uint(n-1))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
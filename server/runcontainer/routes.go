@@ -0,0 +1,85 @@
+package main
+
+import "net/http"
+
+// routeAccess is the way in which the clients of a route are authenticated.
+type routeAccess int
+
+const (
+	// accessSession routes run code or expose session data, and require an authenticated client.
+	accessSession routeAccess = iota
+
+	// accessAdmin routes require the admin token.
+	accessAdmin
+
+	// accessToken routes check a bearer token of their own, such as the claim token or the owner token of a pair-programming session.
+	accessToken
+
+	// accessPublic routes expose no session data.
+	accessPublic
+)
+
+// route is an HTTP route of the server.
+type route struct {
+	pattern string
+	access  routeAccess
+	handler http.HandlerFunc
+}
+
+// routes returns the HTTP routes of the server.
+// The scheduler is optional, and its route is only served if it is set.
+func (cs *ContainerServer) routes(scheduler *Scheduler) []route {
+	sc := &cs.SessionConfig
+	routes := []route{
+		{"/term", accessSession, cs.rejectDraining(cs.limitClients(cs.HandleTerminal))},
+		{"/eval", accessSession, cs.rejectDraining(cs.limitClients(cs.HandleEval))},
+		{"/run", accessSession, cs.rejectDraining(cs.limitClients(cs.HandleRun))},
+		{"/api/run", accessSession, cs.rejectDraining(cs.limitClients(cs.HandleAPIRun))},
+		{"/api/run/stream", accessSession, cs.rejectDraining(cs.limitClients(cs.HandleAPIRunStream))},
+		{"/api/grade", accessSession, cs.rejectDraining(cs.limitClients(cs.HandleAPIGrade))},
+		{"/claim", accessToken, cs.HandleClaim},
+		{"/workspace", accessSession, cs.rejectDraining(cs.HandleWorkspace)},
+		{"/term/join", accessSession, cs.HandleJoin},
+		{"/term/invite", accessToken, cs.HandleInvite},
+		{"/lsp", accessSession, cs.HandleLSP},
+		{"/languages", accessPublic, cs.HandleLanguages},
+		{"/version", accessPublic, cs.HandleVersion},
+		{"/healthz", accessPublic, cs.HandleHealth},
+		{"/readyz", accessPublic, cs.HandleReady},
+		{"/artifact", accessSession, sc.Artifacts.ServeHTTP},
+		{"/events", accessSession, sc.EventLogs.ServeHTTP},
+		{"/poll", accessSession, sc.Polls.ServeHTTP},
+		{"/sessions", accessSession, cs.HandleEvalSessions},
+		{"/sessions/eval", accessSession, sc.EvalSessions.ServeHTTP},
+		{"/api/kernels", accessSession, cs.HandleJupyterKernels},
+		{"/api/kernels/", accessSession, cs.HandleJupyterKernels},
+		{"/api/kernelspecs", accessSession, cs.HandleJupyterKernelSpecs},
+		{"/assignment", accessSession, cs.HandleAssignment},
+		{"/admin/assignments", accessAdmin, cs.HandleAdminAssignments},
+		{"/admin/logs", accessAdmin, cs.HandleAdminLogs},
+		{"/admin/sessions", accessAdmin, cs.HandleAdminSessions},
+		{"/admin/reload", accessAdmin, cs.HandleAdminReload},
+		{"/admin/sessions/", accessAdmin, cs.HandleAdminSessions},
+		{"/admin/recordings/", accessAdmin, cs.HandleAdminRecordings},
+		{"/admin/api/", accessAdmin, cs.adminAPI().ServeHTTP},
+		{"/metrics", accessPublic, metrics.ServeHTTP},
+	}
+	if scheduler != nil {
+		routes = append(routes, route{"/schedules", accessSession, scheduler.ServeHTTP})
+	}
+	return routes
+}
+
+// register adds routes to a mux, wrapping each handler with the authentication required by its access.
+func (cs *ContainerServer) register(mux *http.ServeMux, routes []route) {
+	for _, rt := range routes {
+		h := rt.handler
+		switch rt.access {
+		case accessSession:
+			h = cs.requireAuth(h)
+		case accessAdmin:
+			h = cs.requireAdmin(h)
+		}
+		mux.HandleFunc(rt.pattern, h)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// publicRoutes are the routes which may be served without authentication, as they expose no session data.
+var publicRoutes = map[string]bool{
+	"/languages": true,
+	"/version":   true,
+	"/healthz":   true,
+	"/readyz":    true,
+	"/metrics":   true,
+}
+
+func TestRoutesRequireAuth(t *testing.T) {
+	cs := &ContainerServer{Auth: APIKeys{{Principal: Principal{ID: "alice"}, Hash: "00"}}}
+	routes := cs.routes(&Scheduler{})
+	mux := http.NewServeMux()
+	cs.register(mux, routes)
+
+	for _, rt := range routes {
+		if rt.access == accessPublic {
+			if !publicRoutes[rt.pattern] {
+				t.Errorf("route %s is served without authentication", rt.pattern)
+			}
+			continue
+		}
+
+		// requests without credentials must be rejected before reaching the handler
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, rt.pattern, nil))
+		switch rt.access {
+		case accessSession:
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("route %s: expected status %d without credentials, got %d", rt.pattern, http.StatusUnauthorized, w.Code)
+			}
+		case accessAdmin:
+			if w.Code != http.StatusForbidden {
+				t.Errorf("route %s: expected status %d without an admin token, got %d", rt.pattern, http.StatusForbidden, w.Code)
+			}
+		case accessToken:
+			if w.Code < 400 {
+				t.Errorf("route %s: expected an error without a token, got status %d", rt.pattern, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// runTimeLimit returns the maximum run time of the session, which is the stricter of the language and server limits.
+// Returns zero if run time is not limited.
+func (cs *ContainerSession) runTimeLimit() time.Duration {
+	limit := cs.Config.MaxRunTime
+	if l := time.Duration(cs.ContainerConfig.MaxRunTime * float64(time.Second)); l > 0 && (limit <= 0 || l < limit) {
+		limit = l
+	}
+	return limit
+}
+
+// timeoutRun kills a run which exceeded its time limit, notifying the client and closing the session.
+func (cs *ContainerSession) timeoutRun(limit time.Duration) {
+	atomic.StoreInt32(&cs.timedOut, 1)
+	msg := fmt.Sprintf("run exceeded the time limit of %v", limit)
+	cs.Events.Record("timeout", msg)
+	cs.UpdateStatus(StatusUpdate{Status: "timeout", Error: msg, Code: codeRunTimeout})
+	cs.notifyTimeout(msg)
+	cs.Close()
+}
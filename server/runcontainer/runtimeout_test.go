@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunTimeLimit(t *testing.T) {
+	tbl := []struct {
+		server time.Duration
+		lang   float64
+		expect time.Duration
+	}{
+		{0, 0, 0},
+		{time.Minute, 0, time.Minute},
+		{0, 30, 30 * time.Second},
+		{time.Minute, 30, 30 * time.Second},
+		{time.Minute, 120, time.Minute},
+	}
+	for _, v := range tbl {
+		cs := &ContainerSession{
+			Config:          &ContainerSessionConfig{MaxRunTime: v.server},
+			ContainerConfig: ContainerConfig{MaxRunTime: v.lang},
+		}
+		if got := cs.runTimeLimit(); got != v.expect {
+			t.Errorf("server %v, language %vs: expected %v but got %v", v.server, v.lang, v.expect, got)
+		}
+	}
+}
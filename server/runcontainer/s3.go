@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3RecordingStore stores recordings as objects in an S3-compatible bucket.
+// Requests are signed with AWS signature version 4.
+type S3RecordingStore struct {
+	// Endpoint is the base URL of the object storage service (e.g. "https://s3.amazonaws.com").
+	// Buckets are addressed by path.
+	Endpoint string
+
+	// Bucket is the name of the bucket, and Prefix is prepended to the object keys.
+	Bucket string
+	Prefix string
+
+	Region string
+
+	// AccessKey and SecretKey are the credentials of the requests, and SessionToken is the token of temporary credentials.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	Client *http.Client
+}
+
+// parseS3URL parses an s3://bucket/prefix URL into a store.
+func parseS3URL(str string) (*S3RecordingStore, error) {
+	u, err := url.Parse(str)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 URL %q", str)
+	}
+	return &S3RecordingStore{
+		Bucket: u.Host,
+		Prefix: strings.TrimPrefix(u.Path, "/"),
+	}, nil
+}
+
+// objectURL returns the URL of the object of a recording.
+func (ss *S3RecordingStore) objectURL(id string) string {
+	key := ss.Prefix
+	if key != "" && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	return strings.TrimSuffix(ss.Endpoint, "/") + "/" + ss.Bucket + "/" + key + id + ".cast"
+}
+
+// do sends a signed request.
+func (ss *S3RecordingStore) do(method string, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	ss.sign(req, body, time.Now())
+	cli := ss.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	return cli.Do(req)
+}
+
+// sign signs a request with AWS signature version 4.
+func (ss *S3RecordingStore) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headers := "host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n"
+	if ss.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", ss.SessionToken)
+		signed = append(signed, "x-amz-security-token")
+		headers += "x-amz-security-token:" + ss.SessionToken + "\n"
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	// the canonical request is hashed into the string to sign
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + ss.Region + "/s3/aws4_request"
+	crsum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crsum[:])
+
+	key := []byte("AWS4" + ss.SecretKey)
+	for _, part := range []string{day, ss.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+ss.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// s3Error converts an unsuccessful response to an error.
+func s3Error(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+func (ss *S3RecordingStore) Save(id string, dat []byte) error {
+	resp, err := ss.do(http.MethodPut, ss.objectURL(id), dat)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (ss *S3RecordingStore) Load(id string) ([]byte, error) {
+	resp, err := ss.do(http.MethodGet, ss.objectURL(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, errRecordingNotFound
+	default:
+		return nil, s3Error(resp)
+	}
+}
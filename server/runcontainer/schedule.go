@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// scheduledRuns counts the runs started by the scheduler.
+var scheduledRuns = &Counter{
+	Name:   "openrepl_scheduled_runs_total",
+	Help:   "Number of scheduled snippet runs, by status.",
+	Labels: []string{"status"},
+}
+
+func init() {
+	metrics.Register(scheduledRuns)
+}
+
+// Schedule is a saved snippet which is run on a cron schedule.
+type Schedule struct {
+	ID string `json:"id"`
+
+	// Tenant is the user who owns the schedule, which is set from the authenticated tenant.
+	// Clients without a tenant own their schedules themselves, and Tenant is their principal ID.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Principal is the ID of the authenticated client which saved the schedule, and runs are attributed to it.
+	Principal string `json:"principal,omitempty"`
+
+	// Snippet is the key of the snippet in the code store.
+	Snippet string `json:"snippet"`
+
+	// Cron is the five-field cron expression on which the snippet runs, evaluated in UTC.
+	Cron string `json:"cron"`
+
+	// Args are the command-line arguments passed to the program.
+	Args []string `json:"args,omitempty"`
+
+	// Timeout is the maximum duration of a run in seconds.
+	// If zero, the server limit is used.
+	Timeout float64 `json:"timeout,omitempty"`
+
+	// Webhook is a URL to which the result of every run is posted.
+	// If empty, results are only kept in the job history.
+	Webhook string `json:"webhook,omitempty"`
+}
+
+// scheduleIDPattern matches valid schedule IDs.
+var scheduleIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// snippetKeyPattern matches the keys of the code store, which are hex-encoded SHA-256 hashes.
+var snippetKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// validate checks that the schedule is well-formed and within the duration limit.
+func (s Schedule) validate(maxDuration time.Duration) error {
+	if !scheduleIDPattern.MatchString(s.ID) {
+		return fmt.Errorf("invalid schedule ID %q", s.ID)
+	}
+	if !snippetKeyPattern.MatchString(s.Snippet) {
+		return fmt.Errorf("invalid snippet key %q", s.Snippet)
+	}
+	spec, err := ParseCron(s.Cron)
+	if err != nil {
+		return err
+	}
+	if spec.Next(time.Now()).IsZero() {
+		return fmt.Errorf("cron expression %q never matches", s.Cron)
+	}
+	if s.Timeout < 0 || time.Duration(s.Timeout*float64(time.Second)) > maxDuration {
+		return fmt.Errorf("timeout must be between 0 and %v", maxDuration.Seconds())
+	}
+	if s.Webhook != "" {
+		u, err := url.Parse(s.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL %q", s.Webhook)
+		}
+	}
+	return nil
+}
+
+// timeout returns the maximum duration of a run of the schedule.
+func (s Schedule) timeout(maxDuration time.Duration) time.Duration {
+	if s.Timeout > 0 {
+		return time.Duration(s.Timeout * float64(time.Second))
+	}
+	return maxDuration
+}
+
+// scheduleKey identifies a schedule, as IDs are only unique for a tenant.
+type scheduleKey struct {
+	tenant string
+	id     string
+}
+
+// ScheduleStore is a persistent store of schedules.
+type ScheduleStore struct {
+	// Path is the JSON file in which schedules are saved.
+	// If empty, schedules are only kept in memory.
+	Path string
+
+	lck       sync.Mutex
+	schedules map[scheduleKey]Schedule
+}
+
+// OpenScheduleStore loads the schedules saved in a file, which need not exist yet.
+func OpenScheduleStore(path string) (*ScheduleStore, error) {
+	ss := &ScheduleStore{Path: path, schedules: make(map[scheduleKey]Schedule)}
+	if path == "" {
+		return ss, nil
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ss, nil
+		}
+		return nil, err
+	}
+	var list []Schedule
+	err = json.Unmarshal(dat, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		ss.schedules[scheduleKey{s.Tenant, s.ID}] = s
+	}
+	return ss, nil
+}
+
+// List returns the schedules of a tenant, or all schedules if tenant is empty, ordered by tenant and ID.
+func (ss *ScheduleStore) List(tenant string) []Schedule {
+	ss.lck.Lock()
+	defer ss.lck.Unlock()
+	list := []Schedule{}
+	for _, s := range ss.list() {
+		if tenant == "" || s.Tenant == tenant {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func (ss *ScheduleStore) list() []Schedule {
+	list := make([]Schedule, 0, len(ss.schedules))
+	for _, s := range ss.schedules {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Tenant != list[j].Tenant {
+			return list[i].Tenant < list[j].Tenant
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// errTooManySchedules is returned when a tenant already has the maximum number of schedules.
+var errTooManySchedules = errors.New("too many schedules")
+
+// Put creates or replaces a schedule.
+// New schedules are rejected with errTooManySchedules if the tenant already has max schedules (if max is nonzero).
+func (ss *ScheduleStore) Put(s Schedule, max int) error {
+	ss.lck.Lock()
+	defer ss.lck.Unlock()
+	k := scheduleKey{s.Tenant, s.ID}
+	prev, existed := ss.schedules[k]
+	if !existed && max > 0 {
+		n := 0
+		for k := range ss.schedules {
+			if k.tenant == s.Tenant {
+				n++
+			}
+		}
+		if n >= max {
+			return errTooManySchedules
+		}
+	}
+	ss.schedules[k] = s
+	err := ss.save()
+	if err != nil {
+		// keep memory consistent with the file
+		if existed {
+			ss.schedules[k] = prev
+		} else {
+			delete(ss.schedules, k)
+		}
+	}
+	return err
+}
+
+// Delete removes a schedule, returning false if it did not exist.
+func (ss *ScheduleStore) Delete(tenant string, id string) (bool, error) {
+	ss.lck.Lock()
+	defer ss.lck.Unlock()
+	k := scheduleKey{tenant, id}
+	prev, ok := ss.schedules[k]
+	if !ok {
+		return false, nil
+	}
+	delete(ss.schedules, k)
+	err := ss.save()
+	if err != nil {
+		ss.schedules[k] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+// save writes the schedules to the file, replacing it atomically.
+func (ss *ScheduleStore) save() error {
+	if ss.Path == "" {
+		return nil
+	}
+	dat, err := json.MarshalIndent(ss.list(), "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := ss.Path + ".tmp"
+	err = ioutil.WriteFile(tmp, dat, 0600)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, ss.Path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ScheduleRun is the result of a scheduled run, which is posted to the webhook of the schedule.
+type ScheduleRun struct {
+	Schedule string    `json:"schedule"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Session  string    `json:"session,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// Status is "exited", "error", "timeout" or "skipped" (if the previous run or too many other runs of the tenant were still active).
+	Status   string `json:"status"`
+	ExitCode *int64 `json:"exit_code,omitempty"`
+	Error    string `json:"err,omitempty"`
+
+	// Output is the beginning of the program output.
+	Output    string `json:"output,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// maxScheduleOutput is the amount of output kept from a scheduled run.
+const maxScheduleOutput = 64 << 10
+
+// errScheduleClosed is returned when using the connection of a scheduled run after it has been closed.
+var errScheduleClosed = errors.New("scheduled run closed")
+
+// scheduleConn is a ClientConn which sends the code of a scheduled run, and records its output and status.
+// The run has no input, and pings are answered immediately.
+type scheduleConn struct {
+	code []byte
+
+	lck     sync.Mutex
+	sent    bool
+	out     limitedBuffer
+	session string
+	err     string
+	expired bool
+	pong    func(string) error
+
+	once   sync.Once
+	hangup chan struct{}
+}
+
+func newScheduleConn(code []byte) *scheduleConn {
+	return &scheduleConn{
+		code:   code,
+		out:    limitedBuffer{limit: maxScheduleOutput + 1},
+		hangup: make(chan struct{}),
+	}
+}
+
+func (sc *scheduleConn) WriteMessage(messageType int, data []byte) error {
+	sc.lck.Lock()
+	defer sc.lck.Unlock()
+	if messageType == websocket.TextMessage {
+		sc.out.Write(data)
+	}
+	return nil
+}
+
+func (sc *scheduleConn) WriteJSON(v interface{}) error {
+	status, ok := v.(StatusUpdate)
+	if !ok {
+		return nil
+	}
+	sc.lck.Lock()
+	defer sc.lck.Unlock()
+	if status.Session != "" {
+		sc.session = status.Session
+	}
+	if status.Error != "" {
+		sc.err = status.Error
+	}
+	return nil
+}
+
+// WriteControl answers pings immediately.
+func (sc *scheduleConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	sc.lck.Lock()
+	pong := sc.pong
+	sc.lck.Unlock()
+	if messageType == websocket.PingMessage && pong != nil {
+		return pong(string(data))
+	}
+	return nil
+}
+
+// ReadMessage returns the code, and then waits until the connection is closed.
+func (sc *scheduleConn) ReadMessage() (int, []byte, error) {
+	sc.lck.Lock()
+	sent := sc.sent
+	sc.sent = true
+	sc.lck.Unlock()
+	if !sent {
+		return websocket.BinaryMessage, sc.code, nil
+	}
+	<-sc.hangup
+	return 0, nil, errScheduleClosed
+}
+
+func (sc *scheduleConn) NextReader() (int, io.Reader, error) {
+	t, dat, err := sc.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return t, bytes.NewReader(dat), nil
+}
+
+func (sc *scheduleConn) SetPongHandler(h func(appData string) error) {
+	sc.lck.Lock()
+	defer sc.lck.Unlock()
+	sc.pong = h
+}
+
+func (sc *scheduleConn) Close() error {
+	sc.once.Do(func() { close(sc.hangup) })
+	return nil
+}
+
+// expire ends a run which exceeded its timeout.
+func (sc *scheduleConn) expire() {
+	sc.lck.Lock()
+	sc.expired = true
+	sc.lck.Unlock()
+	sc.Close()
+}
+
+// storedSnippet is a snippet loaded from the code store.
+type storedSnippet struct {
+	Code     string `json:"code"`
+	Language string `json:"language"`
+}
+
+// Scheduler runs saved snippets on their schedules.
+type Scheduler struct {
+	Store  *ScheduleStore
+	Server *ContainerServer
+
+	// StoreURL is the base URL of the code store from which snippets are loaded (e.g. "http://store").
+	StoreURL string
+
+	// MaxDuration is the maximum duration of a scheduled run.
+	MaxDuration time.Duration
+
+	// MaxConcurrent is the maximum number of concurrent scheduled runs of a tenant.
+	// Runs which are due while the limit is reached are skipped.
+	MaxConcurrent int
+
+	// MaxSchedules is the maximum number of schedules of a tenant.
+	// If zero, the number of schedules is not limited.
+	MaxSchedules int
+
+	// Client is the HTTP client used to load snippets and post webhooks.
+	Client *http.Client
+
+	lck     sync.Mutex
+	running map[string]int
+	active  map[scheduleKey]bool
+	last    map[scheduleKey]ScheduleRun
+}
+
+// schedulerPollRate is the interval at which the scheduler checks for due schedules.
+const schedulerPollRate = 10 * time.Second
+
+// Run starts the schedules as they become due.
+// Each minute is checked once, so minutes are not skipped when polls are delayed.
+func (s *Scheduler) Run() {
+	last := time.Now().UTC().Truncate(time.Minute)
+	for now := range time.Tick(schedulerPollRate) {
+		for m := last.Add(time.Minute); !m.After(now); m = m.Add(time.Minute) {
+			s.startDue(m)
+			last = m
+		}
+	}
+}
+
+// startDue starts the schedules which are due in the given minute.
+// Schedules are not started while the server is draining for maintenance.
+func (s *Scheduler) startDue(minute time.Time) {
+	if s.Server.Draining() {
+		return
+	}
+	for _, sched := range s.Store.List("") {
+		spec, err := ParseCron(sched.Cron)
+		if err != nil || !spec.Matches(minute) {
+			continue
+		}
+		go s.execute(sched)
+	}
+}
+
+// acquire reserves a run slot for the schedule, returning false if the schedule is still running or its tenant is at the concurrency limit.
+func (s *Scheduler) acquire(k scheduleKey) bool {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if s.running == nil {
+		s.running = make(map[string]int)
+		s.active = make(map[scheduleKey]bool)
+	}
+	if s.active[k] || s.running[k.tenant] >= s.MaxConcurrent {
+		return false
+	}
+	s.active[k] = true
+	s.running[k.tenant]++
+	return true
+}
+
+// release releases the run slot of a schedule, keeping the result of the run.
+func (s *Scheduler) release(k scheduleKey, run ScheduleRun) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	delete(s.active, k)
+	s.running[k.tenant]--
+	s.setLast(k, run)
+}
+
+// setLast keeps the result of the latest run of a schedule.
+// The lock must be held.
+func (s *Scheduler) setLast(k scheduleKey, run ScheduleRun) {
+	if s.last == nil {
+		s.last = make(map[scheduleKey]ScheduleRun)
+	}
+	s.last[k] = run
+}
+
+// loadSnippet loads a snippet from the code store.
+func (s *Scheduler) loadSnippet(key string) (storedSnippet, error) {
+	resp, err := s.Client.Get(strings.TrimSuffix(s.StoreURL, "/") + "/load?key=" + url.QueryEscape(key))
+	if err != nil {
+		return storedSnippet{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return storedSnippet{}, fmt.Errorf("failed to load snippet %s: store returned %s", key, resp.Status)
+	}
+	var snip storedSnippet
+	err = json.NewDecoder(resp.Body).Decode(&snip)
+	if err != nil {
+		return storedSnippet{}, err
+	}
+	return snip, nil
+}
+
+// runConfig generates the container configuration of a run of the snippet.
+func (s *Scheduler) runConfig(sched Schedule, snip storedSnippet) (ContainerConfig, error) {
+	srv := s.Server
+	lang, ok := srv.languages()[snip.Language]
+	if !ok {
+		return ContainerConfig{}, fmt.Errorf("language %q not supported", snip.Language)
+	}
+	if platform := srv.SessionConfig.Platform(); !lang.SupportsPlatform(platform) {
+		return ContainerConfig{}, fmt.Errorf("language %s is not available on %s hosts", snip.Language, platform)
+	}
+	cc := lang.RunContainer
+	if cc.GPU != nil {
+		return ContainerConfig{}, errors.New("scheduled runs cannot use GPUs")
+	}
+	env, err := srv.localeEnv(url.Values{}, lang)
+	if err != nil {
+		return ContainerConfig{}, err
+	}
+	cc = cc.withEnv(env...)
+	cc = cc.withCommandVars(CommandVars{
+		EntryFile: cc.entryFile(srv.SessionConfig.DaemonOS),
+		Args:      sched.Args,
+		WorkDir:   cc.WorkDir,
+	})
+	return cc, nil
+}
+
+// execute runs a schedule, posting the result to its webhook.
+func (s *Scheduler) execute(sched Schedule) {
+	k := scheduleKey{sched.Tenant, sched.ID}
+	run := ScheduleRun{Schedule: sched.ID, Tenant: sched.Tenant, Started: time.Now()}
+	if !s.acquire(k) {
+		run.Finished, run.Status = run.Started, "skipped"
+		scheduledRuns.Add(1, run.Status)
+		s.lck.Lock()
+		s.setLast(k, run)
+		s.lck.Unlock()
+		s.notify(sched, run)
+		return
+	}
+	run = s.run(sched, run)
+	s.release(k, run)
+	scheduledRuns.Add(1, run.Status)
+	s.notify(sched, run)
+}
+
+// run executes the snippet of a schedule in a run session.
+func (s *Scheduler) run(sched Schedule, run ScheduleRun) ScheduleRun {
+	fail := func(err error) ScheduleRun {
+		serverLog.Errorf("schedule %s/%s: %s", sched.Tenant, sched.ID, err.Error())
+		run.Finished, run.Status, run.Error = time.Now(), "error", err.Error()
+		return run
+	}
+	snip, err := s.loadSnippet(sched.Snippet)
+	if err != nil {
+		return fail(err)
+	}
+	cc, err := s.runConfig(sched, snip)
+	if err != nil {
+		return fail(err)
+	}
+
+	// run the session, ending it once the timeout expires
+	conn := newScheduleConn([]byte(snip.Code))
+	timer := time.AfterFunc(sched.timeout(s.MaxDuration), conn.expire)
+	serveContainerSession(conn, "scheduler", sched.Tenant, "", true, cc, SessionOptions{Principal: sched.Principal}, &s.Server.SessionConfig)
+	timer.Stop()
+	run.Finished = time.Now()
+
+	conn.lck.Lock()
+	defer conn.lck.Unlock()
+	run.Session, run.Error = conn.session, conn.err
+	run.Output = conn.out.String()
+	if len(run.Output) > maxScheduleOutput {
+		run.Output, run.Truncated = run.Output[:maxScheduleOutput], true
+	}
+	switch {
+	case conn.expired:
+		run.Status = "timeout"
+	case run.Error != "":
+		run.Status = "error"
+	default:
+		run.Status = "exited"
+	}
+
+	// use the exit status recorded in the job history
+	if h := s.Server.SessionConfig.History; h != nil && run.Status == "exited" {
+		for _, rec := range h.Query(JobQuery{Tenant: sched.Tenant, Since: run.Started}) {
+			if rec.ID == run.Session {
+				run.ExitCode = rec.ExitCode
+				break
+			}
+		}
+	}
+	return run
+}
+
+// notify posts the result of a run to the webhook of the schedule.
+func (s *Scheduler) notify(sched Schedule, run ScheduleRun) {
+	if sched.Webhook == "" {
+		return
+	}
+	dat, err := json.Marshal(run)
+	if err != nil {
+		serverLog.Errorf("schedule %s/%s: failed to encode result: %s", sched.Tenant, sched.ID, err.Error())
+		return
+	}
+	resp, err := s.Client.Post(sched.Webhook, "application/json", bytes.NewReader(dat))
+	if err != nil {
+		serverLog.Errorf("schedule %s/%s: failed to post webhook: %s", sched.Tenant, sched.ID, err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		serverLog.Errorf("schedule %s/%s: webhook returned %s", sched.Tenant, sched.ID, resp.Status)
+	}
+}
+
+// ScheduleInfo is a schedule along with its next and latest runs.
+type ScheduleInfo struct {
+	Schedule
+	Next time.Time    `json:"next"`
+	Last *ScheduleRun `json:"last,omitempty"`
+}
+
+// info returns the schedules of a tenant along with their runs.
+func (s *Scheduler) info(tenant string, now time.Time) []ScheduleInfo {
+	list := s.Store.List(tenant)
+	infos := make([]ScheduleInfo, 0, len(list))
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	for _, sched := range list {
+		info := ScheduleInfo{Schedule: sched}
+		if spec, err := ParseCron(sched.Cron); err == nil {
+			info.Next = spec.Next(now)
+		}
+		if run, ok := s.last[scheduleKey{sched.Tenant, sched.ID}]; ok {
+			info.Last = &run
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ServeHTTP manages the schedules of the authenticated tenant.
+// GET lists the schedules, PUT creates or replaces a schedule, and DELETE removes the schedule with the given id.
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := requestPrincipal(r)
+	if !ok || p.ID == "" {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	tenant := p.Tenant
+	if tenant == "" {
+		tenant = p.ID
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.info(tenant, time.Now()))
+	case http.MethodPut:
+		var sched Schedule
+		err := json.NewDecoder(r.Body).Decode(&sched)
+		if err != nil {
+			http.Error(w, "failed to decode schedule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sched.Tenant, sched.Principal = tenant, p.ID
+		err = sched.validate(s.MaxDuration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// check that the snippet can be run
+		snip, err := s.loadSnippet(sched.Snippet)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = s.runConfig(sched, snip)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = s.Store.Put(sched, s.MaxSchedules)
+		switch {
+		case err == errTooManySchedules:
+			http.Error(w, fmt.Sprintf("at most %d schedules are allowed", s.MaxSchedules), http.StatusTooManyRequests)
+			return
+		case err != nil:
+			http.Error(w, "failed to save schedule: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		ok, err := s.Store.Delete(tenant, r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "failed to save schedules: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "schedule not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleValidate(t *testing.T) {
+	snippet := strings.Repeat("ab", 32)
+	tests := []struct {
+		name  string
+		sched Schedule
+		ok    bool
+	}{
+		{"valid", Schedule{ID: "nightly", Snippet: snippet, Cron: "0 3 * * *", Timeout: 60, Webhook: "https://example.com/hook"}, true},
+		{"bad ID", Schedule{ID: "Nightly!", Snippet: snippet, Cron: "0 3 * * *"}, false},
+		{"bad snippet", Schedule{ID: "nightly", Snippet: "abc", Cron: "0 3 * * *"}, false},
+		{"bad cron", Schedule{ID: "nightly", Snippet: snippet, Cron: "0 3 * *"}, false},
+		{"never", Schedule{ID: "nightly", Snippet: snippet, Cron: "0 0 30 2 *"}, false},
+		{"long timeout", Schedule{ID: "nightly", Snippet: snippet, Cron: "0 3 * * *", Timeout: 600}, false},
+		{"bad webhook", Schedule{ID: "nightly", Snippet: snippet, Cron: "0 3 * * *", Webhook: "file:///etc/passwd"}, false},
+	}
+	for _, test := range tests {
+		err := test.sched.validate(5 * time.Minute)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok=%v, got %v", test.name, test.ok, err)
+		}
+	}
+}
+
+func TestScheduleStoreLimit(t *testing.T) {
+	ss, err := OpenScheduleStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		err := ss.Put(Schedule{ID: id, Tenant: "alice"}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ss.Put(Schedule{ID: "c", Tenant: "alice"}, 2); err != errTooManySchedules {
+		t.Errorf("expected errTooManySchedules, got %v", err)
+	}
+
+	// existing schedules may be replaced, and other tenants are not affected
+	if err := ss.Put(Schedule{ID: "a", Tenant: "alice", Cron: "* * * * *"}, 2); err != nil {
+		t.Errorf("failed to replace schedule: %s", err.Error())
+	}
+	if err := ss.Put(Schedule{ID: "a", Tenant: "bob"}, 2); err != nil {
+		t.Errorf("failed to add schedule of another tenant: %s", err.Error())
+	}
+	if n := len(ss.List("alice")); n != 2 {
+		t.Errorf("expected 2 schedules, got %d", n)
+	}
+	if n := len(ss.List("")); n != 3 {
+		t.Errorf("expected 3 schedules in total, got %d", n)
+	}
+}
+
+func TestSchedulerConcurrency(t *testing.T) {
+	s := &Scheduler{MaxConcurrent: 1}
+	a, b := scheduleKey{"alice", "a"}, scheduleKey{"alice", "b"}
+	if !s.acquire(a) {
+		t.Fatal("failed to start run")
+	}
+	if s.acquire(a) {
+		t.Error("schedule started while still running")
+	}
+	if s.acquire(b) {
+		t.Error("tenant exceeded the concurrency limit")
+	}
+	if !s.acquire(scheduleKey{"bob", "a"}) {
+		t.Error("other tenant limited")
+	}
+	s.release(a, ScheduleRun{Status: "exited"})
+	if !s.acquire(b) {
+		t.Error("failed to start run after release")
+	}
+}
+
+func TestSchedulesRequirePrincipal(t *testing.T) {
+	s := &Scheduler{}
+	req := httptest.NewRequest(http.MethodGet, "/schedules", nil)
+	req.Header.Set(tenantHeader, "alice")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for a request without a principal, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// loadSeccompProfile reads the seccomp profile of the container, resolving relative paths against dir.
+// The Docker API takes the contents of profiles rather than paths, so they are read once when languages are loaded.
+func (cc *ContainerConfig) loadSeccompProfile(dir string) error {
+	if cc.SeccompProfile == "" {
+		return nil
+	}
+	path := cc.SeccompProfile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// compact the profile, checking that it is valid JSON
+	var buf bytes.Buffer
+	err = json.Compact(&buf, dat)
+	if err != nil {
+		return err
+	}
+	cc.seccomp = buf.String()
+	return nil
+}
+
+// securityOpts generates the security options of the container.
+func (cc ContainerConfig) securityOpts() []string {
+	if cc.seccomp == "" && !cc.NoNewPrivileges {
+		return cc.SecurityOpt
+	}
+	opts := make([]string, 0, len(cc.SecurityOpt)+2)
+	opts = append(opts, cc.SecurityOpt...)
+	if cc.seccomp != "" {
+		opts = append(opts, "seccomp="+cc.seccomp)
+	}
+	if cc.NoNewPrivileges {
+		opts = append(opts, "no-new-privileges")
+	}
+	return opts
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSecurityOpts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seccomp")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "strict.json"), []byte("{\n  \"defaultAction\": \"SCMP_ACT_ERRNO\"\n}\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write profile: %s", err.Error())
+	}
+	ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte("{"), 0644)
+
+	cc := ContainerConfig{SecurityOpt: []string{"apparmor=unconfined"}, SeccompProfile: "strict.json", NoNewPrivileges: true}
+	err = cc.loadSeccompProfile(dir)
+	if err != nil {
+		t.Fatalf("failed to load profile: %s", err.Error())
+	}
+	expect := []string{"apparmor=unconfined", `seccomp={"defaultAction":"SCMP_ACT_ERRNO"}`, "no-new-privileges"}
+	if got := cc.securityOpts(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %q but got %q", expect, got)
+	}
+	if got := (ContainerConfig{SecurityOpt: []string{"label=disable"}}).securityOpts(); !reflect.DeepEqual(got, []string{"label=disable"}) {
+		t.Errorf("unexpected options %q", got)
+	}
+
+	for _, p := range []string{"bad.json", "missing.json"} {
+		cc := ContainerConfig{SeccompProfile: p}
+		if err := cc.loadSeccompProfile(dir); err == nil {
+			t.Errorf("profile %s accepted", p)
+		}
+	}
+}
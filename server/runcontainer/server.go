@@ -1,7 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
@@ -10,6 +19,159 @@ import (
 type Language struct {
 	RunContainer  ContainerConfig `json:"run"`
 	TermContainer ContainerConfig `json:"term"`
+
+	// Locale is the default locale (e.g. "en_US.UTF-8") used by containers of this language.
+	Locale string `json:"locale,omitempty"`
+
+	// Timezone is the default timezone (e.g. "Europe/Berlin") used by containers of this language.
+	Timezone string `json:"tz,omitempty"`
+
+	// OS is the operating system required by the containers of this language ("linux" or "windows").
+	// If empty, "linux" is assumed.
+	OS string `json:"os,omitempty"`
+
+	// Platforms is the list of platforms (e.g. "linux/amd64") for which the images of this language are available.
+	// If empty, all platforms are assumed to be supported.
+	Platforms []string `json:"platforms,omitempty"`
+
+	// Variants maps platforms (e.g. "linux/arm64") to the images of the language built for them, which replace the default images on hosts of that platform.
+	// Platforms with a variant are supported even if they are not listed in Platforms.
+	Variants map[string]ImageVariant `json:"variants,omitempty"`
+
+	// Deprecated marks a language which is being phased out.
+	// Sessions still work, but clients are warned to migrate.
+	Deprecated bool `json:"deprecated,omitempty"`
+
+	// DeprecationMessage is the warning sent to clients of a deprecated language.
+	DeprecationMessage string `json:"deprecation_message,omitempty"`
+
+	// DisplayName is the name of the language shown to users (e.g. "Python 3").
+	// If empty, the name of the language is used.
+	DisplayName string `json:"display_name,omitempty"`
+
+	// Extension is the file extension of source files (e.g. ".py").
+	Extension string `json:"extension,omitempty"`
+
+	// Version is the version of the language installed in the images, which is the default version.
+	Version string `json:"version,omitempty"`
+
+	// Versions maps other versions of the language (e.g. "3.12") which clients may select to the images providing them.
+	// If empty, only the default version is available.
+	Versions map[string]LanguageVersion `json:"versions,omitempty"`
+
+	// Example is a snippet which frontends may show as a starting point.
+	Example string `json:"example,omitempty"`
+}
+
+// LanguageVersion is a version of a language provided by other images than the default version.
+type LanguageVersion struct {
+	// Image is the image of the run and terminal containers of the version.
+	Image string `json:"image"`
+
+	// TermImage is the image of the terminal containers of the version, if it differs from Image.
+	TermImage string `json:"term_image,omitempty"`
+
+	// Variants are builds of the images of the version for other platforms than the default images, keyed like the variants of the language.
+	// On a platform for which the language has a variant, the version is only available if it has a variant too.
+	Variants map[string]ImageVariant `json:"variants,omitempty"`
+}
+
+// ImageVariant is a build of the images of a language for a specific platform.
+type ImageVariant struct {
+	// Image is the image of the run and terminal containers on the platform.
+	Image string `json:"image"`
+
+	// TermImage is the image of the terminal containers on the platform, if it differs from Image.
+	TermImage string `json:"term_image,omitempty"`
+}
+
+// withPlatform returns a copy of the language which uses the image variant of the given platform, if it has one.
+// Other versions use their variants of the platform, and versions without one are dropped, as their images are built for the default platform.
+func (l Language) withPlatform(platform string) Language {
+	v, ok := l.Variants[platform]
+	if !ok {
+		return l
+	}
+	l.RunContainer.Image, l.RunContainer.FallbackImage = v.Image, ""
+	l.TermContainer.Image, l.TermContainer.FallbackImage = v.Image, ""
+	if v.TermImage != "" {
+		l.TermContainer.Image = v.TermImage
+	}
+	var versions map[string]LanguageVersion
+	for name, ver := range l.Versions {
+		pv, ok := ver.Variants[platform]
+		if !ok {
+			continue
+		}
+		if versions == nil {
+			versions = make(map[string]LanguageVersion)
+		}
+		versions[name] = LanguageVersion{Image: pv.Image, TermImage: pv.TermImage}
+	}
+	l.Versions = versions
+	return l
+}
+
+// withVersion returns a copy of a container configuration of the language which runs the named version.
+// An empty name, or the name of the default version, selects the default version.
+func (l Language) withVersion(cc ContainerConfig, version string, isrun bool) (ContainerConfig, error) {
+	if version == "" || version == l.Version {
+		return cc, nil
+	}
+	v, ok := l.Versions[version]
+	if !ok {
+		return cc, fmt.Errorf("version %s of language %s not available", version, cc.Language)
+	}
+	cc.Image, cc.FallbackImage = v.Image, ""
+	if !isrun && v.TermImage != "" {
+		cc.Image = v.TermImage
+	}
+	return cc, nil
+}
+
+// versionNames returns the sorted names of the versions which clients may select, including the default version.
+func (l Language) versionNames() []string {
+	if len(l.Versions) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(l.Versions)+1)
+	if l.Version != "" {
+		names = append(names, l.Version)
+	}
+	for name := range l.Versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deprecationWarning returns the warning sent to clients of the language named name.
+// Returns an empty string if the language is not deprecated.
+func (l Language) deprecationWarning(name string) string {
+	switch {
+	case !l.Deprecated:
+		return ""
+	case l.DeprecationMessage != "":
+		return l.DeprecationMessage
+	default:
+		return fmt.Sprintf("language %s is deprecated and will be removed", name)
+	}
+}
+
+// SupportsPlatform checks whether the language can run on the given platform.
+func (l Language) SupportsPlatform(platform string) bool {
+	if _, ok := l.Variants[platform]; ok {
+		return true
+	}
+	return len(l.Platforms) == 0 || inList(platform, l.Platforms)
+}
+
+// ContainerOS returns the operating system required by the containers of the language.
+func (l Language) ContainerOS() string {
+	if l.OS == "" {
+		return "linux"
+	}
+	return l.OS
 }
 
 // ContainerServer is a server that runs containers
@@ -18,34 +180,674 @@ type ContainerServer struct {
 	SessionConfig ContainerSessionConfig
 
 	// Containers is a map of language names to container names.
+	// Once the server is running, it must only be replaced through setLanguages.
 	Containers map[string]Language
 
+	// Languages loads the language configuration when it is reloaded.
+	// If nil, the configuration cannot be reloaded.
+	Languages *LanguageLoader
+
 	// Upgrader is a websocket Upgrader used for all websocket connections.
 	Upgrader websocket.Upgrader
+
+	// Locales is the list of locales which a client may request.
+	Locales []string
+
+	// Timezones is the list of timezones which a client may request.
+	Timezones []string
+
+	// Env restricts the environment variables which a client may set.
+	// If nil, clients may not set environment variables.
+	Env *EnvPolicy
+
+	// MaxBenchmarkRuns is the maximum number of measured runs a client may request in benchmark mode.
+	MaxBenchmarkRuns int
+
+	// DeterministicTime is the time at which the clock starts in deterministic mode (e.g. "2000-01-01 00:00:00").
+	DeterministicTime string
+
+	// AdminToken is the bearer token required by admin endpoints.
+	// If empty, admin endpoints are disabled.
+	AdminToken string
+
+	// ClaimToken is the bearer token required to claim warm containers.
+	// If empty, claims are disabled.
+	ClaimToken string
+
+	// Claims is the store of containers claimed in advance by trusted integrators.
+	Claims *ClaimStore
+
+	// Assignments is the store of assignments which run submissions may be graded against.
+	// If nil, grading is disabled.
+	Assignments *AssignmentStore
+
+	// Auth authenticates the clients of sessions.
+	// If nil, sessions are open to all clients.
+	Auth Authenticator
+
+	// ImageGC is the collector removing unused language images.
+	// If nil, images are never removed.
+	ImageGC *ImageGC
+
+	// Exec serves sessions to clients of the gRPC execution API.
+	// If nil, the API is disabled.
+	Exec *ExecServer
+
+	// lastPulls is the result of the last pull of each image, guarded by pullLck.
+	lastPulls map[string]PullResult
+	pullLck   sync.Mutex
+
+	// draining is set while new sessions are rejected for maintenance.
+	draining int32
+
+	// langLck guards Containers while the server is running, and reloadLck serializes reloads.
+	langLck   sync.RWMutex
+	reloadLck sync.Mutex
 }
 
-// HandleTerminal serves an interactive terminal websocket.
-func (cs *ContainerServer) HandleTerminal(w http.ResponseWriter, r *http.Request) {
+// deterministicEnv generates the environment variables for a deterministic run.
+// The locale is fixed, the seed is passed as OPENREPL_SEED, and the clock is faked with libfaketime if the image has it.
+func (cs *ContainerServer) deterministicEnv(cc ContainerConfig, seed uint64) []string {
+	sseed := strconv.FormatUint(seed, 10)
+	env := []string{
+		"LANG=C.UTF-8",
+		"LC_ALL=C.UTF-8",
+		"TZ=UTC",
+		"OPENREPL_SEED=" + sseed,
+		"PYTHONHASHSEED=" + sseed,
+	}
+	if cc.FakeTimeLib != "" {
+		env = append(env, "LD_PRELOAD="+cc.FakeTimeLib, "FAKETIME=@"+cs.DeterministicTime)
+	}
+	return env
+}
+
+// realClock is whether a deterministic session runs with the real clock, as its image does not have libfaketime.
+func (cs *ContainerSession) realClock() bool {
+	return cs.Options.Deterministic && cs.ContainerConfig.FakeTimeLib == ""
+}
+
+// boolOption parses a boolean query parameter, which defaults to false.
+func boolOption(q url.Values, name string) (bool, error) {
+	v := q.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s flag %q", name, v)
+	}
+	return b, nil
+}
+
+// parseOptions parses the SessionOptions selected in the query parameters of a request.
+func (cs *ContainerServer) parseOptions(q url.Values, isrun bool) (SessionOptions, error) {
+	var opts SessionOptions
+	var err error
+
+	// benchmark mode
+	if b := q.Get("bench"); b != "" {
+		if !isrun {
+			return opts, errors.New("benchmark mode is only supported for runs")
+		}
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 1 || n > cs.MaxBenchmarkRuns {
+			return opts, fmt.Errorf("benchmark runs must be between 1 and %d", cs.MaxBenchmarkRuns)
+		}
+		opts.Benchmark = n
+	}
+
+	// deterministic mode
+	opts.Deterministic, err = boolOption(q, "deterministic")
+	if err != nil {
+		return opts, err
+	}
+	if sd := q.Get("seed"); sd != "" {
+		if !opts.Deterministic {
+			return opts, errors.New("seed requires deterministic mode")
+		}
+		seed, err := strconv.ParseUint(sd, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid seed %q", sd)
+		}
+		opts.Seed = seed
+	}
+
+	// timestamped output
+	opts.Timestamps, err = boolOption(q, "timestamps")
+	if err != nil {
+		return opts, err
+	}
+
+	// debug mode
+	opts.Debug, err = boolOption(q, "debug")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Debug && !isrun {
+		return opts, errors.New("debug mode is only supported for runs")
+	}
+	if opts.Debug && opts.Benchmark > 0 {
+		return opts, errors.New("debug mode cannot be combined with benchmark mode")
+	}
+
+	// profiling mode
+	opts.Profile, err = boolOption(q, "profile")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Profile && !isrun {
+		return opts, errors.New("profiling mode is only supported for runs")
+	}
+	if opts.Profile && (opts.Benchmark > 0 || opts.Debug) {
+		return opts, errors.New("profiling mode cannot be combined with benchmark or debug mode")
+	}
+
+	// core dump capture
+	opts.CoreDump, err = boolOption(q, "core")
+	if err != nil {
+		return opts, err
+	}
+	if opts.CoreDump && (!isrun || opts.Benchmark > 0) {
+		return opts, errors.New("core dumps are only supported for normal runs")
+	}
+
+	// watch mode
+	opts.Watch, err = boolOption(q, "watch")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Watch && (!isrun || opts.Benchmark > 0 || opts.Profile || opts.CoreDump) {
+		return opts, errors.New("watch mode is only supported for normal runs")
+	}
+
+	// structured eval protocol
+	opts.Eval, err = boolOption(q, "eval")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Eval && isrun {
+		return opts, errors.New("eval mode is only supported for terminals")
+	}
+
+	// stateful HTTP eval sessions
+	opts.HTTPEval = q.Get("transport") == "http"
+	if opts.HTTPEval && !opts.Eval {
+		return opts, errors.New("HTTP sessions are only supported in eval mode")
+	}
+
+	// notebook cell execution
+	opts.Notebook, err = boolOption(q, "notebook")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Notebook && (isrun || opts.Eval) {
+		return opts, errors.New("notebook mode is only supported for terminals without eval mode")
+	}
+
+	// pair-programming participants
+	opts.Pair, err = boolOption(q, "pair")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Pair && (isrun || opts.Eval || opts.Notebook) {
+		return opts, errors.New("pair programming is only supported for raw terminals")
+	}
+
+	// assignment grading
+	if id := q.Get("assignment"); id != "" {
+		if !isrun || opts.Benchmark > 0 || opts.Debug || opts.Profile || opts.CoreDump || opts.Watch {
+			return opts, errors.New("assignments are only supported for normal runs")
+		}
+		a, ok := cs.Assignments.Get(id)
+		if !ok {
+			return opts, fmt.Errorf("assignment %q not found", id)
+		}
+		opts.Assignment = &a
+	}
+
+	// signed execution receipts
+	opts.Receipt, err = boolOption(q, "receipt")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Receipt && cs.SessionConfig.Receipts == nil {
+		return opts, errors.New("receipts are not enabled on this server")
+	}
+	if opts.Receipt && (!isrun || opts.Benchmark > 0 || opts.Watch || opts.Assignment != nil) {
+		return opts, errors.New("receipts are only supported for normal runs")
+	}
+
+	// filesystem diff report
+	opts.Diff, err = boolOption(q, "diff")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Diff && (!isrun || opts.Benchmark > 0 || opts.Watch || opts.Assignment != nil) {
+		return opts, errors.New("diff reports are only supported for normal runs")
+	}
+
+	// separate output streams
+	opts.Streams, err = boolOption(q, "streams")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Streams && (!isrun || opts.Benchmark > 0 || opts.Watch || opts.Assignment != nil || opts.Debug) {
+		return opts, errors.New("separate output streams are only supported for normal runs")
+	}
+
+	// resource usage report
+	opts.Usage, err = boolOption(q, "usage")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Usage && (!isrun || opts.Benchmark > 0 || opts.Watch || opts.Assignment != nil) {
+		return opts, errors.New("usage reports are only supported for normal runs")
+	}
+
+	// instructor test suites
+	opts.Grade, err = boolOption(q, "grade")
+	if err != nil {
+		return opts, err
+	}
+	if opts.Grade && (!isrun || opts.Benchmark > 0 || opts.Debug || opts.Profile || opts.CoreDump || opts.Watch || opts.Assignment != nil || opts.Receipt || opts.Diff) {
+		return opts, errors.New("test runs are only supported for normal runs")
+	}
+
+	// non-interactive runs over plain HTTP
+	switch t := q.Get("transport"); t {
+	case "rest", "sse":
+		opts.RunTransport = t
+	}
+	if opts.RunTransport != "" && !opts.Streams {
+		return opts, errors.New("HTTP runs require separate output streams")
+	}
+	if opts.Grade && opts.RunTransport != "rest" {
+		return opts, errors.New("test runs are only available at /api/grade")
+	}
+
+	// multi-file projects
+	switch opts.Project = q.Get("project"); opts.Project {
+	case "", "tar", "json":
+	default:
+		return opts, fmt.Errorf("unsupported project format %q", opts.Project)
+	}
+	if opts.Project != "" && !isrun {
+		return opts, errors.New("projects are only supported for runs")
+	}
+	opts.Entry = q.Get("entry")
+	if opts.Entry != "" && opts.Project == "" {
+		return opts, errors.New("an entry file may only be selected for projects")
+	}
+
+	// shared workspaces
+	opts.Workspace = q.Get("workspace")
+	if opts.Workspace != "" && (opts.HTTPEval || opts.RunTransport != "") {
+		return opts, errors.New("shared workspaces require a session connection")
+	}
+
+	return opts, nil
+}
+
+// semaphore is a counting semaphore.
+type semaphore chan struct{}
+
+// tryAcquire attempts to acquire the semaphore without blocking.
+func (s semaphore) tryAcquire() bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire acquires the semaphore, waiting until it is available or the context expires.
+func (s semaphore) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release releases a previously acquired semaphore.
+func (s semaphore) release() {
+	<-s
+}
+
+// inList checks whether str is in the list.
+func inList(str string, list []string) bool {
+	for _, v := range list {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
+
+// localeEnv generates the locale and timezone environment variables for the query parameters of a request.
+// The language defaults are used unless the client requests an allowed alternative.
+func (cs *ContainerServer) localeEnv(q url.Values, lang Language) ([]string, error) {
+	locale, tz := lang.Locale, lang.Timezone
+
+	// apply client overrides
+	if l := q.Get("locale"); l != "" {
+		if !inList(l, cs.Locales) {
+			return nil, fmt.Errorf("locale %q not supported", l)
+		}
+		locale = l
+	}
+	if t := q.Get("tz"); t != "" {
+		if !inList(t, cs.Timezones) {
+			return nil, fmt.Errorf("timezone %q not supported", t)
+		}
+		tz = t
+	}
+
+	// generate environment variables
+	var env []string
+	if locale != "" {
+		env = append(env, "LANG="+locale, "LC_ALL="+locale)
+	}
+	if tz != "" {
+		env = append(env, "TZ="+tz)
+	}
+	return env, nil
+}
+
+// serveSession serves a ContainerSession for the language requested by the client.
+func (cs *ContainerServer) serveSession(w http.ResponseWriter, r *http.Request, isrun bool) {
+	// trace the session, continuing the trace of the client
+	spanName := "HandleTerminal"
+	if isrun {
+		spanName = "HandleRun"
+	}
+	span := cs.SessionConfig.Tracer.StartRequest(r, spanName)
+	defer span.End()
+
+	// reattach to a terminal whose client lost its connection
+	if tok := r.URL.Query().Get("session"); tok != "" && !isrun {
+		cs.SessionConfig.serveResume(w, r, tok)
+		return
+	}
+
 	// get language
-	lang, ok := cs.Containers[r.URL.Query().Get("lang")]
+	langname := r.URL.Query().Get("lang")
+	span.SetAttribute("openrepl.language", langname)
+	lang, ok := cs.languages()[langname]
 	if !ok {
 		http.Error(w, "language not supported", http.StatusBadRequest)
 		return
 	}
 
+	// check platform compatibility, routing the session to a node of the cluster supporting the language
+	if platform := cs.SessionConfig.Platform(); !lang.SupportsPlatform(platform) {
+		if cs.SessionConfig.Cluster.serveOnSupportedNode(w, r, lang) {
+			return
+		}
+		http.Error(w, fmt.Sprintf("language %s is not available on %s hosts", langname, platform), http.StatusBadRequest)
+		return
+	}
+
+	// select container
+	cc := lang.TermContainer
+	if isrun {
+		cc = lang.RunContainer
+	}
+	cc, err := lang.withVersion(cc, r.URL.Query().Get("version"), isrun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	span.SetAttribute("container.image.name", cc.Image)
+
+	// parse session options
+	opts, err := cs.parseOptions(r.URL.Query(), isrun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Trace = span
+
+	// pipelines run their own commands
+	if isrun && cc.usesPipeline() && (opts.Benchmark > 0 || opts.Watch || opts.Assignment != nil || opts.Receipt || opts.Diff || opts.Streams || opts.Grade || opts.Usage) {
+		http.Error(w, "benchmark, watch, assignment mode, receipts, diff reports and separate streams are not supported for this language", http.StatusBadRequest)
+		return
+	}
+
+	// features using the Docker API directly are unavailable on other backends
+	if (cs.SessionConfig.DockerClient == nil || cc.Backend != "") && opts.requiresDocker(isrun, cc) {
+		http.Error(w, "this session mode is not supported by the container backend", http.StatusBadRequest)
+		return
+	}
+
+	// run without a terminal to keep output streams apart
+	if opts.Streams {
+		cc = cc.withoutTTY()
+	}
+
+	// submissions are graded in the language of the assignment
+	if opts.Assignment != nil && opts.Assignment.Language != langname {
+		http.Error(w, fmt.Sprintf("assignment %s requires language %s", opts.Assignment.ID, opts.Assignment.Language), http.StatusBadRequest)
+		return
+	}
+
+	// run test suites with the test runner of the language
+	if opts.Grade && cc.Test == nil {
+		http.Error(w, "test runs not supported for this language", http.StatusBadRequest)
+		return
+	}
+
+	// evaluate through the in-container driver
+	if opts.Eval && cc.Eval == nil {
+		http.Error(w, "eval mode not supported for this language", http.StatusBadRequest)
+		return
+	}
+	if opts.Notebook && cc.Eval == nil {
+		http.Error(w, "notebook mode not supported for this language", http.StatusBadRequest)
+		return
+	}
+
+	// run under debugger
+	if opts.Debug {
+		if cc.Debug == nil {
+			http.Error(w, "debug mode not supported for this language", http.StatusBadRequest)
+			return
+		}
+		cc = cc.withDebug()
+	}
+
+	// run under profiler
+	if opts.Profile {
+		if cc.Profile == nil {
+			http.Error(w, "profiling mode not supported for this language", http.StatusBadRequest)
+			return
+		}
+		cc = cc.withProfile()
+	}
+
+	// allow core dumps
+	if opts.CoreDump {
+		if cc.CoreDump == nil {
+			http.Error(w, "core dumps not supported for this language", http.StatusBadRequest)
+			return
+		}
+		cc = cc.withCoreDump()
+	}
+
+	// apply environment variables requested by the client
+	clientEnv, err := cs.Env.parse(r.URL.Query()["env"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cc = cc.withEnv(clientEnv...)
+
+	// apply locale settings, which are fixed in deterministic mode
+	var env []string
+	if opts.Deterministic {
+		env = cs.deterministicEnv(cc, opts.Seed)
+	} else {
+		env, err = cs.localeEnv(r.URL.Query(), lang)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cc = cc.withEnv(env...)
+
+	// run multi-file projects from their project directory
+	entryFile := cc.entryFile(cs.SessionConfig.DaemonOS)
+	if opts.Project != "" {
+		cc, opts.Entry, err = cc.withProject(cs.SessionConfig.DaemonOS, opts.Entry)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entryFile = path.Join(cc.WorkDir, opts.Entry)
+	}
+
+	// expand command placeholders
+	cc = cc.withCommandVars(CommandVars{
+		EntryFile: entryFile,
+		Args:      r.URL.Query()["arg"],
+		WorkDir:   cc.WorkDir,
+	})
+
+	// bind to a container claimed in advance
+	if tok := r.URL.Query().Get("claim"); tok != "" {
+		if isrun || opts.Eval || opts.Notebook || opts.HTTPEval || opts.Deterministic {
+			http.Error(w, "claims are only supported for plain terminals", http.StatusBadRequest)
+			return
+		}
+		claim := cs.Claims.Take(tok)
+		if claim == nil {
+			http.Error(w, "claim not found or expired", http.StatusBadRequest)
+			return
+		}
+		if claim.lang != langname {
+			claim.release()
+			http.Error(w, "claim is for a different language", http.StatusBadRequest)
+			return
+		}
+		opts.Claim = claim
+	}
+
+	// associate the session with the authenticated client
+	if p, ok := requestPrincipal(r); ok {
+		opts.Principal = p.ID
+	}
+
+	// mount the shared workspace of the client as the working directory
+	if opts.Workspace != "" {
+		if cc.WorkDir == "" || opts.Claim != nil {
+			http.Error(w, "shared workspaces not supported for this session", http.StatusBadRequest)
+			return
+		}
+		cc.workspaceVolume, err = cs.SessionConfig.Workspaces.Volume(opts.Workspace, opts.Principal)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// run ContainerSession
-	HandleContainerSession(w, r, false, lang.TermContainer, &cs.SessionConfig)
+	HandleContainerSession(w, r, isrun, cc, opts, &cs.SessionConfig)
+}
+
+// HandleTerminal serves an interactive terminal websocket.
+func (cs *ContainerServer) HandleTerminal(w http.ResponseWriter, r *http.Request) {
+	cs.serveSession(w, r, false)
 }
 
 // HandleRun serves an interactive terminal websocket running user code.
 func (cs *ContainerServer) HandleRun(w http.ResponseWriter, r *http.Request) {
-	// get language
-	lang, ok := cs.Containers[r.URL.Query().Get("lang")]
-	if !ok {
-		http.Error(w, "language not supported", http.StatusBadRequest)
+	cs.serveSession(w, r, true)
+}
+
+// HandleEval serves a websocket using the structured eval protocol, equivalent to a terminal with the eval option.
+func (cs *ContainerServer) HandleEval(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	q.Set("eval", "true")
+	r.URL.RawQuery = q.Encode()
+	cs.serveSession(w, r, false)
+}
+
+// HandleEvalSessions creates (POST) and deletes (DELETE) stateful eval sessions for HTTP clients.
+// Evaluations are sent to the EvalSessionStore with the token returned on creation.
+func (cs *ContainerServer) HandleEvalSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if cs.Draining() {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "server is under maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		q := r.URL.Query()
+		q.Set("eval", "true")
+		q.Set("transport", "http")
+		r.URL.RawQuery = q.Encode()
+		cs.serveSession(w, r, false)
+	case http.MethodDelete:
+		if cs.SessionConfig.EvalSessions == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		cs.SessionConfig.EvalSessions.ServeHTTP(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// LanguageInfo is the public description of a language.
+type LanguageInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Extension   string `json:"extension,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Example     string `json:"example,omitempty"`
+	Deprecated  bool   `json:"deprecated,omitempty"`
+	Message     string `json:"message,omitempty"`
+
+	// Versions is the list of versions which clients may select, if there are several.
+	Versions []string `json:"versions,omitempty"`
+}
+
+// info returns the public description of the language named name.
+func (l Language) info(name string) LanguageInfo {
+	display := l.DisplayName
+	if display == "" {
+		display = name
+	}
+	return LanguageInfo{
+		Name:        name,
+		DisplayName: display,
+		Extension:   l.Extension,
+		Version:     l.Version,
+		Example:     l.Example,
+		Versions:    l.versionNames(),
+		Deprecated:  l.Deprecated,
+		Message:     l.deprecationWarning(name),
+	}
+}
+
+// HandleLanguages serves the list of available languages and their metadata as JSON, so that frontends need not hard-code it.
+func (cs *ContainerServer) HandleLanguages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	// run ContainerSession
-	HandleContainerSession(w, r, true, lang.RunContainer, &cs.SessionConfig)
+	available := cs.languages()
+	langs := make([]LanguageInfo, 0, len(available))
+	for name, lang := range available {
+		langs = append(langs, lang.info(name))
+	}
+	sort.Slice(langs, func(i, j int) bool { return langs[i].Name < langs[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(langs)
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestHandleLanguages(t *testing.T) {
+	cs := &ContainerServer{Containers: map[string]Language{
+		"python3": {DisplayName: "Python 3", Extension: ".py", Version: "3.11", Example: `print("hi")`, Versions: map[string]LanguageVersion{
+			"3.12": {Image: "openrepl/python3:3.12"},
+		}},
+		"forth": {Deprecated: true},
+	}}
+	rec := httptest.NewRecorder()
+	cs.HandleLanguages(rec, httptest.NewRequest(http.MethodGet, "/languages", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %d with type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var langs []LanguageInfo
+	err := json.NewDecoder(rec.Body).Decode(&langs)
+	if err != nil {
+		t.Fatalf("failed to decode languages: %s", err.Error())
+	}
+	expect := []LanguageInfo{
+		{Name: "forth", DisplayName: "forth", Deprecated: true, Message: "language forth is deprecated and will be removed"},
+		{Name: "python3", DisplayName: "Python 3", Extension: ".py", Version: "3.11", Example: `print("hi")`, Versions: []string{"3.11", "3.12"}},
+	}
+	if !reflect.DeepEqual(langs, expect) {
+		t.Errorf("expected %+v but got %+v", expect, langs)
+	}
+
+	rec = httptest.NewRecorder()
+	cs.HandleLanguages(rec, httptest.NewRequest(http.MethodPost, "/languages", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 but got %d", rec.Code)
+	}
+}
+
+func TestLanguageVersion(t *testing.T) {
+	lang := Language{
+		Version: "20",
+		Versions: map[string]LanguageVersion{
+			"18": {Image: "openrepl/javascript:18", TermImage: "openrepl/javascript-term:18"},
+		},
+	}
+	cc := ContainerConfig{Language: "javascript", Image: "openrepl/javascript", FallbackImage: "openrepl/javascript:previous"}
+	for _, v := range []string{"", "20"} {
+		got, err := lang.withVersion(cc, v, true)
+		if err != nil || !reflect.DeepEqual(got, cc) {
+			t.Errorf("version %q: expected the default configuration, got %+v (%v)", v, got, err)
+		}
+	}
+	got, err := lang.withVersion(cc, "18", true)
+	if err != nil || got.Image != "openrepl/javascript:18" || got.FallbackImage != "" {
+		t.Errorf("unexpected run configuration %+v (%v)", got, err)
+	}
+	got, err = lang.withVersion(cc, "18", false)
+	if err != nil || got.Image != "openrepl/javascript-term:18" {
+		t.Errorf("unexpected terminal configuration %+v (%v)", got, err)
+	}
+	if _, err := lang.withVersion(cc, "16", true); err == nil {
+		t.Error("unknown version accepted")
+	}
+	if names := (Language{Version: "3"}).versionNames(); names != nil {
+		t.Errorf("expected no versions, got %v", names)
+	}
+}
+
+func TestLanguageVariants(t *testing.T) {
+	lang := Language{
+		RunContainer:  ContainerConfig{Image: "openrepl/julia"},
+		TermContainer: ContainerConfig{Image: "openrepl/julia", FallbackImage: "openrepl/julia:previous"},
+		Platforms:     []string{"linux/amd64"},
+		Variants: map[string]ImageVariant{
+			"linux/arm64": {Image: "openrepl/julia-arm64", TermImage: "openrepl/julia-term-arm64"},
+		},
+	}
+	got := lang.withPlatform("linux/arm64")
+	if got.RunContainer.Image != "openrepl/julia-arm64" || got.TermContainer.Image != "openrepl/julia-term-arm64" || got.TermContainer.FallbackImage != "" {
+		t.Errorf("unexpected arm64 images %q, %q", got.RunContainer.Image, got.TermContainer.Image)
+	}
+	if got := lang.withPlatform("linux/amd64"); !reflect.DeepEqual(got, lang) {
+		t.Errorf("expected the default images on amd64, got %+v", got)
+	}
+
+	// other versions are only available on the platform if they have a variant for it
+	lang.Versions = map[string]LanguageVersion{
+		"1.9": {Image: "openrepl/julia:1.9", Variants: map[string]ImageVariant{"linux/arm64": {Image: "openrepl/julia-arm64:1.9"}}},
+		"1.6": {Image: "openrepl/julia:1.6"},
+	}
+	got = lang.withPlatform("linux/arm64")
+	expect := map[string]LanguageVersion{"1.9": {Image: "openrepl/julia-arm64:1.9"}}
+	if !reflect.DeepEqual(got.Versions, expect) {
+		t.Errorf("expected arm64 versions %+v, got %+v", expect, got.Versions)
+	}
+	if got := lang.withPlatform("linux/amd64"); !reflect.DeepEqual(got.Versions, lang.Versions) {
+		t.Errorf("expected the default versions on amd64, got %+v", got.Versions)
+	}
+
+	// platforms with a variant are supported, others only if listed
+	for platform, expect := range map[string]bool{"linux/amd64": true, "linux/arm64": true, "linux/s390x": false} {
+		if lang.SupportsPlatform(platform) != expect {
+			t.Errorf("%s: expected supported=%v", platform, expect)
+		}
+	}
+	if !(Language{}).SupportsPlatform("linux/s390x") {
+		t.Error("expected languages without platforms to support every platform")
+	}
+}
+
+func TestLanguageMetadata(t *testing.T) {
+	f, err := os.Open("langs.json")
+	if err != nil {
+		t.Fatalf("failed to open langs.json: %s", err.Error())
+	}
+	defer f.Close()
+	var langs map[string]Language
+	err = json.NewDecoder(f).Decode(&langs)
+	if err != nil {
+		t.Fatalf("failed to decode langs.json: %s", err.Error())
+	}
+	for name, lang := range langs {
+		if lang.DisplayName == "" || lang.Extension == "" || lang.Example == "" {
+			t.Errorf("language %s is missing metadata", name)
+		}
+	}
+}
+
+func TestDeterministicEnv(t *testing.T) {
+	cs := &ContainerServer{DeterministicTime: "2000-01-01 00:00:00"}
+
+	// without libfaketime, only the locale and seed are fixed
+	env := cs.deterministicEnv(ContainerConfig{}, 42)
+	if !inList("OPENREPL_SEED=42", env) || !inList("TZ=UTC", env) || inList("FAKETIME=@2000-01-01 00:00:00", env) {
+		t.Errorf("unexpected environment %v", env)
+	}
+	sess := &ContainerSession{Options: SessionOptions{Deterministic: true}}
+	if !sess.realClock() {
+		t.Error("expected the real clock without libfaketime")
+	}
+
+	env = cs.deterministicEnv(ContainerConfig{FakeTimeLib: "/usr/lib/faketime/libfaketime.so.1"}, 42)
+	if !inList("LD_PRELOAD=/usr/lib/faketime/libfaketime.so.1", env) || !inList("FAKETIME=@2000-01-01 00:00:00", env) {
+		t.Errorf("unexpected environment %v", env)
+	}
+}
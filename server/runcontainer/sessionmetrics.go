@@ -0,0 +1,68 @@
+package main
+
+import "github.com/gorilla/websocket"
+
+// sessionsStarted counts the sessions started for each language.
+var sessionsStarted = &Counter{
+	Name:   "openrepl_sessions_started_total",
+	Help:   "Number of sessions started.",
+	Labels: []string{"language", "kind"},
+}
+
+// sessionsEnded counts the sessions ended for each language.
+var sessionsEnded = &Counter{
+	Name:   "openrepl_sessions_ended_total",
+	Help:   "Number of sessions ended.",
+	Labels: []string{"language", "kind"},
+}
+
+// sessionStartLatency records the time from the start of each session until the program is running.
+// Unlike the deployment phases, this includes waiting for capacity, copying code and waiting for the prompt.
+var sessionStartLatency = &Histogram{
+	Name:    "openrepl_session_start_seconds",
+	Help:    "Time from the start of a session until its program is running.",
+	Labels:  []string{"language", "kind"},
+	Buckets: latencyBuckets,
+}
+
+// containersRunning is the number of containers held by sessions.
+var containersRunning = &Gauge{
+	Name:   "openrepl_containers_running",
+	Help:   "Number of running session containers.",
+	Labels: []string{"language"},
+}
+
+// websocketErrors counts failed websocket operations.
+var websocketErrors = &Counter{
+	Name:   "openrepl_websocket_errors_total",
+	Help:   "Number of websocket errors, by operation.",
+	Labels: []string{"op"},
+}
+
+func init() {
+	metrics.Register(sessionsStarted)
+	metrics.Register(sessionsEnded)
+	metrics.Register(sessionStartLatency)
+	metrics.Register(containersRunning)
+	metrics.Register(websocketErrors)
+}
+
+// kind returns the kind of the session ("run" or "term"), with which session metrics are labeled.
+func (cs *ContainerSession) kind() string {
+	if cs.IsRun {
+		return "run"
+	}
+	return "term"
+}
+
+// countClientError counts an error of a websocket operation on the client connection.
+// Normal closures by the client, and errors of other transports, are not counted.
+func (cs *ContainerSession) countClientError(op string, err error) {
+	if _, ok := cs.Client.(*deadlineConn); !ok || err == nil {
+		return
+	}
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return
+	}
+	websocketErrors.Add(1, op)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// sessionState is the lifecycle state of a session.
+// Sessions start deploying their container, are ready once it exists, run while the client is bridged to the program, and end either closed or in error.
+// States only move forward, and the two final states cannot be left.
+type sessionState int32
+
+const (
+	stateStarting sessionState = iota
+	stateReady
+	stateRunning
+	stateClosed
+	stateError
+)
+
+var sessionStateNames = [...]string{"starting", "ready", "running", "closed", "error"}
+
+func (s sessionState) String() string {
+	if int(s) < len(sessionStateNames) {
+		return sessionStateNames[s]
+	}
+	return "unknown"
+}
+
+// ended returns whether the state is final.
+func (s sessionState) ended() bool {
+	return s >= stateClosed
+}
+
+// State returns the lifecycle state of the session.
+func (cs *ContainerSession) State() sessionState {
+	return sessionState(atomic.LoadInt32(&cs.state))
+}
+
+// setState moves the session to a later state.
+// It returns false without changing the state if the session has already ended or is past the state.
+func (cs *ContainerSession) setState(s sessionState) bool {
+	for {
+		cur := cs.State()
+		if cur.ended() || s <= cur {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&cs.state, int32(cur), int32(s)) {
+			return true
+		}
+	}
+}
+
+// abort ends the session with a failure, recording the event and sending the status explaining it to the client.
+// The caller returns afterwards, and the deferred Close tears down whatever the session has set up so far.
+// Only the first failure of a session is reported; an empty log message is not logged.
+func (cs *ContainerSession) abort(event string, detail string, su StatusUpdate, logmsg string) {
+	if cs.fail(event, detail, su) && logmsg != "" {
+		cs.logger().Errorf("%s", logmsg)
+	}
+}
+
+// reject ends the session like abort when the client may not start it, which is not a failure of the server and is logged at the info level.
+func (cs *ContainerSession) reject(event string, detail string, su StatusUpdate, logmsg string) {
+	if cs.fail(event, detail, su) {
+		cs.logger().Printf("%s", logmsg)
+	}
+}
+
+// fail reports the first failure of the session, returning false if a failure has been reported already.
+func (cs *ContainerSession) fail(event string, detail string, su StatusUpdate) bool {
+	if !cs.setState(stateError) {
+		return false
+	}
+	cs.Events.Record(event, detail)
+	cs.UpdateStatus(su)
+	cs.notifyError(su)
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+// statusConn is a client connection recording the status updates sent to it.
+type statusConn struct {
+	*runConn
+	statuses []StatusUpdate
+}
+
+func (sc *statusConn) WriteJSON(v interface{}) error {
+	if su, ok := v.(StatusUpdate); ok {
+		sc.statuses = append(sc.statuses, su)
+	}
+	return nil
+}
+
+func TestSessionState(t *testing.T) {
+	conn := &statusConn{runConn: newRunConn(nil)}
+	cs := &ContainerSession{ID: "s1", Client: conn, Config: &ContainerSessionConfig{}}
+	if cs.State() != stateStarting {
+		t.Fatalf("expected starting, got %s", cs.State())
+	}
+
+	// states only move forward
+	if !cs.setState(stateReady) || !cs.setState(stateRunning) {
+		t.Fatal("expected forward transitions to succeed")
+	}
+	if cs.setState(stateReady) {
+		t.Error("expected backward transition to fail")
+	}
+
+	// only the first failure is reported, and the session stays in error when closed
+	cs.abort("error", "boom", StatusUpdate{Status: "error", Error: "boom"}, "")
+	cs.abort("error", "again", StatusUpdate{Status: "error", Error: "again"}, "")
+	if cs.State() != stateError {
+		t.Errorf("expected error, got %s", cs.State())
+	}
+	if cs.setState(stateClosed) {
+		t.Error("expected ended session to stay in error")
+	}
+	if len(conn.statuses) != 1 || conn.statuses[0].Error != "boom" || conn.statuses[0].Session != "s1" {
+		t.Errorf("unexpected statuses %+v", conn.statuses)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/filters"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// labelWorkspace is the label identifying the volumes of shared workspaces.
+const labelWorkspace = "openrepl.workspace"
+
+// errWorkspaceNotFound is returned when a session refers to a shared workspace which does not exist or has expired.
+var errWorkspaceNotFound = errors.New("workspace not found or expired")
+
+// errTooManyWorkspaces is returned when the maximum number of shared workspaces is reached.
+var errTooManyWorkspaces = errors.New("too many workspaces")
+
+// sharedWorkspace is a volume mounted as the working directory of every session using its token.
+// Files written in a terminal are thereby available to runs of the same workspace, and the other way around.
+type sharedWorkspace struct {
+	volume string
+
+	// principal is the authenticated client which created the workspace, and is the only one which may use it.
+	principal string
+
+	// users is the number of sessions using the workspace, and idle is the time at which the last of them ended.
+	users int
+	idle  time.Time
+}
+
+// WorkspaceStore keeps the shared workspaces of clients, removing them once they have been unused for TTL.
+// A nil WorkspaceStore has no workspaces.
+type WorkspaceStore struct {
+	// Client is the client of the Docker daemon on which the volumes are created.
+	Client *client.Client
+
+	// TTL is the time for which a workspace is kept after its last session ends.
+	TTL time.Duration
+
+	// Max is the maximum number of workspaces.
+	// If zero, the number of workspaces is unlimited.
+	Max int
+
+	// Size is the maximum number of bytes used by the files of a workspace.
+	// Sessions using a workspace are terminated once it grows beyond Size, which is checked periodically.
+	Size int64
+
+	// Instance is the ID of the server instance, with which volumes are labeled so that orphaned volumes can be removed.
+	Instance string
+
+	lck        sync.Mutex
+	workspaces map[string]*sharedWorkspace
+
+	// pending is the number of workspaces whose volumes are being created.
+	pending int
+}
+
+// New creates a workspace for a principal, returning its token.
+func (st *WorkspaceStore) New(ctx context.Context, principal string, now time.Time) (string, error) {
+	token, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	// reserve a slot while the volume is created, so that concurrent requests cannot exceed Max
+	st.lck.Lock()
+	if st.Max > 0 && len(st.workspaces)+st.pending >= st.Max {
+		st.lck.Unlock()
+		return "", errTooManyWorkspaces
+	}
+	st.pending++
+	st.lck.Unlock()
+
+	// create a volume on the disk of the daemon, as a tmpfs would lose its files whenever no container has it mounted
+	// the size of the volume is instead enforced by the sessions using it
+	vol, err := st.Client.VolumeCreate(ctx, volumetypes.VolumesCreateBody{
+		Name:   "openrepl-workspace-" + token,
+		Driver: "local",
+		Labels: map[string]string{labelWorkspace: "true", labelServer: st.Instance},
+	})
+
+	st.lck.Lock()
+	defer st.lck.Unlock()
+	st.pending--
+	if err != nil {
+		return "", err
+	}
+	if st.workspaces == nil {
+		st.workspaces = make(map[string]*sharedWorkspace)
+	}
+	st.workspaces[token] = &sharedWorkspace{volume: vol.Name, principal: principal, idle: now}
+	return token, nil
+}
+
+// Volume returns the name of the volume of a workspace, checking that the principal may use it.
+func (st *WorkspaceStore) Volume(token string, principal string) (string, error) {
+	if st == nil {
+		return "", errors.New("workspaces disabled")
+	}
+	st.lck.Lock()
+	defer st.lck.Unlock()
+	ws := st.workspaces[token]
+	if ws == nil || ws.principal != principal {
+		return "", errWorkspaceNotFound
+	}
+	return ws.volume, nil
+}
+
+// Acquire marks a workspace as used by a session until the returned function is called.
+func (st *WorkspaceStore) Acquire(token string) (release func()) {
+	if st == nil || token == "" {
+		return func() {}
+	}
+	st.lck.Lock()
+	defer st.lck.Unlock()
+	ws := st.workspaces[token]
+	if ws == nil {
+		return func() {}
+	}
+	ws.users++
+	return func() {
+		st.lck.Lock()
+		defer st.lck.Unlock()
+		ws.users--
+		ws.idle = time.Now()
+	}
+}
+
+// expired removes the workspaces which have been unused for TTL from the store, returning their volumes.
+func (st *WorkspaceStore) expired(now time.Time) []string {
+	st.lck.Lock()
+	defer st.lck.Unlock()
+	var vols []string
+	for token, ws := range st.workspaces {
+		if ws.users == 0 && now.Sub(ws.idle) >= st.TTL {
+			delete(st.workspaces, token)
+			vols = append(vols, ws.volume)
+		}
+	}
+	return vols
+}
+
+// Collect removes the volumes of expired workspaces.
+func (st *WorkspaceStore) Collect(ctx context.Context, now time.Time) {
+	for _, vol := range st.expired(now) {
+		err := st.Client.VolumeRemove(ctx, vol, true)
+		if err != nil {
+			serverLog.Errorf("failed to remove workspace volume %s: %s", vol, err.Error())
+		}
+	}
+}
+
+// Run periodically removes expired workspaces.
+func (st *WorkspaceStore) Run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for now := range tick.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		st.Collect(ctx, now)
+		cancel()
+	}
+}
+
+// RemoveOrphans removes the workspace volumes left behind by a previous run of this instance.
+func (st *WorkspaceStore) RemoveOrphans(ctx context.Context) error {
+	args := filters.NewArgs()
+	args.Add("label", labelWorkspace)
+	args.Add("label", labelServer+"="+st.Instance)
+	vols, err := st.Client.VolumeList(ctx, args)
+	if err != nil {
+		return err
+	}
+	for _, vol := range vols.Volumes {
+		err := st.Client.VolumeRemove(ctx, vol.Name, true)
+		if err != nil {
+			serverLog.Errorf("failed to remove orphaned workspace volume %s: %s", vol.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Clear removes all workspaces.
+func (st *WorkspaceStore) Clear(ctx context.Context) {
+	if st == nil {
+		return
+	}
+	st.lck.Lock()
+	workspaces := st.workspaces
+	st.workspaces = nil
+	st.lck.Unlock()
+	for _, ws := range workspaces {
+		err := st.Client.VolumeRemove(ctx, ws.volume, true)
+		if err != nil {
+			serverLog.Errorf("failed to remove workspace volume %s: %s", ws.volume, err.Error())
+		}
+	}
+}
+
+// Len returns the number of workspaces.
+func (st *WorkspaceStore) Len() int {
+	st.lck.Lock()
+	defer st.lck.Unlock()
+	return len(st.workspaces)
+}
+
+// WorkspaceInfo is the response to creating a shared workspace.
+type WorkspaceInfo struct {
+	// Workspace is the token passed in the workspace query parameter of terminals and runs sharing the workspace.
+	Workspace string `json:"workspace"`
+
+	// TTL is the number of seconds for which the workspace is kept after its last session ends.
+	TTL float64 `json:"ttl"`
+}
+
+// HandleWorkspace creates a shared workspace, whose files are kept across the terminals and runs using its token.
+func (cs *ContainerServer) HandleWorkspace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	st := cs.SessionConfig.Workspaces
+	if st == nil {
+		http.Error(w, "workspaces disabled", http.StatusNotFound)
+		return
+	}
+	p, _ := requestPrincipal(r)
+	token, err := st.New(r.Context(), p.ID, time.Now())
+	switch {
+	case err == errTooManyWorkspaces:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		serverLog.Errorf("failed to create workspace: %s", err.Error())
+		http.Error(w, "failed to create workspace", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WorkspaceInfo{Workspace: token, TTL: st.TTL.Seconds()})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWorkspaceStoreExpiry(t *testing.T) {
+	now := time.Now()
+	st := &WorkspaceStore{TTL: time.Minute}
+	st.workspaces = map[string]*sharedWorkspace{
+		"tok": {volume: "openrepl-workspace-tok", principal: "alice", idle: now},
+	}
+
+	if _, err := st.Volume("tok", "bob"); err != errWorkspaceNotFound {
+		t.Errorf("expected other principal to be rejected, got %v", err)
+	}
+	vol, err := st.Volume("tok", "alice")
+	if err != nil || vol != "openrepl-workspace-tok" {
+		t.Fatalf("unexpected volume %q (%v)", vol, err)
+	}
+
+	// workspaces in use do not expire
+	release := st.Acquire("tok")
+	if vols := st.expired(now.Add(time.Hour)); len(vols) != 0 {
+		t.Errorf("expected workspace in use to be kept, got %v", vols)
+	}
+	release()
+	if vols := st.expired(time.Now().Add(30 * time.Second)); len(vols) != 0 {
+		t.Errorf("expected recently used workspace to be kept, got %v", vols)
+	}
+	if vols := st.expired(time.Now().Add(2 * time.Minute)); len(vols) != 1 || vols[0] != "openrepl-workspace-tok" {
+		t.Errorf("expected idle workspace to expire, got %v", vols)
+	}
+	if _, err := st.Volume("tok", "alice"); err != errWorkspaceNotFound {
+		t.Errorf("expected expired workspace to be gone, got %v", err)
+	}
+}
+
+func TestWorkspaceStoreMax(t *testing.T) {
+	st := &WorkspaceStore{Max: 2}
+	st.workspaces = map[string]*sharedWorkspace{
+		"tok": {volume: "openrepl-workspace-tok", principal: "alice", idle: time.Now()},
+	}
+
+	// workspaces whose volumes are being created count towards the maximum
+	st.pending = 1
+	if _, err := st.New(context.Background(), "bob", time.Now()); err != errTooManyWorkspaces {
+		t.Errorf("expected %v with a pending workspace, got %v", errTooManyWorkspaces, err)
+	}
+}
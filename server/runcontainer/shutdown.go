@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Shutdown drains the server before it exits.
+// New sessions are rejected and connected clients are notified, after which the server waits up to the timeout for sessions to end.
+// Sessions remaining after the timeout are terminated, and their containers and those of outstanding claims are removed.
+// Finally, the queued webhook events are delivered.
+func (cs *ContainerServer) Shutdown(timeout time.Duration) {
+	cs.setDraining(true)
+	sessions := cs.SessionConfig.Sessions.List()
+	serverLog.Printf("shutting down: draining %d sessions", len(sessions))
+
+	// notify clients
+	msg := fmt.Sprintf("server is shutting down; the session will be closed in %v", timeout)
+	for _, sess := range sessions {
+		sess.Events.Record("shutdown", msg)
+		sess.UpdateStatus(StatusUpdate{Status: "shutdown", Message: msg, Code: codeShutdown})
+	}
+
+	// wait for sessions to end
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cs.waitIdle(ctx)
+
+	// terminate remaining sessions
+	var wg sync.WaitGroup
+	for _, sess := range cs.SessionConfig.Sessions.List() {
+		wg.Add(1)
+		go func(sess *ContainerSession) {
+			defer wg.Done()
+			sess.Terminate("server shut down")
+		}(sess)
+	}
+	cs.Claims.Clear()
+	wg.Wait()
+
+	// remove containers of sessions which were still being deployed
+	rctx, rcancel := context.WithTimeout(context.Background(), time.Minute)
+	defer rcancel()
+	err := cs.SessionConfig.Orphans.Collect(rctx, 0)
+	if err != nil {
+		serverLog.Errorf("failed to remove remaining containers: %s", err.Error())
+	}
+	cs.SessionConfig.Workspaces.Clear(rctx)
+	cs.SessionConfig.Webhooks.Flush(rctx)
+	err = cs.SessionConfig.Cluster.Leave(rctx)
+	if err != nil {
+		serverLog.Errorf("failed to leave cluster: %s", err.Error())
+	}
+	serverLog.Printf("shutdown complete")
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	cs := &ContainerServer{SessionConfig: ContainerSessionConfig{Sessions: &SessionRegistry{}}}
+	var conns []*recordConn
+	for _, id := range []string{"a", "b"} {
+		conn := &recordConn{}
+		conns = append(conns, conn)
+		cs.SessionConfig.Sessions.Add(&ContainerSession{ID: id, Client: conn, Config: &cs.SessionConfig, started: time.Now()})
+	}
+
+	cs.Shutdown(0)
+	if !cs.Draining() {
+		t.Error("server accepts new sessions after shutdown")
+	}
+	for i, conn := range conns {
+		if len(conn.updates) != 2 || conn.updates[0].Status != "shutdown" || conn.updates[0].Code != codeShutdown ||
+			conn.updates[1].Status != "terminated" || !conn.closed {
+			t.Errorf("session %d: unexpected updates %+v", i, conn.updates)
+		}
+	}
+	if n := len(cs.SessionConfig.Sessions.List()); n != 0 {
+		t.Errorf("%d sessions remain after shutdown", n)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errSSEClosed is returned when writing to a server-sent event stream after it has been closed.
+var errSSEClosed = errors.New("event stream closed")
+
+// sseConn is a ClientConn which streams the status updates and output of a run to an HTTP client as server-sent events.
+// Status updates are "status" events, and output is sent as "stdout" and "stderr" events whose data is a JSON string.
+type sseConn struct {
+	*runConn
+
+	// wlck serializes writes to the response, which must not be written once the connection is closed.
+	wlck   sync.Mutex
+	w      http.ResponseWriter
+	f      http.Flusher
+	closed bool
+}
+
+func newSSEConn(w http.ResponseWriter, f http.Flusher, code []byte) *sseConn {
+	return &sseConn{
+		runConn: newRunConn(code),
+		w:       w,
+		f:       f,
+	}
+}
+
+// write writes a raw chunk of the event stream and flushes it to the client.
+func (sc *sseConn) write(dat []byte) error {
+	sc.wlck.Lock()
+	defer sc.wlck.Unlock()
+	if sc.closed {
+		return errSSEClosed
+	}
+	_, err := sc.w.Write(dat)
+	if err != nil {
+		return err
+	}
+	sc.f.Flush()
+	return nil
+}
+
+// event sends an event with JSON-encoded data.
+func (sc *sseConn) event(name string, v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return sc.write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, dat)))
+}
+
+// output sends a chunk of output of a stream.
+func (sc *sseConn) output(stream string, dat []byte) error {
+	if stream == "" {
+		stream = "stdout"
+	}
+	return sc.event(stream, string(dat))
+}
+
+func (sc *sseConn) WriteJSON(v interface{}) error {
+	switch v := v.(type) {
+	case OutputEvent:
+		return sc.output(v.Stream, v.Data)
+	case StatusUpdate:
+		return sc.event("status", v)
+	default:
+		return sc.event("message", v)
+	}
+}
+
+// WriteMessage sends raw output, and ends the stream on the close message.
+func (sc *sseConn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case websocket.TextMessage, websocket.BinaryMessage:
+		return sc.output("", data)
+	case websocket.CloseMessage:
+		sc.Close()
+	}
+	return nil
+}
+
+// WriteControl sends pings as comments, which keep proxies from closing the idle stream.
+func (sc *sseConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.PingMessage {
+		err := sc.write([]byte(": ping\n\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return sc.runConn.WriteControl(messageType, data, deadline)
+}
+
+// Close ends the stream, waiting for a write in progress to finish.
+func (sc *sseConn) Close() error {
+	sc.wlck.Lock()
+	sc.closed = true
+	sc.wlck.Unlock()
+	return sc.runConn.Close()
+}
+
+// serveSSERun runs a session for an HTTP run request, streaming its status updates and output as server-sent events.
+func serveSSERun(w http.ResponseWriter, r *http.Request, req *RunRequest, cc ContainerConfig, opts SessionOptions, sc *ContainerSessionConfig) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	// stop the session if the client goes away
+	conn := newSSEConn(w, f, []byte(req.Code))
+	defer conn.Close()
+	ctx := r.Context()
+	stopch := make(chan struct{})
+	defer close(stopch)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopch:
+		}
+	}()
+	serveContainerSession(conn, r.RemoteAddr, r.Header.Get(tenantHeader), defaultSubprotocol, true, cc, opts, sc)
+}
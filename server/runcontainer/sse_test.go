@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSSEConn(t *testing.T) {
+	w := httptest.NewRecorder()
+	conn := newSSEConn(w, w, []byte("code"))
+	conn.WriteJSON(StatusUpdate{Status: "running"})
+	conn.WriteJSON(OutputEvent{Stream: "stderr", Data: []byte("oops\n")})
+	conn.WriteMessage(websocket.TextMessage, []byte("hi"))
+	conn.WriteControl(websocket.PingMessage, nil, time.Now())
+	conn.WriteMessage(websocket.CloseMessage, nil)
+
+	// writes after the stream ended are rejected
+	if err := conn.WriteJSON(StatusUpdate{Status: "late"}); err != errSSEClosed {
+		t.Errorf("expected errSSEClosed but got %v", err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Errorf("expected code but got %v", err)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("expected read to fail after close")
+	}
+
+	expect := "event: status\ndata: {\"status\":\"running\"}\n\n" +
+		"event: stderr\ndata: \"oops\\n\"\n\n" +
+		"event: stdout\ndata: \"hi\"\n\n" +
+		": ping\n\n"
+	if got := w.Body.String(); got != expect {
+		t.Errorf("expected %q but got %q", expect, got)
+	}
+	if !w.Flushed {
+		t.Error("events were not flushed")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// StatsdSink is a MetricSink which sends observations to a StatsD server (e.g. the Datadog agent or Telegraf).
+// Labels are sent as DogStatsD tags.
+type StatsdSink struct {
+	// Prefix is prepended to all metric names (e.g. "openrepl.").
+	Prefix string
+
+	conn net.Conn
+}
+
+// NewStatsdSink creates a StatsdSink sending UDP packets to addr.
+func NewStatsdSink(addr string, prefix string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdSink{
+		Prefix: prefix,
+		conn:   conn,
+	}, nil
+}
+
+// statsdEscaper removes characters with special meaning in the StatsD protocol.
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_", "\n", "_")
+
+// Observe sends an observation as a histogram sample.
+func (ss *StatsdSink) Observe(name string, labels []string, values []string, v float64) {
+	ss.send(name, "h", labels, values, v)
+}
+
+// SetGauge sends the value of a gauge.
+func (ss *StatsdSink) SetGauge(name string, labels []string, values []string, v float64) {
+	ss.send(name, "g", labels, values, v)
+}
+
+// AddCounter sends a counter increment.
+func (ss *StatsdSink) AddCounter(name string, labels []string, values []string, v float64) {
+	ss.send(name, "c", labels, values, v)
+}
+
+// send sends a value of the given StatsD type.
+// Send errors are ignored, as StatsD delivery is best-effort.
+func (ss *StatsdSink) send(name string, typ string, labels []string, values []string, v float64) {
+	var buf bytes.Buffer
+	buf.WriteString(ss.Prefix)
+	buf.WriteString(name)
+	buf.WriteByte(':')
+	buf.WriteString(formatFloat(v))
+	buf.WriteByte('|')
+	buf.WriteString(typ)
+	for i, l := range labels {
+		if i >= len(values) {
+			break
+		}
+		if i == 0 {
+			buf.WriteString("|#")
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(l)
+		buf.WriteByte(':')
+		buf.WriteString(statsdEscaper.Replace(values[i]))
+	}
+	ss.conn.Write(buf.Bytes())
+}
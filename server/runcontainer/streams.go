@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// streamWriter sends the output of one stream of the program to the client.
+type streamWriter struct {
+	cs     *ContainerSession
+	stream string
+}
+
+func (sw streamWriter) Write(dat []byte) (int, error) {
+	err := sw.cs.writeStream(sw.stream, dat)
+	if err != nil {
+		return 0, err
+	}
+	return len(dat), nil
+}
+
+// runStreams demultiplexes the output of a container running without a terminal, sending each stream to the client separately.
+// Returns io.EOF once the program closes its output.
+func (cs *ContainerSession) runStreams() error {
+	_, err := stdcopy.StdCopy(streamWriter{cs, "stdout"}, streamWriter{cs, "stderr"}, cs.Container)
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// withoutTTY returns a copy of the ContainerConfig which runs without a terminal, so that stdout and stderr are kept apart.
+func (cc ContainerConfig) withoutTTY() ContainerConfig {
+	cc.noTTY = true
+	return cc
+}
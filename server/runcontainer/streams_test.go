@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+func TestRunStreams(t *testing.T) {
+	// multiplex output as the daemon does without a terminal
+	var buf bytes.Buffer
+	stdcopy.NewStdWriter(&buf, stdcopy.Stdout).Write([]byte("hello\n"))
+	stdcopy.NewStdWriter(&buf, stdcopy.Stderr).Write([]byte("oops\n"))
+	stdcopy.NewStdWriter(&buf, stdcopy.Stdout).Write([]byte("bye\n"))
+
+	pc := newPollConn("test")
+	cs := &ContainerSession{
+		Client:          pc,
+		Config:          &ContainerSessionConfig{},
+		Container:       &Container{IO: readCloser{&buf}},
+		ContainerConfig: ContainerConfig{}.withoutTTY(),
+	}
+	err := cs.runStreams()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF but got %v", err)
+	}
+
+	var got []OutputEvent
+	for _, msg := range pc.out {
+		var ev OutputEvent
+		err := json.Unmarshal(msg.Data, &ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ev)
+	}
+	expect := []struct{ stream, data string }{{"stdout", "hello\n"}, {"stderr", "oops\n"}, {"stdout", "bye\n"}}
+	if len(got) != len(expect) {
+		t.Fatalf("expected %d events but got %d", len(expect), len(got))
+	}
+	for i, e := range expect {
+		if got[i].Stream != e.stream || string(got[i].Data) != e.data {
+			t.Errorf("event %d: expected %s %q but got %s %q", i, e.stream, e.data, got[i].Stream, got[i].Data)
+		}
+	}
+}
+
+// readCloser is a ReadWriteCloser over a reader, which discards writes.
+type readCloser struct {
+	io.Reader
+}
+
+func (readCloser) Write(dat []byte) (int, error) { return ioutil.Discard.Write(dat) }
+func (readCloser) Close() error                  { return nil }
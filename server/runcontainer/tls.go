@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a TLS certificate from files, reloading it when the files change.
+// This lets certificates renewed by an external ACME client (e.g. certbot or cert-manager) be picked up without a restart.
+type CertReloader struct {
+	// CertFile and KeyFile are the paths of the PEM-encoded certificate chain and private key.
+	CertFile string
+	KeyFile  string
+
+	lck     sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads a certificate, failing if it is invalid.
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	_, err := cr.GetCertificate(nil)
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate.
+// If the files changed but cannot be loaded (e.g. while only one of them has been replaced), the previous certificate is kept.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lck.Lock()
+	defer cr.lck.Unlock()
+	mod, err := cr.latestModTime()
+	if err != nil && cr.cert == nil {
+		return nil, err
+	}
+	if err == nil && mod.After(cr.modTime) {
+		cert, lerr := tls.LoadX509KeyPair(cr.CertFile, cr.KeyFile)
+		if lerr != nil && cr.cert == nil {
+			return nil, lerr
+		}
+		if lerr == nil {
+			cr.cert, cr.modTime = &cert, mod
+		}
+	}
+	return cr.cert, nil
+}
+
+// latestModTime returns the time at which the certificate or key was last modified.
+func (cr *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.CertFile, cr.KeyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// tlsConfig returns the TLS configuration of the server.
+// HTTP/2 is enabled by net/http when serving TLS, while websockets are upgraded over HTTP/1.1.
+func (cr *CertReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+}
+
+// acmeChallengePath is the path prefix of ACME HTTP-01 challenges.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// redirectHandler serves the plain HTTP listener of a TLS server, redirecting requests to HTTPS on the given port.
+// If webroot is not empty, ACME HTTP-01 challenges are served from the files placed in webroot by an external ACME client.
+func redirectHandler(webroot string, port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if webroot != "" && strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+			if token == "" || strings.ContainsAny(token, "/\\") || strings.HasPrefix(token, ".") {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeFile(w, r, filepath.Join(webroot, filepath.FromSlash(acmeChallengePath), token))
+			return
+		}
+		host := r.Host
+		if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for the common name to the files.
+func writeTestCert(t *testing.T, certFile string, keyFile string, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	writeTestCert(t, certFile, keyFile, "old")
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err.Error())
+	}
+	commonName := func() string {
+		cert, err := cr.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("failed to get certificate: %s", err.Error())
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	// a half-written renewal keeps the old certificate
+	later := time.Now().Add(time.Minute)
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	os.Chtimes(keyFile, later, later)
+	if cn := commonName(); cn != "old" {
+		t.Errorf("expected old certificate but got %s", cn)
+	}
+
+	// a complete renewal is picked up
+	writeTestCert(t, certFile, keyFile, "new")
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if cn := commonName(); cn != "new" {
+		t.Errorf("expected renewed certificate but got %s", cn)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, ".well-known", "acme-challenge"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".well-known", "acme-challenge", "tok"), []byte("tok.thumb"), 0644)
+
+	tbl := []struct {
+		port     string
+		url      string
+		status   int
+		location string
+	}{
+		{"443", "http://repl.example.com/term?lang=go", http.StatusMovedPermanently, "https://repl.example.com/term?lang=go"},
+		{"8443", "http://repl.example.com:8080/run", http.StatusMovedPermanently, "https://repl.example.com:8443/run"},
+		{"443", "http://repl.example.com/.well-known/acme-challenge/tok", http.StatusOK, ""},
+		{"443", "http://repl.example.com/.well-known/acme-challenge/..%2f..%2fetc", http.StatusNotFound, ""},
+	}
+	for _, v := range tbl {
+		w := httptest.NewRecorder()
+		redirectHandler(dir, v.port).ServeHTTP(w, httptest.NewRequest(http.MethodGet, v.url, nil))
+		if w.Code != v.status || w.Header().Get("Location") != v.location {
+			t.Errorf("%s: expected %d %q but got %d %q", v.url, v.status, v.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxQueuedSpans is the maximum number of ended spans waiting to be exported, beyond which spans are dropped.
+const maxQueuedSpans = 4096
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// OTLP status code of failed spans
+const spanStatusError = 2
+
+// droppedSpans counts spans which were dropped because the export queue was full or the export failed.
+var droppedSpans = &Counter{
+	Name: "openrepl_trace_spans_dropped_total",
+	Help: "Number of trace spans which could not be exported.",
+}
+
+func init() {
+	metrics.Register(droppedSpans)
+}
+
+// Tracer records trace spans of the session lifecycle, and exports them in batches to an OpenTelemetry collector over OTLP/HTTP with JSON encoding.
+// A nil Tracer records nothing.
+type Tracer struct {
+	// Endpoint is the URL to which spans are posted (e.g. "http://localhost:4318/v1/traces").
+	Endpoint string
+
+	// Headers are sent with every export request (e.g. for authenticating with the collector).
+	Headers map[string]string
+
+	// Service is the service.name resource attribute of the spans.
+	Service string
+
+	Client *http.Client
+
+	lck   sync.Mutex
+	queue []*Span
+}
+
+// Span is an operation in a trace.
+// A nil Span records nothing, so that code may be instrumented whether or not tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	lck   sync.Mutex
+	end   time.Time
+	attrs []spanAttribute
+	err   string
+	ended bool
+}
+
+// spanAttribute is an attribute of a span, whose value is a string, an int64 or a bool.
+type spanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// newSpanID generates a random span or trace ID.
+// Errors are ignored, as sessions cannot start without randomness anyway.
+func newSpanID(id []byte) {
+	rand.Read(id)
+}
+
+// parseTraceparent parses a W3C traceparent header (e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01").
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+// StartRequest starts the server span of a request, continuing the trace of its traceparent header if it has one.
+func (t *Tracer) StartRequest(r *http.Request, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: spanKindServer, start: time.Now()}
+	var ok bool
+	s.traceID, s.parentID, ok = parseTraceparent(r.Header.Get("traceparent"))
+	if !ok {
+		newSpanID(s.traceID[:])
+	}
+	newSpanID(s.spanID[:])
+	s.SetAttribute("http.target", r.URL.Path)
+	return s
+}
+
+// Child starts a span of an operation within the span.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{
+		tracer:   s.tracer,
+		traceID:  s.traceID,
+		parentID: s.spanID,
+		name:     name,
+		kind:     spanKindInternal,
+		start:    time.Now(),
+	}
+	newSpanID(c.spanID[:])
+	return c
+}
+
+// Record records a child span of an operation which started at start and has just ended with err.
+func (s *Span) Record(name string, start time.Time, err error) {
+	c := s.Child(name)
+	if c == nil {
+		return
+	}
+	c.start = start
+	c.SetError(err)
+	c.End()
+}
+
+// SetAttribute sets an attribute of the span, whose value is a string, an int64, an int or a bool.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if i, ok := value.(int); ok {
+		value = int64(i)
+	}
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if s.ended {
+		return
+	}
+	for i := range s.attrs {
+		if s.attrs[i].Key == key {
+			s.attrs[i].Value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, spanAttribute{key, value})
+}
+
+// SetError marks the span as failed with an error, if it is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if !s.ended {
+		s.err = err.Error()
+	}
+}
+
+// End ends the span, queueing it for export.
+// Spans may only be ended once, and are not changed afterwards.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lck.Lock()
+	if s.ended {
+		s.lck.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.lck.Unlock()
+
+	t := s.tracer
+	t.lck.Lock()
+	defer t.lck.Unlock()
+	if len(t.queue) >= maxQueuedSpans {
+		droppedSpans.Add(1)
+		return
+	}
+	t.queue = append(t.queue, s)
+}
+
+// spanKey is the context key of the current span.
+type spanKey struct{}
+
+// withSpan returns a context carrying a span, so that functions called with it can record child spans.
+func withSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// spanFromContext returns the span of a context, or nil if it has none.
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// otlpSpan is the OTLP JSON encoding of a span.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpAttributeOf encodes an attribute, formatting values of unknown types as strings.
+func otlpAttributeOf(a spanAttribute) otlpAttribute {
+	var v otlpValue
+	switch val := a.Value.(type) {
+	case string:
+		v.StringValue = &val
+	case int64:
+		s := strconv.FormatInt(val, 10)
+		v.IntValue = &s
+	case bool:
+		v.BoolValue = &val
+	default:
+		s := fmt.Sprint(val)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: a.Key, Value: v}
+}
+
+// encode encodes the span in OTLP JSON.
+func (s *Span) encode() otlpSpan {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	enc := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		enc.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, a := range s.attrs {
+		enc.Attributes = append(enc.Attributes, otlpAttributeOf(a))
+	}
+	if s.err != "" {
+		enc.Status = &otlpStatus{Code: spanStatusError, Message: s.err}
+	}
+	return enc
+}
+
+// payload generates the OTLP export request of a batch of spans.
+func (t *Tracer) payload(spans []*Span) ([]byte, error) {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		encoded[i] = s.encode()
+	}
+	service := t.Service
+	if service == "" {
+		service = "openrepl"
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{
+					otlpAttributeOf(spanAttribute{"service.name", service}),
+					otlpAttributeOf(spanAttribute{"service.version", version}),
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "openrepl"},
+				"spans": encoded,
+			}},
+		}},
+	})
+}
+
+// Flush exports the queued spans.
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.lck.Lock()
+	spans := t.queue
+	t.queue = nil
+	t.lck.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	err := t.export(ctx, spans)
+	if err != nil {
+		droppedSpans.Add(float64(len(spans)))
+	}
+	return err
+}
+
+// export posts a batch of spans to the collector.
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	dat, err := t.payload(spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.Endpoint, bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	cli := t.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	resp, err := cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.New("trace collector returned " + resp.Status)
+	}
+	return nil
+}
+
+// Run periodically exports the queued spans.
+func (t *Tracer) Run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := t.Flush(ctx)
+		cancel()
+		if err != nil {
+			serverLog.Errorf("failed to export trace spans: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tbl := []struct {
+		header string
+		ok     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false},
+		{"", false},
+	}
+	for _, tt := range tbl {
+		traceID, parentID, ok := parseTraceparent(tt.header)
+		if ok != tt.ok {
+			t.Errorf("%q: expected ok=%v", tt.header, tt.ok)
+			continue
+		}
+		if ok && (hex.EncodeToString(traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(parentID[:]) != "00f067aa0ba902b7") {
+			t.Errorf("%q: unexpected IDs %x %x", tt.header, traceID, parentID)
+		}
+	}
+}
+
+func TestNilSpan(t *testing.T) {
+	var tr *Tracer
+	s := tr.StartRequest(httptest.NewRequest(http.MethodGet, "/run", nil), "HandleRun")
+	s.SetAttribute("k", "v")
+	s.SetError(errors.New("failed"))
+	s.Child("deploy").End()
+	s.Record("create", time.Now(), nil)
+	s.End()
+	if spanFromContext(withSpan(context.Background(), s)) != nil {
+		t.Error("expected no span in context")
+	}
+	if err := tr.Flush(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+	var header string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Api-Key")
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Errorf("invalid export request: %s", err.Error())
+		}
+	}))
+	defer collector.Close()
+	tr := &Tracer{Endpoint: collector.URL, Headers: map[string]string{"Api-Key": "secret"}}
+
+	// continue the trace of the client
+	r := httptest.NewRequest(http.MethodGet, "/run", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	root := tr.StartRequest(r, "HandleRun")
+	root.SetAttribute("openrepl.language", "python3")
+	deploy := root.Child("deploy")
+	spanFromContext(withSpan(context.Background(), deploy)).Record("create", time.Now(), errors.New("no such image"))
+	deploy.SetAttribute("openrepl.deploy.attempt", 0)
+	deploy.End()
+	root.End()
+	root.SetAttribute("ignored", true)
+
+	err := tr.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("export failed: %s", err.Error())
+	}
+	if header != "secret" {
+		t.Errorf("expected collector header but got %q", header)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected export request %+v", got)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans but got %d", len(spans))
+	}
+	create, dspan, rspan := spans[0], spans[1], spans[2]
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s has trace %s", s.Name, s.TraceID)
+		}
+	}
+	if rspan.Name != "HandleRun" || rspan.Kind != spanKindServer || rspan.ParentSpanID != "00f067aa0ba902b7" || len(rspan.Attributes) != 2 {
+		t.Errorf("unexpected root span %+v", rspan)
+	}
+	if dspan.ParentSpanID != rspan.SpanID || create.ParentSpanID != dspan.SpanID {
+		t.Errorf("unexpected span tree %s <- %s <- %s", rspan.SpanID, dspan.ParentSpanID, create.ParentSpanID)
+	}
+	if create.Status == nil || create.Status.Code != spanStatusError || create.Status.Message != "no such image" {
+		t.Errorf("unexpected status %+v", create.Status)
+	}
+	if a := dspan.Attributes[0]; a.Key != "openrepl.deploy.attempt" || a.Value.IntValue == nil || *a.Value.IntValue != "0" {
+		t.Errorf("unexpected attribute %+v", a)
+	}
+
+	// the queue is empty after a flush
+	tr.lck.Lock()
+	n := len(tr.queue)
+	tr.lck.Unlock()
+	if n != 0 {
+		t.Errorf("expected empty queue but got %d spans", n)
+	}
+}
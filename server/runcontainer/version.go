@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// Build information, which is set at link time (e.g. -ldflags "-X main.version=1.2.0").
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+// protocolVersion is the version of the websocket session protocol.
+// It is incremented whenever a change to the protocol would break existing clients.
+const protocolVersion = 3
+
+// subprotocols are the websocket subprotocols supported by the server, in order of preference.
+// In openrepl.v2, terminal input is sent in binary messages, and text messages are ControlMessages.
+// In openrepl.v3, all messages are Envelopes.
+var subprotocols = []string{protocolV3, "openrepl.v2", "openrepl.v1"}
+
+// defaultSubprotocol is the protocol spoken to clients which do not request a subprotocol.
+const defaultSubprotocol = "openrepl.v1"
+
+// negotiateSubprotocol selects the preferred protocol among those offered by a client.
+// Returns false if the client only offered unsupported protocols.
+func negotiateSubprotocol(offered []string) (string, bool) {
+	if len(offered) == 0 {
+		return defaultSubprotocol, true
+	}
+	for _, p := range subprotocols {
+		if inList(p, offered) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// VersionInfo is the build information of the server.
+type VersionInfo struct {
+	Version   string   `json:"version"`
+	GitCommit string   `json:"git_commit"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	Protocol  int      `json:"protocol"`
+	Protocols []string `json:"subprotocols"`
+	Features  []string `json:"features"`
+}
+
+// features returns the list of optional features enabled on the server.
+func (cs *ContainerServer) features() []string {
+	sc := &cs.SessionConfig
+	features := []string{}
+	if sc.Artifacts != nil {
+		features = append(features, "artifacts")
+	}
+	if sc.EventLogs != nil {
+		features = append(features, "events")
+	}
+	if sc.Alerts != nil {
+		features = append(features, "alerts")
+	}
+	if sc.Resources != nil {
+		features = append(features, "capacity")
+	}
+	if sc.DeploySlots != nil {
+		features = append(features, "queue")
+	}
+	if sc.Cgroups != nil {
+		features = append(features, "cgroup2")
+	}
+	if sc.Packages != nil {
+		features = append(features, "packages")
+	}
+	if sc.Tracer != nil {
+		features = append(features, "tracing")
+	}
+	if sc.Cluster != nil {
+		features = append(features, "cluster")
+	}
+	if sc.Backends["wasm"] != nil {
+		features = append(features, "wasm")
+	}
+	if sc.Backends["firecracker"] != nil {
+		features = append(features, "firecracker")
+	}
+	if sc.GPUs != nil {
+		features = append(features, "gpu")
+	}
+	if cs.MaxBenchmarkRuns > 0 {
+		features = append(features, "benchmark")
+	}
+	if cs.DeterministicTime != "" {
+		features = append(features, "deterministic")
+	}
+	if cs.AdminToken != "" {
+		features = append(features, "admin")
+	}
+	if cs.Exec != nil {
+		features = append(features, "grpc")
+	}
+	return features
+}
+
+// HandleVersion serves the build information of the server as JSON.
+func (cs *ContainerServer) HandleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VersionInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Protocol:  protocolVersion,
+		Protocols: subprotocols,
+		Features:  cs.features(),
+	})
+}
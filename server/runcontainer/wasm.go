@@ -0,0 +1,422 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+// errWasmExec is returned when a command is run in a wasm sandbox, which only runs the module of its language.
+var errWasmExec = errors.New("commands cannot be run in wasm sandboxes")
+
+// wasmDirPrefix is the prefix of the directories of wasm sandboxes, by which leftover directories are recognized.
+const wasmDirPrefix = "openrepl-wasm-"
+
+// WasmBackend runs the programs of languages compiled to WebAssembly as WASI modules with wasmtime, which start in milliseconds instead of deploying a container.
+//
+// Each session is a wasmtime process whose only preopened directory is a fresh sandbox directory mounted at "/", into which code is copied.
+// Modules have no network access, and are limited to the memory limit of their language, to Fuel, and to the size limit of their sandbox directory.
+// Programs run without a terminal, with their output streams combined, and cannot run further commands; session modes requiring Docker are unavailable.
+type WasmBackend struct {
+	// Command is the path of the wasmtime binary (14 or later).
+	Command string
+
+	// ModuleDir is the directory containing the modules of languages, which are typically extracted from their toolchain images.
+	ModuleDir string
+
+	// WorkDir is the directory in which the sandbox directories are created.
+	// If empty, the default temporary directory is used.
+	WorkDir string
+
+	// StopTimeout is the timeout for killing modules and removing their sandbox directories.
+	StopTimeout time.Duration
+
+	// Fuel is the amount of fuel, roughly the number of WebAssembly instructions, which a module may consume before it is trapped.
+	// If zero, modules are only bounded by the maximum run time of their language.
+	Fuel uint64
+
+	// DiskLimit is the maximum number of bytes of the files in a sandbox directory, unless the language sets a workspace size.
+	// Modules writing more are killed, which is checked periodically.
+	// If zero, and the language does not set a workspace size, the directory is unbounded.
+	DiskLimit int64
+
+	lck   sync.Mutex
+	procs map[string]*wasmProcess
+}
+
+// wasmProcess is the wasmtime process of a session.
+type wasmProcess struct {
+	root string
+	cmd  *exec.Cmd
+
+	// done is closed once the process has exited with code.
+	done chan struct{}
+	code int64
+}
+
+// wasmIO is the connection to a wasmtime process, whose output streams are combined.
+type wasmIO struct {
+	stdin io.WriteCloser
+	out   io.ReadCloser
+}
+
+func (w *wasmIO) Read(dat []byte) (int, error) {
+	return w.out.Read(dat)
+}
+
+func (w *wasmIO) Write(dat []byte) (int, error) {
+	return w.stdin.Write(dat)
+}
+
+// CloseWrite closes the input of the program.
+func (w *wasmIO) CloseWrite() error {
+	return w.stdin.Close()
+}
+
+func (w *wasmIO) Close() error {
+	w.stdin.Close()
+	return w.out.Close()
+}
+
+// process looks up the process of a container.
+func (b *WasmBackend) process(c *Container) (*wasmProcess, error) {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	p := b.procs[c.ID]
+	if p == nil {
+		return nil, errors.New("wasm sandbox not found")
+	}
+	return p, nil
+}
+
+// command generates the wasmtime command line of a program.
+func (b *WasmBackend) command(cc ContainerConfig, root string) []string {
+	args := []string{"run", "--dir=" + root + "::/", "-W", "max-memory-size=" + strconv.FormatInt(cc.memoryLimit(), 10)}
+	if b.Fuel > 0 {
+		args = append(args, "-W", "fuel="+strconv.FormatUint(b.Fuel, 10))
+	}
+	for _, env := range cc.Env {
+		args = append(args, "--env", env)
+	}
+	args = append(args, filepath.Join(b.ModuleDir, cc.WasmModule))
+	args = append(args, cc.Entrypoint...)
+	return append(args, cc.Command...)
+}
+
+// diskLimit returns the maximum size of the sandbox directory of a language, or 0 if it is unbounded.
+func (b *WasmBackend) diskLimit(cc ContainerConfig) int64 {
+	if size, err := units.RAMInBytes(cc.WorkspaceSize); cc.WorkspaceSize != "" && err == nil {
+		return size
+	}
+	return b.DiskLimit
+}
+
+// watchDisk kills the module of a sandbox once its directory grows beyond limit bytes, until the module exits.
+func (b *WasmBackend) watchDisk(session string, p *wasmProcess, limit int64) {
+	tick := time.NewTicker(workspaceCheckRate)
+	defer tick.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-tick.C:
+		}
+		size, err := dirSize(p.root)
+		if err != nil {
+			Logger{Session: session}.Errorf("failed to check size of wasm sandbox: %s", err.Error())
+			continue
+		}
+		if size > limit {
+			Logger{Session: session}.Printf("wasm sandbox exceeded size limit of %d bytes", limit)
+			p.cmd.Process.Kill()
+			return
+		}
+	}
+}
+
+// dirSize returns the total size of the regular files below a directory, without following symlinks.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Deploy creates the sandbox directory of the session, copies code in with prestart, and then starts the module.
+func (b *WasmBackend) Deploy(ctx context.Context, cc ContainerConfig, session string, prestart func(context.Context, *Container) error) (cont *Container, err error) {
+	// count failures which were not caused by the client going away
+	defer func() {
+		if err != nil && ctx.Err() != context.Canceled {
+			deployFailures.Add(1, cc.Language)
+		}
+	}()
+
+	if cc.WasmModule == "" {
+		return nil, errors.New("no wasm module configured")
+	}
+	_, err = os.Stat(filepath.Join(b.ModuleDir, cc.WasmModule))
+	if err != nil {
+		return nil, err
+	}
+
+	// create sandbox
+	t := time.Now()
+	root, err := ioutil.TempDir(b.WorkDir, wasmDirPrefix+session+"-")
+	if err != nil {
+		return nil, err
+	}
+	p := &wasmProcess{root: root, done: make(chan struct{})}
+	cont = &Container{
+		backend:      b,
+		ID:           filepath.Base(root),
+		closetimeout: b.StopTimeout,
+		lang:         cc.Language,
+		created:      t,
+		session:      session,
+	}
+	b.lck.Lock()
+	if b.procs == nil {
+		b.procs = make(map[string]*wasmProcess)
+	}
+	b.procs[cont.ID] = p
+	b.lck.Unlock()
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "create")
+	containersCreated.Add(1, cc.Language)
+
+	// cleanup sandbox on failed startup
+	defer func() {
+		if err != nil {
+			delctx, cancel := context.WithTimeout(context.Background(), b.StopTimeout)
+			defer cancel()
+			rerr := b.Remove(delctx, cont)
+			if rerr != nil {
+				Logger{Session: session}.Errorf("failed to remove wasm sandbox: %s", rerr.Error())
+			} else {
+				containersRemoved.Add(1, cc.Language)
+			}
+		}
+	}()
+
+	// run prestart hook
+	if prestart != nil {
+		err = prestart(ctx, cont)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// start the module
+	t = time.Now()
+	cmd := exec.Command(b.Command, b.command(cc, root)...)
+	cmd.Dir = root
+	cmd.Env = []string{}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, w, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = w, w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdin.Close()
+		out.Close()
+		return nil, err
+	}
+	p.cmd = cmd
+	go func() {
+		cmd.Wait()
+		if ws, ok := cmd.ProcessState.Sys().(interface {
+			ExitStatus() int
+		}); ok {
+			p.code = int64(ws.ExitStatus())
+		}
+		close(p.done)
+	}()
+	if limit := b.diskLimit(cc); limit > 0 {
+		go b.watchDisk(session, p, limit)
+	}
+	deployLatency.Observe(time.Since(t).Seconds(), cc.Language, "start")
+	cont.IO = &wasmIO{stdin: stdin, out: out}
+
+	containersRunning.Add(1, cc.Language)
+	return cont, nil
+}
+
+// Remove kills the module and removes the sandbox directory.
+func (b *WasmBackend) Remove(ctx context.Context, c *Container) error {
+	b.lck.Lock()
+	p := b.procs[c.ID]
+	delete(b.procs, c.ID)
+	b.lck.Unlock()
+	if p == nil {
+		return nil
+	}
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return os.RemoveAll(p.root)
+}
+
+// CopyTo extracts the tarball into the sandbox directory.
+func (b *WasmBackend) CopyTo(ctx context.Context, c *Container, dir string, tr io.Reader) error {
+	p, err := b.process(c)
+	if err != nil {
+		return err
+	}
+	return extractTarball(filepath.Join(p.root, filepath.FromSlash(path.Clean("/"+dir))), tr)
+}
+
+// ExecInput is not supported, as sandboxes only run their module.
+func (b *WasmBackend) ExecInput(ctx context.Context, c *Container, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return 0, errWasmExec
+}
+
+// Wait waits for the module to exit.
+func (b *WasmBackend) Wait(ctx context.Context, c *Container) (int64, error) {
+	p, err := b.process(c)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-p.done:
+		return p.code, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Resize has no effect, as modules run without a terminal.
+func (b *WasmBackend) Resize(ctx context.Context, c *Container, cols uint, rows uint) error {
+	return nil
+}
+
+// Clean removes the sandbox directories left behind by a previous run of the server.
+func (b *WasmBackend) Clean() error {
+	dir := b.WorkDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, wasmDirPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		err = os.RemoveAll(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTarball extracts the regular files and directories of a tarball into a directory.
+// Entries escaping the directory, including through symlinks created by the program, are rejected.
+func extractTarball(dir string, r io.Reader) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" || strings.Contains(hdr.Name, "..") {
+			return errors.New("invalid file name " + hdr.Name)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		err = checkNoSymlinks(dir, dst)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dst, os.FileMode(hdr.Mode)&os.ModePerm|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = os.MkdirAll(filepath.Dir(dst), 0755)
+			if err == nil {
+				err = writeTarFile(dst, os.FileMode(hdr.Mode)&os.ModePerm, tr)
+			}
+		default:
+			err = errors.New("unsupported file type of " + hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkNoSymlinks checks that no existing component of a path below a directory is a symlink.
+func checkNoSymlinks(dir string, p string) error {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return err
+	}
+	cur := dir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return errors.New("refusing to write through symlink " + rel)
+		}
+	}
+	return nil
+}
+
+// writeTarFile writes a file of a tarball, replacing any previous file.
+func writeTarFile(dst string, mode os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeWasmtime is a stand-in for wasmtime, which prints its arguments and the code file of the sandbox and exits with status 3.
+const fakeWasmtime = `#!/bin/sh
+for a in "$@"; do
+	case "$a" in
+	--dir=*) root="${a#--dir=}"; root="${root%::/}" ;;
+	esac
+done
+echo "$@" | sed "s|$root|ROOT|"
+cat "$root/code"
+read line
+echo "input: $line" >&2
+exit 3
+`
+
+func TestWasmBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wasmtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "wasmtime")
+	if err := ioutil.WriteFile(bin, []byte(fakeWasmtime), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "lua.wasm"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &WasmBackend{Command: bin, ModuleDir: dir, WorkDir: dir, StopTimeout: time.Second}
+	cc := ContainerConfig{Language: "lua", WasmModule: "lua.wasm", Command: []string{"/code"}, Env: []string{"A=1"}, MemoryMB: 64}
+	prestart := func(ctx context.Context, c *Container) error {
+		tr := packTarball([]tarEntry{{&tar.Header{Name: "code", Mode: 0644, Size: 9}, []byte("print(1)\n")}})
+		defer tr.Close()
+		return c.backend.CopyTo(ctx, c, "/", tr)
+	}
+	c, err := b.Deploy(context.Background(), cc, "abc", prestart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(c.ID, wasmDirPrefix+"abc-") {
+		t.Errorf("unexpected container ID %q", c.ID)
+	}
+
+	c.IO.Write([]byte("hi\n"))
+	out, err := ioutil.ReadAll(c.IO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "run --dir=ROOT::/ -W max-memory-size=67108864 --env A=1 " + filepath.Join(dir, "lua.wasm") + " /code\nprint(1)\ninput: hi\n"
+	if string(out) != expect {
+		t.Errorf("expected output %q but got %q", expect, out)
+	}
+	code, err := b.Wait(context.Background(), c)
+	if code != 3 || err != nil {
+		t.Errorf("expected exit status 3, got %d (%v)", code, err)
+	}
+	if _, err := b.ExecInput(context.Background(), c, []string{"ls"}, nil, ioutil.Discard, ioutil.Discard); err != errWasmExec {
+		t.Errorf("expected errWasmExec, got %v", err)
+	}
+
+	// the sandbox is removed with the container
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, c.ID)); !os.IsNotExist(err) {
+		t.Errorf("expected sandbox to be removed, got %v", err)
+	}
+
+	// languages without a module are not deployed
+	if _, err := b.Deploy(context.Background(), ContainerConfig{Language: "lua", WasmModule: "missing.wasm"}, "def", nil); err == nil {
+		t.Error("expected error for missing module")
+	}
+
+	// leftover sandboxes are cleaned up
+	os.Mkdir(filepath.Join(dir, wasmDirPrefix+"old"), 0755)
+	if err := b.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, wasmDirPrefix+"*"))
+	if len(matches) != 0 {
+		t.Errorf("expected no sandboxes, got %v", matches)
+	}
+}
+
+func TestExtractTarball(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wasmtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := packTarball([]tarEntry{
+		{&tar.Header{Name: "lib/", Typeflag: tar.TypeDir, Mode: 0755}, nil},
+		{&tar.Header{Name: "./lib/a.lua", Mode: 0600, Size: 1}, []byte("a")},
+	})
+	if err := extractTarball(dir, tr); err != nil {
+		t.Fatal(err)
+	}
+	dat, err := ioutil.ReadFile(filepath.Join(dir, "lib", "a.lua"))
+	if err != nil || string(dat) != "a" {
+		t.Errorf("unexpected file %q (%v)", dat, err)
+	}
+
+	// files may not escape the directory
+	os.Symlink("/etc", filepath.Join(dir, "link"))
+	for _, name := range []string{"../escape", "link/passwd"} {
+		tr := packTarball([]tarEntry{{&tar.Header{Name: name, Mode: 0644, Size: 1}, []byte("x")}})
+		if err := extractTarball(dir, tr); err == nil {
+			t.Errorf("expected error extracting %s", name)
+		}
+		tr.Close()
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	sortedNames := []string{filepath.Join(dir, "lib"), filepath.Join(dir, "link")}
+	if !reflect.DeepEqual(names, sortedNames) {
+		t.Errorf("unexpected files %v", names)
+	}
+}
+
+func TestWasmLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wasmtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &WasmBackend{ModuleDir: "/modules", Fuel: 1000, DiskLimit: 1 << 20}
+	cc := ContainerConfig{WasmModule: "lua.wasm", MemoryMB: 64}
+	expect := []string{"run", "--dir=" + dir + "::/", "-W", "max-memory-size=67108864", "-W", "fuel=1000", "/modules/lua.wasm"}
+	if args := b.command(cc, dir); !reflect.DeepEqual(args, expect) {
+		t.Errorf("expected arguments %v, got %v", expect, args)
+	}
+
+	// the workspace size of the language overrides the default disk limit
+	if limit := b.diskLimit(cc); limit != 1<<20 {
+		t.Errorf("expected default disk limit, got %d", limit)
+	}
+	cc.WorkspaceSize = "2m"
+	if limit := b.diskLimit(cc); limit != 2<<20 {
+		t.Errorf("expected workspace size as disk limit, got %d", limit)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "lib"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "code"), make([]byte, 100), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "lib", "a"), make([]byte, 50), 0644)
+	os.Symlink("/etc/passwd", filepath.Join(dir, "link"))
+	if size, err := dirSize(dir); size != 150 || err != nil {
+		t.Errorf("expected size 150, got %d (%v)", size, err)
+	}
+}
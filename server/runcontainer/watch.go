@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+)
+
+// startWatchRun starts an execution of the program, sending its exit status to the client when it exits.
+func (cs *ContainerSession) startWatchRun(ctx context.Context) (*execRun, error) {
+	run, err := cs.startExec(ctx, cs.progArgv)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-run.done
+		if run.exited {
+			cs.Events.Record("exit", strconv.FormatInt(run.code, 10))
+			cs.UpdateStatus(StatusUpdate{Status: "exited", ExitCode: &run.code})
+		}
+	}()
+	return run, nil
+}
+
+// runWatch runs the session in watch mode until an error occurs, closing afterwards.
+// Binary messages from the client contain new code, which kills the current execution and starts a new one.
+// Text messages are sent as input to the current execution.
+func (cs *ContainerSession) runWatch(ctx context.Context) error {
+	errch := make(chan error, 2)
+	codech := make(chan []byte)
+	in := &execInput{}
+
+	// start ping-pong
+	cs.runPing(errch)
+
+	// read client messages
+	go cs.runExecInput(ctx, in, codech, errch)
+
+	// run initial code
+	run, err := cs.startWatchRun(ctx)
+	if err == nil {
+		in.set(run)
+	}
+
+	pending := 2
+loop:
+	for err == nil {
+		select {
+		case dat := <-codech:
+			cs.Events.Record("code_received", strconv.Itoa(len(dat))+" bytes")
+
+			// kill current execution
+			cs.stopExec(ctx, in.set(nil))
+
+			// replace code
+			err = cs.copyCode(ctx, cs.Container, dat)
+			if err != nil {
+				break
+			}
+
+			// start new execution
+			err = cs.UpdateStatus(StatusUpdate{Status: "restarting"})
+			if err != nil {
+				break
+			}
+			run, err = cs.startWatchRun(ctx)
+			if err != nil {
+				break
+			}
+			in.set(run)
+		case err = <-errch:
+			pending--
+			break loop
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+
+	// kill remaining execution and close session
+	cs.stopExec(context.Background(), in.set(nil))
+	cs.Close()
+
+	// ignore remaining errors
+	for ; pending > 0; pending-- {
+		<-errch
+	}
+
+	return err
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// webhookSignatureHeader is the header in which the HMAC-SHA256 signature of a webhook payload is sent, as "sha256=<hex>".
+const webhookSignatureHeader = "X-Openrepl-Signature"
+
+// webhookQueueSize is the number of webhook events which may wait to be delivered, beyond which events are dropped.
+const webhookQueueSize = 1024
+
+// webhookDeliveries counts the webhook events by outcome ("delivered", "failed" or "dropped").
+var webhookDeliveries = &Counter{
+	Name:   "openrepl_webhook_deliveries_total",
+	Help:   "Number of session lifecycle events posted to the webhook.",
+	Labels: []string{"event", "outcome"},
+}
+
+func init() {
+	metrics.Register(webhookDeliveries)
+}
+
+// WebhookEvent is the payload posted to the webhook for a session lifecycle event.
+type WebhookEvent struct {
+	// Event is the kind of event: "session_start", "session_end", "session_timeout" or "session_error".
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session"`
+	Language  string    `json:"language,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	ExitCode  *int64    `json:"exit_code,omitempty"`
+	// Duration is the run time of the session in seconds, set when it ends.
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Code     string  `json:"code,omitempty"`
+}
+
+// Webhooks posts session lifecycle events to a webhook.
+// Events are queued in memory and delivered in order by Run.
+// Failed deliveries are retried with exponential backoff in the background, so that they do not hold up later events, which may therefore arrive first.
+// A nil Webhooks discards all events.
+type Webhooks struct {
+	// URL is the URL of the webhook.
+	URL string
+
+	// Secret is the key with which payloads are signed.
+	// If empty, payloads are not signed.
+	Secret []byte
+
+	// Client is the HTTP client used to post events.
+	Client *http.Client
+
+	// Retries is the number of times a failed delivery is retried before the event is dropped.
+	Retries int
+
+	// Backoff is the delay before the first retry, which doubles with each retry.
+	Backoff time.Duration
+
+	queue chan WebhookEvent
+
+	// retrying limits the number of events whose deliveries are retried at once to the size of the queue.
+	retrying chan struct{}
+
+	// pending counts the events which are queued or being retried, and closed is set once Flush stops accepting events.
+	lck     sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+}
+
+// NewWebhooks creates a Webhooks posting to url, which queues up to size events.
+func NewWebhooks(url string, secret []byte, size int) *Webhooks {
+	return &Webhooks{
+		URL:      url,
+		Secret:   secret,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		Retries:  5,
+		Backoff:  time.Second,
+		queue:    make(chan WebhookEvent, size),
+		retrying: make(chan struct{}, size),
+	}
+}
+
+// Send queues an event for delivery, dropping it if the queue is full.
+func (wh *Webhooks) Send(ev WebhookEvent) {
+	if wh == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	wh.lck.Lock()
+	defer wh.lck.Unlock()
+	if wh.closed {
+		webhookDeliveries.Add(1, ev.Event, "dropped")
+		Logger{Session: ev.Session}.Errorf("webhooks flushed, dropping %s event", ev.Event)
+		return
+	}
+	wh.pending.Add(1)
+	select {
+	case wh.queue <- ev:
+	default:
+		wh.pending.Done()
+		webhookDeliveries.Add(1, ev.Event, "dropped")
+		Logger{Session: ev.Session}.Errorf("webhook queue full, dropping %s event", ev.Event)
+	}
+}
+
+// Run delivers queued events until the queue is closed.
+// Failed deliveries are retried in the background, and are dropped if too many events are being retried already.
+func (wh *Webhooks) Run() {
+	for ev := range wh.queue {
+		err := wh.post(ev)
+		if err == nil || wh.Retries <= 0 {
+			wh.done(ev, err)
+			continue
+		}
+		select {
+		case wh.retrying <- struct{}{}:
+			go func(ev WebhookEvent) {
+				wh.done(ev, wh.retry(ev))
+				<-wh.retrying
+			}(ev)
+		default:
+			wh.done(ev, err)
+		}
+	}
+}
+
+// retry retries the delivery of an event which failed to be delivered once.
+func (wh *Webhooks) retry(ev WebhookEvent) error {
+	var err error
+	for n := 1; n <= wh.Retries; n++ {
+		time.Sleep(wh.Backoff << uint(n-1))
+		err = wh.post(ev)
+		if err == nil {
+			break
+		}
+	}
+	return err
+}
+
+// done records the outcome of the delivery of an event.
+func (wh *Webhooks) done(ev WebhookEvent, err error) {
+	defer wh.pending.Done()
+	if err != nil {
+		webhookDeliveries.Add(1, ev.Event, "failed")
+		serverLog.Errorf("failed to deliver %s event of session %s to webhook: %s", ev.Event, ev.Session, err.Error())
+		return
+	}
+	webhookDeliveries.Add(1, ev.Event, "delivered")
+}
+
+// Flush stops accepting events and waits until the queued events have been delivered, or the context expires.
+// Run returns once the queue is empty.
+func (wh *Webhooks) Flush(ctx context.Context) {
+	if wh == nil {
+		return
+	}
+	wh.lck.Lock()
+	if !wh.closed {
+		wh.closed = true
+		close(wh.queue)
+	}
+	wh.lck.Unlock()
+
+	delivered := make(chan struct{})
+	go func() {
+		wh.pending.Wait()
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-ctx.Done():
+		serverLog.Errorf("failed to deliver webhook events before shutdown: %s", ctx.Err().Error())
+	}
+}
+
+// sign computes the signature header value of a payload.
+func (wh *Webhooks) sign(dat []byte) string {
+	mac := hmac.New(sha256.New, wh.Secret)
+	mac.Write(dat)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post posts a single event to the webhook.
+func (wh *Webhooks) post(ev WebhookEvent) error {
+	dat, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.Secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, wh.sign(dat))
+	}
+	resp, err := wh.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookEvent creates a webhook event of the session.
+func (cs *ContainerSession) webhookEvent(event string) WebhookEvent {
+	return WebhookEvent{
+		Event:     event,
+		Session:   cs.ID,
+		Language:  cs.ContainerConfig.Language,
+		Tenant:    cs.Tenant,
+		Principal: cs.Options.Principal,
+	}
+}
+
+// notifyStart notifies the webhook that the session started running.
+func (cs *ContainerSession) notifyStart() {
+	cs.Config.Webhooks.Send(cs.webhookEvent("session_start"))
+}
+
+// notifyEnd notifies the webhook that the session completed, with the exit code of the program if it is known.
+// Sessions which failed or timed out have already been reported.
+func (cs *ContainerSession) notifyEnd() {
+	if cs.Config.Webhooks == nil || cs.State() == stateError || atomic.LoadInt32(&cs.timedOut) != 0 {
+		return
+	}
+	ev := cs.webhookEvent("session_end")
+	ev.ExitCode = cs.exitCode
+	ev.Duration = time.Since(cs.runStarted).Seconds()
+	cs.Config.Webhooks.Send(ev)
+}
+
+// notifyTimeout notifies the webhook that the run was killed for exceeding its time limit.
+func (cs *ContainerSession) notifyTimeout(msg string) {
+	ev := cs.webhookEvent("session_timeout")
+	ev.Duration = time.Since(cs.runStarted).Seconds()
+	ev.Error = msg
+	cs.Config.Webhooks.Send(ev)
+}
+
+// notifyError notifies the webhook that the session failed.
+func (cs *ContainerSession) notifyError(su StatusUpdate) {
+	ev := cs.webhookEvent("session_error")
+	ev.Duration = time.Since(cs.started).Seconds()
+	ev.Error, ev.Code = su.Error, su.Code
+	cs.Config.Webhooks.Send(ev)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooksDelivery(t *testing.T) {
+	received := make(chan WebhookEvent, 1)
+	attempts := 0
+	wh := NewWebhooks("", []byte("secret"), 4)
+	wh.Backoff = time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		dat, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if sig := r.Header.Get(webhookSignatureHeader); sig != wh.sign(dat) {
+			t.Errorf("bad signature %q", sig)
+		}
+		var ev WebhookEvent
+		err = json.Unmarshal(dat, &ev)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer srv.Close()
+	wh.URL = srv.URL
+
+	go wh.Run()
+	defer wh.Flush(context.Background())
+	code := int64(1)
+	wh.Send(WebhookEvent{Event: "session_end", Session: "abc", ExitCode: &code, Duration: 2.5})
+
+	select {
+	case ev := <-received:
+		if ev.Event != "session_end" || ev.Session != "abc" || ev.ExitCode == nil || *ev.ExitCode != 1 || ev.Duration != 2.5 || ev.Time.IsZero() {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+}
+
+func TestWebhooksNil(t *testing.T) {
+	var wh *Webhooks
+	wh.Send(WebhookEvent{Event: "session_start"})
+	wh.Flush(context.Background())
+}
+
+func TestWebhooksRetryInBackground(t *testing.T) {
+	var lck sync.Mutex
+	var received []string
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev WebhookEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		lck.Lock()
+		defer lck.Unlock()
+		if ev.Session == "a" && !failed {
+			failed = true
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, ev.Session)
+	}))
+	defer srv.Close()
+	wh := NewWebhooks(srv.URL, nil, 4)
+	wh.Backoff = 100 * time.Millisecond
+
+	// the retry of the first event must not hold up the second
+	go wh.Run()
+	wh.Send(WebhookEvent{Event: "session_start", Session: "a"})
+	wh.Send(WebhookEvent{Event: "session_start", Session: "b"})
+	wh.Flush(context.Background())
+	lck.Lock()
+	defer lck.Unlock()
+	if len(received) != 2 || received[0] != "b" || received[1] != "a" {
+		t.Errorf("unexpected deliveries %v", received)
+	}
+
+	// events sent after the flush are dropped
+	wh.Send(WebhookEvent{Event: "session_start", Session: "c"})
+}
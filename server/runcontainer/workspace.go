@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workspaceCheckRate is the interval at which the free space of the workspace and the writable layer is checked.
+const workspaceCheckRate = 5 * time.Second
+
+// workspaceFree returns the free space of the filesystem of a directory in kilobytes.
+func (c *Container) workspaceFree(ctx context.Context, dir string) (int64, error) {
+	out, code, err := c.ExecOutput(ctx, []string{"df", "-Pk", dir})
+	if err != nil {
+		return 0, err
+	}
+	if code != 0 {
+		return 0, errors.New("failed to check workspace usage")
+	}
+
+	// parse available column of the second line
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) < 2 {
+		return 0, errors.New("unexpected df output")
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) < 4 {
+		return 0, errors.New("unexpected df output")
+	}
+	return strconv.ParseInt(fields[3], 10, 64)
+}
+
+// workspaceUsage returns the disk usage of a directory in kilobytes.
+func (c *Container) workspaceUsage(ctx context.Context, dir string) (int64, error) {
+	out, code, err := c.ExecOutput(ctx, []string{"du", "-sk", dir})
+	if err != nil {
+		return 0, err
+	}
+	if code != 0 {
+		return 0, errors.New("failed to check workspace usage")
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 1 {
+		return 0, errors.New("unexpected du output")
+	}
+	return strconv.ParseInt(fields[0], 10, 64)
+}
+
+// watchUsage terminates the session once the files in a directory use more than limit bytes, until the context is cancelled.
+// It enforces the size of shared workspaces, whose volumes are on the disk of the daemon rather than a size-limited tmpfs.
+func (cs *ContainerSession) watchUsage(ctx context.Context, dir string, limit int64, msg string) {
+	tick := time.NewTicker(workspaceCheckRate)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		used, err := cs.Container.workspaceUsage(ctx, dir)
+		if err != nil {
+			if ctx.Err() == nil {
+				serverLog.Errorf("failed to check usage of %s: %s", dir, err.Error())
+			}
+			return
+		}
+		if used*1024 <= limit {
+			continue
+		}
+
+		// notify client and terminate
+		cs.Events.Record("disk_quota_exceeded", msg)
+		cs.UpdateStatus(StatusUpdate{Status: "disk_quota_exceeded", Error: msg, Code: codeDiskQuota})
+		cs.Close()
+		return
+	}
+}
+
+// watchDisk notifies the client with a message once the filesystem of a directory is full, until the context is cancelled.
+func (cs *ContainerSession) watchDisk(ctx context.Context, dir string, msg string) {
+	tick := time.NewTicker(workspaceCheckRate)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		// check free space
+		free, err := cs.Container.workspaceFree(ctx, dir)
+		if err != nil {
+			if ctx.Err() == nil {
+				serverLog.Errorf("failed to check free space of %s: %s", dir, err.Error())
+			}
+			return
+		}
+		if free > 0 {
+			continue
+		}
+
+		// notify client
+		cs.Events.Record("disk_quota_exceeded", msg)
+		cs.UpdateStatus(StatusUpdate{Status: "disk_quota_exceeded", Error: msg, Code: codeDiskQuota})
+		return
+	}
+}
@@ -7,10 +7,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -41,6 +46,24 @@ func (ds DirStore) Get(key []byte) ([]byte, error) {
 	return dat, err
 }
 
+// Keys lists the keys of all KV pairs in the store.
+func (ds DirStore) Keys() ([][]byte, error) {
+	files, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, len(files))
+	for _, f := range files {
+		k, err := hex.DecodeString(f.Name())
+		if err != nil || f.IsDir() {
+			// not a KV pair
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
 // MemStore is an in-memory KVStore.
 type MemStore struct {
 	m sync.Map
@@ -62,6 +85,19 @@ func (ms *MemStore) Get(key []byte) ([]byte, error) {
 	return dat.([]byte), nil
 }
 
+// Keys lists the keys of all KV pairs in the store.
+func (ms *MemStore) Keys() ([][]byte, error) {
+	var keys [][]byte
+	ms.m.Range(func(k, v interface{}) bool {
+		key, err := hex.DecodeString(k.(string))
+		if err == nil {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, nil
+}
+
 // ErrNotExist is an error indicating that a KV pair is not set.
 var ErrNotExist = errors.New("kv pair does not exist")
 
@@ -73,21 +109,74 @@ type KVStore interface {
 	// Get gets a value with the given key.
 	// If the KV pair is not set, returns ErrNotExist.
 	Get(key []byte) ([]byte, error)
+
+	// Keys lists the keys of all KV pairs in the store.
+	Keys() ([][]byte, error)
 }
 
 // Code is a struct containing code with metadata.
 type Code struct {
 	Code     string `json:"code"`
 	Language string `json:"language"`
+
+	// Title and Tags are optional, and are used to organize and search snippets.
+	// They are omitted when empty so that the keys of untitled snippets do not change.
+	Title string   `json:"title,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// normalizeTags lowercases, trims, sorts and deduplicates tags.
+func normalizeTags(tags []string) []string {
+	var out []string
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" {
+			out = append(out, t)
+		}
+	}
+	sort.Strings(out)
+	for i := 1; i < len(out); i++ {
+		if out[i] == out[i-1] {
+			out = append(out[:i], out[i+1:]...)
+			i--
+		}
+	}
+	return out
 }
 
 // CodeStore is a code storage system using a KVStore.
+// It keeps an in-memory index of the stored snippets for searching.
 type CodeStore struct {
 	KV KVStore
+
+	lck   sync.RWMutex
+	index map[string]Code
+}
+
+// NewCodeStore creates a CodeStore, indexing the snippets already in the KVStore.
+func NewCodeStore(kv KVStore) (*CodeStore, error) {
+	cs := &CodeStore{KV: kv, index: make(map[string]Code)}
+
+	// index existing snippets
+	keys, err := kv.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		key := hex.EncodeToString(k)
+		c, err := cs.Get(key)
+		if err != nil {
+			// skip unreadable entries rather than refusing to start
+			continue
+		}
+		cs.index[key] = c
+	}
+
+	return cs, nil
 }
 
 // Get retrieves a Code struct from the store.
-func (cs CodeStore) Get(key string) (Code, error) {
+func (cs *CodeStore) Get(key string) (Code, error) {
 	// decode key
 	k, err := hex.DecodeString(key)
 	if err != nil {
@@ -111,7 +200,10 @@ func (cs CodeStore) Get(key string) (Code, error) {
 }
 
 // Store stores Code into tha KVStore.
-func (cs CodeStore) Store(c Code) (string, error) {
+func (cs *CodeStore) Store(c Code) (string, error) {
+	c.Title = strings.TrimSpace(c.Title)
+	c.Tags = normalizeTags(c.Tags)
+
 	// encode Code
 	dat, err := json.Marshal(&c)
 	if err != nil {
@@ -128,14 +220,235 @@ func (cs CodeStore) Store(c Code) (string, error) {
 	}
 
 	// encode hash key into text format
-	return hex.EncodeToString(hash[:]), nil
+	key := hex.EncodeToString(hash[:])
+
+	// add to search index
+	cs.lck.Lock()
+	cs.index[key] = c
+	cs.lck.Unlock()
+
+	return key, nil
+}
+
+// SearchQuery is a search over stored snippets.
+// Empty fields match all snippets.
+type SearchQuery struct {
+	// Title is a case-insensitive substring of the title.
+	Title string
+
+	// Content is a case-insensitive substring of the code.
+	Content string
+
+	// Language is the exact language of the snippet.
+	Language string
+
+	// Tags is a list of tags, all of which must be present.
+	Tags []string
+
+	// Offset is the number of matching snippets skipped.
+	Offset int
+
+	// Limit is the maximum number of snippets returned.
+	Limit int
+}
+
+// matches checks whether a snippet matches the query.
+// The title, content and tags of the query must already be normalized.
+func (q SearchQuery) matches(c Code) bool {
+	if q.Language != "" && c.Language != q.Language {
+		return false
+	}
+	if q.Title != "" && !strings.Contains(strings.ToLower(c.Title), q.Title) {
+		return false
+	}
+	if q.Content != "" && !strings.Contains(strings.ToLower(c.Code), q.Content) {
+		return false
+	}
+	for _, t := range q.Tags {
+		i := sort.SearchStrings(c.Tags, t)
+		if i == len(c.Tags) || c.Tags[i] != t {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchResult is a snippet found by a search, without its code.
+type SearchResult struct {
+	Key      string   `json:"key"`
+	Title    string   `json:"title,omitempty"`
+	Language string   `json:"language"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// SearchResults is a page of search results.
+type SearchResults struct {
+	// Total is the number of matching snippets across all pages.
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
+}
+
+// Search finds the snippets matching a query, ordered by title and then by key.
+func (cs *CodeStore) Search(q SearchQuery) SearchResults {
+	q.Title = strings.ToLower(q.Title)
+	q.Content = strings.ToLower(q.Content)
+	q.Tags = normalizeTags(q.Tags)
+
+	// find matches
+	var matches []SearchResult
+	cs.lck.RLock()
+	for key, c := range cs.index {
+		if q.matches(c) {
+			matches = append(matches, SearchResult{
+				Key:      key,
+				Title:    c.Title,
+				Language: c.Language,
+				Tags:     c.Tags,
+			})
+		}
+	}
+	cs.lck.RUnlock()
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Title != matches[j].Title {
+			return matches[i].Title < matches[j].Title
+		}
+		return matches[i].Key < matches[j].Key
+	})
+
+	// select page
+	res := SearchResults{Total: len(matches), Results: []SearchResult{}}
+	if q.Offset < len(matches) {
+		matches = matches[q.Offset:]
+		if q.Limit < len(matches) {
+			matches = matches[:q.Limit]
+		}
+		res.Results = matches
+	}
+	return res
+}
+
+// maxSearchLimit is the maximum number of results returned in a single page.
+const maxSearchLimit = 100
+
+// parseSearchQuery parses a search from URL parameters.
+// Tags may be passed as repeated tag parameters or as a comma-separated list.
+func parseSearchQuery(r *http.Request) (SearchQuery, error) {
+	v := r.URL.Query()
+	q := SearchQuery{
+		Title:    v.Get("title"),
+		Content:  v.Get("q"),
+		Language: v.Get("lang"),
+		Limit:    20,
+	}
+	for _, t := range v["tag"] {
+		q.Tags = append(q.Tags, strings.Split(t, ",")...)
+	}
+	var err error
+	if s := v.Get("offset"); s != "" {
+		q.Offset, err = strconv.Atoi(s)
+		if err != nil || q.Offset < 0 {
+			return SearchQuery{}, fmt.Errorf("invalid offset %q", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit <= 0 {
+			return SearchQuery{}, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	if q.Limit > maxSearchLimit {
+		q.Limit = maxSearchLimit
+	}
+	return q, nil
+}
+
+// maxSnippetSize is the maximum size of the body of a request saving a snippet.
+const maxSnippetSize = 1 << 20
+
+// snippetIDPattern matches snippet IDs, which are the hex-encoded keys of the store.
+var snippetIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Snippet is a snippet saved and retrieved through the snippet API.
+type Snippet struct {
+	// ID is the ID of the snippet, which is used in share links.
+	// It is set by the server.
+	ID string `json:"id,omitempty"`
+
+	Lang  string   `json:"lang"`
+	Code  string   `json:"code"`
+	Title string   `json:"title,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// HandleSnippets saves a snippet (POST /api/snippets) or retrieves one (GET /api/snippets/{id}).
+func (cs *CodeStore) HandleSnippets(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/snippets"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		// decode snippet
+		var s Snippet
+		err := json.NewDecoder(io.LimitReader(r.Body, maxSnippetSize)).Decode(&s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if s.Lang == "" {
+			http.Error(w, "missing language", http.StatusBadRequest)
+			return
+		}
+
+		key, err := cs.Store(Code{Code: s.Code, Language: s.Lang, Title: s.Title, Tags: s.Tags})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to store: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		// write back ID
+		w.Header().Add("Location", "/api/snippets/"+key)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			ID string `json:"id"`
+		}{key})
+	case id != "" && r.Method == http.MethodGet:
+		if !snippetIDPattern.MatchString(id) {
+			http.Error(w, "snippet not found", http.StatusNotFound)
+			return
+		}
+
+		// handle ETag caching
+		if etag := r.Header.Get("If-None-Match"); etag != "" && etag == id {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		c, err := cs.Get(id)
+		switch {
+		case err == ErrNotExist:
+			http.Error(w, "snippet not found", http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to load: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		// snippets never change, as their IDs are hashes of their contents
+		w.Header().Add("ETag", id)
+		w.Header().Add("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Snippet{ID: id, Lang: c.Language, Code: c.Code, Title: c.Title, Tags: c.Tags})
+	default:
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+	}
 }
 
 func main() {
 	var driver string
 	var dir string
-	flag.StringVar(&driver, "driver", "mem", "driver for key-value store")
+	var dsn string
+	flag.StringVar(&driver, "driver", "mem", "driver for key-value store (mem, dir, postgres or sqlite3)")
 	flag.StringVar(&dir, "dir", "", "directory to use for dir driver")
+	flag.StringVar(&dsn, "dsn", "", "data source name of the database for the postgres and sqlite3 drivers")
 	flag.Parse()
 
 	// initialize KVStore
@@ -145,11 +458,20 @@ func main() {
 		kv = new(MemStore)
 	case "dir":
 		kv = DirStore{dir}
+	case "postgres", "sqlite3":
+		ss, err := OpenSQLStore(driver, dsn)
+		if err != nil {
+			panic(fmt.Errorf("failed to open database: %s", err.Error()))
+		}
+		kv = ss
 	default:
 		panic(fmt.Errorf("unrecognized driver %s", driver))
 	}
 
-	cs := CodeStore{kv}
+	cs, err := NewCodeStore(kv)
+	if err != nil {
+		panic(fmt.Errorf("failed to index store: %s", err.Error()))
+	}
 
 	// store Code
 	http.HandleFunc("/store", func(w http.ResponseWriter, r *http.Request) {
@@ -208,5 +530,29 @@ func main() {
 		json.NewEncoder(w).Encode(c)
 	})
 
+	// search Code
+	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		// check method
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// parse query
+		q, err := parseSearchQuery(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid search: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		// send response
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cs.Search(q))
+	})
+
+	// snippet API
+	http.HandleFunc("/api/snippets", cs.HandleSnippets)
+	http.HandleFunc("/api/snippets/", cs.HandleSnippets)
+
 	panic(http.ListenAndServe(":80", nil))
 }
@@ -0,0 +1,9 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+import (
+	// register the postgres driver
+	_ "github.com/lib/pq"
+)
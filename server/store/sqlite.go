@@ -0,0 +1,9 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	// register the sqlite3 driver, which requires cgo
+	_ "github.com/mattn/go-sqlite3"
+)
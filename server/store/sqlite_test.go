@@ -0,0 +1,36 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLStoreSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlstoretest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snippets.db")
+	ss, err := OpenSQLStore("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSQLStore(t, ss)
+	ss.DB.Close()
+
+	// reopening keeps the existing table
+	ss, err = OpenSQLStore("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.DB.Close()
+	if keys, err := ss.Keys(); err != nil || len(keys) != 1 {
+		t.Errorf("unexpected keys %x (%v)", keys, err)
+	}
+}
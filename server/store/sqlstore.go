@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+)
+
+// SQLStore is a KVStore backed by a SQL database.
+// The queries are supported by both PostgreSQL and SQLite, whose drivers are included with the postgres and sqlite build tags.
+type SQLStore struct {
+	DB *sql.DB
+}
+
+// OpenSQLStore connects to a database with the given driver, creating the snippet table if it does not exist.
+func OpenSQLStore(driver string, dsn string) (*SQLStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS snippets (key TEXT PRIMARY KEY, value TEXT NOT NULL)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLStore{DB: db}, nil
+}
+
+// Set sets key-value pair.
+// As keys are hashes of the values, existing pairs are left unchanged.
+func (ss *SQLStore) Set(key, value []byte) error {
+	_, err := ss.DB.Exec(`INSERT INTO snippets (key, value) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`, hex.EncodeToString(key), string(value))
+	return err
+}
+
+// Get gets a value with the given key.
+// If the KV pair is not set, returns ErrNotExist.
+func (ss *SQLStore) Get(key []byte) ([]byte, error) {
+	var value string
+	err := ss.DB.QueryRow(`SELECT value FROM snippets WHERE key = $1`, hex.EncodeToString(key)).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// Keys lists the keys of all KV pairs in the store.
+func (ss *SQLStore) Keys() ([][]byte, error) {
+	rows, err := ss.DB.Query(`SELECT key FROM snippets`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys [][]byte
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+		k, err := hex.DecodeString(key)
+		if err != nil {
+			// not a KV pair
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQLDriver is a database/sql driver keeping the snippet table in memory.
+// It only understands the statements of SQLStore, so that the store can be tested without a database.
+type fakeSQLDriver struct {
+	lck  sync.Mutex
+	rows map[string]string
+}
+
+func init() {
+	sql.Register("fakesql", &fakeSQLDriver{rows: make(map[string]string)})
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return fakeSQLConn{d}, nil
+}
+
+type fakeSQLConn struct {
+	d *fakeSQLDriver
+}
+
+func (c fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeSQLStmt{c.d, query}, nil
+}
+
+func (c fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type fakeSQLStmt struct {
+	d     *fakeSQLDriver
+	query string
+}
+
+func (s fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s fakeSQLStmt) NumInput() int {
+	return strings.Count(s.query, "$")
+}
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.lck.Lock()
+	defer s.d.lck.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE IF NOT EXISTS snippets "):
+	case strings.HasPrefix(s.query, "INSERT INTO snippets ") && strings.HasSuffix(s.query, " ON CONFLICT (key) DO NOTHING"):
+		key, value := args[0].(string), args[1].(string)
+		if _, ok := s.d.rows[key]; ok {
+			return driver.RowsAffected(0), nil
+		}
+		s.d.rows[key] = value
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.lck.Lock()
+	defer s.d.lck.Unlock()
+	switch s.query {
+	case `SELECT value FROM snippets WHERE key = $1`:
+		value, ok := s.d.rows[args[0].(string)]
+		if !ok {
+			return &fakeSQLRows{col: "value"}, nil
+		}
+		return &fakeSQLRows{col: "value", vals: []string{value}}, nil
+	case `SELECT key FROM snippets`:
+		rows := &fakeSQLRows{col: "key"}
+		for key := range s.d.rows {
+			rows.vals = append(rows.vals, key)
+		}
+		sort.Strings(rows.vals)
+		return rows, nil
+	default:
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+}
+
+type fakeSQLRows struct {
+	col  string
+	vals []string
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{r.col}
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.vals) == 0 {
+		return io.EOF
+	}
+	dest[0], r.vals = r.vals[0], r.vals[1:]
+	return nil
+}
+
+// testSQLStore checks the behavior of a SQLStore with an empty snippet table.
+func testSQLStore(t *testing.T, ss *SQLStore) {
+	key := []byte{0x01, 0xab, 0xff}
+	if _, err := ss.Get(key); err != ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	// existing pairs are left unchanged, as keys are hashes of the values
+	if err := ss.Set(key, []byte(`{"code":"print(1)"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Set(key, []byte(`{"code":"print(2)"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := ss.Get(key); err != nil || string(value) != `{"code":"print(1)"}` {
+		t.Errorf("unexpected value %q (%v)", value, err)
+	}
+
+	// rows whose keys are not hex-encoded are not KV pairs
+	if _, err := ss.DB.Exec(`INSERT INTO snippets (key, value) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`, "not a key", "{}"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ss.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0], key) {
+		t.Errorf("unexpected keys %x", keys)
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	ss, err := OpenSQLStore("fakesql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.DB.Close()
+	testSQLStore(t, ss)
+}
@@ -1,10 +1,13 @@
 // JS API for OpenREPL backend services
 var openrepl = {};
 
+// openrepl.protocols is the list of session protocol versions supported by the client, in order of preference.
+openrepl.protocols = ['openrepl.v1'];
+
 // openrepl.promiseWS returns a promise that is fulfilled when the WebSocket is opened.
 openrepl.promiseWS = function(url) {
     return new Promise(function(s, f) {
-        var ws = new WebSocket(url);
+        var ws = new WebSocket(url, openrepl.protocols);
         var opened = false;
         ws.onopen = function() {
             s(ws);
@@ -55,11 +58,16 @@ openrepl.run = function(code, lang) {
                     finished = true;
                     s(ws);
                     break;
+                case 'warning':
+                    // warning - keep going
+                    console.warn(su.message);
+                    break;
                 case 'error':
+                case 'capacity':
                     // error - fail
                     finished = true;
                     ws.close();
-                    f(su.err);
+                    f(su.session ? su.err + ' (session ' + su.session + ')' : su.err);
                     break;
                 }
             };
@@ -103,11 +111,16 @@ openrepl.term = function(lang) {
                     finished = true;
                     s(ws);
                     break;
+                case 'warning':
+                    // warning - keep going
+                    console.warn(su.message);
+                    break;
                 case 'error':
+                case 'capacity':
                     // error - fail
                     finished = true;
                     ws.close();
-                    f(su.err);
+                    f(su.session ? su.err + ' (session ' + su.session + ')' : su.err);
                     break;
                 }
             };
@@ -141,12 +154,18 @@ openrepl.xhrpromise = function(xhr, body) {
     });
 };
 
-openrepl.store = function(code, lang) {
+// meta is optional, and may contain a title and a list of tags
+openrepl.store = function(code, lang, meta) {
     return new Promise(function(resolve, reject) {
         var xhr = new XMLHttpRequest();
         xhr.open('POST', '/api/store/store');
         xhr.responseType = 'text';
-        openrepl.xhrpromise(xhr, JSON.stringify({"code": code, "language": lang})).then(function(key) {
+        var snippet = {"code": code, "language": lang};
+        if (meta) {
+            snippet.title = meta.title;
+            snippet.tags = meta.tags;
+        }
+        openrepl.xhrpromise(xhr, JSON.stringify(snippet)).then(function(key) {
             resolve(key);
         }, function(e) {
             reject(e);
@@ -169,6 +188,30 @@ openrepl.load = function(key) {
     });
 };
 
+// search for stored snippets
+// query may contain title, q (content), lang, tags, offset and limit
+openrepl.searchSnippets = function(query) {
+    return new Promise(function(resolve, reject) {
+        var xhr = new XMLHttpRequest();
+        var targ = new URL('/api/store/search', window.location.href);
+        ['title', 'q', 'lang', 'offset', 'limit'].forEach(function(k) {
+            if (query[k] !== undefined) {
+                targ.searchParams.set(k, query[k]);
+            }
+        });
+        (query.tags || []).forEach(function(t) {
+            targ.searchParams.append('tag', t);
+        });
+        xhr.open('GET', targ.toString());
+        xhr.responseType = 'json';
+        openrepl.xhrpromise(xhr).then(function(resp) {
+            resolve(resp);
+        }, function(e) {
+            reject(e);
+        });
+    });
+};
+
 openrepl.queryExamples = function(query) {
     return new Promise(function(resolve, reject) {
         var xhr = new XMLHttpRequest();